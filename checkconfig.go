@@ -0,0 +1,368 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/abja/net-watcher/internal/enrich"
+	"github.com/abja/net-watcher/internal/notify"
+	"github.com/abja/net-watcher/internal/report"
+	"github.com/abja/net-watcher/internal/scheduler"
+	"github.com/abja/net-watcher/internal/sink"
+	"github.com/abja/net-watcher/internal/web"
+	"github.com/abja/net-watcher/pkg/watcher"
+)
+
+// configProblem is an invalid or suspicious start setting
+type configProblem struct {
+	Where   string // path:line and key in the config file, or the command line flag
+	Message string
+	Warning bool // the daemon starts anyway
+}
+
+func (p configProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Where, level, p.Message)
+}
+
+// configCheck validates the value of one start flag; empty values are not
+// checked
+type configCheck struct {
+	flag  string
+	check func(value string) error
+	warn  bool
+}
+
+// startChecks returns the validation of every start flag that is more than
+// a plain number or duration, which flag parsing already checks
+func startChecks(fs *flag.FlagSet) []configCheck {
+	value := func(name string) string { return fs.Lookup(name).Value.String() }
+	since := func(v string) error {
+		if d, err := report.ParseSince(v); err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration %q, expected e.g. 24h or 7d", v)
+		}
+		return nil
+	}
+	webURL := func(v string) error {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid URL %q, expected http(s)://host:port", v)
+		}
+		return nil
+	}
+	scheme := func(schemes ...string) func(string) error {
+		return func(v string) error {
+			if v == "none" && slices.Contains(schemes, "none") {
+				return nil
+			}
+			u, err := url.Parse(v)
+			if err != nil || !slices.Contains(schemes, u.Scheme) || u.Host == "" {
+				return fmt.Errorf("invalid URL %q, expected %s://host", v, strings.Join(schemes, ":// or "))
+			}
+			return nil
+		}
+	}
+	file := func(v string) error {
+		_, err := os.Stat(v)
+		return err
+	}
+	oneOf := func(allowed ...string) func(string) error {
+		return func(v string) error {
+			if !slices.Contains(allowed, v) {
+				return fmt.Errorf("unknown value %q (expected %s)", v, strings.Join(allowed, ", "))
+			}
+			return nil
+		}
+	}
+
+	return []configCheck{
+		{flag: "interface", check: func(v string) error {
+			names, configs, err := watcher.ParseInterfaceSpec(v)
+			if err != nil {
+				return err
+			}
+			if err := checkBPFFiles(configs); err != nil {
+				return err
+			}
+			if !watcher.IsInterfacePattern(names) && value("auto-interfaces") != "true" {
+				_, err = getInterfacesByName(names)
+				return err
+			}
+			_, err = watcher.ParseInterfacePattern(names)
+			return err
+		}},
+		// The daemon waits for interfaces matching a pattern, or named with
+		// --auto-interfaces, to appear
+		{flag: "interface", warn: true, check: func(v string) error {
+			names, _, err := watcher.ParseInterfaceSpec(v)
+			if err != nil || (!watcher.IsInterfacePattern(names) && value("auto-interfaces") != "true") {
+				return nil
+			}
+			pattern, err := watcher.ParseInterfacePattern(names)
+			if err != nil {
+				return nil
+			}
+			if ifaces, err := pattern.Resolve(); err == nil && len(ifaces) == 0 {
+				return fmt.Errorf("no interface currently matches %s", pattern)
+			}
+			return nil
+		}},
+		{flag: "interface-config", check: func(v string) error {
+			configs, err := watcher.ParseInterfaceConfigs(v)
+			if err != nil {
+				return err
+			}
+			return checkBPFFiles(configs)
+		}},
+		{flag: "bpf", check: func(v string) error {
+			_, err := watcher.LoadBPFFilter(v)
+			return err
+		}},
+		{flag: "vlan", check: func(v string) error {
+			_, err := watcher.ParseVLANs(v)
+			return err
+		}},
+		{flag: "snaplen", check: func(v string) error {
+			_, err := watcher.ParseSnapLen(v)
+			return err
+		}},
+		{flag: "only", check: func(v string) error { return watcher.ValidateFilters(v, "", "") }},
+		{flag: "traffic-exclude", check: func(v string) error { return watcher.ValidateFilters("", v, "") }},
+		{flag: "exclude-ports", check: func(v string) error { return watcher.ValidateFilters("", "", v) }},
+		{flag: "p2p", check: watcher.ValidateP2PMode},
+		{flag: "capture-backend", check: watcher.ValidateCaptureBackend},
+		{flag: "ntp-servers", check: watcher.ValidateNTPServers},
+		{flag: "tag-rules", check: func(v string) error {
+			_, err := enrich.NewTagger(v)
+			return err
+		}},
+		{flag: "privacy", check: enrich.ValidatePrivacyPolicy},
+		{flag: "blocklist", check: func(v string) error {
+			sources, err := enrich.ParseBlocklistSources(v)
+			if err != nil {
+				return err
+			}
+			for _, src := range sources {
+				if !strings.Contains(src.Source, "://") {
+					if err := file(src.Source); err != nil {
+						return fmt.Errorf("list %s: %w", src.Name, err)
+					}
+				}
+			}
+			return nil
+		}},
+		{flag: "auto-compact", check: since},
+		{flag: "anomaly-learn", check: since},
+		{flag: "storage-ttl", check: since},
+		{flag: "storage", check: scheme("clickhouse", "none")},
+		{flag: "stream", check: scheme("kafka", "nats")},
+		{flag: "flow-export", check: scheme("http", "https", "kafka", "nats")},
+		{flag: "zeek-format", check: oneOf("tsv", "json")},
+		{flag: "report-format", check: oneOf(report.Formats...)},
+		{flag: "report-daily", check: func(v string) error {
+			if _, err := report.ParseTimeOfDay(v); err != nil {
+				return err
+			}
+			schedule := &report.Schedule{Format: value("report-format"), SMTP: value("report-smtp"),
+				Webhook: value("report-webhook"), Dir: value("report-save")}
+			if value("report-email") != "" {
+				schedule.Email = strings.Split(value("report-email"), ",")
+			}
+			return schedule.Validate()
+		}},
+		{flag: "notify", check: func(v string) error {
+			_, err := notify.ParseChannels(v)
+			return err
+		}},
+		{flag: "notify-events", check: func(v string) error {
+			_, err := notify.ParseKinds(v)
+			return err
+		}},
+		{flag: "notify-template", check: func(v string) error {
+			_, err := notify.ParseTemplate(v)
+			return err
+		}},
+		{flag: "schedule", check: func(v string) error {
+			_, err := scheduler.ParseOverrides(v)
+			return err
+		}},
+		{flag: "splunk-events", check: func(v string) error {
+			_, err := sink.ParseSplunkRoutes(v)
+			return err
+		}},
+		{flag: "otlp-headers", check: func(v string) error {
+			_, err := sink.ParseHeaders(v)
+			return err
+		}},
+		{flag: "flow-headers", check: func(v string) error {
+			_, err := sink.ParseHeaders(v)
+			return err
+		}},
+		{flag: "collector", check: webURL},
+		{flag: "ha-peer", check: webURL},
+		{flag: "splunk-url", check: webURL},
+		{flag: "otlp-endpoint", check: webURL},
+		{flag: "api-rate-limit", check: web.ValidateAPIRateLimit},
+		{flag: "api-tokens", check: web.ValidateAPITokens},
+		{flag: "tls-cert", check: file},
+		{flag: "tls-key", check: file},
+		{flag: "tls-client-ca", check: file},
+		{flag: "collector-ca", check: file},
+		{flag: "rdns-rate", check: func(v string) error {
+			var rate float64
+			if _, err := fmt.Sscan(v, &rate); err != nil || rate <= 0 {
+				return fmt.Errorf("invalid rate %s, expected lookups per second above 0", v)
+			}
+			return nil
+		}},
+		{flag: "web-port", check: func(v string) error {
+			var port int
+			if _, err := fmt.Sscan(v, &port); err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("invalid port %s", v)
+			}
+			return nil
+		}},
+	}
+}
+
+// checkBPFFiles loads the BPF programs of per-interface settings
+func checkBPFFiles(configs []watcher.InterfaceConfig) error {
+	for _, cfg := range configs {
+		if cfg.BPF == "" {
+			continue
+		}
+		if _, err := watcher.LoadBPFFilter(cfg.BPF); err != nil {
+			return fmt.Errorf("interface %s: %w", cfg.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkStartConfig validates the start flags after the config file at path
+// (if any) was applied: unknown or repeated keys, malformed values, filter
+// names, rule files, CIDRs and interfaces. With only given, just those
+// flags are checked.
+func checkStartConfig(fs *flag.FlagSet, path string, explicit map[string]bool, only ...string) []configProblem {
+	var problems []configProblem
+	lines := make(map[string]configEntry)
+	if path != "" {
+		entries, err := readConfigFile(path)
+		if err != nil {
+			return []configProblem{{Where: path, Message: err.Error()}}
+		}
+		for _, e := range entries {
+			where := fmt.Sprintf("%s:%d: %s", path, e.Line, e.Key)
+			name, known := configFlags[e.Key]
+			switch {
+			case !known:
+				msg := "unknown setting"
+				if suggestion := closestConfigKey(e.Key); suggestion != "" {
+					msg += fmt.Sprintf(", did you mean %s?", suggestion)
+				}
+				problems = append(problems, configProblem{Where: where, Message: msg})
+				continue
+			case explicit[name]:
+				problems = append(problems, configProblem{Where: where, Warning: true,
+					Message: fmt.Sprintf("overridden by --%s on the command line", name)})
+			}
+			if prev, ok := lines[e.Key]; ok {
+				problems = append(problems, configProblem{Where: where, Warning: true,
+					Message: fmt.Sprintf("repeats line %d, this value is used", prev.Line)})
+			}
+			lines[e.Key] = e
+		}
+	}
+
+	where := func(name string) string {
+		if !explicit[name] {
+			for key, flagName := range configFlags {
+				if e, ok := lines[key]; ok && flagName == name {
+					return fmt.Sprintf("%s:%d: %s", path, e.Line, key)
+				}
+			}
+		}
+		return "--" + name
+	}
+	for _, c := range startChecks(fs) {
+		if len(only) > 0 && !slices.Contains(only, c.flag) {
+			continue
+		}
+		value := fs.Lookup(c.flag).Value.String()
+		if value == "" {
+			continue
+		}
+		if err := c.check(value); err != nil {
+			problems = append(problems, configProblem{Where: where(c.flag), Message: err.Error(), Warning: c.warn})
+		}
+	}
+	if len(only) == 0 && (fs.Lookup("tls-cert").Value.String() == "") != (fs.Lookup("tls-key").Value.String() == "") {
+		problems = append(problems, configProblem{Where: where("tls-cert"), Message: "--tls-cert and --tls-key must be set together"})
+	}
+	return problems
+}
+
+// hasErrors reports whether any problem keeps the daemon from starting
+func hasErrors(problems []configProblem) bool {
+	return slices.ContainsFunc(problems, func(p configProblem) bool { return !p.Warning })
+}
+
+// closestConfigKey suggests the known key a misspelt one was probably meant
+// to be
+func closestConfigKey(key string) string {
+	// NETWATCHER_WRITE_BATCH_SIZE for the --write-batch-size flag
+	flagName := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(strings.ToUpper(key), "NETWATCHER_"), "_", "-"))
+	for known, name := range configFlags {
+		if name == flagName {
+			return known
+		}
+	}
+	best, bestDistance := "", 4
+	for known := range configFlags {
+		if d := editDistance(strings.ToUpper(key), known); d < bestDistance || (d == bestDistance && known < best) {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// printConfigProblems writes the problems for check-config and reports
+// whether the configuration is usable
+func printConfigProblems(problems []configProblem) bool {
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if hasErrors(problems) {
+		fmt.Println("Configuration is invalid")
+		return false
+	}
+	fmt.Println("Configuration OK")
+	return true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configFlags maps config file keys to the start flags they set
+var configFlags = map[string]string{
+	"NETWATCHER_INTERFACE":        "interface",
+	"NETWATCHER_ONLY":             "only",
+	"NETWATCHER_TRAFFIC_EXCLUDE":  "traffic-exclude",
+	"NETWATCHER_EXCLUDE_PORTS":    "exclude-ports",
+	"NETWATCHER_INTERFACE_CONFIG": "interface-config",
+	"NETWATCHER_AUTO_INTERFACES":  "auto-interfaces",
+	"NETWATCHER_BPF":              "bpf",
+	"NETWATCHER_VLAN":             "vlan",
+	"NETWATCHER_SNAPLEN":          "snaplen",
+	"NETWATCHER_CAPTURE_BACKEND":  "capture-backend",
+	"NETWATCHER_CAPTURE_WORKERS":  "capture-workers",
+	"NETWATCHER_P2P":              "p2p",
+	"NETWATCHER_NTP_SERVERS":      "ntp-servers",
+	"NETWATCHER_DEBUG":            "debug",
+	"NETWATCHER_BATCH_SIZE":       "write-batch-size",
+	"NETWATCHER_DEDUP_WINDOW":     "dedup-window",
+	"NETWATCHER_TCP_TIMEOUT":      "tcp-timeout",
+	"NETWATCHER_UDP_TIMEOUT":      "udp-timeout",
+	"NETWATCHER_MAX_SESSIONS":     "max-sessions",
+	"NETWATCHER_AUTO_COMPACT":     "auto-compact",
+	"NETWATCHER_SCHEDULE":         "schedule",
+	"NETWATCHER_STORAGE":          "storage",
+	"NETWATCHER_READ_REPLICA":     "read-replica",
+	"NETWATCHER_STORAGE_TTL":      "storage-ttl",
+	"NETWATCHER_ZEEK_DIR":         "zeek-dir",
+	"NETWATCHER_SPLUNK_URL":       "splunk-url",
+	"NETWATCHER_SPLUNK_TOKEN":     "splunk-token",
+	"NETWATCHER_FLOW_EXPORT":      "flow-export",
+	"NETWATCHER_FLOW_HEADERS":     "flow-headers",
+	"NETWATCHER_INGEST_TOKEN":     "ingest-token",
+	"NETWATCHER_INGEST_DEDUP":     "ingest-dedup",
+	"NETWATCHER_API_RATE_LIMIT":   "api-rate-limit",
+	"NETWATCHER_API_TOKENS":       "api-tokens",
+	"NETWATCHER_HA_PEER":          "ha-peer",
+	"NETWATCHER_TLS_CERT":         "tls-cert",
+	"NETWATCHER_TLS_KEY":          "tls-key",
+	"NETWATCHER_TLS_CLIENT_CA":    "tls-client-ca",
+	"NETWATCHER_COLLECTOR":        "collector",
+	"NETWATCHER_COLLECTOR_TOKEN":  "collector-token",
+	"NETWATCHER_AGENT_NAME":       "agent-name",
+	"NETWATCHER_PCAP_DIR":         "pcap-dir",
+	"NETWATCHER_PCAP_BUDGET":      "pcap-budget",
+	"NETWATCHER_PREFLIGHT":        "preflight",
+	"NETWATCHER_RDNS":             "rdns",
+	"NETWATCHER_RDNS_RATE":        "rdns-rate",
+	"NETWATCHER_TAG_RULES":        "tag-rules",
+	"NETWATCHER_PRIVACY":          "privacy",
+	"NETWATCHER_PRIVACY_SALT":     "privacy-salt",
+	"NETWATCHER_REPORT_DAILY":     "report-daily",
+	"NETWATCHER_REPORT_FORMAT":    "report-format",
+	"NETWATCHER_REPORT_EMAIL":     "report-email",
+	"NETWATCHER_REPORT_SMTP":      "report-smtp",
+	"NETWATCHER_REPORT_WEBHOOK":   "report-webhook",
+	"NETWATCHER_REPORT_SAVE":      "report-save",
+	"NETWATCHER_NOTIFY":           "notify",
+	"NETWATCHER_NOTIFY_EVENTS":    "notify-events",
+	"NETWATCHER_NOTIFY_TEMPLATE":  "notify-template",
+	"NETWATCHER_NOTIFY_DISK":      "notify-disk",
+}
+
+// configEntry is one KEY=value line of a config file
+type configEntry struct {
+	Key, Value string
+	Line       int
+}
+
+// readConfigFile reads a KEY="value" environment file such as
+// /etc/net-watcher/config.env. Blank lines and # comments are ignored.
+func readConfigFile(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []configEntry
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		entries = append(entries, configEntry{Key: strings.TrimSpace(key), Value: value, Line: n})
+	}
+	return entries, scanner.Err()
+}
+
+// explicitFlags returns the names of flags given on the command line
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// applyConfigFile sets start flags from the config file. Flags given on the
+// command line take precedence; keys missing from the file reset their flag
+// to its default so a reload can remove a setting.
+func applyConfigFile(fs *flag.FlagSet, path string, explicit map[string]bool) error {
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]configEntry, len(entries))
+	for _, e := range entries {
+		values[e.Key] = e
+	}
+	for key, name := range configFlags {
+		if explicit[name] {
+			continue
+		}
+		entry, ok := values[key]
+		if !ok {
+			entry.Value = fs.Lookup(name).DefValue
+		}
+		if err := fs.Set(name, entry.Value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s %q: %w", path, entry.Line, key, entry.Value, err)
+		}
+	}
+	return nil
+}
@@ -449,17 +449,65 @@ create_config() {
 # Database path
 NETWATCHER_DB="/var/lib/net-watcher/dns.sqlite"
 
+# Read replica for the web UI and reports: a SQLite copy refreshed every
+# minute (e.g. "/var/lib/net-watcher/replica.db") or a postgres:// replica
+NETWATCHER_READ_REPLICA=""
+
+# API requests per second per client, RATE[:BURST], with CLIENT=RATE[:BURST]
+# overrides for an IP, CIDR or bearer token (0 = no limit)
+NETWATCHER_API_RATE_LIMIT="10:100"
+
+# Bearer tokens the web UI and API require, comma-separated TOKEN=ROLE:
+# viewer tokens may only read, admin tokens may also change views and run
+# jobs (empty = no token needed)
+NETWATCHER_API_TOKENS=""
+
+# Privacy mode: rewrite DNS queries, TLS server names and hostnames before
+# they are stored, e.g. "hash" or "dns=hash,sni=truncate,hostname=truncate"
+# (empty = store them as captured). Hashing needs a secret salt, kept
+# unchanged so hashes match across restarts
+NETWATCHER_PRIVACY=""
+NETWATCHER_PRIVACY_SALT=""
+
 # Data retention period (days)
 NETWATCHER_RETENTION="90"
 
 # Batch insert size
 NETWATCHER_BATCH_SIZE="100"
 
+# Identical consecutive events of a flow no more than this apart are stored
+# once with a repeat count (0 = store every event)
+NETWATCHER_DEDUP_WINDOW="30s"
+
+# Session table: idle timeouts, and connections tracked at once before the
+# least recently seen is ended as EVICTED (0 = no limit); re-read on reload
+NETWATCHER_TCP_TIMEOUT="2m"
+NETWATCHER_UDP_TIMEOUT="2m"
+NETWATCHER_MAX_SESSIONS="100000"
+
 # Debug mode (true/false)
 NETWATCHER_DEBUG="false"
 
 # Network interface to monitor (empty = auto-detect)
 NETWATCHER_INTERFACE=""
+
+# Traffic filters, re-read on 'systemctl reload net-watcher' (SIGHUP)
+NETWATCHER_ONLY=""
+NETWATCHER_TRAFFIC_EXCLUDE=""
+NETWATCHER_EXCLUDE_PORTS=""
+# BitTorrent flows: "log" records their class (dht, utp, tracker, peer), "exclude" drops them
+NETWATCHER_P2P="log"
+# Time servers devices should use, e.g. "*.pool.ntp.org,192.168.1.1"; NTP
+# with other external servers is flagged UNEXPECTED_SOURCE (empty = any)
+NETWATCHER_NTP_SERVERS=""
+
+# Per-interface filters, e.g. full capture on the LAN bridge and DNS only on
+# the WAN: "br-lan:bpf=/etc/net-watcher/lan.bpf;wan0:only=dns"
+# BPF files hold the output of: tcpdump -ddd '<expression>'
+NETWATCHER_INTERFACE_CONFIG=""
+NETWATCHER_BPF=""
+# Only record these VLANs (outer or inner tag), e.g. "10,20-29"; 0 = untagged
+NETWATCHER_VLAN=""
 EOF
     
     chown root:root "$config_file"
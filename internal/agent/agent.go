@@ -0,0 +1,346 @@
+// Package agent ships the events of a capture-only sensor to a central
+// net-watcher collector, which stores them and serves the web UI for the
+// whole fleet.
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/charmbracelet/log"
+)
+
+// drainInterval is how often spooled batches are retried
+const drainInterval = 5 * time.Second
+
+// Options configures how an agent reaches its collector
+type Options struct {
+	Collector string // collector base URL, e.g. https://central:8920
+	Token     string // bearer token matching the collector's --ingest-token
+	Sensor    string // name stored on every event; default the client certificate's CN, else the hostname
+	CAFile    string // CA that signed the collector certificate; default system roots
+	CertFile  string // client certificate for mutual TLS
+	KeyFile   string // key of CertFile
+	SpoolDir  string // batches are kept here while the collector is unreachable
+	SpoolMB   int    // disk budget of SpoolDir; the oldest batches are dropped beyond it
+}
+
+// Shipper is an EventStore that posts each batch to the collector's
+// /api/ingest. Batches that cannot be delivered are spooled to disk and
+// resent in order once the collector is back; the collector deduplicates
+// by content hash, so a batch sent twice is stored once.
+type Shipper struct {
+	endpoint string
+	token    string
+	sensor   string
+	spoolDir string
+	budget   int64
+	client   *http.Client
+	logger   *log.Logger
+
+	mu      sync.Mutex // guards spooled and new spool files
+	spooled int        // batch files in spoolDir
+	seq     uint64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// ingestBatch is the body of the collector's POST /api/ingest
+type ingestBatch struct {
+	Sensor string                  `json:"sensor"`
+	Events []database.NetworkEvent `json:"events"`
+}
+
+// New creates a shipper and starts resending batches left in the spool
+// by an earlier run
+func New(opts Options, logger *log.Logger) (*Shipper, error) {
+	if !strings.HasPrefix(opts.Collector, "https://") && !strings.HasPrefix(opts.Collector, "http://") {
+		return nil, fmt.Errorf("collector must be an https:// URL, got %q", opts.Collector)
+	}
+	tlsConfig, err := clientTLS(opts)
+	if err != nil {
+		return nil, err
+	}
+	// The collector only accepts the name in the certificate
+	if opts.Sensor == "" && len(tlsConfig.Certificates) > 0 && tlsConfig.Certificates[0].Leaf != nil {
+		opts.Sensor = tlsConfig.Certificates[0].Leaf.Subject.CommonName
+	}
+	if opts.Sensor == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine sensor name: %w", err)
+		}
+		opts.Sensor = host
+	}
+	spoolDir, err := filepath.Abs(opts.SpoolDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(spoolDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Shipper{
+		endpoint: strings.TrimRight(opts.Collector, "/") + "/api/ingest",
+		token:    opts.Token,
+		sensor:   opts.Sensor,
+		spoolDir: spoolDir,
+		budget:   int64(opts.SpoolMB) << 20,
+		client: &http.Client{
+			Timeout:   15 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+		logger: logger,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	files, err := s.spoolFiles()
+	if err != nil {
+		return nil, err
+	}
+	s.spooled = len(files)
+	if s.spooled > 0 {
+		logger.Info("[AGENT] Resending spooled batches", "batches", s.spooled)
+	}
+	go s.drainLoop()
+	return s, nil
+}
+
+// clientTLS builds the TLS configuration for reaching the collector
+func clientTLS(opts Options) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read collector CA: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load agent certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// InsertBatch sends events to the collector, spooling them when it is
+// unreachable or while older batches are still waiting
+func (s *Shipper) InsertBatch(events []database.NetworkEvent) error {
+	body, err := json.Marshal(ingestBatch{Sensor: s.sensor, Events: events})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spooled == 0 {
+		err := s.send(body)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		s.logger.Warn("[AGENT] Collector unreachable, spooling events", "error", err)
+	}
+	return s.spool(body)
+}
+
+// Name identifies the shipper when it runs as a sink next to local
+// storage, replicating events to an HA peer
+func (s *Shipper) Name() string {
+	return "peer " + s.endpoint
+}
+
+// Write sends a batch like InsertBatch
+func (s *Shipper) Write(events []database.NetworkEvent) error {
+	return s.InsertBatch(events)
+}
+
+// Close stops the resend loop. Spooled batches stay on disk for the next run.
+func (s *Shipper) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// Spooled returns the number of batches waiting on disk
+func (s *Shipper) Spooled() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spooled
+}
+
+// statusError is a response from the collector other than 200
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("collector returned %d: %s", e.code, e.body)
+}
+
+// retryable reports whether a failed batch may succeed later. Batches the
+// collector rejects as malformed or too large never will.
+func retryable(err error) bool {
+	se, ok := err.(*statusError)
+	if !ok {
+		return true
+	}
+	return se.code != http.StatusBadRequest && se.code != http.StatusRequestEntityTooLarge
+}
+
+// send posts one encoded batch
+func (s *Shipper) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{code: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	}
+	var result struct {
+		Rejected []struct {
+			Index int    `json:"index"`
+			Error string `json:"error"`
+		} `json:"rejected"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && len(result.Rejected) > 0 {
+		s.logger.Warn("[AGENT] Collector rejected events", "count", len(result.Rejected), "first", result.Rejected[0].Error)
+	}
+	return nil
+}
+
+// spool writes a batch to disk and drops the oldest batches over budget
+func (s *Shipper) spool(body []byte) error {
+	s.seq++
+	name := fmt.Sprintf("batch-%020d-%06d.json", time.Now().UnixNano(), s.seq%1000000)
+	tmp := filepath.Join(s.spoolDir, name+".tmp")
+	if err := os.WriteFile(tmp, body, 0o640); err != nil {
+		return fmt.Errorf("failed to spool events: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.spoolDir, name)); err != nil {
+		return fmt.Errorf("failed to spool events: %w", err)
+	}
+	s.spooled++
+	s.enforceBudget()
+	return nil
+}
+
+// enforceBudget deletes the oldest spooled batches while the spool is over budget
+func (s *Shipper) enforceBudget() {
+	files, err := s.spoolFiles()
+	if err != nil || s.budget <= 0 {
+		return
+	}
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; total > s.budget && i < len(files)-1; i++ {
+		if err := os.Remove(files[i]); err != nil {
+			s.logger.Warn("[AGENT] Failed to delete spooled batch", "file", files[i], "error", err)
+			continue
+		}
+		total -= sizes[i]
+		s.spooled--
+		s.logger.Warn("[AGENT] Spool over budget, dropped oldest batch", "file", filepath.Base(files[i]))
+	}
+}
+
+// spoolFiles lists spooled batches, oldest first
+func (s *Shipper) spoolFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.spoolDir, "batch-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// drainLoop resends spooled batches until Close
+func (s *Shipper) drainLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.drain()
+		}
+	}
+}
+
+// drain sends spooled batches in order, stopping at the first failure.
+// The lock is only held for bookkeeping, so new batches keep being
+// spooled while a large backlog is resent.
+func (s *Shipper) drain() {
+	s.mu.Lock()
+	pending := s.spooled
+	s.mu.Unlock()
+	if pending == 0 {
+		return
+	}
+	files, err := s.spoolFiles()
+	if err != nil {
+		s.logger.Warn("[AGENT] Failed to read spool", "error", err)
+		return
+	}
+	sent := 0
+	for _, f := range files {
+		body, err := os.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue // dropped by enforceBudget meanwhile
+		}
+		if err == nil {
+			err = s.send(body)
+		}
+		if err != nil && retryable(err) {
+			s.logger.Debug("[AGENT] Collector still unreachable", "error", err)
+			break
+		}
+		if err != nil {
+			s.logger.Error("[AGENT] Collector refused spooled batch, dropping it", "file", filepath.Base(f), "error", err)
+		}
+		s.mu.Lock()
+		if os.Remove(f) == nil {
+			s.spooled--
+		}
+		s.mu.Unlock()
+		sent++
+	}
+	if sent > 0 {
+		s.logger.Info("[AGENT] Resent spooled batches", "batches", sent, "remaining", s.Spooled())
+	}
+}
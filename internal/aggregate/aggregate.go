@@ -0,0 +1,360 @@
+// Net Watcher - Shareable aggregates
+// Summarises stored traffic into coarse, anonymized statistics that can be
+// shared for community benchmarking or compared across sites. Nothing that
+// identifies a device, user or site leaves this package: local addresses
+// are only counted, destinations are reduced to the network operator (ASN)
+// they belong to, counts are rounded, and anything seen from fewer than
+// MinDevices devices is left out.
+package aggregate
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// Schema is the version of the Aggregates layout, raised on incompatible changes
+const Schema = 1
+
+// maxServicePort excludes ephemeral ports, which identify sessions rather
+// than services
+const maxServicePort = 49151
+
+// Options controls what is aggregated
+type Options struct {
+	Since      time.Duration // period covered, rounded up to whole days
+	ASNs       *ASNTable     // maps destinations to operators; nil omits destination networks
+	MinDevices int           // an ASN or service is listed only when at least this many devices used it (default 3)
+	Top        int           // ASNs and services listed (default 20)
+	Site       string        // label chosen by the operator to tell sites apart, e.g. "office-a"
+}
+
+// Share is one entry of a distribution, as a percentage of its total
+type Share struct {
+	Name    string  `json:"name"`
+	Percent float64 `json:"percent"`
+}
+
+// ASNShare is the share of connections to one network operator
+type ASNShare struct {
+	ASN
+	Percent float64 `json:"percent"`
+	Devices int64   `json:"devices"` // rounded
+}
+
+// Aggregates is everything shared for a period. Percentages are rounded to
+// one decimal and counts to two significant digits.
+type Aggregates struct {
+	Schema        int        `json:"schema"`
+	Site          string     `json:"site,omitempty"`
+	PeriodStart   string     `json:"periodStart"` // UTC date, the period ends at the start of the day it was generated
+	Days          int        `json:"days"`
+	Events        int64      `json:"events"`
+	Devices       int64      `json:"devices"` // local sources seen
+	Protocols     []Share    `json:"protocols"`
+	TLSVersions   []Share    `json:"tlsVersions"`
+	DNSResponses  []Share    `json:"dnsResponses"` // response codes
+	Services      []Share    `json:"services"`     // destination port/protocol of connections
+	Destinations  []ASNShare `json:"destinationAsns,omitempty"`
+	MinDevices    int        `json:"minDevices"` // threshold applied to services and destinations
+	ASNCoveredPct float64    `json:"asnCoveredPercent,omitempty"`
+}
+
+// Generate computes the aggregates of the whole days before today (UTC) and
+// verifies with Check that they carry no addresses
+func Generate(db *database.DB, opts Options) (*Aggregates, error) {
+	if opts.MinDevices <= 0 {
+		opts.MinDevices = 3
+	}
+	if opts.Top <= 0 {
+		opts.Top = 20
+	}
+	days := max(1, int(math.Ceil(opts.Since.Hours()/24)))
+	end := time.Now().UTC().Truncate(24 * time.Hour)
+	start := end.AddDate(0, 0, -days)
+	a := &Aggregates{
+		Schema:      Schema,
+		Site:        opts.Site,
+		PeriodStart: start.Format("2006-01-02"),
+		Days:        days,
+		MinDevices:  opts.MinDevices,
+		Services:    []Share{},
+	}
+
+	inRange := func() *gorm.DB {
+		return db.Model(&database.NetworkEvent{}).
+			Where("timestamp >= ? AND timestamp < ? AND event_type != ?", start, end, database.EventHourlySummary)
+	}
+	local := func() *gorm.DB {
+		return inRange().Where("src_ip != ''").Where(database.LocalSourceCondition)
+	}
+	connections := func() *gorm.DB {
+		return local().Where("event_type IN ? AND dst_port != 0",
+			[]database.EventType{database.EventTCPStart, database.EventTCP, database.EventUDPStart, database.EventUDP})
+	}
+
+	var events, devices int64
+	if err := inRange().Count(&events).Error; err != nil {
+		return nil, fmt.Errorf("failed to count events: %w", err)
+	}
+	local().Distinct("src_ip").Count(&devices)
+	a.Events = roundCount(events)
+	a.Devices = roundCount(devices)
+
+	protocols := []struct {
+		name  string
+		query *gorm.DB
+	}{
+		{"tcp", inRange().Where("event_type IN ?", []database.EventType{database.EventTCPStart, database.EventTCP})},
+		{"udp", inRange().Where("event_type IN ?", []database.EventType{database.EventUDPStart, database.EventUDP})},
+		{"dns", inRange().Where(database.LookupCondition)},
+		{"tls", inRange().Where("event_type = ?", database.EventTLSSNI)},
+		{"icmp", inRange().Where("event_type = ?", database.EventICMP)},
+	}
+	counts := make(map[string]int64)
+	for _, p := range protocols {
+		var n int64
+		p.query.Count(&n)
+		counts[p.name] = n
+	}
+	a.Protocols = shares(counts)
+	a.TLSVersions = shares(countBy(inRange().Where("event_type = ? AND tls_version != ''", database.EventTLSSNI), "tls_version"))
+	a.DNSResponses = shares(countBy(inRange().Where("event_type = ? AND dns_rcode != ''", database.EventDNS), "dns_rcode"))
+
+	// Services: destination ports many devices use, as shares of all connections
+	var total int64
+	connections().Count(&total)
+	var services []struct {
+		Name    string
+		Count   int64
+		Devices int64
+	}
+	connections().Where("dst_port <= ?", maxServicePort).
+		Select(database.PortName+" as name, count(*) as count, count(DISTINCT src_ip) as devices").
+		Group("name").Having("count(DISTINCT src_ip) >= ?", opts.MinDevices).
+		Order("count DESC").Limit(opts.Top).Scan(&services)
+	for _, s := range services {
+		a.Services = append(a.Services, Share{Name: s.Name, Percent: percent(s.Count, total)})
+	}
+
+	if opts.ASNs != nil {
+		if err := a.destinations(connections(), opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.Check(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// destinations sums connections to public addresses per ASN
+func (a *Aggregates) destinations(connections *gorm.DB, opts Options) error {
+	var rows []struct {
+		DstIP string
+		SrcIP string
+		Count int64
+	}
+	err := connections.Select("dst_ip, src_ip, count(*) as count").Group("dst_ip, src_ip").Scan(&rows).Error
+	if err != nil {
+		return fmt.Errorf("failed to group connections by destination: %w", err)
+	}
+
+	type operator struct {
+		asn     ASN
+		count   int64
+		devices map[string]bool
+	}
+	operators := make(map[int]*operator)
+	var public, covered int64
+	for _, row := range rows {
+		addr, err := netip.ParseAddr(row.DstIP)
+		if err != nil || !isPublic(addr) {
+			continue
+		}
+		public += row.Count
+		asn, ok := opts.ASNs.Lookup(addr)
+		if !ok {
+			continue
+		}
+		covered += row.Count
+		op := operators[asn.Number]
+		if op == nil {
+			op = &operator{asn: asn, devices: make(map[string]bool)}
+			operators[asn.Number] = op
+		}
+		op.count += row.Count
+		op.devices[row.SrcIP] = true
+	}
+
+	for _, op := range operators {
+		if len(op.devices) < opts.MinDevices {
+			continue
+		}
+		a.Destinations = append(a.Destinations, ASNShare{
+			ASN:     op.asn,
+			Percent: percent(op.count, public),
+			Devices: roundCount(int64(len(op.devices))),
+		})
+	}
+	slices.SortFunc(a.Destinations, func(x, y ASNShare) int {
+		if x.Percent != y.Percent {
+			return -cmp.Compare(x.Percent, y.Percent)
+		}
+		return x.Number - y.Number
+	})
+	if len(a.Destinations) > opts.Top {
+		a.Destinations = a.Destinations[:opts.Top]
+	}
+	a.ASNCoveredPct = percent(covered, public)
+	return nil
+}
+
+// Check verifies that no string in the aggregates is or contains an IP
+// address. Generate runs it, and it can be run on received aggregates.
+func (a *Aggregates) Check() error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return checkValue(doc)
+}
+
+func checkValue(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if err := checkString(key); err != nil {
+				return err
+			}
+			if err := checkValue(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if err := checkValue(value); err != nil {
+				return err
+			}
+		}
+	case string:
+		return checkString(v)
+	}
+	return nil
+}
+
+// checkString rejects s when any run of address characters in it parses
+// as an IPv4 or IPv6 address
+func checkString(s string) error {
+	tokens := strings.FieldsFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789abcdefABCDEF.:", r)
+	})
+	for _, token := range tokens {
+		if _, err := netip.ParseAddr(strings.Trim(token, ".:")); err == nil && strings.ContainsAny(token, ".:") {
+			return fmt.Errorf("aggregates contain an address in %q", s)
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the aggregates as indented JSON
+func (a *Aggregates) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
+
+// Post sends the aggregates as JSON to a collection endpoint
+func (a *Aggregates) Post(url string) error {
+	var body bytes.Buffer
+	if err := a.WriteJSON(&body); err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", &body)
+	if err != nil {
+		return fmt.Errorf("failed to post aggregates: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("aggregates rejected: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// countBy counts the rows of q per distinct value of column
+func countBy(q *gorm.DB, column string) map[string]int64 {
+	var rows []struct {
+		Name  string
+		Count int64
+	}
+	q.Select(column + " as name, count(*) as count").Group("name").Scan(&rows)
+	counts := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		counts[r.Name] = r.Count
+	}
+	return counts
+}
+
+// shares turns counts into percentages, largest first, dropping zeros
+func shares(counts map[string]int64) []Share {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	list := []Share{}
+	for name, n := range counts {
+		if n > 0 {
+			list = append(list, Share{Name: name, Percent: percent(n, total)})
+		}
+	}
+	slices.SortFunc(list, func(x, y Share) int {
+		if x.Percent != y.Percent {
+			return -cmp.Compare(x.Percent, y.Percent)
+		}
+		return strings.Compare(x.Name, y.Name)
+	})
+	return list
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)*1000/float64(total)) / 10
+}
+
+// roundCount keeps two significant digits, so totals show scale without
+// being exact enough to match a particular site's logs
+func roundCount(n int64) int64 {
+	if n < 100 {
+		return n
+	}
+	scale := int64(math.Pow(10, math.Floor(math.Log10(float64(n)))-1))
+	return (n + scale/2) / scale * scale
+}
+
+// sharedAddressSpace is carrier-grade NAT space (RFC 6598), local to the ISP
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublic reports whether addr is a globally routed unicast address
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
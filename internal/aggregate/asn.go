@@ -0,0 +1,111 @@
+package aggregate
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ASN is an autonomous system, the network operator owning an address range
+type ASN struct {
+	Number int    `json:"asn"`
+	Name   string `json:"name"`
+}
+
+// asnRange maps the addresses first through last to an ASN
+type asnRange struct {
+	first, last netip.Addr
+	asn         ASN
+}
+
+// ASNTable looks up the autonomous system of public addresses
+type ASNTable struct {
+	ranges []asnRange // sorted by first address, not overlapping
+}
+
+// LoadASNTable reads an IP to ASN database in the iptoasn.com TSV layout
+// (range_start, range_end, AS_number, country_code, AS_description), as
+// published at https://iptoasn.com/data/ip2asn-combined.tsv.gz. Files
+// ending in .gz are decompressed. Unrouted ranges (AS 0) are skipped.
+func LoadASNTable(path string) (*ASNTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ASN database: %w", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress ASN database: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	table, err := parseASNTable(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ASN database %s: %w", path, err)
+	}
+	return table, nil
+}
+
+func parseASNTable(r io.Reader) (*ASNTable, error) {
+	t := &ASNTable{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		first, err1 := netip.ParseAddr(fields[0])
+		last, err2 := netip.ParseAddr(fields[1])
+		number, err3 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil || first.Is4() != last.Is4() {
+			return nil, fmt.Errorf("line %d: expected range_start, range_end and AS number", line)
+		}
+		if number == 0 {
+			continue
+		}
+		asn := ASN{Number: number}
+		if len(fields) >= 5 {
+			asn.Name = fields[4]
+		}
+		t.ranges = append(t.ranges, asnRange{first: first, last: last, asn: asn})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(t.ranges, func(a, b asnRange) int {
+		return a.first.Compare(b.first)
+	})
+	return t, nil
+}
+
+// Lookup returns the ASN announcing addr
+func (t *ASNTable) Lookup(addr netip.Addr) (ASN, bool) {
+	addr = addr.Unmap()
+	// The last range starting at or before addr is the only candidate
+	i, found := slices.BinarySearchFunc(t.ranges, addr, func(r asnRange, a netip.Addr) int {
+		return r.first.Compare(a)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || t.ranges[i].last.Compare(addr) < 0 || t.ranges[i].first.Is4() != addr.Is4() {
+		return ASN{}, false
+	}
+	return t.ranges[i].asn, true
+}
+
+// Len returns the number of address ranges in the table
+func (t *ASNTable) Len() int {
+	return len(t.ranges)
+}
@@ -0,0 +1,247 @@
+// Package chart renders timeline and top-N charts to PNG or SVG for
+// embedding in reports, email digests and READMEs
+package chart
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	gochart "github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
+)
+
+// Formats lists the supported image formats
+var Formats = []string{"png", "svg"}
+
+// ErrNoData is returned when there is nothing to plot
+var ErrNoData = errors.New("no data to chart")
+
+// Default image size in pixels
+const (
+	DefaultWidth  = 1024
+	DefaultHeight = 400
+)
+
+// maxLabelLen keeps bar labels from overlapping their neighbours
+const maxLabelLen = 18
+
+// Series is one line of a timeline chart
+type Series struct {
+	Name   string
+	Times  []time.Time
+	Values []float64
+}
+
+// Bar is one entry of a top-N chart
+type Bar struct {
+	Label string
+	Value float64
+}
+
+// Options sets the title, size and colours of a chart
+type Options struct {
+	Title  string
+	Width  int  // pixels, default DefaultWidth
+	Height int  // pixels, default DefaultHeight
+	Dark   bool // light text on the dark background of the web UI and HTML reports
+}
+
+// Dark theme colours, matching the web UI and HTML reports
+var (
+	darkBackground = drawing.ColorFromHex("1a1a1a")
+	darkText       = drawing.ColorFromHex("888888")
+	darkTitle      = drawing.ColorFromHex("e0e0e0")
+	darkAxis       = drawing.ColorFromHex("333333")
+	darkAccent     = drawing.ColorFromHex("00ff88")
+)
+
+// ValidFormat reports whether name is a supported image format
+func ValidFormat(name string) bool {
+	for _, f := range Formats {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType returns the MIME type of an image format
+func ContentType(format string) string {
+	if format == "svg" {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// Timeline draws one line per series over time
+func Timeline(w io.Writer, format string, opts Options, series ...Series) error {
+	rp, err := renderer(format)
+	if err != nil {
+		return err
+	}
+
+	graph := gochart.Chart{
+		Title:  opts.Title,
+		Width:  orDefault(opts.Width, DefaultWidth),
+		Height: orDefault(opts.Height, DefaultHeight),
+		Background: gochart.Style{
+			Padding: gochart.Box{Top: 50, Left: 20, Right: 20, Bottom: 30},
+		},
+		XAxis: gochart.XAxis{
+			ValueFormatter: gochart.TimeValueFormatterWithFormat("01-02 15:04"),
+		},
+		YAxis: gochart.YAxis{ValueFormatter: compactValue},
+		// Every series uses the primary axis; the secondary one would
+		// otherwise draw stray ticks
+		YAxisSecondary: gochart.YAxis{Style: gochart.Hidden()},
+	}
+
+	maxValue := 0.0
+	for i, s := range series {
+		if len(s.Times) < 2 || len(s.Times) != len(s.Values) {
+			continue
+		}
+		for _, v := range s.Values {
+			maxValue = max(maxValue, v)
+		}
+		color := gochart.GetDefaultColor(i)
+		if opts.Dark && i == 0 {
+			color = darkAccent
+		}
+		graph.Series = append(graph.Series, gochart.TimeSeries{
+			Name: s.Name,
+			Style: gochart.Style{
+				StrokeColor: color,
+				StrokeWidth: 2,
+				FillColor:   color.WithAlpha(48),
+			},
+			XValues: s.Times,
+			YValues: s.Values,
+		})
+	}
+	if len(graph.Series) == 0 {
+		return ErrNoData
+	}
+	graph.YAxis.Range = yRange(maxValue)
+	if len(graph.Series) > 1 {
+		graph.Elements = []gochart.Renderable{gochart.Legend(&graph)}
+	}
+	if opts.Dark {
+		graph.Background.FillColor = darkBackground
+		graph.Canvas.FillColor = darkBackground
+		graph.TitleStyle.FontColor = darkTitle
+		graph.XAxis.Style = gochart.Style{FontColor: darkText, StrokeColor: darkAxis}
+		graph.YAxis.Style = gochart.Style{FontColor: darkText, StrokeColor: darkAxis}
+		graph.YAxis.GridMajorStyle = gochart.Style{StrokeColor: darkAxis, StrokeWidth: 1}
+		graph.YAxis.GridLines = gridLines(graph.YAxis.Range.GetMax())
+	}
+
+	return graph.Render(rp, w)
+}
+
+// Bars draws a bar chart of the given entries in order
+func Bars(w io.Writer, format string, opts Options, bars []Bar) error {
+	rp, err := renderer(format)
+	if err != nil {
+		return err
+	}
+	if len(bars) == 0 {
+		return ErrNoData
+	}
+
+	width := orDefault(opts.Width, DefaultWidth)
+	graph := gochart.BarChart{
+		Title:  opts.Title,
+		Width:  width,
+		Height: orDefault(opts.Height, DefaultHeight),
+		Background: gochart.Style{
+			Padding: gochart.Box{Top: 50, Left: 20, Right: 20, Bottom: 30},
+		},
+		YAxis:      gochart.YAxis{ValueFormatter: compactValue},
+		BarWidth:   max(8, width/(2*len(bars))),
+		BarSpacing: max(4, width/(4*len(bars))),
+	}
+
+	maxValue := 0.0
+	for i, b := range bars {
+		maxValue = max(maxValue, b.Value)
+		graph.Bars = append(graph.Bars, gochart.Value{
+			Label: truncate(b.Label, maxLabelLen),
+			Value: b.Value,
+			Style: gochart.Style{
+				FillColor:   gochart.GetDefaultColor(i),
+				StrokeColor: drawing.ColorWhite,
+			},
+		})
+	}
+	graph.YAxis.Range = yRange(maxValue)
+
+	return graph.Render(rp, w)
+}
+
+// yRange anchors the y-axis at zero; go-chart cannot scale a range whose
+// minimum equals its maximum, as with a single bar or a flat line
+func yRange(maxValue float64) gochart.Range {
+	if maxValue <= 0 {
+		maxValue = 1
+	}
+	return &gochart.ContinuousRange{Min: 0, Max: maxValue}
+}
+
+// gridLines places four horizontal lines up to maxValue
+func gridLines(maxValue float64) []gochart.GridLine {
+	lines := make([]gochart.GridLine, 4)
+	for i := range lines {
+		lines[i] = gochart.GridLine{Value: maxValue * float64(i+1) / 4}
+	}
+	return lines
+}
+
+// compactValue formats axis ticks as 950, 12.5k, 3.2M
+func compactValue(v interface{}) string {
+	f, ok := v.(float64)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	switch {
+	case f >= 1e9:
+		return strconv.FormatFloat(f/1e9, 'f', 1, 64) + "G"
+	case f >= 1e6:
+		return strconv.FormatFloat(f/1e6, 'f', 1, 64) + "M"
+	case f >= 1e3:
+		return strconv.FormatFloat(f/1e3, 'f', 1, 64) + "k"
+	case f == float64(int64(f)):
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// renderer maps an image format to its go-chart renderer
+func renderer(format string) (gochart.RendererProvider, error) {
+	switch format {
+	case "png":
+		return gochart.PNG, nil
+	case "svg":
+		return gochart.SVG, nil
+	}
+	return nil, fmt.Errorf("unknown chart format %q (expected png or svg)", format)
+}
+
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// truncate shortens s to n runes, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,185 @@
+// Net Watcher - Control socket
+// A running daemon listens on a unix socket so local tools can query its
+// status and pause, resume or reload it without going through the web UI.
+// The protocol is plain HTTP/JSON; access is limited by the socket's file
+// permissions.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/abja/net-watcher/pkg/watcher"
+	"github.com/charmbracelet/log"
+)
+
+// DefaultSocket is the control socket path used by start and the client commands
+const DefaultSocket = "netwatcher.sock"
+
+// Daemon is the part of the watcher the control socket drives
+type Daemon interface {
+	Status() watcher.Status
+	Pause()
+	Resume()
+}
+
+// StatusResponse is the reply to a status request
+type StatusResponse struct {
+	Version string `json:"version"`
+	watcher.Status
+}
+
+// ActionResponse is the reply to pause, resume and reload
+type ActionResponse struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// Server serves control requests on a unix socket
+type Server struct {
+	path    string
+	daemon  Daemon
+	reload  func() error
+	version string
+	logger  *log.Logger
+}
+
+// NewServer creates a control server; reload re-reads the configuration and
+// may be nil when there is nothing to reload
+func NewServer(path string, daemon Daemon, reload func() error, version string, logger *log.Logger) *Server {
+	return &Server{
+		path:    path,
+		daemon:  daemon,
+		reload:  reload,
+		version: version,
+		logger:  logger,
+	}
+}
+
+// Start listens on the socket until ctx is cancelled. A stale socket left
+// by a crashed daemon is replaced; one in use by a running daemon is not.
+func (s *Server) Start(ctx context.Context) error {
+	if conn, err := net.Dial("unix", s.path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use by another net-watcher", s.path)
+	}
+	os.Remove(s.path)
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	// Owner and group only: the socket can pause capture
+	if err := os.Chmod(s.path, 0o660); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("POST /pause", s.handlePause)
+	mux.HandleFunc("POST /resume", s.handleResume)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		os.Remove(s.path)
+	}()
+
+	s.logger.Info("Control socket listening", "path", s.path)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, StatusResponse{Version: s.version, Status: s.daemon.Status()})
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	s.daemon.Pause()
+	writeJSON(w, http.StatusOK, ActionResponse{OK: true, Message: "capture paused"})
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	s.daemon.Resume()
+	writeJSON(w, http.StatusOK, ActionResponse{OK: true, Message: "capture resumed"})
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		writeJSON(w, http.StatusConflict, ActionResponse{Message: "no config file to reload, start with --config"})
+		return
+	}
+	if err := s.reload(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, ActionResponse{Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, ActionResponse{OK: true, Message: "configuration reloaded"})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Client talks to a daemon's control socket
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client for the socket at path
+func NewClient(path string) *Client {
+	return &Client{http: &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+// Status fetches the daemon status
+func (c *Client) Status() (*StatusResponse, error) {
+	resp, err := c.http.Get("http://net-watcher/status")
+	if err != nil {
+		return nil, fmt.Errorf("daemon not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+	var st StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("invalid status response: %w", err)
+	}
+	return &st, nil
+}
+
+// Do sends an action (pause, resume or reload) and returns the daemon's reply
+func (c *Client) Do(action string) (*ActionResponse, error) {
+	resp, err := c.http.Post("http://net-watcher/"+action, "application/json", nil)
+	if err != nil {
+		return nil, fmt.Errorf("daemon not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var ar ActionResponse
+	if err := json.Unmarshal(body, &ar); err != nil {
+		return nil, fmt.Errorf("unexpected response (%s): %s", resp.Status, body)
+	}
+	if !ar.OK {
+		return &ar, errors.New(ar.Message)
+	}
+	return &ar, nil
+}
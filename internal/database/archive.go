@@ -0,0 +1,88 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Errors returned by Originals
+var (
+	ErrEventNotFound = errors.New("event not found")
+	ErrNotArchived   = errors.New("event has no archived originals")
+)
+
+// ArchiveChunk is the undo archive of one compaction batch: the events
+// merged into compacted records, gzip-compressed JSON with one entry per
+// record, so the originals can still be audited after they are deleted
+type ArchiveChunk struct {
+	ID    uint   `gorm:"primaryKey"`
+	RunID uint   `gorm:"index"` // CompactionRun that wrote the chunk
+	Kind  string // name of the pairs, e.g. "TCP"
+	Count int    // compacted records in the chunk
+	Data  []byte // gzip of [][]NetworkEvent, indexed by record
+}
+
+// archivePairs stores the originals of a batch of compacted records and
+// sets the OriginalRef of each record to its entry in the archive
+func archivePairs(tx *gorm.DB, run uint, kind string, records []NetworkEvent, originals [][]NetworkEvent) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(originals); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	chunk := ArchiveChunk{RunID: run, Kind: kind, Count: len(records), Data: buf.Bytes()}
+	if err := tx.Create(&chunk).Error; err != nil {
+		return fmt.Errorf("failed to archive originals: %w", err)
+	}
+	for i := range records {
+		records[i].OriginalRef = fmt.Sprintf("%d:%d:%d", run, chunk.ID, i)
+	}
+	return nil
+}
+
+// Originals returns the events a compacted record was merged from, read
+// back from the undo archive its OriginalRef points into
+func (db *DB) Originals(id uint) ([]NetworkEvent, error) {
+	var event NetworkEvent
+	err := db.Select("id", "event_type", "compacted").Take(&event, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var run, chunkID uint
+	var index int
+	if _, err := fmt.Sscanf(event.OriginalRef, "%d:%d:%d", &run, &chunkID, &index); err != nil {
+		return nil, ErrNotArchived
+	}
+
+	var chunk ArchiveChunk
+	err = db.Where("id = ? AND run_id = ?", chunkID, run).Take(&chunk).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: archive chunk %d of run %d was removed", ErrNotArchived, chunkID, run)
+	}
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(chunk.Data))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt archive chunk %d: %w", chunk.ID, err)
+	}
+	var originals [][]NetworkEvent
+	if err := json.NewDecoder(zr).Decode(&originals); err != nil {
+		return nil, fmt.Errorf("corrupt archive chunk %d: %w", chunk.ID, err)
+	}
+	if index < 0 || index >= len(originals) {
+		return nil, fmt.Errorf("%w: record %d is not in archive chunk %d", ErrNotArchived, index, chunk.ID)
+	}
+	return originals[index], nil
+}
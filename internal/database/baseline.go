@@ -0,0 +1,152 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SourceBaseline is the persisted anomaly profile of one source address
+type SourceBaseline struct {
+	SrcIP        string `gorm:"primaryKey"`
+	Events       int64
+	Destinations string // Newline-separated destinations seen from the source
+	Hours        string // Comma-separated event counts per hour of day (24 values)
+	VolumeCount  int64  // Connections with a byte count
+	VolumeMean   float64
+	VolumeM2     float64 // Sum of squared deviations (Welford)
+	UpdatedAt    time.Time
+}
+
+// PortBaseline is how often a destination port has been connected to
+type PortBaseline struct {
+	Port  uint16 `gorm:"primaryKey;autoIncrement:false"`
+	Count int64
+}
+
+// WeeklySummary holds the headline metrics of one week (Monday 00:00 UTC),
+// computed from raw events before compaction merges them
+type WeeklySummary struct {
+	WeekStart       time.Time `gorm:"primaryKey"`
+	TotalEvents     int64
+	TCPCount        int64
+	UDPCount        int64
+	DNSCount        int64
+	TLSCount        int64
+	UniqueSources   int64
+	UniqueHosts     int64
+	UniqueDomains   int64
+	Bytes           int64
+	ThreatEvents    int64
+	AnomalousEvents int64  // Events with an anomaly score of 50 or more
+	TopDomains      string // Comma-separated, most queried first
+	TopDestinations string // Comma-separated, most contacted first
+	UpdatedAt       time.Time
+}
+
+// models lists every table created on open
+var models = []any{&NetworkEvent{}, &SourceBaseline{}, &PortBaseline{}, &WeeklySummary{}, &CompactionRun{}, &ArchiveChunk{}, &InterfaceCounters{}, &SavedView{},
+	&ICMPDetail{}, &DNSAnswerDetail{}, &FileShareDetail{}, &NTPDetail{}, &CompactionDetail{}, &MinuteRollup{}, &HourRollup{}, &RollupBackfill{}, &Destination{},
+	&Beacon{}}
+
+// anomalousScore is the score from which an event counts as anomalous in
+// weekly summaries
+const anomalousScore = 50
+
+// WeekStart returns the Monday 00:00 UTC starting the week that contains t
+func WeekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// SummarizeWeek computes the summary of the week starting at start from the
+// stored events and saves it, replacing an earlier one
+func (db *DB) SummarizeWeek(start time.Time) (*WeeklySummary, error) {
+	start = WeekStart(start)
+	end := start.AddDate(0, 0, 7)
+	inWeek := func() *gorm.DB {
+		return db.Model(&NetworkEvent{}).
+			Where("timestamp >= ? AND timestamp < ? AND event_type != ?", start, end, EventHourlySummary)
+	}
+
+	s := &WeeklySummary{WeekStart: start}
+	if err := inWeek().Count(&s.TotalEvents).Error; err != nil {
+		return nil, fmt.Errorf("failed to count events of week %s: %w", start.Format("2006-01-02"), err)
+	}
+	inWeek().Where("event_type IN ?", []EventType{EventTCPStart, EventTCP}).Count(&s.TCPCount)
+	inWeek().Where("event_type IN ?", []EventType{EventUDPStart, EventUDP}).Count(&s.UDPCount)
+	inWeek().Where("event_type = ? AND dns_type IN ?", EventDNS, []string{"QUERY", "COMPLETE"}).Count(&s.DNSCount)
+	inWeek().Where("event_type = ?", EventTLSSNI).Count(&s.TLSCount)
+	inWeek().Where("src_ip != ''").Distinct("src_ip").Count(&s.UniqueSources)
+	inWeek().Where("dst_ip != ''").Distinct("dst_ip").Count(&s.UniqueHosts)
+	inWeek().Where("dns_query != ''").Distinct("dns_query").Count(&s.UniqueDomains)
+	inWeek().Select("COALESCE(SUM(byte_count), 0)").Scan(&s.Bytes)
+	inWeek().Where("threat = ?", true).Count(&s.ThreatEvents)
+	inWeek().Where("anomaly_score >= ?", anomalousScore).Count(&s.AnomalousEvents)
+	s.TopDomains = topNames(inWeek(), "dns_query", 10)
+	s.TopDestinations = topNames(inWeek(), "dst_ip", 10)
+
+	if err := db.Save(s).Error; err != nil {
+		return nil, fmt.Errorf("failed to save summary of week %s: %w", start.Format("2006-01-02"), err)
+	}
+	return s, nil
+}
+
+// SummarizeWeeks stores a summary for every completed week before now that
+// has events but no summary yet, and returns how many were created
+func (db *DB) SummarizeWeeks(now time.Time) (int, error) {
+	var first time.Time
+	var oldest struct{ Timestamp time.Time }
+	err := db.Model(&NetworkEvent{}).Select("timestamp").
+		Where("event_type != ?", EventHourlySummary).
+		Order("timestamp ASC").Limit(1).Scan(&oldest).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to find oldest event: %w", err)
+	}
+	if first = oldest.Timestamp; first.IsZero() {
+		return 0, nil
+	}
+
+	var done []time.Time
+	db.Model(&WeeklySummary{}).Pluck("week_start", &done)
+	have := make(map[int64]bool, len(done))
+	for _, w := range done {
+		have[w.Unix()] = true
+	}
+
+	created := 0
+	current := WeekStart(now)
+	for week := WeekStart(first); week.Before(current); week = week.AddDate(0, 0, 7) {
+		if have[week.Unix()] {
+			continue
+		}
+		s, err := db.SummarizeWeek(week)
+		if err != nil {
+			return created, err
+		}
+		if s.TotalEvents > 0 {
+			created++
+		}
+	}
+	return created, nil
+}
+
+// WeeklySummaries returns up to limit stored summaries of weeks starting
+// before end, newest first
+func (db *DB) WeeklySummaries(end time.Time, limit int) ([]WeeklySummary, error) {
+	var weeks []WeeklySummary
+	err := db.Where("week_start < ? AND total_events > 0", end).
+		Order("week_start DESC").Limit(limit).Find(&weeks).Error
+	return weeks, err
+}
+
+// topNames returns the most frequent non-empty values of a column, comma-separated
+func topNames(q *gorm.DB, column string, limit int) string {
+	var names []string
+	q.Where(column+" != ''").
+		Group(column).Order("count(*) DESC").Limit(limit).Pluck(column, &names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,223 @@
+package database
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Beacon is a local host connecting to the same remote service at regular
+// intervals with requests of the same size, the pattern of malware checking
+// in with its command and control server or of devices phoning home.
+// Detection runs store the beacons they find, replacing the previous run's.
+type Beacon struct {
+	SrcIP       string    `gorm:"primaryKey" json:"srcIp"`
+	DstIP       string    `gorm:"primaryKey" json:"dstIp"`
+	DstPort     uint16    `gorm:"primaryKey" json:"dstPort"`
+	Protocol    string    `gorm:"primaryKey" json:"protocol"` // TCP or UDP
+	Domain      string    `json:"domain,omitempty"`           // TLS server name or hostname of the latest connection
+	Connections int       `json:"connections"`                // check-ins, connections less than a second apart counting once
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Interval    float64   `json:"interval"`    // median seconds between check-ins
+	Jitter      float64   `json:"jitter"`      // median deviation from Interval, as a fraction of it
+	MedianBytes int64     `json:"medianBytes"` // median bytes per connection
+	SizeJitter  float64   `json:"sizeJitter"`  // median deviation from MedianBytes, as a fraction of it
+	Score       int       `gorm:"index" json:"score"`
+	DetectedAt  time.Time `json:"detectedAt"`
+}
+
+// BeaconOptions controls beacon detection
+type BeaconOptions struct {
+	Since          time.Time // connections started from here to now are analysed
+	MinConnections int       // fewer check-ins are never a beacon (default: 8)
+	MinScore       int       // lower scores are left out, 0-100 (default: 70)
+}
+
+// Beacon score weights: regular intervals matter most, then constant
+// sizes, then how much of the analysed window the check-ins span
+const (
+	beaconIntervalWeight = 0.5
+	beaconSizeWeight     = 0.3
+	beaconSpanWeight     = 0.2
+)
+
+// beaconFlow collects the connections of one host to one remote service
+type beaconFlow struct {
+	starts []time.Time
+	sizes  []int64
+	domain string
+}
+
+// beaconFlowTypes are the events standing for one finished connection each
+var beaconFlowTypes = []EventType{EventTCPEnd, EventUDPEnd, EventTCP, EventUDP}
+
+// DetectBeacons scores the connections local hosts made to remote services
+// since opts.Since and returns those regular enough to be beacons, highest
+// score first
+func (db *DB) DetectBeacons(opts BeaconOptions) ([]Beacon, error) {
+	if opts.MinConnections < 3 {
+		opts.MinConnections = 8
+	}
+	if opts.MinScore <= 0 {
+		opts.MinScore = 70
+	}
+	now := time.Now()
+
+	flows := make(map[Beacon]*beaconFlow)
+	var batch []NetworkEvent
+	err := db.Model(&NetworkEvent{}).
+		Select("id", "timestamp", "event_type", "src_ip", "dst_ip", "dst_port", "duration", "byte_count", "tls_sni", "hostname").
+		Where("timestamp >= ? AND event_type IN ?", opts.Since, beaconFlowTypes).
+		Where(LocalSourceCondition).
+		FindInBatches(&batch, 5000, func(*gorm.DB, int) error {
+			for _, e := range batch {
+				if isLocalAddr(e.DstIP) || e.DstIP == "" {
+					continue
+				}
+				key := Beacon{SrcIP: e.SrcIP, DstIP: e.DstIP, DstPort: e.DstPort, Protocol: "TCP"}
+				if e.EventType == EventUDPEnd || e.EventType == EventUDP {
+					key.Protocol = "UDP"
+				}
+				f, ok := flows[key]
+				if !ok {
+					f = &beaconFlow{}
+					flows[key] = f
+				}
+				// END events are stamped when the connection closed
+				start := e.Timestamp
+				if e.EventType == EventTCPEnd || e.EventType == EventUDPEnd {
+					start = start.Add(-time.Duration(e.Duration) * time.Millisecond)
+				}
+				f.starts = append(f.starts, start)
+				f.sizes = append(f.sizes, e.ByteCount)
+				if name := cmp.Or(e.TLSSNI, e.Hostname); name != "" {
+					f.domain = strings.ToLower(name)
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var beacons []Beacon
+	for key, f := range flows {
+		b, ok := scoreBeacon(key, f, now.Sub(opts.Since), opts.MinConnections)
+		if ok && b.Score >= opts.MinScore {
+			b.DetectedAt = now
+			beacons = append(beacons, b)
+		}
+	}
+	slices.SortFunc(beacons, func(a, b Beacon) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(b.Connections, a.Connections), strings.Compare(a.SrcIP, b.SrcIP), strings.Compare(a.DstIP, b.DstIP))
+	})
+	return beacons, nil
+}
+
+// scoreBeacon scores a flow's regularity from 0 to 100. Connections opened
+// less than a second apart are one check-in, with their bytes added up.
+func scoreBeacon(b Beacon, f *beaconFlow, window time.Duration, minConnections int) (Beacon, bool) {
+	order := make([]int, len(f.starts))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(i, j int) int { return f.starts[i].Compare(f.starts[j]) })
+
+	var starts []time.Time
+	var sizes []float64
+	for _, i := range order {
+		if n := len(starts); n > 0 && f.starts[i].Sub(starts[n-1]) < time.Second {
+			sizes[n-1] += float64(f.sizes[i])
+			continue
+		}
+		starts = append(starts, f.starts[i])
+		sizes = append(sizes, float64(f.sizes[i]))
+	}
+	if len(starts) < minConnections {
+		return b, false
+	}
+
+	intervals := make([]float64, 0, len(starts)-1)
+	for i := 1; i < len(starts); i++ {
+		intervals = append(intervals, starts[i].Sub(starts[i-1]).Seconds())
+	}
+	interval, jitter := medianDeviation(intervals)
+	size, sizeJitter := medianDeviation(sizes)
+	span := starts[len(starts)-1].Sub(starts[0])
+
+	b.Domain = f.domain
+	b.Connections = len(starts)
+	b.FirstSeen, b.LastSeen = starts[0], starts[len(starts)-1]
+	b.Interval = math.Round(interval*10) / 10
+	b.Jitter = math.Round(jitter*1000) / 1000
+	b.MedianBytes = int64(size)
+	b.SizeJitter = math.Round(sizeJitter*1000) / 1000
+	score := beaconIntervalWeight*max(0, 1-jitter) +
+		beaconSizeWeight*max(0, 1-sizeJitter) +
+		beaconSpanWeight*min(1, span.Seconds()/window.Seconds())
+	b.Score = int(math.Round(score * 100))
+	return b, true
+}
+
+// medianDeviation returns the median of values and their median absolute
+// deviation from it as a fraction of the median; values all zero deviate
+// by nothing
+func medianDeviation(values []float64) (median, deviation float64) {
+	median = medianOf(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	mad := medianOf(deviations)
+	switch {
+	case median > 0:
+		return median, mad / median
+	case mad > 0:
+		return median, 1
+	}
+	return median, 0
+}
+
+// medianOf returns the median of values, sorting a copy
+func medianOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// SaveBeacons replaces the stored beacons with those of a detection run
+func (db *DB) SaveBeacons(beacons []Beacon) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&Beacon{}).Error; err != nil {
+			return err
+		}
+		if len(beacons) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(beacons, 200).Error
+	})
+}
+
+// Beacons returns the stored beacons scoring at least minScore, highest
+// first, optionally only those of one source
+func (db *DB) Beacons(minScore int, srcIP string, limit int) ([]Beacon, error) {
+	q := db.Where("score >= ?", minScore)
+	if srcIP != "" {
+		q = q.Where("src_ip = ?", srcIP)
+	}
+	var beacons []Beacon
+	err := q.Order("score DESC, connections DESC, src_ip, dst_ip").Limit(limit).Find(&beacons).Error
+	return beacons, err
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LocalSourceCondition matches events sent by a host on a private network
+const LocalSourceCondition = `(src_ip LIKE '10.%' OR src_ip LIKE '192.168.%' OR src_ip LIKE '172.1_.%' OR
+	src_ip LIKE '172.2_.%' OR src_ip LIKE '172.3_.%' OR src_ip LIKE 'fd%' OR src_ip LIKE 'fe80:%')`
+
+// maxBehaviorItems caps the new domains and ports listed per device
+const maxBehaviorItems = 25
+
+// BehaviorItem is a domain or port a device contacted for the first time
+type BehaviorItem struct {
+	Name       string    `json:"name"` // domain, or port as 443/tcp
+	FirstSeen  time.Time `json:"firstSeen"`
+	EventCount int64     `json:"eventCount"`
+}
+
+// DeviceBehavior is what one local device did in a week that it had never
+// done before
+type DeviceBehavior struct {
+	IP          string         `json:"ip"`
+	NewDevice   bool           `json:"newDevice"` // first seen this week, so everything is new
+	NewDomains  []BehaviorItem `json:"newDomains"`
+	NewPorts    []BehaviorItem `json:"newPorts"`
+	MoreDomains int            `json:"moreDomains,omitempty"` // new domains beyond those listed
+	MorePorts   int            `json:"morePorts,omitempty"`
+}
+
+// NewBehavior compares the week starting at start with each local device's
+// own history before it, and returns the devices that contacted domains
+// (DNS queries and TLS server names) or destination ports they never had,
+// most changed first. Devices first seen in the week are listed without
+// detail.
+func (db *DB) NewBehavior(start time.Time) ([]DeviceBehavior, error) {
+	start = WeekStart(start)
+	end := start.AddDate(0, 0, 7)
+	inWeek := func() *gorm.DB {
+		return db.Model(&NetworkEvent{}).
+			Where("timestamp >= ? AND timestamp < ? AND src_ip != ''", start, end).
+			Where(LocalSourceCondition)
+	}
+	before := func(ip string) *gorm.DB {
+		return db.Model(&NetworkEvent{}).Where("src_ip = ? AND timestamp < ?", ip, start)
+	}
+
+	var devices []string
+	if err := inWeek().Distinct("src_ip").Order("src_ip").Pluck("src_ip", &devices).Error; err != nil {
+		return nil, fmt.Errorf("failed to list devices of week %s: %w", start.Format("2006-01-02"), err)
+	}
+
+	var changes []DeviceBehavior
+	for _, ip := range devices {
+		d := DeviceBehavior{IP: ip, NewDomains: []BehaviorItem{}, NewPorts: []BehaviorItem{}}
+		var earlier []uint
+		before(ip).Limit(1).Pluck("id", &earlier)
+		if len(earlier) == 0 {
+			d.NewDevice = true
+			changes = append(changes, d)
+			continue
+		}
+
+		// Domains: DNS lookups the device made and TLS server names it sent
+		var known []string
+		before(ip).Where(LookupCondition).Distinct("dns_query").Pluck("dns_query", &known)
+		var sni []string
+		before(ip).Where("tls_sni != ''").Distinct("tls_sni").Pluck("tls_sni", &sni)
+		d.NewDomains, d.MoreDomains = newItems(inWeek().Where("src_ip = ?", ip).
+			Where("tls_sni != '' OR "+LookupCondition).
+			Select("COALESCE(NULLIF(tls_sni, ''), dns_query) as name, min(timestamp) as first_seen, count(*) as event_count").
+			Group("name"), append(known, sni...))
+
+		// Ports of connections the device opened
+		var ports []string
+		connections := []EventType{EventTCPStart, EventTCP, EventUDPStart, EventUDP}
+		before(ip).Where("event_type IN ? AND dst_port > 0", connections).
+			Distinct(PortName).Pluck(PortName, &ports)
+		d.NewPorts, d.MorePorts = newItems(inWeek().Where("src_ip = ?", ip).
+			Where("event_type IN ? AND dst_port > 0", connections).
+			Select(PortName+" as name, min(timestamp) as first_seen, count(*) as event_count").
+			Group("name"), ports)
+
+		if len(d.NewDomains) > 0 || len(d.NewPorts) > 0 {
+			changes = append(changes, d)
+		}
+	}
+	slices.SortStableFunc(changes, func(a, b DeviceBehavior) int {
+		return cmp.Compare(len(b.NewDomains)+b.MoreDomains+len(b.NewPorts)+b.MorePorts,
+			len(a.NewDomains)+a.MoreDomains+len(a.NewPorts)+a.MorePorts)
+	})
+	return changes, nil
+}
+
+// LookupCondition matches DNS events carrying a query sent by their source
+const LookupCondition = "(event_type = 'DNS' AND dns_type IN ('QUERY', 'COMPLETE') AND dns_query != '')"
+
+// PortName renders a connection's destination port and protocol as 443/tcp
+const PortName = "dst_port || '/' || CASE WHEN event_type IN ('TCP_START', 'TCP') THEN 'tcp' ELSE 'udp' END"
+
+// newItems runs a query grouped by name and keeps the names not in known,
+// most frequent first. It returns those listed and how many more there are.
+func newItems(q *gorm.DB, known []string) ([]BehaviorItem, int) {
+	var rows []struct {
+		Name       string
+		FirstSeen  string
+		EventCount int64
+	}
+	q.Order("event_count DESC, name").Scan(&rows)
+	seen := make(map[string]bool, len(known))
+	for _, name := range known {
+		seen[name] = true
+	}
+	items := []BehaviorItem{}
+	more := 0
+	for _, row := range rows {
+		if row.Name == "" || seen[row.Name] {
+			continue
+		}
+		if len(items) == maxBehaviorItems {
+			more++
+			continue
+		}
+		items = append(items, BehaviorItem{Name: row.Name, FirstSeen: ParseTime(row.FirstSeen), EventCount: row.EventCount})
+	}
+	return items, more
+}
+
+// ParseTime parses a timestamp returned by an aggregate (min/max), which
+// SQLite hands back as text rather than a typed time
+func ParseTime(value string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
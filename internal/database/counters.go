@@ -0,0 +1,54 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// InterfaceCounters accumulates the capture counters of one interface
+// across daemon restarts, for long-term capture quality
+type InterfaceCounters struct {
+	Interface string `gorm:"primaryKey"`
+	Packets   uint64 // delivered to the ring by the kernel
+	Drops     uint64 // dropped by the kernel, ring full
+	Processed uint64 // decoded by net-watcher
+	FirstSeen time.Time
+	UpdatedAt time.Time
+}
+
+// AddInterfaceCounters adds counter deltas to the stored totals of iface,
+// creating them with FirstSeen set to since
+func (db *DB) AddInterfaceCounters(iface string, since time.Time, packets, drops, processed uint64) error {
+	now := time.Now()
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "interface"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"packets":    gorm.Expr("packets + ?", packets),
+			"drops":      gorm.Expr("drops + ?", drops),
+			"processed":  gorm.Expr("processed + ?", processed),
+			"updated_at": now,
+		}),
+	}).Create(&InterfaceCounters{
+		Interface: iface,
+		Packets:   packets,
+		Drops:     drops,
+		Processed: processed,
+		FirstSeen: since,
+		UpdatedAt: now,
+	}).Error
+}
+
+// InterfaceCounterTotals returns the stored totals by interface
+func (db *DB) InterfaceCounterTotals() (map[string]InterfaceCounters, error) {
+	var rows []InterfaceCounters
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	totals := make(map[string]InterfaceCounters, len(rows))
+	for _, r := range rows {
+		totals[r.Interface] = r
+	}
+	return totals, nil
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"time"
@@ -14,6 +15,7 @@ import (
 // DB wraps the gorm database
 type DB struct {
 	*gorm.DB
+	readOnly bool // a read replica (see OpenReplica)
 }
 
 // New creates a new database connection
@@ -29,15 +31,45 @@ func New(dbPath string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Lets Purge give deleted pages back to the file system. It only takes
+	// effect on new databases, or on older ones at their next VACUUM.
+	_, _ = sqlDB.Exec("PRAGMA auto_vacuum=INCREMENTAL")
 	_, _ = sqlDB.Exec("PRAGMA journal_mode=WAL")
 	_, _ = sqlDB.Exec("PRAGMA synchronous=NORMAL")
 	_, _ = sqlDB.Exec("PRAGMA cache_size=2000")
 
-	if err := db.AutoMigrate(&NetworkEvent{}); err != nil {
+	return setup(db)
+}
+
+// setup creates the tables of a freshly opened database, makes content
+// hashes unique and moves columns to side tables in databases created
+// before they were, and hooks the side tables into event queries
+func setup(db *gorm.DB) (*DB, error) {
+	if err := uniqueContentHashes(db); err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		return nil, err
+	}
+	if err := moveToSideTables(db); err != nil {
+		return nil, err
+	}
+	if err := registerSideTables(db); err != nil {
 		return nil, err
 	}
+	return &DB{DB: db}, nil
+}
+
+// ReadOnly reports whether the database is a read replica, where nothing
+// may be stored
+func (db *DB) ReadOnly() bool {
+	return db.readOnly
+}
 
-	return &DB{db}, nil
+// Checkpoint copies the write-ahead log into the database file and
+// truncates it
+func (db *DB) Checkpoint() error {
+	return db.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error
 }
 
 // Close closes the database connection
@@ -54,243 +86,563 @@ func (db *DB) InsertEvent(event *NetworkEvent) error {
 	return db.Create(event).Error
 }
 
-// InsertBatch inserts multiple events in batches
+// InsertBatch inserts multiple events in batches and counts them into the
+// rollup tables, in one transaction
 func (db *DB) InsertBatch(events []NetworkEvent) error {
 	if len(events) == 0 {
 		return nil
 	}
-	return db.CreateInBatches(events, 100).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(events, 100).Error; err != nil {
+			return err
+		}
+		if err := addRollups(tx, events); err != nil {
+			return err
+		}
+		return recordDestinations(tx, events)
+	})
+}
+
+// UpdateRepeats sets the repeat count and last occurrence of stored events
+func (db *DB) UpdateRepeats(repeats []Repeat) error {
+	if len(repeats) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, r := range repeats {
+			err := tx.Exec("UPDATE network_events SET repeats = ?, end_time = ? WHERE id = ?", r.Repeats, r.LastSeen, r.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // CompactStats holds statistics about compaction operations
 type CompactStats struct {
-	TCPPairsCompacted   int64
-	UDPPairsCompacted   int64
-	DNSPairsCompacted   int64
-	DuplicatesRemoved   int64
-	HourlySummaries     int64
-	OrphanedEndsRemoved int64
-	TotalEventsRemoved  int64
-	TotalEventsCreated  int64
-	TotalBytesInDB      int64
-	TCPBytes            int64
-	UDPBytes            int64
+	TCPPairsCompacted   int64     `json:"tcpPairsCompacted"`
+	UDPPairsCompacted   int64     `json:"udpPairsCompacted"`
+	DNSPairsCompacted   int64     `json:"dnsPairsCompacted"`
+	DuplicatesRemoved   int64     `json:"duplicatesRemoved"`
+	HourlySummaries     int64     `json:"hourlySummaries"`
+	WeeklySummaries     int64     `json:"weeklySummaries"`
+	DaysCompacted       int64     `json:"daysCompacted"`
+	ResumedFrom         time.Time `json:"resumedFrom"` // where this run started
+	OrphanedEndsRemoved int64     `json:"orphanedEndsRemoved"`
+	TotalEventsRemoved  int64     `json:"totalEventsRemoved"`
+	TotalEventsCreated  int64     `json:"totalEventsCreated"`
+	TotalBytesInDB      int64     `json:"totalBytesInDb"`
+	TCPBytes            int64     `json:"tcpBytes"`
+	UDPBytes            int64     `json:"udpBytes"`
 }
 
-// Compact performs database compaction with various strategies
-func (db *DB) Compact(olderThan time.Time, dedupeWindow time.Duration) (*CompactStats, error) {
+// DNSPairing selects how compaction matches DNS responses to their queries
+type DNSPairing string
+
+const (
+	// DNSPairByID matches the transaction ID and the reversed 5-tuple, so
+	// identical concurrent queries through one resolver pair correctly
+	DNSPairByID DNSPairing = "id"
+	// DNSPairByName matches the query name and client within 5 seconds;
+	// for events recorded before transaction IDs were stored
+	DNSPairByName DNSPairing = "name"
+)
+
+// ParseDNSPairing validates a --dns-pairing value
+func ParseDNSPairing(s string) (DNSPairing, error) {
+	switch p := DNSPairing(s); p {
+	case DNSPairByID, DNSPairByName:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown DNS pairing %q, expected id or name", s)
+}
+
+// Response windows after the query for each pairing mode. An ID and
+// 5-tuple match is unambiguous, so slow resolvers can be given longer.
+const (
+	dnsNamePairWindow = 5 * time.Second
+	dnsIDPairWindow   = 30 * time.Second
+)
+
+// CompactOptions controls what Compact merges and removes
+type CompactOptions struct {
+	OlderThan    time.Time     // only events before this are compacted
+	DedupeWindow time.Duration // repeated DNS queries within this window are dropped; 0 keeps them
+	DNSPairing   DNSPairing    // default DNSPairByID
+	Full         bool          // rescan from the oldest event instead of resuming from recorded progress
+	Background   bool          // share the database with the live writer: short transactions, no VACUUM
+}
+
+// backgroundPause is how long a background compaction yields the database
+// to the live writer between transactions
+const backgroundPause = 500 * time.Millisecond
+
+// CompactionRun records how far a compaction got. Each range is compacted
+// in one transaction together with the update of DoneThrough, so an
+// interrupted run resumes at the first range it had not finished.
+type CompactionRun struct {
+	ID          uint `gorm:"primaryKey"`
+	StartedAt   time.Time
+	OlderThan   time.Time // cutoff of the run
+	DoneThrough time.Time // events before this have been compacted
+	Finished    bool
+}
+
+// startOfDay returns midnight UTC of the day containing t
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Compact merges START/END and QUERY/RESPONSE pairs and removes duplicates
+// and orphans, one day (one hour with opts.Background) per transaction.
+// Progress is stored with every transaction and a later call continues where
+// the previous one stopped, unless opts.Full is set. Cancelling ctx rolls back
+// the range in progress and returns ctx.Err().
+func (db *DB) Compact(ctx context.Context, opts CompactOptions) (*CompactStats, error) {
 	stats := &CompactStats{}
+	if opts.DNSPairing == "" {
+		opts.DNSPairing = DNSPairByID
+	}
 
-	// 1. Compact TCP: Merge TCP_START + TCP_END pairs
-	if err := db.compactTCP(olderThan, stats); err != nil {
-		return stats, fmt.Errorf("TCP compaction failed: %w", err)
+	// Summarise completed weeks while their raw events still exist
+	weeks, err := db.SummarizeWeeks(time.Now())
+	stats.WeeklySummaries = int64(weeks)
+	if err != nil {
+		return stats, fmt.Errorf("weekly summary failed: %w", err)
 	}
 
-	// 2. Compact UDP: Merge UDP_START + UDP_END pairs
-	if err := db.compactUDP(olderThan, stats); err != nil {
-		return stats, fmt.Errorf("UDP compaction failed: %w", err)
+	run, err := db.compactionRun(opts)
+	if err != nil {
+		return stats, err
 	}
+	stats.ResumedFrom = run.DoneThrough
 
-	// 3. Compact DNS: Merge QUERY + RESPONSE pairs
-	if err := db.compactDNS(olderThan, stats); err != nil {
-		return stats, fmt.Errorf("DNS compaction failed: %w", err)
+	// A background run works in hourly slices with a pause in between, so
+	// the live writer never waits long for the write lock
+	step, logDone := 24*time.Hour, log.Info
+	if opts.Background {
+		step, logDone = time.Hour, log.Debug
 	}
 
-	// 4. Remove duplicate DNS queries within window
-	if dedupeWindow > 0 {
-		if err := db.deduplicateDNS(olderThan, dedupeWindow, stats); err != nil {
-			return stats, fmt.Errorf("DNS deduplication failed: %w", err)
+	for slice := startOfDay(run.DoneThrough); slice.Before(opts.OlderThan); slice = slice.Add(step) {
+		if ctx.Err() != nil {
+			break
+		}
+		from, to := slice, slice.Add(step)
+		if !run.DoneThrough.Before(to) {
+			continue
+		}
+		if run.DoneThrough.After(from) {
+			from = run.DoneThrough
+		}
+		if opts.OlderThan.Before(to) {
+			to = opts.OlderThan
+		}
+		var sliceStats CompactStats
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := (&DB{DB: tx}).compactRange(from, to, run.ID, opts, &sliceStats); err != nil {
+				return err
+			}
+			return tx.Model(run).Update("done_through", to).Error
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return stats, fmt.Errorf("compaction of %s failed: %w", from.Format("2006-01-02 15:04"), err)
+		}
+		run.DoneThrough = to
+		stats.add(&sliceStats)
+		if to.Equal(startOfDay(to)) || to.Equal(opts.OlderThan) {
+			stats.DaysCompacted++
+		}
+		logDone("[COMPACT] Range done", "from", from.Format("2006-01-02 15:04"),
+			"tcp_pairs", sliceStats.TCPPairsCompacted,
+			"udp_pairs", sliceStats.UDPPairsCompacted,
+			"dns_pairs", sliceStats.DNSPairsCompacted,
+			"removed", sliceStats.TotalEventsRemoved,
+		)
+		if opts.Background {
+			select {
+			case <-ctx.Done():
+			case <-time.After(backgroundPause):
+			}
 		}
 	}
+	if ctx.Err() != nil {
+		log.Warn("[COMPACT] Interrupted, the next run resumes here", "done_through", run.DoneThrough)
+		return stats, ctx.Err()
+	}
 
-	// 5. Remove orphaned END events (no matching START)
-	if err := db.removeOrphanedEnds(olderThan, stats); err != nil {
-		return stats, fmt.Errorf("orphan removal failed: %w", err)
+	if err := db.Model(run).Update("finished", true).Error; err != nil {
+		return stats, fmt.Errorf("failed to record compaction progress: %w", err)
 	}
 
-	// 6. Calculate data transfer statistics
+	// Calculate data transfer statistics
 	db.calculateTransferStats(stats)
 
-	// 7. Vacuum the database
-	db.Exec("VACUUM")
+	if opts.Background {
+		// VACUUM would lock out the writer for its whole duration; fold the
+		// WAL back into the database instead so it does not keep growing
+		if err := db.Checkpoint(); err != nil {
+			log.Warn("[COMPACT] WAL checkpoint failed", "error", err)
+		}
+	} else {
+		// Vacuum the database
+		db.Exec("VACUUM")
+	}
 
 	return stats, nil
 }
 
-// compactTCP merges TCP_START and TCP_END pairs into single TCP records
-func (db *DB) compactTCP(olderThan time.Time, stats *CompactStats) error {
-	// Find TCP_START events that have matching TCP_END
-	var startEvents []NetworkEvent
-	db.Where("event_type = ? AND timestamp < ? AND (compacted = ? OR compacted IS NULL)", EventTCPStart, olderThan, false).
-		Find(&startEvents)
-
-	total := len(startEvents)
-	log.Info("Processing TCP events", "total", total)
-
-	for i, start := range startEvents {
-		if (i+1)%1000 == 0 || i+1 == total {
-			log.Info("TCP progress", "processed", i+1, "total", total, "pairs_found", stats.TCPPairsCompacted)
+// compactionRun returns the run to continue: an interrupted one, or a new
+// run starting where the last one stopped (or at the oldest event)
+func (db *DB) compactionRun(opts CompactOptions) (*CompactionRun, error) {
+	var last CompactionRun
+	found := false
+	if !opts.Full {
+		res := db.Order("id DESC").Limit(1).Find(&last)
+		if res.Error != nil {
+			return nil, fmt.Errorf("failed to read compaction progress: %w", res.Error)
 		}
-		// Find matching END event (same src/dst within reasonable time)
-		var endEvent NetworkEvent
-		result := db.Where(
-			"event_type IN (?, ?) AND src_ip = ? AND src_port = ? AND dst_ip = ? AND dst_port = ? AND timestamp > ? AND timestamp < ?",
-			EventTCPEnd, EventTimeout,
-			start.SrcIP, start.SrcPort, start.DstIP, start.DstPort,
-			start.Timestamp, start.Timestamp.Add(24*time.Hour),
-		).Order("timestamp ASC").First(&endEvent)
-
-		if result.Error == nil {
-			// Create compacted record
-			compacted := NetworkEvent{
-				Timestamp:   start.Timestamp,
-				EndTime:     endEvent.Timestamp,
-				EventType:   EventTCP,
-				Interface:   start.Interface,
-				IPVersion:   start.IPVersion,
-				SrcIP:       start.SrcIP,
-				SrcPort:     start.SrcPort,
-				DstIP:       start.DstIP,
-				DstPort:     start.DstPort,
-				Hostname:    start.Hostname,
-				DNSAge:      start.DNSAge,
-				Duration:    endEvent.Duration,
-				ByteCount:   endEvent.ByteCount,
-				Reason:      endEvent.Reason,
-				Compacted:   true,
-				OriginalIDs: fmt.Sprintf("%d,%d", start.ID, endEvent.ID),
-			}
+		found = res.RowsAffected > 0
+	}
 
-			if err := db.Create(&compacted).Error; err != nil {
-				continue
+	if found && !last.Finished {
+		log.Info("[COMPACT] Resuming interrupted run", "run", last.ID, "done_through", last.DoneThrough)
+		if opts.OlderThan.After(last.OlderThan) {
+			last.OlderThan = opts.OlderThan
+			if err := db.Model(&last).Update("older_than", last.OlderThan).Error; err != nil {
+				return nil, fmt.Errorf("failed to record compaction progress: %w", err)
 			}
-
-			// Delete original events
-			db.Delete(&start)
-			db.Delete(&endEvent)
-			stats.TCPPairsCompacted++
-			stats.TotalEventsRemoved += 2
-			stats.TotalEventsCreated++
 		}
+		return &last, nil
 	}
 
-	return nil
+	run := &CompactionRun{StartedAt: time.Now(), OlderThan: opts.OlderThan}
+	if found {
+		run.DoneThrough = last.DoneThrough
+	} else {
+		var oldest struct{ Timestamp time.Time }
+		db.Model(&NetworkEvent{}).Select("timestamp").
+			Where("compacted = ? OR compacted IS NULL", false).
+			Order("timestamp ASC").Limit(1).Scan(&oldest)
+		if oldest.Timestamp.IsZero() {
+			oldest.Timestamp = opts.OlderThan
+		}
+		run.DoneThrough = startOfDay(oldest.Timestamp)
+	}
+	if err := db.Create(run).Error; err != nil {
+		return nil, fmt.Errorf("failed to record compaction progress: %w", err)
+	}
+	return run, nil
 }
 
-// compactUDP merges UDP_START and UDP_END pairs into single UDP records
-func (db *DB) compactUDP(olderThan time.Time, stats *CompactStats) error {
-	var startEvents []NetworkEvent
-	db.Where("event_type = ? AND timestamp < ? AND (compacted = ? OR compacted IS NULL)", EventUDPStart, olderThan, false).
-		Find(&startEvents)
-
-	total := len(startEvents)
-	log.Info("Processing UDP events", "total", total)
+// compactRange runs every compaction step on events in [from, to),
+// archiving merged events under the given CompactionRun
+func (db *DB) compactRange(from, to time.Time, run uint, opts CompactOptions, stats *CompactStats) error {
+	// 1. Compact TCP: Merge TCP_START + TCP_END pairs
+	if err := db.compactTCP(from, to, run, stats); err != nil {
+		return fmt.Errorf("TCP compaction failed: %w", err)
+	}
 
-	for i, start := range startEvents {
-		if (i+1)%1000 == 0 || i+1 == total {
-			log.Info("UDP progress", "processed", i+1, "total", total, "pairs_found", stats.UDPPairsCompacted)
-		}
-		var endEvent NetworkEvent
-		result := db.Where(
-			"event_type = ? AND src_ip = ? AND src_port = ? AND dst_ip = ? AND dst_port = ? AND timestamp > ? AND timestamp < ?",
-			EventUDPEnd,
-			start.SrcIP, start.SrcPort, start.DstIP, start.DstPort,
-			start.Timestamp, start.Timestamp.Add(24*time.Hour),
-		).Order("timestamp ASC").First(&endEvent)
-
-		if result.Error == nil {
-			compacted := NetworkEvent{
-				Timestamp:   start.Timestamp,
-				EndTime:     endEvent.Timestamp,
-				EventType:   EventUDP,
-				Interface:   start.Interface,
-				IPVersion:   start.IPVersion,
-				SrcIP:       start.SrcIP,
-				SrcPort:     start.SrcPort,
-				DstIP:       start.DstIP,
-				DstPort:     start.DstPort,
-				Protocol:    start.Protocol,
-				Duration:    endEvent.Duration,
-				ByteCount:   endEvent.ByteCount,
-				Compacted:   true,
-				OriginalIDs: fmt.Sprintf("%d,%d", start.ID, endEvent.ID),
-			}
+	// 2. Compact UDP: Merge UDP_START + UDP_END pairs
+	if err := db.compactUDP(from, to, run, stats); err != nil {
+		return fmt.Errorf("UDP compaction failed: %w", err)
+	}
 
-			if err := db.Create(&compacted).Error; err != nil {
-				continue
-			}
+	// 3. Compact DNS: Merge QUERY + RESPONSE pairs
+	if err := db.compactDNS(from, to, run, opts.DNSPairing, stats); err != nil {
+		return fmt.Errorf("DNS compaction failed: %w", err)
+	}
 
-			db.Delete(&start)
-			db.Delete(&endEvent)
-			stats.UDPPairsCompacted++
-			stats.TotalEventsRemoved += 2
-			stats.TotalEventsCreated++
+	// 4. Remove duplicate DNS queries within window
+	if opts.DedupeWindow > 0 {
+		if err := db.deduplicateDNS(from, to, opts.DedupeWindow, stats); err != nil {
+			return fmt.Errorf("DNS deduplication failed: %w", err)
 		}
 	}
 
+	// 5. Remove orphaned END events (no matching START)
+	if err := db.removeOrphanedEnds(from, to, stats); err != nil {
+		return fmt.Errorf("orphan removal failed: %w", err)
+	}
 	return nil
 }
 
-// compactDNS merges DNS QUERY and RESPONSE pairs
-func (db *DB) compactDNS(olderThan time.Time, stats *CompactStats) error {
-	var queryEvents []NetworkEvent
-	db.Where("event_type = ? AND dns_type = ? AND timestamp < ? AND (compacted = ? OR compacted IS NULL)",
-		EventDNS, "QUERY", olderThan, false).
-		Find(&queryEvents)
-
-	total := len(queryEvents)
-	log.Info("Processing DNS events", "total", total)
-
-	for i, query := range queryEvents {
-		if (i+1)%1000 == 0 || i+1 == total {
-			log.Info("DNS progress", "processed", i+1, "total", total, "pairs_found", stats.DNSPairsCompacted)
-		}
-		var response NetworkEvent
-		result := db.Where(
-			"event_type = ? AND dns_type = ? AND dns_query = ? AND timestamp > ? AND timestamp < ?",
-			EventDNS, "RESPONSE", query.DNSQuery,
-			query.Timestamp, query.Timestamp.Add(5*time.Second),
-		).Order("timestamp ASC").First(&response)
-
-		if result.Error == nil {
-			compacted := NetworkEvent{
-				Timestamp:   query.Timestamp,
-				EndTime:     response.Timestamp,
-				EventType:   EventDNS,
-				Interface:   query.Interface,
-				IPVersion:   query.IPVersion,
-				SrcIP:       query.SrcIP,
-				SrcPort:     query.SrcPort,
-				DstIP:       query.DstIP,
-				DstPort:     query.DstPort,
-				DNSType:     "COMPLETE",
-				DNSQuery:    query.DNSQuery,
-				DNSAnswers:  response.DNSAnswers,
-				DNSCNAMEs:   response.DNSCNAMEs,
-				Duration:    response.Timestamp.Sub(query.Timestamp).Milliseconds(),
-				Compacted:   true,
-				OriginalIDs: fmt.Sprintf("%d,%d", query.ID, response.ID),
+// add accumulates the counters of one compacted range
+func (s *CompactStats) add(o *CompactStats) {
+	s.TCPPairsCompacted += o.TCPPairsCompacted
+	s.UDPPairsCompacted += o.UDPPairsCompacted
+	s.DNSPairsCompacted += o.DNSPairsCompacted
+	s.DuplicatesRemoved += o.DuplicatesRemoved
+	s.OrphanedEndsRemoved += o.OrphanedEndsRemoved
+	s.TotalEventsRemoved += o.TotalEventsRemoved
+	s.TotalEventsCreated += o.TotalEventsCreated
+}
+
+// compactBatchSize is how many pairs are merged per bulk insert and delete
+const compactBatchSize = 500
+
+// pairSpec describes how compaction pairs an opening event with the event
+// that closes it
+type pairSpec struct {
+	name      string        // used in progress logs
+	where     string        // selects candidate opening and closing events
+	args      []any         // arguments of where
+	partition string        // expressions both events of a pair share
+	isStart   string        // condition true for an opening event
+	isEnd     string        // condition true for a closing event
+	window    time.Duration // maximum time from opening to closing event
+	publish   bool          // send merged records to live subscribers
+}
+
+// compactPairs finds all pairs with one windowed query: an opening event is
+// paired with the event directly following it in its partition, if that
+// one closes it within the window. Each pair is replaced by merge(start,
+// end) using bulk inserts and deletes inside a single transaction, and the
+// pair itself is kept in the undo archive of the run.
+func (db *DB) compactPairs(from, to time.Time, run uint, spec pairSpec, merge func(start, end *NetworkEvent) NetworkEvent) (int64, error) {
+	// Opening events must lie in [from, to), closing ones may fall just after
+	query := fmt.Sprintf(`SELECT id AS start_id, next_id AS end_id FROM (
+		SELECT id, timestamp,
+			CASE WHEN %[1]s THEN 1 ELSE 0 END AS is_start,
+			LEAD(id) OVER w AS next_id,
+			LEAD(CASE WHEN %[2]s THEN 1 ELSE 0 END) OVER w AS next_is_end
+		FROM network_events
+		WHERE (%[3]s) AND timestamp >= ? AND timestamp < ? AND (compacted = ? OR compacted IS NULL)
+		WINDOW w AS (PARTITION BY %[4]s ORDER BY timestamp, id)
+	) candidates
+	WHERE is_start = 1 AND next_is_end = 1 AND timestamp < ?
+	ORDER BY start_id`, spec.isStart, spec.isEnd, spec.where, spec.partition)
+	args := append(append([]any{}, spec.args...), from, to.Add(spec.window), false, to)
+
+	var pairs []struct {
+		StartID uint
+		EndID   uint
+	}
+	if err := db.Raw(query, args...).Scan(&pairs).Error; err != nil {
+		return 0, fmt.Errorf("failed to pair %s events: %w", spec.name, err)
+	}
+	log.Debug("Processing "+spec.name+" events", "from", from, "candidate_pairs", len(pairs))
+
+	var merged int64
+	var created []NetworkEvent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for offset := 0; offset < len(pairs); offset += compactBatchSize {
+			chunk := pairs[offset:min(offset+compactBatchSize, len(pairs))]
+			ids := make([]uint, 0, 2*len(chunk))
+			for _, p := range chunk {
+				ids = append(ids, p.StartID, p.EndID)
+			}
+			var rows []NetworkEvent
+			if err := tx.Where("id IN ?", ids).Find(&rows).Error; err != nil {
+				return err
+			}
+			byID := make(map[uint]*NetworkEvent, len(rows))
+			for i := range rows {
+				byID[rows[i].ID] = &rows[i]
 			}
 
-			if err := db.Create(&compacted).Error; err != nil {
+			var records []NetworkEvent
+			var originals [][]NetworkEvent
+			var consumed []uint
+			for _, p := range chunk {
+				start, end := byID[p.StartID], byID[p.EndID]
+				if start == nil || end == nil || end.Timestamp.Sub(start.Timestamp) >= spec.window {
+					continue
+				}
+				records = append(records, merge(start, end))
+				originals = append(originals, []NetworkEvent{*start, *end})
+				consumed = append(consumed, start.ID, end.ID)
+			}
+			if len(records) == 0 {
 				continue
 			}
+			if err := archivePairs(tx, run, spec.name, records, originals); err != nil {
+				return err
+			}
+			if err := tx.CreateInBatches(records, compactBatchSize).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("id IN ?", consumed).Delete(&NetworkEvent{}).Error; err != nil {
+				return err
+			}
+			merged += int64(len(records))
+			if spec.publish {
+				created = append(created, records...)
+			}
+			log.Debug(spec.name+" progress", "processed", offset+len(chunk), "total", len(pairs), "pairs_found", merged)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to merge %s pairs: %w", spec.name, err)
+	}
+	PublishEvents(created)
+	return merged, nil
+}
+
+// compactTCP merges TCP_START and TCP_END pairs into single TCP records
+func (db *DB) compactTCP(from, to time.Time, run uint, stats *CompactStats) error {
+	pairs, err := db.compactPairs(from, to, run, pairSpec{
+		name:      "TCP",
+		where:     "event_type IN (?, ?, ?)",
+		args:      []any{EventTCPStart, EventTCPEnd, EventTimeout},
+		partition: "src_ip, src_port, dst_ip, dst_port",
+		isStart:   fmt.Sprintf("event_type = '%s'", EventTCPStart),
+		isEnd:     fmt.Sprintf("event_type IN ('%s', '%s')", EventTCPEnd, EventTimeout),
+		window:    24 * time.Hour,
+		publish:   true,
+	}, func(start, end *NetworkEvent) NetworkEvent {
+		return NetworkEvent{
+			Timestamp:    start.Timestamp,
+			EndTime:      end.Timestamp,
+			EventType:    EventTCP,
+			FlowID:       start.FlowID,
+			Interface:    start.Interface,
+			VLAN:         start.VLAN,
+			InnerVLAN:    start.InnerVLAN,
+			Tunnel:       start.Tunnel,
+			TunnelID:     start.TunnelID,
+			TunnelSrcIP:  start.TunnelSrcIP,
+			TunnelDstIP:  start.TunnelDstIP,
+			IPVersion:    start.IPVersion,
+			SrcIP:        start.SrcIP,
+			SrcPort:      start.SrcPort,
+			DstIP:        start.DstIP,
+			DstPort:      start.DstPort,
+			Hostname:     start.Hostname,
+			DNSAge:       start.DNSAge,
+			Duration:     end.Duration,
+			ByteCount:    end.ByteCount,
+			SrcBytes:     end.SrcBytes,
+			DstBytes:     end.DstBytes,
+			Reason:       end.Reason,
+			P2P:          end.P2P,
+			Compacted:    true,
+			CaptureFile:  start.CaptureFile,
+			CaptureFrame: start.CaptureFrame,
+		}
+	})
+	stats.TCPPairsCompacted += pairs
+	stats.TotalEventsRemoved += 2 * pairs
+	stats.TotalEventsCreated += pairs
+	return err
+}
 
-			db.Delete(&query)
-			db.Delete(&response)
-			stats.DNSPairsCompacted++
-			stats.TotalEventsRemoved += 2
-			stats.TotalEventsCreated++
+// compactUDP merges UDP_START and UDP_END pairs into single UDP records
+func (db *DB) compactUDP(from, to time.Time, run uint, stats *CompactStats) error {
+	pairs, err := db.compactPairs(from, to, run, pairSpec{
+		name:      "UDP",
+		where:     "event_type IN (?, ?)",
+		args:      []any{EventUDPStart, EventUDPEnd},
+		partition: "src_ip, src_port, dst_ip, dst_port",
+		isStart:   fmt.Sprintf("event_type = '%s'", EventUDPStart),
+		isEnd:     fmt.Sprintf("event_type = '%s'", EventUDPEnd),
+		window:    24 * time.Hour,
+		publish:   true,
+	}, func(start, end *NetworkEvent) NetworkEvent {
+		return NetworkEvent{
+			Timestamp:    start.Timestamp,
+			EndTime:      end.Timestamp,
+			EventType:    EventUDP,
+			FlowID:       start.FlowID,
+			Interface:    start.Interface,
+			VLAN:         start.VLAN,
+			InnerVLAN:    start.InnerVLAN,
+			Tunnel:       start.Tunnel,
+			TunnelID:     start.TunnelID,
+			TunnelSrcIP:  start.TunnelSrcIP,
+			TunnelDstIP:  start.TunnelDstIP,
+			IPVersion:    start.IPVersion,
+			SrcIP:        start.SrcIP,
+			SrcPort:      start.SrcPort,
+			DstIP:        start.DstIP,
+			DstPort:      start.DstPort,
+			Protocol:     start.Protocol,
+			Duration:     end.Duration,
+			ByteCount:    end.ByteCount,
+			SrcBytes:     end.SrcBytes,
+			DstBytes:     end.DstBytes,
+			P2P:          end.P2P,
+			Compacted:    true,
+			CaptureFile:  start.CaptureFile,
+			CaptureFrame: start.CaptureFrame,
 		}
+	})
+	stats.UDPPairsCompacted += pairs
+	stats.TotalEventsRemoved += 2 * pairs
+	stats.TotalEventsCreated += pairs
+	return err
+}
+
+// compactDNS merges DNS QUERY and RESPONSE pairs
+func (db *DB) compactDNS(from, to time.Time, run uint, pairing DNSPairing, stats *CompactStats) error {
+	// Responses travel back over the query's 5-tuple, so key both by the
+	// client side (query source, response destination)
+	client := "CASE WHEN dns_type = 'QUERY' THEN src_ip ELSE dst_ip END"
+	spec := pairSpec{
+		name:    "DNS",
+		where:   "event_type = ? AND dns_type IN (?, ?)",
+		args:    []any{EventDNS, "QUERY", "RESPONSE"},
+		isStart: "dns_type = 'QUERY'",
+		isEnd:   "dns_type = 'RESPONSE'",
+	}
+	if pairing == DNSPairByName {
+		spec.partition = "dns_query, " + client
+		spec.window = dnsNamePairWindow
+	} else {
+		spec.partition = "dns_id, dns_query, " + client + ", " +
+			"CASE WHEN dns_type = 'QUERY' THEN src_port ELSE dst_port END, " +
+			"CASE WHEN dns_type = 'QUERY' THEN dst_ip ELSE src_ip END, " +
+			"CASE WHEN dns_type = 'QUERY' THEN dst_port ELSE src_port END"
+		spec.window = dnsIDPairWindow
 	}
 
-	return nil
+	pairs, err := db.compactPairs(from, to, run, spec, func(query, response *NetworkEvent) NetworkEvent {
+		return NetworkEvent{
+			Timestamp:      query.Timestamp,
+			EndTime:        response.Timestamp,
+			EventType:      EventDNS,
+			Interface:      query.Interface,
+			VLAN:           query.VLAN,
+			InnerVLAN:      query.InnerVLAN,
+			Tunnel:         query.Tunnel,
+			TunnelID:       query.TunnelID,
+			TunnelSrcIP:    query.TunnelSrcIP,
+			TunnelDstIP:    query.TunnelDstIP,
+			IPVersion:      query.IPVersion,
+			SrcIP:          query.SrcIP,
+			SrcPort:        query.SrcPort,
+			DstIP:          query.DstIP,
+			DstPort:        query.DstPort,
+			DNSType:        "COMPLETE",
+			DNSID:          query.DNSID,
+			DNSQuery:       query.DNSQuery,
+			DNSAnswers:     response.DNSAnswers,
+			DNSCNAMEs:      response.DNSCNAMEs,
+			DNSRCode:       response.DNSRCode,
+			DNSAnswerCount: response.DNSAnswerCount,
+			DNSTTL:         response.DNSTTL,
+			Duration:       response.Timestamp.Sub(query.Timestamp).Milliseconds(),
+			Compacted:      true,
+			CaptureFile:    query.CaptureFile,
+			CaptureFrame:   query.CaptureFrame,
+		}
+	})
+	stats.DNSPairsCompacted += pairs
+	stats.TotalEventsRemoved += 2 * pairs
+	stats.TotalEventsCreated += pairs
+	return err
 }
 
 // deduplicateDNS removes duplicate DNS queries within a time window
-func (db *DB) deduplicateDNS(olderThan time.Time, window time.Duration, stats *CompactStats) error {
+func (db *DB) deduplicateDNS(from, to time.Time, window time.Duration, stats *CompactStats) error {
 	var events []NetworkEvent
-	db.Where("event_type = ? AND timestamp < ?", EventDNS, olderThan).
+	db.Where("event_type = ? AND timestamp >= ? AND timestamp < ?", EventDNS, from, to).
 		Order("dns_query, timestamp").
 		Find(&events)
 
@@ -308,8 +660,10 @@ func (db *DB) deduplicateDNS(olderThan time.Time, window time.Duration, stats *C
 	}
 
 	if len(toDelete) > 0 {
-		db.Where("id IN ?", toDelete).Delete(&NetworkEvent{})
-		stats.DuplicatesRemoved = int64(len(toDelete))
+		if err := db.Where("id IN ?", toDelete).Delete(&NetworkEvent{}).Error; err != nil {
+			return err
+		}
+		stats.DuplicatesRemoved += int64(len(toDelete))
 		stats.TotalEventsRemoved += int64(len(toDelete))
 	}
 
@@ -317,12 +671,12 @@ func (db *DB) deduplicateDNS(olderThan time.Time, window time.Duration, stats *C
 }
 
 // removeOrphanedEnds removes END events without matching START
-func (db *DB) removeOrphanedEnds(olderThan time.Time, stats *CompactStats) error {
+func (db *DB) removeOrphanedEnds(from, to time.Time, stats *CompactStats) error {
 	// Find TCP_END without TCP_START
 	result := db.Exec(`
 		DELETE FROM network_events 
 		WHERE event_type = 'TCP_END' 
-		AND timestamp < ?
+		AND timestamp >= ? AND timestamp < ?
 		AND NOT EXISTS (
 			SELECT 1 FROM network_events AS starts 
 			WHERE starts.event_type = 'TCP_START'
@@ -332,7 +686,10 @@ func (db *DB) removeOrphanedEnds(olderThan time.Time, stats *CompactStats) error
 			AND starts.dst_port = network_events.dst_port
 			AND starts.timestamp < network_events.timestamp
 		)
-	`, olderThan)
+	`, from, to)
+	if result.Error != nil {
+		return result.Error
+	}
 	stats.OrphanedEndsRemoved += result.RowsAffected
 	stats.TotalEventsRemoved += result.RowsAffected
 
@@ -340,7 +697,7 @@ func (db *DB) removeOrphanedEnds(olderThan time.Time, stats *CompactStats) error
 	result = db.Exec(`
 		DELETE FROM network_events 
 		WHERE event_type = 'UDP_END' 
-		AND timestamp < ?
+		AND timestamp >= ? AND timestamp < ?
 		AND NOT EXISTS (
 			SELECT 1 FROM network_events AS starts 
 			WHERE starts.event_type = 'UDP_START'
@@ -350,7 +707,10 @@ func (db *DB) removeOrphanedEnds(olderThan time.Time, stats *CompactStats) error
 			AND starts.dst_port = network_events.dst_port
 			AND starts.timestamp < network_events.timestamp
 		)
-	`, olderThan)
+	`, from, to)
+	if result.Error != nil {
+		return result.Error
+	}
 	stats.OrphanedEndsRemoved += result.RowsAffected
 	stats.TotalEventsRemoved += result.RowsAffected
 
@@ -361,6 +721,11 @@ func (db *DB) removeOrphanedEnds(olderThan time.Time, stats *CompactStats) error
 func (db *DB) CreateHourlySummary(olderThan time.Time) (int64, error) {
 	var count int64
 
+	// The events are deleted below, keep their weekly metrics first
+	if _, err := db.SummarizeWeeks(time.Now()); err != nil {
+		return 0, err
+	}
+
 	// Get distinct hours with events
 	var hours []struct {
 		Hour      string
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// observationKey identifies what an event saw on the wire, independent of
+// the sensor, interface and exact time it was captured at
+func (e *NetworkEvent) observationKey() string {
+	return fmt.Sprintf("%s|%s|%d|%s|%d|%s|%d|%s|%s", e.EventType, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+		e.DNSType, e.DNSID, e.DNSQuery, e.TLSSNI)
+}
+
+// SeenByOtherSensor reports for each event whether a sensor other than the
+// given one (including this host's own capture) already stored the same
+// observation within window of it. Two sensors on redundant routers see the
+// same traffic while it fails over, so events replicated from one to the
+// other are checked against this before being stored.
+func (db *DB) SeenByOtherSensor(events []NetworkEvent, sensor string, window time.Duration) ([]bool, error) {
+	seen := make([]bool, len(events))
+	if len(events) == 0 || window <= 0 {
+		return seen, nil
+	}
+	first, last := events[0].Timestamp, events[0].Timestamp
+	sources := make(map[string]bool)
+	for i := range events {
+		first = minTime(first, events[i].Timestamp)
+		last = maxTime(last, events[i].Timestamp)
+		sources[events[i].SrcIP] = true
+	}
+	srcIPs := make([]string, 0, len(sources))
+	for ip := range sources {
+		srcIPs = append(srcIPs, ip)
+	}
+
+	var stored []NetworkEvent
+	err := db.Model(&NetworkEvent{}).
+		Select("timestamp, event_type, src_ip, src_port, dst_ip, dst_port, dns_type, dns_id, dns_query, tls_sni").
+		Where("timestamp >= ? AND timestamp <= ? AND sensor != ? AND src_ip IN ?", first.Add(-window), last.Add(window), sensor, srcIPs).
+		Find(&stored).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up events of other sensors: %w", err)
+	}
+	times := make(map[string][]time.Time, len(stored))
+	for i := range stored {
+		key := stored[i].observationKey()
+		times[key] = append(times[key], stored[i].Timestamp)
+	}
+	for i := range events {
+		for _, t := range times[events[i].observationKey()] {
+			if d := t.Sub(events[i].Timestamp); d <= window && d >= -window {
+				seen[i] = true
+				break
+			}
+		}
+	}
+	return seen, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"net/netip"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Destination kinds: a domain asked for or connected to by name, and an
+// address outside the local networks connected to
+const (
+	DestinationDomain = "domain"
+	DestinationIP     = "ip"
+)
+
+// NewDestinationGap is how long a destination must go unseen to count as
+// new again when it comes back
+const NewDestinationGap = 30 * 24 * time.Hour
+
+// Destination records when local hosts first reached a domain or a remote
+// address. Like rollups it is maintained as events are inserted, so it
+// outlives compaction and retention; FirstSeen starts over when the
+// destination was not seen for NewDestinationGap.
+type Destination struct {
+	Kind        string    `gorm:"primaryKey" json:"kind"`
+	Name        string    `gorm:"primaryKey" json:"name"`
+	FirstSeen   time.Time `gorm:"index" json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	FirstClient string    `json:"firstClient"` // local host that reached it first
+	Events      int64     `json:"events"`
+}
+
+// destinationKey identifies one destination row
+type destinationKey struct {
+	kind, name string
+}
+
+// destinationLookupBatch is how many names recordDestinations loads per
+// query
+const destinationLookupBatch = 500
+
+// eventDestinations are the destinations an event sent by a local host
+// reaches. DNS responses are the resolver's, not the host's.
+func eventDestinations(e *NetworkEvent) []destinationKey {
+	if !isLocalAddr(e.SrcIP) || e.EventType == EventDNS && e.DNSType == "RESPONSE" {
+		return nil
+	}
+	var keys []destinationKey
+	if domain := rollupDomain(e); domain != "" {
+		keys = append(keys, destinationKey{DestinationDomain, domain})
+	}
+	if addr, err := netip.ParseAddr(e.DstIP); err == nil && addr.IsGlobalUnicast() && !isLocalAddr(e.DstIP) {
+		keys = append(keys, destinationKey{DestinationIP, addr.String()})
+	}
+	return keys
+}
+
+// see counts an event at ts from client into a destination. Events older
+// than the first sighting move it back unless a gap separates them, so a
+// backfill of old events keeps the latest appearance.
+func (d *Destination) see(ts time.Time, client string) {
+	switch {
+	case d.FirstSeen.IsZero(), ts.Sub(d.LastSeen) > NewDestinationGap:
+		d.FirstSeen, d.FirstClient = ts, client
+	case ts.Before(d.FirstSeen) && d.FirstSeen.Sub(ts) <= NewDestinationGap:
+		d.FirstSeen, d.FirstClient = ts, client
+	}
+	if ts.After(d.LastSeen) {
+		d.LastSeen = ts
+	}
+	d.Events++
+}
+
+// recordDestinations counts newly inserted events into the destinations
+// table, merging them with the stored rows
+func recordDestinations(tx *gorm.DB, events []NetworkEvent) error {
+	seen := make(map[destinationKey]*Destination)
+	names := make(map[string][]string)
+	for i := range events {
+		for _, key := range eventDestinations(&events[i]) {
+			if _, ok := seen[key]; !ok {
+				seen[key] = &Destination{Kind: key.kind, Name: key.name}
+				names[key.kind] = append(names[key.kind], key.name)
+			}
+		}
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+
+	for kind, list := range names {
+		for start := 0; start < len(list); start += destinationLookupBatch {
+			var stored []Destination
+			chunk := list[start:min(start+destinationLookupBatch, len(list))]
+			if err := tx.Where("kind = ? AND name IN ?", kind, chunk).Find(&stored).Error; err != nil {
+				return err
+			}
+			for _, d := range stored {
+				*seen[destinationKey{d.Kind, d.Name}] = d
+			}
+		}
+	}
+	for i := range events {
+		e := &events[i]
+		for _, key := range eventDestinations(e) {
+			seen[key].see(e.Timestamp.UTC(), e.SrcIP)
+		}
+	}
+
+	batch := make([]Destination, 0, len(seen))
+	for _, d := range seen {
+		batch = append(batch, *d)
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"first_seen", "last_seen", "first_client", "events"}),
+	}).CreateInBatches(batch, 200).Error
+}
+
+// BackfillDestinations records the destinations of the events stored
+// before the table existed, as BackfillRollups does for rollups
+func (db *DB) BackfillDestinations(upTo uint) (int64, error) {
+	return db.backfill(destinationsBackfill, upTo, recordDestinations)
+}
+
+// NewDestinations returns the destinations first seen since the given
+// time, newest first, of one kind or both when kind is empty
+func (db *DB) NewDestinations(since time.Time, kind string, limit int) ([]Destination, error) {
+	q := db.Where("first_seen >= ?", since.UTC())
+	if kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	var destinations []Destination
+	err := q.Order("first_seen DESC, kind, name").Limit(limit).Find(&destinations).Error
+	return destinations, err
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// contentHashIndex is the unique index on the content hashes of events;
+// events without a hash are left out of it
+const contentHashIndex = "idx_network_events_content_hash_unique"
+
+// insertUniqueAttempts bounds how often InsertUnique starts over after a
+// concurrent insert stored some of its events first
+const insertUniqueAttempts = 3
+
+// errHashConflict rolls back an insert that found some of its events
+// stored meanwhile
+var errHashConflict = errors.New("events stored concurrently")
+
+// MergeOptions controls an import of events from another database
+type MergeOptions struct {
+	BatchSize int                     // rows read and written per batch
+	Progress  func(read, total int64) // called after every batch
+}
+
+// MergeStats holds the outcome of one merged source
+type MergeStats struct {
+	SourceRows int64 `json:"sourceRows"`
+	Imported   int64 `json:"imported"`
+	Duplicates int64 `json:"duplicates"` // already in the target, or repeated within the source
+	Hashed     int64 `json:"hashed"`     // target rows that got a content hash before the merge
+}
+
+// ContentHash identifies an event by what was captured, leaving out its ID,
+// enrichment (threat and anomaly fields, hostname) and packet reference, so
+// the same event imported twice or recorded in two copies of a database
+// hashes the same. Timestamps count to the microsecond, the precision every
+// backend keeps.
+func (e *NetworkEvent) ContentHash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%s|%s|%s|%d|%s|%s|%d|%s|%d|", e.Timestamp.UnixMicro(), e.EventType, e.Sensor, e.Interface,
+		e.IPVersion, e.FlowID, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort)
+	fmt.Fprintf(h, "%s|%d|%s|%s|%s|%s|%d|%d|", e.DNSType, e.DNSID, e.DNSQuery, e.DNSAnswers, e.DNSCNAMEs,
+		e.DNSRCode, e.DNSAnswerCount, e.DNSTTL)
+	fmt.Fprintf(h, "%s|%s|%s|%s|%s|%s|%t|", e.TLSSNI, e.TLSJA3, e.TLSJA4, e.TLSVersion, e.TLSCipher, e.TLSALPN, e.TLSECH)
+	fmt.Fprintf(h, "%d|%d|%s|%d|%d|%d|%s|%s|%t|%d", e.Duration, e.ByteCount, e.Reason, e.EndTime.UnixMicro(),
+		e.ICMPType, e.ICMPCode, e.ICMPDesc, e.Protocol, e.Compacted, e.EventCount)
+	// Added later; left out when empty so earlier events keep their hashes
+	if e.ICMPOrigProto != "" {
+		fmt.Fprintf(h, "|%s|%s|%d|%s|%d", e.ICMPOrigProto, e.ICMPOrigSrcIP, e.ICMPOrigSrcPort, e.ICMPOrigDstIP, e.ICMPOrigDstPort)
+	}
+	if e.VLAN != 0 || e.InnerVLAN != 0 {
+		fmt.Fprintf(h, "|vlan %d.%d", e.VLAN, e.InnerVLAN)
+	}
+	if e.Tunnel != "" {
+		fmt.Fprintf(h, "|tunnel %s %d %s %s", e.Tunnel, e.TunnelID, e.TunnelSrcIP, e.TunnelDstIP)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Merge imports the events of src into dst with new IDs, skipping events
+// whose content hash dst already holds. Hashes of dst's own events are
+// filled in first, so merging the same source twice imports nothing.
+func Merge(src, dst *DB, opts MergeOptions) (*MergeStats, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	stats := &MergeStats{}
+
+	hashed, err := dst.fillContentHashes(opts.BatchSize)
+	stats.Hashed = hashed
+	if err != nil {
+		return stats, err
+	}
+
+	if err := src.Model(&NetworkEvent{}).Count(&stats.SourceRows).Error; err != nil {
+		return stats, fmt.Errorf("failed to count source rows: %w", err)
+	}
+
+	var lastID uint
+	var read int64
+	for {
+		var batch []NetworkEvent
+		if err := src.Where("id > ?", lastID).Order("id ASC").Limit(opts.BatchSize).Find(&batch).Error; err != nil {
+			return stats, fmt.Errorf("failed to read batch after id %d: %w", lastID, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		lastID = batch[len(batch)-1].ID
+		read += int64(len(batch))
+
+		imported, duplicates, err := dst.InsertUnique(batch)
+		stats.Imported += int64(imported)
+		stats.Duplicates += int64(duplicates)
+		if err != nil {
+			return stats, fmt.Errorf("failed to import batch after id %d: %w", lastID, err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(read, stats.SourceRows)
+		}
+	}
+	return stats, nil
+}
+
+// InsertUnique stores the events whose content hash is not in the database
+// yet, with new IDs and their hash set, and returns how many were inserted
+// and skipped. The events are modified in place. The hash is unique in the
+// database, so a producer retrying a batch while the first attempt is still
+// being stored gets no duplicates: the insert that loses the race starts
+// over and finds the events stored.
+func (db *DB) InsertUnique(events []NetworkEvent) (inserted, duplicates int, err error) {
+	hashes := make([]string, len(events))
+	for i := range events {
+		hashes[i] = events[i].ContentHash()
+	}
+	for range insertUniqueAttempts - 1 {
+		inserted, duplicates, err = db.insertUnique(events, hashes)
+		if !errors.Is(err, errHashConflict) {
+			return inserted, duplicates, err
+		}
+	}
+	return db.insertUnique(events, hashes)
+}
+
+// insertUnique is one attempt of InsertUnique
+func (db *DB) insertUnique(events []NetworkEvent, hashes []string) (inserted, duplicates int, err error) {
+	var existing []string
+	if err := db.Model(&NetworkEvent{}).Where("content_hash IN ?", hashes).Pluck("content_hash", &existing).Error; err != nil {
+		return 0, 0, fmt.Errorf("failed to look up existing events: %w", err)
+	}
+	seen := make(map[string]bool, len(existing)+len(events))
+	for _, h := range existing {
+		seen[h] = true
+	}
+
+	fresh := make([]NetworkEvent, 0, len(events))
+	var indexes []int
+	for i := range events {
+		events[i].ID = 0
+		if seen[hashes[i]] {
+			duplicates++
+			continue
+		}
+		seen[hashes[i]] = true
+		events[i].Hash = hashes[i]
+		fresh = append(fresh, events[i])
+		indexes = append(indexes, i)
+	}
+	if len(fresh) == 0 {
+		return 0, duplicates, nil
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Events another insert stored since the lookup are skipped, which
+		// leaves the IDs returned out of step with fresh: start over then
+		result := tx.Clauses(clause.OnConflict{
+			Columns:     []clause.Column{{Name: "content_hash"}},
+			TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "content_hash <> ''"}}},
+			DoNothing:   true,
+		}).CreateInBatches(fresh, 100)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(fresh)) {
+			return errHashConflict
+		}
+		if err := addRollups(tx, fresh); err != nil {
+			return err
+		}
+		return recordDestinations(tx, fresh)
+	})
+	if err != nil {
+		return 0, duplicates, err
+	}
+	for j, i := range indexes {
+		events[i].ID = fresh[j].ID
+	}
+	return len(fresh), duplicates, nil
+}
+
+// fillContentHashes stores the content hash of every event that has none
+// and returns how many were updated. Events identical to one holding the
+// hash already keep none, as the hash is unique.
+func (db *DB) fillContentHashes(batchSize int) (int64, error) {
+	var updated int64
+	var lastID uint
+	for {
+		var batch []NetworkEvent
+		err := db.Where("id > ? AND (content_hash = '' OR content_hash IS NULL)", lastID).Order("id ASC").Limit(batchSize).Find(&batch).Error
+		if err != nil {
+			return updated, fmt.Errorf("failed to read events without hash: %w", err)
+		}
+		if len(batch) == 0 {
+			return updated, nil
+		}
+		lastID = batch[len(batch)-1].ID
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for i := range batch {
+				hash := batch[i].ContentHash()
+				result := tx.Exec("UPDATE network_events SET content_hash = ? WHERE id = ? AND NOT EXISTS "+
+					"(SELECT 1 FROM network_events WHERE content_hash = ?)", hash, batch[i].ID, hash)
+				if result.Error != nil {
+					return result.Error
+				}
+				updated += result.RowsAffected
+			}
+			return nil
+		})
+		if err != nil {
+			return updated, fmt.Errorf("failed to store content hashes: %w", err)
+		}
+	}
+}
+
+// uniqueContentHashes prepares a database created while content hashes
+// were not unique for their unique index: identical events stored twice by
+// concurrent imports keep the hash only on the first, and the plain index
+// it replaces is dropped. It runs before the tables are migrated.
+func uniqueContentHashes(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&NetworkEvent{}) || !m.HasColumn(&NetworkEvent{}, "content_hash") || m.HasIndex(&NetworkEvent{}, contentHashIndex) {
+		return nil
+	}
+	log.Info("Making event content hashes unique (one-time)")
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("UPDATE network_events SET content_hash = '' WHERE content_hash <> '' AND id NOT IN " +
+			"(SELECT MIN(id) FROM network_events WHERE content_hash <> '' GROUP BY content_hash)").Error
+		if err != nil {
+			return fmt.Errorf("failed to clear repeated content hashes: %w", err)
+		}
+		if tx.Migrator().HasIndex(&NetworkEvent{}, "idx_network_events_content_hash") {
+			if err := tx.Migrator().DropIndex(&NetworkEvent{}, "idx_network_events_content_hash"); err != nil {
+				return fmt.Errorf("failed to drop the content hash index: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// migrateInsertBatch is how many rows one INSERT writes, whatever the read
+// batch size, to stay below the bound variable limits of SQLite and Postgres
+const migrateInsertBatch = 100
+
+// migrateChunkBatch caps the compaction archive chunks copied per batch,
+// which hold compressed events rather than one row's worth of data
+const migrateChunkBatch = 50
+
+// Open connects to a database given as "sqlite:path", "postgres://..." or a
+// plain SQLite file path
+func Open(dsn string) (*DB, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+			Logger: logger.Default.LogMode(logger.Silent),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return setup(db)
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return New(strings.TrimPrefix(dsn, "sqlite://"))
+	case strings.HasPrefix(dsn, "sqlite:"):
+		return New(strings.TrimPrefix(dsn, "sqlite:"))
+	}
+	return New(dsn)
+}
+
+// MigrateOptions controls a database-to-database copy
+type MigrateOptions struct {
+	BatchSize int                       // rows read and written per batch
+	Progress  func(copied, total int64) // called after every batch
+}
+
+// MigrateStats holds the outcome of a copy and its validation counts
+type MigrateStats struct {
+	SourceRows  int64            `json:"sourceRows"`
+	SkippedRows int64            `json:"skippedRows"` // already present in the target from an earlier run
+	CopiedRows  int64            `json:"copiedRows"`
+	TargetRows  int64            `json:"targetRows"`
+	Tables      map[string]int64 `json:"tables"`     // rows copied into every other table, by table name
+	Mismatches  []string         `json:"mismatches"` // event types and tables whose counts differ between source and target
+}
+
+// Migrate copies all events from src to dst in ID order, keeping their IDs,
+// then every other table: side tables, baselines, weekly summaries,
+// compaction runs and archives, counters, views, rollups with their
+// backfill state, destinations and beacons. Events already in dst (from an
+// interrupted run) are skipped and rows of other tables overwritten, so the
+// copy can be restarted safely.
+func Migrate(src, dst *DB, opts MigrateOptions) (*MigrateStats, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	stats := &MigrateStats{}
+
+	if err := src.Model(&NetworkEvent{}).Count(&stats.SourceRows).Error; err != nil {
+		return nil, fmt.Errorf("failed to count source rows: %w", err)
+	}
+
+	var lastID uint
+	if err := dst.Model(&NetworkEvent{}).Select("COALESCE(MAX(id), 0)").Scan(&lastID).Error; err != nil {
+		return nil, fmt.Errorf("failed to read target position: %w", err)
+	}
+	if lastID > 0 {
+		src.Model(&NetworkEvent{}).Where("id <= ?", lastID).Count(&stats.SkippedRows)
+	}
+
+	for {
+		var batch []NetworkEvent
+		if err := src.Where("id > ?", lastID).Order("id ASC").Limit(opts.BatchSize).Find(&batch).Error; err != nil {
+			return stats, fmt.Errorf("failed to read batch after id %d: %w", lastID, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if err := dst.CreateInBatches(batch, migrateInsertBatch).Error; err != nil {
+			return stats, fmt.Errorf("failed to write batch after id %d: %w", lastID, err)
+		}
+		lastID = batch[len(batch)-1].ID
+		stats.CopiedRows += int64(len(batch))
+		if opts.Progress != nil {
+			opts.Progress(stats.SkippedRows+stats.CopiedRows, stats.SourceRows)
+		}
+	}
+
+	stats.Tables = make(map[string]int64)
+	for _, model := range models {
+		if _, ok := model.(*NetworkEvent); ok {
+			continue
+		}
+		if err := migrateTable(src, dst, model, opts.BatchSize, stats); err != nil {
+			return stats, err
+		}
+	}
+
+	// Explicit IDs bypass Postgres sequences, so move them past the copied rows
+	if dst.Dialector.Name() == "postgres" {
+		for _, model := range models {
+			s, err := parseModel(model)
+			if err != nil {
+				return stats, err
+			}
+			if pk := s.PrioritizedPrimaryField; pk == nil || !pk.AutoIncrement {
+				continue
+			}
+			sql := fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', '%[2]s'), COALESCE(MAX(%[2]s), 0) + 1, false) FROM %[1]s",
+				s.Table, s.PrioritizedPrimaryField.DBName)
+			if err := dst.Exec(sql).Error; err != nil {
+				return stats, fmt.Errorf("failed to reset id sequence of %s: %w", s.Table, err)
+			}
+		}
+	}
+
+	if err := validateMigration(src, dst, stats); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+var migrateSchemas sync.Map
+
+// parseModel returns the schema of one of the models
+func parseModel(model any) (*schema.Schema, error) {
+	return schema.Parse(model, &migrateSchemas, schema.NamingStrategy{})
+}
+
+// migrateTable copies every row of one table in primary key order,
+// replacing rows dst already has
+func migrateTable(src, dst *DB, model any, batchSize int, stats *MigrateStats) error {
+	s, err := parseModel(model)
+	if err != nil {
+		return fmt.Errorf("failed to parse model %T: %w", model, err)
+	}
+	if _, ok := model.(*ArchiveChunk); ok {
+		batchSize = min(batchSize, migrateChunkBatch)
+	}
+	order := strings.Join(s.PrimaryFieldDBNames, ", ")
+	for offset := 0; ; offset += batchSize {
+		batch := reflect.New(reflect.SliceOf(s.ModelType))
+		if err := src.Model(model).Order(order).Offset(offset).Limit(batchSize).Find(batch.Interface()).Error; err != nil {
+			return fmt.Errorf("failed to read %s at row %d: %w", s.Table, offset, err)
+		}
+		n := batch.Elem().Len()
+		if n == 0 {
+			return nil
+		}
+		if err := dst.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(batch.Interface(), migrateInsertBatch).Error; err != nil {
+			return fmt.Errorf("failed to write %s at row %d: %w", s.Table, offset, err)
+		}
+		stats.Tables[s.Table] += int64(n)
+	}
+}
+
+// validateMigration compares total and per-type event counts of both
+// databases, and the row counts of every other table
+func validateMigration(src, dst *DB, stats *MigrateStats) error {
+	if err := dst.Model(&NetworkEvent{}).Count(&stats.TargetRows).Error; err != nil {
+		return fmt.Errorf("failed to count target rows: %w", err)
+	}
+
+	type typeCount struct {
+		EventType string
+		Count     int64
+	}
+	countByType := func(db *DB) (map[string]int64, error) {
+		var rows []typeCount
+		err := db.Model(&NetworkEvent{}).Select("event_type, count(*) as count").Group("event_type").Scan(&rows).Error
+		counts := make(map[string]int64, len(rows))
+		for _, r := range rows {
+			counts[r.EventType] = r.Count
+		}
+		return counts, err
+	}
+
+	srcCounts, err := countByType(src)
+	if err != nil {
+		return fmt.Errorf("failed to count source event types: %w", err)
+	}
+	dstCounts, err := countByType(dst)
+	if err != nil {
+		return fmt.Errorf("failed to count target event types: %w", err)
+	}
+	for t, n := range srcCounts {
+		if dstCounts[t] != n {
+			stats.Mismatches = append(stats.Mismatches, fmt.Sprintf("%s: source=%d target=%d", t, n, dstCounts[t]))
+		}
+	}
+	for t, n := range dstCounts {
+		if _, ok := srcCounts[t]; !ok {
+			stats.Mismatches = append(stats.Mismatches, fmt.Sprintf("%s: source=0 target=%d", t, n))
+		}
+	}
+
+	for _, model := range models {
+		if _, ok := model.(*NetworkEvent); ok {
+			continue
+		}
+		s, err := parseModel(model)
+		if err != nil {
+			return err
+		}
+		var srcRows, dstRows int64
+		if err := src.Model(model).Count(&srcRows).Error; err != nil {
+			return fmt.Errorf("failed to count source rows of %s: %w", s.Table, err)
+		}
+		if err := dst.Model(model).Count(&dstRows).Error; err != nil {
+			return fmt.Errorf("failed to count target rows of %s: %w", s.Table, err)
+		}
+		if srcRows != dstRows {
+			stats.Mismatches = append(stats.Mismatches, fmt.Sprintf("table %s: source=%d target=%d", s.Table, srcRows, dstRows))
+		}
+	}
+	return nil
+}
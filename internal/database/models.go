@@ -1,6 +1,8 @@
 package database
 
 import (
+	"fmt"
+	"net"
 	"time"
 )
 
@@ -16,6 +18,32 @@ const (
 	EventTLSSNI   EventType = "TLS_SNI"
 	EventICMP     EventType = "ICMP"
 	EventTimeout  EventType = "TIMEOUT"
+	EventVPN      EventType = "VPN" // WireGuard, IPsec or OpenVPN tunnel, named in Protocol
+
+	// EventRemoteAccess is an SSH or RDP session on any port, named in Protocol
+	EventRemoteAccess EventType = "REMOTE_ACCESS"
+
+	// EventFileShare is a closed SMB or NFS flow, named in Protocol
+	EventFileShare EventType = "FILESHARE"
+
+	// EventNTP is a device synchronising with a time server, over NTP or NTS
+	// as named in Protocol; written once an hour per device and server
+	EventNTP EventType = "NTP"
+
+	// EventRateLimited summarises events dropped by the per-source rate limiter
+	EventRateLimited EventType = "RATE_LIMITED"
+
+	// EventSampled summarises events skipped by per-source sampling
+	EventSampled EventType = "SAMPLED"
+
+	// EventScan is a source probing many ports of one host or one port of
+	// many hosts; EventCount holds the ports or hosts, Reason the attempts
+	EventScan EventType = "SCAN"
+
+	// EventCaptureGap is a period an interface was not captured, from its
+	// link going down or its capture failing until capture resumed at
+	// EndTime; Reason says why
+	EventCaptureGap EventType = "CAPTURE_GAP"
 
 	// Compacted event types
 	EventTCP           EventType = "TCP"    // Merged TCP_START + TCP_END
@@ -23,47 +51,160 @@ const (
 	EventHourlySummary EventType = "HOURLY" // Hourly aggregation
 )
 
-// NetworkEvent represents a captured network event
+// NetworkEvent represents a captured network event.
+//
+// Besides the single-column indexes it has three composite ones:
+// idx_events_pair serves START/END pairing, idx_events_time_type time
+// range queries filtered by type, and idx_events_timeline covers the
+// columns the timeline buckets read, so they never touch the table rows.
 type NetworkEvent struct {
 	ID        uint      `gorm:"primaryKey"`
-	Timestamp time.Time `gorm:"index;not null"`
-	EventType EventType `gorm:"index;not null"`
+	Timestamp time.Time `gorm:"index;not null;index:idx_events_time_type,priority:1;index:idx_events_timeline,priority:1;index:idx_events_pair,priority:6"`
+	EventType EventType `gorm:"index;not null;index:idx_events_time_type,priority:2;index:idx_events_pair,priority:1"`
 	Interface string    `gorm:"index"`
-	IPVersion uint8     `gorm:"index"` // 4 or 6
+	VLAN      uint16    `gorm:"index;default:0"` // 802.1Q tag, the service tag for QinQ; 0 when untagged
+	InnerVLAN uint16    `gorm:"default:0"`       // QinQ (802.1ad) customer tag
+	IPVersion uint8     `gorm:"index"`           // 4 or 6
+	FlowID    string    `gorm:"index"`           // Shared by all events of one connection
+	Sensor    string    `gorm:"index"`           // External sensor that sent the event; empty when captured here
+
+	// Tunnel the packets were unwrapped from (GRE, VXLAN, Geneve or IPIP),
+	// its key or VNI, and the outer endpoints; empty for untunnelled traffic
+	Tunnel      string `gorm:"index"`
+	TunnelID    uint32 `gorm:"default:0"`
+	TunnelSrcIP string
+	TunnelDstIP string
 
 	// Connection info
-	SrcIP   string `gorm:"index"`
-	SrcPort uint16
-	DstIP   string `gorm:"index"`
-	DstPort uint16
+	SrcIP   string `gorm:"index;index:idx_events_pair,priority:2;index:idx_events_timeline,priority:2"`
+	SrcPort uint16 `gorm:"index:idx_events_pair,priority:3"`
+	DstIP   string `gorm:"index;index:idx_events_pair,priority:4;index:idx_events_timeline,priority:3"`
+	DstPort uint16 `gorm:"index:idx_events_pair,priority:5"`
 
 	// DNS specific
-	DNSType    string // QUERY or RESPONSE
-	DNSQuery   string `gorm:"index"` // Domain name
-	DNSAnswers string // Comma-separated IPs
-	DNSCNAMEs  string // Comma-separated CNAME chain
+	DNSType        string // QUERY or RESPONSE
+	DNSID          uint16 `gorm:"index"` // Transaction ID, shared by a query and its response
+	DNSQuery       string `gorm:"index"` // Domain name
+	DNSAnswers     string `gorm:"-"`     // Comma-separated IPs (side table, see DNSAnswerDetail)
+	DNSCNAMEs      string `gorm:"-"`     // Comma-separated CNAME chain
+	DNSRCode       string `gorm:"index"` // Response code (NOERROR, NXDOMAIN, SERVFAIL, ...)
+	DNSAnswerCount uint16 // Number of answer records
+	DNSTTL         uint32 // Lowest answer TTL in seconds
 
 	// TLS specific
-	TLSSNI string `gorm:"index"`
+	TLSSNI     string `gorm:"index"`
+	TLSJA3     string `gorm:"index"` // MD5 of the JA3 client fingerprint
+	TLSJA4     string `gorm:"index"` // JA4 client fingerprint
+	TLSVersion string `gorm:"index"` // Negotiated version (TLS1.0 ... TLS1.3)
+	TLSCipher  string // Negotiated cipher suite
+	TLSALPN    string // Negotiated ALPN (h2, ...), or the offered list when encrypted (TLS 1.3)
+	TLSECH     bool   `gorm:"index"` // Client offered Encrypted ClientHello / ESNI
+
+	// Remote access (SSH, RDP)
+	RemoteVersion string `gorm:"index"` // Negotiated SSH protocol version or RDP security protocol
+	RemoteClient  string // SSH client software, or the RDP security protocols offered
+	RemoteServer  string // SSH server software
+
+	// File sharing (SMB, NFS), stored in a side table (see FileShareDetail)
+	ShareServer  string `gorm:"-"` // Server name in SMB tree paths
+	Shares       string `gorm:"-"` // Shares (SMB) or exports (NFS) accessed, comma-separated
+	ShareVersion string `gorm:"-"` // SMB dialect or NFS version, noting SMB3 encryption
+
+	// Time synchronisation, stored in a side table (see NTPDetail)
+	NTPVersion uint8  `gorm:"-"`
+	NTPStratum uint8  `gorm:"-"` // Server's distance from a reference clock, 1 for the clock's own server
+	NTPRefID   string `gorm:"-"` // Reference clock (GPS, PPS, ...) or the server's upstream address
 
 	// Connection lifecycle
-	Hostname  string // Resolved hostname from DNS cache
-	DNSAge    int64  // Milliseconds since DNS resolution
-	Duration  int64  // Milliseconds (for END events or compacted)
-	ByteCount int64
+	Hostname  string    // Resolved hostname from DNS cache
+	DNSAge    int64     // Milliseconds since DNS resolution
+	Duration  int64     // Milliseconds (for END events or compacted)
+	ByteCount int64     `gorm:"index:idx_events_timeline,priority:4"`
+	SrcBytes  int64     `gorm:"default:0"` // Of ByteCount, sent by SrcIP (END events)
+	DstBytes  int64     `gorm:"default:0"` // Of ByteCount, sent by DstIP (END events)
 	Reason    string    // FIN, RST, TIMEOUT
-	EndTime   time.Time // End timestamp for compacted events
+	EndTime   time.Time // End timestamp for compacted events, last packet of timed-out flows
 
-	// ICMP specific
-	ICMPType uint8
-	ICMPCode uint8
-	ICMPDesc string
+	// ICMP specific, stored in a side table (see ICMPDetail)
+	ICMPType uint8  `gorm:"-"`
+	ICMPCode uint8  `gorm:"-"`
+	ICMPDesc string `gorm:"-"`
+	// Packet an ICMP error (unreachable, time exceeded, ...) was sent in
+	// response to, from the header quoted in its payload
+	ICMPOrigProto   string `gorm:"-"` // TCP, UDP, ICMP or the IP protocol number
+	ICMPOrigSrcIP   string `gorm:"-"`
+	ICMPOrigSrcPort uint16 `gorm:"-"`
+	ICMPOrigDstIP   string `gorm:"-"`
+	ICMPOrigDstPort uint16 `gorm:"-"`
 
 	// Protocol for timeout events
 	Protocol string
 
-	// Compaction metadata
+	// Threat intelligence
+	Threat     bool   `gorm:"index"` // Matched a blocklist entry
+	ThreatList string // Comma-separated names of matching blocklists
+
+	// Anomaly scoring
+	AnomalyScore   uint8  `gorm:"index"` // 0-100, higher is more unusual for the source
+	AnomalyReasons string // Comma-separated: novel_destination, rare_port, odd_hour, large_volume
+
+	// Labels from tag rules
+	Tags string `gorm:"index"` // Comma-separated, sorted
+
+	// BitTorrent traffic class: dht, utp, tracker or peer; empty for other traffic
+	P2P string `gorm:"column:p2p;index"`
+
+	// Raw packet reference, set when packet recording is enabled
+	CaptureFile  string // Capture archive file holding the packet
+	CaptureFrame uint64 // 1-based frame number within CaptureFile
+
+	// Compaction metadata; all but Compacted in a side table (see CompactionDetail)
 	Compacted   bool   // Whether this is a compacted record
-	OriginalIDs string // Comma-separated original event IDs (for audit)
-	EventCount  int64  // Count of events (for hourly summaries)
+	OriginalRef string `gorm:"-"` // Undo archive entry of the merged events, run:chunk:index (see Originals)
+	EventCount  int64  `gorm:"-"` // Count of events (for hourly summaries)
+
+	// Identical events of the same flow folded into this one as they were
+	// captured (see --dedup-window); EndTime is the last of them
+	Repeats int64 `gorm:"default:0"`
+
+	// Set by merge to recognise events already imported (see ContentHash)
+	Hash string `gorm:"column:content_hash;uniqueIndex:idx_network_events_content_hash_unique,where:content_hash <> ''"`
+}
+
+// VLANTag describes the VLAN tags, such as "100" or "100.20" for QinQ
+// (service.customer), or is empty for untagged traffic
+func (e *NetworkEvent) VLANTag() string {
+	switch {
+	case e.InnerVLAN != 0:
+		return fmt.Sprintf("%d.%d", e.VLAN, e.InnerVLAN)
+	case e.VLAN != 0:
+		return fmt.Sprint(e.VLAN)
+	}
+	return ""
+}
+
+// TunnelInfo describes the tunnel the event was unwrapped from, such as
+// "VXLAN 5001 10.0.0.1 -> 10.0.0.2", or is empty for untunnelled traffic
+func (e *NetworkEvent) TunnelInfo() string {
+	switch {
+	case e.Tunnel == "":
+		return ""
+	case e.TunnelID != 0:
+		return fmt.Sprintf("%s %d %s -> %s", e.Tunnel, e.TunnelID, e.TunnelSrcIP, e.TunnelDstIP)
+	}
+	return fmt.Sprintf("%s %s -> %s", e.Tunnel, e.TunnelSrcIP, e.TunnelDstIP)
+}
+
+// ICMPOrigin describes the packet an ICMP error was about, such as
+// "UDP 10.0.0.5:5353 -> 8.8.8.8:53", or is empty for other events
+func (e *NetworkEvent) ICMPOrigin() string {
+	if e.ICMPOrigProto == "" {
+		return ""
+	}
+	if e.ICMPOrigSrcPort == 0 && e.ICMPOrigDstPort == 0 {
+		return fmt.Sprintf("%s %s -> %s", e.ICMPOrigProto, e.ICMPOrigSrcIP, e.ICMPOrigDstIP)
+	}
+	return fmt.Sprintf("%s %s -> %s", e.ICMPOrigProto,
+		net.JoinHostPort(e.ICMPOrigSrcIP, fmt.Sprint(e.ICMPOrigSrcPort)),
+		net.JoinHostPort(e.ICMPOrigDstIP, fmt.Sprint(e.ICMPOrigDstPort)))
 }
@@ -7,6 +7,12 @@ type EventPublisher interface {
 	PublishEvent(event interface{})
 }
 
+// BatchPublisher is implemented by publishers that deliver a batch of
+// events at once
+type BatchPublisher interface {
+	PublishEvents(events []NetworkEvent)
+}
+
 // Global event publisher (set by web server)
 var globalPublisher EventPublisher
 
@@ -21,3 +27,18 @@ func PublishEvent(event interface{}) {
 		globalPublisher.PublishEvent(event)
 	}
 }
+
+// PublishEvents publishes freshly written events, in one batch when the
+// publisher supports it
+func PublishEvents(events []NetworkEvent) {
+	if globalPublisher == nil || len(events) == 0 {
+		return
+	}
+	if bp, ok := globalPublisher.(BatchPublisher); ok {
+		bp.PublishEvents(events)
+		return
+	}
+	for i := range events {
+		globalPublisher.PublishEvent(&events[i])
+	}
+}
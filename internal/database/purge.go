@@ -0,0 +1,322 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
+)
+
+// ErrNoPurgeCriteria is returned by Purge when nothing narrows what it
+// deletes; deleting every event is a job for rm
+var ErrNoPurgeCriteria = errors.New("purge needs at least one of before, domain or ip")
+
+// PurgeCriteria selects the events Purge deletes: those matching every
+// criterion given
+type PurgeCriteria struct {
+	Before time.Time `json:"before,omitzero"` // events older than this
+	// Hostname, DNS query or TLS SNI; * matches any characters, so
+	// *.example.com matches every subdomain
+	Domain string `json:"domain,omitempty"`
+	// Source, destination, tunnel endpoint or ICMP original address
+	IP     string `json:"ip,omitempty"`
+	DryRun bool   `json:"dryRun,omitempty"` // only count what would be deleted
+}
+
+// PurgeStats reports what Purge deleted and the space it gave back
+type PurgeStats struct {
+	Events    int64 `json:"events"`    // events deleted, or matching with DryRun
+	Originals int64 `json:"originals"` // archived originals of deleted compacted records
+	Baselines int64 `json:"baselines"` // anomaly baselines of the purged IP
+	// Database size before and after, and what was freed: returned to the
+	// file system, or kept as free pages for new events when the database
+	// has no incremental vacuum (see New)
+	SizeBefore int64 `json:"sizeBefore"`
+	SizeAfter  int64 `json:"sizeAfter"`
+	Freed      int64 `json:"freed"`
+	Reusable   int64 `json:"reusable"`
+}
+
+// purgeBatch is how many events Purge deletes per transaction, so a
+// running capture is not locked out for long
+const purgeBatch = 5000
+
+// ParseBefore parses the before criterion, a date (YYYY-MM-DD, midnight
+// UTC) or an RFC 3339 time
+func ParseBefore(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// Validate checks that the criteria select something narrower than
+// everything and that the IP is an address
+func (c *PurgeCriteria) Validate() error {
+	c.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(c.Domain), "."))
+	c.IP = strings.TrimSpace(c.IP)
+	if c.Before.IsZero() && c.Domain == "" && c.IP == "" {
+		return ErrNoPurgeCriteria
+	}
+	if c.Domain == "*" {
+		return fmt.Errorf("domain %q matches every domain, use before instead", c.Domain)
+	}
+	if c.IP != "" {
+		addr, err := netip.ParseAddr(c.IP)
+		if err != nil {
+			return fmt.Errorf("invalid IP %q", c.IP)
+		}
+		c.IP = addr.String()
+	}
+	return nil
+}
+
+// apply narrows an event query to the criteria
+func (c *PurgeCriteria) apply(q *gorm.DB) *gorm.DB {
+	if !c.Before.IsZero() {
+		q = q.Where("timestamp < ?", c.Before)
+	}
+	if c.Domain != "" {
+		pattern := c.domainPattern()
+		q = q.Where(`(LOWER(hostname) LIKE ? ESCAPE '\' OR LOWER(dns_query) LIKE ? ESCAPE '\' OR LOWER(tls_sni) LIKE ? ESCAPE '\')`,
+			pattern, pattern, pattern)
+	}
+	if c.IP != "" {
+		icmp := q.Session(&gorm.Session{NewDB: true}).Model(&ICMPDetail{}).Select("event_id").
+			Where("icmp_orig_src_ip = ? OR icmp_orig_dst_ip = ?", c.IP, c.IP)
+		q = q.Where("(src_ip = ? OR dst_ip = ? OR tunnel_src_ip = ? OR tunnel_dst_ip = ? OR id IN (?))",
+			c.IP, c.IP, c.IP, c.IP, icmp)
+	}
+	return q
+}
+
+// domainPattern is the domain criterion as a LIKE pattern escaped by \
+func (c *PurgeCriteria) domainPattern() string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%").Replace(c.Domain)
+}
+
+// Purge deletes the events matching the criteria, with their side-table
+// rows and the archived originals of compacted ones, and for an IP its
+// anomaly baseline, for requests to delete a device's or a site's history.
+// Deleted events are taken out of the rollups, and a purged IP's or
+// domain's rollup rows, destinations and beacons go with them.
+// Weekly summaries keep their aggregate counts. Deleted pages are zeroed
+// and, with incremental vacuum, given back to the file system. Cancelling
+// ctx stops after the batch in progress; what was deleted stays deleted.
+func (db *DB) Purge(ctx context.Context, c PurgeCriteria) (*PurgeStats, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	stats := &PurgeStats{}
+	if c.DryRun {
+		err := c.apply(db.WithContext(ctx).Model(&NetworkEvent{})).Count(&stats.Events).Error
+		return stats, err
+	}
+
+	sqlite := db.Dialector.Name() == "sqlite"
+	stats.SizeBefore = db.size()
+	err := db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		conn = conn.Session(&gorm.Session{NewDB: true}) // statements of their own, on this connection
+		if sqlite {
+			// Overwrite deleted content instead of leaving it in free pages
+			conn.Exec("PRAGMA secure_delete=ON")
+			defer conn.Exec("PRAGMA secure_delete=OFF")
+		}
+		for ctx.Err() == nil {
+			var ids []uint
+			if err := c.apply(conn.Model(&NetworkEvent{})).Limit(purgeBatch).Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				break
+			}
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				originals, err := purgeOriginals(tx, ids)
+				if err != nil {
+					return err
+				}
+				var counted []NetworkEvent
+				if err := tx.Model(&NetworkEvent{}).Select(rollupColumns).Where("id IN ?", ids).Find(&counted).Error; err != nil {
+					return err
+				}
+				if err := removeRollups(tx, counted); err != nil {
+					return err
+				}
+				res := tx.Where("id IN ?", ids).Delete(&NetworkEvent{})
+				if res.Error != nil {
+					return res.Error
+				}
+				stats.Events += res.RowsAffected
+				stats.Originals += originals
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			log.Debug("[PURGE] Batch deleted", "events", len(ids), "total", stats.Events)
+			if len(ids) < purgeBatch {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A device's or site's whole history goes: drop its rollup rows
+		// too, whatever counts compaction left in them
+		var forgotten error
+		switch {
+		case c.IP != "" && c.Before.IsZero() && c.Domain == "":
+			forgotten = forgetRollups(conn, "dimension = ? AND name = ?", RollupHost, c.IP)
+			if forgotten == nil {
+				forgotten = conn.Where("kind = ? AND name = ?", DestinationIP, c.IP).Delete(&Destination{}).Error
+			}
+			if forgotten == nil {
+				forgotten = conn.Model(&Destination{}).Where("first_client = ?", c.IP).Update("first_client", "").Error
+			}
+			if forgotten == nil {
+				forgotten = conn.Where("src_ip = ? OR dst_ip = ?", c.IP, c.IP).Delete(&Beacon{}).Error
+			}
+		case c.Domain != "" && c.Before.IsZero() && c.IP == "":
+			forgotten = forgetRollups(conn, `dimension = ? AND name LIKE ? ESCAPE '\'`, RollupDomain, c.domainPattern())
+			if forgotten == nil {
+				forgotten = conn.Where(`kind = ? AND name LIKE ? ESCAPE '\'`, DestinationDomain, c.domainPattern()).Delete(&Destination{}).Error
+			}
+			if forgotten == nil {
+				forgotten = conn.Where(`domain LIKE ? ESCAPE '\'`, c.domainPattern()).Delete(&Beacon{}).Error
+			}
+		}
+		if forgotten != nil {
+			return forgotten
+		}
+		if c.IP != "" && c.Before.IsZero() && c.Domain == "" {
+			res := conn.Where("src_ip = ?", c.IP).Delete(&SourceBaseline{})
+			if res.Error != nil {
+				return res.Error
+			}
+			stats.Baselines = res.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if sqlite {
+		var autoVacuum int
+		db.Raw("PRAGMA auto_vacuum").Scan(&autoVacuum)
+		if autoVacuum == 2 { // INCREMENTAL
+			if err := db.Exec("PRAGMA incremental_vacuum").Error; err != nil {
+				log.Warn("[PURGE] Incremental vacuum failed", "error", err)
+			}
+		}
+		if err := db.Checkpoint(); err != nil {
+			log.Warn("[PURGE] WAL checkpoint failed", "error", err)
+		}
+		var free, pageSize int64
+		db.Raw("PRAGMA freelist_count").Scan(&free)
+		db.Raw("PRAGMA page_size").Scan(&pageSize)
+		stats.Reusable = free * pageSize
+	}
+	stats.SizeAfter = db.size()
+	stats.Freed = max(stats.SizeBefore-stats.SizeAfter, 0)
+	return stats, nil
+}
+
+// size is the size of the database: its pages on SQLite, or what Postgres
+// reports for the database
+func (db *DB) size() int64 {
+	var size int64
+	if db.Dialector.Name() == "sqlite" {
+		var pages, pageSize int64
+		db.Raw("PRAGMA page_count").Scan(&pages)
+		db.Raw("PRAGMA page_size").Scan(&pageSize)
+		return pages * pageSize
+	}
+	db.Raw("SELECT pg_database_size(current_database())").Scan(&size)
+	return size
+}
+
+// purgeOriginals clears the archive entries of the compacted events among
+// ids, deleting chunks left empty, and returns how many originals went
+func purgeOriginals(tx *gorm.DB, ids []uint) (int64, error) {
+	var refs []string
+	err := tx.Model(&CompactionDetail{}).Where("event_id IN ? AND original_ref != ''", ids).
+		Pluck("original_ref", &refs).Error
+	if err != nil {
+		return 0, err
+	}
+	entries := make(map[uint][]int) // chunk ID -> record indexes
+	for _, ref := range refs {
+		// run:chunk:index, see archivePairs
+		parts := strings.Split(ref, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		chunk, err1 := strconv.ParseUint(parts[1], 10, 64)
+		index, err2 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		entries[uint(chunk)] = append(entries[uint(chunk)], index)
+	}
+
+	var removed int64
+	for id, indexes := range entries {
+		var chunk ArchiveChunk
+		if err := tx.Take(&chunk, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(chunk.Data))
+		if err != nil {
+			return removed, fmt.Errorf("archive chunk %d: %w", id, err)
+		}
+		var originals [][]NetworkEvent
+		if err := json.NewDecoder(zr).Decode(&originals); err != nil {
+			return removed, fmt.Errorf("archive chunk %d: %w", id, err)
+		}
+		for _, i := range indexes {
+			if i >= 0 && i < len(originals) {
+				removed += int64(len(originals[i]))
+				originals[i] = nil
+			}
+		}
+		empty := true
+		for _, o := range originals {
+			empty = empty && len(o) == 0
+		}
+		if empty {
+			if err := tx.Delete(&chunk).Error; err != nil {
+				return removed, err
+			}
+			continue
+		}
+		// Keep the indexes of the records left pointing at their entries
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if err := json.NewEncoder(zw).Encode(originals); err != nil {
+			return removed, err
+		}
+		if err := zw.Close(); err != nil {
+			return removed, err
+		}
+		if err := tx.Model(&chunk).Update("data", buf.Bytes()).Error; err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,490 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Filter is a compiled filter expression such as
+//
+//	dst_port=443 AND (dns_query~"*.googleapis.com" OR tls_sni~"*.gstatic.com")
+//
+// Fields are the event columns (src_ip, dns_query, anomaly_score, ...),
+// including those kept in side tables (icmp_type, dns_answers, shares, ...).
+// Operators are = != > >= < <= and ~ / !~, which match a glob pattern
+// (* and ?, case-insensitive; without wildcards the text may appear
+// anywhere). Comparisons combine with AND, OR, NOT and parentheses; values
+// with spaces or operator characters are double-quoted.
+type Filter struct {
+	Expr string
+	sql  string
+	args []any
+}
+
+// ParseFilter compiles a filter expression
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty filter")
+	}
+	p := &filterParser{tokens: tokens}
+	sql, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.tokens[p.pos].text, p.tokens[p.pos].at+1)
+	}
+	return &Filter{Expr: expr, sql: sql, args: p.args}, nil
+}
+
+// Apply restricts q to events matching the filter; a nil filter matches all
+func (f *Filter) Apply(q *gorm.DB) *gorm.DB {
+	if f == nil {
+		return q
+	}
+	return q.Where("("+f.sql+")", f.args...)
+}
+
+// FilterParams are the event filters of the events API, which saved views store
+var FilterParams = []string{
+	"eventType", "srcIP", "dstIP", "q", "startDate", "endDate", "threat", "threatList", "dnsRcode",
+	"dnsFailed", "ja3", "ja4", "tlsVersion", "ech", "minScore", "anomalyReason", "tag", "vlan",
+	"p2p", "query",
+}
+
+// ParamsFilter compiles events API filter parameters into a Filter; it
+// returns nil when params filter nothing. Unknown names are ignored.
+func ParamsFilter(params map[string]string) (*Filter, error) {
+	var conds []string
+	var args []any
+	add := func(cond string, a ...any) {
+		conds = append(conds, "("+cond+")")
+		args = append(args, a...)
+	}
+	var expr []string
+	for _, name := range FilterParams {
+		value := params[name]
+		if value == "" {
+			continue
+		}
+		expr = append(expr, name+"="+strconv.Quote(value))
+		switch name {
+		case "eventType":
+			add("event_type IN ?", strings.Split(value, ","))
+		case "srcIP":
+			add("src_ip LIKE ?", "%"+value+"%")
+		case "dstIP":
+			add("dst_ip LIKE ?", "%"+value+"%")
+		case "q":
+			search := "%" + value + "%"
+			add("src_ip LIKE ? OR dst_ip LIKE ? OR hostname LIKE ? OR dns_query LIKE ? OR tls_sni LIKE ?",
+				search, search, search, search, search)
+		case "startDate", "endDate":
+			t, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return nil, fmt.Errorf("%s needs a date like 2006-01-02, got %q", name, value)
+			}
+			if name == "startDate" {
+				add("timestamp >= ?", t)
+			} else {
+				add("timestamp <= ?", t.Add(24*time.Hour))
+			}
+		case "threat":
+			if value == "true" {
+				add("threat = ?", true)
+			} else if value == "false" {
+				add("threat = ? OR threat IS NULL", false)
+			}
+		case "threatList":
+			add("threat_list LIKE ?", "%"+value+"%")
+		case "dnsRcode":
+			add("dns_rcode IN ?", strings.Split(strings.ToUpper(value), ","))
+		case "dnsFailed":
+			if value == "true" {
+				// Failed lookups are responses with any rcode other than NOERROR
+				add("event_type = ? AND dns_rcode != '' AND dns_rcode != ?", EventDNS, "NOERROR")
+			}
+		case "ja3":
+			add("tls_ja3 = ?", value)
+		case "ja4":
+			add("tls_ja4 = ?", value)
+		case "tlsVersion":
+			add("tls_version IN ?", strings.Split(value, ","))
+		case "ech":
+			if value == "true" {
+				add("tls_ech = ?", true)
+			} else if value == "false" {
+				add("tls_ech = ? OR tls_ech IS NULL", false)
+			}
+		case "minScore":
+			if score, _ := strconv.Atoi(value); score > 0 {
+				add("anomaly_score >= ?", score)
+			}
+		case "anomalyReason":
+			add("anomaly_reasons LIKE ?", "%"+value+"%")
+		case "tag":
+			// Any of the comma-separated tags
+			var tagConds []string
+			for _, tag := range strings.Split(value, ",") {
+				tagConds = append(tagConds, `(',' || tags || ',') LIKE ? ESCAPE '\'`)
+				args = append(args, "%,"+likeEscaper.Replace(strings.TrimSpace(tag))+",%")
+			}
+			conds = append(conds, "("+strings.Join(tagConds, " OR ")+")")
+		case "vlan":
+			// Either tag, so a QinQ customer VLAN matches too
+			var ids []int
+			for _, part := range strings.Split(value, ",") {
+				id, err := strconv.Atoi(strings.TrimSpace(part))
+				if err != nil || id < 0 || id > 4094 {
+					return nil, fmt.Errorf("vlan needs VLAN IDs 0-4094, got %q", part)
+				}
+				ids = append(ids, id)
+			}
+			add("vlan IN ? OR inner_vlan IN ?", ids, ids)
+		case "p2p":
+			// true for any BitTorrent class, otherwise the listed classes
+			if value == "true" {
+				add("p2p != '' AND p2p IS NOT NULL")
+			} else {
+				add("p2p IN ?", strings.Split(value, ","))
+			}
+		case "query":
+			f, err := ParseFilter(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid query: %w", err)
+			}
+			add(f.sql, f.args...)
+		}
+	}
+	if len(conds) == 0 {
+		return nil, nil
+	}
+	return &Filter{Expr: strings.Join(expr, " "), sql: strings.Join(conds, " AND "), args: args}, nil
+}
+
+type filterTokenKind int
+
+const (
+	tokWord filterTokenKind = iota
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	at   int // byte offset in the expression
+}
+
+// filterOps lists the comparison operators, longest first
+var filterOps = []string{"!=", "!~", ">=", "<=", "=", "~", ">", "<"}
+
+// lexFilter splits an expression into words, quoted strings, operators and parentheses
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokRParen, ")", i})
+			i++
+		case c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					j++
+				}
+				sb.WriteByte(expr[j])
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			tokens = append(tokens, filterToken{tokString, sb.String(), i})
+			i = j + 1
+		case strings.ContainsRune("=!~<>", rune(c)):
+			op := ""
+			for _, o := range filterOps {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("invalid operator at position %d", i+1)
+			}
+			tokens = append(tokens, filterToken{tokOp, op, i})
+			i += len(op)
+		default:
+			j := i
+			for j < len(expr) && !unicode.IsSpace(rune(expr[j])) && !strings.ContainsRune("()\"=!~<>", rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{tokWord, expr[i:j], i})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser emitting a SQL condition
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	args   []any
+}
+
+// keyword reports whether the next token is the given keyword and consumes it
+func (p *filterParser) keyword(kw string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokWord && strings.EqualFold(p.tokens[p.pos].text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (string, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return "", err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + " OR " + right + ")"
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (string, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return "", err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + " AND " + right + ")"
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (string, error) {
+	if p.keyword("NOT") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + inner, nil
+	}
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of filter")
+	}
+	if p.tokens[p.pos].kind == tokLParen {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return "", err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokRParen {
+			return "", fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return "(" + inner + ")", nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (string, error) {
+	if p.pos+3 > len(p.tokens) {
+		return "", fmt.Errorf("incomplete comparison at position %d", p.tokens[p.pos].at+1)
+	}
+	name, op, value := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	if name.kind != tokWord {
+		return "", fmt.Errorf("expected a field name at position %d", name.at+1)
+	}
+	if op.kind != tokOp {
+		return "", fmt.Errorf("expected an operator after %q", name.text)
+	}
+	if value.kind != tokWord && value.kind != tokString {
+		return "", fmt.Errorf("expected a value after %s%s", name.text, op.text)
+	}
+	p.pos += 3
+
+	col, ok := filterFields()[strings.ToLower(name.text)]
+	if !ok {
+		return "", fmt.Errorf("unknown field %q", name.text)
+	}
+	field := col.field
+	column := field.DBName
+
+	if op.text == "~" || op.text == "!~" {
+		if field.DataType != schema.String {
+			return "", fmt.Errorf("%s only supports = != > >= < <=", column)
+		}
+		p.args = append(p.args, globToLike(value.text))
+		if col.table != "" {
+			return col.exists(op.text == "!~", `d.`+column+` LIKE ? ESCAPE '\'`), nil
+		}
+		if op.text == "!~" {
+			return "(" + column + " IS NULL OR " + column + ` NOT LIKE ? ESCAPE '\')`, nil
+		}
+		return column + ` LIKE ? ESCAPE '\'`, nil
+	}
+
+	arg, err := filterValue(field, value.text)
+	if err != nil {
+		return "", err
+	}
+	p.args = append(p.args, arg)
+	if col.table != "" {
+		if op.text == "!=" {
+			return col.exists(true, "d."+column+" = ?"), nil
+		}
+		return col.exists(false, "d."+column+" "+op.text+" ?"), nil
+	}
+	if op.text == "!=" {
+		return "(" + column + " IS NULL OR " + column + " != ?)", nil
+	}
+	return column + " " + op.text + " ?", nil
+}
+
+// filterValue converts a value to the type of the field it is compared with
+func filterValue(field *schema.Field, value string) (any, error) {
+	switch field.DataType {
+	case schema.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs true or false, got %q", field.DBName, value)
+		}
+		return b, nil
+	case schema.Int, schema.Uint:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number, got %q", field.DBName, value)
+		}
+		return n, nil
+	case schema.Time:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("%s needs a time like 2006-01-02 or 2006-01-02T15:04:05Z, got %q", field.DBName, value)
+	}
+	return value, nil
+}
+
+// likeEscaper escapes the LIKE wildcards of a literal value
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// globToLike converts a * and ? pattern into a LIKE pattern. A pattern
+// without wildcards matches anywhere in the value.
+func globToLike(glob string) string {
+	var sb strings.Builder
+	wild := strings.ContainsAny(glob, "*?")
+	if !wild {
+		sb.WriteByte('%')
+	}
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteByte('%')
+		case '?':
+			sb.WriteByte('_')
+		case '%', '_', '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	if !wild {
+		sb.WriteByte('%')
+	}
+	return sb.String()
+}
+
+// filterColumn is a column a filter may compare: one of network_events,
+// or of a side table when table is set
+type filterColumn struct {
+	field *schema.Field
+	table string
+}
+
+// exists returns a condition matching events with a side-table row that
+// satisfies cond, which refers to the row as d; negated, events without
+// such a row, including events without any row
+func (c filterColumn) exists(negate bool, cond string) string {
+	sql := "EXISTS (SELECT 1 FROM " + c.table + " d WHERE d.event_id = network_events.id AND " + cond + ")"
+	if negate {
+		return "NOT " + sql
+	}
+	return sql
+}
+
+var (
+	filterFieldsOnce sync.Once
+	filterFieldMap   map[string]filterColumn
+)
+
+// filterFields maps column names to the NetworkEvent fields a filter may
+// use, including the fields kept in side tables
+func filterFields() map[string]filterColumn {
+	filterFieldsOnce.Do(func() {
+		filterFieldMap = make(map[string]filterColumn)
+		cache := &sync.Map{}
+		s, err := schema.Parse(&NetworkEvent{}, cache, schema.NamingStrategy{})
+		if err != nil {
+			return
+		}
+		for _, f := range s.Fields {
+			if f.DBName != "" {
+				filterFieldMap[f.DBName] = filterColumn{field: f}
+			}
+		}
+		for _, t := range sideTables {
+			ts, err := schema.Parse(t.model, cache, schema.NamingStrategy{})
+			if err != nil {
+				continue
+			}
+			for _, f := range ts.Fields {
+				if f.DBName != "" && f.DBName != "event_id" {
+					filterFieldMap[f.DBName] = filterColumn{field: f, table: ts.Table}
+				}
+			}
+		}
+	})
+	return filterFieldMap
+}
+
+// UnixHourSQL is an expression for the start of the hour of an event's
+// timestamp in Unix seconds, in the database's SQL dialect
+func (db *DB) UnixHourSQL() string {
+	if db.Dialector.Name() == "postgres" {
+		return "CAST(EXTRACT(EPOCH FROM date_trunc('hour', timestamp)) AS BIGINT)"
+	}
+	return "CAST(strftime('%s', timestamp) AS INTEGER) / 3600 * 3600"
+}
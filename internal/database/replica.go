@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Replica is a read-only connection for the web UI and reports, so their
+// heavy analytical queries run beside the capture writer rather than on
+// its connection pool. It is either a Postgres streaming replica, kept
+// current by the server, or a SQLite copy of the primary database that
+// Refresh brings up to date.
+type Replica struct {
+	*DB
+	primary *DB
+	path    string // SQLite copy; empty for Postgres
+}
+
+// OpenReplica connects to a read replica given as "postgres://...", or as
+// "sqlite:path" or a plain path for a SQLite copy of primary, which is
+// made before connecting. The replica's schema is never migrated: a
+// Postgres replica gets it from its primary.
+func OpenReplica(dsn string, primary *DB) (*Replica, error) {
+	config := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+	r := &Replica{primary: primary}
+	var dialector gorm.Dialector
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		dialector = postgres.Open(dsn)
+	default:
+		r.path = strings.TrimPrefix(strings.TrimPrefix(dsn, "sqlite://"), "sqlite:")
+		if r.path == "" {
+			return nil, fmt.Errorf("read replica needs a file path")
+		}
+		if err := r.Refresh(context.Background()); err != nil {
+			return nil, err
+		}
+		// Readers wait for a refresh to finish instead of failing
+		dialector = sqlite.Open(r.path + "?_busy_timeout=30000&_query_only=true")
+	}
+	db, err := gorm.Open(dialector, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerSideTables(db); err != nil {
+		return nil, err
+	}
+	r.DB = &DB{DB: db, readOnly: true}
+	return r, nil
+}
+
+// Copied reports whether the replica is a SQLite copy that needs Refresh
+func (r *Replica) Copied() bool {
+	return r.path != ""
+}
+
+// Refresh copies the primary SQLite database over the replica file with
+// SQLite's online backup. The copy reads one consistent snapshot, which
+// in WAL mode does not block the capture writer; replica queries wait
+// for the copy to finish. It does nothing for a Postgres replica.
+func (r *Replica) Refresh(ctx context.Context) error {
+	if r.path == "" {
+		return nil
+	}
+	src, err := r.primary.DB.DB()
+	if err != nil {
+		return err
+	}
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	dst, err := sql.Open("sqlite3", r.path+"?_busy_timeout=30000")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	err = dstConn.Raw(func(dstDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			to, ok := dstDriver.(*sqlite3.SQLiteConn)
+			from, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return fmt.Errorf("read replica copies need a SQLite primary")
+			}
+			backup, err := to.Backup("main", from, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to refresh read replica %s: %w", r.path, err)
+	}
+	return nil
+}
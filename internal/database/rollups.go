@@ -0,0 +1,328 @@
+package database
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rollup dimensions: events are counted per event type, per source host,
+// per domain (DNS query, TLS server name or hostname) and per interface
+const (
+	RollupType      = "type"
+	RollupHost      = "host"
+	RollupDomain    = "domain"
+	RollupInterface = "interface"
+)
+
+// RollupCounts are the events and bytes of one dimension value in one
+// bucket. BytesOut are bytes of events sent by a local host, BytesIn of
+// events sent to one.
+type RollupCounts struct {
+	Bucket    time.Time `gorm:"primaryKey"`
+	Dimension string    `gorm:"primaryKey"`
+	Name      string    `gorm:"primaryKey"`
+	Events    int64
+	BytesIn   int64
+	BytesOut  int64
+}
+
+// MinuteRollup counts the events written in one minute. Rollups are
+// maintained as events are inserted, so time-series queries read them
+// instead of scanning network_events; compaction leaves them alone, so
+// they keep counting events as they were captured.
+type MinuteRollup struct {
+	RollupCounts `gorm:"embedded"`
+}
+
+// HourRollup counts the events written in one hour
+type HourRollup struct {
+	RollupCounts `gorm:"embedded"`
+}
+
+// rollupKey identifies one rollup row
+type rollupKey struct {
+	bucket          time.Time
+	dimension, name string
+}
+
+// rollupSet accumulates rollup rows of a batch of events
+type rollupSet struct {
+	minute, hour map[rollupKey]*RollupCounts
+}
+
+func newRollupSet() *rollupSet {
+	return &rollupSet{minute: make(map[rollupKey]*RollupCounts), hour: make(map[rollupKey]*RollupCounts)}
+}
+
+// add counts an event, or takes it away with sign -1
+func (s *rollupSet) add(e *NetworkEvent, sign int64) {
+	var in, out int64
+	if isLocalAddr(e.SrcIP) {
+		out = e.ByteCount
+	}
+	if isLocalAddr(e.DstIP) {
+		in = e.ByteCount
+	}
+	names := [][2]string{{RollupType, string(e.EventType)}}
+	if e.SrcIP != "" {
+		names = append(names, [2]string{RollupHost, e.SrcIP})
+	}
+	if domain := rollupDomain(e); domain != "" {
+		names = append(names, [2]string{RollupDomain, domain})
+	}
+	if e.Interface != "" {
+		names = append(names, [2]string{RollupInterface, e.Interface})
+	}
+	ts := e.Timestamp.UTC()
+	for _, n := range names {
+		for _, level := range []struct {
+			rows map[rollupKey]*RollupCounts
+			size time.Duration
+		}{{s.minute, time.Minute}, {s.hour, time.Hour}} {
+			key := rollupKey{ts.Truncate(level.size), n[0], n[1]}
+			r, ok := level.rows[key]
+			if !ok {
+				r = &RollupCounts{Bucket: key.bucket, Dimension: key.dimension, Name: key.name}
+				level.rows[key] = r
+			}
+			r.Events += sign
+			r.BytesIn += sign * in
+			r.BytesOut += sign * out
+		}
+	}
+}
+
+// save adds the accumulated rows to the rollup tables
+func (s *rollupSet) save(tx *gorm.DB) error {
+	if err := upsertRollups(tx, "minute_rollups", s.minute); err != nil {
+		return err
+	}
+	return upsertRollups(tx, "hour_rollups", s.hour)
+}
+
+func upsertRollups(tx *gorm.DB, table string, rows map[rollupKey]*RollupCounts) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	batch := make([]RollupCounts, 0, len(rows))
+	for _, r := range rows {
+		batch = append(batch, *r)
+	}
+	return tx.Table(table).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "bucket"}, {Name: "dimension"}, {Name: "name"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"events":    gorm.Expr(table + ".events + excluded.events"),
+			"bytes_in":  gorm.Expr(table + ".bytes_in + excluded.bytes_in"),
+			"bytes_out": gorm.Expr(table + ".bytes_out + excluded.bytes_out"),
+		}),
+	}).CreateInBatches(batch, 200).Error
+}
+
+// rollupDomain is the name an event is counted under in the domain rollup
+func rollupDomain(e *NetworkEvent) string {
+	name := e.DNSQuery
+	if name == "" {
+		name = e.TLSSNI
+	}
+	if name == "" {
+		name = e.Hostname
+	}
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// isLocalAddr reports whether an address is on a private network, as
+// LocalSourceCondition matches them
+func isLocalAddr(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && (addr.IsPrivate() || addr.IsLinkLocalUnicast())
+}
+
+// addRollups counts newly inserted events into the rollup tables
+func addRollups(tx *gorm.DB, events []NetworkEvent) error {
+	set := newRollupSet()
+	for i := range events {
+		set.add(&events[i], 1)
+	}
+	return set.save(tx)
+}
+
+// removeRollups takes events about to be deleted out of the rollup tables
+// and drops rows left empty. Compaction merges events after they were
+// counted, so for compacted records this is approximate.
+func removeRollups(tx *gorm.DB, events []NetworkEvent) error {
+	set := newRollupSet()
+	for i := range events {
+		set.add(&events[i], -1)
+	}
+	if err := set.save(tx); err != nil {
+		return err
+	}
+	for _, table := range []string{"minute_rollups", "hour_rollups"} {
+		if err := tx.Exec("DELETE FROM " + table + " WHERE events <= 0").Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetRollups deletes the minute and hour rollup rows matching a condition
+func forgetRollups(tx *gorm.DB, query string, args ...any) error {
+	if err := tx.Where(query, args...).Delete(&MinuteRollup{}).Error; err != nil {
+		return err
+	}
+	return tx.Where(query, args...).Delete(&HourRollup{}).Error
+}
+
+// rollupColumns are the event columns rollups and destinations are
+// computed from
+var rollupColumns = []string{"id", "timestamp", "event_type", "interface", "src_ip", "dst_ip", "byte_count", "dns_type", "dns_query", "tls_sni", "hostname"}
+
+// RollupBackfill records how far the events stored before a table derived
+// from them existed have been counted into it, one row per table
+type RollupBackfill struct {
+	ID   uint `gorm:"primaryKey"`
+	UpTo uint // last event ID stored before the table was maintained
+	Done uint // last event ID counted so far
+}
+
+// Rows of RollupBackfill
+const (
+	rollupsBackfill      = 1
+	destinationsBackfill = 2
+)
+
+// rollupBackfillBatch is how many events a backfill counts per transaction
+const rollupBackfillBatch = 5000
+
+// BackfillRollups counts the events stored before rollups existed into
+// them, for databases written by older versions or filled by migrate. The
+// first call records upTo, the last event ID stored before capture starts,
+// as the end; the writer counts every later event. An interrupted backfill
+// resumes where it stopped. It returns the number of events counted.
+func (db *DB) BackfillRollups(upTo uint) (int64, error) {
+	return db.backfill(rollupsBackfill, upTo, addRollups)
+}
+
+// backfill passes the events up to upTo not counted yet by the backfill
+// of one table to add, in batches, recording its progress with each
+func (db *DB) backfill(id, upTo uint, add func(tx *gorm.DB, events []NetworkEvent) error) (int64, error) {
+	state := RollupBackfill{ID: id, UpTo: upTo}
+	if err := db.FirstOrCreate(&state, RollupBackfill{ID: id}).Error; err != nil {
+		return 0, fmt.Errorf("failed to read backfill state: %w", err)
+	}
+	var counted int64
+	for state.Done < state.UpTo {
+		var batch []NetworkEvent
+		err := db.Model(&NetworkEvent{}).Select(rollupColumns).
+			Where("id > ? AND id <= ?", state.Done, state.UpTo).
+			Order("id ASC").Limit(rollupBackfillBatch).Find(&batch).Error
+		if err != nil {
+			return counted, fmt.Errorf("failed to read events after id %d: %w", state.Done, err)
+		}
+		next := state.UpTo
+		if len(batch) == rollupBackfillBatch {
+			next = batch[len(batch)-1].ID
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := add(tx, batch); err != nil {
+				return err
+			}
+			return tx.Model(&state).Update("done", next).Error
+		})
+		if err != nil {
+			return counted, err
+		}
+		state.Done = next
+		counted += int64(len(batch))
+	}
+	return counted, nil
+}
+
+// LastEventID returns the highest stored event ID, 0 when there are none
+func (db *DB) LastEventID() (uint, error) {
+	var id uint
+	err := db.Model(&NetworkEvent{}).Select("COALESCE(MAX(id), 0)").Scan(&id).Error
+	return id, err
+}
+
+// rollupTable is the rollup table serving buckets of a resolution: the
+// hour rollups for an hour or coarser, else the minute rollups
+func rollupTable(resolution time.Duration) (string, time.Duration) {
+	if resolution >= time.Hour {
+		return "hour_rollups", time.Hour
+	}
+	return "minute_rollups", time.Minute
+}
+
+// RollupBuckets returns the counts of every event type summed per bucket
+// between from and to, from the rollup table of the resolution
+func (db *DB) RollupBuckets(from, to time.Time, resolution time.Duration) ([]RollupCounts, error) {
+	table, size := rollupTable(resolution)
+	var rows []RollupCounts
+	err := db.Table(table).
+		Select("bucket, SUM(events) as events, SUM(bytes_in) as bytes_in, SUM(bytes_out) as bytes_out").
+		Where("dimension = ? AND bucket >= ? AND bucket <= ?", RollupType, from.UTC().Truncate(size), to.UTC()).
+		Group("bucket").
+		Order("bucket ASC").
+		Scan(&rows).Error
+	return rows, err
+}
+
+// RollupSeries returns the rollup rows of a dimension between from and to,
+// ordered by bucket, from the rollup table of the resolution; with names,
+// only the rows of those names
+func (db *DB) RollupSeries(dimension string, from, to time.Time, resolution time.Duration, names []string) ([]RollupCounts, error) {
+	table, size := rollupTable(resolution)
+	q := db.Table(table).
+		Where("dimension = ? AND bucket >= ? AND bucket <= ?", dimension, from.UTC().Truncate(size), to.UTC())
+	if names != nil {
+		q = q.Where("name IN ?", names)
+	}
+	var rows []RollupCounts
+	err := q.Order("bucket ASC").Scan(&rows).Error
+	return rows, err
+}
+
+// RollupTop returns the names of a dimension with the most events, or the
+// most bytes, between from and to, with their totals from the hour rollups
+func (db *DB) RollupTop(dimension string, from, to time.Time, limit int, byBytes bool) ([]RollupCounts, error) {
+	order := "SUM(events) DESC"
+	if byBytes {
+		order = "SUM(bytes_in) + SUM(bytes_out) DESC, SUM(events) DESC"
+	}
+	var rows []RollupCounts
+	err := db.Model(&HourRollup{}).
+		Select("name, SUM(events) as events, SUM(bytes_in) as bytes_in, SUM(bytes_out) as bytes_out").
+		Where("dimension = ? AND bucket >= ? AND bucket <= ?", dimension, from.UTC().Truncate(time.Hour), to.UTC()).
+		Group("name").
+		Order(order).
+		Limit(limit).
+		Scan(&rows).Error
+	return rows, err
+}
+
+// RollupTotals returns the events counted per name of a dimension, from
+// the hour rollups; a zero from or to leaves that end open
+func (db *DB) RollupTotals(dimension string, from, to time.Time) (map[string]int64, error) {
+	q := db.Model(&HourRollup{}).Select("name, SUM(events) as events").Where("dimension = ?", dimension)
+	if !from.IsZero() {
+		q = q.Where("bucket >= ?", from.UTC().Truncate(time.Hour))
+	}
+	if !to.IsZero() {
+		q = q.Where("bucket <= ?", to.UTC())
+	}
+	var rows []RollupCounts
+	if err := q.Group("name").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		totals[r.Name] = r.Events
+	}
+	return totals, nil
+}
@@ -0,0 +1,392 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Rarely used event columns live in side tables keyed by event ID, so the
+// rows of network_events stay narrow: inserts write less and more rows fit
+// in the page cache. NetworkEvent keeps the fields (tagged gorm:"-"); the
+// callbacks registered by registerSideTables write and read them with the
+// event, and delete them along with it. Updates of these fields, and raw
+// SQL, do not reach the side tables.
+
+// ICMPDetail holds the ICMP fields of an ICMP event
+type ICMPDetail struct {
+	EventID         uint `gorm:"primaryKey;autoIncrement:false"`
+	ICMPType        uint8
+	ICMPCode        uint8
+	ICMPDesc        string
+	ICMPOrigProto   string
+	ICMPOrigSrcIP   string `gorm:"index"`
+	ICMPOrigSrcPort uint16
+	ICMPOrigDstIP   string `gorm:"index"`
+	ICMPOrigDstPort uint16
+}
+
+// DNSAnswerDetail holds the answer records of a DNS response
+type DNSAnswerDetail struct {
+	EventID    uint `gorm:"primaryKey;autoIncrement:false"`
+	DNSAnswers string
+	DNSCNAMEs  string
+}
+
+// FileShareDetail holds the server, shares and version of a FILESHARE event
+type FileShareDetail struct {
+	EventID      uint `gorm:"primaryKey;autoIncrement:false"`
+	ShareServer  string
+	Shares       string
+	ShareVersion string
+}
+
+// NTPDetail holds the NTP version, stratum and reference of an NTP event
+type NTPDetail struct {
+	EventID    uint `gorm:"primaryKey;autoIncrement:false"`
+	NTPVersion uint8
+	NTPStratum uint8
+	NTPRefID   string
+}
+
+// CompactionDetail holds the compaction metadata of compacted records and
+// the suppressed count of rate limiter and sampling summaries
+type CompactionDetail struct {
+	EventID     uint `gorm:"primaryKey;autoIncrement:false"`
+	OriginalRef string
+	EventCount  int64
+}
+
+func (d *ICMPDetail) split(e *NetworkEvent) bool {
+	*d = ICMPDetail{e.ID, e.ICMPType, e.ICMPCode, e.ICMPDesc, e.ICMPOrigProto,
+		e.ICMPOrigSrcIP, e.ICMPOrigSrcPort, e.ICMPOrigDstIP, e.ICMPOrigDstPort}
+	return *d != ICMPDetail{EventID: e.ID}
+}
+
+func (d *ICMPDetail) merge(e *NetworkEvent) {
+	e.ICMPType, e.ICMPCode, e.ICMPDesc, e.ICMPOrigProto = d.ICMPType, d.ICMPCode, d.ICMPDesc, d.ICMPOrigProto
+	e.ICMPOrigSrcIP, e.ICMPOrigSrcPort = d.ICMPOrigSrcIP, d.ICMPOrigSrcPort
+	e.ICMPOrigDstIP, e.ICMPOrigDstPort = d.ICMPOrigDstIP, d.ICMPOrigDstPort
+}
+
+func (d *ICMPDetail) eventID() uint { return d.EventID }
+
+func (d *DNSAnswerDetail) split(e *NetworkEvent) bool {
+	*d = DNSAnswerDetail{e.ID, e.DNSAnswers, e.DNSCNAMEs}
+	return d.DNSAnswers != "" || d.DNSCNAMEs != ""
+}
+
+func (d *DNSAnswerDetail) merge(e *NetworkEvent) {
+	e.DNSAnswers, e.DNSCNAMEs = d.DNSAnswers, d.DNSCNAMEs
+}
+
+func (d *DNSAnswerDetail) eventID() uint { return d.EventID }
+
+func (d *FileShareDetail) split(e *NetworkEvent) bool {
+	*d = FileShareDetail{e.ID, e.ShareServer, e.Shares, e.ShareVersion}
+	return *d != FileShareDetail{EventID: e.ID}
+}
+
+func (d *FileShareDetail) merge(e *NetworkEvent) {
+	e.ShareServer, e.Shares, e.ShareVersion = d.ShareServer, d.Shares, d.ShareVersion
+}
+
+func (d *FileShareDetail) eventID() uint { return d.EventID }
+
+func (d *NTPDetail) split(e *NetworkEvent) bool {
+	*d = NTPDetail{e.ID, e.NTPVersion, e.NTPStratum, e.NTPRefID}
+	return *d != NTPDetail{EventID: e.ID}
+}
+
+func (d *NTPDetail) merge(e *NetworkEvent) {
+	e.NTPVersion, e.NTPStratum, e.NTPRefID = d.NTPVersion, d.NTPStratum, d.NTPRefID
+}
+
+func (d *NTPDetail) eventID() uint { return d.EventID }
+
+func (d *CompactionDetail) split(e *NetworkEvent) bool {
+	*d = CompactionDetail{e.ID, e.OriginalRef, e.EventCount}
+	return d.OriginalRef != "" || d.EventCount != 0
+}
+
+func (d *CompactionDetail) merge(e *NetworkEvent) {
+	e.OriginalRef, e.EventCount = d.OriginalRef, d.EventCount
+}
+
+func (d *CompactionDetail) eventID() uint { return d.EventID }
+
+// eventDetail is a side-table row: split copies its columns out of an
+// event, reporting whether any is set, and merge copies them back
+type eventDetail[T any] interface {
+	*T
+	split(e *NetworkEvent) bool
+	merge(e *NetworkEvent)
+	eventID() uint
+}
+
+// sideTable describes one side table and the events that can have a row
+// in it, so queries returning none of those skip it
+type sideTable struct {
+	model any
+	holds func(e *NetworkEvent) bool
+	save  func(tx *gorm.DB, events []*NetworkEvent) error
+	load  func(tx *gorm.DB, events []*NetworkEvent) error
+}
+
+var sideTables = []sideTable{
+	{
+		model: &ICMPDetail{},
+		holds: func(e *NetworkEvent) bool { return e.EventType == EventICMP },
+		save:  saveDetails[ICMPDetail],
+		load:  loadDetails[ICMPDetail],
+	},
+	{
+		model: &DNSAnswerDetail{},
+		holds: func(e *NetworkEvent) bool { return e.EventType == EventDNS },
+		save:  saveDetails[DNSAnswerDetail],
+		load:  loadDetails[DNSAnswerDetail],
+	},
+	{
+		model: &FileShareDetail{},
+		holds: func(e *NetworkEvent) bool { return e.EventType == EventFileShare },
+		save:  saveDetails[FileShareDetail],
+		load:  loadDetails[FileShareDetail],
+	},
+	{
+		model: &NTPDetail{},
+		holds: func(e *NetworkEvent) bool { return e.EventType == EventNTP },
+		save:  saveDetails[NTPDetail],
+		load:  loadDetails[NTPDetail],
+	},
+	{
+		model: &CompactionDetail{},
+		holds: func(e *NetworkEvent) bool {
+			return e.Compacted || e.EventType == EventRateLimited || e.EventType == EventSampled || e.EventType == EventScan
+		},
+		save: saveDetails[CompactionDetail],
+		load: loadDetails[CompactionDetail],
+	},
+}
+
+// saveDetails inserts the side-table rows of events that have any of its
+// columns set
+func saveDetails[T any, P eventDetail[T]](tx *gorm.DB, events []*NetworkEvent) error {
+	var rows []T
+	for _, e := range events {
+		var d T
+		if P(&d).split(e) {
+			rows = append(rows, d)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(rows, 500).Error
+}
+
+// loadDetails fills in the side-table columns of events, reading the rows
+// of compactBatchSize events at a time to stay below SQLite's limit on
+// bound variables
+func loadDetails[T any, P eventDetail[T]](tx *gorm.DB, events []*NetworkEvent) error {
+	byID := make(map[uint]*NetworkEvent, len(events))
+	ids := make([]uint, 0, len(events))
+	for _, e := range events {
+		byID[e.ID] = e
+		ids = append(ids, e.ID)
+	}
+	for start := 0; start < len(ids); start += compactBatchSize {
+		var rows []T
+		if err := tx.Where("event_id IN ?", ids[start:min(start+compactBatchSize, len(ids))]).Find(&rows).Error; err != nil {
+			return err
+		}
+		for i := range rows {
+			d := P(&rows[i])
+			d.merge(byID[d.eventID()])
+		}
+	}
+	return nil
+}
+
+// registerSideTables hooks the side tables into creating, querying and
+// deleting events
+func registerSideTables(db *gorm.DB) error {
+	cb := db.Callback()
+	if err := cb.Create().After("gorm:create").Register("netwatcher:save_side_tables", saveSideTables); err != nil {
+		return err
+	}
+	if err := cb.Query().After("gorm:query").Register("netwatcher:load_side_tables", loadSideTables); err != nil {
+		return err
+	}
+	return cb.Delete().Before("gorm:delete").Register("netwatcher:delete_side_tables", deleteSideTables)
+}
+
+// eventStatement reports whether a statement works on network_events
+func eventStatement(db *gorm.DB) bool {
+	return db.Error == nil && db.Statement.Schema != nil && db.Statement.Schema.ModelType == reflect.TypeOf(NetworkEvent{})
+}
+
+// eventsOf returns the events a statement created or read, given as an
+// event or a slice of events or event pointers
+func eventsOf(rv reflect.Value) []*NetworkEvent {
+	var events []*NetworkEvent
+	add := func(v reflect.Value) {
+		v = reflect.Indirect(v)
+		if !v.CanAddr() {
+			return
+		}
+		if e, ok := v.Addr().Interface().(*NetworkEvent); ok && e.ID != 0 {
+			events = append(events, e)
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := range rv.Len() {
+			add(rv.Index(i))
+		}
+	case reflect.Struct:
+		add(rv)
+	}
+	return events
+}
+
+// eachSideTable calls fn with the events each side table can hold rows of
+func eachSideTable(db *gorm.DB, fn func(t sideTable, tx *gorm.DB, events []*NetworkEvent) error) {
+	events := eventsOf(db.Statement.ReflectValue)
+	if len(events) == 0 {
+		return
+	}
+	tx := db.Session(&gorm.Session{NewDB: true})
+	for _, t := range sideTables {
+		var held []*NetworkEvent
+		for _, e := range events {
+			if t.holds(e) {
+				held = append(held, e)
+			}
+		}
+		if len(held) == 0 {
+			continue
+		}
+		if err := fn(t, tx, held); err != nil {
+			_ = db.AddError(fmt.Errorf("side table of %T: %w", t.model, err))
+			return
+		}
+	}
+}
+
+// saveSideTables writes the side-table rows of created events, in the
+// transaction that inserted them
+func saveSideTables(db *gorm.DB) {
+	if eventStatement(db) {
+		eachSideTable(db, func(t sideTable, tx *gorm.DB, events []*NetworkEvent) error {
+			return t.save(tx, events)
+		})
+	}
+}
+
+// loadSideTables fills in the side-table columns of queried events
+func loadSideTables(db *gorm.DB) {
+	if eventStatement(db) {
+		eachSideTable(db, func(t sideTable, tx *gorm.DB, events []*NetworkEvent) error {
+			return t.load(tx, events)
+		})
+	}
+}
+
+// deleteSideTables deletes the side-table rows of the events a delete
+// selects, by its conditions or the IDs of the events given to it
+func deleteSideTables(db *gorm.DB) {
+	if !eventStatement(db) {
+		return
+	}
+	ids := db.Session(&gorm.Session{NewDB: true}).Model(&NetworkEvent{}).Select("id")
+	where, conditional := db.Statement.Clauses["WHERE"]
+	if conditional {
+		ids = ids.Clauses(where.Expression)
+	}
+	if events := eventsOf(db.Statement.ReflectValue); len(events) > 0 {
+		keys := make([]uint, len(events))
+		for i, e := range events {
+			keys[i] = e.ID
+		}
+		ids, conditional = ids.Where("id IN ?", keys), true
+	}
+	if !conditional && !db.AllowGlobalUpdate {
+		return // refused by gorm:delete
+	}
+	tx := db.Session(&gorm.Session{NewDB: true, AllowGlobalUpdate: true})
+	for _, t := range sideTables {
+		if err := tx.Where("event_id IN (?)", ids).Delete(t.model).Error; err != nil {
+			_ = db.AddError(fmt.Errorf("side table of %T: %w", t.model, err))
+			return
+		}
+	}
+}
+
+// moveToSideTables copies the values of columns that moved to side tables
+// out of network_events and drops them there, once, when opening a
+// database created before the move. On SQLite dropping rewrites the table,
+// which takes a while on large databases.
+func moveToSideTables(db *gorm.DB) error {
+	m := db.Migrator()
+	type move struct {
+		table   string
+		columns []string
+		values  []string // columns with NULL as the zero value
+		set     []string // conditions of rows with a value
+	}
+	var moves []move
+	for _, t := range sideTables {
+		s, err := schema.Parse(t.model, &sync.Map{}, db.NamingStrategy)
+		if err != nil {
+			return err
+		}
+		mv := move{table: s.Table}
+		for _, f := range s.Fields {
+			if f.PrimaryKey || !m.HasColumn("network_events", f.DBName) {
+				continue
+			}
+			// Rows written before a column existed hold NULL
+			zero := "0"
+			if f.DataType == schema.String {
+				zero = "''"
+			}
+			value := "COALESCE(" + f.DBName + ", " + zero + ")"
+			mv.columns = append(mv.columns, f.DBName)
+			mv.values = append(mv.values, value)
+			mv.set = append(mv.set, value+" != "+zero)
+		}
+		if len(mv.columns) > 0 {
+			moves = append(moves, mv)
+		}
+	}
+	if len(moves) == 0 {
+		return nil
+	}
+
+	log.Info("Moving rarely used event columns to side tables (one-time)", "tables", len(moves))
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, mv := range moves {
+			columns := strings.Join(mv.columns, ", ")
+			res := tx.Exec(fmt.Sprintf("INSERT INTO %s (event_id, %s) SELECT id, %s FROM network_events WHERE %s",
+				mv.table, columns, strings.Join(mv.values, ", "), strings.Join(mv.set, " OR ")))
+			if res.Error != nil {
+				return fmt.Errorf("failed to fill %s: %w", mv.table, res.Error)
+			}
+			for _, c := range mv.columns {
+				if err := tx.Exec("DROP INDEX IF EXISTS idx_network_events_" + c).Error; err != nil {
+					return err
+				}
+				if err := tx.Exec("ALTER TABLE network_events DROP COLUMN " + c).Error; err != nil {
+					return fmt.Errorf("failed to drop column %s: %w", c, err)
+				}
+			}
+			log.Info("Moved event columns", "table", mv.table, "rows", res.RowsAffected, "columns", columns)
+		}
+		return nil
+	})
+}
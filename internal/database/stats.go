@@ -0,0 +1,73 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Stats are the headline numbers of the events since a point in time:
+// what /api/stats returns, plus transferred bytes and the busiest domains
+// and destinations
+type Stats struct {
+	Since           time.Time        `json:"since"`
+	TotalEvents     int64            `json:"totalEvents"`
+	EventCounts     map[string]int64 `json:"eventCounts"`
+	FirstEvent      *time.Time       `json:"firstEvent,omitempty"`
+	LastEvent       *time.Time       `json:"lastEvent,omitempty"`
+	TotalBytes      int64            `json:"totalBytes"`
+	TCPBytes        int64            `json:"tcpBytes"`
+	UDPBytes        int64            `json:"udpBytes"`
+	TopDomains      []StatsEntry     `json:"topDomains"`
+	TopDestinations []StatsEntry     `json:"topDestinations"`
+}
+
+// StatsEntry is a domain or destination address with its event count and
+// the bytes of the connections to it
+type StatsEntry struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes,omitempty"`
+}
+
+// Stats counts the events recorded since the given time, listing the top
+// domains queried and destinations connected to. Event counts come from
+// the hour rollups, from the start of since's hour.
+func (db *DB) Stats(since time.Time, top int) (*Stats, error) {
+	q := func() *gorm.DB {
+		return db.Model(&NetworkEvent{}).Where("timestamp >= ?", since)
+	}
+	counts, err := db.RollupTotals(RollupType, since, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{Since: since, EventCounts: counts}
+	for _, c := range counts {
+		s.TotalEvents += c
+	}
+
+	var first, last NetworkEvent
+	if q().Order("timestamp ASC").Limit(1).Find(&first); first.ID != 0 {
+		s.FirstEvent = &first.Timestamp
+	}
+	if q().Order("timestamp DESC").Limit(1).Find(&last); last.ID != 0 {
+		s.LastEvent = &last.Timestamp
+	}
+
+	// Same split as the compaction transfer statistics
+	q().Select("COALESCE(SUM(byte_count), 0)").Scan(&s.TotalBytes)
+	q().Select("COALESCE(SUM(byte_count), 0)").
+		Where("event_type IN ?", []EventType{EventTCP, EventTCPStart, EventTCPEnd}).
+		Scan(&s.TCPBytes)
+	q().Select("COALESCE(SUM(byte_count), 0)").
+		Where("event_type IN ?", []EventType{EventUDP, EventUDPStart, EventUDPEnd}).
+		Scan(&s.UDPBytes)
+
+	q().Select("dns_query as name, count(*) as count, 0 as bytes").
+		Where("event_type = ? AND dns_query != ''", EventDNS).
+		Group("dns_query").Order("count DESC").Limit(top).Scan(&s.TopDomains)
+	q().Select("dst_ip as name, count(*) as count, COALESCE(SUM(byte_count), 0) as bytes").
+		Where("dst_ip != ''").
+		Group("dst_ip").Order("bytes DESC, count DESC").Limit(top).Scan(&s.TopDestinations)
+	return s, nil
+}
@@ -0,0 +1,42 @@
+package database
+
+import "time"
+
+// EventStore receives the batches of captured events written by the
+// daemon. *DB is the default; high-volume deployments can move the event
+// write path to another backend such as ClickHouse.
+type EventStore interface {
+	InsertBatch(events []NetworkEvent) error
+	Close() error
+}
+
+// RepeatStore is implemented by event stores that can raise the repeat
+// count of stored events, so the capture's deduplication can fold repeats
+// arriving after the first event was written. With other stores a run of
+// repeats ends with the batch it started in.
+type RepeatStore interface {
+	UpdateRepeats(repeats []Repeat) error
+}
+
+// UniqueStore is implemented by event stores that can skip events whose
+// content hash is stored already, so batches sent by external producers can
+// be retried. InsertUnique sets the ID and hash of the events it stores.
+type UniqueStore interface {
+	InsertUnique(events []NetworkEvent) (inserted, duplicates int, err error)
+}
+
+// Repeat is the repeat count and last occurrence of a stored event
+type Repeat struct {
+	ID       uint
+	Repeats  int64
+	LastSeen time.Time
+}
+
+// Discard is an EventStore that keeps nothing, for sensors whose events
+// only go to streams and log files
+var Discard EventStore = discardStore{}
+
+type discardStore struct{}
+
+func (discardStore) InsertBatch([]NetworkEvent) error { return nil }
+func (discardStore) Close() error                     { return nil }
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Errors returned by the saved view methods
+var (
+	ErrViewNotFound = errors.New("view not found")
+	ErrViewExists   = errors.New("view name already in use")
+)
+
+// SavedView is a named combination of event filters, e.g. "IoT VLAN
+// outbound", kept for recurring investigations
+type SavedView struct {
+	ID          uint              `gorm:"primaryKey" json:"id"`
+	Name        string            `gorm:"uniqueIndex;not null" json:"name"`
+	Description string            `json:"description"`
+	Filters     map[string]string `gorm:"serializer:json" json:"filters"` // events API parameters, see FilterParams
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// Filter compiles the filters of the view; nil when it filters nothing
+func (v *SavedView) Filter() (*Filter, error) {
+	return ParamsFilter(v.Filters)
+}
+
+// FilterWith compiles the filters of the view narrowed by a filter
+// expression, which is ANDed with any expression the view stores
+func (v *SavedView) FilterWith(expr string) (*Filter, error) {
+	params := maps.Clone(v.Filters)
+	if params == nil {
+		params = map[string]string{}
+	}
+	if stored := params["query"]; stored != "" && expr != "" {
+		params["query"] = "(" + stored + ") AND (" + expr + ")"
+	} else if expr != "" {
+		params["query"] = expr
+	}
+	f, err := ParamsFilter(params)
+	if err != nil || f == nil {
+		return f, err
+	}
+	// Reports show the view by name rather than its parameters
+	f.Expr = fmt.Sprintf("view %q", v.Name)
+	if expr != "" {
+		f.Expr += " AND " + expr
+	}
+	return f, nil
+}
+
+// Views returns all saved views ordered by name
+func (db *DB) Views() ([]SavedView, error) {
+	views := []SavedView{}
+	err := db.Order("name").Find(&views).Error
+	return views, err
+}
+
+// View returns the saved view with the given ID
+func (db *DB) View(id uint) (*SavedView, error) {
+	return db.findView("id = ?", id)
+}
+
+// ViewByName returns the saved view with the given name
+func (db *DB) ViewByName(name string) (*SavedView, error) {
+	return db.findView("name = ?", name)
+}
+
+func (db *DB) findView(cond string, arg any) (*SavedView, error) {
+	var view SavedView
+	err := db.Where(cond, arg).Take(&view).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrViewNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
+
+// SaveView creates the view, or updates it when it has an ID. The name
+// must be unique.
+func (db *DB) SaveView(view *SavedView) error {
+	var clash int64
+	if err := db.Model(&SavedView{}).Where("name = ? AND id != ?", view.Name, view.ID).Count(&clash).Error; err != nil {
+		return err
+	}
+	if clash > 0 {
+		return fmt.Errorf("%w: %q", ErrViewExists, view.Name)
+	}
+	if view.ID == 0 {
+		return db.Create(view).Error
+	}
+	result := db.Model(view).Select("name", "description", "filters").Updates(view)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrViewNotFound
+	}
+	return result.Error
+}
+
+// DeleteView removes the saved view with the given ID
+func (db *DB) DeleteView(id uint) error {
+	result := db.Delete(&SavedView{}, id)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrViewNotFound
+	}
+	return result.Error
+}
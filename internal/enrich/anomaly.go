@@ -0,0 +1,321 @@
+package enrich
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// Anomaly reasons stored in NetworkEvent.AnomalyReasons
+const (
+	ReasonNovelDestination = "novel_destination"
+	ReasonRarePort         = "rare_port"
+	ReasonOddHour          = "odd_hour"
+	ReasonLargeVolume      = "large_volume"
+)
+
+// Score weights; a new destination on a rare port at 3am moving an unusual
+// amount of data scores 100
+var anomalyWeights = map[string]uint8{
+	ReasonNovelDestination: 30,
+	ReasonRarePort:         25,
+	ReasonOddHour:          20,
+	ReasonLargeVolume:      25,
+}
+
+const (
+	// A source needs this many events before it has a baseline to deviate from
+	minSourceHistory = 50
+	// Ports need this many observations in total before one counts as rare
+	minPortHistory = 1000
+	// A port seen on less than this share of connections is rare
+	rarePortShare = 0.001
+	// An hour with less than this share of a source's activity is odd, once
+	// the source has enough events to have a daily pattern
+	oddHourShare   = 0.01
+	minHourHistory = 500
+	// Volume more than this many standard deviations above the mean is large
+	largeVolumeSigma = 3.0
+	// Bounds on remembered sources and destinations per source
+	maxAnomalySources     = 10000
+	maxSourceDestinations = 5000
+)
+
+// sourceProfile is the learned behaviour of one source address
+type sourceProfile struct {
+	events       int64
+	destinations map[string]bool
+	hours        [24]int64
+	// Running mean and variance of bytes per connection (Welford)
+	volumeCount int64
+	volumeMean  float64
+	volumeM2    float64
+}
+
+// AnomalyScorer gives each event a 0-100 score for how unusual it is
+// compared to what its source has done before: a never-seen destination,
+// a rarely used port, activity at an hour the source is normally quiet, or
+// a connection moving far more data than usual. Profiles are learned from
+// the events as they are scored.
+type AnomalyScorer struct {
+	sources    map[string]*sourceProfile
+	ports      map[uint16]int64
+	portEvents int64
+	mutex      sync.Mutex
+}
+
+// NewAnomalyScorer creates a scorer with no history
+func NewAnomalyScorer() *AnomalyScorer {
+	return &AnomalyScorer{
+		sources: make(map[string]*sourceProfile),
+		ports:   make(map[uint16]int64),
+	}
+}
+
+// Name returns the enricher name
+func (a *AnomalyScorer) Name() string {
+	return "anomaly"
+}
+
+// Enrich scores the event against the learned profiles, then learns from it
+func (a *AnomalyScorer) Enrich(event *database.NetworkEvent) {
+	if event.SrcIP == "" {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	reasons := a.score(event)
+	a.observe(event)
+	if len(reasons) == 0 {
+		return
+	}
+	var score uint8
+	for _, r := range reasons {
+		score += anomalyWeights[r]
+	}
+	event.AnomalyScore = score
+	event.AnomalyReasons = strings.Join(reasons, ",")
+}
+
+// Reset clears the score before the event is re-scored
+func (a *AnomalyScorer) Reset(event *database.NetworkEvent) {
+	event.AnomalyScore = 0
+	event.AnomalyReasons = ""
+}
+
+// Columns returns the event columns the scorer writes
+func (a *AnomalyScorer) Columns() []string {
+	return []string{"anomaly_score", "anomaly_reasons"}
+}
+
+// Learn builds profiles from stored events newer than since without
+// changing them, so scores stay meaningful across restarts
+func (a *AnomalyScorer) Learn(db *database.DB, since time.Time) (int64, error) {
+	var learned int64
+	var batch []database.NetworkEvent
+	err := db.Where("timestamp >= ? AND event_type != ?", since, database.EventHourlySummary).
+		Order("id ASC").
+		FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+			a.mutex.Lock()
+			for i := range batch {
+				if batch[i].SrcIP != "" {
+					a.observe(&batch[i])
+				}
+			}
+			a.mutex.Unlock()
+			learned += int64(len(batch))
+			return nil
+		}).Error
+	return learned, err
+}
+
+// Save replaces the stored baselines with the current profiles, so a
+// restart can resume from them instead of re-learning from raw events
+func (a *AnomalyScorer) Save(db *database.DB) error {
+	a.mutex.Lock()
+	sources := make([]database.SourceBaseline, 0, len(a.sources))
+	now := time.Now()
+	for ip, p := range a.sources {
+		hours := make([]string, len(p.hours))
+		for h, n := range p.hours {
+			hours[h] = strconv.FormatInt(n, 10)
+		}
+		dests := make([]string, 0, len(p.destinations))
+		for d := range p.destinations {
+			dests = append(dests, d)
+		}
+		sources = append(sources, database.SourceBaseline{
+			SrcIP:        ip,
+			Events:       p.events,
+			Destinations: strings.Join(dests, "\n"),
+			Hours:        strings.Join(hours, ","),
+			VolumeCount:  p.volumeCount,
+			VolumeMean:   p.volumeMean,
+			VolumeM2:     p.volumeM2,
+			UpdatedAt:    now,
+		})
+	}
+	ports := make([]database.PortBaseline, 0, len(a.ports))
+	for port, n := range a.ports {
+		ports = append(ports, database.PortBaseline{Port: port, Count: n})
+	}
+	a.mutex.Unlock()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&database.SourceBaseline{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("1 = 1").Delete(&database.PortBaseline{}).Error; err != nil {
+			return err
+		}
+		if len(sources) > 0 {
+			if err := tx.CreateInBatches(sources, 500).Error; err != nil {
+				return err
+			}
+		}
+		if len(ports) > 0 {
+			if err := tx.CreateInBatches(ports, 500).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Load restores profiles saved by Save and returns when they were saved,
+// or the zero time if there are none. Events after that time still need
+// to be learned.
+func (a *AnomalyScorer) Load(db *database.DB) (time.Time, error) {
+	var sources []database.SourceBaseline
+	if err := db.Find(&sources).Error; err != nil {
+		return time.Time{}, err
+	}
+	var ports []database.PortBaseline
+	if err := db.Find(&ports).Error; err != nil {
+		return time.Time{}, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var saved time.Time
+	for _, s := range sources {
+		p := &sourceProfile{
+			events:       s.Events,
+			destinations: make(map[string]bool),
+			volumeCount:  s.VolumeCount,
+			volumeMean:   s.VolumeMean,
+			volumeM2:     s.VolumeM2,
+		}
+		for h, n := range strings.Split(s.Hours, ",") {
+			if h < len(p.hours) {
+				p.hours[h], _ = strconv.ParseInt(n, 10, 64)
+			}
+		}
+		if s.Destinations != "" {
+			for _, d := range strings.Split(s.Destinations, "\n") {
+				p.destinations[d] = true
+			}
+		}
+		a.sources[s.SrcIP] = p
+		if s.UpdatedAt.After(saved) {
+			saved = s.UpdatedAt
+		}
+	}
+	for _, port := range ports {
+		a.ports[port.Port] = port.Count
+		a.portEvents += port.Count
+	}
+	return saved, nil
+}
+
+// score returns the reasons the event stands out; callers hold the mutex
+func (a *AnomalyScorer) score(event *database.NetworkEvent) []string {
+	var reasons []string
+	profile := a.sources[event.SrcIP]
+	established := profile != nil && profile.events >= minSourceHistory
+
+	if dest := destinationKey(event); dest != "" && established &&
+		!profile.destinations[dest] && len(profile.destinations) < maxSourceDestinations {
+		reasons = append(reasons, ReasonNovelDestination)
+	}
+
+	if isConnection(event) && a.portEvents >= minPortHistory &&
+		float64(a.ports[event.DstPort]) < rarePortShare*float64(a.portEvents) {
+		reasons = append(reasons, ReasonRarePort)
+	}
+
+	if profile != nil && profile.events >= minHourHistory && float64(profile.hours[event.Timestamp.Hour()]) < oddHourShare*float64(profile.events) {
+		reasons = append(reasons, ReasonOddHour)
+	}
+
+	if event.ByteCount > 0 && established && profile.volumeCount >= minSourceHistory {
+		stddev := math.Sqrt(profile.volumeM2 / float64(profile.volumeCount))
+		if float64(event.ByteCount) > profile.volumeMean+largeVolumeSigma*max(stddev, 1) {
+			reasons = append(reasons, ReasonLargeVolume)
+		}
+	}
+	return reasons
+}
+
+// observe adds the event to the profiles; callers hold the mutex
+func (a *AnomalyScorer) observe(event *database.NetworkEvent) {
+	profile := a.sources[event.SrcIP]
+	if profile == nil {
+		if len(a.sources) >= maxAnomalySources {
+			return
+		}
+		profile = &sourceProfile{destinations: make(map[string]bool)}
+		a.sources[event.SrcIP] = profile
+	}
+
+	profile.events++
+	profile.hours[event.Timestamp.Hour()]++
+	if dest := destinationKey(event); dest != "" && len(profile.destinations) < maxSourceDestinations {
+		profile.destinations[dest] = true
+	}
+	if event.ByteCount > 0 {
+		profile.volumeCount++
+		delta := float64(event.ByteCount) - profile.volumeMean
+		profile.volumeMean += delta / float64(profile.volumeCount)
+		profile.volumeM2 += delta * (float64(event.ByteCount) - profile.volumeMean)
+	}
+
+	if isConnection(event) {
+		a.ports[event.DstPort]++
+		a.portEvents++
+	}
+}
+
+// isConnection reports whether the event opens a connection to a service
+// port; DNS responses and ICMP carry client or no ports
+func isConnection(event *database.NetworkEvent) bool {
+	if event.DstPort == 0 {
+		return false
+	}
+	switch event.EventType {
+	case database.EventTCPStart, database.EventUDPStart, database.EventTLSSNI,
+		database.EventTCP, database.EventUDP:
+		return true
+	}
+	return false
+}
+
+// destinationKey names what an event talks to, preferring names over
+// addresses so CDN address churn does not look novel
+func destinationKey(event *database.NetworkEvent) string {
+	switch {
+	case event.DNSQuery != "":
+		return event.DNSQuery
+	case event.TLSSNI != "":
+		return event.TLSSNI
+	case event.Hostname != "":
+		return event.Hostname
+	}
+	return event.DstIP
+}
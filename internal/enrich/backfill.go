@@ -0,0 +1,106 @@
+package enrich
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// Backfiller is an enricher that can be re-run over stored events. Reset
+// clears the fields it owns so stale annotations (e.g. an IP removed from a
+// feed) are dropped, and Columns names those fields for the update.
+type Backfiller interface {
+	Enricher
+	Reset(event *database.NetworkEvent)
+	Columns() []string
+}
+
+// BackfillOptions controls a historical re-enrichment run
+type BackfillOptions struct {
+	Since     time.Duration              // only events newer than this; 0 = all
+	BatchSize int                        // events read and updated per batch
+	Progress  func(scanned, total int64) // called after every batch
+}
+
+// BackfillStats holds the outcome of a re-enrichment run
+type BackfillStats struct {
+	Scanned int64 `json:"scanned"`
+	Updated int64 `json:"updated"`
+}
+
+// Backfill re-runs the enrichers over historical events in ID order and
+// writes back only the enrichment columns of events that changed
+func Backfill(db *database.DB, enrichers []Backfiller, opts BackfillOptions) (*BackfillStats, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	var columns []string
+	for _, e := range enrichers {
+		columns = append(columns, e.Columns()...)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no enrichers to run")
+	}
+
+	var cutoff time.Time
+	if opts.Since > 0 {
+		cutoff = time.Now().Add(-opts.Since)
+	}
+	scope := func() *gorm.DB {
+		return db.Model(&database.NetworkEvent{}).Where("timestamp >= ?", cutoff)
+	}
+
+	var total int64
+	if err := scope().Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count events: %w", err)
+	}
+
+	stats := &BackfillStats{}
+	var lastID uint
+	for {
+		var batch []database.NetworkEvent
+		if err := scope().Where("id > ?", lastID).Order("id ASC").Limit(opts.BatchSize).Find(&batch).Error; err != nil {
+			return stats, fmt.Errorf("failed to read batch after id %d: %w", lastID, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var changed []database.NetworkEvent
+		for _, event := range batch {
+			before := event
+			for _, e := range enrichers {
+				e.Reset(&event)
+				e.Enrich(&event)
+			}
+			if event != before {
+				changed = append(changed, event)
+			}
+		}
+
+		if len(changed) > 0 {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				for i := range changed {
+					if err := tx.Model(&changed[i]).Select(columns).Updates(&changed[i]).Error; err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return stats, fmt.Errorf("failed to update batch after id %d: %w", lastID, err)
+			}
+		}
+
+		lastID = batch[len(batch)-1].ID
+		stats.Scanned += int64(len(batch))
+		stats.Updated += int64(len(changed))
+		if opts.Progress != nil {
+			opts.Progress(stats.Scanned, total)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,284 @@
+package enrich
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/charmbracelet/log"
+)
+
+// BlocklistSource describes one IP/domain list and where to load it from
+type BlocklistSource struct {
+	Name    string
+	Source  string        // local file path or http(s) URL
+	Refresh time.Duration // how often the list is reloaded
+}
+
+// blocklistSet holds the parsed entries of one source
+type blocklistSet struct {
+	ips     map[string]bool
+	nets    []*net.IPNet
+	domains map[string]bool
+}
+
+// Blocklist tags events whose addresses or domains appear on a threat
+// intelligence list (e.g. abuse.ch Feodo Tracker, URLhaus hostfile)
+type Blocklist struct {
+	sources []BlocklistSource
+	sets    map[string]*blocklistSet
+	mutex   sync.RWMutex
+	logger  *log.Logger
+	client  *http.Client
+}
+
+// NewBlocklist creates an empty blocklist; add sources with AddSource
+func NewBlocklist(logger *log.Logger) *Blocklist {
+	return &Blocklist{
+		sets:   make(map[string]*blocklistSet),
+		logger: logger,
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// ParseBlocklistSources parses "name=source[@refresh],..." where source is
+// a file path or URL, e.g. "feodo=https://feodotracker.abuse.ch/downloads/ipblocklist.txt@1h"
+func ParseBlocklistSources(spec string) ([]BlocklistSource, error) {
+	var sources []BlocklistSource
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || rest == "" {
+			return nil, fmt.Errorf("invalid blocklist %q, expected name=source[@refresh]", entry)
+		}
+
+		src := BlocklistSource{Name: strings.TrimSpace(name), Source: rest}
+		if at := strings.LastIndex(rest, "@"); at > 0 {
+			if d, err := time.ParseDuration(rest[at+1:]); err == nil {
+				src.Source = rest[:at]
+				src.Refresh = d
+			}
+		}
+		if src.Refresh == 0 {
+			if isURL(src.Source) {
+				src.Refresh = time.Hour
+			} else {
+				src.Refresh = 5 * time.Minute
+			}
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// AddSource registers a list to be loaded by Load and LoadSource
+func (b *Blocklist) AddSource(src BlocklistSource) {
+	b.sources = append(b.sources, src)
+}
+
+// Load fetches every source once. Sources that fail keep their previous
+// entries so a feed outage does not silently clear the list.
+func (b *Blocklist) Load() {
+	for _, src := range b.sources {
+		_ = b.LoadSource(src)
+	}
+}
+
+// Name returns the enricher name
+func (b *Blocklist) Name() string {
+	return "blocklist"
+}
+
+// Enrich flags the event when any of its addresses or names is listed
+func (b *Blocklist) Enrich(event *database.NetworkEvent) {
+	lists := b.matchEvent(event)
+	if len(lists) == 0 {
+		return
+	}
+	event.Threat = true
+	event.ThreatList = strings.Join(lists, ",")
+}
+
+// Reset clears the threat annotation before the event is re-checked
+func (b *Blocklist) Reset(event *database.NetworkEvent) {
+	event.Threat = false
+	event.ThreatList = ""
+}
+
+// Columns returns the event columns the blocklist writes
+func (b *Blocklist) Columns() []string {
+	return []string{"threat", "threat_list"}
+}
+
+// Sources returns the configured sources
+func (b *Blocklist) Sources() []BlocklistSource {
+	return b.sources
+}
+
+// matchEvent returns the sorted names of all lists matching the event
+func (b *Blocklist) matchEvent(event *database.NetworkEvent) []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if len(b.sets) == 0 {
+		return nil
+	}
+
+	var candidatesIP, candidatesDomain []string
+	candidatesIP = append(candidatesIP, event.SrcIP, event.DstIP)
+	if event.DNSAnswers != "" {
+		candidatesIP = append(candidatesIP, strings.Split(event.DNSAnswers, ",")...)
+	}
+	candidatesDomain = append(candidatesDomain, event.DNSQuery, event.TLSSNI, event.Hostname)
+	if event.DNSCNAMEs != "" {
+		candidatesDomain = append(candidatesDomain, strings.Split(event.DNSCNAMEs, ",")...)
+	}
+
+	var lists []string
+	for name, set := range b.sets {
+		if set.matchAnyIP(candidatesIP) || set.matchAnyDomain(candidatesDomain) {
+			lists = append(lists, name)
+		}
+	}
+	sort.Strings(lists)
+	return lists
+}
+
+// LoadSource reads and parses one source, replacing its previous entries.
+// On failure the previous entries are kept.
+func (b *Blocklist) LoadSource(src BlocklistSource) error {
+	reader, err := b.open(src.Source)
+	if err != nil {
+		b.logger.Warn("[BLOCKLIST] Failed to load list", "list", src.Name, "source", src.Source, "error", err)
+		return err
+	}
+	defer reader.Close()
+
+	set, err := parseBlocklist(reader)
+	if err != nil {
+		b.logger.Warn("[BLOCKLIST] Failed to parse list", "list", src.Name, "source", src.Source, "error", err)
+		return err
+	}
+
+	b.mutex.Lock()
+	b.sets[src.Name] = set
+	b.mutex.Unlock()
+
+	b.logger.Info("[BLOCKLIST] Loaded list",
+		"list", src.Name,
+		"ips", len(set.ips),
+		"networks", len(set.nets),
+		"domains", len(set.domains),
+	)
+	return nil
+}
+
+// open returns a reader for a file path or http(s) URL
+func (b *Blocklist) open(source string) (io.ReadCloser, error) {
+	if !isURL(source) {
+		return os.Open(source)
+	}
+	resp, err := b.client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// parseBlocklist reads one entry per line: an IP, a CIDR, a domain, or a
+// hosts-file line ("0.0.0.0 bad.example"). Comments start with # or ;.
+func parseBlocklist(r io.Reader) (*blocklistSet, error) {
+	set := &blocklistSet{
+		ips:     make(map[string]bool),
+		domains: make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := fields[0]
+		// hosts-file format: sinkhole address followed by the listed name
+		if len(fields) > 1 && (entry == "0.0.0.0" || entry == "127.0.0.1" || entry == "::") {
+			entry = fields[1]
+		}
+		// CSV feeds: take the first column
+		entry = strings.Trim(strings.SplitN(entry, ",", 2)[0], `"`)
+
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			set.nets = append(set.nets, n)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			set.ips[ip.String()] = true
+		} else if strings.Contains(entry, ".") {
+			set.domains[strings.ToLower(strings.TrimSuffix(entry, "."))] = true
+		}
+	}
+	return set, scanner.Err()
+}
+
+// matchAnyIP reports whether any address is listed directly or by network
+func (s *blocklistSet) matchAnyIP(addrs []string) bool {
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			continue
+		}
+		if s.ips[ip.String()] {
+			return true
+		}
+		for _, n := range s.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchAnyDomain reports whether any name or one of its parent domains is listed
+func (s *blocklistSet) matchAnyDomain(names []string) bool {
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		for name != "" {
+			if s.domains[name] {
+				return true
+			}
+			i := strings.Index(name, ".")
+			if i < 0 {
+				break
+			}
+			name = name[i+1:]
+		}
+	}
+	return false
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
@@ -0,0 +1,22 @@
+// Net Watcher - Event enrichment
+// Enrichers annotate events with derived information (threat intel, tags,
+// ...) before they are stored. The same enrichers can be re-run over
+// historical events when their source data changes.
+package enrich
+
+import (
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// Enricher annotates a network event in place
+type Enricher interface {
+	Name() string
+	Enrich(event *database.NetworkEvent)
+}
+
+// Apply runs every enricher over the event in order
+func Apply(enrichers []Enricher, event *database.NetworkEvent) {
+	for _, e := range enrichers {
+		e.Enrich(event)
+	}
+}
@@ -0,0 +1,222 @@
+package enrich
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// PrivacyAction is what privacy mode does to a name before it is stored
+type PrivacyAction int
+
+const (
+	// PrivacyKeep stores the name as captured
+	PrivacyKeep PrivacyAction = iota
+	// PrivacyTruncate keeps the last labels of the name: the site visited,
+	// not the page's content hosts
+	PrivacyTruncate
+	// PrivacyHash replaces the name with a salted hash, so repeat visits
+	// still count as one destination without revealing it
+	PrivacyHash
+	// PrivacyDrop stores no name
+	PrivacyDrop
+)
+
+// privacyFields are the event fields privacy mode covers, by policy name
+var privacyFields = []string{"dns", "sni", "hostname"}
+
+// FieldPolicy is the privacy action for one field
+type FieldPolicy struct {
+	Action PrivacyAction
+	Labels int // labels PrivacyTruncate keeps
+}
+
+// PrivacyPolicy maps the fields dns (queries and CNAMEs), sni and
+// hostname to their action; missing fields are kept
+type PrivacyPolicy map[string]FieldPolicy
+
+// hashedName matches names PrivacyHash produced, which are not hashed
+// again, e.g. when a sensor in privacy mode sends them to a collector in
+// privacy mode
+var hashedName = regexp.MustCompile(`^[0-9a-f]{16}\.hashed$`)
+
+// ParsePrivacyPolicy parses a --privacy value: an action for every field,
+// or comma-separated field=action entries, e.g.
+//
+//	hash
+//	dns=hash,sni=truncate,hostname=truncate:3
+//
+// Actions are keep, truncate (the last two labels, or truncate:N), hash
+// and drop.
+func ParsePrivacyPolicy(spec string) (PrivacyPolicy, error) {
+	policy := make(PrivacyPolicy)
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return policy, nil
+	}
+	if !strings.Contains(spec, "=") {
+		p, err := parseFieldPolicy(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range privacyFields {
+			policy[field] = p
+		}
+		return policy, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		field, action, ok := strings.Cut(entry, "=")
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok {
+			return nil, fmt.Errorf("invalid privacy policy %q, expected field=action", entry)
+		}
+		known := false
+		for _, f := range privacyFields {
+			known = known || f == field
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown privacy field %q, expected dns, sni or hostname", field)
+		}
+		p, err := parseFieldPolicy(action)
+		if err != nil {
+			return nil, err
+		}
+		policy[field] = p
+	}
+	return policy, nil
+}
+
+func parseFieldPolicy(action string) (FieldPolicy, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	name, arg, hasArg := strings.Cut(action, ":")
+	if hasArg && name != "truncate" {
+		return FieldPolicy{}, fmt.Errorf("invalid privacy action %q, only truncate takes a label count", action)
+	}
+	switch name {
+	case "keep":
+		return FieldPolicy{Action: PrivacyKeep}, nil
+	case "hash":
+		return FieldPolicy{Action: PrivacyHash}, nil
+	case "drop":
+		return FieldPolicy{Action: PrivacyDrop}, nil
+	case "truncate":
+		labels := 2
+		if hasArg {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return FieldPolicy{}, fmt.Errorf("invalid label count %q for truncate", arg)
+			}
+			labels = n
+		}
+		return FieldPolicy{Action: PrivacyTruncate, Labels: labels}, nil
+	}
+	return FieldPolicy{}, fmt.Errorf("unknown privacy action %q, expected keep, truncate, hash or drop", action)
+}
+
+// ValidatePrivacyPolicy checks a --privacy value
+func ValidatePrivacyPolicy(spec string) error {
+	_, err := ParsePrivacyPolicy(spec)
+	return err
+}
+
+// Hashes reports whether any field is hashed, which needs a salt
+func (p PrivacyPolicy) Hashes() bool {
+	for _, f := range p {
+		if f.Action == PrivacyHash {
+			return true
+		}
+	}
+	return false
+}
+
+// Privacy hashes, truncates or drops the DNS queries, TLS server names and
+// hostnames of events before they are stored, so a shared household or
+// office can be monitored without keeping everyone's browsing history.
+// It must run after enrichers that match names (blocklists, tags) and
+// before the anomaly scorer, whose baselines store destinations.
+type Privacy struct {
+	policy PrivacyPolicy
+	salt   []byte
+}
+
+// NewPrivacy creates the privacy enricher. The salt keys the hashes; it
+// must stay the same for hashes of one name to match across restarts, and
+// secret for them not to be reversed by hashing candidate names.
+func NewPrivacy(policy PrivacyPolicy, salt string) (*Privacy, error) {
+	if policy.Hashes() && salt == "" {
+		return nil, fmt.Errorf("hashing names needs a salt (--privacy-salt)")
+	}
+	return &Privacy{policy: policy, salt: []byte(salt)}, nil
+}
+
+// Name returns the enricher name
+func (p *Privacy) Name() string {
+	return "privacy"
+}
+
+// Enrich rewrites the names of the event by the policy
+func (p *Privacy) Enrich(event *database.NetworkEvent) {
+	if f, ok := p.policy["dns"]; ok {
+		event.DNSQuery = p.apply(f, event.DNSQuery)
+		if event.DNSCNAMEs != "" {
+			names := strings.Split(event.DNSCNAMEs, ",")
+			for i, name := range names {
+				names[i] = p.apply(f, name)
+			}
+			event.DNSCNAMEs = strings.Join(names, ",")
+			if f.Action == PrivacyDrop {
+				event.DNSCNAMEs = ""
+			}
+		}
+	}
+	if f, ok := p.policy["sni"]; ok {
+		event.TLSSNI = p.apply(f, event.TLSSNI)
+	}
+	if f, ok := p.policy["hostname"]; ok {
+		event.Hostname = p.apply(f, event.Hostname)
+	}
+}
+
+// Rewrite returns a name of one field (dns, sni or hostname) as the policy
+// stores it, e.g. for the capture log
+func (p *Privacy) Rewrite(field, name string) string {
+	f, ok := p.policy[field]
+	if !ok {
+		return name
+	}
+	return p.apply(f, name)
+}
+
+func (p *Privacy) apply(f FieldPolicy, name string) string {
+	if name == "" {
+		return ""
+	}
+	switch f.Action {
+	case PrivacyTruncate:
+		labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+		if len(labels) > f.Labels {
+			labels = labels[len(labels)-f.Labels:]
+		}
+		return strings.Join(labels, ".")
+	case PrivacyHash:
+		if hashedName.MatchString(name) {
+			return name
+		}
+		mac := hmac.New(sha256.New, p.salt)
+		mac.Write([]byte(strings.ToLower(strings.TrimSuffix(name, "."))))
+		return hex.EncodeToString(mac.Sum(nil))[:16] + ".hashed"
+	case PrivacyDrop:
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,163 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	rdnsCacheSize   = 50000            // addresses remembered, named or not
+	rdnsTTL         = 6 * time.Hour    // how long a PTR name is reused
+	rdnsNegativeTTL = 30 * time.Minute // how long an address without a name is not looked up again
+	rdnsTimeout     = 3 * time.Second  // per lookup
+	rdnsQueueSize   = 1024             // addresses waiting for a lookup; more are tried on a later event
+	rdnsWorkers     = 4                // lookups in flight, so slow servers do not hold up the rate
+)
+
+// rdnsEntry is the cached PTR name of one address, empty when it has none
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+	pending bool // queued or being looked up
+}
+
+// ReverseDNS names destinations that no DNS answer seen on the wire named,
+// e.g. cloud addresses reached through DoH or a cached connection, from
+// their PTR records. Lookups run in the background at a limited rate: the
+// event that triggers one is stored without a hostname, later events to
+// the same address get it from the cache.
+type ReverseDNS struct {
+	resolver *net.Resolver
+	interval time.Duration // between lookups
+	logger   *log.Logger
+
+	mutex sync.Mutex
+	cache map[string]*rdnsEntry
+	queue chan string
+}
+
+// NewReverseDNS creates a resolver making at most rate lookups per second;
+// start its lookups with Run
+func NewReverseDNS(rate float64, logger *log.Logger) *ReverseDNS {
+	return &ReverseDNS{
+		resolver: net.DefaultResolver,
+		interval: time.Duration(float64(time.Second) / rate),
+		logger:   logger,
+		cache:    make(map[string]*rdnsEntry),
+		queue:    make(chan string, rdnsQueueSize),
+	}
+}
+
+// Name returns the enricher name
+func (r *ReverseDNS) Name() string {
+	return "rdns"
+}
+
+// Enrich sets the hostname of an unnamed destination from the cache, or
+// queues its lookup
+func (r *ReverseDNS) Enrich(event *database.NetworkEvent) {
+	if event.Hostname != "" || event.DstIP == "" {
+		return
+	}
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if e, ok := r.cache[event.DstIP]; ok && (e.pending || now.Before(e.expires)) {
+		event.Hostname = e.name
+		return
+	}
+	if ip := net.ParseIP(event.DstIP); ip == nil || !reverseLookupable(ip) {
+		return
+	}
+	select {
+	case r.queue <- event.DstIP:
+		r.evict(now)
+		r.cache[event.DstIP] = &rdnsEntry{pending: true}
+	default:
+	}
+}
+
+// Run looks up queued addresses until ctx is cancelled
+func (r *ReverseDNS) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+	for range rdnsWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var addr string
+				select {
+				case <-ctx.Done():
+					return
+				case addr = <-r.queue:
+				}
+				// Every lookup waits for a tick, whichever worker makes it
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				r.lookup(ctx, addr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// lookup resolves one address and caches its first PTR name
+func (r *ReverseDNS) lookup(ctx context.Context, addr string) {
+	lctx, cancel := context.WithTimeout(ctx, rdnsTimeout)
+	defer cancel()
+	names, err := r.resolver.LookupAddr(lctx, addr)
+
+	entry := &rdnsEntry{expires: time.Now().Add(rdnsNegativeTTL)}
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil && len(names) > 0:
+		entry.name = strings.TrimSuffix(names[0], ".")
+		entry.expires = time.Now().Add(rdnsTTL)
+	case err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound):
+		r.logger.Debug("Reverse DNS lookup failed", "ip", addr, "error", err)
+	}
+	r.mutex.Lock()
+	r.cache[addr] = entry
+	r.mutex.Unlock()
+}
+
+// evict makes room when the cache is full: expired entries go first, then
+// arbitrary ones until a tenth is free, so it does not run on every new
+// entry. The caller holds the mutex.
+func (r *ReverseDNS) evict(now time.Time) {
+	if len(r.cache) < rdnsCacheSize {
+		return
+	}
+	for addr, e := range r.cache {
+		if !e.pending && !now.Before(e.expires) {
+			delete(r.cache, addr)
+		}
+	}
+	for addr, e := range r.cache {
+		if len(r.cache) < rdnsCacheSize*9/10 {
+			break
+		}
+		if !e.pending {
+			delete(r.cache, addr)
+		}
+	}
+}
+
+// reverseLookupable reports whether an address may have a PTR record
+// worth asking for: not loopback, link-local, multicast or unspecified
+func reverseLookupable(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsMulticast() &&
+		!ip.IsUnspecified() && !ip.Equal(net.IPv4bcast)
+}
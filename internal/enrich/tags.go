@@ -0,0 +1,223 @@
+package enrich
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// TagRule attaches a tag to events matching all of its conditions. Each
+// condition lists alternatives; an empty condition matches everything.
+type TagRule struct {
+	Tag        string
+	Nets       []*net.IPNet // source or destination address
+	Domains    []string     // DNS query, TLS server name or hostname; * wildcards
+	Ports      []uint16     // source or destination port
+	Interfaces []string     // capture interface; * wildcards
+}
+
+// Tagger labels events by declarative rules, e.g. "streaming" for
+// *.nflxvideo.net or "backup" for port 873 to the NAS
+type Tagger struct {
+	path  string
+	rules []TagRule
+	mutex sync.RWMutex
+}
+
+// NewTagger loads tag rules from a file
+func NewTagger(path string) (*Tagger, error) {
+	t := &Tagger{path: path}
+	if err := t.Load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Load re-reads the rules file, keeping the current rules when it is invalid
+func (t *Tagger) Load() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("failed to open tag rules: %w", err)
+	}
+	defer f.Close()
+
+	var rules []TagRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := ParseTagRule(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", t.path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.rules = rules
+	t.mutex.Unlock()
+	return nil
+}
+
+// Rules returns the number of loaded rules
+func (t *Tagger) Rules() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return len(t.rules)
+}
+
+// ParseTagRule parses one rule: a tag followed by key=value conditions,
+// with comma-separated alternatives, e.g.
+//
+//	work-vpn  cidr=10.8.0.0/16 interface=wg0
+//	streaming domain=*.netflix.com,*.nflxvideo.net
+//	backup    cidr=192.168.1.50/32 port=22,873
+func ParseTagRule(line string) (TagRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return TagRule{}, fmt.Errorf("expected a tag and at least one condition, got %q", strings.TrimSpace(line))
+	}
+	rule := TagRule{Tag: fields[0]}
+	if strings.ContainsAny(rule.Tag, ",=") {
+		return TagRule{}, fmt.Errorf("invalid tag %q", rule.Tag)
+	}
+	for _, cond := range fields[1:] {
+		key, values, ok := strings.Cut(cond, "=")
+		if !ok || values == "" {
+			return TagRule{}, fmt.Errorf("invalid condition %q, expected key=value", cond)
+		}
+		for _, v := range strings.Split(values, ",") {
+			switch key {
+			case "cidr":
+				if !strings.Contains(v, "/") {
+					if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+						v += "/32"
+					} else {
+						v += "/128"
+					}
+				}
+				_, n, err := net.ParseCIDR(v)
+				if err != nil {
+					return TagRule{}, fmt.Errorf("invalid cidr %q", v)
+				}
+				rule.Nets = append(rule.Nets, n)
+			case "domain":
+				rule.Domains = append(rule.Domains, strings.ToLower(strings.TrimSuffix(v, ".")))
+			case "port":
+				p, err := strconv.ParseUint(v, 10, 16)
+				if err != nil {
+					return TagRule{}, fmt.Errorf("invalid port %q", v)
+				}
+				rule.Ports = append(rule.Ports, uint16(p))
+			case "interface":
+				rule.Interfaces = append(rule.Interfaces, v)
+			default:
+				return TagRule{}, fmt.Errorf("unknown condition %q, expected cidr, domain, port or interface", key)
+			}
+		}
+	}
+	return rule, nil
+}
+
+// Name returns the enricher name
+func (t *Tagger) Name() string {
+	return "tags"
+}
+
+// Enrich sets the tags of every matching rule, sorted and comma-separated
+func (t *Tagger) Enrich(event *database.NetworkEvent) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var tags []string
+	for i := range t.rules {
+		if t.rules[i].matches(event) && !slices.Contains(tags, t.rules[i].Tag) {
+			tags = append(tags, t.rules[i].Tag)
+		}
+	}
+	slices.Sort(tags)
+	event.Tags = strings.Join(tags, ",")
+}
+
+// Reset clears the tags before the event is re-checked
+func (t *Tagger) Reset(event *database.NetworkEvent) {
+	event.Tags = ""
+}
+
+// Columns returns the event columns the tagger writes
+func (t *Tagger) Columns() []string {
+	return []string{"tags"}
+}
+
+func (r *TagRule) matches(e *database.NetworkEvent) bool {
+	if len(r.Ports) > 0 && !slices.Contains(r.Ports, e.DstPort) && !slices.Contains(r.Ports, e.SrcPort) {
+		return false
+	}
+	if len(r.Interfaces) > 0 && !globAny(r.Interfaces, e.Interface) {
+		return false
+	}
+	if len(r.Nets) > 0 && !r.matchesAddr(e.SrcIP) && !r.matchesAddr(e.DstIP) {
+		return false
+	}
+	if len(r.Domains) > 0 {
+		for _, name := range []string{e.DNSQuery, e.TLSSNI, e.Hostname} {
+			if name != "" && globDomain(r.Domains, strings.ToLower(strings.TrimSuffix(name, "."))) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r *TagRule) matchesAddr(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// globDomain matches name against patterns; *.example.com also matches
+// example.com itself
+func globDomain(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if strings.HasPrefix(p, "*.") && (name == p[2:] || strings.HasSuffix(name, p[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func globAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, value); ok {
+			return true
+		}
+	}
+	return false
+}
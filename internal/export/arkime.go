@@ -0,0 +1,192 @@
+package export
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// arkimeEndpoint is the source or destination of an Arkime session
+type arkimeEndpoint struct {
+	IP    string `json:"ip"`
+	Port  uint16 `json:"port,omitempty"`
+	Bytes int64  `json:"bytes"`
+}
+
+// arkimeDNS holds the DNS fields of an Arkime session
+type arkimeDNS struct {
+	Host    []string `json:"host,omitempty"`
+	HostCnt int      `json:"hostCnt,omitempty"`
+	IP      []string `json:"ip,omitempty"`
+	IPCnt   int      `json:"ipCnt,omitempty"`
+	Status  []string `json:"status,omitempty"`
+}
+
+// arkimeTLS holds the TLS fields of an Arkime session
+type arkimeTLS struct {
+	Version    []string `json:"version,omitempty"`
+	VersionCnt int      `json:"versionCnt,omitempty"`
+	Cipher     []string `json:"cipher,omitempty"`
+	CipherCnt  int      `json:"cipherCnt,omitempty"`
+	JA3        []string `json:"ja3,omitempty"`
+	JA3Cnt     int      `json:"ja3Cnt,omitempty"`
+	JA4        []string `json:"ja4,omitempty"`
+	JA4Cnt     int      `json:"ja4Cnt,omitempty"`
+}
+
+// arkimeHTTP carries the TLS server name, which Arkime files under
+// host.http like an HTTP Host header
+type arkimeHTTP struct {
+	Host    []string `json:"host"`
+	HostCnt int      `json:"hostCnt"`
+}
+
+// arkimeSession is one session document (SPI data) as Arkime stores it in
+// its sessions3 indices
+type arkimeSession struct {
+	Timestamp   int64          `json:"@timestamp"`
+	FirstPacket int64          `json:"firstPacket"`
+	LastPacket  int64          `json:"lastPacket"`
+	Length      int64          `json:"length"`
+	IPProtocol  int            `json:"ipProtocol"`
+	Node        string         `json:"node"`
+	Source      arkimeEndpoint `json:"source"`
+	Destination arkimeEndpoint `json:"destination"`
+	Network     struct {
+		Bytes int64 `json:"bytes"`
+	} `json:"network"`
+	TotDataBytes int64       `json:"totDataBytes"`
+	Protocol     []string    `json:"protocol"`
+	ProtocolCnt  int         `json:"protocolCnt"`
+	DNS          *arkimeDNS  `json:"dns,omitempty"`
+	TLS          *arkimeTLS  `json:"tls,omitempty"`
+	HTTP         *arkimeHTTP `json:"http,omitempty"`
+	Tags         []string    `json:"tags"`
+	TagsCnt      int         `json:"tagsCnt"`
+}
+
+// writeArkime writes an event as an Elasticsearch bulk index action plus
+// Arkime session document. Only finished sessions are exported: merged or
+// END connection events, DNS responses, TLS handshakes and ICMP; START
+// events are covered by their END and sessions still open are left out.
+func writeArkime(w io.Writer, event *database.NetworkEvent, opts Options) (bool, error) {
+	s, ok := arkimeSessionOf(event)
+	if !ok {
+		return false, nil
+	}
+	s.Node = opts.Node
+
+	action := map[string]map[string]string{
+		"index": {"_index": opts.IndexPrefix + "sessions3-" + time.UnixMilli(s.FirstPacket).UTC().Format("060102")},
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(action); err != nil {
+		return false, err
+	}
+	return true, enc.Encode(s)
+}
+
+// arkimeSessionOf maps an event to a session document
+func arkimeSessionOf(e *database.NetworkEvent) (*arkimeSession, bool) {
+	first, last := e.Timestamp, e.Timestamp
+	s := &arkimeSession{
+		Source:      arkimeEndpoint{IP: e.SrcIP, Port: e.SrcPort},
+		Destination: arkimeEndpoint{IP: e.DstIP, Port: e.DstPort},
+		Tags:        []string{"net-watcher"},
+	}
+
+	switch e.EventType {
+	case database.EventTCP, database.EventUDP:
+		if !e.EndTime.IsZero() {
+			last = e.EndTime
+		} else {
+			last = first.Add(time.Duration(e.Duration) * time.Millisecond)
+		}
+	case database.EventTCPEnd, database.EventUDPEnd:
+		first = last.Add(-time.Duration(e.Duration) * time.Millisecond)
+	case database.EventDNS:
+		switch e.DNSType {
+		case "COMPLETE":
+			if !e.EndTime.IsZero() {
+				last = e.EndTime
+			}
+		case "RESPONSE":
+			// Responses travel server -> client; sessions start at the client
+			s.Source, s.Destination = s.Destination, s.Source
+		default:
+			return nil, false
+		}
+		s.DNS = &arkimeDNS{Host: []string{e.DNSQuery}, HostCnt: 1}
+		if e.DNSAnswers != "" {
+			s.DNS.IP = strings.Split(e.DNSAnswers, ",")
+			s.DNS.IPCnt = len(s.DNS.IP)
+		}
+		if e.DNSRCode != "" {
+			s.DNS.Status = []string{e.DNSRCode}
+		}
+	case database.EventTLSSNI:
+		s.TLS = &arkimeTLS{}
+		s.TLS.Version, s.TLS.VersionCnt = arkimeField(e.TLSVersion)
+		s.TLS.Cipher, s.TLS.CipherCnt = arkimeField(e.TLSCipher)
+		s.TLS.JA3, s.TLS.JA3Cnt = arkimeField(e.TLSJA3)
+		s.TLS.JA4, s.TLS.JA4Cnt = arkimeField(e.TLSJA4)
+		if e.TLSSNI != "" {
+			s.HTTP = &arkimeHTTP{Host: []string{e.TLSSNI}, HostCnt: 1}
+		}
+	case database.EventICMP:
+	default:
+		return nil, false
+	}
+
+	switch {
+	case e.EventType == database.EventICMP:
+		s.IPProtocol = 1
+		s.Protocol = []string{"icmp"}
+	case e.EventType == database.EventDNS:
+		s.IPProtocol = 17
+		s.Protocol = []string{"udp", "dns"}
+	case e.EventType == database.EventTLSSNI:
+		s.IPProtocol = 6
+		s.Protocol = []string{"tcp", "tls"}
+	case e.EventType == database.EventUDP || e.EventType == database.EventUDPEnd:
+		s.IPProtocol = 17
+		s.Protocol = []string{"udp"}
+	default:
+		s.IPProtocol = 6
+		s.Protocol = []string{"tcp"}
+	}
+	s.ProtocolCnt = len(s.Protocol)
+
+	if e.Threat {
+		for _, list := range strings.Split(e.ThreatList, ",") {
+			s.Tags = append(s.Tags, "threat:"+list)
+		}
+	}
+	if e.AnomalyReasons != "" {
+		for _, reason := range strings.Split(e.AnomalyReasons, ",") {
+			s.Tags = append(s.Tags, "anomaly:"+reason)
+		}
+	}
+	s.TagsCnt = len(s.Tags)
+
+	// Byte counts are not split by direction; attribute them to the client
+	s.Source.Bytes = e.ByteCount
+	s.Network.Bytes = e.ByteCount
+	s.TotDataBytes = e.ByteCount
+	s.FirstPacket = first.UnixMilli()
+	s.LastPacket = last.UnixMilli()
+	s.Length = s.LastPacket - s.FirstPacket
+	s.Timestamp = s.LastPacket
+	return s, true
+}
+
+// arkimeField returns a single-valued Arkime field and its count
+func arkimeField(value string) ([]string, int) {
+	if value == "" {
+		return nil, 0
+	}
+	return []string{value}, 1
+}
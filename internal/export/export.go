@@ -0,0 +1,69 @@
+// Net Watcher - Event export
+// Writes stored events in formats other tools can import, so net-watcher
+// can act as a lightweight sensor for existing analysis stacks.
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// Formats lists the export formats
+var Formats = []string{"arkime"}
+
+// Options controls what is exported
+type Options struct {
+	Since       time.Duration // how far back from now the export reaches
+	Node        string        // sensor name recorded on exported sessions
+	IndexPrefix string        // Arkime index prefix (default arkime_)
+}
+
+// ValidFormat reports whether name is one of Formats
+func ValidFormat(name string) bool {
+	return slices.Contains(Formats, name)
+}
+
+// Write exports the events of the period to w and returns how many records
+// were written
+func Write(db *database.DB, w io.Writer, format string, opts Options) (int, error) {
+	var encode func(w io.Writer, event *database.NetworkEvent) (bool, error)
+	switch format {
+	case "arkime":
+		if opts.IndexPrefix == "" {
+			opts.IndexPrefix = "arkime_"
+		}
+		encode = func(w io.Writer, event *database.NetworkEvent) (bool, error) {
+			return writeArkime(w, event, opts)
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	bw := bufio.NewWriter(w)
+	written := 0
+	var batch []database.NetworkEvent
+	err := db.Where("timestamp >= ? AND event_type != ?", time.Now().Add(-opts.Since), database.EventHourlySummary).
+		Order("id ASC").
+		FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				ok, err := encode(bw, &batch[i])
+				if err != nil {
+					return err
+				}
+				if ok {
+					written++
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return written, fmt.Errorf("export failed: %w", err)
+	}
+	return written, bw.Flush()
+}
@@ -0,0 +1,193 @@
+// Package importer reads the logs of other network sensors, Zeek conn.log
+// and dns.log and Suricata eve.json, into NetworkEvents, so their traffic
+// gets net-watcher's storage, compaction, reports and dashboard.
+package importer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// Formats lists the log formats that can be imported
+var Formats = []string{"zeek", "suricata"}
+
+// batchSize is how many events are handed to the store at once
+const batchSize = 1000
+
+// maxLine bounds one log line; eve.json records with large payloads are
+// the longest
+const maxLine = 16 << 20
+
+// Options controls how records become events
+type Options struct {
+	Sensor    string // stored on every event (default: the format)
+	Interface string // stored on events whose record names none
+}
+
+// Stats reports what an import read
+type Stats struct {
+	Records int64 `json:"records"` // log records read
+	Events  int64 `json:"events"`  // events produced
+	Skipped int64 `json:"skipped"` // records of a kind with no event, e.g. Suricata http
+	Invalid int64 `json:"invalid"` // records that failed to parse
+}
+
+// ImportFile reads the log at path, gzip-compressed if its name ends in
+// .gz as Zeek archives are, and hands its events to store in batches
+func ImportFile(path, format string, opts Options, store func([]database.NetworkEvent) error) (Stats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return Stats{}, fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	stats, err := Import(r, format, opts, store)
+	if err != nil {
+		return stats, fmt.Errorf("%s: %w", path, err)
+	}
+	return stats, nil
+}
+
+// Import reads a log in format, one of Formats, and hands its events to
+// store in batches. Records that fail to parse are counted and skipped.
+func Import(r io.Reader, format string, opts Options, store func([]database.NetworkEvent) error) (Stats, error) {
+	if opts.Sensor == "" {
+		opts.Sensor = format
+	}
+	var parse func(line string) ([]database.NetworkEvent, error)
+	switch format {
+	case "zeek":
+		parse = newZeekParser().parse
+	case "suricata":
+		parse = parseEve
+	default:
+		return Stats{}, fmt.Errorf("unknown log format %q (use %s)", format, strings.Join(Formats, " or "))
+	}
+
+	var stats Stats
+	batch := make([]database.NetworkEvent, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := store(batch)
+		batch = make([]database.NetworkEvent, 0, batchSize)
+		return err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		events, err := parse(line)
+		switch {
+		case err == errHeader:
+			continue
+		case err == errSkipped:
+			stats.Records++
+			stats.Skipped++
+			continue
+		case err != nil:
+			stats.Records++
+			stats.Invalid++
+			continue
+		}
+		stats.Records++
+		for _, e := range events {
+			e.Sensor = opts.Sensor
+			if e.Interface == "" {
+				e.Interface = opts.Interface
+			}
+			batch = append(batch, e)
+			stats.Events++
+		}
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	return stats, flush()
+}
+
+// errHeader marks a line that holds no record, such as a Zeek header
+var errHeader = fmt.Errorf("header line")
+
+// errSkipped marks a record of a kind that maps to no event
+var errSkipped = fmt.Errorf("record skipped")
+
+// endpoints validates the addresses of a record and returns its IP version
+func endpoints(src, dst string) (uint8, error) {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP == nil || dstIP == nil {
+		return 0, fmt.Errorf("invalid addresses %q and %q", src, dst)
+	}
+	if srcIP.To4() != nil {
+		return 4, nil
+	}
+	return 6, nil
+}
+
+// splitAnswers sorts DNS answers into addresses and names (CNAMEs and
+// other records), as captured DNS events store them
+func splitAnswers(answers []string) (ips, names []string) {
+	for _, a := range answers {
+		if a == "" {
+			continue
+		}
+		if net.ParseIP(a) != nil {
+			ips = append(ips, a)
+		} else {
+			names = append(names, a)
+		}
+	}
+	return ips, names
+}
+
+// flowEvents returns the START and closing events of a connection that
+// began at e.Timestamp and ended at e.EndTime, the way capture writes
+// them: TCP_END with FIN or RST for TCP connections that closed, TIMEOUT
+// for the other TCP ones and UDP_END for UDP
+func flowEvents(e database.NetworkEvent, proto, reason string) []database.NetworkEvent {
+	start, end := e, e
+	start.EndTime, start.Duration = time.Time{}, 0
+	start.ByteCount, start.SrcBytes, start.DstBytes = 0, 0, 0
+	end.Timestamp = e.EndTime
+	switch proto {
+	case "tcp":
+		start.EventType = database.EventTCPStart
+		switch reason {
+		case "FIN", "RST":
+			end.EventType, end.Reason = database.EventTCPEnd, reason
+		default:
+			end.EventType, end.Reason, end.Protocol = database.EventTimeout, "TIMEOUT", "TCP"
+		}
+	case "udp":
+		start.EventType = database.EventUDPStart
+		end.EventType, end.Reason = database.EventUDPEnd, "TIMEOUT"
+	default:
+		return nil
+	}
+	return []database.NetworkEvent{start, end}
+}
@@ -0,0 +1,220 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// eveRecord holds the fields of a Suricata eve.json record that map to
+// events: flow, dns and tls records
+type eveRecord struct {
+	Timestamp string   `json:"timestamp"`
+	EventType string   `json:"event_type"`
+	FlowID    int64    `json:"flow_id"`
+	InIface   string   `json:"in_iface"`
+	VLAN      []uint16 `json:"vlan"`
+	SrcIP     string   `json:"src_ip"`
+	SrcPort   uint16   `json:"src_port"`
+	DestIP    string   `json:"dest_ip"`
+	DestPort  uint16   `json:"dest_port"`
+	Proto     string   `json:"proto"`
+	ICMPType  uint8    `json:"icmp_type"`
+	ICMPCode  uint8    `json:"icmp_code"`
+	Flow      *struct {
+		BytesToServer int64  `json:"bytes_toserver"`
+		BytesToClient int64  `json:"bytes_toclient"`
+		Start         string `json:"start"`
+		End           string `json:"end"`
+		Alerted       bool   `json:"alerted"`
+	} `json:"flow"`
+	TCP *struct {
+		FIN bool `json:"fin"`
+		RST bool `json:"rst"`
+	} `json:"tcp"`
+	DNS *struct {
+		Type    string      `json:"type"`
+		ID      uint16      `json:"id"`
+		RRName  string      `json:"rrname"` // version 2 records
+		RCode   string      `json:"rcode"`
+		Queries []eveDNSRR  `json:"queries"` // version 3 records
+		Answers []eveDNSRR  `json:"answers"`
+		Grouped eveDNSGroup `json:"grouped"`
+	} `json:"dns"`
+	TLS *struct {
+		SNI     string `json:"sni"`
+		Version string `json:"version"`
+		JA3     *struct {
+			Hash string `json:"hash"`
+		} `json:"ja3"`
+		JA4 string `json:"ja4"`
+	} `json:"tls"`
+}
+
+// eveDNSRR is a DNS query or answer of an eve.json dns record
+type eveDNSRR struct {
+	RRName string `json:"rrname"`
+	RRType string `json:"rrtype"`
+	TTL    uint32 `json:"ttl"`
+	RData  string `json:"rdata"`
+}
+
+// eveDNSGroup holds the answers of the "grouped" answer format by type
+type eveDNSGroup map[string][]json.RawMessage
+
+// eveTimeLayout is Suricata's timestamp format, with an offset like +0000
+const eveTimeLayout = "2006-01-02T15:04:05.999999-0700"
+
+// parseEveTime parses an eve.json timestamp
+func parseEveTime(s string) (time.Time, error) {
+	if t, err := time.Parse(eveTimeLayout, s); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t.UTC(), err
+}
+
+// parseEve maps an eve.json record: flow records to the START and closing
+// events of a connection, or an ICMP event, dns records to DNS events and
+// tls records to TLS_SNI events. Flows Suricata raised an alert on are
+// flagged as threats from the "suricata" list. Other records, alerts
+// included, are skipped.
+func parseEve(line string) ([]database.NetworkEvent, error) {
+	var rec eveRecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		return nil, err
+	}
+	switch rec.EventType {
+	case "flow", "dns", "tls":
+	default:
+		return nil, errSkipped
+	}
+
+	var e database.NetworkEvent
+	ts, err := parseEveTime(rec.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", rec.Timestamp)
+	}
+	e.Timestamp = ts
+	if rec.FlowID != 0 {
+		e.FlowID = strconv.FormatInt(rec.FlowID, 10)
+	}
+	e.Interface = rec.InIface
+	if len(rec.VLAN) > 0 {
+		e.VLAN = rec.VLAN[0]
+	}
+	if len(rec.VLAN) > 1 {
+		e.InnerVLAN = rec.VLAN[1]
+	}
+	e.SrcIP, e.SrcPort, e.DstIP, e.DstPort = rec.SrcIP, rec.SrcPort, rec.DestIP, rec.DestPort
+	if e.IPVersion, err = endpoints(e.SrcIP, e.DstIP); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case rec.EventType == "flow" && rec.Flow != nil:
+		return eveFlow(e, &rec)
+	case rec.EventType == "dns" && rec.DNS != nil:
+		return eveDNS(e, &rec)
+	case rec.EventType == "tls" && rec.TLS != nil:
+		e.EventType = database.EventTLSSNI
+		e.TLSSNI = rec.TLS.SNI
+		// "TLS 1.3" as TLS1.3, the way capture names versions
+		e.TLSVersion = strings.ReplaceAll(rec.TLS.Version, " ", "")
+		if rec.TLS.JA3 != nil {
+			e.TLSJA3 = rec.TLS.JA3.Hash
+		}
+		e.TLSJA4 = rec.TLS.JA4
+		return []database.NetworkEvent{e}, nil
+	}
+	return nil, errSkipped
+}
+
+// eveFlow maps a flow record
+func eveFlow(e database.NetworkEvent, rec *eveRecord) ([]database.NetworkEvent, error) {
+	start, err := parseEveTime(rec.Flow.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flow start %q", rec.Flow.Start)
+	}
+	end, err := parseEveTime(rec.Flow.End)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flow end %q", rec.Flow.End)
+	}
+	e.Timestamp, e.EndTime = start, end
+	e.Duration = end.Sub(start).Milliseconds()
+	e.SrcBytes, e.DstBytes = rec.Flow.BytesToServer, rec.Flow.BytesToClient
+	e.ByteCount = e.SrcBytes + e.DstBytes
+	if rec.Flow.Alerted {
+		e.Threat, e.ThreatList = true, "suricata"
+	}
+
+	switch rec.Proto {
+	case "ICMP", "IPv6-ICMP":
+		e.EventType = database.EventICMP
+		e.ICMPType, e.ICMPCode = rec.ICMPType, rec.ICMPCode
+		e.SrcPort, e.DstPort, e.EndTime = 0, 0, time.Time{}
+		return []database.NetworkEvent{e}, nil
+	case "TCP":
+		reason := "TIMEOUT"
+		switch {
+		case rec.TCP != nil && rec.TCP.RST:
+			reason = "RST"
+		case rec.TCP != nil && rec.TCP.FIN:
+			reason = "FIN"
+		}
+		return flowEvents(e, "tcp", reason), nil
+	case "UDP":
+		return flowEvents(e, "udp", ""), nil
+	}
+	return nil, errSkipped
+}
+
+// eveDNS maps a dns record: a query, or an answer to one. Both the
+// version 2 format (Suricata 6 and 7) and version 3 (Suricata 8) are read.
+func eveDNS(e database.NetworkEvent, rec *eveRecord) ([]database.NetworkEvent, error) {
+	dns := rec.DNS
+	e.EventType = database.EventDNS
+	e.DNSID = dns.ID
+	e.DNSQuery = dns.RRName
+	if len(dns.Queries) > 0 {
+		e.DNSQuery = dns.Queries[0].RRName
+	}
+	switch dns.Type {
+	case "query", "request":
+		e.DNSType = "QUERY"
+	case "answer", "response":
+		e.DNSType = "RESPONSE"
+		e.DNSRCode = dns.RCode
+	default:
+		return nil, errSkipped
+	}
+	if e.DNSQuery == "" {
+		return nil, errSkipped
+	}
+
+	var answers []string
+	var ttl uint32
+	for i, a := range dns.Answers {
+		answers = append(answers, a.RData)
+		if i == 0 || a.TTL < ttl {
+			ttl = a.TTL
+		}
+	}
+	// The grouped format lists data by record type, without TTLs
+	for _, values := range dns.Grouped {
+		for _, raw := range values {
+			var data string
+			if json.Unmarshal(raw, &data) == nil {
+				answers = append(answers, data)
+			}
+		}
+	}
+	ips, names := splitAnswers(answers)
+	e.DNSAnswers, e.DNSCNAMEs = strings.Join(ips, ","), strings.Join(names, ",")
+	e.DNSAnswerCount, e.DNSTTL = uint16(len(answers)), ttl
+	return []database.NetworkEvent{e}, nil
+}
@@ -0,0 +1,258 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// zeekParser reads conn.log and dns.log records, in Zeek's tab-separated
+// format with its #fields header or as JSON lines (LogAscii::use_json)
+type zeekParser struct {
+	path      string // log of the TSV header: conn or dns
+	fields    []string
+	separator string
+	setSep    string
+	empty     string
+	unset     string
+}
+
+func newZeekParser() *zeekParser {
+	return &zeekParser{separator: "\t", setSep: ",", empty: "(empty)", unset: "-"}
+}
+
+// zeekRecord holds the fields of a record as text, with unset fields left
+// out and vectors joined by commas
+type zeekRecord map[string]string
+
+func (p *zeekParser) parse(line string) ([]database.NetworkEvent, error) {
+	if strings.HasPrefix(line, "{") {
+		rec, err := zeekJSON(line)
+		if err != nil {
+			return nil, err
+		}
+		// JSON logs carry no header; records are told apart by their fields
+		if _, ok := rec["trans_id"]; ok {
+			return zeekDNS(rec)
+		}
+		if _, ok := rec["conn_state"]; ok {
+			return zeekConn(rec)
+		}
+		return nil, errSkipped
+	}
+	if strings.HasPrefix(line, "#") {
+		p.header(line)
+		return nil, errHeader
+	}
+	if p.fields == nil {
+		return nil, fmt.Errorf("record before the #fields header")
+	}
+
+	values := strings.Split(line, p.separator)
+	if len(values) != len(p.fields) {
+		return nil, fmt.Errorf("%d values for %d fields", len(values), len(p.fields))
+	}
+	rec := make(zeekRecord, len(values))
+	for i, v := range values {
+		switch v {
+		case p.unset:
+			continue
+		case p.empty:
+			v = ""
+		}
+		if p.setSep != "," {
+			v = strings.ReplaceAll(v, p.setSep, ",")
+		}
+		rec[p.fields[i]] = v
+	}
+	switch p.path {
+	case "conn":
+		return zeekConn(rec)
+	case "dns":
+		return zeekDNS(rec)
+	}
+	return nil, errSkipped
+}
+
+// header applies a line of the TSV header
+func (p *zeekParser) header(line string) {
+	// "#separator \x09" declares the separator itself, after a space
+	if v, ok := strings.CutPrefix(line, "#separator "); ok {
+		if b, err := strconv.ParseUint(strings.TrimPrefix(v, "\\x"), 16, 8); err == nil {
+			p.separator = string(rune(b))
+		}
+		return
+	}
+	key, value, _ := strings.Cut(line[1:], p.separator)
+	switch key {
+	case "set_separator":
+		p.setSep = value
+	case "empty_field":
+		p.empty = value
+	case "unset_field":
+		p.unset = value
+	case "path":
+		p.path = value
+	case "fields":
+		p.fields = strings.Split(value, p.separator)
+	}
+}
+
+// zeekJSON flattens a JSON log line into a record
+func zeekJSON(line string) (zeekRecord, error) {
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return nil, err
+	}
+	rec := make(zeekRecord, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case nil:
+		case []any:
+			parts := make([]string, len(v))
+			for i, item := range v {
+				parts[i] = jsonText(item)
+			}
+			rec[k] = strings.Join(parts, ",")
+		default:
+			rec[k] = jsonText(v)
+		}
+	}
+	return rec, nil
+}
+
+// jsonText renders a decoded JSON scalar
+func jsonText(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// zeekTime parses a ts field: epoch seconds, or ISO 8601 when Zeek writes
+// JSON with JSON::TS_ISO8601
+func zeekTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(math.Round(frac*1e6))*1e3).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// zeekSeconds parses an interval field
+func zeekSeconds(s string) time.Duration {
+	secs, _ := strconv.ParseFloat(s, 64)
+	return time.Duration(secs * float64(time.Second))
+}
+
+// zeekCount parses a count or port field, 0 when unset
+func zeekCount(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// zeekBase returns the event fields every record has: time, flow and
+// endpoints
+func zeekBase(rec zeekRecord) (database.NetworkEvent, error) {
+	var e database.NetworkEvent
+	ts, err := zeekTime(rec["ts"])
+	if err != nil {
+		return e, fmt.Errorf("invalid ts %q", rec["ts"])
+	}
+	e.Timestamp = ts
+	e.FlowID = strings.TrimPrefix(rec["uid"], "C")
+	e.SrcIP, e.DstIP = rec["id.orig_h"], rec["id.resp_h"]
+	e.SrcPort, e.DstPort = uint16(zeekCount(rec["id.orig_p"])), uint16(zeekCount(rec["id.resp_p"]))
+	e.VLAN, e.InnerVLAN = uint16(zeekCount(rec["vlan"])), uint16(zeekCount(rec["inner_vlan"]))
+	if e.IPVersion, err = endpoints(e.SrcIP, e.DstIP); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+// zeekConn maps a conn.log record to the START and closing events of a
+// TCP or UDP connection, or an ICMP event
+func zeekConn(rec zeekRecord) ([]database.NetworkEvent, error) {
+	e, err := zeekBase(rec)
+	if err != nil {
+		return nil, err
+	}
+	duration := zeekSeconds(rec["duration"])
+	e.Duration = duration.Milliseconds()
+	e.EndTime = e.Timestamp.Add(duration)
+	// IP bytes, as capture counts them, when the log has them
+	e.SrcBytes, e.DstBytes = zeekCount(rec["orig_ip_bytes"]), zeekCount(rec["resp_ip_bytes"])
+	if _, ok := rec["orig_ip_bytes"]; !ok {
+		e.SrcBytes, e.DstBytes = zeekCount(rec["orig_bytes"]), zeekCount(rec["resp_bytes"])
+	}
+	e.ByteCount = e.SrcBytes + e.DstBytes
+
+	switch proto := rec["proto"]; proto {
+	case "icmp":
+		// Zeek logs the ICMP type and code in the port columns
+		e.EventType = database.EventICMP
+		e.ICMPType, e.ICMPCode = uint8(e.SrcPort), uint8(e.DstPort)
+		e.SrcPort, e.DstPort = 0, 0
+		e.EndTime = time.Time{}
+		return []database.NetworkEvent{e}, nil
+	case "tcp", "udp":
+		return flowEvents(e, proto, zeekReason(rec["conn_state"])), nil
+	}
+	return nil, errSkipped
+}
+
+// zeekReason maps a conn_state to how capture records the end of a TCP
+// connection
+func zeekReason(state string) string {
+	switch state {
+	case "SF":
+		return "FIN"
+	case "REJ", "RSTO", "RSTR", "RSTOS0", "RSTRH":
+		return "RST"
+	}
+	return "TIMEOUT"
+}
+
+// zeekDNS maps a dns.log record to a DNS event holding the query and its
+// response, like compaction merges them
+func zeekDNS(rec zeekRecord) ([]database.NetworkEvent, error) {
+	e, err := zeekBase(rec)
+	if err != nil {
+		return nil, err
+	}
+	e.EventType = database.EventDNS
+	e.DNSQuery = rec["query"]
+	if e.DNSQuery == "" {
+		return nil, errSkipped
+	}
+	e.DNSID = uint16(zeekCount(rec["trans_id"]))
+	e.Duration = zeekSeconds(rec["rtt"]).Milliseconds()
+	e.DNSRCode = rec["rcode_name"]
+	e.DNSType = "QUERY"
+	if e.DNSRCode != "" {
+		e.DNSType = "COMPLETE"
+	}
+	if answers := rec["answers"]; answers != "" {
+		list := strings.Split(answers, ",")
+		ips, names := splitAnswers(list)
+		e.DNSAnswers, e.DNSCNAMEs = strings.Join(ips, ","), strings.Join(names, ",")
+		e.DNSAnswerCount = uint16(len(list))
+	}
+	if ttls := rec["TTLs"]; ttls != "" {
+		var secs []float64
+		for _, t := range strings.Split(ttls, ",") {
+			secs = append(secs, zeekSeconds(t).Seconds())
+		}
+		e.DNSTTL = uint32(slices.Min(secs))
+	}
+	return []database.NetworkEvent{e}, nil
+}
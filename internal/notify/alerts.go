@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// Alerts turns written events worth a notification, SCAN events and
+// blocklist matches, into notifications. It is added to the watcher as a
+// sink, so it sees every stored event.
+type Alerts struct {
+	dispatcher *Dispatcher
+}
+
+// NewAlerts creates the alerting sink of a dispatcher
+func NewAlerts(d *Dispatcher) *Alerts {
+	return &Alerts{dispatcher: d}
+}
+
+func (a *Alerts) Name() string { return "notify" }
+
+// Write notifies about the alerting events of a batch; repeats of a source
+// and target are throttled by the dispatcher
+func (a *Alerts) Write(events []database.NetworkEvent) error {
+	for i := range events {
+		e := &events[i]
+		switch {
+		case e.EventType == database.EventScan:
+			target := e.DstIP
+			if target == "" {
+				target = fmt.Sprintf("port %d/%s", e.DstPort, e.Protocol)
+			}
+			a.dispatcher.Notify(Notification{
+				Kind:     KindScan,
+				Severity: SeverityWarning,
+				Title:    fmt.Sprintf("Scan from %s", e.SrcIP),
+				Message:  fmt.Sprintf("%s, %s, on %s", target, e.Reason, e.Interface),
+				Time:     e.Timestamp,
+				Fields: map[string]string{
+					"src": e.SrcIP, "dst": e.DstIP, "port": strconv.Itoa(int(e.DstPort)),
+					"protocol": e.Protocol, "targets": strconv.FormatInt(e.EventCount, 10), "interface": e.Interface,
+				},
+				Key: e.SrcIP + " " + target,
+			})
+		case e.Threat:
+			a.dispatcher.Notify(Notification{
+				Kind:     KindThreat,
+				Severity: SeverityCritical,
+				Title:    fmt.Sprintf("Blocklisted traffic from %s", e.SrcIP),
+				Message:  fmt.Sprintf("%s %s matched %s", e.EventType, threatTarget(e), e.ThreatList),
+				Time:     e.Timestamp,
+				Fields: map[string]string{
+					"src": e.SrcIP, "dst": e.DstIP, "port": strconv.Itoa(int(e.DstPort)),
+					"target": threatTarget(e), "lists": e.ThreatList, "type": string(e.EventType), "interface": e.Interface,
+				},
+				Key: e.SrcIP + " " + e.DstIP + " " + e.ThreatList,
+			})
+		}
+	}
+	return nil
+}
+
+func (a *Alerts) Close() error { return nil }
+
+// threatTarget names what a flagged event reached: its domain, or address
+func threatTarget(e *database.NetworkEvent) string {
+	for _, name := range []string{e.DNSQuery, e.TLSSNI, e.Hostname} {
+		if name != "" {
+			return name
+		}
+	}
+	return e.DstIP
+}
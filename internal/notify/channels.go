@@ -0,0 +1,173 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Channel delivers a notification, rendered as text, to one service
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, n Notification, text string) error
+}
+
+// ParseChannels parses comma-separated channel URLs:
+//
+//	ntfy://[token@]host/topic        ntfy over HTTPS (ntfy+http:// for plain HTTP)
+//	telegram://bottoken@chatid       Telegram Bot API message
+//	slack://hooks.slack.com/services/...  Slack incoming webhook
+//	https://host/path                JSON POST of the notification and its text
+func ParseChannels(spec string) ([]Channel, error) {
+	var channels []Channel
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		c, err := ParseChannel(raw)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+	return channels, nil
+}
+
+// ParseChannel parses one channel URL (see ParseChannels)
+func ParseChannel(raw string) (Channel, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid notification channel %q", raw)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ntfy", "ntfy+http":
+		topic := strings.Trim(u.Path, "/")
+		if topic == "" {
+			return nil, fmt.Errorf("ntfy channel %q needs a topic, e.g. ntfy://ntfy.sh/my-topic", u.Redacted())
+		}
+		scheme := "https"
+		if u.Scheme == "ntfy+http" {
+			scheme = "http"
+		}
+		c := &ntfyChannel{url: scheme + "://" + u.Host + "/" + topic}
+		if u.User != nil {
+			c.token = u.User.Username()
+		}
+		return c, nil
+	case "telegram":
+		// Bot tokens are "id:secret", which URL parsing splits into a
+		// user and a password
+		if u.User == nil {
+			return nil, fmt.Errorf("telegram channel needs telegram://bottoken@chatid")
+		}
+		token := u.User.Username()
+		if secret, ok := u.User.Password(); ok {
+			token += ":" + secret
+		}
+		return &telegramChannel{token: token, chat: u.Host}, nil
+	case "slack":
+		u.Scheme = "https"
+		return &slackChannel{url: u.String()}, nil
+	case "http", "https":
+		return &webhookChannel{url: u.String(), redacted: u.Redacted()}, nil
+	}
+	return nil, fmt.Errorf("unsupported notification channel %q (use ntfy://, telegram://, slack:// or https://)", u.Scheme)
+}
+
+// post sends a request body and turns non-2xx answers into errors
+func post(ctx context.Context, url, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ntfyChannel publishes to an ntfy topic, with the severity as priority
+type ntfyChannel struct {
+	url, token string
+}
+
+func (c *ntfyChannel) Name() string { return "ntfy" }
+
+func (c *ntfyChannel) Send(ctx context.Context, n Notification, text string) error {
+	header := http.Header{}
+	header.Set("Title", n.Title)
+	header.Set("Tags", n.Kind)
+	switch n.Severity {
+	case SeverityCritical:
+		header.Set("Priority", "urgent")
+	case SeverityWarning:
+		header.Set("Priority", "high")
+	}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+	return post(ctx, c.url, "text/plain; charset=utf-8", []byte(text), header)
+}
+
+// telegramChannel sends a message through the Telegram Bot API
+type telegramChannel struct {
+	token, chat string
+}
+
+func (c *telegramChannel) Name() string { return "telegram" }
+
+func (c *telegramChannel) Send(ctx context.Context, n Notification, text string) error {
+	body, _ := json.Marshal(map[string]string{"chat_id": c.chat, "text": text})
+	err := post(ctx, "https://api.telegram.org/bot"+c.token+"/sendMessage", "application/json", body, nil)
+	if err != nil {
+		// Errors of the HTTP client quote the URL, and with it the token
+		return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), c.token, "***"))
+	}
+	return nil
+}
+
+// slackChannel posts to a Slack incoming webhook
+type slackChannel struct {
+	url string
+}
+
+func (c *slackChannel) Name() string { return "slack" }
+
+func (c *slackChannel) Send(ctx context.Context, n Notification, text string) error {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	return post(ctx, c.url, "application/json", body, nil)
+}
+
+// webhookChannel posts the notification as JSON, with the rendered text
+type webhookChannel struct {
+	url, redacted string
+}
+
+func (c *webhookChannel) Name() string { return "webhook " + c.redacted }
+
+func (c *webhookChannel) Send(ctx context.Context, n Notification, text string) error {
+	body, err := json.Marshal(struct {
+		Notification
+		Text string `json:"text"`
+	}{n, text})
+	if err != nil {
+		return err
+	}
+	return post(ctx, c.url, "application/json", body, nil)
+}
@@ -0,0 +1,196 @@
+// Package notify sends notifications about alerts (scans, blocklist
+// matches) and the daemon's own health (start and stop, sustained packet
+// drops, a nearly full disk) to ntfy, Telegram, Slack or a webhook.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Notification kinds
+const (
+	KindStart  = "start"  // the daemon started capturing
+	KindStop   = "stop"   // the daemon is shutting down
+	KindDrops  = "drops"  // the kernel kept dropping packets
+	KindDisk   = "disk"   // the disk holding the database is nearly full
+	KindScan   = "scan"   // a SCAN event was recorded
+	KindThreat = "threat" // an event matched a blocklist
+)
+
+// Kinds lists every notification kind, for --notify-events
+var Kinds = []string{KindStart, KindStop, KindDrops, KindDisk, KindScan, KindThreat}
+
+// Severities of notifications
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Notification is one message sent to every channel
+type Notification struct {
+	Kind     string            `json:"kind"`
+	Severity string            `json:"severity"`
+	Title    string            `json:"title"`
+	Message  string            `json:"message"`
+	Time     time.Time         `json:"time"`
+	Host     string            `json:"host"` // machine the daemon runs on
+	Fields   map[string]string `json:"fields,omitempty"`
+	// Key identifies what the notification is about, such as a source and
+	// target; repeats of a kind and key within Throttle are not sent
+	Key string `json:"-"`
+}
+
+// DefaultTemplate renders a notification as the text channels send
+const DefaultTemplate = `{{.Title}}{{if .Message}}: {{.Message}}{{end}}`
+
+// Throttle is how long repeats of a notification are held back
+const Throttle = 15 * time.Minute
+
+// queueSize is how many notifications wait for delivery; more are dropped
+const queueSize = 100
+
+// sendTimeout bounds the delivery of one notification to one channel
+const sendTimeout = 10 * time.Second
+
+// ParseTemplate parses a notification template, the default when text is
+// empty. Templates see a Notification: {{.Title}}, {{.Message}},
+// {{.Severity}}, {{.Host}}, {{.Time}} and {{index .Fields "src"}}.
+func ParseTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New("notification").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// ParseKinds parses a comma-separated list of notification kinds; an
+// empty list selects every kind
+func ParseKinds(spec string) (map[string]bool, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	kinds := make(map[string]bool)
+	for _, kind := range strings.Split(spec, ",") {
+		kind = strings.TrimSpace(kind)
+		if !slices.Contains(Kinds, kind) {
+			return nil, fmt.Errorf("unknown notification kind %q, expected any of %s", kind, strings.Join(Kinds, ", "))
+		}
+		kinds[kind] = true
+	}
+	return kinds, nil
+}
+
+// Dispatcher renders notifications with a template and delivers them to
+// every channel from a background goroutine, so a slow chat service never
+// blocks capture
+type Dispatcher struct {
+	channels []Channel
+	tmpl     *template.Template
+	kinds    map[string]bool // nil sends every kind
+	host     string
+	logger   *log.Logger
+	queue    chan Notification
+	done     chan struct{}
+	mutex    sync.Mutex
+	sent     map[string]time.Time // kind and key -> last sent
+	dropped  int
+	closed   bool
+}
+
+// NewDispatcher starts delivering notifications of the given kinds (all
+// when nil) to channels
+func NewDispatcher(channels []Channel, tmpl *template.Template, kinds map[string]bool, logger *log.Logger) *Dispatcher {
+	host, _ := os.Hostname()
+	d := &Dispatcher{
+		channels: channels,
+		tmpl:     tmpl,
+		kinds:    kinds,
+		host:     host,
+		logger:   logger,
+		queue:    make(chan Notification, queueSize),
+		done:     make(chan struct{}),
+		sent:     make(map[string]time.Time),
+	}
+	go d.run()
+	return d
+}
+
+// Notify queues a notification unless its kind is not selected or it
+// repeats one sent within Throttle. It never blocks: when the queue is
+// full the notification is dropped.
+func (d *Dispatcher) Notify(n Notification) {
+	if d.kinds != nil && !d.kinds[n.Kind] {
+		return
+	}
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	if n.Host == "" {
+		n.Host = d.host
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	key := n.Kind + "|" + n.Key
+	if last, ok := d.sent[key]; d.closed || ok && n.Time.Sub(last) < Throttle {
+		return
+	}
+	d.sent[key] = n.Time
+	for k, last := range d.sent {
+		if n.Time.Sub(last) >= Throttle {
+			delete(d.sent, k)
+		}
+	}
+	select {
+	case d.queue <- n:
+	default:
+		d.dropped++
+	}
+}
+
+// Close delivers the notifications still queued, such as the stop
+// notification, and stops the dispatcher
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	d.closed = true
+	close(d.queue)
+	d.mutex.Unlock()
+	<-d.done
+	if d.dropped > 0 {
+		d.logger.Warn("[NOTIFY] Notifications dropped, queue full", "dropped", d.dropped)
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for n := range d.queue {
+		var buf bytes.Buffer
+		if err := d.tmpl.Execute(&buf, n); err != nil {
+			d.logger.Error("[NOTIFY] Failed to render notification", "kind", n.Kind, "error", err)
+			buf.Reset()
+			buf.WriteString(n.Title + ": " + n.Message)
+		}
+		text := strings.TrimSpace(buf.String())
+		for _, c := range d.channels {
+			ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			if err := c.Send(ctx, n, text); err != nil {
+				d.logger.Error("[NOTIFY] Delivery failed", "channel", c.Name(), "kind", n.Kind, "error", err)
+			}
+			cancel()
+		}
+	}
+}
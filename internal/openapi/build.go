@@ -0,0 +1,148 @@
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Route describes one operation of the API for Build
+type Route struct {
+	Method      string
+	Path        string // with {name} path parameters, e.g. /api/views/{id}
+	ID          string // operationId, e.g. listEvents
+	Summary     string
+	Description string
+	Tag         string
+	Params      []Param // path parameters default to strings when not listed
+	Body        any     // value of the JSON request body type, or nil
+	Response    any     // value of the JSON response type, or nil
+	Status      int     // success status, default 200
+	Content     string  // media type of a response that is not JSON
+	Auth        bool    // requires the bearer token
+}
+
+// Param is a path or query parameter: a path parameter when the route's
+// path names it, a query parameter otherwise
+type Param struct {
+	Name        string
+	Type        string // string, integer or boolean
+	Description string
+	Enum        []string
+}
+
+// Build describes routes as an OpenAPI document; types named with Define
+// before are used under their names
+func (b *Builder) Build(info Info, routes []Route) *Document {
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info:    info,
+		Paths:   make(map[string]*PathItem),
+	}
+	secured := false
+	for _, r := range routes {
+		item := doc.Paths[r.Path]
+		if item == nil {
+			item = &PathItem{}
+			doc.Paths[r.Path] = item
+		}
+		(*item)[strings.ToLower(r.Method)] = b.operation(r)
+		secured = secured || r.Auth
+	}
+	doc.Components.Schemas = b.schemas
+	if secured {
+		doc.Components.SecuritySchemes = map[string]any{
+			"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+		}
+	}
+	return doc
+}
+
+// Define names the schema of the type of v, typically an anonymous struct
+// wrapping a list, and returns a reference to it
+func (b *Builder) Define(name string, v any) *Schema {
+	t := reflect.TypeOf(v)
+	if _, ok := b.names[t]; !ok {
+		b.names[t] = name
+		b.schemas[name] = b.object(t)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func (b *Builder) operation(r Route) *Operation {
+	op := &Operation{
+		OperationID: r.ID,
+		Summary:     r.Summary,
+		Description: r.Description,
+		Responses:   make(map[string]*Response),
+	}
+	if r.Tag != "" {
+		op.Tags = []string{r.Tag}
+	}
+	listed := make(map[string]bool)
+	for _, p := range r.Params {
+		listed[p.Name] = true
+		op.Parameters = append(op.Parameters, parameter(r.Path, p))
+	}
+	// Path parameters not listed, in path order
+	for rest := r.Path; ; {
+		_, after, ok := strings.Cut(rest, "{")
+		if !ok {
+			break
+		}
+		name, tail, _ := strings.Cut(after, "}")
+		rest = tail
+		if !listed[name] {
+			op.Parameters = append(op.Parameters, parameter(r.Path, Param{Name: name, Type: "string"}))
+		}
+	}
+
+	if r.Body != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{"application/json": {Schema: b.schemaOf(r.Body)}},
+		}
+	}
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := &Response{Description: http.StatusText(status)}
+	switch {
+	case r.Content != "":
+		ok.Content = map[string]MediaType{r.Content: {Schema: &Schema{Type: "string", Format: "binary"}}}
+	case r.Response != nil:
+		ok.Content = map[string]MediaType{"application/json": {Schema: b.schemaOf(r.Response)}}
+	}
+	op.Responses[strconv.Itoa(status)] = ok
+	op.Responses["default"] = &Response{
+		Description: "Error, with the message as plain text",
+		Content:     map[string]MediaType{"text/plain": {Schema: &Schema{Type: "string"}}},
+	}
+	if r.Auth {
+		op.Security = []map[string][]string{{"bearer": {}}}
+	}
+	return op
+}
+
+// schemaOf accepts a schema returned by Define as well as a value
+func (b *Builder) schemaOf(v any) *Schema {
+	if s, ok := v.(*Schema); ok {
+		return s
+	}
+	return b.SchemaOf(v)
+}
+
+func parameter(path string, p Param) Parameter {
+	param := Parameter{
+		Name:        p.Name,
+		In:          "query",
+		Description: p.Description,
+		Schema:      &Schema{Type: p.Type, Enum: p.Enum},
+	}
+	if strings.Contains(path, "{"+p.Name+"}") {
+		param.In, param.Required = "path", true
+	}
+	return param
+}
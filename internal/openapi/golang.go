@@ -0,0 +1,437 @@
+package openapi
+
+import (
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// pathOperation is an operation with its method and path
+type pathOperation struct {
+	method, path string
+	*Operation
+}
+
+// operations lists the operations of a document by path, then method
+func operations(doc *Document) []pathOperation {
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var ops []pathOperation
+	for _, path := range paths {
+		for _, method := range []string{"get", "post", "put", "patch", "delete"} {
+			if op := (*doc.Paths[path])[method]; op != nil {
+				ops = append(ops, pathOperation{method, path, op})
+			}
+		}
+	}
+	return ops
+}
+
+// propertyOrder is the order of a schema's properties: that of the Go
+// struct, or by name for a document read back from JSON
+func propertyOrder(s *Schema) []string {
+	if len(s.Order) == len(s.Properties) {
+		return s.Order
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// success is the 2xx response of an operation, with its status
+func success(op *Operation) (string, *Response) {
+	for _, status := range sortedKeys(op.Responses) {
+		if strings.HasPrefix(status, "2") {
+			return status, op.Responses[status]
+		}
+	}
+	return "", nil
+}
+
+// jsonSchema is the schema of a JSON body, or nil if it is not JSON
+func jsonSchema(content map[string]MediaType) *Schema {
+	if media, ok := content["application/json"]; ok {
+		return media.Schema
+	}
+	return nil
+}
+
+// goInitialisms are spelt in capitals in Go names
+var goInitialisms = map[string]bool{
+	"Dns": true, "Ech": true, "Http": true, "Id": true, "Ip": true, "Json": true, "Tls": true, "Url": true, "Vlan": true,
+}
+
+// goName turns a JSON or parameter name into an exported Go name
+func goName(name string) string {
+	var words []string
+	start := 0
+	for i, r := range name {
+		switch {
+		case r == '-' || r == '_' || r == '.':
+			words = append(words, name[start:i])
+			start = i + 1
+		case unicode.IsUpper(r) && i > start && unicode.IsLower(rune(name[i-1])):
+			words = append(words, name[start:i])
+			start = i
+		}
+	}
+	words = append(words, name[start:])
+	var b strings.Builder
+	for _, w := range words {
+		if w == "" {
+			continue
+		}
+		w = strings.ToUpper(w[:1]) + w[1:]
+		if goInitialisms[w] {
+			w = strings.ToUpper(w)
+		}
+		b.WriteString(w)
+	}
+	return b.String()
+}
+
+// goArg is a parameter name as an unexported Go identifier
+func goArg(name string) string {
+	n := goName(name)
+	if n == strings.ToUpper(n) {
+		return strings.ToLower(n)
+	}
+	return strings.ToLower(n[:1]) + n[1:]
+}
+
+func goType(s *Schema) string {
+	if s == nil {
+		return "json.RawMessage"
+	}
+	if s.Ref != "" {
+		if s.Nullable {
+			return "*" + refName(s.Ref)
+		}
+		return refName(s.Ref)
+	}
+	var t string
+	switch s.Type {
+	case "boolean":
+		t = "bool"
+	case "integer":
+		t = "int64"
+		if s.Format == "int32" {
+			t = "int32"
+		}
+	case "number":
+		t = "float64"
+		if s.Format == "float" {
+			t = "float32"
+		}
+	case "string":
+		switch s.Format {
+		case "date-time":
+			t = "time.Time"
+		case "byte":
+			return "[]byte"
+		default:
+			t = "string"
+		}
+	case "array":
+		return "[]" + goType(s.Items)
+	case "object":
+		if s.AdditionalProperties != nil {
+			return "map[string]" + goType(s.AdditionalProperties)
+		}
+		if len(s.Properties) > 0 {
+			var b strings.Builder
+			b.WriteString("struct {\n")
+			goFields(&b, s)
+			b.WriteString("}")
+			t = b.String()
+		} else {
+			return "map[string]any"
+		}
+	default:
+		return "json.RawMessage"
+	}
+	if s.Nullable {
+		return "*" + t
+	}
+	return t
+}
+
+func goFields(b *strings.Builder, s *Schema) {
+	required := make(map[string]bool, len(s.Required))
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	for _, name := range propertyOrder(s) {
+		tag := name
+		if !required[name] {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(b, "%s %s `json:%q`\n", goName(name), goType(s.Properties[name]), tag)
+	}
+}
+
+// goQueryType is the Go type of a query parameter
+func goQueryType(s *Schema) string {
+	switch s.Type {
+	case "integer":
+		return "int"
+	case "boolean":
+		return "bool"
+	}
+	return "string"
+}
+
+// GoClient renders a Go client of the API in package pkg: a struct per
+// component schema and a Client method per operation
+func GoClient(doc *Document, pkg string) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("// Code generated by net-watcher openapi --client go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "// Package %s is a client of the net-watcher REST API\n", pkg)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+
+	var body strings.Builder
+	body.WriteString(goRuntime)
+	for _, name := range sortedKeys(doc.Components.Schemas) {
+		s := doc.Components.Schemas[name]
+		fmt.Fprintf(&body, "\n// %s is a schema of the API\ntype %s ", name, name)
+		if s.Type == "object" && s.AdditionalProperties == nil {
+			body.WriteString("struct {\n")
+			goFields(&body, s)
+			body.WriteString("}\n")
+		} else {
+			body.WriteString(goType(s) + "\n")
+		}
+	}
+	for _, op := range operations(doc) {
+		goOperation(&body, op)
+	}
+
+	imports := []string{"bytes", "context", "encoding/json", "fmt", "io", "net/http", "net/url", "strings"}
+	if strings.Contains(body.String(), "strconv.") {
+		imports = append(imports, "strconv")
+	}
+	if strings.Contains(body.String(), "time.") {
+		imports = append(imports, "time")
+	}
+	sort.Strings(imports)
+	b.WriteString("import (\n")
+	for _, imp := range imports {
+		fmt.Fprintf(&b, "%q\n", imp)
+	}
+	b.WriteString(")\n")
+	b.WriteString(body.String())
+	return format.Source([]byte(b.String()))
+}
+
+func goOperation(b *strings.Builder, op pathOperation) {
+	name := goName(op.OperationID)
+	var args, query []string
+	var queryParams []Parameter
+	path := fmt.Sprintf("%q", op.path)
+	for _, p := range op.Parameters {
+		if p.In == "path" {
+			arg := goArg(p.Name)
+			typ := "string"
+			if p.Schema.Type == "integer" {
+				typ = "int64"
+			}
+			args = append(args, arg+" "+typ)
+			path = strings.Replace(path, "{"+p.Name+"}", `" + url.PathEscape(fmt.Sprint(`+arg+`)) + "`, 1)
+			continue
+		}
+		queryParams = append(queryParams, p)
+	}
+	path = strings.TrimSuffix(path, ` + ""`)
+
+	if len(queryParams) > 0 {
+		fmt.Fprintf(b, "\n// %sParams are the query parameters of %s\ntype %sParams struct {\n", name, name, name)
+		for _, p := range queryParams {
+			if p.Description != "" {
+				fmt.Fprintf(b, "// %s\n", p.Description)
+			}
+			fmt.Fprintf(b, "%s %s\n", goName(p.Name), goQueryType(p.Schema))
+		}
+		b.WriteString("}\n")
+		args = append(args, "params *"+name+"Params")
+		query = append(query, "if params != nil {")
+		for _, p := range queryParams {
+			field := "params." + goName(p.Name)
+			switch goQueryType(p.Schema) {
+			case "int":
+				query = append(query, fmt.Sprintf("if %s != 0 {\nquery.Set(%q, strconv.Itoa(%s))\n}", field, p.Name, field))
+			case "bool":
+				query = append(query, fmt.Sprintf("if %s {\nquery.Set(%q, \"true\")\n}", field, p.Name))
+			default:
+				query = append(query, fmt.Sprintf("if %s != \"\" {\nquery.Set(%q, %s)\n}", field, p.Name, field))
+			}
+		}
+		query = append(query, "}")
+	}
+	reqBody := "nil"
+	if op.RequestBody != nil {
+		args = append(args, "body "+goRef(jsonSchema(op.RequestBody.Content)))
+		reqBody = "body"
+	}
+
+	_, resp := success(op.Operation)
+	result := jsonSchema(resp.Content)
+	binary := result == nil && len(resp.Content) > 0
+
+	fmt.Fprintf(b, "\n// %s %s\n", name, lowerFirst(strings.TrimSuffix(op.Summary, ".")))
+	if binary {
+		b.WriteString("// The caller closes the returned body.\n")
+	}
+	fmt.Fprintf(b, "func (c *Client) %s(%s) ", name, strings.Join(append([]string{"ctx context.Context"}, args...), ", "))
+	switch {
+	case binary:
+		b.WriteString("(io.ReadCloser, error) {\n")
+	case result != nil:
+		fmt.Fprintf(b, "(%s, error) {\n", goRef(result))
+	default:
+		b.WriteString("error {\n")
+	}
+	queryArg := "nil"
+	if len(query) > 0 {
+		b.WriteString("query := url.Values{}\n" + strings.Join(query, "\n") + "\n")
+		queryArg = "query"
+	}
+	method := "http.Method" + strings.ToUpper(op.method[:1]) + op.method[1:]
+	switch {
+	case binary:
+		fmt.Fprintf(b, "return c.send(ctx, %s, %s, %s, %s)\n", method, path, queryArg, reqBody)
+	case result != nil:
+		target := "&out"
+		if strings.HasPrefix(goRef(result), "*") {
+			fmt.Fprintf(b, "out := new(%s)\n", strings.TrimPrefix(goRef(result), "*"))
+			target = "out"
+		} else {
+			fmt.Fprintf(b, "var out %s\n", goRef(result))
+		}
+		fmt.Fprintf(b, "if err := c.call(ctx, %s, %s, %s, %s, %s); err != nil {\nreturn nil, err\n}\nreturn out, nil\n",
+			method, path, queryArg, reqBody, target)
+	default:
+		fmt.Fprintf(b, "return c.call(ctx, %s, %s, %s, %s, nil)\n", method, path, queryArg, reqBody)
+	}
+	b.WriteString("}\n")
+}
+
+// lowerFirst turns a summary such as "Lists events" into the rest of a
+// sentence starting with the method name
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// goRef is the Go type of a body: a pointer to a named struct, or a slice
+// or map as is
+func goRef(s *Schema) string {
+	t := goType(s)
+	if s.Ref != "" && !strings.HasPrefix(t, "*") {
+		return "*" + t
+	}
+	return t
+}
+
+// goRuntime is the request plumbing every generated Go client shares
+const goRuntime = `
+// Client calls the net-watcher REST API
+type Client struct {
+	// BaseURL is the web server's address, e.g. http://localhost:8080
+	BaseURL string
+	// Token is sent as a bearer token: one of --api-tokens, or for /api/ingest its token
+	Token string
+	// HTTPClient makes the requests; http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// New creates a client of the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is a response with a status other than 2xx
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("net-watcher API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// send makes a request and returns the body of its 2xx response
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body any) (io.ReadCloser, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	target := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return resp.Body, nil
+}
+
+// call makes a request and decodes its JSON response into out, unless nil
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	rc, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(rc).Decode(out)
+}
+`
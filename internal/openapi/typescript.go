@@ -0,0 +1,221 @@
+package openapi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var tsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// tsKey quotes a property name unless it is a valid identifier
+func tsKey(name string) string {
+	if tsIdentifier.MatchString(name) {
+		return name
+	}
+	return fmt.Sprintf("%q", name)
+}
+
+func tsType(s *Schema) string {
+	if s == nil {
+		return "unknown"
+	}
+	var t string
+	switch {
+	case s.Ref != "":
+		t = refName(s.Ref)
+	case len(s.Enum) > 0:
+		quoted := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			quoted[i] = fmt.Sprintf("%q", v)
+		}
+		t = strings.Join(quoted, " | ")
+	case s.Type == "boolean":
+		t = "boolean"
+	case s.Type == "integer", s.Type == "number":
+		t = "number"
+	case s.Type == "string":
+		t = "string"
+	case s.Type == "array":
+		item := tsType(s.Items)
+		if strings.ContainsAny(item, " |") {
+			item = "(" + item + ")"
+		}
+		t = item + "[]"
+	case s.Type == "object" && s.AdditionalProperties != nil:
+		t = "Record<string, " + tsType(s.AdditionalProperties) + ">"
+	case s.Type == "object" && len(s.Properties) > 0:
+		var b strings.Builder
+		b.WriteString("{ ")
+		tsFields(&b, s, "")
+		b.WriteString("}")
+		t = b.String()
+	case s.Type == "object":
+		t = "Record<string, unknown>"
+	default:
+		t = "unknown"
+	}
+	if s.Nullable {
+		t += " | null"
+	}
+	return t
+}
+
+func tsFields(b *strings.Builder, s *Schema, indent string) {
+	required := make(map[string]bool, len(s.Required))
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	for _, name := range propertyOrder(s) {
+		optional := "?"
+		if required[name] {
+			optional = ""
+		}
+		fmt.Fprintf(b, "%s%s%s: %s;", indent, tsKey(name), optional, tsType(s.Properties[name]))
+		if indent != "" {
+			b.WriteString("\n")
+		} else {
+			b.WriteString(" ")
+		}
+	}
+}
+
+// TypeScriptClient renders a TypeScript client of the API: an interface
+// per component schema and a NetWatcherClient method per operation, using
+// fetch
+func TypeScriptClient(doc *Document) []byte {
+	var b strings.Builder
+	b.WriteString("// Code generated by net-watcher openapi --client ts; DO NOT EDIT.\n")
+	b.WriteString("// Client of the net-watcher REST API\n")
+	for _, name := range sortedKeys(doc.Components.Schemas) {
+		s := doc.Components.Schemas[name]
+		if s.Type == "object" && s.AdditionalProperties == nil {
+			fmt.Fprintf(&b, "\nexport interface %s {\n", name)
+			tsFields(&b, s, "  ")
+			b.WriteString("}\n")
+		} else {
+			fmt.Fprintf(&b, "\nexport type %s = %s;\n", name, tsType(s))
+		}
+	}
+	for _, op := range operations(doc) {
+		var query []Parameter
+		for _, p := range op.Parameters {
+			if p.In == "query" {
+				query = append(query, p)
+			}
+		}
+		if len(query) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\nexport interface %sParams {\n", goName(op.OperationID))
+		for _, p := range query {
+			if p.Description != "" {
+				fmt.Fprintf(&b, "  /** %s */\n", p.Description)
+			}
+			fmt.Fprintf(&b, "  %s?: %s;\n", tsKey(p.Name), tsType(p.Schema))
+		}
+		b.WriteString("}\n")
+	}
+
+	b.WriteString(tsRuntime)
+	for _, op := range operations(doc) {
+		tsOperation(&b, op)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func tsOperation(b *strings.Builder, op pathOperation) {
+	var args []string
+	path := op.path
+	hasQuery := false
+	for _, p := range op.Parameters {
+		if p.In == "path" {
+			arg := goArg(p.Name)
+			args = append(args, arg+": "+tsType(p.Schema))
+			path = strings.Replace(path, "{"+p.Name+"}", "${encodeURIComponent(String("+arg+"))}", 1)
+		} else {
+			hasQuery = true
+		}
+	}
+	if op.RequestBody != nil {
+		args = append(args, "body: "+tsType(jsonSchema(op.RequestBody.Content)))
+	}
+	query := "undefined"
+	if hasQuery {
+		args = append(args, "params: "+goName(op.OperationID)+"Params = {}")
+		query = "params"
+	}
+	body := "undefined"
+	if op.RequestBody != nil {
+		body = "body"
+	}
+
+	_, resp := success(op.Operation)
+	result := jsonSchema(resp.Content)
+	fmt.Fprintf(b, "\n  /** %s */\n", strings.TrimSuffix(op.Summary, "."))
+	call := fmt.Sprintf("this.send(%q, `%s`, %s, %s)", strings.ToUpper(op.method), path, query, body)
+	switch {
+	case result != nil:
+		fmt.Fprintf(b, "  async %s(%s): Promise<%s> {\n    return (await %s).json();\n  }\n",
+			op.OperationID, strings.Join(args, ", "), tsType(result), call)
+	case len(resp.Content) > 0:
+		fmt.Fprintf(b, "  async %s(%s): Promise<Blob> {\n    return (await %s).blob();\n  }\n",
+			op.OperationID, strings.Join(args, ", "), call)
+	default:
+		fmt.Fprintf(b, "  async %s(%s): Promise<void> {\n    await %s;\n  }\n",
+			op.OperationID, strings.Join(args, ", "), call)
+	}
+}
+
+// tsRuntime is the request plumbing every generated TypeScript client
+// shares; the class is closed after the operations
+const tsRuntime = `
+/** A response with a status other than 2xx */
+export class NetWatcherError extends Error {
+  constructor(public readonly status: number, message: string) {
+    super(` + "`net-watcher API: ${status} ${message}`" + `);
+  }
+}
+
+export interface NetWatcherClientOptions {
+  /** Sent as a bearer token: one of --api-tokens, or for /api/ingest its token */
+  token?: string;
+  fetch?: typeof fetch;
+}
+
+/** Client of the net-watcher REST API */
+export class NetWatcherClient {
+  private readonly baseUrl: string;
+
+  constructor(baseUrl: string, private readonly options: NetWatcherClientOptions = {}) {
+    this.baseUrl = baseUrl.replace(/\/+$/, "");
+  }
+
+  private async send(method: string, path: string, params?: object, body?: unknown): Promise<Response> {
+    const query = new URLSearchParams();
+    for (const [name, value] of Object.entries(params ?? {})) {
+      if (value !== undefined && value !== null && value !== "") {
+        query.set(name, String(value));
+      }
+    }
+    const headers: Record<string, string> = {};
+    if (body !== undefined) {
+      headers["Content-Type"] = "application/json";
+    }
+    if (this.options.token) {
+      headers["Authorization"] = ` + "`Bearer ${this.options.token}`" + `;
+    }
+    const search = query.toString();
+    const doFetch = this.options.fetch ?? fetch;
+    const response = await doFetch(this.baseUrl + path + (search ? "?" + search : ""), {
+      method,
+      headers,
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!response.ok) {
+      throw new NetWatcherError(response.status, (await response.text()).trim());
+    }
+    return response;
+  }
+`
@@ -0,0 +1,216 @@
+//go:build linux
+
+// Package preflight checks the environment before capture starts, so a
+// missing capability or a full disk is reported with a fix instead of as
+// a cryptic error from deep inside afpacket or SQLite.
+package preflight
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Level is the outcome of a check
+type Level int
+
+const (
+	Pass Level = iota
+	Warn
+	Fail
+)
+
+// Disk space thresholds for directories net-watcher writes to
+const (
+	minFreeBytes = 100 << 20 // below this writes will soon fail
+	lowFreeBytes = 1 << 30   // below this a busy sensor fills the disk within days
+)
+
+const (
+	clockSaneYear = 2024 // clocks before this were never set (no RTC, no NTP yet)
+	clockMaxSkew  = 5 * time.Minute
+	ethPAll       = 0x0003 // ETH_P_ALL
+)
+
+// Result is the outcome of one check with how to fix a problem
+type Result struct {
+	Check   string
+	Level   Level
+	Problem string
+	Fix     string
+}
+
+// Options says what the daemon is about to use
+type Options struct {
+	DBPath string   // SQLite database file
+	Dirs   []string // other directories written to (pcap, spool, Zeek logs, ...)
+}
+
+// Run performs all checks
+func Run(opts Options) []Result {
+	results := []Result{checkCapture()}
+	dirs := append([]string{filepath.Dir(opts.DBPath)}, opts.Dirs...)
+	results = append(results, checkDatabase(opts.DBPath))
+	seen := make(map[uint64]bool)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if r, dev := checkDiskSpace(dir); !seen[dev] {
+			seen[dev] = true
+			results = append(results, r)
+		}
+	}
+	return append(results, checkClock(opts.DBPath))
+}
+
+// Log reports problems found by Run and whether it is safe to start
+func Log(logger *log.Logger, results []Result) bool {
+	ok := true
+	for _, r := range results {
+		switch r.Level {
+		case Pass:
+			logger.Debug("[PREFLIGHT] OK", "check", r.Check)
+		case Warn:
+			logger.Warn("[PREFLIGHT] "+r.Problem, "check", r.Check, "fix", r.Fix)
+		case Fail:
+			logger.Error("[PREFLIGHT] "+r.Problem, "check", r.Check, "fix", r.Fix)
+			ok = false
+		}
+	}
+	if !ok {
+		logger.Error("[PREFLIGHT] Not starting, fix the problems above or skip the checks with --preflight=false")
+	}
+	return ok
+}
+
+// checkCapture opens the same kind of socket afpacket does
+func checkCapture() Result {
+	r := Result{Check: "capture"}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPAll)))
+	if err == nil {
+		syscall.Close(fd)
+		return r
+	}
+	r.Level = Fail
+	switch {
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		exe, _ := os.Executable()
+		if exe == "" {
+			exe = "net-watcher"
+		}
+		r.Problem = "Missing CAP_NET_RAW, packets cannot be captured"
+		r.Fix = fmt.Sprintf("run as root, or grant the capability once with 'sudo setcap cap_net_raw,cap_net_admin=eip %s' "+
+			"(systemd: AmbientCapabilities=CAP_NET_RAW CAP_NET_ADMIN)", exe)
+	case errors.Is(err, syscall.EAFNOSUPPORT):
+		r.Problem = "The kernel has no AF_PACKET support"
+		r.Fix = "load it with 'sudo modprobe af_packet'; in a container, run with the host network or a kernel that has CONFIG_PACKET"
+	default:
+		r.Problem = "Cannot open a packet socket: " + err.Error()
+		r.Fix = "check the kernel log (dmesg) and any seccomp or LSM policy applied to net-watcher"
+	}
+	return r
+}
+
+// checkDatabase verifies the database and its directory are writable,
+// since SQLite also creates -wal and -shm files next to it
+func checkDatabase(path string) Result {
+	r := Result{Check: "database"}
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, ".netwatcher-preflight-*")
+	if err != nil {
+		r.Level = Fail
+		r.Problem = fmt.Sprintf("Database directory %s is not writable", absPath(dir))
+		r.Fix = fmt.Sprintf("start net-watcher from a writable directory, or 'sudo chown %d %s'", os.Getuid(), absPath(dir))
+		return r
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	if _, err := os.Stat(path); err == nil {
+		db, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			r.Level = Fail
+			r.Problem = fmt.Sprintf("Database %s is not writable", absPath(path))
+			r.Fix = fmt.Sprintf("'sudo chown %d %s', it was probably created by another user", os.Getuid(), absPath(path))
+			return r
+		}
+		db.Close()
+	}
+	return r
+}
+
+// checkDiskSpace checks the free space of the filesystem holding dir, or
+// its nearest existing parent when it is still to be created. It also
+// returns the filesystem's device so each is checked once.
+func checkDiskSpace(dir string) (Result, uint64) {
+	r := Result{Check: "disk space"}
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	var st syscall.Stat_t
+	var fs syscall.Statfs_t
+	if syscall.Stat(dir, &st) != nil || syscall.Statfs(dir, &fs) != nil {
+		return r, 0
+	}
+	free := fs.Bavail * uint64(fs.Bsize)
+	switch {
+	case free < minFreeBytes:
+		r.Level = Fail
+		r.Problem = fmt.Sprintf("Only %d MB free on the filesystem of %s", free>>20, absPath(dir))
+		r.Fix = "free disk space, compact old events ('net-watcher compact') or move the data to a larger disk"
+	case free < lowFreeBytes:
+		r.Level = Warn
+		r.Problem = fmt.Sprintf("Low disk space, %d MB free on the filesystem of %s", free>>20, absPath(dir))
+		r.Fix = "enable --auto-compact, lower --pcap-budget or move the data to a larger disk"
+	}
+	return r, uint64(st.Dev)
+}
+
+// DiskUsage returns the free and total bytes of the filesystem holding path
+func DiskUsage(path string) (free, total uint64, err error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), fs.Blocks * uint64(fs.Bsize), nil
+}
+
+// checkClock catches clocks that were never set and clocks that moved
+// back since the database was last written, which both misplace events in time
+func checkClock(dbPath string) Result {
+	r := Result{Check: "clock"}
+	now := time.Now()
+	if now.Year() < clockSaneYear {
+		r.Level = Warn
+		r.Problem = fmt.Sprintf("System clock reads %s and looks unset, events will get wrong timestamps", now.Format(time.RFC3339))
+		r.Fix = "enable time synchronisation ('sudo timedatectl set-ntp true') and wait for it before starting"
+		return r
+	}
+	if info, err := os.Stat(dbPath); err == nil && info.ModTime().Sub(now) > clockMaxSkew {
+		r.Level = Warn
+		r.Problem = fmt.Sprintf("The database was written at %s, later than the current time %s; the clock moved back",
+			info.ModTime().Format(time.RFC3339), now.Format(time.RFC3339))
+		r.Fix = "check time synchronisation ('timedatectl status'); new events will sort before older ones"
+	}
+	return r
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,250 @@
+package report
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// maxChanges caps each list of changed or new entries
+const maxChanges = 15
+
+// Delta is one counter or top-list entry measured in the report period and
+// in the baseline window
+type Delta struct {
+	Name     string
+	Count    int64 // in the report period
+	Baseline int64 // in the baseline window, scaled to the period's length
+	Bytes    bool  `json:",omitempty"` // the values are byte counts
+}
+
+// Comparison holds what changed between a report's period and the
+// baseline window before it
+type Comparison struct {
+	BaselineStart  time.Time
+	BaselineEnd    time.Time
+	Scale          float64 // period length / baseline length, applied to baseline values
+	Counters       []Delta // overview counters and bytes transferred
+	Domains        []Delta // DNS lookups per domain, biggest changes first
+	Destinations   []Delta // events per destination address
+	Traffic        []Delta // bytes per destination address
+	NewDomains     []CountEntry
+	NewDomainCount int64 // domains looked up in the period and never before it
+	NewHosts       []CountEntry
+	NewHostCount   int64 // destinations contacted in the period and never before it
+}
+
+// ParseCompare parses a comparison spec of space or comma separated
+// key=value pairs: since=7d sets the report period and baseline=prev7d the
+// window immediately before it (default: one as long as the period).
+// Either value is zero when not given.
+func ParseCompare(spec string) (since, baseline time.Duration, err error) {
+	for _, field := range strings.FieldsFunc(spec, func(r rune) bool { return r == ' ' || r == ',' }) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return 0, 0, fmt.Errorf("invalid comparison %q, expected key=value", field)
+		}
+		switch key {
+		case "since":
+			if since, err = ParseSince(value); err != nil || since <= 0 {
+				return 0, 0, fmt.Errorf("invalid comparison period %q", value)
+			}
+		case "baseline":
+			if baseline, err = ParseSince(strings.TrimPrefix(value, "prev")); err != nil || baseline <= 0 {
+				return 0, 0, fmt.Errorf("invalid baseline %q, expected e.g. prev7d", value)
+			}
+		default:
+			return 0, 0, fmt.Errorf("unknown comparison key %q (expected since or baseline)", key)
+		}
+	}
+	return since, baseline, nil
+}
+
+// compare measures the period from start to end against the opts.Compare
+// long window before it
+func compare(db *database.DB, opts Options, start, end time.Time) *Comparison {
+	c := &Comparison{
+		BaselineStart: start.Add(-opts.Compare),
+		BaselineEnd:   start,
+		Scale:         float64(end.Sub(start)) / float64(opts.Compare),
+	}
+	window := func(from, to time.Time) func() *gorm.DB {
+		return func() *gorm.DB {
+			return opts.Filter.Apply(db.Model(&database.NetworkEvent{}).Where("timestamp >= ? AND timestamp < ?", from, to))
+		}
+	}
+	current, baseline := window(start, end), window(c.BaselineStart, c.BaselineEnd)
+
+	now, before := overview(current), overview(baseline)
+	counters := []struct {
+		name        string
+		now, before int64
+	}{
+		{"Total events", now.TotalEvents, before.TotalEvents},
+		{"TCP connections", now.TCPCount, before.TCPCount},
+		{"UDP sessions", now.UDPCount, before.UDPCount},
+		{"DNS queries", now.DNSCount, before.DNSCount},
+		{"TLS handshakes", now.TLSCount, before.TLSCount},
+		{"Unique hosts", now.UniqueHosts, before.UniqueHosts},
+		{"Unique domains", now.UniqueDomains, before.UniqueDomains},
+		{"Flagged events", countWhere(current(), "threat = ?", true), countWhere(baseline(), "threat = ?", true)},
+	}
+	for _, counter := range counters {
+		c.Counters = append(c.Counters, Delta{Name: counter.name, Count: counter.now, Baseline: c.scale(counter.before)})
+	}
+	c.Counters = append(c.Counters, Delta{Name: "Data", Count: sumBytes(current()), Baseline: c.scale(sumBytes(baseline())), Bytes: true})
+
+	lookups := func(q func() *gorm.DB) func() *gorm.DB {
+		return func() *gorm.DB { return q().Where(database.LookupCondition) }
+	}
+	c.Domains = c.deltas(lookups(current), lookups(baseline), "dns_query", "count(*)")
+	c.Destinations = c.deltas(current, baseline, "dst_ip", "count(*)")
+	c.Traffic = c.deltas(current, baseline, "dst_ip", "COALESCE(SUM(byte_count), 0)")
+	for i := range c.Traffic {
+		c.Traffic[i].Bytes = true
+	}
+
+	seenBefore := func(column string) *gorm.DB {
+		return db.Model(&database.NetworkEvent{}).Select(column).Where("timestamp < ? AND "+column+" != ''", start)
+	}
+	newDomains := func() *gorm.DB {
+		return lookups(current)().Where("dns_query NOT IN (?)", seenBefore("dns_query"))
+	}
+	newDomains().Distinct("dns_query").Count(&c.NewDomainCount)
+	c.NewDomains = topBy(newDomains(), "dns_query", maxChanges)
+	newHosts := func() *gorm.DB {
+		return current().Where("dst_ip NOT IN (?)", seenBefore("dst_ip"))
+	}
+	newHosts().Where("dst_ip != ''").Distinct("dst_ip").Count(&c.NewHostCount)
+	c.NewHosts = topBy(newHosts(), "dst_ip", maxChanges)
+	return c
+}
+
+// deltas returns the entries of column whose value changed most between the
+// windows, drawn from the top entries of both
+func (c *Comparison) deltas(current, baseline func() *gorm.DB, column, value string) []Delta {
+	top := func(q *gorm.DB) []CountEntry {
+		var entries []CountEntry
+		q.Select(column + " as name, " + value + " as count").Where(column + " != ''").
+			Group(column).Order("count DESC").Limit(maxChanges).Scan(&entries)
+		return entries
+	}
+	values := func(q *gorm.DB, names []string) map[string]int64 {
+		var entries []CountEntry
+		q.Select(column+" as name, "+value+" as count").Where(column+" IN ?", names).Group(column).Scan(&entries)
+		m := make(map[string]int64, len(entries))
+		for _, e := range entries {
+			m[e.Name] = e.Count
+		}
+		return m
+	}
+
+	var names []string
+	for _, e := range append(top(current()), top(baseline())...) {
+		if !slices.Contains(names, e.Name) {
+			names = append(names, e.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	now, before := values(current(), names), values(baseline(), names)
+	deltas := make([]Delta, 0, len(names))
+	for _, name := range names {
+		d := Delta{Name: name, Count: now[name], Baseline: c.scale(before[name])}
+		if d.Change() != 0 {
+			deltas = append(deltas, d)
+		}
+	}
+	slices.SortFunc(deltas, func(a, b Delta) int {
+		if n := cmp.Compare(abs(b.Change()), abs(a.Change())); n != 0 {
+			return n
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(deltas) > maxChanges {
+		deltas = deltas[:maxChanges]
+	}
+	return deltas
+}
+
+// scale converts a baseline value to the length of the report period
+func (c *Comparison) scale(n int64) int64 {
+	return int64(math.Round(float64(n) * c.Scale))
+}
+
+// Scaled reports whether baseline values were scaled because the windows
+// differ in length
+func (c *Comparison) Scaled() bool {
+	return math.Abs(c.Scale-1) > 0.001
+}
+
+// Change is the difference from the baseline
+func (d Delta) Change() int64 {
+	return d.Count - d.Baseline
+}
+
+// Up reports whether the value grew
+func (d Delta) Up() bool {
+	return d.Count > d.Baseline
+}
+
+// Value renders the period's value
+func (d Delta) Value() string {
+	return d.format(d.Count)
+}
+
+// BaselineValue renders the baseline's value
+func (d Delta) BaselineValue() string {
+	return d.format(d.Baseline)
+}
+
+// ChangeText renders the change as +12 (+40%), new or gone
+func (d Delta) ChangeText() string {
+	change := d.Change()
+	switch {
+	case change == 0:
+		return "0"
+	case d.Baseline == 0:
+		return "new"
+	case d.Count == 0:
+		return "gone"
+	}
+	sign := "+"
+	if change < 0 {
+		sign = "-"
+	}
+	return fmt.Sprintf("%s%s (%s%.0f%%)", sign, d.format(abs(change)), sign, math.Abs(float64(change))*100/float64(d.Baseline))
+}
+
+func (d Delta) format(n int64) string {
+	if d.Bytes {
+		return database.FormatBytes(n)
+	}
+	return fmt.Sprint(n)
+}
+
+func countWhere(q *gorm.DB, query string, args ...interface{}) int64 {
+	var n int64
+	q.Where(query, args...).Count(&n)
+	return n
+}
+
+func sumBytes(q *gorm.DB) int64 {
+	var n int64
+	q.Select("COALESCE(SUM(byte_count), 0)").Scan(&n)
+	return n
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// maxHourlyRows is the longest timeline listed per hour; longer ones are
+// summed per day so a 30 day report stays readable
+const maxHourlyRows = 48
+
+// markdownFuncs adds what the Markdown template needs to templateFuncs
+var markdownFuncs = texttemplate.FuncMap{
+	"md":      markdownCell,
+	"details": eventDetails,
+	"daily":   dailyTimeline,
+	"inc":     func(i int) int { return i + 1 },
+}
+
+// WriteMarkdown renders the report as a Markdown document
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	tmpl, err := texttemplate.New("report.md").Funcs(texttemplate.FuncMap(templateFuncs)).Funcs(markdownFuncs).
+		ParseFS(templateFiles, "templates/report.md")
+	if err != nil {
+		return fmt.Errorf("failed to parse report template: %w", err)
+	}
+	return tmpl.Execute(w, r)
+}
+
+// markdownCell makes a value safe inside a table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ", "\r", "").Replace(s)
+}
+
+// eventDetails is the plain text form of the HTML report's details column
+func eventDetails(e database.NetworkEvent) string {
+	var parts []string
+	add := func(format string, args ...interface{}) {
+		parts = append(parts, fmt.Sprintf(format, args...))
+	}
+	if e.DNSQuery != "" {
+		add("Query: %s", e.DNSQuery)
+	}
+	if e.DNSAnswers != "" {
+		add("-> %s", e.DNSAnswers)
+	}
+	if e.DNSRCode != "" && e.DNSRCode != "NOERROR" {
+		add("[%s]", e.DNSRCode)
+	}
+	if e.TLSSNI != "" {
+		add("SNI: %s", e.TLSSNI)
+	}
+	if e.TLSVersion != "" {
+		add("%s", e.TLSVersion)
+	}
+	if e.TLSALPN != "" {
+		add("ALPN: %s", e.TLSALPN)
+	}
+	if e.TLSECH {
+		add("ECH")
+	}
+	if e.Hostname != "" {
+		add("Host: %s", e.Hostname)
+	}
+	if e.ICMPDesc != "" {
+		add("%s", e.ICMPDesc)
+	}
+	if origin := e.ICMPOrigin(); origin != "" {
+		add("about %s", origin)
+	}
+	if e.Protocol != "" {
+		add("%s", e.Protocol)
+	}
+	if e.RemoteVersion != "" {
+		add("%s", e.RemoteVersion)
+	}
+	if e.RemoteClient != "" {
+		add("client: %s", e.RemoteClient)
+	}
+	if e.RemoteServer != "" {
+		add("server: %s", e.RemoteServer)
+	}
+	if e.ShareVersion != "" {
+		add("%s", e.ShareVersion)
+	}
+	if e.Shares != "" {
+		add("shares: %s", e.Shares)
+	}
+	if e.ShareServer != "" {
+		add("on %s", e.ShareServer)
+	}
+	if e.EventType == database.EventNTP {
+		add("stratum %d", e.NTPStratum)
+		if e.NTPRefID != "" {
+			add("ref: %s", e.NTPRefID)
+		}
+	}
+	if tunnel := e.TunnelInfo(); tunnel != "" {
+		add("via %s", tunnel)
+	}
+	if e.Duration != 0 {
+		add("Duration: %dms", e.Duration)
+	}
+	if e.ByteCount != 0 {
+		add("Bytes: %s", database.FormatBytes(e.ByteCount))
+	}
+	if e.EventCount != 0 {
+		add("Count: %d", e.EventCount)
+	}
+	if e.Repeats != 0 {
+		add("Repeats: %d", e.Repeats)
+	}
+	return strings.Join(parts, " ")
+}
+
+// dailyTimeline sums an hourly timeline per day, or returns nil when it is
+// short enough to list per hour
+func dailyTimeline(points []TimelinePoint) []TimelinePoint {
+	if len(points) <= maxHourlyRows {
+		return nil
+	}
+	var days []TimelinePoint
+	for _, p := range points {
+		day, _, _ := strings.Cut(p.X, " ")
+		if n := len(days); n > 0 && days[n-1].X == day {
+			days[n-1].Y += p.Y
+			continue
+		}
+		days = append(days, TimelinePoint{X: day, Y: p.Y})
+	}
+	return days
+}
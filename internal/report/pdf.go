@@ -0,0 +1,328 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 page layout in points
+const (
+	pdfWidth    = 595.0
+	pdfHeight   = 842.0
+	pdfMargin   = 40.0
+	pdfText     = 9.0 // paragraph font size
+	pdfTable    = 7.0 // table font size, Courier keeps columns aligned
+	pdfLeading  = 1.3 // line height as a multiple of the font size
+	pdfCourierW = 0.6 // Courier glyph width per point of font size
+	pdfHelvW    = 0.5 // average Helvetica glyph width, for wrapping
+)
+
+// Standard Type 1 fonts every PDF reader has, so nothing is embedded
+const (
+	fontRegular = "F1"
+	fontBold    = "F2"
+	fontMono    = "F3"
+	fontMonoB   = "F4"
+)
+
+// WritePDF renders the report as a PDF document. It lays out the Markdown
+// rendering, so both formats always carry the same sections.
+func (r *Report) WritePDF(w io.Writer) error {
+	var md bytes.Buffer
+	if err := r.WriteMarkdown(&md); err != nil {
+		return err
+	}
+	doc := &pdfDoc{}
+	doc.newPage()
+	lines := strings.Split(md.String(), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " ")
+		switch {
+		case strings.HasPrefix(line, "|"):
+			j := i
+			for j < len(lines) && strings.HasPrefix(lines[j], "|") {
+				j++
+			}
+			doc.table(lines[i:j])
+			i = j - 1
+		case strings.HasPrefix(line, "### "):
+			doc.space(6)
+			doc.text(fontBold, 11, line[4:])
+		case strings.HasPrefix(line, "## "):
+			doc.space(12)
+			doc.text(fontBold, 14, line[3:])
+			doc.rule()
+		case strings.HasPrefix(line, "# "):
+			doc.text(fontBold, 18, line[2:])
+		case line == "":
+			doc.space(4)
+		default:
+			doc.text(fontRegular, pdfText, strings.NewReplacer("**", "", "`", "").Replace(line))
+		}
+	}
+	return doc.write(w)
+}
+
+// pdfDoc accumulates the content streams of a document's pages
+type pdfDoc struct {
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+	y     float64 // baseline of the next line, from the bottom of the page
+}
+
+func (d *pdfDoc) newPage() {
+	d.page = &bytes.Buffer{}
+	d.pages = append(d.pages, d.page)
+	d.y = pdfHeight - pdfMargin
+	fmt.Fprintf(d.page, "BT /%s 7 Tf %.2f %.2f Td (%d) Tj ET\n", fontRegular, pdfWidth/2, pdfMargin/2, len(d.pages))
+}
+
+// ensure starts a new page unless height fits above the bottom margin
+func (d *pdfDoc) ensure(height float64) {
+	if d.y-height < pdfMargin {
+		d.newPage()
+	}
+}
+
+func (d *pdfDoc) space(height float64) {
+	if d.y < pdfHeight-pdfMargin {
+		d.y -= height
+	}
+}
+
+// show writes one line at the current position and moves below it
+func (d *pdfDoc) show(font string, size, x float64, s string) {
+	fmt.Fprintf(d.page, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y-size, pdfString(s))
+}
+
+// text writes a paragraph, wrapped at the page width
+func (d *pdfDoc) text(font string, size float64, s string) {
+	perLine := int((pdfWidth - 2*pdfMargin) / (size * pdfHelvW))
+	for _, line := range wrap(strings.TrimSpace(removeEmoji(s)), perLine) {
+		d.ensure(size * pdfLeading)
+		d.show(font, size, pdfMargin, line)
+		d.y -= size * pdfLeading
+	}
+}
+
+func (d *pdfDoc) rule() {
+	d.y -= 3
+	fmt.Fprintf(d.page, "0.6 G %.2f %.2f m %.2f %.2f l S 0 G\n", pdfMargin, d.y, pdfWidth-pdfMargin, d.y)
+	d.y -= 6
+}
+
+// table lays out Markdown table rows in fixed-width columns, shrinking the
+// widest columns to fit the page and repeating the header on new pages
+func (d *pdfDoc) table(lines []string) {
+	var rows [][]string
+	var right []bool
+	for _, line := range lines {
+		cells := splitRow(line)
+		if isSeparator(cells) {
+			for _, c := range cells {
+				right = append(right, strings.HasSuffix(c, ":"))
+			}
+			continue
+		}
+		rows = append(rows, cells)
+	}
+	if len(rows) == 0 {
+		return
+	}
+	cols := 0
+	for _, row := range rows {
+		cols = max(cols, len(row))
+	}
+	widths := make([]int, cols)
+	for _, row := range rows {
+		for i, c := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(c))
+		}
+	}
+	lineWidth := (pdfWidth - 2*pdfMargin) / (pdfTable * pdfCourierW)
+	available := int(lineWidth) - 2*(cols-1)
+	for total := sum(widths); total > available; total = sum(widths) {
+		widest := 0
+		for i := range widths {
+			if widths[i] > widths[widest] {
+				widest = i
+			}
+		}
+		widths[widest] = max(widths[widest]-(total-available), 4)
+		if widths[widest] == 4 {
+			break
+		}
+	}
+
+	format := func(row []string) string {
+		var b strings.Builder
+		for i := range widths {
+			var c string
+			if i < len(row) {
+				c = row[i]
+			}
+			if n := utf8.RuneCountInString(c); n > widths[i] {
+				c = string([]rune(c)[:widths[i]-3]) + "..."
+			}
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c))
+			if i < len(right) && right[i] {
+				c = pad + c
+			} else {
+				c += pad
+			}
+			if i > 0 {
+				b.WriteString("  ")
+			}
+			b.WriteString(c)
+		}
+		return b.String()
+	}
+
+	height := pdfTable * pdfLeading
+	header := format(rows[0])
+	d.ensure(2 * height)
+	d.show(fontMonoB, pdfTable, pdfMargin, header)
+	d.y -= height
+	for _, row := range rows[1:] {
+		if d.y-height < pdfMargin {
+			d.newPage()
+			d.show(fontMonoB, pdfTable, pdfMargin, header)
+			d.y -= height
+		}
+		d.show(fontMono, pdfTable, pdfMargin, format(row))
+		d.y -= height
+	}
+	d.y -= 4
+}
+
+// write assembles the pages, fonts and cross-reference table
+func (d *pdfDoc) write(w io.Writer) error {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// 1 catalog, 2 page tree, 3-6 fonts, then a page and its content per page
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 7+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, name := range []string{"Helvetica", "Helvetica-Bold", "Courier", "Courier-Bold"} {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+	}
+	fonts := fmt.Sprintf("<< /%s 3 0 R /%s 4 0 R /%s 5 0 R /%s 6 0 R >>", fontRegular, fontBold, fontMono, fontMonoB)
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font %s >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, fonts, 8+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// pdfString encodes text for a PDF string literal in WinAnsiEncoding.
+// Characters it cannot represent are replaced.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case r == '⚠':
+			b.WriteByte('!')
+		case r == '→':
+			b.WriteString("->")
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// removeEmoji drops the pictographs headings start with, which the
+// standard fonts lack
+func removeEmoji(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 0x2600 && r != '→' || r == 0xfe0f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// wrap breaks s into lines of at most width characters at spaces
+func wrap(s string, width int) []string {
+	var lines []string
+	for utf8.RuneCountInString(s) > width {
+		runes := []rune(s)
+		cut := strings.LastIndex(string(runes[:width]), " ")
+		if cut <= 0 {
+			cut = len(string(runes[:width]))
+		}
+		lines = append(lines, s[:cut])
+		s = strings.TrimLeft(s[cut:], " ")
+	}
+	return append(lines, s)
+}
+
+// splitRow splits a Markdown table row into its cells, honouring \| escapes
+func splitRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// isSeparator reports whether cells are a header separator like |---|---:|
+func isSeparator(cells []string) bool {
+	for _, c := range cells {
+		if strings.Trim(c, ":-") != "" || !strings.Contains(c, "-") {
+			return false
+		}
+	}
+	return true
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
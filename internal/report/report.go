@@ -0,0 +1,480 @@
+// Net Watcher - HTML report generation
+package report
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/chart"
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+// Sections lists the report sections that can be selected with Options.Sections
+var Sections = []string{"overview", "timeline", "top", "threats", "beacons", "dns", "tls", "p2p", "ntp", "new", "weekly", "events"}
+
+// newDestinationLimit caps the rows of the new destinations section
+const newDestinationLimit = 100
+
+// Formats lists the output formats a report can be written in
+var Formats = []string{"html", "json", "md", "pdf"}
+
+// Options controls what a report covers
+type Options struct {
+	Since      time.Duration    // how far back from now the report reaches
+	EventLimit int              // maximum rows in the events table
+	Sections   []string         // sections to include; empty means all
+	Filter     *database.Filter // only events matching this filter; nil means all
+	Compare    time.Duration    // length of the baseline window ending where the period starts; 0 disables
+}
+
+// Overview holds the headline counters of a report
+type Overview struct {
+	TotalEvents   int64
+	TCPCount      int64
+	UDPCount      int64
+	DNSCount      int64
+	TLSCount      int64
+	UniqueHosts   int64
+	UniqueDomains int64
+}
+
+// CountEntry is one row of a top-N list
+type CountEntry struct {
+	Name  string
+	Count int64
+}
+
+// TimelinePoint is one hourly bucket of the activity chart
+type TimelinePoint struct {
+	X string `json:"x"`
+	Y int64  `json:"y"`
+}
+
+// ThreatSection summarises traffic flagged by blocklists
+type ThreatSection struct {
+	FlaggedEvents int64
+	ByList        []CountEntry
+	TopTargets    []CountEntry
+	Events        []database.NetworkEvent
+}
+
+// DNSFailureSection summarises lookups answered with an error rcode
+type DNSFailureSection struct {
+	FailedLookups int64
+	ByRCode       []CountEntry
+	TopDomains    []CountEntry
+	TopClients    []CountEntry
+}
+
+// TLSSection summarises negotiated TLS versions and legacy (pre-1.2) clients
+type TLSSection struct {
+	Handshakes    int64
+	LegacyCount   int64
+	ECHCount      int64
+	ByVersion     []CountEntry
+	ByALPN        []CountEntry
+	LegacyClients []CountEntry
+	LegacyServers []CountEntry
+}
+
+// P2PSection summarises BitTorrent flows by class and by the local host
+// taking part, with their volume
+type P2PSection struct {
+	Flows    int64
+	Bytes    int64
+	ByClass  []CountEntry
+	TopHosts []VolumeEntry
+}
+
+// VolumeEntry is a host with the flows it took part in and their bytes
+type VolumeEntry struct {
+	Name  string
+	Flows int64
+	Bytes int64
+}
+
+// NTPSection lists the time servers devices synchronise with, and the
+// devices using external servers outside --ntp-servers
+type NTPSection struct {
+	Syncs      int64
+	NTS        int64 // syncs protected by Network Time Security
+	Servers    []NTPServerEntry
+	Unexpected []CountEntry
+}
+
+// NTPServerEntry is a time server with the devices syncing against it
+type NTPServerEntry struct {
+	Name       string
+	Hostname   string
+	Stratum    uint8
+	Clients    int64
+	Syncs      int64
+	Unexpected bool // outside the expected time sources
+}
+
+// Report is the data rendered into the HTML template
+type Report struct {
+	GeneratedAt     time.Time
+	Period          string
+	Query           string // filter expression the events were selected with
+	Start           time.Time
+	End             time.Time
+	Overview        Overview
+	Timeline        []TimelinePoint
+	TopDomains      []CountEntry
+	TopDestinations []CountEntry
+	TopSNI          []CountEntry
+	Threats         ThreatSection
+	DNSFailures     DNSFailureSection
+	TLS             TLSSection
+	P2P             P2PSection
+	NTP             NTPSection
+	NewDestinations []database.Destination    // domains and addresses first seen in the period
+	Beacons         []database.Beacon         // regular connections to remote services in the period
+	Weeks           []database.WeeklySummary  // stored weekly summaries, newest first
+	NewBehaviorWeek time.Time                 // week NewBehavior covers, the last completed one
+	NewBehavior     []database.DeviceBehavior // devices contacting domains or ports they never had before
+	Comparison      *Comparison               // changes against a baseline window, with Options.Compare
+	EventTypes      []string
+	Events          []database.NetworkEvent
+	Sections        map[string]bool `json:"-"` // selected sections; empty means all
+}
+
+// Has reports whether a section is included in the report
+func (r *Report) Has(section string) bool {
+	return len(r.Sections) == 0 || r.Sections[section]
+}
+
+// ValidSection reports whether name is one of Sections
+func ValidSection(name string) bool {
+	return slices.Contains(Sections, name)
+}
+
+// ValidFormat reports whether name is one of Formats
+func ValidFormat(name string) bool {
+	return slices.Contains(Formats, name)
+}
+
+// Generate collects report data for the requested period
+func Generate(db *database.DB, opts Options) (*Report, error) {
+	if opts.Since <= 0 {
+		opts.Since = 24 * time.Hour
+	}
+	if opts.EventLimit <= 0 {
+		opts.EventLimit = 5000
+	}
+
+	end := time.Now()
+	start := end.Add(-opts.Since)
+	r := &Report{
+		GeneratedAt: end,
+		Period:      fmt.Sprintf("Last %s", formatSince(opts.Since)),
+		Start:       start,
+		End:         end,
+		Sections:    make(map[string]bool),
+	}
+	if opts.Filter != nil {
+		r.Query = opts.Filter.Expr
+	}
+	for _, section := range opts.Sections {
+		if !ValidSection(section) {
+			return nil, fmt.Errorf("unknown report section %q", section)
+		}
+		r.Sections[section] = true
+	}
+
+	inRange := func() *gorm.DB {
+		return opts.Filter.Apply(db.Model(&database.NetworkEvent{}).Where("timestamp >= ? AND timestamp <= ?", start, end))
+	}
+
+	// Overview (always collected, the header counters are cheap)
+	r.Overview = overview(inRange)
+
+	// Timeline
+	if r.Has("timeline") {
+		var buckets []struct {
+			Bucket string
+			Count  int64
+		}
+		inRange().Select("strftime('%Y-%m-%d %H:00', timestamp) as bucket, count(*) as count").
+			Group("bucket").Order("bucket ASC").Scan(&buckets)
+		for _, b := range buckets {
+			r.Timeline = append(r.Timeline, TimelinePoint{X: b.Bucket, Y: b.Count})
+		}
+	}
+
+	// Top lists
+	if r.Has("top") {
+		r.TopDomains = topBy(inRange(), "dns_query", 10)
+		r.TopDestinations = topBy(inRange(), "dst_ip", 10)
+		r.TopSNI = topBy(inRange(), "tls_sni", 10)
+	}
+
+	// Flagged traffic
+	threats := func() *gorm.DB {
+		return inRange().Where("threat = ?", true)
+	}
+	threats().Count(&r.Threats.FlaggedEvents)
+	if r.Threats.FlaggedEvents > 0 && r.Has("threats") {
+		r.Threats.ByList = topBy(threats(), "threat_list", 10)
+		threats().Select("COALESCE(NULLIF(hostname, ''), NULLIF(dns_query, ''), NULLIF(tls_sni, ''), dst_ip) as name, count(*) as count").
+			Group("name").Order("count DESC").Limit(10).Scan(&r.Threats.TopTargets)
+		threats().Order("timestamp DESC").Limit(200).Find(&r.Threats.Events)
+	}
+
+	// Failed DNS lookups (NXDOMAIN, SERVFAIL, ...)
+	failures := func() *gorm.DB {
+		return inRange().Where("event_type = ? AND dns_rcode != '' AND dns_rcode != ?", database.EventDNS, "NOERROR")
+	}
+	failures().Count(&r.DNSFailures.FailedLookups)
+	if r.DNSFailures.FailedLookups > 0 && r.Has("dns") {
+		r.DNSFailures.ByRCode = topBy(failures(), "dns_rcode", 10)
+		r.DNSFailures.TopDomains = topBy(failures(), "dns_query", 10)
+		// Responses travel server -> client, so the client is the destination
+		r.DNSFailures.TopClients = topBy(failures(), "dst_ip", 10)
+	}
+
+	// TLS versions; anything below TLS 1.2 is flagged as legacy
+	handshakes := func() *gorm.DB {
+		return inRange().Where("event_type = ?", database.EventTLSSNI)
+	}
+	legacy := func() *gorm.DB {
+		return handshakes().Where("tls_version IN ?", []string{"SSL3.0", "TLS1.0", "TLS1.1"})
+	}
+	handshakes().Count(&r.TLS.Handshakes)
+	if r.TLS.Handshakes > 0 && r.Has("tls") {
+		handshakes().Where("tls_ech = ?", true).Count(&r.TLS.ECHCount)
+		r.TLS.ByVersion = topBy(handshakes(), "tls_version", 10)
+		r.TLS.ByALPN = topBy(handshakes(), "tls_alpn", 10)
+		legacy().Count(&r.TLS.LegacyCount)
+		if r.TLS.LegacyCount > 0 {
+			r.TLS.LegacyClients = topBy(legacy(), "src_ip", 10)
+			legacy().Select("COALESCE(NULLIF(tls_sni, ''), dst_ip) as name, count(*) as count").
+				Group("name").Order("count DESC").Limit(10).Scan(&r.TLS.LegacyServers)
+		}
+	}
+
+	// BitTorrent volume, counted on the events closing each flow. A host is
+	// the local end: the destination of flows coming in from outside.
+	p2pFlows := func() *gorm.DB {
+		return inRange().Where("p2p != '' AND event_type IN ?", []database.EventType{
+			database.EventTCPEnd, database.EventUDPEnd, database.EventTimeout, database.EventTCP, database.EventUDP})
+	}
+	p2pFlows().Count(&r.P2P.Flows)
+	if r.P2P.Flows > 0 && r.Has("p2p") {
+		p2pFlows().Select("COALESCE(SUM(byte_count), 0)").Scan(&r.P2P.Bytes)
+		r.P2P.ByClass = topBy(p2pFlows(), "p2p", 10)
+		dstLocal := strings.ReplaceAll(database.LocalSourceCondition, "src_ip", "dst_ip")
+		p2pFlows().Select("CASE WHEN NOT " + database.LocalSourceCondition + " AND " + dstLocal + " THEN dst_ip ELSE src_ip END as name, " +
+			"count(*) as flows, COALESCE(SUM(byte_count), 0) as bytes").
+			Group("name").Order("bytes DESC").Limit(10).Scan(&r.P2P.TopHosts)
+	}
+
+	// Time sources: one NTP event per device and server each hour
+	ntp := func() *gorm.DB { return inRange().Where("event_type = ?", database.EventNTP) }
+	ntp().Count(&r.NTP.Syncs)
+	if r.NTP.Syncs > 0 && r.Has("ntp") {
+		ntp().Where("protocol = ?", "NTS").Count(&r.NTP.NTS)
+		ntp().Select("dst_ip as name, MAX(hostname) as hostname, count(DISTINCT src_ip) as clients, count(*) as syncs, " +
+			"MAX(CASE WHEN reason = 'UNEXPECTED_SOURCE' THEN 1 ELSE 0 END) = 1 as unexpected").
+			Group("dst_ip").Order("clients DESC, syncs DESC").Limit(20).Scan(&r.NTP.Servers)
+		// The stratum lives in the NTPDetail side table, loaded with the events
+		for i := range r.NTP.Servers {
+			var last database.NetworkEvent
+			if ntp().Where("dst_ip = ?", r.NTP.Servers[i].Name).Order("timestamp DESC").Limit(1).Find(&last); last.ID != 0 {
+				r.NTP.Servers[i].Stratum = last.NTPStratum
+			}
+		}
+		r.NTP.Unexpected = topBy(ntp().Where("reason = ?", "UNEXPECTED_SOURCE"), "src_ip", 20)
+	}
+
+	// Hosts checking in with a remote service at regular intervals
+	if r.Has("beacons") {
+		beacons, err := db.DetectBeacons(database.BeaconOptions{Since: start})
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect beacons: %w", err)
+		}
+		r.Beacons = beacons
+	}
+
+	// Destinations reached for the first time, or the first time in
+	// database.NewDestinationGap
+	if r.Has("new") {
+		destinations, err := db.NewDestinations(start, "", newDestinationLimit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load new destinations: %w", err)
+		}
+		r.NewDestinations = destinations
+	}
+
+	// Week-over-week comparison from the stored summaries
+	if r.Has("weekly") {
+		// A read replica has the summaries the daemon's weekly-summaries job stored
+		if !db.ReadOnly() {
+			if _, err := db.SummarizeWeeks(end); err != nil {
+				return nil, err
+			}
+		}
+		weeks, err := db.WeeklySummaries(end, 8)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load weekly summaries: %w", err)
+		}
+		r.Weeks = weeks
+		r.NewBehaviorWeek = database.WeekStart(end).AddDate(0, 0, -7)
+		if r.NewBehavior, err = db.NewBehavior(r.NewBehaviorWeek); err != nil {
+			return nil, err
+		}
+	}
+
+	// Changes against the baseline window before the period
+	if opts.Compare > 0 {
+		r.Comparison = compare(db, opts, start, end)
+	}
+
+	// Events table
+	if r.Has("events") {
+		inRange().Distinct("event_type").Order("event_type").Pluck("event_type", &r.EventTypes)
+		inRange().Order("timestamp DESC").Limit(opts.EventLimit).Find(&r.Events)
+	}
+
+	return r, nil
+}
+
+// WriteHTML renders the report as a single HTML page
+func (r *Report) WriteHTML(w io.Writer) error {
+	tmpl, err := template.New("report.html").Funcs(templateFuncs).ParseFS(templateFiles, "templates/report.html")
+	if err != nil {
+		return fmt.Errorf("failed to parse report template: %w", err)
+	}
+	return tmpl.Execute(w, r)
+}
+
+// WriteJSON writes the report data as JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Write renders the report in the given format (html, json, md or pdf)
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "", "html":
+		return r.WriteHTML(w)
+	case "json":
+		return r.WriteJSON(w)
+	case "md":
+		return r.WriteMarkdown(w)
+	case "pdf":
+		return r.WritePDF(w)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// timelineChart draws the hourly timeline as inline SVG, so the report shows
+// it without scripts or network access
+func timelineChart(points []TimelinePoint) template.HTML {
+	series := chart.Series{Name: "Events per Hour"}
+	for _, p := range points {
+		t, err := time.ParseInLocation("2006-01-02 15:04", p.X, time.Local)
+		if err != nil {
+			continue
+		}
+		series.Times = append(series.Times, t)
+		series.Values = append(series.Values, float64(p.Y))
+	}
+	var buf bytes.Buffer
+	if err := chart.Timeline(&buf, "svg", chart.Options{Height: 300, Dark: true}, series); err != nil {
+		return `<p class="meta">Not enough activity to chart.</p>`
+	}
+	// The SVG is generated from numbers and fixed labels only
+	return template.HTML(buf.String())
+}
+
+// ParseSince parses a Go duration, additionally accepting a day suffix (7d)
+func ParseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		if _, err := fmt.Sscanf(days, "%d", &n); err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// topBy returns the most frequent non-empty values of a column
+// overview counts the headline numbers of the events selected by inRange
+func overview(inRange func() *gorm.DB) Overview {
+	var o Overview
+	inRange().Count(&o.TotalEvents)
+	inRange().Where("event_type IN ?", []database.EventType{database.EventTCPStart, database.EventTCP}).Count(&o.TCPCount)
+	inRange().Where("event_type IN ?", []database.EventType{database.EventUDPStart, database.EventUDP}).Count(&o.UDPCount)
+	inRange().Where("event_type = ? AND dns_type IN ?", database.EventDNS, []string{"QUERY", "COMPLETE"}).Count(&o.DNSCount)
+	inRange().Where("event_type = ?", database.EventTLSSNI).Count(&o.TLSCount)
+	inRange().Where("dst_ip != ''").Distinct("dst_ip").Count(&o.UniqueHosts)
+	inRange().Where("dns_query != ''").Distinct("dns_query").Count(&o.UniqueDomains)
+	return o
+}
+
+func topBy(q *gorm.DB, column string, limit int) []CountEntry {
+	var entries []CountEntry
+	q.Select(column + " as name, count(*) as count").
+		Where(column + " != '' AND " + column + " IS NOT NULL").
+		Group(column).Order("count DESC").Limit(limit).Scan(&entries)
+	return entries
+}
+
+// formatSince renders a duration the way users type it (24h, 7d)
+func formatSince(d time.Duration) string {
+	switch {
+	case d > 24*time.Hour && d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	}
+	return d.String()
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) template.JS {
+		data, _ := json.Marshal(v)
+		return template.JS(data)
+	},
+	"clock": func(t time.Time) string {
+		return t.Format("15:04:05")
+	},
+	"datetime": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"bytes": database.FormatBytes,
+	"seconds": func(s float64) string {
+		return time.Duration(s * float64(time.Second)).Round(time.Second).String()
+	},
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.0f%%", f*100)
+	},
+	"timeline": timelineChart,
+	// link is replaced by Site.link in multi-page reports
+	"link": func(kind, name string) template.HTML {
+		return template.HTML(template.HTMLEscapeString(name))
+	},
+	"dict": func(kv ...interface{}) map[string]interface{} {
+		m := make(map[string]interface{}, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			m[fmt.Sprint(kv[i])] = kv[i+1]
+		}
+		return m
+	},
+}
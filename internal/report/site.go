@@ -0,0 +1,296 @@
+package report
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// Drilldown pages are written for the busiest devices and domains only,
+// each listing its latest events
+const (
+	maxSiteDevices = 200
+	maxSiteDomains = 500
+	siteEventLimit = 500
+)
+
+// domainName picks the name an event is about: its DNS query, TLS server
+// name or HTTP host
+const domainName = "COALESCE(NULLIF(dns_query, ''), NULLIF(tls_sni, ''), NULLIF(hostname, ''))"
+
+// DeviceDetail is the drilldown page of one local device
+type DeviceDetail struct {
+	IP            string
+	Events        int64
+	Flagged       int64
+	Bytes         int64
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	Domains       []CountEntry // looked up or reached by TLS server name
+	Destinations  []CountEntry
+	Ports         []CountEntry // of connections the device opened, as 443/tcp
+	FailedDomains []CountEntry
+	LegacyTLS     []CountEntry // servers reached with TLS below 1.2
+	EventTypes    []string
+	Recent        []database.NetworkEvent
+}
+
+// DomainDetail is the drilldown page of one domain
+type DomainDetail struct {
+	Name          string
+	Events        int64
+	Lookups       int64
+	FailedLookups int64
+	Handshakes    int64
+	Flagged       int64
+	Clients       []CountEntry
+	Answers       []CountEntry
+	RCodes        []CountEntry
+	TLSVersions   []CountEntry
+	EventTypes    []string
+	Recent        []database.NetworkEvent
+}
+
+// Site is a report split into linked pages, for periods with more events
+// than a single page can list
+type Site struct {
+	Report      *Report
+	Devices     []CountEntry // local devices with a page, busiest first
+	DeviceCount int64
+	Domains     []CountEntry // domains with a page, busiest first
+	DomainCount int64
+	DeviceInfo  map[string]*DeviceDetail
+	DomainInfo  map[string]*DomainDetail
+}
+
+// sitePage is the data of one page of a Site
+type sitePage struct {
+	Title   string
+	Kind    string // which template renders the body
+	Section string // navigation entry to highlight
+	Nav     []navLink
+	Report  *Report
+	Site    *Site
+	Device  *DeviceDetail
+	Domain  *DomainDetail
+}
+
+type navLink struct {
+	File  string
+	Title string
+}
+
+// GenerateSite collects the report data and the drilldowns of every device
+// and domain that gets a page
+func GenerateSite(db *database.DB, opts Options) (*Site, error) {
+	r, err := Generate(db, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Site{
+		Report:     r,
+		DeviceInfo: make(map[string]*DeviceDetail),
+		DomainInfo: make(map[string]*DomainDetail),
+	}
+	inRange := func() *gorm.DB {
+		return opts.Filter.Apply(db.Model(&database.NetworkEvent{}).Where("timestamp >= ? AND timestamp <= ?", r.Start, r.End))
+	}
+
+	devices := func() *gorm.DB {
+		return inRange().Where("src_ip != ''").Where(database.LocalSourceCondition)
+	}
+	devices().Distinct("src_ip").Count(&s.DeviceCount)
+	s.Devices = topBy(devices(), "src_ip", maxSiteDevices)
+	for _, d := range s.Devices {
+		s.DeviceInfo[d.Name] = deviceDetail(inRange, d.Name)
+	}
+
+	inRange().Select("COUNT(DISTINCT " + domainName + ")").Scan(&s.DomainCount)
+	s.Domains = topBy(inRange(), domainName, maxSiteDomains)
+	for _, d := range s.Domains {
+		s.DomainInfo[d.Name] = domainDetail(inRange, d.Name)
+	}
+	return s, nil
+}
+
+func deviceDetail(inRange func() *gorm.DB, ip string) *DeviceDetail {
+	d := &DeviceDetail{IP: ip}
+	involved := func() *gorm.DB {
+		return inRange().Where("src_ip = ? OR dst_ip = ?", ip, ip)
+	}
+	sent := func() *gorm.DB {
+		return inRange().Where("src_ip = ?", ip)
+	}
+
+	var span struct {
+		Events    int64
+		Bytes     int64
+		FirstSeen string
+		LastSeen  string
+	}
+	involved().Select("count(*) as events, COALESCE(SUM(byte_count), 0) as bytes, min(timestamp) as first_seen, max(timestamp) as last_seen").Scan(&span)
+	d.Events, d.Bytes = span.Events, span.Bytes
+	d.FirstSeen, d.LastSeen = database.ParseTime(span.FirstSeen), database.ParseTime(span.LastSeen)
+	involved().Where("threat = ?", true).Count(&d.Flagged)
+
+	sent().Where("tls_sni != '' OR " + database.LookupCondition).
+		Select("COALESCE(NULLIF(tls_sni, ''), dns_query) as name, count(*) as count").
+		Group("name").Order("count DESC").Limit(20).Scan(&d.Domains)
+	d.Destinations = topBy(sent(), "dst_ip", 20)
+	sent().Where("event_type IN ? AND dst_port > 0", []database.EventType{database.EventTCPStart, database.EventTCP, database.EventUDPStart, database.EventUDP}).
+		Select(database.PortName + " as name, count(*) as count").
+		Group("name").Order("count DESC").Limit(20).Scan(&d.Ports)
+	// Responses travel server -> client, so failures the device got have it as destination
+	d.FailedDomains = topBy(inRange().Where("dst_ip = ? AND event_type = ? AND dns_rcode != '' AND dns_rcode != ?", ip, database.EventDNS, "NOERROR"), "dns_query", 10)
+	sent().Where("event_type = ? AND tls_version IN ?", database.EventTLSSNI, []string{"SSL3.0", "TLS1.0", "TLS1.1"}).
+		Select("COALESCE(NULLIF(tls_sni, ''), dst_ip) as name, count(*) as count").
+		Group("name").Order("count DESC").Limit(10).Scan(&d.LegacyTLS)
+
+	involved().Distinct("event_type").Order("event_type").Pluck("event_type", &d.EventTypes)
+	involved().Order("timestamp DESC").Limit(siteEventLimit).Find(&d.Recent)
+	return d
+}
+
+func domainDetail(inRange func() *gorm.DB, name string) *DomainDetail {
+	d := &DomainDetail{Name: name}
+	involved := func() *gorm.DB {
+		return inRange().Where("dns_query = ? OR tls_sni = ? OR hostname = ?", name, name, name)
+	}
+	lookups := func() *gorm.DB {
+		return inRange().Where("event_type = ? AND dns_query = ?", database.EventDNS, name)
+	}
+	handshakes := func() *gorm.DB {
+		return inRange().Where("event_type = ? AND tls_sni = ?", database.EventTLSSNI, name)
+	}
+
+	involved().Count(&d.Events)
+	involved().Where("threat = ?", true).Count(&d.Flagged)
+	inRange().Where(database.LookupCondition).Where("dns_query = ?", name).Count(&d.Lookups)
+	lookups().Where("dns_rcode != '' AND dns_rcode != ?", "NOERROR").Count(&d.FailedLookups)
+	handshakes().Count(&d.Handshakes)
+
+	d.Clients = topBy(inRange().Where("tls_sni = ? OR (dns_query = ? AND "+database.LookupCondition+")", name, name), "src_ip", 20)
+	d.Answers = topBy(lookups().Joins("JOIN dns_answer_details ON dns_answer_details.event_id = network_events.id"),
+		"dns_answer_details.dns_answers", 10)
+	d.RCodes = topBy(lookups(), "dns_rcode", 10)
+	d.TLSVersions = topBy(handshakes(), "tls_version", 10)
+
+	involved().Distinct("event_type").Order("event_type").Pluck("event_type", &d.EventTypes)
+	involved().Order("timestamp DESC").Limit(siteEventLimit).Find(&d.Recent)
+	return d
+}
+
+// Write renders the site into dir: index.html with the overview, a page per
+// selected section, and device and domain pages linked from every list
+func (s *Site) Write(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmpl, err := template.New("site").Funcs(templateFuncs).Funcs(template.FuncMap{"link": s.link}).
+		ParseFS(templateFiles, "templates/report.html", "templates/site.html")
+	if err != nil {
+		return fmt.Errorf("failed to parse report templates: %w", err)
+	}
+
+	nav := []navLink{{"index.html", "Overview"}, {"devices.html", "Devices"}, {"domains.html", "Domains"}}
+	pages := []sitePage{
+		{Title: "Overview", Kind: "index", Section: "index.html"},
+		{Title: "Devices", Kind: "devices", Section: "devices.html"},
+		{Title: "Domains", Kind: "domains", Section: "domains.html"},
+	}
+	for _, p := range []struct{ section, file, title string }{
+		{"dns", "dns.html", "DNS"},
+		{"tls", "tls.html", "TLS"},
+		{"p2p", "p2p.html", "P2P"},
+		{"ntp", "ntp.html", "Time Sources"},
+		{"new", "new.html", "New Destinations"},
+		{"threats", "alerts.html", "Alerts"},
+		{"beacons", "beacons.html", "Beacons"},
+		{"weekly", "weekly.html", "Weekly"},
+		{"events", "events.html", "Events"},
+	} {
+		if s.Report.Has(p.section) {
+			nav = append(nav, navLink{p.file, p.title})
+			pages = append(pages, sitePage{Title: p.title, Kind: p.section, Section: p.file})
+		}
+	}
+
+	write := func(file string, page sitePage) error {
+		page.Nav, page.Report, page.Site = nav, s.Report, s
+		f, err := os.Create(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		if err := tmpl.ExecuteTemplate(f, "page", page); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		return f.Close()
+	}
+	for _, page := range pages {
+		if err := write(page.Section, page); err != nil {
+			return err
+		}
+	}
+	for ip, d := range s.DeviceInfo {
+		if err := write(pageFile("device", ip), sitePage{Title: ip, Kind: "device", Section: "devices.html", Device: d}); err != nil {
+			return err
+		}
+	}
+	for name, d := range s.DomainInfo {
+		if err := write(pageFile("domain", name), sitePage{Title: name, Kind: "domain", Section: "domains.html", Domain: d}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pages returns how many files Write creates
+func (s *Site) Pages() int {
+	n := 3 + len(s.DeviceInfo) + len(s.DomainInfo)
+	for _, section := range []string{"dns", "tls", "p2p", "ntp", "new", "threats", "beacons", "weekly", "events"} {
+		if s.Report.Has(section) {
+			n++
+		}
+	}
+	return n
+}
+
+// link renders a device or domain as a link to its page when it has one
+func (s *Site) link(kind, name string) template.HTML {
+	text := template.HTMLEscapeString(name)
+	switch {
+	case kind == "device" && s.DeviceInfo[name] != nil,
+		kind == "domain" && s.DomainInfo[name] != nil:
+		return template.HTML(fmt.Sprintf(`<a href="%s">%s</a>`, template.HTMLEscapeString(pageFile(kind, name)), text))
+	}
+	return template.HTML(text)
+}
+
+// pageFile names the page of a device or domain. Characters unsafe in file
+// names are replaced, with a hash of the name keeping those pages apart.
+func pageFile(kind, name string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+	if len(safe) > 100 {
+		safe = safe[:100]
+	}
+	if safe != name {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		safe = fmt.Sprintf("%s-%08x", safe, h.Sum32())
+	}
+	return kind + "-" + safe + ".html"
+}
@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is when a job runs: a 5-field cron expression
+// (minute hour day-of-month month day-of-week), one of the shorthands
+// @hourly, @daily, @weekly and @monthly, or "@every <duration>".
+// Cron times are wall-clock times in the local time zone.
+type Spec interface {
+	// Next returns the first run time after t
+	Next(t time.Time) time.Time
+	String() string
+}
+
+// Parse parses a schedule spec
+func Parse(spec string) (Spec, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid schedule %q, expected e.g. @every 6h", spec)
+		}
+		return every(d), nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 cron fields, @daily or @every <duration>", spec)
+	}
+	c := &cron{spec: spec}
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, field := range fields {
+		set, err := parseField(field, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		*bounds[i].set = set
+	}
+	// 7 is another name for Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// Like cron, a restricted day of month or week matches either one
+	c.anyDay = fields[2] == "*" || fields[4] == "*"
+	return c, nil
+}
+
+// every runs at a fixed interval, unaffected by clock changes
+type every time.Duration
+
+// Every returns a spec running at a fixed interval
+func Every(d time.Duration) Spec {
+	return every(d)
+}
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func (e every) String() string {
+	return "@every " + time.Duration(e).String()
+}
+
+// cron matches wall-clock times; each field is a bit set of allowed values
+type cron struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	anyDay                        bool // day of month and week must both match
+}
+
+func (c *cron) String() string {
+	return c.spec
+}
+
+// Next walks forward field by field in local wall-clock time. Times
+// skipped when clocks go forward run at the first minute after the gap, and
+// times repeated when clocks go back run only once.
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.In(time.Local)
+	last := t.Format("2006-01-02 15:04")
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		y, mo, d := next.Date()
+		h, mi := next.Hour(), next.Minute()
+		switch {
+		case !has(c.month, int(mo)):
+			next = forward(next, time.Date(y, mo+1, 1, 0, 0, 0, 0, time.Local))
+		case !c.matchDay(next):
+			next = forward(next, time.Date(y, mo, d+1, 0, 0, 0, 0, time.Local))
+		case !has(c.hour, h):
+			// Step in absolute time: time.Date resolves a wall-clock hour
+			// inside a gap to a time before it
+			following := next.Add(time.Duration(60-mi) * time.Minute)
+			// The clocks skipped an hour the schedule wanted
+			if skipped := following.Hour() - h; skipped > 1 && has(c.hour, h+1) && following.Day() == d {
+				return following
+			}
+			next = following
+		case !has(c.minute, mi):
+			next = next.Add(time.Minute)
+		case next.Format("2006-01-02 15:04") <= last:
+			// A wall-clock minute repeated after clocks went back
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// forward returns to, or an hour after from when a midnight that clocks
+// skipped resolved to a time before from
+func forward(from, to time.Time) time.Time {
+	if !to.After(from) {
+		return from.Add(time.Hour)
+	}
+	return to
+}
+
+func (c *cron) matchDay(t time.Time) bool {
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
+
+// parseField parses a comma separated list of *, n, a-b and their /step forms
+func parseField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,257 @@
+// Net Watcher - Job scheduler
+// Runs the daemon's periodic maintenance (compaction, weekly summaries,
+// blocklist refreshes, scheduled reports) from one place, so every job is
+// configured the same way and its last and next run can be inspected and
+// triggered through the API.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// ErrUnknownJob is returned by Trigger for a name no job has
+var ErrUnknownJob = errors.New("unknown job")
+
+// ErrRunning is returned by Trigger while the job is already running
+var ErrRunning = errors.New("job is already running")
+
+// Job is a named task and when to run it
+type Job struct {
+	Name    string
+	Spec    Spec
+	Jitter  time.Duration // each run is delayed by a random amount up to this
+	AtStart bool          // also run once when the scheduler starts
+	Run     func(ctx context.Context) error
+}
+
+// Status is a job's schedule and the outcome of its last run
+type Status struct {
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule"`
+	Jitter       string    `json:"jitter,omitempty"`
+	Running      bool      `json:"running"`
+	Runs         int       `json:"runs"`
+	LastRun      time.Time `json:"lastRun,omitzero"`
+	LastDuration string    `json:"lastDuration,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+	NextRun      time.Time `json:"nextRun,omitzero"`
+}
+
+// job is a Job with its state
+type job struct {
+	Job
+	status  Status
+	trigger chan struct{}
+}
+
+// Scheduler runs jobs on their schedules until its context is cancelled
+type Scheduler struct {
+	logger *log.Logger
+	mutex  sync.Mutex
+	jobs   []*job
+	ctx    context.Context
+}
+
+// New creates an empty scheduler
+func New(logger *log.Logger) *Scheduler {
+	return &Scheduler{logger: logger}
+}
+
+// Add registers a job. Jobs added after Start begin running immediately.
+func (s *Scheduler) Add(j Job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if slices.ContainsFunc(s.jobs, func(other *job) bool { return other.Name == j.Name }) {
+		return fmt.Errorf("job %q already exists", j.Name)
+	}
+	entry := &job{
+		Job:     j,
+		trigger: make(chan struct{}, 1),
+		status:  Status{Name: j.Name, Schedule: j.Spec.String()},
+	}
+	if j.Jitter > 0 {
+		entry.status.Jitter = j.Jitter.String()
+	}
+	s.jobs = append(s.jobs, entry)
+	if s.ctx != nil {
+		go s.loop(s.ctx, entry)
+	}
+	return nil
+}
+
+// Start runs every job on its schedule until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ctx = ctx
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+}
+
+// Jobs returns the status of every job, in the order they were added
+func (s *Scheduler) Jobs() []Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]Status, len(s.jobs))
+	for i, j := range s.jobs {
+		list[i] = j.status
+	}
+	return list
+}
+
+// Trigger runs a job now, outside its schedule. Its next scheduled run is
+// unchanged.
+func (s *Scheduler) Trigger(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, j := range s.jobs {
+		if j.Name != name {
+			continue
+		}
+		if j.status.Running {
+			return ErrRunning
+		}
+		select {
+		case j.trigger <- struct{}{}:
+		default:
+			return ErrRunning
+		}
+		return nil
+	}
+	return ErrUnknownJob
+}
+
+// loop waits for each scheduled time or a trigger and runs the job
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	if j.AtStart {
+		s.run(ctx, j)
+	}
+	scheduled := time.Now()
+	for {
+		scheduled = j.Spec.Next(scheduled)
+		if scheduled.IsZero() {
+			s.logger.Warn("[SCHEDULER] Job has no future run", "job", j.Name, "schedule", j.Spec)
+			return
+		}
+		at := scheduled
+		if j.Jitter > 0 {
+			at = at.Add(rand.N(j.Jitter))
+		}
+		s.mutex.Lock()
+		j.status.NextRun = at
+		s.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(at))
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-j.trigger:
+				s.run(ctx, j)
+			case <-timer.C:
+				break wait
+			}
+		}
+		s.run(ctx, j)
+		// Catch up without piling up runs when the job outlasted its interval
+		if now := time.Now(); scheduled.Before(now) {
+			scheduled = now
+		}
+	}
+}
+
+// run executes the job once and records the outcome
+func (s *Scheduler) run(ctx context.Context, j *job) {
+	s.mutex.Lock()
+	j.status.Running = true
+	s.mutex.Unlock()
+
+	start := time.Now()
+	err := j.Run(ctx)
+	elapsed := time.Since(start)
+
+	s.mutex.Lock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.LastDuration = elapsed.Round(time.Millisecond).String()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+	}
+	s.mutex.Unlock()
+
+	switch {
+	case ctx.Err() != nil:
+	case err != nil:
+		s.logger.Error("[SCHEDULER] Job failed", "job", j.Name, "error", err, "duration", elapsed.Round(time.Millisecond))
+	default:
+		s.logger.Debug("[SCHEDULER] Job complete", "job", j.Name, "duration", elapsed.Round(time.Millisecond))
+	}
+}
+
+// ParseOverrides parses a semicolon separated list of name=spec pairs that
+// replace jobs' default schedules. A spec may end in ~duration to set the
+// job's jitter, e.g. "auto-compact=0 3 * * *~15m;report=@daily".
+func ParseOverrides(s string) (map[string]Override, error) {
+	overrides := make(map[string]Override)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid job schedule %q, expected name=spec", item)
+		}
+		var o Override
+		if spec, jitter, ok := strings.Cut(value, "~"); ok {
+			d, err := time.ParseDuration(strings.TrimSpace(jitter))
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid jitter %q for job %s", jitter, name)
+			}
+			o.Jitter, value = d, spec
+		}
+		if strings.TrimSpace(value) != "" {
+			spec, err := Parse(value)
+			if err != nil {
+				return nil, err
+			}
+			o.Spec = spec
+		}
+		overrides[strings.TrimSpace(name)] = o
+	}
+	return overrides, nil
+}
+
+// Override replaces a job's default schedule and jitter; zero fields keep
+// the default
+type Override struct {
+	Spec   Spec
+	Jitter time.Duration
+}
+
+// Apply returns j with the override for its name, if there is one
+func Apply(j Job, overrides map[string]Override) Job {
+	if o, ok := overrides[j.Name]; ok {
+		if o.Spec != nil {
+			j.Spec = o.Spec
+		}
+		if o.Jitter > 0 {
+			j.Jitter = o.Jitter
+		}
+	}
+	return j
+}
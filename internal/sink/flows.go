@@ -0,0 +1,201 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// FlowRecord is a connection as exported when it closes, aggregated over
+// its lifetime so billing and analytics systems need not query the database
+type FlowRecord struct {
+	FlowID     string    `json:"flow_id"`
+	Transport  string    `json:"transport"` // tcp or udp
+	Interface  string    `json:"interface"`
+	VLAN       uint16    `json:"vlan,omitempty"`
+	InnerVLAN  uint16    `json:"inner_vlan,omitempty"`
+	SrcIP      string    `json:"src_ip"`
+	SrcPort    uint16    `json:"src_port"`
+	DstIP      string    `json:"dst_ip"`
+	DstPort    uint16    `json:"dst_port"`
+	Hostname   string    `json:"hostname,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"` // last packet
+	DurationMs int64     `json:"duration_ms"`
+	Bytes      int64     `json:"bytes"`
+	SrcBytes   int64     `json:"src_bytes"`  // sent by the originator
+	DstBytes   int64     `json:"dst_bytes"`  // sent by the responder
+	EndReason  string    `json:"end_reason"` // FIN, RST, TIMEOUT or EVICTED
+	P2P        string    `json:"p2p,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Threat     bool      `json:"threat,omitempty"`
+	ThreatList string    `json:"threat_list,omitempty"`
+}
+
+// NewFlowRecord returns the flow record of an event closing a TCP or UDP
+// connection, and false for every other event
+func NewFlowRecord(e *database.NetworkEvent) (FlowRecord, bool) {
+	var transport string
+	switch {
+	case e.EventType == database.EventTCPEnd:
+		transport = "tcp"
+	case e.EventType == database.EventUDPEnd:
+		transport = "udp"
+	case e.EventType == database.EventTimeout && e.Protocol == "TCP":
+		transport = "tcp"
+	default:
+		return FlowRecord{}, false
+	}
+	end := e.Timestamp
+	if !e.EndTime.IsZero() {
+		end = e.EndTime
+	}
+	reason := e.Reason
+	if reason == "" {
+		reason = "TIMEOUT"
+	}
+	var tags []string
+	if e.Tags != "" {
+		tags = strings.Split(e.Tags, ",")
+	}
+	return FlowRecord{
+		FlowID:     e.FlowID,
+		Transport:  transport,
+		Interface:  e.Interface,
+		VLAN:       e.VLAN,
+		InnerVLAN:  e.InnerVLAN,
+		SrcIP:      e.SrcIP,
+		SrcPort:    e.SrcPort,
+		DstIP:      e.DstIP,
+		DstPort:    e.DstPort,
+		Hostname:   e.Hostname,
+		Start:      end.Add(-time.Duration(e.Duration) * time.Millisecond),
+		End:        end,
+		DurationMs: e.Duration,
+		Bytes:      e.ByteCount,
+		SrcBytes:   e.SrcBytes,
+		DstBytes:   e.DstBytes,
+		EndReason:  reason,
+		P2P:        e.P2P,
+		Tags:       tags,
+		Threat:     e.Threat,
+		ThreatList: e.ThreatList,
+	}, true
+}
+
+// NewFlowExport creates a sink receiving only closed connections. An
+// http(s):// URL gets each batch POSTed as a JSON array of FlowRecords; a
+// kafka:// or nats:// URL gets the closing events published to topic.
+func NewFlowExport(rawURL, topic string, headers map[string]string) (Sink, error) {
+	if strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://") {
+		return &flowWebhook{url: rawURL, headers: headers, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	s, err := New(rawURL, topic)
+	if err != nil {
+		return nil, fmt.Errorf("flow export needs an http(s)://, kafka:// or nats:// URL: %w", err)
+	}
+	return &flowFilter{sink: s}, nil
+}
+
+// flowFilter passes only events closing a connection on to a stream sink
+type flowFilter struct {
+	sink Sink
+}
+
+// Name returns the wrapped sink's name
+func (f *flowFilter) Name() string {
+	return f.sink.Name() + " flows"
+}
+
+// Write publishes the events of the batch that close a connection
+func (f *flowFilter) Write(events []database.NetworkEvent) error {
+	var flows []database.NetworkEvent
+	for i := range events {
+		if _, ok := NewFlowRecord(&events[i]); ok {
+			flows = append(flows, events[i])
+		}
+	}
+	if len(flows) == 0 {
+		return nil
+	}
+	return f.sink.Write(flows)
+}
+
+// Close closes the wrapped sink
+func (f *flowFilter) Close() error {
+	return f.sink.Close()
+}
+
+// flowWebhook POSTs closed connections to an HTTP endpoint
+type flowWebhook struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// flowWebhookAttempts is how often a batch is sent before it is given up
+// on when the endpoint is unreachable or fails with a server error
+const flowWebhookAttempts = 3
+
+// Name returns the sink name
+func (w *flowWebhook) Name() string {
+	return "flow webhook"
+}
+
+// Write POSTs the flows closed in the batch as one JSON array
+func (w *flowWebhook) Write(events []database.NetworkEvent) error {
+	var flows []FlowRecord
+	for i := range events {
+		if flow, ok := NewFlowRecord(&events[i]); ok {
+			flows = append(flows, flow)
+		}
+	}
+	if len(flows) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(flows)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil || !retry || attempt == flowWebhookAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// post sends one batch, reporting whether a failure may succeed on retry
+func (w *flowWebhook) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("flow webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("flow webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return false, nil
+}
+
+// Close is a no-op; the HTTP client holds no long-lived state
+func (w *flowWebhook) Close() error {
+	return nil
+}
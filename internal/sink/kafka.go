@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaSink publishes events as JSON messages to a Kafka topic
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// newKafkaSink creates a Kafka producer for the given brokers and topic.
+// Messages are keyed by source IP so one device's events stay ordered
+// within a partition.
+func newKafkaSink(brokers []string, topic string) *kafkaSink {
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireOne,
+			BatchTimeout: 50 * time.Millisecond,
+		},
+	}
+}
+
+// Name returns the sink name
+func (k *kafkaSink) Name() string {
+	return "kafka"
+}
+
+// Write publishes a batch of events to Kafka
+func (k *kafkaSink) Write(events []database.NetworkEvent) error {
+	msgs := make([]kafka.Message, 0, len(events))
+	for i := range events {
+		data, err := json.Marshal(&events[i])
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(events[i].SrcIP),
+			Value: data,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return k.writer.WriteMessages(ctx, msgs...)
+}
+
+// Close flushes and closes the Kafka writer
+func (k *kafkaSink) Close() error {
+	return k.writer.Close()
+}
@@ -0,0 +1,380 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// otlpSink exports events as OTLP logs and per-batch delta metrics over
+// OTLP/HTTP with JSON encoding, which every OpenTelemetry collector and
+// most hosted backends accept without a gRPC client
+type otlpSink struct {
+	endpoint string
+	headers  map[string]string
+	resource otlpResource
+	client   *http.Client
+	// End of the interval the last exported metrics counted, where the
+	// next delta starts; Write is only called by one Streamer goroutine
+	lastExport time.Time
+}
+
+// NewOTLP creates an OTLP/HTTP exporter. endpoint is the collector base URL
+// (e.g. http://localhost:4318); logs and metrics are posted to /v1/logs and
+// /v1/metrics below it. headers are added to every request, typically for
+// API keys such as x-honeycomb-team.
+func NewOTLP(endpoint string, headers map[string]string, version string) (Sink, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("OTLP endpoint must be an http:// or https:// URL, got %q", endpoint)
+	}
+
+	return &otlpSink{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		headers:  headers,
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			stringAttr("service.name", "net-watcher"),
+			stringAttr("service.version", version),
+		}},
+		client:     &http.Client{Timeout: 10 * time.Second},
+		lastExport: time.Now(),
+	}, nil
+}
+
+// ParseHeaders converts "key=value,key2=value2" into a header map
+func ParseHeaders(spec string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected key=value", pair)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// Name returns the sink name
+func (o *otlpSink) Name() string {
+	return "otlp"
+}
+
+// Write exports a batch of events as log records plus event and byte counters
+func (o *otlpSink) Write(events []database.NetworkEvent) error {
+	if err := o.post("/v1/logs", o.buildLogs(events)); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := o.post("/v1/metrics", o.buildMetrics(events, now)); err != nil {
+		return err
+	}
+	o.lastExport = now
+	return nil
+}
+
+// Close is a no-op; the HTTP client holds no long-lived state
+func (o *otlpSink) Close() error {
+	return nil
+}
+
+// post sends an OTLP JSON payload to the given signal path
+func (o *otlpSink) post(path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("OTLP export to %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLP export to %s failed: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// buildLogs maps each event to an OTLP log record
+func (o *otlpSink) buildLogs(events []database.NetworkEvent) otlpLogsRequest {
+	now := unixNano(time.Now())
+	records := make([]otlpLogRecord, 0, len(events))
+	for i := range events {
+		records = append(records, otlpLogRecord{
+			TimeUnixNano:         unixNano(events[i].Timestamp),
+			ObservedTimeUnixNano: now,
+			SeverityNumber:       9, // INFO
+			SeverityText:         "INFO",
+			Body:                 otlpAnyValue{StringValue: strPtr(string(events[i].EventType))},
+			Attributes:           eventAttributes(&events[i]),
+		})
+	}
+
+	return otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: o.resource,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "net-watcher"},
+			LogRecords: records,
+		}},
+	}}}
+}
+
+// buildMetrics aggregates the batch into delta counters keyed by event type
+// and interface, covering the time from the last export to now, so
+// consecutive points neither overlap nor leave gaps
+func (o *otlpSink) buildMetrics(events []database.NetworkEvent, now time.Time) otlpMetricsRequest {
+	type key struct {
+		eventType database.EventType
+		iface     string
+	}
+	counts := make(map[key]int64)
+	byteCounts := make(map[key]int64)
+	for i := range events {
+		k := key{events[i].EventType, events[i].Interface}
+		counts[k]++
+		byteCounts[k] += events[i].ByteCount
+	}
+
+	startNano, endNano := unixNano(o.lastExport), unixNano(now)
+	var eventPoints, bytePoints []otlpNumberDataPoint
+	for k, c := range counts {
+		attrs := []otlpKeyValue{
+			stringAttr("netwatcher.event_type", string(k.eventType)),
+			stringAttr("network.interface.name", k.iface),
+		}
+		eventPoints = append(eventPoints, otlpNumberDataPoint{
+			Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: endNano, AsInt: strconv.FormatInt(c, 10),
+		})
+		bytePoints = append(bytePoints, otlpNumberDataPoint{
+			Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: endNano, AsInt: strconv.FormatInt(byteCounts[k], 10),
+		})
+	}
+
+	return otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: o.resource,
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScope{Name: "net-watcher"},
+			Metrics: []otlpMetric{
+				{Name: "netwatcher.events", Unit: "{event}", Sum: otlpSum{AggregationTemporality: 1, IsMonotonic: true, DataPoints: eventPoints}},
+				{Name: "netwatcher.bytes", Unit: "By", Sum: otlpSum{AggregationTemporality: 1, IsMonotonic: true, DataPoints: bytePoints}},
+			},
+		}},
+	}}}
+}
+
+// eventAttributes maps event fields to OpenTelemetry semantic convention
+// attribute names where one exists
+func eventAttributes(e *database.NetworkEvent) []otlpKeyValue {
+	attrs := []otlpKeyValue{
+		stringAttr("netwatcher.event_type", string(e.EventType)),
+		stringAttr("network.interface.name", e.Interface),
+		stringAttr("network.type", fmt.Sprintf("ipv%d", e.IPVersion)),
+		stringAttr("source.address", e.SrcIP),
+		intAttr("source.port", int64(e.SrcPort)),
+		stringAttr("destination.address", e.DstIP),
+		intAttr("destination.port", int64(e.DstPort)),
+	}
+	if e.VLAN != 0 {
+		attrs = append(attrs, intAttr("netwatcher.vlan.id", int64(e.VLAN)))
+	}
+	if e.InnerVLAN != 0 {
+		attrs = append(attrs, intAttr("netwatcher.vlan.inner_id", int64(e.InnerVLAN)))
+	}
+	if e.Tunnel != "" {
+		attrs = append(attrs,
+			stringAttr("netwatcher.tunnel.type", strings.ToLower(e.Tunnel)),
+			intAttr("netwatcher.tunnel.id", int64(e.TunnelID)),
+			stringAttr("netwatcher.tunnel.source.address", e.TunnelSrcIP),
+			stringAttr("netwatcher.tunnel.destination.address", e.TunnelDstIP),
+		)
+	}
+	if e.P2P != "" {
+		attrs = append(attrs, stringAttr("netwatcher.p2p.class", e.P2P))
+	}
+	if e.Hostname != "" {
+		attrs = append(attrs, stringAttr("server.address", e.Hostname))
+	}
+	if e.TLSSNI != "" {
+		attrs = append(attrs, stringAttr("tls.client.server_name", e.TLSSNI))
+	}
+	if e.DNSQuery != "" {
+		attrs = append(attrs, stringAttr("dns.question.name", e.DNSQuery), stringAttr("netwatcher.dns.type", e.DNSType))
+	}
+	if e.DNSAnswers != "" {
+		attrs = append(attrs, stringAttr("netwatcher.dns.answers", e.DNSAnswers))
+	}
+	if e.Protocol != "" {
+		attrs = append(attrs, stringAttr("network.protocol.name", e.Protocol))
+	}
+	if e.RemoteVersion != "" {
+		attrs = append(attrs, stringAttr("network.protocol.version", e.RemoteVersion))
+	}
+	if e.RemoteClient != "" {
+		attrs = append(attrs, stringAttr("netwatcher.remote.client", e.RemoteClient))
+	}
+	if e.RemoteServer != "" {
+		attrs = append(attrs, stringAttr("netwatcher.remote.server", e.RemoteServer))
+	}
+	if e.ShareVersion != "" {
+		attrs = append(attrs, stringAttr("network.protocol.version", e.ShareVersion))
+	}
+	if e.Shares != "" {
+		attrs = append(attrs, stringAttr("netwatcher.fileshare.shares", e.Shares))
+	}
+	if e.ShareServer != "" {
+		attrs = append(attrs, stringAttr("netwatcher.fileshare.server", e.ShareServer))
+	}
+	if e.EventType == database.EventNTP {
+		attrs = append(attrs,
+			intAttr("network.protocol.version", int64(e.NTPVersion)),
+			intAttr("netwatcher.ntp.stratum", int64(e.NTPStratum)),
+		)
+		if e.NTPRefID != "" {
+			attrs = append(attrs, stringAttr("netwatcher.ntp.refid", e.NTPRefID))
+		}
+	}
+	if e.Duration > 0 {
+		attrs = append(attrs, intAttr("netwatcher.duration_ms", e.Duration))
+	}
+	if e.ByteCount > 0 {
+		attrs = append(attrs, intAttr("netwatcher.bytes", e.ByteCount))
+	}
+	if e.Repeats > 0 {
+		attrs = append(attrs, intAttr("netwatcher.repeats", e.Repeats))
+	}
+	if e.Reason != "" {
+		attrs = append(attrs, stringAttr("netwatcher.end_reason", e.Reason))
+	}
+	if e.EventType == database.EventICMP {
+		attrs = append(attrs,
+			intAttr("netwatcher.icmp.type", int64(e.ICMPType)),
+			intAttr("netwatcher.icmp.code", int64(e.ICMPCode)),
+			stringAttr("netwatcher.icmp.description", e.ICMPDesc),
+		)
+		if e.ICMPOrigProto != "" {
+			attrs = append(attrs,
+				stringAttr("netwatcher.icmp.original.transport", strings.ToLower(e.ICMPOrigProto)),
+				stringAttr("netwatcher.icmp.original.source.address", e.ICMPOrigSrcIP),
+				intAttr("netwatcher.icmp.original.source.port", int64(e.ICMPOrigSrcPort)),
+				stringAttr("netwatcher.icmp.original.destination.address", e.ICMPOrigDstIP),
+				intAttr("netwatcher.icmp.original.destination.port", int64(e.ICMPOrigDstPort)),
+			)
+		}
+	}
+	return attrs
+}
+
+// OTLP/JSON wire types. 64-bit integers are encoded as strings per the spec.
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name string  `json:"name"`
+	Unit string  `json:"unit"`
+	Sum  otlpSum `json:"sum"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: strPtr(value)}}
+}
+
+func intAttr(key string, value int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: strPtr(strconv.FormatInt(value, 10))}}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func unixNano(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
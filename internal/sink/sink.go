@@ -0,0 +1,151 @@
+// Net Watcher - Event streaming sinks
+// Sinks receive every event after it has been written to the database so
+// larger installs can fan events into stream processors without polling.
+package sink
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/charmbracelet/log"
+)
+
+// Sink is an output that receives batches of captured events
+type Sink interface {
+	Name() string
+	Write(events []database.NetworkEvent) error
+	Close() error
+}
+
+// New creates a sink from a URL such as kafka://broker1:9092,broker2:9092
+// or nats://localhost:4222. topic is the Kafka topic or NATS subject.
+func New(rawURL, topic string) (Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream URL %q: %w", rawURL, err)
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("stream topic must not be empty")
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "kafka":
+		return newKafkaSink(strings.Split(u.Host, ","), topic), nil
+	case "nats":
+		return newNATSSink(u, topic), nil
+	default:
+		return nil, fmt.Errorf("unsupported stream scheme %q (use kafka:// or nats://)", u.Scheme)
+	}
+}
+
+// Streamer batches events in memory and hands them to a Sink from a
+// background goroutine, so a slow broker never blocks the capture path.
+type Streamer struct {
+	sink          Sink
+	logger        *log.Logger
+	queue         chan database.NetworkEvent
+	batchSize     int
+	flushInterval time.Duration
+	dropped       uint64
+	droppedMux    sync.Mutex
+	done          chan struct{}
+}
+
+// NewStreamer wraps a sink with batching. batchSize and flushInterval
+// control how many events are grouped per write and how long a partial
+// batch may wait.
+func NewStreamer(s Sink, logger *log.Logger, batchSize int, flushInterval time.Duration) *Streamer {
+	if batchSize < 1 {
+		batchSize = 100
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	st := &Streamer{
+		sink:          s,
+		logger:        logger,
+		queue:         make(chan database.NetworkEvent, batchSize*10),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+	go st.run()
+	return st
+}
+
+// Name returns the name of the wrapped sink
+func (st *Streamer) Name() string {
+	return st.sink.Name()
+}
+
+// Write enqueues events for delivery, dropping them if the queue is full
+func (st *Streamer) Write(events []database.NetworkEvent) error {
+	for _, e := range events {
+		select {
+		case st.queue <- e:
+		default:
+			st.droppedMux.Lock()
+			st.dropped++
+			dropped := st.dropped
+			st.droppedMux.Unlock()
+			if dropped%1000 == 1 {
+				st.logger.Warn("[STREAM] Queue full, dropping events", "sink", st.sink.Name(), "dropped", dropped)
+			}
+		}
+	}
+	return nil
+}
+
+// QueueDepth returns the number of events waiting to be published
+func (st *Streamer) QueueDepth() int {
+	return len(st.queue)
+}
+
+// Close flushes queued events and closes the wrapped sink
+func (st *Streamer) Close() error {
+	close(st.queue)
+	<-st.done
+	return st.sink.Close()
+}
+
+// run collects events into batches and writes them to the sink
+func (st *Streamer) run() {
+	defer close(st.done)
+
+	ticker := time.NewTicker(st.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]database.NetworkEvent, 0, st.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := st.sink.Write(batch); err != nil {
+			st.logger.Error("[STREAM] Failed to publish events", "sink", st.sink.Name(), "count", len(batch), "error", err)
+		} else {
+			st.logger.Debug("[STREAM] Published events", "sink", st.sink.Name(), "count", len(batch))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case e, ok := <-st.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= st.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
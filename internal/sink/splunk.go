@@ -0,0 +1,330 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// SplunkRoute is where events of one type go: a sourcetype and an optional
+// index overriding the default
+type SplunkRoute struct {
+	Sourcetype string
+	Index      string
+}
+
+// splunkSink sends events to a Splunk HTTP Event Collector with fields
+// named after the Common Information Model (Network Traffic, Network
+// Resolution and Certificates), so CIM data models and apps pick them up
+type splunkSink struct {
+	url    string
+	token  string
+	index  string
+	routes map[database.EventType]SplunkRoute // nil forwards every type
+	host   string
+	client *http.Client
+}
+
+// splunkEvent is one HEC event envelope
+type splunkEvent struct {
+	Time       float64        `json:"time"`
+	Host       string         `json:"host,omitempty"`
+	Source     string         `json:"source"`
+	Sourcetype string         `json:"sourcetype"`
+	Index      string         `json:"index,omitempty"`
+	Event      map[string]any `json:"event"`
+}
+
+// NewSplunkHEC creates a HEC sink. endpoint is the collector base URL
+// (e.g. https://splunk:8088), token the HEC token and index the default
+// index (empty uses the token's). routes limits the forwarded event types
+// and sets their sourcetype; nil forwards all as net-watcher:<type>.
+func NewSplunkHEC(endpoint, token, index string, routes map[database.EventType]SplunkRoute) (Sink, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("Splunk HEC endpoint must be an http:// or https:// URL, got %q", endpoint)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("Splunk HEC token must not be empty")
+	}
+	host, _ := os.Hostname()
+	return &splunkSink{
+		url:    strings.TrimRight(endpoint, "/") + "/services/collector/event",
+		token:  token,
+		index:  index,
+		routes: routes,
+		host:   host,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// ParseSplunkRoutes parses "TCP_END,DNS=netwatcher:dns@netindex" into
+// routes: event types to forward, each with an optional sourcetype after =
+// and index after @
+func ParseSplunkRoutes(spec string) (map[database.EventType]SplunkRoute, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	routes := make(map[database.EventType]SplunkRoute)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var route SplunkRoute
+		part, route.Index, _ = strings.Cut(part, "@")
+		name, sourcetype, _ := strings.Cut(part, "=")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("invalid Splunk route %q, expected TYPE[=sourcetype][@index]", part)
+		}
+		route.Sourcetype = strings.TrimSpace(sourcetype)
+		routes[database.EventType(name)] = route
+	}
+	return routes, nil
+}
+
+// Name returns the sink name
+func (s *splunkSink) Name() string {
+	return "splunk"
+}
+
+// Write sends the batch as one HEC request of concatenated events
+func (s *splunkSink) Write(events []database.NetworkEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	sent := 0
+	for i := range events {
+		e := &events[i]
+		route, ok := s.route(e.EventType)
+		if !ok {
+			continue
+		}
+		if route.Index == "" {
+			route.Index = s.index
+		}
+		err := enc.Encode(splunkEvent{
+			Time:       float64(e.Timestamp.UnixMicro()) / 1e6,
+			Host:       s.host,
+			Source:     "net-watcher",
+			Sourcetype: route.Sourcetype,
+			Index:      route.Index,
+			Event:      cimFields(e),
+		})
+		if err != nil {
+			return err
+		}
+		sent++
+	}
+	if sent == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Splunk HEC request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Splunk HEC returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Close is a no-op; the HTTP client holds no long-lived state
+func (s *splunkSink) Close() error {
+	return nil
+}
+
+// route returns where an event type goes and whether it is forwarded
+func (s *splunkSink) route(t database.EventType) (SplunkRoute, bool) {
+	route := SplunkRoute{}
+	if s.routes != nil {
+		var ok bool
+		if route, ok = s.routes[t]; !ok {
+			return route, false
+		}
+	}
+	if route.Sourcetype == "" {
+		route.Sourcetype = "net-watcher:" + strings.ToLower(string(t))
+	}
+	return route, true
+}
+
+// cimFields maps an event to CIM field names, keeping net-watcher specific
+// fields under their own names
+func cimFields(e *database.NetworkEvent) map[string]any {
+	f := map[string]any{
+		"vendor_product": "net-watcher",
+		"event_type":     string(e.EventType),
+		"dvc_interface":  e.Interface,
+		"src":            e.SrcIP,
+		"src_ip":         e.SrcIP,
+		"dest":           e.DstIP,
+		"dest_ip":        e.DstIP,
+	}
+	if e.SrcPort != 0 || e.DstPort != 0 {
+		f["src_port"] = e.SrcPort
+		f["dest_port"] = e.DstPort
+	}
+	if e.VLAN != 0 {
+		f["vlan"] = e.VLAN
+	}
+	if e.InnerVLAN != 0 {
+		f["inner_vlan"] = e.InnerVLAN
+	}
+	if e.IPVersion != 0 {
+		f["protocol_version"] = fmt.Sprintf("ipv%d", e.IPVersion)
+	}
+	if e.FlowID != "" {
+		f["session_id"] = e.FlowID
+	}
+	if e.Hostname != "" {
+		f["dest_host"] = e.Hostname
+	}
+
+	switch e.EventType {
+	case database.EventTCPStart, database.EventTCPEnd, database.EventTCP, database.EventTLSSNI:
+		f["transport"] = "tcp"
+		f["protocol"] = "ip"
+	case database.EventUDPStart, database.EventUDPEnd, database.EventUDP, database.EventDNS:
+		f["transport"] = "udp"
+		f["protocol"] = "ip"
+	case database.EventICMP:
+		f["transport"] = "icmp"
+		f["protocol"] = "ip"
+		f["icmp_type"] = e.ICMPType
+		f["icmp_code"] = e.ICMPCode
+		if e.ICMPDesc != "" {
+			f["icmp_description"] = e.ICMPDesc
+		}
+		if e.ICMPOrigProto != "" {
+			f["icmp_orig_transport"] = strings.ToLower(e.ICMPOrigProto)
+			f["icmp_orig_src"], f["icmp_orig_src_port"] = e.ICMPOrigSrcIP, e.ICMPOrigSrcPort
+			f["icmp_orig_dest"], f["icmp_orig_dest_port"] = e.ICMPOrigDstIP, e.ICMPOrigDstPort
+		}
+	case database.EventVPN:
+		f["protocol"] = "ip"
+		f["app"] = strings.ToLower(e.Protocol)
+	case database.EventRemoteAccess:
+		f["transport"] = "tcp"
+		f["protocol"] = "ip"
+		f["app"] = strings.ToLower(e.Protocol)
+		if e.RemoteVersion != "" {
+			f["app_version"] = e.RemoteVersion
+		}
+	case database.EventFileShare:
+		f["protocol"] = "ip"
+		f["app"] = strings.ToLower(e.Protocol)
+		if e.ShareVersion != "" {
+			f["app_version"] = e.ShareVersion
+		}
+		if e.Shares != "" {
+			f["share"] = strings.Split(e.Shares, ",")
+		}
+		if e.ShareServer != "" {
+			f["dest_nt_host"] = e.ShareServer
+		}
+	case database.EventNTP:
+		f["transport"] = "udp"
+		f["protocol"] = "ip"
+		f["app"] = strings.ToLower(e.Protocol)
+		f["ntp_version"] = e.NTPVersion
+		f["ntp_stratum"] = e.NTPStratum
+		if e.NTPRefID != "" {
+			f["ntp_refid"] = e.NTPRefID
+		}
+	}
+	if e.P2P != "" {
+		f["app"] = "bittorrent"
+		f["p2p_class"] = e.P2P
+	}
+	if e.Tunnel != "" {
+		f["tunnel"] = strings.ToLower(e.Tunnel)
+		f["tunnel_id"] = e.TunnelID
+		f["tunnel_src"], f["tunnel_dest"] = e.TunnelSrcIP, e.TunnelDstIP
+	}
+	if e.ByteCount > 0 {
+		f["bytes"] = e.ByteCount
+	}
+	if e.Duration > 0 {
+		f["duration"] = float64(e.Duration) / 1000
+	}
+	if e.Reason != "" {
+		f["tcp_flag"] = e.Reason
+	}
+	if e.Repeats > 0 {
+		f["count"] = e.Repeats + 1
+	}
+
+	// Network Resolution (DNS)
+	if e.EventType == database.EventDNS {
+		f["app"] = "dns"
+		f["query"] = e.DNSQuery
+		f["transaction_id"] = e.DNSID
+		switch e.DNSType {
+		case "QUERY":
+			f["message_type"] = "Query"
+		default:
+			f["message_type"] = "Response"
+		}
+		if e.DNSAnswers != "" {
+			f["answer"] = strings.Split(e.DNSAnswers, ",")
+			f["answer_count"] = e.DNSAnswerCount
+			f["ttl"] = e.DNSTTL
+		}
+		if e.DNSCNAMEs != "" {
+			f["cname"] = strings.Split(e.DNSCNAMEs, ",")
+		}
+		if e.DNSRCode != "" {
+			f["reply_code"] = e.DNSRCode
+		}
+	}
+
+	// Certificates / TLS
+	if e.EventType == database.EventTLSSNI {
+		f["app"] = "ssl"
+		if e.TLSSNI != "" {
+			f["ssl_server_name"] = e.TLSSNI
+			f["dest_host"] = e.TLSSNI
+		}
+		if e.TLSVersion != "" {
+			f["ssl_version"] = e.TLSVersion
+		}
+		if e.TLSCipher != "" {
+			f["ssl_cipher"] = e.TLSCipher
+		}
+		if e.TLSALPN != "" {
+			f["ssl_alpn"] = e.TLSALPN
+		}
+		if e.TLSJA3 != "" {
+			f["ja3"] = e.TLSJA3
+		}
+		if e.TLSJA4 != "" {
+			f["ja4"] = e.TLSJA4
+		}
+	}
+
+	if e.Threat {
+		f["threat_match_value"] = e.ThreatList
+		f["category"] = "threat"
+	}
+	if e.AnomalyScore > 0 {
+		f["anomaly_score"] = e.AnomalyScore
+		f["anomaly_reasons"] = e.AnomalyReasons
+	}
+	return f
+}
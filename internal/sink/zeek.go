@@ -0,0 +1,382 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// ZeekFormats lists the log formats the Zeek sink writes
+var ZeekFormats = []string{"tsv", "json"}
+
+// zeekSchemas are the columns written to each log, a subset of Zeek's own
+// so zeek-cut and Zeek analysis scripts find the fields they expect
+var zeekSchemas = map[string]struct{ fields, types []string }{
+	"conn": {
+		fields: []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "proto", "service", "duration", "orig_bytes", "resp_bytes", "conn_state", "vlan", "inner_vlan"},
+		types:  []string{"time", "string", "addr", "port", "addr", "port", "enum", "string", "interval", "count", "count", "string", "int", "int"},
+	},
+	"dns": {
+		fields: []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "proto", "trans_id", "query", "rcode_name", "answers", "TTLs"},
+		types:  []string{"time", "string", "addr", "port", "addr", "port", "enum", "count", "string", "string", "vector[string]", "vector[interval]"},
+	},
+	"ssl": {
+		fields: []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "version", "cipher", "server_name", "next_protocol", "ja3", "ja4"},
+		types:  []string{"time", "string", "addr", "port", "addr", "port", "string", "string", "string", "string", "string", "string"},
+	},
+	"ssh": {
+		fields: []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "version", "client", "server"},
+		types:  []string{"time", "string", "addr", "port", "addr", "port", "count", "string", "string"},
+	},
+	"rdp": {
+		fields: []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "result", "security_protocol"},
+		types:  []string{"time", "string", "addr", "port", "addr", "port", "string", "string"},
+	},
+}
+
+// zeekInterval marks a value written as a Zeek interval (seconds)
+type zeekInterval time.Duration
+
+// zeekSink writes events as Zeek conn.log, dns.log, ssl.log, ssh.log and
+// rdp.log files. The
+// current logs are rotated every hour like Zeek does, to
+// conn.2006-01-02-15.log and so on.
+type zeekSink struct {
+	dir    string
+	json   bool
+	logs   map[string]*zeekLog
+	hour   time.Time
+	mutex  sync.Mutex
+	closed bool
+}
+
+// zeekLog is one open log file
+type zeekLog struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// NewZeek creates a sink writing Zeek logs in format (tsv or json) to dir
+func NewZeek(dir, format string) (Sink, error) {
+	if format != "tsv" && format != "json" {
+		return nil, fmt.Errorf("unknown Zeek log format %q (use tsv or json)", format)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create Zeek log directory: %w", err)
+	}
+	return &zeekSink{dir: dir, json: format == "json", logs: make(map[string]*zeekLog)}, nil
+}
+
+// Name returns the sink name
+func (z *zeekSink) Name() string {
+	return "zeek"
+}
+
+// Write appends the events that map to a Zeek log
+func (z *zeekSink) Write(events []database.NetworkEvent) error {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	if z.closed {
+		return nil
+	}
+
+	if hour := time.Now().Truncate(time.Hour); !hour.Equal(z.hour) {
+		if err := z.rotate(); err != nil {
+			return err
+		}
+		z.hour = hour
+	}
+
+	for i := range events {
+		path, values := zeekRecord(&events[i])
+		if path == "" {
+			continue
+		}
+		l, err := z.open(path)
+		if err != nil {
+			return err
+		}
+		if z.json {
+			err = writeZeekJSON(l.writer, zeekSchemas[path].fields, values)
+		} else {
+			err = writeZeekTSV(l.writer, values)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s.log: %w", path, err)
+		}
+	}
+	for _, l := range z.logs {
+		if err := l.writer.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes and rotates the current logs
+func (z *zeekSink) Close() error {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.closed = true
+	return z.rotate()
+}
+
+// open returns the current log for path, creating it with a header;
+// callers hold the mutex
+func (z *zeekSink) open(path string) (*zeekLog, error) {
+	if l := z.logs[path]; l != nil {
+		return l, nil
+	}
+	name := filepath.Join(z.dir, path+".log")
+	// A log left behind by an earlier run keeps its own hour
+	if info, err := os.Stat(name); err == nil {
+		archiveZeekLog(name, path, info.ModTime())
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s.log: %w", path, err)
+	}
+	l := &zeekLog{file: f, writer: bufio.NewWriter(f)}
+	if !z.json {
+		schema := zeekSchemas[path]
+		fmt.Fprintf(l.writer, "#separator \\x09\n#set_separator\t,\n#empty_field\t(empty)\n#unset_field\t-\n")
+		fmt.Fprintf(l.writer, "#path\t%s\n#open\t%s\n", path, time.Now().Format("2006-01-02-15-04-05"))
+		fmt.Fprintf(l.writer, "#fields\t%s\n#types\t%s\n", strings.Join(schema.fields, "\t"), strings.Join(schema.types, "\t"))
+	}
+	z.logs[path] = l
+	return l, nil
+}
+
+// rotate closes the current logs and moves them to their hourly names;
+// callers hold the mutex
+func (z *zeekSink) rotate() error {
+	var firstErr error
+	for path, l := range z.logs {
+		if !z.json {
+			fmt.Fprintf(l.writer, "#close\t%s\n", time.Now().Format("2006-01-02-15-04-05"))
+		}
+		if err := l.writer.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := l.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		archiveZeekLog(l.file.Name(), path, z.hour)
+		delete(z.logs, path)
+	}
+	return firstErr
+}
+
+// archiveZeekLog renames a finished log to its hourly archive name
+func archiveZeekLog(name, path string, hour time.Time) {
+	archived := filepath.Join(filepath.Dir(name), path+"."+hour.Format("2006-01-02-15")+".log")
+	// Never overwrite an archive; a second file for the hour gets a suffix
+	for n := 1; ; n++ {
+		if _, err := os.Stat(archived); os.IsNotExist(err) {
+			break
+		}
+		archived = filepath.Join(filepath.Dir(name), fmt.Sprintf("%s.%s.%d.log", path, hour.Format("2006-01-02-15"), n))
+	}
+	_ = os.Rename(name, archived)
+}
+
+// zeekRecord maps an event to a log and its column values; nil values are
+// unset. Events without a Zeek counterpart return an empty path.
+func zeekRecord(e *database.NetworkEvent) (string, []any) {
+	uid := zeekUID(e)
+	switch e.EventType {
+	case database.EventTCPEnd, database.EventUDPEnd, database.EventTCP, database.EventUDP:
+		proto := "tcp"
+		if e.EventType == database.EventUDPEnd || e.EventType == database.EventUDP {
+			proto = "udp"
+		}
+		start := e.Timestamp
+		if e.EventType == database.EventTCPEnd || e.EventType == database.EventUDPEnd {
+			start = start.Add(-time.Duration(e.Duration) * time.Millisecond)
+		}
+		// Events stored before bytes were counted per direction report
+		// them all as sent by the originator
+		var origBytes, respBytes any = e.ByteCount, nil
+		if e.SrcBytes+e.DstBytes == e.ByteCount && e.ByteCount > 0 {
+			origBytes, respBytes = e.SrcBytes, e.DstBytes
+		}
+		return "conn", []any{start, uid, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort, proto, nil,
+			zeekInterval(time.Duration(e.Duration) * time.Millisecond), origBytes, respBytes, zeekConnState(e.Reason),
+			zeekVLAN(e.VLAN), zeekVLAN(e.InnerVLAN)}
+	case database.EventICMP:
+		// Zeek logs the ICMP type and code in the port columns
+		return "conn", []any{e.Timestamp, uid, e.SrcIP, uint16(e.ICMPType), e.DstIP, uint16(e.ICMPCode), "icmp", nil,
+			nil, e.ByteCount, nil, "OTH", zeekVLAN(e.VLAN), zeekVLAN(e.InnerVLAN)}
+	case database.EventDNS:
+		src, srcPort, dst, dstPort := e.SrcIP, e.SrcPort, e.DstIP, e.DstPort
+		switch e.DNSType {
+		case "RESPONSE":
+			// Responses travel server -> client; Zeek's originator is the client
+			src, srcPort, dst, dstPort = dst, dstPort, src, srcPort
+		case "COMPLETE":
+		default:
+			return "", nil
+		}
+		var answers, ttls any
+		if e.DNSAnswers != "" {
+			list := strings.Split(e.DNSAnswers, ",")
+			answers = list
+			// Only the lowest TTL is stored; Zeek has one per answer
+			ttl := make([]zeekInterval, len(list))
+			for i := range ttl {
+				ttl[i] = zeekInterval(time.Duration(e.DNSTTL) * time.Second)
+			}
+			ttls = ttl
+		}
+		var rcode any
+		if e.DNSRCode != "" {
+			rcode = e.DNSRCode
+		}
+		return "dns", []any{e.Timestamp, uid, src, srcPort, dst, dstPort, "udp", e.DNSID, e.DNSQuery, rcode, answers, ttls}
+	case database.EventTLSSNI:
+		return "ssl", []any{e.Timestamp, uid, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			zeekOptional(e.TLSVersion), zeekOptional(e.TLSCipher), zeekOptional(e.TLSSNI),
+			zeekOptional(e.TLSALPN), zeekOptional(e.TLSJA3), zeekOptional(e.TLSJA4)}
+	case database.EventRemoteAccess:
+		switch e.Protocol {
+		case "SSH":
+			// Zeek logs the major version only
+			var version any
+			if major, _, _ := strings.Cut(e.RemoteVersion, "."); major != "" {
+				version, _ = strconv.Atoi(major)
+			}
+			return "ssh", []any{e.Timestamp, uid, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+				version, zeekOptional(e.RemoteClient), zeekOptional(e.RemoteServer)}
+		case "RDP":
+			var result any = "Success"
+			if e.Reason != "" {
+				result = e.Reason
+			} else if e.RemoteVersion == "" {
+				result = nil
+			}
+			return "rdp", []any{e.Timestamp, uid, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+				result, zeekOptional(e.RemoteVersion)}
+		}
+	}
+	return "", nil
+}
+
+// zeekUID derives a Zeek-style connection UID from the flow ID, so records
+// of one connection share it across logs
+func zeekUID(e *database.NetworkEvent) any {
+	if e.FlowID == "" {
+		return nil
+	}
+	return "C" + e.FlowID
+}
+
+// zeekConnState maps how a connection ended to the closest Zeek conn_state
+func zeekConnState(reason string) string {
+	switch reason {
+	case "FIN":
+		return "SF"
+	case "RST":
+		return "RSTO"
+	}
+	return "OTH"
+}
+
+// zeekOptional returns nil (unset) for an empty string
+func zeekOptional(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// zeekVLAN returns nil (unset) for an untagged frame, as Zeek's vlan
+// logging policy does
+func zeekVLAN(id uint16) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// writeZeekTSV writes one record in Zeek's tab-separated format
+func writeZeekTSV(w *bufio.Writer, values []any) error {
+	for i, v := range values {
+		if i > 0 {
+			w.WriteByte('\t')
+		}
+		w.WriteString(zeekText(v))
+	}
+	return w.WriteByte('\n')
+}
+
+// zeekText renders a value the way Zeek writes it in TSV logs
+func zeekText(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "-"
+	case string:
+		if v == "" {
+			return "(empty)"
+		}
+		return v
+	case time.Time:
+		return strconv.FormatFloat(float64(v.UnixMicro())/1e6, 'f', 6, 64)
+	case zeekInterval:
+		return strconv.FormatFloat(time.Duration(v).Seconds(), 'f', 6, 64)
+	case []string:
+		return strings.Join(v, ",")
+	case []zeekInterval:
+		parts := make([]string, len(v))
+		for i, d := range v {
+			parts[i] = zeekText(d)
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// writeZeekJSON writes one record as a JSON object like Zeek's JSON logs,
+// leaving out unset fields
+func writeZeekJSON(w *bufio.Writer, fields []string, values []any) error {
+	w.WriteByte('{')
+	first := true
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		switch t := v.(type) {
+		case time.Time:
+			v = json.Number(zeekText(t))
+		case zeekInterval:
+			v = json.Number(zeekText(t))
+		case []zeekInterval:
+			nums := make([]json.Number, len(t))
+			for j, d := range t {
+				nums[j] = json.Number(zeekText(d))
+			}
+			v = nums
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		key, _ := json.Marshal(fields[i])
+		w.Write(key)
+		w.WriteByte(':')
+		w.Write(data)
+	}
+	w.WriteString("}\n")
+	return nil
+}
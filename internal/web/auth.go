@@ -0,0 +1,165 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Role is what an API token may do
+type Role int
+
+const (
+	// RoleViewer reads events, statistics and reports
+	RoleViewer Role = iota + 1
+	// RoleAdmin also changes state: saved views, jobs such as compaction
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{"viewer": RoleViewer, "admin": RoleAdmin}
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// apiToken is a bearer token with its role
+type apiToken struct {
+	token string
+	role  Role
+}
+
+// viewerWrites are the requests other than GET a viewer may make: they
+// create nothing but a copy of data the viewer can read anyway
+var viewerWrites = map[string]bool{
+	"POST /api/reports": true,
+}
+
+// parseAPITokens parses an --api-tokens value: comma-separated TOKEN=ROLE
+// entries, where ROLE is viewer or admin
+func parseAPITokens(spec string) ([]apiToken, error) {
+	var tokens []apiToken
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		token, roleName, ok := strings.Cut(entry, "=")
+		token = strings.TrimSpace(token)
+		if !ok || token == "" {
+			return nil, fmt.Errorf("invalid API token %q, expected TOKEN=ROLE", entry)
+		}
+		role, ok := roleNames[strings.ToLower(strings.TrimSpace(roleName))]
+		if !ok {
+			return nil, fmt.Errorf("invalid role %q for an API token, expected viewer or admin", roleName)
+		}
+		if seen[token] {
+			return nil, fmt.Errorf("API token listed twice")
+		}
+		seen[token] = true
+		tokens = append(tokens, apiToken{token: token, role: role})
+	}
+	return tokens, nil
+}
+
+// ValidateAPITokens checks an --api-tokens value
+func ValidateAPITokens(spec string) error {
+	_, err := parseAPITokens(spec)
+	return err
+}
+
+// SetAPITokens requires a bearer token on every API request except
+// /api/ingest, which has its own (see parseAPITokens). Viewer tokens may
+// only read; admin tokens may also change state. An empty spec leaves the
+// API open.
+func (s *Server) SetAPITokens(spec string) error {
+	tokens, err := parseAPITokens(spec)
+	if err != nil {
+		return err
+	}
+	s.apiTokens = tokens
+	return nil
+}
+
+// role returns the role of a request's token, or 0 if it has no valid one.
+// Browsers cannot set headers on WebSocket connections, so /api/ws takes
+// the token as the token query parameter too.
+func (s *Server) role(r *http.Request) Role {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok && r.URL.Path == "/api/ws" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return 0
+	}
+	var role Role
+	for _, t := range s.apiTokens {
+		// Compare with every token so the time taken tells nothing
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1 {
+			role = t.role
+		}
+	}
+	return role
+}
+
+// hasAdminToken reports whether an admin token is configured, so that
+// requests changing state are authenticated
+func (s *Server) hasAdminToken() bool {
+	for _, t := range s.apiTokens {
+		if t.role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// authMiddleware answers 401 Unauthorized to API requests without a valid
+// token and 403 Forbidden to viewers making changes
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.apiTokens) == 0 || !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/ingest" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		role := s.role(r)
+		if role == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="net-watcher"`)
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		if role < RoleAdmin && !readOnly(r) {
+			http.Error(w, "this token's role ("+role.String()+") may only read", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnly reports whether a request changes nothing a viewer may not
+func readOnly(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	}
+	return viewerWrites[r.Method+" "+r.URL.Path]
+}
+
+// redactToken hides the token query parameter of /api/ws in logs
+func redactToken(rawQuery string) string {
+	if !strings.Contains(rawQuery, "token=") {
+		return rawQuery
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "(unparsable)"
+	}
+	query.Set("token", "REDACTED")
+	return query.Encode()
+}
@@ -0,0 +1,38 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// BeaconsResponse lists the beacons the last detection run found
+type BeaconsResponse struct {
+	Beacons []database.Beacon `json:"beacons"`
+}
+
+// handleBeacons returns the beacons stored by the beacons job, highest
+// score first
+func (s *Server) handleBeacons(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	minScore, err := strconv.Atoi(query.Get("minScore"))
+	if err != nil || minScore < 0 || minScore > 100 {
+		minScore = 0
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+	beacons, err := s.reader().Beacons(minScore, query.Get("srcIP"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if beacons == nil {
+		beacons = []database.Beacon{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BeaconsResponse{Beacons: beacons})
+}
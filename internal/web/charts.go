@@ -0,0 +1,140 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/chart"
+)
+
+// ChartTypes lists the charts served under /api/charts/{type}.{png,svg}
+var ChartTypes = []string{"timeline", "events", "top-hosts"}
+
+// handleChart renders a chart as an image, e.g. /api/charts/timeline.png.
+// It accepts the query parameters of the matching JSON endpoint
+// (/api/traffic-timeline or /api/top-hosts) plus width, height and title.
+func (s *Server) handleChart(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	format := strings.TrimPrefix(path.Ext(file), ".")
+	chartType := strings.TrimSuffix(file, path.Ext(file))
+	if !chart.ValidFormat(format) {
+		http.Error(w, fmt.Sprintf("invalid chart format %q, expected one of %v", format, chart.Formats), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := chart.Options{Title: query.Get("title")}
+	opts.Width, _ = strconv.Atoi(query.Get("width"))
+	opts.Height, _ = strconv.Atoi(query.Get("height"))
+	if opts.Width > 4096 || opts.Height > 4096 {
+		http.Error(w, "chart size is limited to 4096x4096", http.StatusBadRequest)
+		return
+	}
+
+	// Render into a buffer so a failed chart still gets a proper error status
+	var buf bytes.Buffer
+	var err error
+	switch chartType {
+	case "timeline", "events":
+		if chartType == "events" && query.Get("metric") == "" {
+			query.Set("metric", "events")
+		}
+		timeline := s.trafficTimeline(query)
+		series := timelineSeries(timeline, chartType)
+		if opts.Title == "" {
+			opts.Title = fmt.Sprintf("%s (%s buckets)", chartTitle(chartType), timeline.BucketSize)
+		}
+		err = chart.Timeline(&buf, format, opts, series...)
+	case "top-hosts":
+		top := s.topHosts(query)
+		bars := make([]chart.Bar, 0, len(top.Hosts))
+		for _, h := range top.Hosts {
+			value := float64(h.EventCount)
+			if top.Metric == "traffic" {
+				value = float64(h.ByteCount)
+			}
+			bars = append(bars, chart.Bar{Label: h.Host, Value: value})
+		}
+		if opts.Title == "" {
+			opts.Title = fmt.Sprintf("Top %s by %s", top.HostType, top.Metric)
+		}
+		err = chart.Bars(&buf, format, opts, bars)
+	default:
+		http.Error(w, fmt.Sprintf("unknown chart %q, expected one of %v", chartType, ChartTypes), http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, chart.ErrNoData) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error("Chart rendering failed", "chart", file, "error", err)
+		http.Error(w, "chart rendering failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", chart.ContentType(format))
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Write(buf.Bytes())
+}
+
+// timelineSeries turns timeline buckets into bytes in/out or event count lines
+func timelineSeries(timeline TrafficTimelineResponse, chartType string) []chart.Series {
+	data := timeline.Data
+	// Without any events there are no buckets; plot a flat line over the range
+	if len(data) == 0 {
+		data = []TrafficDataPoint{{Timestamp: timeline.StartTime}, {Timestamp: timeline.EndTime}}
+	}
+
+	times := make([]time.Time, len(data))
+	in := make([]float64, len(data))
+	out := make([]float64, len(data))
+	events := make([]float64, len(data))
+	for i, d := range data {
+		times[i] = d.Timestamp
+		in[i] = float64(d.BytesIn)
+		out[i] = float64(d.BytesOut)
+		events[i] = float64(d.EventCount)
+	}
+
+	// Grouped timelines plot a line per host, protocol or interface
+	if len(timeline.Series) > 0 {
+		series := make([]chart.Series, 0, len(timeline.Series))
+		for _, s := range timeline.Series {
+			times := make([]time.Time, len(s.Data))
+			values := make([]float64, len(s.Data))
+			for i, d := range s.Data {
+				times[i] = d.Timestamp
+				values[i] = float64(d.BytesIn + d.BytesOut)
+				if chartType == "events" {
+					values[i] = float64(d.EventCount)
+				}
+			}
+			series = append(series, chart.Series{Name: s.Name, Times: times, Values: values})
+		}
+		return series
+	}
+
+	if chartType == "events" {
+		return []chart.Series{{Name: "Events", Times: times, Values: events}}
+	}
+	return []chart.Series{
+		{Name: "Bytes in", Times: times, Values: in},
+		{Name: "Bytes out", Times: times, Values: out},
+	}
+}
+
+// chartTitle returns the default title for a chart type
+func chartTitle(chartType string) string {
+	if chartType == "events" {
+		return "Events"
+	}
+	return "Traffic"
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// eventCursor is the position of one row in the events order. Clients get
+// it base64-encoded and pass it back unchanged.
+type eventCursor struct {
+	Timestamp time.Time `json:"t"`
+	ID        uint      `json:"i"`
+	Score     uint8     `json:"s,omitempty"`
+}
+
+// encodeCursor returns the cursor of an event
+func encodeCursor(e *database.NetworkEvent) string {
+	data, _ := json.Marshal(eventCursor{Timestamp: e.Timestamp, ID: e.ID, Score: e.AnomalyScore})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor from a request; an empty one is nil
+func decodeCursor(value string) (*eventCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c eventCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// keyset orders q newest first (highest score first with byScore) and
+// keeps the rows after c. With backward the order is reversed and the
+// rows before c are kept, for paging back. Unlike an offset, the cost
+// does not grow with the position in the table.
+func keyset(q *gorm.DB, c *eventCursor, byScore, backward bool) *gorm.DB {
+	cmp, dir := "<", "DESC"
+	if backward {
+		cmp, dir = ">", "ASC"
+	}
+	if c != nil {
+		after := fmt.Sprintf("timestamp %[1]s ? OR (timestamp = ? AND id %[1]s ?)", cmp)
+		args := []any{c.Timestamp, c.Timestamp, c.ID}
+		if byScore {
+			after = fmt.Sprintf("COALESCE(anomaly_score, 0) %[1]s ? OR (COALESCE(anomaly_score, 0) = ? AND (%[2]s))", cmp, after)
+			args = append([]any{c.Score, c.Score}, args...)
+		}
+		q = q.Where("("+after+")", args...)
+	}
+	if byScore {
+		q = q.Order("COALESCE(anomaly_score, 0) " + dir)
+	}
+	return q.Order("timestamp " + dir).Order("id " + dir)
+}
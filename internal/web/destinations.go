@@ -0,0 +1,54 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/abja/net-watcher/internal/report"
+)
+
+// NewDestinationsResponse lists the destinations first seen since a time
+type NewDestinationsResponse struct {
+	Since        time.Time              `json:"since"`
+	Destinations []database.Destination `json:"destinations"`
+}
+
+// handleNewDestinations returns the domains and remote addresses local
+// hosts reached for the first time, or the first time in 30 days, within
+// the since window (default 24h)
+func (s *Server) handleNewDestinations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	window := 24 * time.Hour
+	if value := query.Get("since"); value != "" {
+		d, err := report.ParseSince(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	kind := query.Get("kind")
+	if kind != "" && kind != database.DestinationDomain && kind != database.DestinationIP {
+		http.Error(w, "kind must be domain or ip", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	since := time.Now().Add(-window)
+	destinations, err := s.reader().NewDestinations(since, kind, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if destinations == nil {
+		destinations = []database.Destination{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewDestinationsResponse{Since: since, Destinations: destinations})
+}
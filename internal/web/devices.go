@@ -0,0 +1,186 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"gorm.io/gorm"
+)
+
+// DeviceCount is a name with its event count and bytes
+type DeviceCount struct {
+	Name       string `json:"name"`
+	EventCount int64  `json:"eventCount"`
+	ByteCount  int64  `json:"byteCount"`
+}
+
+// DeviceSummary describes what one source address did in the time range
+type DeviceSummary struct {
+	IP              string           `json:"ip"`
+	Sensor          string           `json:"sensor,omitempty"`
+	FirstSeen       time.Time        `json:"firstSeen"`
+	LastSeen        time.Time        `json:"lastSeen"`
+	EventCount      int64            `json:"eventCount"`
+	BytesOut        int64            `json:"bytesOut"` // connections the device opened
+	BytesIn         int64            `json:"bytesIn"`  // connections opened to the device
+	TopDomains      []DeviceCount    `json:"topDomains"`
+	TopDestinations []DeviceCount    `json:"topDestinations"`
+	Protocols       map[string]int64 `json:"protocols"` // events by type
+}
+
+// DevicesResponse is one page of device summaries
+type DevicesResponse struct {
+	Devices   []DeviceSummary `json:"devices"`
+	Total     int64           `json:"total"`
+	Page      int             `json:"page"`
+	PageSize  int             `json:"pageSize"`
+	StartTime time.Time       `json:"startTime"`
+	EndTime   time.Time       `json:"endTime"`
+}
+
+// handleDevices summarises events per source address. By default only
+// hosts with private addresses are listed (all=true lists every source),
+// sorted by bytes sent (sort=events or sort=lastSeen change that).
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	response := s.devices(r.URL.Query())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// devices queries one page of device summaries for the start, end, page,
+// pageSize, q, all and sort parameters
+func (s *Server) devices(query url.Values) DevicesResponse {
+	startTime, endTime := parseTimeRange(query)
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(query.Get("pageSize"))
+	if pageSize < 1 || pageSize > 50 {
+		pageSize = 20
+	}
+
+	base := func() *gorm.DB {
+		return s.reader().Model(&database.NetworkEvent{}).
+			Where("timestamp >= ? AND timestamp <= ? AND event_type NOT IN ?", startTime, endTime,
+				[]database.EventType{database.EventHourlySummary, database.EventRateLimited, database.EventSampled, database.EventScan})
+	}
+	sources := func() *gorm.DB {
+		q := base().Where("src_ip != ''")
+		if query.Get("all") != "true" {
+			q = q.Where(database.LocalSourceCondition)
+		}
+		if search := query.Get("q"); search != "" {
+			q = q.Where("src_ip LIKE ?", "%"+search+"%")
+		}
+		return q
+	}
+
+	var total int64
+	sources().Distinct("src_ip").Count(&total)
+
+	order := "bytes_out DESC"
+	switch query.Get("sort") {
+	case "events":
+		order = "event_count DESC"
+	case "lastSeen":
+		order = "last_seen DESC"
+	}
+	var rows []struct {
+		IP         string
+		Sensor     string
+		FirstSeen  string
+		LastSeen   string
+		EventCount int64
+		BytesOut   int64
+	}
+	sources().Select("src_ip as ip, max(sensor) as sensor, min(timestamp) as first_seen, max(timestamp) as last_seen, " +
+		"count(*) as event_count, COALESCE(sum(byte_count), 0) as bytes_out").
+		Group("src_ip").Order(order + ", src_ip").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&rows)
+
+	devices := make([]DeviceSummary, 0, len(rows))
+	for _, row := range rows {
+		d := DeviceSummary{
+			IP:              row.IP,
+			Sensor:          row.Sensor,
+			FirstSeen:       database.ParseTime(row.FirstSeen),
+			LastSeen:        database.ParseTime(row.LastSeen),
+			EventCount:      row.EventCount,
+			BytesOut:        row.BytesOut,
+			TopDomains:      []DeviceCount{},
+			TopDestinations: []DeviceCount{},
+			Protocols:       map[string]int64{},
+		}
+		base().Where("dst_ip = ?", row.IP).Select("COALESCE(sum(byte_count), 0)").Scan(&d.BytesIn)
+
+		// Domains from DNS lookups and TLS server names
+		base().Where("src_ip = ? AND (dns_query != '' OR tls_sni != '')", row.IP).
+			Select("COALESCE(NULLIF(tls_sni, ''), dns_query) as name, count(*) as event_count, COALESCE(sum(byte_count), 0) as byte_count").
+			Group("name").Order("event_count DESC").Limit(5).
+			Scan(&d.TopDomains)
+
+		base().Where("src_ip = ? AND dst_ip != ''", row.IP).
+			Select("dst_ip as name, count(*) as event_count, COALESCE(sum(byte_count), 0) as byte_count").
+			Group("dst_ip").Order("byte_count DESC, event_count DESC").Limit(5).
+			Scan(&d.TopDestinations)
+
+		var protocols []struct {
+			EventType string
+			Count     int64
+		}
+		base().Where("src_ip = ?", row.IP).
+			Select("event_type, count(*) as count").Group("event_type").
+			Scan(&protocols)
+		for _, p := range protocols {
+			d.Protocols[p.EventType] = p.Count
+		}
+		devices = append(devices, d)
+	}
+
+	return DevicesResponse{
+		Devices:   devices,
+		Total:     total,
+		Page:      page,
+		PageSize:  pageSize,
+		StartTime: startTime,
+		EndTime:   endTime,
+	}
+}
+
+// NewBehaviorResponse lists the devices that did something new in a week
+type NewBehaviorResponse struct {
+	WeekStart time.Time                 `json:"weekStart"`
+	WeekEnd   time.Time                 `json:"weekEnd"`
+	Devices   []database.DeviceBehavior `json:"devices"`
+}
+
+// handleNewBehavior returns the domains and ports each local device
+// contacted for the first time in a week: the week containing the week
+// parameter (YYYY-MM-DD), by default the last completed one
+func (s *Server) handleNewBehavior(w http.ResponseWriter, r *http.Request) {
+	week := database.WeekStart(time.Now()).AddDate(0, 0, -7)
+	if value := r.URL.Query().Get("week"); value != "" {
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			http.Error(w, "week needs a date like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+		week = database.WeekStart(t)
+	}
+	devices, err := s.reader().NewBehavior(week)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if devices == nil {
+		devices = []database.DeviceBehavior{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewBehaviorResponse{WeekStart: week, WeekEnd: week.AddDate(0, 0, 7), Devices: devices})
+}
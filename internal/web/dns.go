@@ -0,0 +1,194 @@
+package web
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"golang.org/x/net/publicsuffix"
+	"gorm.io/gorm"
+)
+
+// DNSDomainVolume is a queried name with its query count and the clients
+// that asked for it
+type DNSDomainVolume struct {
+	Name    string `json:"name"`
+	Queries int64  `json:"queries"`
+	Clients int64  `json:"clients"`
+}
+
+// DNSRegisteredDomain counts the distinct names queried under one
+// registered domain. Many unique subdomains are how domain generation
+// algorithms and DNS tunnels show up.
+type DNSRegisteredDomain struct {
+	Domain     string `json:"domain"`
+	Subdomains int64  `json:"subdomains"`
+	Queries    int64  `json:"queries"`
+}
+
+// DNSResponseTimes are percentiles of the time between a query and its
+// response, in milliseconds, from DNS pairs merged by compaction
+type DNSResponseTimes struct {
+	Samples int64 `json:"samples"`
+	P50     int64 `json:"p50"`
+	P90     int64 `json:"p90"`
+	P95     int64 `json:"p95"`
+	P99     int64 `json:"p99"`
+	Max     int64 `json:"max"`
+}
+
+// DNSClientErrors is a client's query count and how many were answered
+// NXDOMAIN, as a rate between 0 and 1
+type DNSClientErrors struct {
+	IP       string  `json:"ip"`
+	Queries  int64   `json:"queries"`
+	NXDomain int64   `json:"nxdomain"`
+	Rate     float64 `json:"rate"`
+}
+
+// DNSResponse holds the DNS aggregations of a time range
+type DNSResponse struct {
+	StartTime         time.Time             `json:"startTime"`
+	EndTime           time.Time             `json:"endTime"`
+	TotalQueries      int64                 `json:"totalQueries"`
+	Domains           []DNSDomainVolume     `json:"domains"`
+	RegisteredDomains []DNSRegisteredDomain `json:"registeredDomains"`
+	ResponseTimes     DNSResponseTimes      `json:"responseTimes"`
+	Clients           []DNSClientErrors     `json:"clients"`
+}
+
+// dnsQueryTypes are the DNS events standing for one query each: queries
+// not merged yet and pairs merged by compaction
+var dnsQueryTypes = []string{"QUERY", "COMPLETE"}
+
+// handleDNS aggregates DNS traffic: query volume per name, unique
+// subdomains per registered domain, response time percentiles and
+// NXDOMAIN rates per client
+func (s *Server) handleDNS(w http.ResponseWriter, r *http.Request) {
+	response := s.dnsAnalytics(r.URL.Query())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// dnsAnalytics computes the DNS aggregations for the start, end, limit and
+// srcIP parameters
+func (s *Server) dnsAnalytics(query url.Values) DNSResponse {
+	startTime, endTime := parseTimeRange(query)
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	base := func() *gorm.DB {
+		q := s.reader().Model(&database.NetworkEvent{}).
+			Where("event_type = ? AND timestamp >= ? AND timestamp <= ?", database.EventDNS, startTime, endTime)
+		if ip := query.Get("srcIP"); ip != "" {
+			q = q.Where("(src_ip = ? AND dns_type != 'RESPONSE' OR dst_ip = ? AND dns_type = 'RESPONSE')", ip, ip)
+		}
+		return q
+	}
+	queries := func() *gorm.DB {
+		return base().Where("dns_type IN ? AND dns_query != ''", dnsQueryTypes)
+	}
+
+	response := DNSResponse{
+		StartTime:         startTime,
+		EndTime:           endTime,
+		Domains:           []DNSDomainVolume{},
+		RegisteredDomains: []DNSRegisteredDomain{},
+		Clients:           []DNSClientErrors{},
+	}
+	queries().Count(&response.TotalQueries)
+
+	queries().
+		Select("dns_query as name, count(*) as queries, count(DISTINCT src_ip) as clients").
+		Group("dns_query").
+		Order("queries DESC").
+		Limit(limit).
+		Scan(&response.Domains)
+
+	response.RegisteredDomains = s.dnsRegisteredDomains(queries(), limit)
+	response.ResponseTimes = dnsResponseTimes(base().Where("dns_type = 'COMPLETE' AND compacted = ?", true))
+
+	// Clients are the query's source and the response's destination
+	client := "CASE WHEN dns_type = 'RESPONSE' THEN dst_ip ELSE src_ip END"
+	base().
+		Select(client+" as ip, "+
+			"SUM(CASE WHEN dns_type != 'RESPONSE' THEN 1 ELSE 0 END) as queries, "+
+			"SUM(CASE WHEN dns_type != 'QUERY' AND dns_r_code = 'NXDOMAIN' THEN 1 ELSE 0 END) as nx_domain").
+		Group(client).
+		Having("SUM(CASE WHEN dns_type != 'QUERY' AND dns_r_code = 'NXDOMAIN' THEN 1 ELSE 0 END) > 0").
+		Order("nx_domain DESC").
+		Limit(limit).
+		Scan(&response.Clients)
+	for i, c := range response.Clients {
+		if c.Queries > 0 {
+			response.Clients[i].Rate = min(float64(c.NXDomain)/float64(c.Queries), 1)
+		}
+	}
+	return response
+}
+
+// dnsRegisteredDomains groups the distinct queried names by registered
+// domain (example.co.uk for a.b.example.co.uk) and returns those with the
+// most unique subdomains
+func (s *Server) dnsRegisteredDomains(queries *gorm.DB, limit int) []DNSRegisteredDomain {
+	var names []struct {
+		Name    string
+		Queries int64
+	}
+	if err := queries.Select("LOWER(dns_query) as name, count(*) as queries").Group("LOWER(dns_query)").Scan(&names).Error; err != nil {
+		s.logger.Error("Failed to query DNS names", "error", err)
+	}
+
+	byDomain := make(map[string]*DNSRegisteredDomain)
+	for _, n := range names {
+		name := strings.TrimSuffix(n.Name, ".")
+		domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+		if err != nil {
+			domain = name // a bare public suffix or an unqualified name
+		}
+		d, ok := byDomain[domain]
+		if !ok {
+			d = &DNSRegisteredDomain{Domain: domain}
+			byDomain[domain] = d
+		}
+		if name != domain {
+			d.Subdomains++
+		}
+		d.Queries += n.Queries
+	}
+
+	domains := make([]DNSRegisteredDomain, 0, len(byDomain))
+	for _, d := range byDomain {
+		domains = append(domains, *d)
+	}
+	slices.SortFunc(domains, func(a, b DNSRegisteredDomain) int {
+		return cmp.Or(cmp.Compare(b.Subdomains, a.Subdomains), cmp.Compare(b.Queries, a.Queries), strings.Compare(a.Domain, b.Domain))
+	})
+	return domains[:min(limit, len(domains))]
+}
+
+// dnsResponseTimes reads percentiles of the durations of merged DNS pairs,
+// each by its rank, so the durations are never loaded all at once
+func dnsResponseTimes(pairs *gorm.DB) DNSResponseTimes {
+	var times DNSResponseTimes
+	pairs = pairs.Session(&gorm.Session{})
+	pairs.Count(&times.Samples)
+	if times.Samples == 0 {
+		return times
+	}
+	at := func(p float64) int64 {
+		var d int64
+		rank := int(float64(times.Samples-1) * p)
+		pairs.Select("duration").Order("duration ASC").Offset(rank).Limit(1).Scan(&d)
+		return d
+	}
+	times.P50, times.P90, times.P95, times.P99, times.Max = at(0.5), at(0.9), at(0.95), at(0.99), at(1)
+	return times
+}
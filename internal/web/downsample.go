@@ -0,0 +1,48 @@
+package web
+
+import "math"
+
+// downsampleLTTB reduces points to at most threshold with the
+// largest-triangle-three-buckets algorithm: the first and last points are
+// kept, and from each bucket in between the point forming the largest
+// triangle with the previously kept point and the next bucket's average.
+// Peaks and dips survive, unlike with averaging or striding. value picks
+// the series the shape is taken from.
+func downsampleLTTB(points []TrafficDataPoint, threshold int, value func(TrafficDataPoint) float64) []TrafficDataPoint {
+	if threshold < 3 || len(points) <= threshold {
+		return points
+	}
+	x := func(i int) float64 { return float64(points[i].Timestamp.Unix()) }
+
+	sampled := make([]TrafficDataPoint, 0, threshold)
+	sampled = append(sampled, points[0])
+	every := float64(len(points)-2) / float64(threshold-2)
+	kept := 0
+	for b := 0; b < threshold-2; b++ {
+		start := int(float64(b)*every) + 1
+		end := min(int(float64(b+1)*every)+1, len(points)-1)
+
+		// Average of the next bucket, or the last point for the final one
+		nextStart, nextEnd := end, min(int(float64(b+2)*every)+1, len(points))
+		var avgX, avgY float64
+		for i := nextStart; i < nextEnd; i++ {
+			avgX += x(i)
+			avgY += value(points[i])
+		}
+		if n := float64(nextEnd - nextStart); n > 0 {
+			avgX, avgY = avgX/n, avgY/n
+		}
+
+		ax, ay := x(kept), value(points[kept])
+		best, bestArea := start, -1.0
+		for i := start; i < end; i++ {
+			area := math.Abs((ax-avgX)*(value(points[i])-ay) - (ax-x(i))*(avgY-ay))
+			if area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+		sampled = append(sampled, points[best])
+		kept = best
+	}
+	return append(sampled, points[len(points)-1])
+}
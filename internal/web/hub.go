@@ -3,7 +3,10 @@ package web
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"reflect"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,6 +21,8 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for development
 	},
+	// Preferred first when a client offers both
+	Subprotocols: []string{msgpackProtocol, jsonProtocol},
 }
 
 // Client represents a WebSocket client connection
@@ -25,6 +30,20 @@ type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
+	// Messages are sent as MessagePack in binary frames instead of JSON
+	binary bool
+	// While history is replayed, live messages wait in pending
+	mu        sync.Mutex
+	replaying bool
+	pending   [][]byte
+	overflow  bool
+	closed    bool // send is closed; guarded by the hub mutex
+}
+
+// replayRequest selects the stored events sent before live ones
+type replayRequest struct {
+	since   time.Time // events from this time on
+	afterID uint      // or events after this ID, to resume after a reconnect
 }
 
 // Hub maintains the set of active clients and broadcasts messages
@@ -37,10 +56,39 @@ type Hub struct {
 	logger       *log.Logger
 	db           *database.DB
 	lastEventID  uint
+	pollHorizon  uint // highest ID at the previous poll
 	pollInterval time.Duration
 	stopChan     chan struct{}
+	// IDs of events pushed by this process, which the poller skips: it
+	// only picks up events stored by other processes (e.g. merge)
+	pushed    map[uint]struct{}
+	pushedMux sync.Mutex
+	// Last published fields per flow, so later events of the same
+	// connection are sent as in-place updates instead of new rows
+	flows    map[string]*flowState
+	flowsMux sync.Mutex
+}
+
+// flowState is what live clients currently show for one flow
+type flowState struct {
+	fields   map[string]interface{}
+	lastSeen time.Time
 }
 
+const (
+	maxTrackedFlows = 10000
+	flowStateTTL    = 10 * time.Minute
+	// Rows the poller looks past per poll, and most events it publishes
+	pollScanLimit    = 5000
+	pollPublishLimit = 100
+	maxPushedIDs     = 100000
+	// Limits of the history replayed to a connecting client
+	maxReplayWindow  = 24 * time.Hour
+	maxReplayEvents  = 20000
+	maxReplayPending = 10000 // live messages held during a replay
+	replayPageSize   = 500
+)
+
 // NewHub creates a new WebSocket hub
 func NewHub(logger *log.Logger, db *database.DB) *Hub {
 	hub := &Hub{
@@ -52,6 +100,8 @@ func NewHub(logger *log.Logger, db *database.DB) *Hub {
 		db:           db,
 		pollInterval: 2 * time.Second,
 		stopChan:     make(chan struct{}),
+		flows:        make(map[string]*flowState),
+		pushed:       make(map[uint]struct{}),
 	}
 	// Register as the global event publisher
 	database.SetEventPublisher(hub)
@@ -60,7 +110,7 @@ func NewHub(logger *log.Logger, db *database.DB) *Hub {
 	if db != nil {
 		var maxID uint
 		if err := db.Raw("SELECT COALESCE(MAX(id), 0) FROM network_events").Scan(&maxID).Error; err == nil {
-			hub.lastEventID = maxID
+			hub.lastEventID, hub.pollHorizon = maxID, maxID
 			hub.logger.Debug("[WS] Initialized lastEventID", "id", maxID)
 		}
 	}
@@ -84,6 +134,7 @@ func (h *Hub) Run() {
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
+				client.closed = true
 			}
 			clientCount := len(h.clients)
 			h.mutex.Unlock()
@@ -91,9 +142,25 @@ func (h *Hub) Run() {
 
 		case message := <-h.broadcast:
 			h.mutex.RLock()
+			// Encoded once for all binary clients, on first use
+			var packed []byte
 			for client := range h.clients {
+				data := message
+				if client.binary {
+					if packed == nil {
+						var err error
+						if packed, err = jsonToMsgpack(message); err != nil {
+							h.logger.Error("[WS] MessagePack encoding failed", "error", err)
+							continue
+						}
+					}
+					data = packed
+				}
+				if client.hold(data) {
+					continue
+				}
 				select {
-				case client.send <- message:
+				case client.send <- data:
 				default:
 					// Client buffer full, disconnect
 					close(client.send)
@@ -119,7 +186,7 @@ func (h *Hub) StartPolling() {
 		return
 	}
 	go h.pollLoop()
-	h.logger.Info("[WS] Database polling started", "interval", h.pollInterval)
+	h.logger.Info("[WS] Database polling started for external writers", "interval", h.pollInterval)
 }
 
 // StopPolling stops the database polling goroutine
@@ -127,7 +194,8 @@ func (h *Hub) StopPolling() {
 	close(h.stopChan)
 }
 
-// pollLoop periodically checks for new events in the database
+// pollLoop periodically checks for events other processes stored in the
+// database. Events written by this process are pushed directly.
 func (h *Hub) pollLoop() {
 	ticker := time.NewTicker(h.pollInterval)
 	defer ticker.Stop()
@@ -139,53 +207,149 @@ func (h *Hub) pollLoop() {
 			return
 		case <-ticker.C:
 			if h.ClientCount() == 0 {
-				continue // No clients, skip polling
+				h.skipToLatest() // Nobody to catch up once a client connects
+				continue
 			}
 			h.pollNewEvents()
 		}
 	}
 }
 
-// pollNewEvents queries the database for events newer than lastEventID
+// skipToLatest moves the poller past all stored events
+func (h *Hub) skipToLatest() {
+	var maxID uint
+	if err := h.db.Raw("SELECT COALESCE(MAX(id), 0) FROM network_events").Scan(&maxID).Error; err != nil {
+		return
+	}
+	h.lastEventID, h.pollHorizon = maxID, maxID
+	h.pushedMux.Lock()
+	clear(h.pushed)
+	h.pushedMux.Unlock()
+}
+
+// pollNewEvents publishes events newer than lastEventID that were not
+// pushed by this process. Only rows already seen by the previous poll are
+// considered, so the writer has had time to push its own.
 func (h *Hub) pollNewEvents() {
-	var events []database.NetworkEvent
-	result := h.db.Where("id > ?", h.lastEventID).Order("id ASC").Limit(100).Find(&events)
+	var ids []uint
+	result := h.db.Model(&database.NetworkEvent{}).Where("id > ? AND id <= ?", h.lastEventID, h.pollHorizon).
+		Order("id ASC").Limit(pollScanLimit).Pluck("id", &ids)
 	if result.Error != nil {
 		h.logger.Error("[WS] Failed to poll events", "error", result.Error)
 		return
 	}
+	h.db.Raw("SELECT COALESCE(MAX(id), 0) FROM network_events").Scan(&h.pollHorizon)
+
+	var external []uint
+	h.pushedMux.Lock()
+	for _, id := range ids {
+		h.lastEventID = id
+		if _, ok := h.pushed[id]; ok {
+			delete(h.pushed, id)
+			continue
+		}
+		external = append(external, id)
+		if len(external) == pollPublishLimit {
+			break
+		}
+	}
+	h.pushedMux.Unlock()
+	if len(external) == 0 {
+		return
+	}
 
-	if len(events) == 0 {
+	var events []database.NetworkEvent
+	if err := h.db.Where("id IN ?", external).Order("id ASC").Find(&events).Error; err != nil {
+		h.logger.Error("[WS] Failed to poll events", "error", err)
 		return
 	}
+	h.logger.Debug("[WS] Polled events from external writers", "count", len(events), "to_id", h.lastEventID)
+	h.broadcastEvents(events)
+}
 
-	h.logger.Debug("[WS] Polled new events", "count", len(events), "from_id", h.lastEventID)
+// PublishEvents sends freshly stored events to all connected clients as
+// one batch, and keeps the poller from sending them again.
+// Implements database.BatchPublisher interface
+func (h *Hub) PublishEvents(events []database.NetworkEvent) {
+	if h.ClientCount() == 0 {
+		return
+	}
+	h.pushedMux.Lock()
+	if len(h.pushed) > maxPushedIDs {
+		clear(h.pushed) // poller is far behind; at worst events are sent twice
+	}
+	for i := range events {
+		if events[i].ID != 0 {
+			h.pushed[events[i].ID] = struct{}{}
+		}
+	}
+	h.pushedMux.Unlock()
+	h.broadcastEvents(events)
+}
 
-	for _, event := range events {
-		h.PublishEvent(&event)
-		if event.ID > h.lastEventID {
-			h.lastEventID = event.ID
+// broadcastEvents sends events as newline-separated messages in a single
+// broadcast, which clients split like the batches of writePump
+func (h *Hub) broadcastEvents(events []database.NetworkEvent) {
+	var batch []byte
+	for i := range events {
+		data, ok := h.encodeEvent(&events[i])
+		if !ok {
+			continue
 		}
+		if len(batch) > 0 {
+			batch = append(batch, '\n')
+		}
+		batch = append(batch, data...)
+	}
+	if len(batch) > 0 {
+		h.send(batch)
 	}
 }
 
-// PublishEvent sends an event to all connected clients
+// PublishEvent sends an event to all connected clients. Events belonging to
+// a flow that was already published are sent as an "update" message holding
+// only the fields that changed, keyed by flow ID.
 // Implements database.EventPublisher interface
 func (h *Hub) PublishEvent(event interface{}) {
 	if h.ClientCount() == 0 {
 		return
 	}
+	if data, ok := h.encodeEvent(event); ok {
+		h.send(data)
+	}
+}
 
-	data, err := json.Marshal(map[string]interface{}{
+// encodeEvent builds the message for one event; ok is false when there is
+// nothing to send
+func (h *Hub) encodeEvent(event interface{}) (data []byte, ok bool) {
+	message := map[string]interface{}{
 		"type":      "event",
 		"data":      event,
 		"timestamp": time.Now().UnixMilli(),
-	})
+	}
+	if e, ok := event.(*database.NetworkEvent); ok && e.FlowID != "" {
+		changed, isUpdate := h.diffFlow(e)
+		if isUpdate {
+			if len(changed) == 0 {
+				return nil, false // already published
+			}
+			message["type"] = "update"
+			message["flowId"] = e.FlowID
+			message["id"] = e.ID
+			message["data"] = changed
+		}
+	}
+
+	data, err := json.Marshal(message)
 	if err != nil {
 		h.logger.Error("Failed to marshal event for broadcast", "error", err)
-		return
+		return nil, false
 	}
+	return data, true
+}
 
+// send queues a message for all clients
+func (h *Hub) send(data []byte) {
 	select {
 	case h.broadcast <- data:
 	default:
@@ -193,8 +357,75 @@ func (h *Hub) PublishEvent(event interface{}) {
 	}
 }
 
-// ServeWs handles WebSocket requests from clients
+// diffFlow records the event as the flow's current state and returns the
+// fields that differ from what was last published. isUpdate is false for
+// the first event of a flow.
+func (h *Hub) diffFlow(event *database.NetworkEvent) (changed map[string]interface{}, isUpdate bool) {
+	fields, err := eventFields(event)
+	if err != nil {
+		return nil, false
+	}
+	delete(fields, "ID") // the row being updated keeps its own ID
+
+	h.flowsMux.Lock()
+	defer h.flowsMux.Unlock()
+
+	now := time.Now()
+	state, exists := h.flows[event.FlowID]
+	if !exists {
+		if len(h.flows) >= maxTrackedFlows {
+			h.pruneFlows(now)
+			if len(h.flows) >= maxTrackedFlows {
+				h.flows = make(map[string]*flowState)
+			}
+		}
+		h.flows[event.FlowID] = &flowState{fields: fields, lastSeen: now}
+		return nil, false
+	}
+
+	changed = make(map[string]interface{})
+	for k, v := range fields {
+		if prev, ok := state.fields[k]; !ok || !reflect.DeepEqual(prev, v) {
+			changed[k] = v
+		}
+	}
+	state.fields = fields
+	state.lastSeen = now
+	return changed, true
+}
+
+// pruneFlows drops flow state not touched within flowStateTTL
+func (h *Hub) pruneFlows(now time.Time) {
+	for id, state := range h.flows {
+		if now.Sub(state.lastSeen) > flowStateTTL {
+			delete(h.flows, id)
+		}
+	}
+}
+
+// eventFields returns the event as its JSON field map
+func eventFields(event *database.NetworkEvent) (map[string]interface{}, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// ServeWs handles WebSocket requests from clients. With replay=10m (or a
+// number of minutes) the client first receives the events stored in that
+// window, with afterId=N those stored after event N, then a "replayed"
+// message and live events from there on. Clients asking for the
+// netwatcher.msgpack subprotocol receive MessagePack instead of JSON.
 func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
+	replay, err := parseReplay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.logger.Error("WebSocket upgrade failed", "error", err)
@@ -202,9 +433,11 @@ func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		hub:  h,
-		conn: conn,
-		send: make(chan []byte, 256),
+		hub:       h,
+		conn:      conn,
+		send:      make(chan []byte, 256),
+		binary:    conn.Subprotocol() == msgpackProtocol,
+		replaying: replay != nil,
 	}
 
 	h.register <- client
@@ -212,6 +445,164 @@ func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
 	// Start goroutines for reading and writing
 	go client.writePump()
 	go client.readPump()
+	if replay != nil {
+		go h.replay(client, *replay)
+	}
+}
+
+// parseReplay reads the replay and afterId parameters of a connection
+func parseReplay(r *http.Request) (*replayRequest, error) {
+	query := r.URL.Query()
+	if value := query.Get("afterId"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid afterId %q", value)
+		}
+		return &replayRequest{afterID: uint(id), since: time.Now().Add(-maxReplayWindow)}, nil
+	}
+	value := query.Get("replay")
+	if value == "" {
+		return nil, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil {
+		minutes, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return nil, fmt.Errorf("invalid replay %q, expected minutes or a duration like 15m", value)
+		}
+		window = time.Duration(minutes) * time.Minute
+	}
+	if window <= 0 || window > maxReplayWindow {
+		return nil, fmt.Errorf("replay must be between 1m and %s", maxReplayWindow)
+	}
+	return &replayRequest{since: time.Now().Add(-window)}, nil
+}
+
+// hold keeps a live message back while the client is replaying; it
+// reports whether it did
+func (c *Client) hold(message []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.replaying {
+		return false
+	}
+	if len(c.pending) < maxReplayPending {
+		c.pending = append(c.pending, message)
+	} else {
+		c.overflow = true
+	}
+	return true
+}
+
+// replay sends stored events to one client in ID order, then the live
+// messages held meanwhile, and switches it to live mode. Later events of a
+// flow are sent as updates of its first, like live ones.
+func (h *Hub) replay(c *Client, req replayRequest) {
+	var last uint
+	h.db.Raw("SELECT COALESCE(MAX(id), 0) FROM network_events").Scan(&last)
+
+	sent := 0
+	flows := make(map[string]bool)
+	cursor := req.afterID
+	closed := false
+	for sent < maxReplayEvents && !closed {
+		var events []database.NetworkEvent
+		err := h.db.Where("id > ? AND id <= ? AND timestamp >= ? AND event_type != ?", cursor, last, req.since, database.EventHourlySummary).
+			Order("id ASC").Limit(min(replayPageSize, maxReplayEvents-sent)).Find(&events).Error
+		if err != nil {
+			h.logger.Error("[WS] Replay failed", "error", err)
+			break
+		}
+		for i := range events {
+			e := &events[i]
+			message := map[string]interface{}{"type": "event", "data": e, "replay": true}
+			if e.FlowID != "" && flows[e.FlowID] {
+				if fields, err := eventFields(e); err == nil {
+					delete(fields, "ID")
+					message = map[string]interface{}{"type": "update", "flowId": e.FlowID, "id": e.ID, "data": fields, "replay": true}
+				}
+			}
+			if e.FlowID != "" {
+				flows[e.FlowID] = true
+			}
+			if !c.deliver(message) {
+				closed = true
+				break
+			}
+		}
+		sent += len(events)
+		if len(events) < replayPageSize {
+			break
+		}
+		cursor = events[len(events)-1].ID
+	}
+
+	c.mu.Lock()
+	overflow := c.overflow
+	c.mu.Unlock()
+	if !closed {
+		closed = !c.deliver(map[string]interface{}{
+			"type": "replayed", "count": sent, "truncated": sent >= maxReplayEvents || overflow,
+			"timestamp": time.Now().UnixMilli(),
+		})
+	}
+
+	// Send the live messages held meanwhile until none are left, then let
+	// the hub deliver directly
+	held := 0
+	for {
+		c.mu.Lock()
+		pending := c.pending
+		c.pending = nil
+		if len(pending) == 0 || closed {
+			c.replaying = false
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+		for _, message := range pending {
+			if closed = !c.deliverRaw(message); closed {
+				break
+			}
+		}
+		held += len(pending)
+	}
+	h.logger.Debug("[WS] Replay done", "events", sent, "held", held, "overflow", overflow)
+}
+
+// deliver sends a message to one client, waiting for room in its buffer.
+// It returns false once the client is gone.
+func (c *Client) deliver(message map[string]interface{}) bool {
+	data, err := json.Marshal(message)
+	if err == nil && c.binary {
+		data, err = jsonToMsgpack(data)
+	}
+	if err != nil {
+		return true
+	}
+	return c.deliverRaw(data)
+}
+
+// deliverRaw is deliver for a message encoded for the client. The hub only closes the
+// send channel of a replaying client on unregister, under its write lock.
+func (c *Client) deliverRaw(data []byte) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		c.hub.mutex.RLock()
+		if c.closed {
+			c.hub.mutex.RUnlock()
+			return false
+		}
+		select {
+		case c.send <- data:
+			c.hub.mutex.RUnlock()
+			return true
+		default:
+		}
+		c.hub.mutex.RUnlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
 }
 
 // readPump pumps messages from the WebSocket connection to the hub
@@ -256,7 +647,12 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			frame, separator := websocket.TextMessage, []byte("\n")
+			if c.binary {
+				// MessagePack values delimit themselves
+				frame, separator = websocket.BinaryMessage, nil
+			}
+			w, err := c.conn.NextWriter(frame)
 			if err != nil {
 				return
 			}
@@ -265,7 +661,7 @@ func (c *Client) writePump() {
 			// Batch pending messages
 			n := len(c.send)
 			for i := 0; i < n; i++ {
-				_, _ = w.Write([]byte("\n"))
+				_, _ = w.Write(separator)
 				_, _ = w.Write(<-c.send)
 			}
 
@@ -0,0 +1,295 @@
+package web
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/abja/net-watcher/internal/enrich"
+	"github.com/abja/net-watcher/pkg/watcher"
+)
+
+const (
+	// maxIngestBatch is the most events accepted per request
+	maxIngestBatch = 5000
+	// maxIngestBody bounds the request body
+	maxIngestBody = 32 << 20
+	// maxIngestSkew is how far in the future an event timestamp may be
+	maxIngestSkew = 5 * time.Minute
+)
+
+// ingestEventTypes lists the event types external sensors may send
+var ingestEventTypes = map[database.EventType]bool{
+	database.EventTCPStart: true, database.EventTCPEnd: true,
+	database.EventUDPStart: true, database.EventUDPEnd: true,
+	database.EventTCP: true, database.EventUDP: true,
+	database.EventDNS: true, database.EventTLSSNI: true,
+	database.EventICMP: true, database.EventTimeout: true,
+	database.EventVPN: true, database.EventRemoteAccess: true,
+	database.EventFileShare: true, database.EventNTP: true,
+}
+
+// IngestRequest is the body of POST /api/ingest. A bare array of events,
+// or a single event, is accepted too, with the sensor named by the sensor
+// query parameter or the X-Sensor header; that suits router scripts and
+// Home Assistant's rest_command, which template one event at a time.
+type IngestRequest struct {
+	Sensor string                  `json:"sensor"` // name of the sending sensor, stored on every event; must be the client certificate's CN when there is one
+	Events []database.NetworkEvent `json:"events"`
+}
+
+// IngestRejection explains why one event of a batch was not stored
+type IngestRejection struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// IngestResponse reports what happened to an ingested batch
+type IngestResponse struct {
+	Accepted   int               `json:"accepted"`
+	Duplicates int               `json:"duplicates"`
+	Rejected   []IngestRejection `json:"rejected,omitempty"`
+}
+
+// IngestPipeline is the capture pipeline ingested events go through when
+// the daemon captures too, so they get the enrichment, scan detection,
+// event store and sinks of captured events
+type IngestPipeline interface {
+	EnrichIngested(events []database.NetworkEvent)
+	StoreIngested(events []database.NetworkEvent) (stored []database.NetworkEvent, duplicates int, err error)
+}
+
+// SetIngestPipeline routes ingested events through the capture's pipeline
+// instead of writing them to the database directly
+func (s *Server) SetIngestPipeline(p IngestPipeline) {
+	s.ingestPipeline = p
+}
+
+// SetIngestToken enables POST /api/ingest for clients sending
+// "Authorization: Bearer <token>"; an empty token disables it
+func (s *Server) SetIngestToken(token string) {
+	s.ingestToken = token
+}
+
+// SetIngestDedup drops ingested events that another sensor, or this host's
+// own capture, stored within window of them; for HA pairs seeing the same
+// traffic during failover. Zero disables it.
+func (s *Server) SetIngestDedup(window time.Duration) {
+	s.ingestDedup = window
+}
+
+// SetIngestPrivacy rewrites the names of ingested events by privacy mode
+// before they are stored, so sensors without it keep no history here
+// either. With SetIngestPipeline the pipeline's enrichers do this instead.
+func (s *Server) SetIngestPrivacy(p enrich.Enricher) {
+	s.ingestPrivacy = p
+}
+
+// handleIngest stores events sent by external sensors. Invalid events are
+// rejected individually and events already stored (same content hash) are
+// skipped, so a sensor can safely retry a batch. With SetIngestDedup, events
+// other sensors already recorded are skipped too.
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if s.ingestToken == "" && s.clientCAs == nil {
+		http.Error(w, "ingestion is disabled (start with --ingest-token or --tls-client-ca)", http.StatusNotFound)
+		return
+	}
+	var certName string
+	if s.clientCAs != nil {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "a client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		certName = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if s.ingestToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.ingestToken)) != 1 {
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	req, err := decodeIngestBody(http.MaxBytesReader(w, r.Body, maxIngestBody))
+	if err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) > maxIngestBatch {
+		http.Error(w, fmt.Sprintf("at most %d events per request", maxIngestBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+	claimed := []string{req.Sensor, r.URL.Query().Get("sensor"), r.Header.Get("X-Sensor")}
+	if certName != "" {
+		// A verified certificate names the sensor; it may not speak for another
+		for _, name := range claimed {
+			if name != "" && name != certName {
+				http.Error(w, fmt.Sprintf("sensor %q does not match the client certificate (%q)", name, certName), http.StatusForbidden)
+				return
+			}
+		}
+		req.Sensor = certName
+	} else {
+		for _, name := range claimed {
+			if req.Sensor == "" {
+				req.Sensor = name
+			}
+		}
+	}
+	if req.Sensor == "" {
+		http.Error(w, "sensor must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	var resp IngestResponse
+	valid := make([]database.NetworkEvent, 0, len(req.Events))
+	now := time.Now()
+	for i := range req.Events {
+		e := req.Events[i]
+		if err := validateIngestEvent(&e, now); err != nil {
+			resp.Rejected = append(resp.Rejected, IngestRejection{Index: i, Error: err.Error()})
+			continue
+		}
+		e.Sensor = req.Sensor
+		// Storage metadata is ours to assign
+		e.CaptureFile, e.CaptureFrame, e.Hash = "", 0, ""
+		if s.ingestPipeline == nil && s.ingestPrivacy != nil {
+			s.ingestPrivacy.Enrich(&e)
+		}
+		valid = append(valid, e)
+	}
+	// Before deduplication, which compares names privacy mode rewrites
+	if s.ingestPipeline != nil {
+		s.ingestPipeline.EnrichIngested(valid)
+	}
+
+	if s.ingestDedup > 0 && len(valid) > 0 {
+		seen, err := s.db.SeenByOtherSensor(valid, req.Sensor, s.ingestDedup)
+		if err != nil {
+			s.logger.Error("Failed to deduplicate ingested events", "sensor", req.Sensor, "error", err)
+			http.Error(w, "failed to store events", http.StatusInternalServerError)
+			return
+		}
+		fresh := valid[:0]
+		for i, e := range valid {
+			if seen[i] {
+				resp.Duplicates++
+				continue
+			}
+			fresh = append(fresh, e)
+		}
+		valid = fresh
+	}
+
+	if len(valid) > 0 && s.ingestPipeline != nil {
+		stored, duplicates, err := s.ingestPipeline.StoreIngested(valid)
+		if errors.Is(err, watcher.ErrStopped) {
+			// Shutting down; the sensor retries the batch later
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			s.logger.Error("Failed to store ingested events", "sensor", req.Sensor, "error", err)
+			http.Error(w, "failed to store events", http.StatusInternalServerError)
+			return
+		}
+		resp.Accepted = len(stored)
+		resp.Duplicates += duplicates
+	} else if len(valid) > 0 {
+		accepted, duplicates, err := s.db.InsertUnique(valid)
+		if err != nil {
+			s.logger.Error("Failed to store ingested events", "sensor", req.Sensor, "error", err)
+			http.Error(w, "failed to store events", http.StatusInternalServerError)
+			return
+		}
+		resp.Accepted = accepted
+		resp.Duplicates += duplicates
+		stored := valid[:0]
+		for _, e := range valid {
+			if e.ID != 0 {
+				stored = append(stored, e)
+			}
+		}
+		database.PublishEvents(stored)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// decodeIngestBody reads an IngestRequest, a bare array of events or a
+// single event. Unknown fields are rejected, catching misspelt names.
+func decodeIngestBody(r io.Reader) (IngestRequest, error) {
+	var req IngestRequest
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return req, err
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return req, fmt.Errorf("empty body")
+	}
+	strict := func(v any) error {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+	}
+	if body[0] == '[' {
+		return req, strict(&req.Events)
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return req, err
+	}
+	for key := range keys {
+		// Field names match case-insensitively, as encoding/json does
+		if strings.EqualFold(key, "events") || strings.EqualFold(key, "sensor") {
+			return req, strict(&req)
+		}
+	}
+	req.Events = make([]database.NetworkEvent, 1)
+	return req, strict(&req.Events[0])
+}
+
+// validateIngestEvent checks an event against the schema the daemon
+// itself writes
+func validateIngestEvent(e *database.NetworkEvent, now time.Time) error {
+	switch {
+	case e.Timestamp.IsZero():
+		return fmt.Errorf("Timestamp is required")
+	case e.Timestamp.After(now.Add(maxIngestSkew)):
+		return fmt.Errorf("Timestamp %s is in the future", e.Timestamp.Format(time.RFC3339))
+	case !ingestEventTypes[e.EventType]:
+		return fmt.Errorf("unsupported EventType %q", e.EventType)
+	case e.IPVersion != 0 && e.IPVersion != 4 && e.IPVersion != 6:
+		return fmt.Errorf("IPVersion must be 4 or 6")
+	case e.SrcIP == "" || e.DstIP == "":
+		return fmt.Errorf("SrcIP and DstIP are required")
+	case net.ParseIP(e.SrcIP) == nil:
+		return fmt.Errorf("invalid SrcIP %q", e.SrcIP)
+	case net.ParseIP(e.DstIP) == nil:
+		return fmt.Errorf("invalid DstIP %q", e.DstIP)
+	case e.Duration < 0 || e.ByteCount < 0:
+		return fmt.Errorf("Duration and ByteCount must not be negative")
+	}
+	if e.EventType == database.EventDNS {
+		switch e.DNSType {
+		case "QUERY", "RESPONSE", "COMPLETE":
+		default:
+			return fmt.Errorf("DNSType must be QUERY, RESPONSE or COMPLETE")
+		}
+		if e.DNSQuery == "" {
+			return fmt.Errorf("DNSQuery is required for DNS events")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/abja/net-watcher/internal/scheduler"
+)
+
+// SetScheduler exposes the daemon's periodic jobs through /api/jobs
+func (s *Server) SetScheduler(jobs *scheduler.Scheduler) {
+	s.jobs = jobs
+}
+
+// handleJobs lists the periodic jobs with their last and next runs
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := []scheduler.Status{}
+	if s.jobs != nil {
+		jobs = s.jobs.Jobs()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobs})
+}
+
+// handleJobRun runs a job now, outside its schedule
+func (s *Server) handleJobRun(w http.ResponseWriter, r *http.Request) {
+	if s.jobs == nil {
+		http.Error(w, "no scheduled jobs", http.StatusNotFound)
+		return
+	}
+	name := r.PathValue("name")
+	switch err := s.jobs.Trigger(name); {
+	case errors.Is(err, scheduler.ErrUnknownJob):
+		http.Error(w, "unknown job "+name, http.StatusNotFound)
+		return
+	case errors.Is(err, scheduler.ErrRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.logger.Info("[SCHEDULER] Job triggered", "job", name, "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"job": name, "status": "triggered"})
+}
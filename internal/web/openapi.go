@@ -0,0 +1,234 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/abja/net-watcher/internal/openapi"
+	"github.com/abja/net-watcher/internal/scheduler"
+	"github.com/abja/net-watcher/pkg/watcher"
+)
+
+// timeRangeParams are the start and end parameters of parseTimeRange
+var timeRangeParams = []openapi.Param{
+	{Name: "start", Type: "string", Description: "Start of the range, RFC 3339 or YYYY-MM-DD (default: 24 hours ago)"},
+	{Name: "end", Type: "string", Description: "End of the range, RFC 3339 or YYYY-MM-DD (default: now)"},
+}
+
+var topHostsParams = []openapi.Param{
+	{Name: "limit", Type: "integer", Description: "Hosts returned, 1-100 (default: 10)"},
+	{Name: "metric", Type: "string", Description: "Rank by event count or bytes", Enum: []string{"events", "traffic"}},
+	{Name: "type", Type: "string", Description: "Group by hostname, source or destination IP", Enum: []string{"hostname", "srcIP", "dstIP"}},
+	{Name: "start", Type: "string", Description: "Start of the range, RFC 3339 or YYYY-MM-DD (default: all events, or 24 hours for sparklines)"},
+	{Name: "end", Type: "string", Description: "End of the range, RFC 3339 or YYYY-MM-DD (default: now)"},
+	{Name: "interface", Type: "string", Description: "Only events captured on this interface"},
+	{Name: "direction", Type: "string", Description: "Only events sent by local hosts (out) or from outside (in)", Enum: []string{"in", "out"}},
+	{Name: "eventType", Type: "string", Description: "Only these event types, comma-separated"},
+	{Name: "sparkline", Type: "boolean", Description: "Add hourly values per host over the range (default range: 24 hours)"},
+}
+
+// timelineParams are the parameters of trafficTimeline
+func timelineParams() []openapi.Param {
+	buckets := make([]string, len(timelineBuckets))
+	for i, b := range timelineBuckets {
+		buckets[i] = b.label
+	}
+	return append(timeRangeParams[:len(timeRangeParams):len(timeRangeParams)],
+		openapi.Param{Name: "bucket", Type: "string", Description: "Finest bucket size wanted", Enum: buckets},
+		openapi.Param{Name: "points", Type: "integer", Description: "Most data points returned, at least 10"},
+		openapi.Param{Name: "metric", Type: "string", Description: "Series whose shape downsampling preserves", Enum: []string{"bytes", "events"}},
+		openapi.Param{Name: "groupBy", Type: "string", Description: "Add a series per host, protocol or interface", Enum: TimelineGroups},
+		openapi.Param{Name: "series", Type: "integer", Description: "Hosts or interfaces with a series, 1-50, the rest summed as other (default: 10)"},
+	)
+}
+
+// eventsParams are the paging and filter parameters of /api/events
+func eventsParams() []openapi.Param {
+	params := []openapi.Param{
+		{Name: "pageSize", Type: "integer", Description: "Events per page, 1-100 (default: 20)"},
+		{Name: "cursor", Type: "string", Description: "nextCursor or prevCursor of the previous page"},
+		{Name: "direction", Type: "string", Description: "prev pages backwards from cursor", Enum: []string{"next", "prev"}},
+		{Name: "sort", Type: "string", Description: "Order by time or by anomaly score", Enum: []string{"time", "score"}},
+	}
+	for _, name := range database.FilterParams {
+		p := openapi.Param{Name: name, Type: "string"}
+		if name == "query" {
+			p.Description = "Filter expression, e.g. dst_port=443 AND threat=true"
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// APIDocument describes the REST API as an OpenAPI document, from the
+// routes registered in Start and the types their handlers encode
+func APIDocument(version string) *openapi.Document {
+	b := openapi.NewBuilder()
+	b.Define("JobStatus", scheduler.Status{})
+	eventList := []database.NetworkEvent{}
+	reportList := b.Define("ReportList", struct {
+		Reports []ReportJob `json:"reports"`
+	}{})
+	viewList := b.Define("ViewList", struct {
+		Views []database.SavedView `json:"views"`
+	}{})
+	jobList := b.Define("JobList", struct {
+		Jobs []scheduler.Status `json:"jobs"`
+	}{})
+	jobRun := b.Define("JobRun", struct {
+		Job    string `json:"job"`
+		Status string `json:"status"`
+	}{})
+	activeConnections := b.Define("ActiveConnections", struct {
+		Connections []watcher.ActiveSession `json:"connections"`
+		Total       int                     `json:"total"`
+	}{})
+	id := []openapi.Param{{Name: "id", Type: "integer"}}
+
+	routes := []openapi.Route{
+		{Method: "GET", Path: "/api/events", ID: "listEvents", Tag: "events", Summary: "Lists events, newest first, one page at a time",
+			Description: "With format=ndjson up to limit events are streamed instead, one JSON object per line, " +
+				"and the X-Next-Cursor trailer continues after them.",
+			Params: eventsParams(), Response: EventsResponse{}},
+		{Method: "GET", Path: "/api/events/{id}/originals", ID: "getEventOriginals", Tag: "events",
+			Summary: "Returns the events a compacted record was merged from", Params: id, Response: eventList},
+		{Method: "POST", Path: "/api/purge", ID: "purgeEvents", Tag: "events",
+			Summary: "Deletes the events matching every criterion given",
+			Description: "For data deletion requests: side-table rows and archived originals of the events go too, and the space freed is reported. " +
+				"Only served with an admin API token configured; the body must be application/json.",
+			Body: PurgeRequest{}, Response: database.PurgeStats{}},
+		{Method: "GET", Path: "/api/event-types", ID: "listEventTypes", Tag: "events",
+			Summary: "Lists the event types stored", Response: []string{}},
+		{Method: "GET", Path: "/api/stats", ID: "getStats", Tag: "events",
+			Summary: "Returns the number of events by type and their time span", Response: StatsResponse{}},
+		{Method: "GET", Path: "/api/version", ID: "getVersion", Tag: "server",
+			Summary: "Returns the server version", Response: VersionResponse{}},
+		{Method: "GET", Path: "/api/openapi.json", ID: "getOpenAPI", Tag: "server",
+			Summary: "Returns this document", Response: map[string]any{}},
+		{Method: "GET", Path: "/api/top-hosts", ID: "getTopHosts", Tag: "traffic",
+			Summary: "Ranks hosts by events or traffic", Params: topHostsParams, Response: TopHostsResponse{}},
+		{Method: "GET", Path: "/api/traffic-timeline", ID: "getTrafficTimeline", Tag: "traffic",
+			Summary: "Returns traffic in and out over time", Params: timelineParams(), Response: TrafficTimelineResponse{}},
+		{Method: "GET", Path: "/api/tls/fingerprints", ID: "listTLSFingerprints", Tag: "traffic",
+			Summary: "Lists TLS client fingerprints with their clients",
+			Params: []openapi.Param{
+				{Name: "limit", Type: "integer", Description: "Fingerprints returned"},
+				{Name: "type", Type: "string", Enum: []string{"ja4", "ja3"}},
+				{Name: "order", Type: "string", Description: "rare lists the least common first", Enum: []string{"common", "rare"}},
+				{Name: "srcIP", Type: "string", Description: "Only fingerprints of this client"},
+			},
+			Response: TLSFingerprintsResponse{}},
+		{Method: "GET", Path: "/api/dns", ID: "getDNSAnalytics", Tag: "traffic",
+			Summary: "Aggregates DNS queries: volume per name, unique subdomains per registered domain, response times and NXDOMAIN rates per client",
+			Params: append(timeRangeParams[:len(timeRangeParams):len(timeRangeParams)],
+				openapi.Param{Name: "limit", Type: "integer", Description: "Entries per list, 1-100 (default: 20)"},
+				openapi.Param{Name: "srcIP", Type: "string", Description: "Only this client's queries"},
+			),
+			Response: DNSResponse{}},
+		{Method: "GET", Path: "/api/destinations/new", ID: "getNewDestinations", Tag: "traffic",
+			Summary: "Lists the domains and remote addresses reached for the first time, or the first time in 30 days",
+			Params: []openapi.Param{
+				{Name: "since", Type: "string", Description: "How far back, e.g. 24h or 7d (default: 24h)"},
+				{Name: "kind", Type: "string", Enum: []string{database.DestinationDomain, database.DestinationIP}},
+				{Name: "limit", Type: "integer", Description: "1-1000 (default: 100)"},
+			},
+			Response: NewDestinationsResponse{}},
+		{Method: "GET", Path: "/api/beacons", ID: "listBeacons", Tag: "traffic",
+			Summary:     "Lists hosts connecting to a remote service at regular intervals with constant sizes",
+			Description: "Beacons are found by the beacons job, over the last 24h every hour by default; run it with POST /api/jobs/beacons/run.",
+			Params: []openapi.Param{
+				{Name: "minScore", Type: "integer", Description: "Lowest score, 0-100 (default: all stored, 70 and up)"},
+				{Name: "srcIP", Type: "string", Description: "Only this host's beacons"},
+				{Name: "limit", Type: "integer", Description: "1-500 (default: 100)"},
+			},
+			Response: BeaconsResponse{}},
+		{Method: "GET", Path: "/api/charts/{file}", ID: "getChart", Tag: "traffic",
+			Summary: "Renders a chart as an image",
+			Description: "file is one of " + strings.Join(ChartTypes, ", ") + " with a .png or .svg extension. " +
+				"The parameters of the matching JSON endpoint apply too.",
+			Params: []openapi.Param{
+				{Name: "file", Type: "string", Description: "Chart and format, e.g. timeline.png"},
+				{Name: "width", Type: "integer"},
+				{Name: "height", Type: "integer"},
+				{Name: "title", Type: "string"},
+			},
+			Content: "image/*"},
+		{Method: "GET", Path: "/api/devices", ID: "listDevices", Tag: "devices",
+			Summary: "Lists devices with their traffic, one page at a time",
+			Params: append(timeRangeParams[:len(timeRangeParams):len(timeRangeParams)],
+				openapi.Param{Name: "page", Type: "integer"},
+				openapi.Param{Name: "pageSize", Type: "integer", Description: "Devices per page, 1-50 (default: 20)"},
+				openapi.Param{Name: "q", Type: "string", Description: "Part of the device address"},
+				openapi.Param{Name: "all", Type: "boolean", Description: "Include non-local sources"},
+				openapi.Param{Name: "sort", Type: "string", Enum: []string{"bytes", "events", "lastSeen"}},
+			),
+			Response: DevicesResponse{}},
+		{Method: "GET", Path: "/api/devices/new-behavior", ID: "getNewBehavior", Tag: "devices",
+			Summary:  "Lists the domains and ports devices contacted for the first time in a week",
+			Params:   []openapi.Param{{Name: "week", Type: "string", Description: "A day of the week, YYYY-MM-DD (default: the last completed week)"}},
+			Response: NewBehaviorResponse{}},
+		{Method: "GET", Path: "/api/reports", ID: "listReports", Tag: "reports",
+			Summary: "Lists report jobs, newest first", Response: reportList},
+		{Method: "POST", Path: "/api/reports", ID: "createReport", Tag: "reports",
+			Summary: "Starts generating a report", Body: ReportRequest{}, Response: ReportJob{}, Status: http.StatusAccepted},
+		{Method: "GET", Path: "/api/reports/{id}", ID: "getReport", Tag: "reports",
+			Summary: "Returns a report job", Response: ReportJob{}},
+		{Method: "GET", Path: "/api/reports/{id}/download", ID: "downloadReport", Tag: "reports",
+			Summary: "Downloads a finished report", Content: "application/octet-stream"},
+		{Method: "GET", Path: "/api/views", ID: "listViews", Tag: "views",
+			Summary: "Lists saved views", Response: viewList},
+		{Method: "POST", Path: "/api/views", ID: "createView", Tag: "views",
+			Summary: "Saves a view", Body: ViewRequest{}, Response: database.SavedView{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/api/views/{id}", ID: "getView", Tag: "views",
+			Summary: "Returns a saved view", Params: id, Response: database.SavedView{}},
+		{Method: "PUT", Path: "/api/views/{id}", ID: "updateView", Tag: "views",
+			Summary: "Replaces a saved view", Params: id, Body: ViewRequest{}, Response: database.SavedView{}},
+		{Method: "DELETE", Path: "/api/views/{id}", ID: "deleteView", Tag: "views",
+			Summary: "Deletes a saved view", Params: id, Status: http.StatusNoContent},
+		{Method: "POST", Path: "/api/ingest", ID: "ingestEvents", Tag: "ingest",
+			Summary: "Stores events sent by an external sensor",
+			Description: "Enabled with --ingest-token or --tls-client-ca. Events already stored are skipped, so a batch can be retried. " +
+				"The body may also be a bare array of events or a single event, with the sensor given by the sensor parameter or an X-Sensor header. " +
+				"With a client certificate, its CN is the sensor and a batch naming another is refused with 403. " +
+				"When the daemon captures too, events get its enrichment, scan detection and sinks.",
+			Body: IngestRequest{}, Response: IngestResponse{}, Auth: true},
+		{Method: "GET", Path: "/api/jobs", ID: "listJobs", Tag: "jobs",
+			Summary: "Lists the periodic jobs with their last and next runs", Response: jobList},
+		{Method: "POST", Path: "/api/jobs/{name}/run", ID: "runJob", Tag: "jobs",
+			Summary: "Runs a job now, outside its schedule", Response: jobRun, Status: http.StatusAccepted},
+		{Method: "GET", Path: "/api/sessions", ID: "getSessionTable", Tag: "sessions",
+			Summary: "Returns the occupancy and limits of the session table", Response: watcher.SessionTable{}},
+		{Method: "GET", Path: "/api/connections/active", ID: "listActiveConnections", Tag: "sessions",
+			Summary: "Lists the connections tracked right now, most recently seen first",
+			Params: []openapi.Param{
+				{Name: "limit", Type: "integer", Description: "Connections returned, 1-1000 (default: 50)"},
+				{Name: "protocol", Type: "string", Description: "Only connections of this protocol, e.g. TCP"},
+			},
+			Response: activeConnections},
+	}
+	return b.Build(openapi.Info{
+		Title:   "net-watcher",
+		Version: version,
+		Description: "REST API of the net-watcher web server. Live events are streamed over a WebSocket at /api/ws, " +
+			"which is not described here. With --api-tokens every request needs a bearer token: viewer tokens " +
+			"may only read (and generate reports), admin tokens may also make changes.",
+	}, routes)
+}
+
+// openapiSpec caches the encoded document, which only changes with the binary
+type openapiSpec struct {
+	once sync.Once
+	data []byte
+}
+
+// handleOpenAPI serves the OpenAPI document of the API
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	s.openapi.once.Do(func() {
+		s.openapi.data, _ = json.MarshalIndent(APIDocument(s.version), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.openapi.data)
+}
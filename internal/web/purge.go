@@ -0,0 +1,65 @@
+package web
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// PurgeRequest is the body of POST /api/purge; events matching every
+// criterion given are deleted
+type PurgeRequest struct {
+	Before string `json:"before"` // events older than this, YYYY-MM-DD or RFC 3339
+	Domain string `json:"domain"` // hostname, DNS query or SNI, e.g. *.example.com
+	IP     string `json:"ip"`     // source, destination or tunnel address
+	DryRun bool   `json:"dryRun"` // only count the matching events
+}
+
+// handlePurge deletes events for data deletion requests (see
+// database.Purge) and reports what went and the space freed. It is only
+// served with an admin token in --api-tokens, which it then requires. The
+// JSON content type keeps web pages from posting to it without a CORS
+// preflight.
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if !s.hasAdminToken() {
+		http.Error(w, "purging is disabled (start with --api-tokens naming an admin token)", http.StatusNotFound)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "the request body must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req PurgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	criteria := database.PurgeCriteria{Domain: req.Domain, IP: req.IP, DryRun: req.DryRun}
+	if req.Before != "" {
+		before, err := database.ParseBefore(req.Before)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		criteria.Before = before
+	}
+	if err := criteria.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := s.db.Purge(r.Context(), criteria)
+	if err != nil {
+		s.logger.Error("[PURGE] Failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !req.DryRun {
+		s.logger.Warn("[PURGE] Events deleted", "before", req.Before, "domain", criteria.Domain, "ip", criteria.IP,
+			"events", stats.Events, "freed", database.FormatBytes(stats.Freed), "remote", r.RemoteAddr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
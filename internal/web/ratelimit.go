@@ -0,0 +1,206 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAPIRateLimit allows each client 10 API requests per second with
+// bursts of 100, enough for the UI loading a page of charts at once
+const DefaultAPIRateLimit = "10:100"
+
+// apiRate is a token bucket's refill rate in requests per second and its
+// capacity; a zero rate is unlimited
+type apiRate struct {
+	rate  float64
+	burst float64
+}
+
+// apiClientRate is the rate of the clients with a token, or from an address
+// range
+type apiClientRate struct {
+	token  string
+	prefix netip.Prefix
+	rate   apiRate
+}
+
+// apiLimiter limits the /api requests of each client with a token bucket.
+// Clients sending a bearer token named in an override are limited per
+// token, the others per address, so made-up tokens get no fresh bucket.
+type apiLimiter struct {
+	fallback apiRate
+	clients  []apiClientRate // first match wins
+	mutex    sync.Mutex
+	buckets  map[string]*apiBucket
+	pruned   time.Time
+}
+
+type apiBucket struct {
+	tokens float64
+	last   time.Time
+	rate   apiRate
+}
+
+// parseAPIRateLimit parses an --api-rate-limit value: requests per second
+// with an optional burst, "10" or "10:100", followed by comma-separated
+// overrides CLIENT=RATE[:BURST], where CLIENT is an IP, a CIDR range or a
+// bearer token. A rate of 0 is unlimited.
+func parseAPIRateLimit(spec string) (*apiLimiter, error) {
+	l := &apiLimiter{buckets: make(map[string]*apiBucket)}
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		client, value, override := strings.Cut(part, "=")
+		if !override {
+			value = client
+		}
+		if i == 0 && override || i > 0 && !override {
+			return nil, fmt.Errorf("invalid API rate limit %q, expected RATE[:BURST] followed by CLIENT=RATE[:BURST] entries", part)
+		}
+		rate, err := parseAPIRate(value)
+		if err != nil {
+			return nil, err
+		}
+		if !override {
+			l.fallback = rate
+			continue
+		}
+		c := apiClientRate{rate: rate}
+		client = strings.TrimSpace(client)
+		if prefix, err := netip.ParsePrefix(client); err == nil {
+			c.prefix = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(client); err == nil {
+			c.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else if client != "" {
+			c.token = client
+		} else {
+			return nil, fmt.Errorf("invalid API rate limit %q: missing client", part)
+		}
+		l.clients = append(l.clients, c)
+	}
+	return l, nil
+}
+
+// ValidateAPIRateLimit checks an --api-rate-limit value
+func ValidateAPIRateLimit(spec string) error {
+	_, err := parseAPIRateLimit(spec)
+	return err
+}
+
+// parseAPIRate parses RATE[:BURST]; the burst defaults to the rate
+func parseAPIRate(value string) (apiRate, error) {
+	rateStr, burstStr, hasBurst := strings.Cut(strings.TrimSpace(value), ":")
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) {
+		return apiRate{}, fmt.Errorf("invalid API request rate %q", rateStr)
+	}
+	r := apiRate{rate: rate, burst: max(rate, 1)}
+	if hasBurst {
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return apiRate{}, fmt.Errorf("invalid API request burst %q", burstStr)
+		}
+		r.burst = float64(burst)
+	}
+	return r, nil
+}
+
+// SetAPIRateLimit limits /api requests per client (see parseAPIRateLimit);
+// an empty spec removes the limit
+func (s *Server) SetAPIRateLimit(spec string) error {
+	if spec == "" {
+		s.apiLimiter = nil
+		return nil
+	}
+	l, err := parseAPIRateLimit(spec)
+	if err != nil {
+		return err
+	}
+	s.apiLimiter = l
+	return nil
+}
+
+// rateLimitMiddleware answers 429 Too Many Requests to API clients over
+// their rate, with Retry-After set to when their next request is allowed
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.apiLimiter != nil && strings.HasPrefix(r.URL.Path, "/api/") {
+			if wait := s.apiLimiter.allow(r); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "API rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow takes a token from the request's client and returns 0, or how
+// long until a token is available if there is none
+func (l *apiLimiter) allow(r *http.Request) time.Duration {
+	key, rate := l.client(r)
+	if rate.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = &apiBucket{tokens: rate.burst, last: now, rate: rate}
+		l.buckets[key] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate.rate, rate.burst)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate.rate * float64(time.Second))
+}
+
+// client identifies the client of a request and its rate
+func (l *apiLimiter) client(r *http.Request) (string, apiRate) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		// Compared in constant time like the auth tokens; the bucket is
+		// keyed by the override, so the token is not kept around
+		for i, c := range l.clients {
+			if c.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+				return "token #" + strconv.Itoa(i), c.rate
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	for _, c := range l.clients {
+		if c.prefix.IsValid() && c.prefix.Contains(addr.Unmap()) {
+			return "ip " + host, c.rate
+		}
+	}
+	return "ip " + host, l.fallback
+}
+
+// prune forgets, once a minute, clients whose bucket has refilled
+func (l *apiLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate.rate >= b.rate.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
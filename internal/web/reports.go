@@ -0,0 +1,294 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/abja/net-watcher/internal/report"
+)
+
+// Report job states
+const (
+	reportPending = "pending"
+	reportRunning = "running"
+	reportDone    = "done"
+	reportFailed  = "failed"
+)
+
+// reportRetention is how long finished reports stay downloadable
+const reportRetention = 24 * time.Hour
+
+// ReportRequest is the body of POST /api/reports
+type ReportRequest struct {
+	Range    string   `json:"range"`    // e.g. 24h, 7d (default: 24h)
+	Format   string   `json:"format"`   // html, json, md or pdf (default: html)
+	Sections []string `json:"sections"` // default: all
+	Limit    int      `json:"limit"`    // maximum rows in the events table
+	Query    string   `json:"query"`    // filter expression, e.g. dst_port=443 AND threat=true
+	View     string   `json:"view"`     // name of a saved view whose filters apply too
+	Compare  string   `json:"compare"`  // baseline window before the range to compare with, e.g. prev7d
+}
+
+// ReportJob describes an asynchronous report generation
+type ReportJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Range       string     `json:"range"`
+	Format      string     `json:"format"`
+	Sections    []string   `json:"sections,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StatusURL   string     `json:"statusUrl"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+	path        string
+}
+
+// reportJobs tracks report jobs in memory; files live in dir
+type reportJobs struct {
+	jobs  map[string]*ReportJob
+	dir   string
+	mutex sync.RWMutex
+}
+
+func newReportJobs() *reportJobs {
+	return &reportJobs{
+		jobs: make(map[string]*ReportJob),
+		dir:  filepath.Join(os.TempDir(), "net-watcher-reports"),
+	}
+}
+
+// SetReportDir sets where reports generated through the API are written
+func (s *Server) SetReportDir(dir string) {
+	s.reports.dir = dir
+}
+
+// handleReports lists report jobs (GET) or starts a new one (POST)
+func (s *Server) handleReports(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.reports.mutex.RLock()
+		jobs := make([]ReportJob, 0, len(s.reports.jobs))
+		for _, job := range s.reports.jobs {
+			jobs = append(jobs, *job)
+		}
+		s.reports.mutex.RUnlock()
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"reports": jobs})
+	case http.MethodPost:
+		s.createReport(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createReport validates the request and generates the report in the background
+func (s *Server) createReport(w http.ResponseWriter, r *http.Request) {
+	var req ReportRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Range == "" {
+		req.Range = "24h"
+	}
+	if req.Format == "" {
+		req.Format = "html"
+	}
+
+	since, err := report.ParseSince(req.Range)
+	if err != nil || since <= 0 {
+		http.Error(w, fmt.Sprintf("invalid range %q", req.Range), http.StatusBadRequest)
+		return
+	}
+	if !report.ValidFormat(req.Format) {
+		http.Error(w, fmt.Sprintf("invalid format %q, expected one of %v", req.Format, report.Formats), http.StatusBadRequest)
+		return
+	}
+	for _, section := range req.Sections {
+		if !report.ValidSection(section) {
+			http.Error(w, fmt.Sprintf("invalid section %q, expected any of %v", section, report.Sections), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var baseline time.Duration
+	if req.Compare != "" {
+		if _, baseline, err = report.ParseCompare("baseline=" + req.Compare); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter, err := s.reportFilter(req.View, req.Query)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, database.ErrViewNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	id := newReportID()
+	job := &ReportJob{
+		ID:        id,
+		Status:    reportPending,
+		Range:     req.Range,
+		Format:    req.Format,
+		Sections:  req.Sections,
+		CreatedAt: time.Now(),
+		StatusURL: "/api/reports/" + id,
+	}
+
+	s.reports.mutex.Lock()
+	s.pruneReports()
+	s.reports.jobs[id] = job
+	s.reports.mutex.Unlock()
+
+	response := *job
+	go s.runReport(job, report.Options{Since: since, EventLimit: req.Limit, Sections: req.Sections, Filter: filter, Compare: baseline})
+
+	s.logger.Info("[REPORT] Queued", "id", id, "range", req.Range, "format", req.Format)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", response.StatusURL)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// reportFilter combines the filters of a saved view with a filter expression
+func (s *Server) reportFilter(view, query string) (*database.Filter, error) {
+	if view == "" {
+		if query == "" {
+			return nil, nil
+		}
+		filter, err := database.ParseFilter(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %w", err)
+		}
+		return filter, nil
+	}
+	v, err := s.db.ViewByName(view)
+	if err != nil {
+		return nil, fmt.Errorf("view %q: %w", view, err)
+	}
+	return v.FilterWith(query)
+}
+
+// runReport generates the report file and records the outcome on the job
+func (s *Server) runReport(job *ReportJob, opts report.Options) {
+	s.setReportStatus(job, reportRunning, "", "")
+
+	path := filepath.Join(s.reports.dir, fmt.Sprintf("report-%s.%s", job.ID, job.Format))
+	err := func() error {
+		if err := os.MkdirAll(s.reports.dir, 0o750); err != nil {
+			return err
+		}
+		r, err := report.Generate(s.reader(), opts)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return r.Write(f, job.Format)
+	}()
+
+	if err != nil {
+		s.logger.Error("[REPORT] Generation failed", "id", job.ID, "error", err)
+		os.Remove(path)
+		s.setReportStatus(job, reportFailed, err.Error(), "")
+		return
+	}
+	s.logger.Info("[REPORT] Ready", "id", job.ID, "file", path)
+	s.setReportStatus(job, reportDone, "", path)
+}
+
+func (s *Server) setReportStatus(job *ReportJob, status, errMsg, path string) {
+	s.reports.mutex.Lock()
+	defer s.reports.mutex.Unlock()
+	job.Status = status
+	job.Error = errMsg
+	if status == reportDone || status == reportFailed {
+		now := time.Now()
+		job.FinishedAt = &now
+	}
+	if path != "" {
+		job.path = path
+		job.DownloadURL = job.StatusURL + "/download"
+	}
+}
+
+// handleReport returns the status of one job
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.lookupReport(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// handleReportDownload serves a finished report file
+func (s *Server) handleReportDownload(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.lookupReport(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	}
+	if job.Status != reportDone {
+		http.Error(w, "report is "+job.Status, http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(job.path)))
+	http.ServeFile(w, r, job.path)
+}
+
+// lookupReport returns a copy of a job so callers can read it unlocked
+func (s *Server) lookupReport(id string) (ReportJob, bool) {
+	s.reports.mutex.RLock()
+	defer s.reports.mutex.RUnlock()
+	job, ok := s.reports.jobs[id]
+	if !ok {
+		return ReportJob{}, false
+	}
+	return *job, true
+}
+
+// pruneReports forgets finished jobs past retention and removes their files.
+// Caller must hold the reports mutex.
+func (s *Server) pruneReports() {
+	cutoff := time.Now().Add(-reportRetention)
+	for id, job := range s.reports.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			if job.path != "" {
+				os.Remove(job.path)
+			}
+			delete(s.reports.jobs, id)
+		}
+	}
+}
+
+func newReportID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
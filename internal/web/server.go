@@ -3,18 +3,27 @@ package web
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/abja/net-watcher/internal/database"
+	"github.com/abja/net-watcher/internal/enrich"
+	"github.com/abja/net-watcher/internal/scheduler"
 	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
 )
 
 //go:embed all:static
@@ -23,11 +32,36 @@ var staticFiles embed.FS
 // Server represents the web server
 type Server struct {
 	db      *database.DB
+	replica *database.DB // read replica for event queries and reports; nil reads db
 	port    int
 	server  *http.Server
 	logger  *log.Logger
 	version string
 	hub     *Hub
+	reports *reportJobs
+	// Bearer token for POST /api/ingest; empty disables ingestion
+	ingestToken string
+	// Window within which ingested events already seen by another sensor are dropped
+	ingestDedup time.Duration
+	// Privacy mode applied to ingested events, as to captured ones
+	ingestPrivacy enrich.Enricher
+	// Capture pipeline ingested events go through; nil writes them to db
+	ingestPipeline IngestPipeline
+	// HTTPS certificate, and the CA sensors' client certificates must chain to
+	tlsCert, tlsKey string
+	clientCAs       *x509.CertPool
+	// Sockets passed by systemd socket activation, used instead of port
+	listeners []net.Listener
+	// Periodic jobs shown and triggered through /api/jobs
+	jobs *scheduler.Scheduler
+	// Session table shown through /api/sessions
+	sessions SessionSource
+	// Per-client limit on /api requests; nil allows any rate
+	apiLimiter *apiLimiter
+	// Bearer tokens /api requests need, with their roles; none leaves the API open
+	apiTokens []apiToken
+	// OpenAPI document served at /api/openapi.json, built on first request
+	openapi openapiSpec
 }
 
 // NewServer creates a new web server instance
@@ -42,6 +76,7 @@ func NewServer(db *database.DB, port int, logger *log.Logger, version string) *S
 		logger:  logger,
 		version: version,
 		hub:     hub,
+		reports: newReportJobs(),
 	}
 }
 
@@ -51,11 +86,31 @@ func (s *Server) Start(ctx context.Context) error {
 
 	// API routes
 	mux.HandleFunc("/api/events", s.handleEvents)
+	mux.HandleFunc("GET /api/events/{id}/originals", s.handleOriginals)
+	mux.HandleFunc("POST /api/purge", s.handlePurge)
 	mux.HandleFunc("/api/stats", s.handleStats)
 	mux.HandleFunc("/api/event-types", s.handleEventTypes)
 	mux.HandleFunc("/api/version", s.handleVersion)
+	mux.HandleFunc("GET /api/openapi.json", s.handleOpenAPI)
 	mux.HandleFunc("/api/top-hosts", s.handleTopHosts)
 	mux.HandleFunc("/api/traffic-timeline", s.handleTrafficTimeline)
+	mux.HandleFunc("GET /api/devices", s.handleDevices)
+	mux.HandleFunc("GET /api/devices/new-behavior", s.handleNewBehavior)
+	mux.HandleFunc("/api/tls/fingerprints", s.handleTLSFingerprints)
+	mux.HandleFunc("GET /api/dns", s.handleDNS)
+	mux.HandleFunc("GET /api/destinations/new", s.handleNewDestinations)
+	mux.HandleFunc("GET /api/beacons", s.handleBeacons)
+	mux.HandleFunc("GET /api/charts/{file}", s.handleChart)
+	mux.HandleFunc("/api/reports", s.handleReports)
+	mux.HandleFunc("GET /api/reports/{id}", s.handleReport)
+	mux.HandleFunc("GET /api/reports/{id}/download", s.handleReportDownload)
+	mux.HandleFunc("/api/views", s.handleViews)
+	mux.HandleFunc("/api/views/{id}", s.handleView)
+	mux.HandleFunc("POST /api/ingest", s.handleIngest)
+	mux.HandleFunc("GET /api/jobs", s.handleJobs)
+	mux.HandleFunc("POST /api/jobs/{name}/run", s.handleJobRun)
+	mux.HandleFunc("GET /api/sessions", s.handleSessions)
+	mux.HandleFunc("GET /api/connections/active", s.handleActiveConnections)
 	mux.HandleFunc("/api/ws", s.hub.ServeWs)
 
 	// Serve static files (React app)
@@ -69,10 +124,23 @@ func (s *Server) Start(ctx context.Context) error {
 
 	s.server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", s.port),
-		Handler: s.loggingMiddleware(corsMiddleware(mux)),
+		Handler: s.loggingMiddleware(corsMiddleware(s.rateLimitMiddleware(s.authMiddleware(mux)))),
 	}
 
-	s.logger.Info("Starting web server", "port", s.port, "url", fmt.Sprintf("http://localhost:%d", s.port))
+	scheme := "http"
+	if s.tlsCert != "" {
+		scheme = "https"
+		s.server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if s.clientCAs != nil {
+			// Browsers have no client certificate; handleIngest requires one
+			s.server.TLSConfig.ClientCAs = s.clientCAs
+			s.server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	if len(s.listeners) == 0 {
+		s.logger.Info("Starting web server", "port", s.port, "url", fmt.Sprintf("%s://localhost:%d", scheme, s.port))
+	}
 
 	go func() {
 		<-ctx.Done()
@@ -81,18 +149,79 @@ func (s *Server) Start(ctx context.Context) error {
 		_ = s.server.Shutdown(shutdownCtx)
 	}()
 
-	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+	switch {
+	case len(s.listeners) > 0:
+		errs := make(chan error, len(s.listeners))
+		for _, l := range s.listeners {
+			s.logger.Info("Starting web server on socket from systemd", "address", l.Addr().String(), "scheme", scheme)
+			go func() {
+				if s.tlsCert != "" {
+					errs <- s.server.ServeTLS(l, s.tlsCert, s.tlsKey)
+				} else {
+					errs <- s.server.Serve(l)
+				}
+			}()
+		}
+		err = <-errs
+	case s.tlsCert != "":
+		err = s.server.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+	default:
+		err = s.server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		return err
 	}
 	return nil
 }
 
+// SetReadReplica runs event queries and reports on a read replica, so
+// they never hold up the capture writer. Writes (ingest, views) and the
+// live event stream, which needs the newest rows, stay on the primary.
+func (s *Server) SetReadReplica(replica *database.DB) {
+	s.replica = replica
+}
+
+// reader is the database event queries and reports read from
+func (s *Server) reader() *database.DB {
+	if s.replica != nil {
+		return s.replica
+	}
+	return s.db
+}
+
+// SetListeners serves on sockets passed by systemd socket activation
+// instead of opening the web port
+func (s *Server) SetListeners(listeners []net.Listener) {
+	s.listeners = listeners
+}
+
+// SetTLS serves the UI and API over HTTPS. With a clientCA, sensors posting
+// to /api/ingest must present a client certificate signed by it.
+func (s *Server) SetTLS(certFile, keyFile, clientCA string) error {
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	s.tlsCert, s.tlsKey = certFile, keyFile
+	if clientCA == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA: %w", err)
+	}
+	s.clientCAs = x509.NewCertPool()
+	if !s.clientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", clientCA)
+	}
+	return nil
+}
+
 // corsMiddleware adds CORS headers for development
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -120,7 +249,7 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 			s.logger.Info("API request",
 				"method", r.Method,
 				"path", r.URL.Path,
-				"query", r.URL.RawQuery,
+				"query", redactToken(r.URL.RawQuery),
 				"status", lrw.statusCode,
 				"duration", duration.Round(time.Microsecond),
 			)
@@ -139,6 +268,13 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush implements http.Flusher for streamed responses
+func (lrw *loggingResponseWriter) Flush() {
+	if flusher, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Hijack implements http.Hijacker for WebSocket support
 func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if hijacker, ok := lrw.ResponseWriter.(http.Hijacker); ok {
@@ -151,11 +287,17 @@ func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error)
 type EventsResponse struct {
 	Events     []database.NetworkEvent `json:"events"`
 	Total      int64                   `json:"total"`
-	Page       int                     `json:"page"`
 	PageSize   int                     `json:"pageSize"`
-	TotalPages int                     `json:"totalPages"`
+	NextCursor string                  `json:"nextCursor,omitempty"` // empty on the last page
+	PrevCursor string                  `json:"prevCursor,omitempty"` // empty on the first page
 }
 
+const (
+	// defaultStreamRows and maxStreamRows bound format=ndjson responses
+	defaultStreamRows = 10000
+	maxStreamRows     = 100000
+)
+
 // StatsResponse represents database statistics
 type StatsResponse struct {
 	TotalEvents int64            `json:"totalEvents"`
@@ -164,115 +306,145 @@ type StatsResponse struct {
 	FirstEvent  *time.Time       `json:"firstEvent,omitempty"`
 }
 
-// handleEvents returns paginated and filtered events
+// handleEvents returns filtered events one page at a time. A page starts
+// after the row of the cursor parameter, or ends before it with
+// direction=prev. With format=ndjson up to limit events are streamed
+// instead, one per line, and the X-Next-Cursor trailer continues after them.
 func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 
 	// Pagination
-	page, _ := strconv.Atoi(query.Get("page"))
-	if page < 1 {
-		page = 1
-	}
 	pageSize, _ := strconv.Atoi(query.Get("pageSize"))
 	if pageSize < 1 || pageSize > 100 {
 		pageSize = 20
 	}
-
-	// Filters
-	eventType := query.Get("eventType")
-	srcIP := query.Get("srcIP")
-	dstIP := query.Get("dstIP")
-	searchQuery := query.Get("q")
-	startDate := query.Get("startDate")
-	endDate := query.Get("endDate")
-
-	// Build query
-	dbQuery := s.db.Model(&database.NetworkEvent{})
-
-	// Handle multi-select event types (comma-separated)
-	if eventType != "" {
-		types := strings.Split(eventType, ",")
-		if len(types) == 1 {
-			dbQuery = dbQuery.Where("event_type = ?", types[0])
-		} else {
-			dbQuery = dbQuery.Where("event_type IN ?", types)
-		}
-	}
-	if srcIP != "" {
-		dbQuery = dbQuery.Where("src_ip LIKE ?", "%"+srcIP+"%")
-	}
-	if dstIP != "" {
-		dbQuery = dbQuery.Where("dst_ip LIKE ?", "%"+dstIP+"%")
-	}
-	if searchQuery != "" {
-		search := "%" + searchQuery + "%"
-		dbQuery = dbQuery.Where(
-			"src_ip LIKE ? OR dst_ip LIKE ? OR hostname LIKE ? OR dns_query LIKE ? OR tls_sni LIKE ?",
-			search, search, search, search, search,
-		)
+	cursor, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if startDate != "" {
-		if t, err := time.Parse("2006-01-02", startDate); err == nil {
-			dbQuery = dbQuery.Where("timestamp >= ?", t)
-		}
+	backward := query.Get("direction") == "prev"
+	byScore := query.Get("sort") == "score"
+
+	dbQuery, err := s.filterEvents(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if endDate != "" {
-		if t, err := time.Parse("2006-01-02", endDate); err == nil {
-			dbQuery = dbQuery.Where("timestamp <= ?", t.Add(24*time.Hour))
-		}
+	if query.Get("format") == "ndjson" {
+		s.streamEvents(w, dbQuery, cursor, byScore, query.Get("limit"))
+		return
 	}
 
 	// Get total count
 	var total int64
 	dbQuery.Count(&total)
 
-	// Get paginated results
+	// Fetch one row more than a page to learn whether another page follows
 	var events []database.NetworkEvent
-	offset := (page - 1) * pageSize
-	dbQuery.Order("timestamp DESC").Limit(pageSize).Offset(offset).Find(&events)
-
-	totalPages := int(total) / pageSize
-	if int(total)%pageSize > 0 {
-		totalPages++
+	keyset(dbQuery, cursor, byScore, backward).Limit(pageSize + 1).Find(&events)
+	more := len(events) > pageSize
+	if more {
+		events = events[:pageSize]
+	}
+	if backward {
+		slices.Reverse(events)
 	}
 
 	response := EventsResponse{
-		Events:     events,
-		Total:      total,
-		Page:       page,
-		PageSize:   pageSize,
-		TotalPages: totalPages,
+		Events:   events,
+		Total:    total,
+		PageSize: pageSize,
+	}
+	if len(events) > 0 {
+		hasPrev, hasNext := cursor != nil, more
+		if backward {
+			hasPrev, hasNext = more, cursor != nil
+		}
+		if hasPrev {
+			response.PrevCursor = encodeCursor(&events[0])
+		}
+		if hasNext {
+			response.NextCursor = encodeCursor(&events[len(events)-1])
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-// handleStats returns database statistics
-func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
-	var total int64
-	s.db.Model(&database.NetworkEvent{}).Count(&total)
+// streamEvents writes up to limit events after cursor as NDJSON
+func (s *Server) streamEvents(w http.ResponseWriter, dbQuery *gorm.DB, cursor *eventCursor, byScore bool, limitParam string) {
+	limit, _ := strconv.Atoi(limitParam)
+	if limit < 1 {
+		limit = defaultStreamRows
+	}
+	limit = min(limit, maxStreamRows)
+
+	rows, err := keyset(dbQuery, cursor, byScore, false).Limit(limit).Rows()
+	if err != nil {
+		http.Error(w, "failed to query events", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "X-Next-Cursor")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	var last database.NetworkEvent
+	n := 0
+	for rows.Next() {
+		var e database.NetworkEvent
+		if err := s.reader().ScanRows(rows, &e); err != nil {
+			s.logger.Error("Failed to read event", "error", err)
+			return
+		}
+		if err := enc.Encode(&e); err != nil {
+			return // client went away
+		}
+		last = e
+		if n++; n%1000 == 0 {
+			_ = rc.Flush()
+		}
+	}
+	if n == limit {
+		w.Header().Set("X-Next-Cursor", encodeCursor(&last))
+	}
+}
 
-	// Count by event type
-	type eventCount struct {
-		EventType string
-		Count     int64
+// filterEvents applies the filter parameters of /api/events, including a
+// filter expression in query (see database.Filter)
+func (s *Server) filterEvents(query url.Values) (*gorm.DB, error) {
+	params := make(map[string]string, len(database.FilterParams))
+	for _, name := range database.FilterParams {
+		params[name] = query.Get(name)
 	}
-	var counts []eventCount
-	s.db.Model(&database.NetworkEvent{}).
-		Select("event_type, count(*) as count").
-		Group("event_type").
-		Scan(&counts)
+	filter, err := database.ParamsFilter(params)
+	if err != nil {
+		return nil, err
+	}
+	dbQuery := filter.Apply(s.reader().Model(&database.NetworkEvent{}))
+	return dbQuery.Session(&gorm.Session{}), nil
+}
 
-	eventCounts := make(map[string]int64)
-	for _, c := range counts {
-		eventCounts[c.EventType] = c.Count
+// handleStats returns database statistics. Counts come from the hour
+// rollups, so they are events as captured, before compaction merged them.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	eventCounts, err := s.reader().RollupTotals(database.RollupType, time.Time{}, time.Time{})
+	if err != nil {
+		s.logger.Error("Failed to read event rollups", "error", err)
+		eventCounts = make(map[string]int64)
+	}
+	var total int64
+	for _, c := range eventCounts {
+		total += c
 	}
 
 	// Get first and last event timestamps
 	var firstEvent, lastEvent database.NetworkEvent
-	s.db.Model(&database.NetworkEvent{}).Order("timestamp ASC").First(&firstEvent)
-	s.db.Model(&database.NetworkEvent{}).Order("timestamp DESC").First(&lastEvent)
+	s.reader().Model(&database.NetworkEvent{}).Order("timestamp ASC").First(&firstEvent)
+	s.reader().Model(&database.NetworkEvent{}).Order("timestamp DESC").First(&lastEvent)
 
 	response := StatsResponse{
 		TotalEvents: total,
@@ -290,10 +462,31 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(response)
 }
 
+// handleOriginals returns the events a compacted record was merged from,
+// read back from the compaction undo archive
+func (s *Server) handleOriginals(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "event not found", http.StatusNotFound)
+		return
+	}
+	events, err := s.reader().Originals(uint(id))
+	switch {
+	case errors.Is(err, database.ErrEventNotFound), errors.Is(err, database.ErrNotArchived):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
 // handleEventTypes returns available event types
 func (s *Server) handleEventTypes(w http.ResponseWriter, r *http.Request) {
 	var types []string
-	s.db.Model(&database.NetworkEvent{}).
+	s.reader().Model(&database.NetworkEvent{}).
 		Distinct("event_type").
 		Pluck("event_type", &types)
 
@@ -321,6 +514,8 @@ type TopHostEntry struct {
 	Host       string `json:"host"`
 	EventCount int64  `json:"eventCount"`
 	ByteCount  int64  `json:"byteCount"`
+	// Events, or bytes for the traffic metric, per hour from SparklineStart
+	Sparkline []int64 `json:"sparkline,omitempty" gorm:"-"`
 }
 
 // TopHostsResponse represents the top hosts response
@@ -329,12 +524,26 @@ type TopHostsResponse struct {
 	Total    int64          `json:"total"`
 	Metric   string         `json:"metric"`
 	HostType string         `json:"hostType"`
+	// Hour of the first sparkline value, with sparkline=true
+	SparklineStart *time.Time `json:"sparklineStart,omitempty"`
 }
 
+// maxSparklineHours caps sparklines to the last 31 days of the range
+const maxSparklineHours = 31 * 24
+
 // handleTopHosts returns top hosts by traffic or event count
 func (s *Server) handleTopHosts(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
+	if d := r.URL.Query().Get("direction"); d != "" && d != "in" && d != "out" {
+		http.Error(w, fmt.Sprintf("unknown direction %q, expected in or out", d), http.StatusBadRequest)
+		return
+	}
+	response := s.topHosts(r.URL.Query())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
+// topHosts queries the top hosts for the limit, metric and type parameters
+func (s *Server) topHosts(query url.Values) TopHostsResponse {
 	// Parameters
 	limit, _ := strconv.Atoi(query.Get("limit"))
 	if limit < 1 || limit > 100 {
@@ -362,35 +571,46 @@ func (s *Server) handleTopHosts(w http.ResponseWriter, r *http.Request) {
 		groupColumn = "hostname"
 	}
 
-	// Build query based on metric
-	var results []TopHostEntry
+	// Optional filters, all applied in the same query: a time range,
+	// interface, direction relative to the local network (out: sent by a
+	// local host, in: sent from outside) and event types
+	base := func() *gorm.DB {
+		q := s.reader().Model(&database.NetworkEvent{}).
+			Where(groupColumn + " != '' AND " + groupColumn + " IS NOT NULL")
+		if query.Get("start") != "" || query.Get("end") != "" {
+			startTime, endTime := parseTimeRange(query)
+			q = q.Where("timestamp >= ? AND timestamp <= ?", startTime, endTime)
+		}
+		if iface := query.Get("interface"); iface != "" {
+			q = q.Where("interface = ?", iface)
+		}
+		switch query.Get("direction") {
+		case "out":
+			q = q.Where(database.LocalSourceCondition)
+		case "in":
+			q = q.Where("NOT " + database.LocalSourceCondition)
+		}
+		if types := query.Get("eventType"); types != "" {
+			q = q.Where("event_type IN ?", strings.Split(types, ","))
+		}
+		return q
+	}
 
+	order := "event_count DESC"
 	if metric == "traffic" {
-		// Order by total bytes
-		s.db.Model(&database.NetworkEvent{}).
-			Select(groupColumn + " as host, count(*) as event_count, COALESCE(sum(byte_count), 0) as byte_count").
-			Where(groupColumn + " != '' AND " + groupColumn + " IS NOT NULL").
-			Group(groupColumn).
-			Order("byte_count DESC").
-			Limit(limit).
-			Scan(&results)
-	} else {
-		// Order by event count
-		s.db.Model(&database.NetworkEvent{}).
-			Select(groupColumn + " as host, count(*) as event_count, COALESCE(sum(byte_count), 0) as byte_count").
-			Where(groupColumn + " != '' AND " + groupColumn + " IS NOT NULL").
-			Group(groupColumn).
-			Order("event_count DESC").
-			Limit(limit).
-			Scan(&results)
+		order = "byte_count DESC"
 	}
+	var results []TopHostEntry
+	base().
+		Select(groupColumn + " as host, count(*) as event_count, COALESCE(sum(byte_count), 0) as byte_count").
+		Group(groupColumn).
+		Order(order).
+		Limit(limit).
+		Scan(&results)
 
 	// Get total unique hosts
 	var total int64
-	s.db.Model(&database.NetworkEvent{}).
-		Where(groupColumn + " != '' AND " + groupColumn + " IS NOT NULL").
-		Distinct(groupColumn).
-		Count(&total)
+	base().Distinct(groupColumn).Count(&total)
 
 	response := TopHostsResponse{
 		Hosts:    results,
@@ -398,6 +618,144 @@ func (s *Server) handleTopHosts(w http.ResponseWriter, r *http.Request) {
 		Metric:   metric,
 		HostType: hostType,
 	}
+	if query.Get("sparkline") == "true" && len(results) > 0 {
+		response.SparklineStart = s.topHostSparklines(query, base, groupColumn, metric, results)
+	}
+	return response
+}
+
+// topHostSparklines fills in the hourly events or bytes of the top hosts
+// over the requested range (default: the last 24 hours) and returns the
+// hour they start at
+func (s *Server) topHostSparklines(query url.Values, base func() *gorm.DB, groupColumn, metric string, hosts []TopHostEntry) *time.Time {
+	startTime, endTime := parseTimeRange(query)
+	start, end := startTime.UTC().Truncate(time.Hour), endTime.UTC().Truncate(time.Hour)
+	if end.Sub(start) >= maxSparklineHours*time.Hour {
+		start = end.Add(-(maxSparklineHours - 1) * time.Hour)
+	}
+	hours := int(end.Sub(start)/time.Hour) + 1
+
+	names := make([]string, len(hosts))
+	index := make(map[string]int, len(hosts))
+	for i, h := range hosts {
+		names[i] = h.Host
+		index[h.Host] = i
+		hosts[i].Sparkline = make([]int64, hours)
+	}
+
+	value := "count(*)"
+	if metric == "traffic" {
+		value = "COALESCE(sum(byte_count), 0)"
+	}
+	var rows []struct {
+		Host  string
+		Hour  int64
+		Value int64
+	}
+	err := base().
+		Select(groupColumn+" as host, "+s.reader().UnixHourSQL()+" as hour, "+value+" as value").
+		Where(groupColumn+" IN ? AND timestamp >= ? AND timestamp < ?", names, start, end.Add(time.Hour)).
+		Group("host, hour").
+		Scan(&rows).Error
+	if err != nil {
+		s.logger.Error("Failed to query top host sparklines", "error", err)
+	}
+	for _, r := range rows {
+		if h := int((r.Hour - start.Unix()) / 3600); h >= 0 && h < hours {
+			hosts[index[r.Host]].Sparkline[h] += r.Value
+		}
+	}
+	return &start
+}
+
+// TLSFingerprintEntry represents one client fingerprint and where it was seen
+type TLSFingerprintEntry struct {
+	Fingerprint string    `json:"fingerprint"`
+	EventCount  int64     `json:"eventCount"`
+	ClientCount int64     `json:"clientCount"`
+	SNICount    int64     `json:"sniCount"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Clients     []string  `json:"clients"`
+	SNIs        []string  `json:"snis"`
+}
+
+// TLSFingerprintsResponse represents the TLS fingerprints response
+type TLSFingerprintsResponse struct {
+	Fingerprints []TLSFingerprintEntry `json:"fingerprints"`
+	Total        int64                 `json:"total"`
+	Type         string                `json:"type"`
+}
+
+// handleTLSFingerprints groups TLS handshakes by JA3 or JA4 client fingerprint.
+// Sorting ascending by event count (order=rare) surfaces unusual clients.
+func (s *Server) handleTLSFingerprints(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	fpType := query.Get("type") // "ja4" or "ja3"
+	if fpType != "ja3" {
+		fpType = "ja4"
+	}
+	column := "tls_" + fpType
+
+	order := "event_count DESC"
+	if query.Get("order") == "rare" {
+		order = "event_count ASC"
+	}
+
+	base := func() *gorm.DB {
+		q := s.reader().Model(&database.NetworkEvent{}).
+			Where("event_type = ? AND "+column+" != '' AND "+column+" IS NOT NULL", database.EventTLSSNI)
+		if srcIP := query.Get("srcIP"); srcIP != "" {
+			q = q.Where("src_ip = ?", srcIP)
+		}
+		return q
+	}
+
+	var rows []struct {
+		Fingerprint string
+		EventCount  int64
+		ClientCount int64
+		SNICount    int64
+		FirstSeen   string
+		LastSeen    string
+	}
+	base().
+		Select(column + " as fingerprint, count(*) as event_count, count(DISTINCT src_ip) as client_count, " +
+			"count(DISTINCT tls_sni) as sni_count, min(timestamp) as first_seen, max(timestamp) as last_seen").
+		Group(column).
+		Order(order).
+		Limit(limit).
+		Scan(&rows)
+
+	results := make([]TLSFingerprintEntry, 0, len(rows))
+	for _, row := range rows {
+		entry := TLSFingerprintEntry{
+			Fingerprint: row.Fingerprint,
+			EventCount:  row.EventCount,
+			ClientCount: row.ClientCount,
+			SNICount:    row.SNICount,
+			FirstSeen:   database.ParseTime(row.FirstSeen),
+			LastSeen:    database.ParseTime(row.LastSeen),
+		}
+		base().Where(column+" = ?", row.Fingerprint).Distinct("src_ip").Limit(10).Pluck("src_ip", &entry.Clients)
+		base().Where(column+" = ? AND tls_sni != ''", row.Fingerprint).Distinct("tls_sni").Limit(10).Pluck("tls_sni", &entry.SNIs)
+		results = append(results, entry)
+	}
+
+	var total int64
+	base().Distinct(column).Count(&total)
+
+	response := TLSFingerprintsResponse{
+		Fingerprints: results,
+		Total:        total,
+		Type:         fpType,
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -419,16 +777,145 @@ type TrafficTimelineResponse struct {
 	BucketSize string             `json:"bucketSize"`
 	TotalIn    int64              `json:"totalIn"`
 	TotalOut   int64              `json:"totalOut"`
+	// Buckets before downsampling; more than len(Data) when Downsampled
+	Buckets     int  `json:"buckets"`
+	Downsampled bool `json:"downsampled,omitempty"`
+	// With groupBy, the traffic of each host, protocol or interface
+	GroupBy string           `json:"groupBy,omitempty"`
+	Series  []TimelineSeries `json:"series,omitempty"`
+}
+
+// timelineBucket is a bucket size the timeline can group by
+type timelineBucket struct {
+	label string
+	size  time.Duration
+}
+
+var timelineBuckets = []timelineBucket{
+	{"1min", time.Minute},
+	{"5min", 5 * time.Minute},
+	{"15min", 15 * time.Minute},
+	{"30min", 30 * time.Minute},
+	{"1hour", time.Hour},
+	{"2hour", 2 * time.Hour},
+	{"6hour", 6 * time.Hour},
+	{"1day", 24 * time.Hour},
+	{"1week", 7 * 24 * time.Hour},
 }
 
+// Timeline resolution limits. Ranges are grouped in the finest bucket
+// (5min or coarser by default) giving at most maxTimelineBuckets buckets,
+// which are downsampled to the requested points (default 1000).
+const (
+	defaultTimelinePoints = 1000
+	maxTimelinePoints     = 5000
+	maxTimelineBuckets    = 10000
+)
+
 // handleTrafficTimeline returns time-series traffic data
 func (s *Server) handleTrafficTimeline(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
+	if err := validateTimelineGroup(r.URL.Query().Get("groupBy")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := s.trafficTimeline(r.URL.Query())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-	// Parse date range
-	now := time.Now()
-	var startTime, endTime time.Time
+// trafficTimeline queries bucketed traffic for the start and end parameters.
+// bucket (e.g. 1hour) chooses the resolution, points the most data points
+// returned, and metric (bytes or events) the series whose shape
+// downsampling preserves. groupBy (host, protocol or interface) adds a
+// series per group, for the busiest series hosts or interfaces.
+func (s *Server) trafficTimeline(query url.Values) TrafficTimelineResponse {
+	startTime, endTime := parseTimeRange(query)
+	duration := endTime.Sub(startTime)
+
+	points := defaultTimelinePoints
+	if n, err := strconv.Atoi(query.Get("points")); err == nil && n >= 10 {
+		points = min(n, maxTimelinePoints)
+	}
+
+	// The finest bucket within the limit, no finer than requested
+	bucket := timelineBuckets[len(timelineBuckets)-1]
+	minimum := 5 * time.Minute
+	for _, b := range timelineBuckets {
+		if b.label == query.Get("bucket") {
+			minimum = b.size
+		}
+	}
+	for _, b := range timelineBuckets {
+		if b.size >= minimum && duration/b.size <= maxTimelineBuckets {
+			bucket = b
+			break
+		}
+	}
+
+	// Read the minute or hour rollups and group them into buckets. Buckets
+	// are counted from Go's zero time, like time.Truncate, so days start at
+	// midnight UTC and weeks on Monday.
+	rollups, err := s.reader().RollupBuckets(startTime, endTime, bucket.size)
+	if err != nil {
+		s.logger.Error("Failed to read timeline rollups", "error", err)
+	}
+
+	data := make([]TrafficDataPoint, 0, len(rollups))
+	var totalIn, totalOut int64
+
+	for _, r := range rollups {
+		ts := r.Bucket.UTC().Truncate(bucket.size)
+		if n := len(data); n == 0 || !data[n-1].Timestamp.Equal(ts) {
+			data = append(data, TrafficDataPoint{Timestamp: ts})
+		}
+		p := &data[len(data)-1]
+		p.BytesIn += r.BytesIn
+		p.BytesOut += r.BytesOut
+		p.EventCount += r.Events
+		totalIn += r.BytesIn
+		totalOut += r.BytesOut
+	}
+
+	// Fill in missing buckets with zero values for a complete timeline
+	filledData := fillTimeGaps(data, startTime, endTime, bucket.size)
+
+	response := TrafficTimelineResponse{
+		Data:       filledData,
+		StartTime:  startTime,
+		EndTime:    endTime,
+		BucketSize: bucket.label,
+		TotalIn:    totalIn,
+		TotalOut:   totalOut,
+		Buckets:    len(filledData),
+	}
+	byEvents := query.Get("metric") == "events" || totalIn+totalOut == 0
+	if groupBy := query.Get("groupBy"); validateTimelineGroup(groupBy) == nil && groupBy != "" {
+		limit := defaultTimelineSeries
+		if n, err := strconv.Atoi(query.Get("series")); err == nil && n >= 1 {
+			limit = min(n, maxTimelineSeries)
+		}
+		series, err := s.groupedTimeline(groupBy, startTime, endTime, bucket, limit, byEvents, filledData)
+		if err != nil {
+			s.logger.Error("Failed to read timeline series", "groupBy", groupBy, "error", err)
+		}
+		response.GroupBy, response.Series = groupBy, series
+	}
+	if len(filledData) > points {
+		value := func(p TrafficDataPoint) float64 { return float64(p.BytesIn + p.BytesOut) }
+		if byEvents {
+			value = func(p TrafficDataPoint) float64 { return float64(p.EventCount) }
+		}
+		response.Data = downsampleLTTB(filledData, points, value)
+		response.Downsampled = true
+		keepTimestamps(response.Series, response.Data)
+	}
+	return response
+}
 
+// parseTimeRange reads the start and end parameters (RFC 3339 or a date),
+// defaulting to the last 24 hours
+func parseTimeRange(query url.Values) (startTime, endTime time.Time) {
+	now := time.Now()
 	if start := query.Get("start"); start != "" {
 		if t, err := time.Parse(time.RFC3339, start); err == nil {
 			startTime = t
@@ -457,107 +944,7 @@ func (s *Server) handleTrafficTimeline(w http.ResponseWriter, r *http.Request) {
 		startTime, endTime = endTime, startTime
 	}
 
-	// Calculate duration and determine bucket size
-	duration := endTime.Sub(startTime)
-	var bucketSize string
-	var bucketDuration time.Duration
-	var sqlFormat string
-
-	switch {
-	case duration <= 4*time.Hour:
-		bucketSize = "5min"
-		bucketDuration = 5 * time.Minute
-		sqlFormat = "%Y-%m-%d %H:%M"
-	case duration <= 24*time.Hour:
-		bucketSize = "30min"
-		bucketDuration = 30 * time.Minute
-		sqlFormat = "%Y-%m-%d %H:%M"
-	case duration <= 7*24*time.Hour:
-		bucketSize = "2hour"
-		bucketDuration = 2 * time.Hour
-		sqlFormat = "%Y-%m-%d %H:00"
-	case duration <= 30*24*time.Hour:
-		bucketSize = "6hour"
-		bucketDuration = 6 * time.Hour
-		sqlFormat = "%Y-%m-%d %H:00"
-	case duration <= 90*24*time.Hour:
-		bucketSize = "1day"
-		bucketDuration = 24 * time.Hour
-		sqlFormat = "%Y-%m-%d"
-	default:
-		bucketSize = "1week"
-		bucketDuration = 7 * 24 * time.Hour
-		sqlFormat = "%Y-%W"
-	}
-
-	// Query aggregated data
-	type bucketData struct {
-		Bucket     string
-		BytesIn    int64
-		BytesOut   int64
-		EventCount int64
-	}
-
-	var buckets []bucketData
-
-	// SQLite date formatting for grouping
-	s.db.Model(&database.NetworkEvent{}).
-		Select(`strftime('`+sqlFormat+`', timestamp) as bucket,
-			COALESCE(SUM(CASE WHEN src_ip LIKE '192.168.%' OR src_ip LIKE '10.%' OR src_ip LIKE '172.16.%' THEN byte_count ELSE 0 END), 0) as bytes_out,
-			COALESCE(SUM(CASE WHEN dst_ip LIKE '192.168.%' OR dst_ip LIKE '10.%' OR dst_ip LIKE '172.16.%' THEN byte_count ELSE 0 END), 0) as bytes_in,
-			COUNT(*) as event_count`).
-		Where("timestamp >= ? AND timestamp <= ?", startTime, endTime).
-		Group("bucket").
-		Order("bucket ASC").
-		Scan(&buckets)
-
-	// Convert to response format with proper timestamps
-	data := make([]TrafficDataPoint, 0, len(buckets))
-	var totalIn, totalOut int64
-
-	for _, b := range buckets {
-		var ts time.Time
-		// Parse bucket string back to time
-		switch bucketSize {
-		case "5min", "30min":
-			ts, _ = time.Parse("2006-01-02 15:04", b.Bucket)
-		case "2hour", "6hour":
-			ts, _ = time.Parse("2006-01-02 15:00", b.Bucket)
-		case "1day":
-			ts, _ = time.Parse("2006-01-02", b.Bucket)
-		case "1week":
-			// Parse year-week format
-			ts, _ = time.Parse("2006-01-02", b.Bucket+"-1") // Approximate
-		}
-
-		if ts.IsZero() {
-			continue
-		}
-
-		data = append(data, TrafficDataPoint{
-			Timestamp:  ts,
-			BytesIn:    b.BytesIn,
-			BytesOut:   b.BytesOut,
-			EventCount: b.EventCount,
-		})
-		totalIn += b.BytesIn
-		totalOut += b.BytesOut
-	}
-
-	// Fill in missing buckets with zero values for a complete timeline
-	filledData := fillTimeGaps(data, startTime, endTime, bucketDuration)
-
-	response := TrafficTimelineResponse{
-		Data:       filledData,
-		StartTime:  startTime,
-		EndTime:    endTime,
-		BucketSize: bucketSize,
-		TotalIn:    totalIn,
-		TotalOut:   totalOut,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return startTime, endTime
 }
 
 // fillTimeGaps fills in missing time buckets with zero values
@@ -592,8 +979,8 @@ func fillTimeGaps(data []TrafficDataPoint, start, end time.Time, bucketDuration
 		}
 		current = current.Add(bucketDuration)
 
-		// Safety limit
-		if len(result) > 1000 {
+		// Safety limit, above what trafficTimeline asks for
+		if len(result) > 2*maxTimelineBuckets {
 			break
 		}
 	}
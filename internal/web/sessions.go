@@ -0,0 +1,53 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/abja/net-watcher/pkg/watcher"
+)
+
+// SessionSource is the capture whose session table /api/sessions and
+// /api/connections/active show
+type SessionSource interface {
+	SessionTable() watcher.SessionTable
+	ActiveSessions(protocol string, limit int) []watcher.ActiveSession
+}
+
+// SetSessionSource exposes the capture's session table through
+// /api/sessions and /api/connections/active
+func (s *Server) SetSessionSource(src SessionSource) {
+	s.sessions = src
+}
+
+// handleSessions reports how full the session table is, its limits, and
+// how many sessions were ended by timeout or eviction
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if s.sessions == nil {
+		http.Error(w, "no capture running", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sessions.SessionTable())
+}
+
+// handleActiveConnections lists the connections being tracked right now,
+// most recently seen first: up to limit (default 50, at most 1000),
+// optionally of one protocol, with the number tracked in total
+func (s *Server) handleActiveConnections(w http.ResponseWriter, r *http.Request) {
+	if s.sessions == nil {
+		http.Error(w, "no capture running", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"connections": s.sessions.ActiveSessions(query.Get("protocol"), limit),
+		"total":       s.sessions.SessionTable().Active,
+	})
+}
@@ -22,9 +22,12 @@ function formatAxisBytes(bytes) {
 function formatAxisTime(date, bucketSize) {
     const d = new Date(date);
     switch (bucketSize) {
+        case '1min':
         case '5min':
+        case '15min':
         case '30min':
             return d.toLocaleTimeString('en-US', { hour: '2-digit', minute: '2-digit' });
+        case '1hour':
         case '2hour':
         case '6hour':
             return d.toLocaleTimeString('en-US', { hour: '2-digit', minute: '2-digit' });
@@ -305,6 +308,7 @@ NetWatcher.Components.TrafficChart = function() {
     const [data, setData] = useState([]);
     const [loading, setLoading] = useState(true);
     const [bucketSize, setBucketSize] = useState('30min');
+    const [downsampled, setDownsampled] = useState(false);
     const [totalIn, setTotalIn] = useState(0);
     const [totalOut, setTotalOut] = useState(0);
     const [activeRange, setActiveRange] = useState('24H');
@@ -326,6 +330,7 @@ NetWatcher.Components.TrafficChart = function() {
             const result = await res.json();
             setData(result.data || []);
             setBucketSize(result.bucketSize || '30min');
+            setDownsampled(!!result.downsampled);
             setTotalIn(result.totalIn || 0);
             setTotalOut(result.totalOut || 0);
         } catch (err) {
@@ -377,7 +382,7 @@ NetWatcher.Components.TrafficChart = function() {
                     <h2>
                         Network Activity
                         <span className="dashboard-card-subtitle">
-                            Traffic over time ({bucketSize} intervals)
+                            Traffic over time ({bucketSize} intervals{downsampled ? ', downsampled' : ''})
                         </span>
                     </h2>
                 </div>
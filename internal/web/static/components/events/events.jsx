@@ -5,11 +5,20 @@ window.NetWatcher.Components = window.NetWatcher.Components || {};
 
 const { Icon, Utils, UI, CONFIG } = NetWatcher;
 
+/**
+ * ICMP description, with the connection an ICMP error was about
+ */
+function icmpDetails(event) {
+    if (!event.ICMPOrigProto) return event.ICMPDesc;
+    const addr = (ip, port) => port ? (ip.includes(':') ? `[${ip}]:${port}` : `${ip}:${port}`) : ip;
+    return `${event.ICMPDesc} (${event.ICMPOrigProto} ${addr(event.ICMPOrigSrcIP, event.ICMPOrigSrcPort)} → ${addr(event.ICMPOrigDstIP, event.ICMPOrigDstPort)})`;
+}
+
 /**
  * Single Event Row
  */
 NetWatcher.Components.EventRow = function({ event }) {
-    const details = event.DNSQuery || event.TLSSNI || event.Reason || '-';
+    const details = event.DNSQuery || event.TLSSNI || (event.EventType === 'VPN' && event.Protocol) || (event.EventType === 'REMOTE_ACCESS' && [event.Protocol, event.RemoteVersion, event.RemoteServer].filter(Boolean).join(' ')) || (event.EventType === 'FILESHARE' && [event.Protocol, event.Shares].filter(Boolean).join(' ')) || (event.EventType === 'NTP' && [event.Protocol, event.Hostname || event.DstIP, `stratum ${event.NTPStratum}`, event.Reason].filter(Boolean).join(' ')) || event.Reason || icmpDetails(event) || '-';
     const detailStyle = event.DNSQuery 
         ? { color: 'var(--secondary)' }
         : event.TLSSNI 
@@ -18,7 +27,7 @@ NetWatcher.Components.EventRow = function({ event }) {
 
     return (
         <tr>
-            <td className="timestamp">{Utils.formatTimestamp(event.Timestamp)}</td>
+            <td className="timestamp" title={event.CaptureFile ? `${event.CaptureFile} frame ${event.CaptureFrame}` : undefined}>{Utils.formatTimestamp(event.Timestamp)}</td>
             <td>
                 <UI.Badge variant={Utils.getEventTypeClass(event.EventType)}>
                     {event.EventType}
@@ -37,9 +46,39 @@ NetWatcher.Components.EventRow = function({ event }) {
             </td>
             <td className="details-cell">
                 <span style={detailStyle}>{details}</span>
+                {event.VLAN > 0 && (
+                    <span className="event-tag" title="VLAN (service.customer for QinQ)">
+                        vlan {event.VLAN}{event.InnerVLAN ? `.${event.InnerVLAN}` : ''}
+                    </span>
+                )}
+                {event.Tunnel && (
+                    <span className="event-tag" title={`${event.TunnelSrcIP} → ${event.TunnelDstIP}`}>
+                        {event.Tunnel}{event.TunnelID ? ` ${event.TunnelID}` : ''}
+                    </span>
+                )}
+                {event.P2P && (
+                    <span className="event-tag" title="BitTorrent traffic">p2p {event.P2P}</span>
+                )}
+                {event.Repeats > 0 && (
+                    <span className="event-tag" title={`Repeated until ${Utils.formatTimestamp(event.EndTime)}`}>
+                        ×{Utils.formatNumber(event.Repeats + 1)}
+                    </span>
+                )}
+                {event.Tags && event.Tags.split(',').map(tag => (
+                    <span key={tag} className="event-tag">{tag}</span>
+                ))}
             </td>
             <td>{Utils.formatDuration(event.Duration)}</td>
             <td>{Utils.formatBytes(event.ByteCount)}</td>
+            <td>
+                {event.AnomalyScore > 0 ? (
+                    <span title={(event.AnomalyReasons || '').replace(/_/g, ' ').replace(/,/g, ', ')}>
+                        <UI.Badge variant={Utils.getScoreClass(event.AnomalyScore)}>
+                            {event.AnomalyScore}
+                        </UI.Badge>
+                    </span>
+                ) : '-'}
+            </td>
         </tr>
     );
 };
@@ -69,7 +108,8 @@ NetWatcher.Components.EventsTable = function({ events, loading }) {
         { key: 'destination', label: 'Destination' },
         { key: 'details', label: 'Details' },
         { key: 'duration', label: 'Duration' },
-        { key: 'size', label: 'Size' }
+        { key: 'size', label: 'Size' },
+        { key: 'score', label: 'Score' }
     ];
 
     return (
@@ -94,33 +134,10 @@ NetWatcher.Components.EventsTable = function({ events, loading }) {
 
 /**
  * Pagination Controls
+ * Pages are fetched by cursor, so only the first, previous, next and last
+ * page can be reached; onPageChange receives one of those names.
  */
-NetWatcher.Components.Pagination = function({ page, totalPages, total, pageSize, onPageChange, onPageSizeChange }) {
-    const renderPageNumbers = () => {
-        const pages = [];
-        const maxVisible = CONFIG.MAX_VISIBLE_PAGES;
-        let start = Math.max(1, page - Math.floor(maxVisible / 2));
-        let end = Math.min(totalPages, start + maxVisible - 1);
-
-        if (end - start < maxVisible - 1) {
-            start = Math.max(1, end - maxVisible + 1);
-        }
-
-        for (let i = start; i <= end; i++) {
-            pages.push(
-                <button
-                    key={i}
-                    className={`page-btn ${i === page ? 'active' : ''}`}
-                    onClick={() => onPageChange(i)}
-                >
-                    {i}
-                </button>
-            );
-        }
-
-        return pages;
-    };
-
+NetWatcher.Components.Pagination = function({ page, totalPages, total, pageSize, hasPrev, hasNext, onPageChange, onPageSizeChange }) {
     return (
         <div className="pagination">
             <div className="pagination-info">
@@ -141,8 +158,8 @@ NetWatcher.Components.Pagination = function({ page, totalPages, total, pageSize,
             <div className="pagination-controls">
                 <button
                     className="page-btn"
-                    onClick={() => onPageChange(1)}
-                    disabled={page <= 1}
+                    onClick={() => onPageChange('first')}
+                    disabled={!hasPrev}
                     title="First page"
                     aria-label="First page"
                 >
@@ -150,18 +167,20 @@ NetWatcher.Components.Pagination = function({ page, totalPages, total, pageSize,
                 </button>
                 <button
                     className="page-btn"
-                    onClick={() => onPageChange(page - 1)}
-                    disabled={page <= 1}
+                    onClick={() => onPageChange('prev')}
+                    disabled={!hasPrev}
                     title="Previous page"
                     aria-label="Previous page"
                 >
                     <Icon.ChevronLeft />
                 </button>
-                {renderPageNumbers()}
+                <button className="page-btn active" disabled aria-current="page">
+                    {page}
+                </button>
                 <button
                     className="page-btn"
-                    onClick={() => onPageChange(page + 1)}
-                    disabled={page >= totalPages}
+                    onClick={() => onPageChange('next')}
+                    disabled={!hasNext}
                     title="Next page"
                     aria-label="Next page"
                 >
@@ -169,8 +188,8 @@ NetWatcher.Components.Pagination = function({ page, totalPages, total, pageSize,
                 </button>
                 <button
                     className="page-btn"
-                    onClick={() => onPageChange(totalPages)}
-                    disabled={page >= totalPages}
+                    onClick={() => onPageChange('last')}
+                    disabled={!hasNext}
                     title="Last page"
                     aria-label="Last page"
                 >
@@ -184,7 +203,7 @@ NetWatcher.Components.Pagination = function({ page, totalPages, total, pageSize,
 /**
  * Events Card - Container for table and pagination
  */
-NetWatcher.Components.EventsCard = function({ events, loading, total, page, totalPages, pageSize, onPageChange, onPageSizeChange, isSearching }) {
+NetWatcher.Components.EventsCard = function({ events, loading, total, page, totalPages, pageSize, hasPrev, hasNext, onPageChange, onPageSizeChange, isSearching }) {
     return (
         <div className="events-card">
             <div className="events-header">
@@ -201,6 +220,8 @@ NetWatcher.Components.EventsCard = function({ events, loading, total, page, tota
                     totalPages={totalPages}
                     total={total}
                     pageSize={pageSize}
+                    hasPrev={hasPrev}
+                    hasNext={hasNext}
                     onPageChange={onPageChange}
                     onPageSizeChange={onPageSizeChange}
                 />
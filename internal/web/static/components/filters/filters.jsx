@@ -16,7 +16,12 @@ NetWatcher.Components.Filters = function({
     liveEnabled,
     onLiveToggle,
     liveConnected,
-    liveEventCount
+    liveEventCount,
+    views,
+    viewId,
+    onViewSelect,
+    onViewSave,
+    onViewDelete
 }) {
     const updateFilter = (key, value) => {
         onFiltersChange({ ...filters, [key]: value });
@@ -27,13 +32,43 @@ NetWatcher.Components.Filters = function({
             q: '',
             eventTypes: [],
             srcIP: '',
-            dstIP: ''
+            dstIP: '',
+            minScore: '',
+            sort: 'time',
+            extra: {}
         });
+        onViewSelect('');
     };
 
+    const extraFilters = Object.entries(filters.extra);
+
     return (
         <div className="filters">
             <div className="filters-row">
+                <div className="filter-group filter-group-select">
+                    <label className="filter-label">Saved View</label>
+                    <div className="filter-actions-row">
+                        <select
+                            className="filter-input"
+                            value={viewId}
+                            onChange={(e) => onViewSelect(e.target.value)}
+                        >
+                            <option value="">None</option>
+                            {views.map(v => (
+                                <option key={v.id} value={String(v.id)} title={v.description}>{v.name}</option>
+                            ))}
+                        </select>
+                        <UI.Button variant="secondary" onClick={onViewSave} title="Save the current filters as a view">
+                            Save
+                        </UI.Button>
+                        {viewId && (
+                            <UI.Button variant="secondary" onClick={onViewDelete} title="Delete this view">
+                                Delete
+                            </UI.Button>
+                        )}
+                    </div>
+                </div>
+
                 <UI.Input
                     label="Search"
                     value={filters.q}
@@ -68,6 +103,32 @@ NetWatcher.Components.Filters = function({
                     isSearching={isSearching}
                 />
 
+                <div className="filter-group filter-group-select">
+                    <label className="filter-label">Anomaly Score</label>
+                    <select
+                        className="filter-input"
+                        value={filters.minScore}
+                        onChange={(e) => updateFilter('minScore', e.target.value)}
+                    >
+                        <option value="">Any</option>
+                        <option value="25">25+</option>
+                        <option value="50">50+</option>
+                        <option value="75">75+</option>
+                    </select>
+                </div>
+
+                <div className="filter-group filter-group-select">
+                    <label className="filter-label">Sort By</label>
+                    <select
+                        className="filter-input"
+                        value={filters.sort}
+                        onChange={(e) => updateFilter('sort', e.target.value)}
+                    >
+                        <option value="time">Newest first</option>
+                        <option value="score">Highest score</option>
+                    </select>
+                </div>
+
                 <div className="filter-group filter-group-actions">
                     <label className="filter-label">&nbsp;</label>
                     <div className="filter-actions-row">
@@ -89,6 +150,11 @@ NetWatcher.Components.Filters = function({
                     </div>
                 </div>
             </div>
+            {extraFilters.length > 0 && (
+                <div className="filters-extra">
+                    Also filtered by {extraFilters.map(([key, value]) => `${key}=${value}`).join(', ')}
+                </div>
+            )}
         </div>
     );
 };
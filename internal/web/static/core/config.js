@@ -6,7 +6,7 @@ NetWatcher.CONFIG = {
     API_BASE: '',
     DEBOUNCE_DELAY: 300,
     AUTO_REFRESH_INTERVAL: 30000,
+    LIVE_REFRESH_INTERVAL: 2000,
     DEFAULT_PAGE_SIZE: 20,
-    PAGE_SIZE_OPTIONS: [10, 20, 50, 100],
-    MAX_VISIBLE_PAGES: 5
+    PAGE_SIZE_OPTIONS: [10, 20, 50, 100]
 };
@@ -41,21 +41,31 @@ NetWatcher.useClickOutside = function(ref, handler) {
 
 /**
  * WebSocket hook for real-time event streaming
+ * onUpdate receives (flowId, changedFields) for events that update a flow
+ * already delivered, e.g. the byte count and duration set when it closes
  */
-NetWatcher.useWebSocket = function(enabled, onEvent) {
+NetWatcher.useWebSocket = function(enabled, onEvent, onUpdate) {
     const wsRef = useRef(null);
     const [connected, setConnected] = useState(false);
     const [eventCount, setEventCount] = useState(0);
     const reconnectTimeoutRef = useRef(null);
+    // Last event received, so a reconnect replays what was missed
+    const lastIdRef = useRef(0);
 
     const connect = useCallback(() => {
         if (wsRef.current?.readyState === WebSocket.OPEN) return;
 
         const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+        const params = new URLSearchParams();
+        if (lastIdRef.current) params.set('afterId', lastIdRef.current);
         const wsUrl = `${protocol}//${window.location.host}/api/ws`;
         
-        console.log('[WS] Connecting to', wsUrl);
-        const ws = new WebSocket(wsUrl);
+        console.log('[WS] Connecting to', wsUrl, params.toString());
+        // Browsers cannot send headers with a WebSocket, so the token goes in the URL
+        const token = NetWatcher.Auth.token();
+        if (token) params.set('token', token);
+        const query = params.toString();
+        const ws = new WebSocket(query ? `${wsUrl}?${query}` : wsUrl);
 
         ws.onopen = () => {
             console.log('[WS] Connected');
@@ -68,9 +78,17 @@ NetWatcher.useWebSocket = function(enabled, onEvent) {
                 const messages = event.data.split('\n').filter(m => m.trim());
                 messages.forEach(msg => {
                     const parsed = JSON.parse(msg);
+                    const id = parsed.type === 'event' ? parsed.data.ID : parsed.id;
+                    if (id > lastIdRef.current) {
+                        lastIdRef.current = id;
+                    }
                     if (parsed.type === 'event' && onEvent) {
                         onEvent(parsed.data);
                         setEventCount(c => c + 1);
+                    } else if (parsed.type === 'update' && onUpdate) {
+                        onUpdate(parsed.flowId, parsed.data);
+                    } else if (parsed.type === 'replayed') {
+                        console.log('[WS] Replayed missed events', parsed.count);
                     }
                 });
             } catch (err) {
@@ -97,7 +115,7 @@ NetWatcher.useWebSocket = function(enabled, onEvent) {
         };
 
         wsRef.current = ws;
-    }, [enabled, onEvent]);
+    }, [enabled, onEvent, onUpdate]);
 
     const disconnect = useCallback(() => {
         if (reconnectTimeoutRef.current) {
@@ -108,6 +126,7 @@ NetWatcher.useWebSocket = function(enabled, onEvent) {
             wsRef.current.close(1000, 'User disconnected');
             wsRef.current = null;
         }
+        lastIdRef.current = 0;
         setConnected(false);
     }, []);
 
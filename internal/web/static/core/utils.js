@@ -46,6 +46,12 @@ NetWatcher.Utils = {
         return 'default';
     },
 
+    getScoreClass(score) {
+        if (score >= 75) return 'score-high';
+        if (score >= 50) return 'score-medium';
+        return 'score-low';
+    },
+
     buildQueryParams(params) {
         const searchParams = new URLSearchParams();
         Object.entries(params).forEach(([key, value]) => {
@@ -60,3 +66,43 @@ NetWatcher.Utils = {
         return searchParams.toString();
     }
 };
+
+/**
+ * API token, for servers started with --api-tokens. It is kept in
+ * localStorage and sent with every API request; a request answered 401
+ * asks for a token and is retried with it.
+ */
+NetWatcher.Auth = (function() {
+    const STORAGE_KEY = 'netwatcher.apiToken';
+    const nativeFetch = window.fetch.bind(window);
+
+    function token() {
+        return localStorage.getItem(STORAGE_KEY) || '';
+    }
+
+    function send(input, init, used) {
+        const headers = new Headers(init.headers || {});
+        if (used) headers.set('Authorization', `Bearer ${used}`);
+        return nativeFetch(input, { ...init, headers });
+    }
+
+    window.fetch = async function(input, init = {}) {
+        const url = typeof input === 'string' ? input : input.url;
+        if (!url.includes('/api/')) return nativeFetch(input, init);
+
+        const used = token();
+        const res = await send(input, init, used);
+        if (res.status !== 401) return res;
+
+        // Another request may have asked already while this one was out
+        let current = token();
+        if (current === used) {
+            current = (window.prompt('This Net Watcher needs an API token:') || '').trim();
+            if (!current) return res;
+            localStorage.setItem(STORAGE_KEY, current);
+        }
+        return send(input, init, current);
+    };
+
+    return { token };
+})();
@@ -147,6 +147,99 @@ function StatsSummary({ hosts, metric, hostType, total }) {
     );
 }
 
+/**
+ * Address with its port, if any
+ */
+function endpoint(ip, port) {
+    if (!port) return ip;
+    return ip.includes(':') ? `[${ip}]:${port}` : `${ip}:${port}`;
+}
+
+/**
+ * Active Connections - sessions being tracked right now, refreshed live
+ */
+function ActiveConnections() {
+    const [connections, setConnections] = useState([]);
+    const [total, setTotal] = useState(0);
+    const [available, setAvailable] = useState(true);
+
+    const fetchConnections = useCallback(async () => {
+        try {
+            const res = await fetch(`${CONFIG.API_BASE}/api/connections/active?limit=20`);
+            if (!res.ok) {
+                // No capture in this process (e.g. serving a copied database)
+                setAvailable(false);
+                return;
+            }
+            const data = await res.json();
+            setConnections(data.connections || []);
+            setTotal(data.total || 0);
+            setAvailable(true);
+        } catch (err) {
+            console.error('Failed to fetch active connections:', err);
+        }
+    }, []);
+
+    useEffect(() => {
+        fetchConnections();
+        const interval = setInterval(fetchConnections, CONFIG.LIVE_REFRESH_INTERVAL);
+        return () => clearInterval(interval);
+    }, [fetchConnections]);
+
+    if (!available) return null;
+
+    return (
+        <div className="dashboard-card">
+            <div className="dashboard-card-header">
+                <h2>
+                    Active Connections
+                    <span className="dashboard-card-subtitle">
+                        {Utils.formatNumber(total)} tracked now
+                    </span>
+                </h2>
+            </div>
+            <div className="dashboard-card-content">
+                {connections.length === 0 ? (
+                    <UI.EmptyState
+                        icon={Icon.BarChart}
+                        title="No active connections"
+                        description="Connections appear here while they are open"
+                    />
+                ) : (
+                    <table className="connections-table">
+                        <thead>
+                            <tr>
+                                <th>Protocol</th>
+                                <th>Source</th>
+                                <th>Destination</th>
+                                <th>Host</th>
+                                <th className="numeric">Duration</th>
+                                <th className="numeric">Bytes</th>
+                            </tr>
+                        </thead>
+                        <tbody>
+                            {connections.map(c => {
+                                const src = endpoint(c.srcIp, c.srcPort);
+                                const dst = endpoint(c.dstIp, c.dstPort);
+                                return (
+                                    <tr key={c.flowId || `${src}-${dst}`}>
+                                        <td className="connections-protocol">{c.protocol}</td>
+                                        <td title={src}>{src}</td>
+                                        <td title={dst}>{dst}</td>
+                                        <td title={c.hostname}>{c.hostname || '-'}</td>
+                                        <td className="numeric">{Utils.formatDuration(c.duration)}</td>
+                                        <td className="numeric">{Utils.formatBytes(c.bytes)}</td>
+                                    </tr>
+                                );
+                            })}
+                        </tbody>
+                    </table>
+                )}
+            </div>
+        </div>
+    );
+}
+
 /**
  * Dashboard Page
  */
@@ -272,6 +365,9 @@ NetWatcher.Pages.DashboardPage = function() {
                         )}
                     </div>
                 </div>
+
+                {/* What's talking right now */}
+                <ActiveConnections />
             </div>
         </>
     );
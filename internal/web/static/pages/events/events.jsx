@@ -10,6 +10,11 @@ const { CONFIG, Utils, useDebounce, useWebSocket, useApp, Layout, Components } =
  * Check if an event matches the current filters
  */
 function eventMatchesFilters(event, filters) {
+    // Filters from a saved view that only the server evaluates
+    if (Object.keys(filters.extra).length > 0) {
+        return false;
+    }
+
     // Check event type filter
     if (filters.eventTypes.length > 0 && !filters.eventTypes.includes(event.EventType)) {
         return false;
@@ -25,6 +30,11 @@ function eventMatchesFilters(event, filters) {
         return false;
     }
     
+    // Check anomaly score filter
+    if (filters.minScore && (event.AnomalyScore || 0) < Number(filters.minScore)) {
+        return false;
+    }
+    
     // Check query filter (matches hostname, DNS query, TLS SNI, or IPs)
     if (filters.q) {
         const q = filters.q.toLowerCase();
@@ -44,15 +54,54 @@ function eventMatchesFilters(event, filters) {
     return true;
 }
 
+// Filter fields of the page, and the saved view parameters they map to
+const UI_FILTER_PARAMS = ['q', 'eventType', 'srcIP', 'dstIP', 'minScore', 'sort'];
+
+/**
+ * Convert page filters to saved view parameters
+ */
+function filtersToParams(filters) {
+    const params = { ...filters.extra };
+    if (filters.q) params.q = filters.q;
+    if (filters.eventTypes.length > 0) params.eventType = filters.eventTypes.join(',');
+    if (filters.srcIP) params.srcIP = filters.srcIP;
+    if (filters.dstIP) params.dstIP = filters.dstIP;
+    if (filters.minScore) params.minScore = filters.minScore;
+    if (filters.sort === 'score') params.sort = 'score';
+    return params;
+}
+
+/**
+ * Convert saved view parameters to page filters
+ */
+function paramsToFilters(params) {
+    const extra = {};
+    Object.entries(params || {}).forEach(([key, value]) => {
+        if (!UI_FILTER_PARAMS.includes(key)) extra[key] = value;
+    });
+    return {
+        q: params.q || '',
+        eventTypes: params.eventType ? params.eventType.split(',') : [],
+        srcIP: params.srcIP || '',
+        dstIP: params.dstIP || '',
+        minScore: params.minScore || '',
+        sort: params.sort === 'score' ? 'score' : 'time',
+        extra
+    };
+}
+
+// Page number for display, and the cursor the page is fetched from
+const FIRST_PAGE = { page: 1, cursor: '', direction: '' };
+
 /**
  * Events Page - Main events view
  */
 NetWatcher.Pages.EventsPage = function() {
     const [events, setEvents] = useState([]);
     const [total, setTotal] = useState(0);
-    const [page, setPage] = useState(1);
+    const [position, setPosition] = useState(FIRST_PAGE);
+    const [cursors, setCursors] = useState({ next: '', prev: '' });
     const [pageSize, setPageSize] = useState(CONFIG.DEFAULT_PAGE_SIZE);
-    const [totalPages, setTotalPages] = useState(0);
     const [loading, setLoading] = useState(true);
     const [stats, setStats] = useState(null);
     const [eventTypes, setEventTypes] = useState([]);
@@ -60,8 +109,13 @@ NetWatcher.Pages.EventsPage = function() {
         q: '',
         eventTypes: [],
         srcIP: '',
-        dstIP: ''
+        dstIP: '',
+        minScore: '',
+        sort: 'time',
+        extra: {}
     });
+    const [views, setViews] = useState([]);
+    const [viewId, setViewId] = useState('');
     
     // Live updates state
     const [liveEnabled, setLiveEnabled] = useState(false);
@@ -89,12 +143,20 @@ NetWatcher.Pages.EventsPage = function() {
         }
     }, []);
 
+    // Apply flow updates to rows already on screen or buffered
+    const handleFlowUpdate = useCallback((flowId, changes) => {
+        const apply = list => list.map(e => e.FlowID === flowId ? { ...e, ...changes } : e);
+        setEvents(apply);
+        setNewEventsBuffer(apply);
+    }, []);
+
     // WebSocket connection
-    const { connected, eventCount } = useWebSocket(liveEnabled, handleNewEvent);
+    const { connected, eventCount } = useWebSocket(liveEnabled, handleNewEvent, handleFlowUpdate);
 
-    // Merge new events into display when on page 1
+    // Merge new events into display when on page 1 of the newest-first view
+    const onFirstPage = position.cursor === '' && position.direction === '';
     useEffect(() => {
-        if (newEventsBuffer.length > 0 && page === 1) {
+        if (newEventsBuffer.length > 0 && onFirstPage && debouncedFilters.sort !== 'score') {
             setEvents(prev => {
                 // Prepend new events and trim to page size
                 const merged = [...newEventsBuffer, ...prev];
@@ -110,18 +172,22 @@ NetWatcher.Pages.EventsPage = function() {
             setTotal(prev => prev + newEventsBuffer.length);
             setNewEventsBuffer([]);
         }
-    }, [newEventsBuffer, page, pageSize]);
+    }, [newEventsBuffer, onFirstPage, pageSize, debouncedFilters.sort]);
 
     // Fetch events
     const fetchEvents = useCallback(async () => {
         setLoading(true);
         const params = Utils.buildQueryParams({
-            page,
+            cursor: position.cursor,
+            direction: position.direction,
             pageSize,
             q: debouncedFilters.q,
             srcIP: debouncedFilters.srcIP,
             dstIP: debouncedFilters.dstIP,
-            eventType: debouncedFilters.eventTypes
+            eventType: debouncedFilters.eventTypes,
+            minScore: debouncedFilters.minScore,
+            sort: debouncedFilters.sort === 'score' ? 'score' : '',
+            ...debouncedFilters.extra
         });
 
         try {
@@ -129,13 +195,32 @@ NetWatcher.Pages.EventsPage = function() {
             const data = await res.json();
             setEvents(data.events || []);
             setTotal(data.total || 0);
-            setTotalPages(data.totalPages || 0);
+            setCursors({ next: data.nextCursor || '', prev: data.prevCursor || '' });
         } catch (err) {
             console.error('Failed to fetch events:', err);
             setEvents([]);
         }
         setLoading(false);
-    }, [page, pageSize, debouncedFilters]);
+    }, [position, pageSize, debouncedFilters]);
+
+    const totalPages = Math.max(1, Math.ceil(total / pageSize));
+
+    // Move between pages by the cursors of the current one
+    const changePage = useCallback((target) => {
+        switch (target) {
+            case 'next':
+                setPosition(p => ({ page: p.page + 1, cursor: cursors.next, direction: '' }));
+                break;
+            case 'prev':
+                setPosition(p => ({ page: p.page - 1, cursor: cursors.prev, direction: 'prev' }));
+                break;
+            case 'last':
+                setPosition({ page: totalPages, cursor: '', direction: 'prev' });
+                break;
+            default:
+                setPosition(FIRST_PAGE);
+        }
+    }, [cursors, totalPages]);
 
     // Fetch stats
     const fetchStats = useCallback(async () => {
@@ -158,6 +243,63 @@ NetWatcher.Pages.EventsPage = function() {
         }
     }, []);
 
+    // Fetch saved views
+    const fetchViews = useCallback(async () => {
+        try {
+            const res = await fetch(`${CONFIG.API_BASE}/api/views`);
+            const data = await res.json();
+            setViews(data.views || []);
+        } catch (err) {
+            console.error('Failed to fetch views:', err);
+        }
+    }, []);
+
+    // Apply a saved view, or keep the current filters for none
+    const applyView = useCallback((id) => {
+        setViewId(id);
+        const view = views.find(v => String(v.id) === id);
+        if (view) {
+            setFilters(paramsToFilters(view.filters));
+        }
+    }, [views]);
+
+    // Save the current filters, replacing the view of the same name
+    const saveView = useCallback(async () => {
+        const current = views.find(v => String(v.id) === viewId);
+        const name = window.prompt('Save filters as view:', current ? current.name : '');
+        if (!name || !name.trim()) return;
+        const existing = views.find(v => v.name === name.trim());
+        const res = await fetch(`${CONFIG.API_BASE}/api/views${existing ? `/${existing.id}` : ''}`, {
+            method: existing ? 'PUT' : 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                name: name.trim(),
+                description: existing ? existing.description : '',
+                filters: filtersToParams(filters)
+            })
+        });
+        if (!res.ok) {
+            window.alert(`Failed to save view: ${await res.text()}`);
+            return;
+        }
+        const saved = await res.json();
+        await fetchViews();
+        setViewId(String(saved.id));
+    }, [views, viewId, filters, fetchViews]);
+
+    // Delete the selected view
+    const deleteView = useCallback(async () => {
+        const view = views.find(v => String(v.id) === viewId);
+        if (!view || !window.confirm(`Delete view "${view.name}"?`)) return;
+        const res = await fetch(`${CONFIG.API_BASE}/api/views/${view.id}`, { method: 'DELETE' });
+        if (!res.ok) {
+            window.alert(`Failed to delete view: ${await res.text()}`);
+            return;
+        }
+        setViewId('');
+        fetchViews();
+    }, [views, viewId, fetchViews]);
+
     // Fetch version
     const fetchVersion = useCallback(async () => {
         try {
@@ -169,10 +311,10 @@ NetWatcher.Pages.EventsPage = function() {
         }
     }, [setVersion]);
 
-    // Reset page when filters change
+    // Reset page when filters or page size change
     useEffect(() => {
-        setPage(1);
-    }, [debouncedFilters]);
+        setPosition(FIRST_PAGE);
+    }, [debouncedFilters, pageSize]);
 
     // Fetch events when dependencies change
     useEffect(() => {
@@ -183,8 +325,9 @@ NetWatcher.Pages.EventsPage = function() {
     useEffect(() => {
         fetchStats();
         fetchEventTypes();
+        fetchViews();
         fetchVersion();
-    }, [fetchStats, fetchEventTypes, fetchVersion]);
+    }, [fetchStats, fetchEventTypes, fetchViews, fetchVersion]);
 
     // Auto-refresh stats
     useEffect(() => {
@@ -205,15 +348,22 @@ NetWatcher.Pages.EventsPage = function() {
                     onLiveToggle={() => setLiveEnabled(prev => !prev)}
                     liveConnected={connected}
                     liveEventCount={eventCount}
+                    views={views}
+                    viewId={viewId}
+                    onViewSelect={applyView}
+                    onViewSave={saveView}
+                    onViewDelete={deleteView}
                 />
                 <Components.EventsCard
                     events={events}
                     loading={loading}
                     total={total}
-                    page={page}
+                    page={position.page}
                     totalPages={totalPages}
                     pageSize={pageSize}
-                    onPageChange={setPage}
+                    hasPrev={cursors.prev !== ''}
+                    hasNext={cursors.next !== ''}
+                    onPageChange={changePage}
                     onPageSizeChange={setPageSize}
                     isSearching={isSearching}
                 />
@@ -0,0 +1,169 @@
+package web
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// TimelineGroups are the groupBy values of /api/traffic-timeline
+var TimelineGroups = []string{"host", "protocol", "interface"}
+
+// Series limits of a grouped timeline: the busiest hosts or interfaces
+// get a series each, the rest are summed into "other"
+const (
+	defaultTimelineSeries = 10
+	maxTimelineSeries     = 50
+)
+
+// otherSeries names the series of everything outside the busiest groups
+const otherSeries = "other"
+
+// TimelineSeries is the traffic of one host, protocol or interface, on the
+// same buckets as the timeline's Data so series can be stacked
+type TimelineSeries struct {
+	Name     string             `json:"name"`
+	Data     []TrafficDataPoint `json:"data"`
+	TotalIn  int64              `json:"totalIn"`
+	TotalOut int64              `json:"totalOut"`
+	Events   int64              `json:"events"`
+}
+
+// validateTimelineGroup checks a groupBy parameter
+func validateTimelineGroup(groupBy string) error {
+	if groupBy != "" && !slices.Contains(TimelineGroups, groupBy) {
+		return fmt.Errorf("unknown groupBy %q, expected one of %s", groupBy, strings.Join(TimelineGroups, ", "))
+	}
+	return nil
+}
+
+// timelineProtocol is the protocol an event type is charted under, so the
+// START and END events and compacted records of a flow share a series
+func timelineProtocol(eventType string) string {
+	switch eventType {
+	case string(database.EventTLSSNI):
+		return "TLS"
+	}
+	eventType = strings.TrimSuffix(eventType, "_START")
+	return strings.TrimSuffix(eventType, "_END")
+}
+
+// groupedTimeline splits the timeline into one series per host, protocol or
+// interface from the rollups. Hosts and interfaces are ranked by bytes, or
+// by events with byEvents, and those beyond limit are summed into "other",
+// the part of total no series covers.
+func (s *Server) groupedTimeline(groupBy string, start, end time.Time, bucket timelineBucket, limit int, byEvents bool, total []TrafficDataPoint) ([]TimelineSeries, error) {
+	dimension, name := database.RollupHost, func(n string) string { return n }
+	switch groupBy {
+	case "protocol":
+		dimension, name = database.RollupType, timelineProtocol
+	case "interface":
+		dimension = database.RollupInterface
+	}
+
+	var names []string
+	if dimension != database.RollupType {
+		top, err := s.reader().RollupTop(dimension, start, end, limit, !byEvents)
+		if err != nil {
+			return nil, err
+		}
+		names = make([]string, 0, len(top))
+		for _, t := range top {
+			names = append(names, t.Name)
+		}
+	}
+	rows, err := s.reader().RollupSeries(dimension, start, end, bucket.size, names)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows come in bucket order, so each series is built in time order
+	byName := make(map[string]*TimelineSeries)
+	for _, r := range rows {
+		n := name(r.Name)
+		series, ok := byName[n]
+		if !ok {
+			series = &TimelineSeries{Name: n}
+			byName[n] = series
+		}
+		ts := r.Bucket.UTC().Truncate(bucket.size)
+		if k := len(series.Data); k == 0 || !series.Data[k-1].Timestamp.Equal(ts) {
+			series.Data = append(series.Data, TrafficDataPoint{Timestamp: ts})
+		}
+		p := &series.Data[len(series.Data)-1]
+		p.BytesIn += r.BytesIn
+		p.BytesOut += r.BytesOut
+		p.EventCount += r.Events
+		series.TotalIn += r.BytesIn
+		series.TotalOut += r.BytesOut
+		series.Events += r.Events
+	}
+
+	series := make([]TimelineSeries, 0, len(byName)+1)
+	for _, sr := range byName {
+		sr.Data = fillTimeGaps(sr.Data, start, end, bucket.size)
+		series = append(series, *sr)
+	}
+	slices.SortFunc(series, func(a, b TimelineSeries) int {
+		if byEvents {
+			return cmp.Or(cmp.Compare(b.Events, a.Events), strings.Compare(a.Name, b.Name))
+		}
+		return cmp.Or(cmp.Compare(b.TotalIn+b.TotalOut, a.TotalIn+a.TotalOut), cmp.Compare(b.Events, a.Events), strings.Compare(a.Name, b.Name))
+	})
+
+	// What the named series leave of the total
+	if names != nil {
+		rest := make(map[int64]TrafficDataPoint, len(total))
+		for _, p := range total {
+			rest[p.Timestamp.Unix()] = p
+		}
+		for _, sr := range byName {
+			for _, p := range sr.Data {
+				r := rest[p.Timestamp.Unix()]
+				r.BytesIn -= p.BytesIn
+				r.BytesOut -= p.BytesOut
+				r.EventCount -= p.EventCount
+				rest[p.Timestamp.Unix()] = r
+			}
+		}
+		other := &TimelineSeries{Name: otherSeries}
+		for _, p := range total {
+			r := rest[p.Timestamp.Unix()]
+			if r.BytesIn == 0 && r.BytesOut == 0 && r.EventCount == 0 {
+				continue
+			}
+			r.Timestamp = p.Timestamp
+			other.Data = append(other.Data, r)
+			other.TotalIn += r.BytesIn
+			other.TotalOut += r.BytesOut
+			other.Events += r.EventCount
+		}
+		if len(other.Data) > 0 {
+			other.Data = fillTimeGaps(other.Data, start, end, bucket.size)
+			series = append(series, *other)
+		}
+	}
+	return series, nil
+}
+
+// keepTimestamps drops the points of series whose timestamps are not in
+// kept, so series follow the downsampled timeline
+func keepTimestamps(series []TimelineSeries, kept []TrafficDataPoint) {
+	times := make(map[int64]bool, len(kept))
+	for _, p := range kept {
+		times[p.Timestamp.Unix()] = true
+	}
+	for i := range series {
+		data := series[i].Data[:0]
+		for _, p := range series[i].Data {
+			if times[p.Timestamp.Unix()] {
+				data = append(data, p)
+			}
+		}
+		series[i].Data = data
+	}
+}
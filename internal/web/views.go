@@ -0,0 +1,136 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// ViewRequest is the body of POST /api/views and PUT /api/views/{id}
+type ViewRequest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Filters     map[string]string `json:"filters"` // events API parameters, e.g. {"srcIP": "10.20.", "query": "dst_port=443"}
+}
+
+// viewParams are the filter names a view may store: the event filters and
+// the sort order of the events page
+var viewParams = append([]string{"sort"}, database.FilterParams...)
+
+// handleViews lists saved views (GET) or creates one (POST)
+func (s *Server) handleViews(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		views, err := s.db.Views()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"views": views})
+	case http.MethodPost:
+		view, ok := decodeView(w, r)
+		if !ok {
+			return
+		}
+		s.saveView(w, view, http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleView returns (GET), replaces (PUT) or deletes (DELETE) one view
+func (s *Server) handleView(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "view not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		view, err := s.db.View(uint(id))
+		if err != nil {
+			viewError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+	case http.MethodPut:
+		view, ok := decodeView(w, r)
+		if !ok {
+			return
+		}
+		view.ID = uint(id)
+		s.saveView(w, view, http.StatusOK)
+	case http.MethodDelete:
+		if err := s.db.DeleteView(uint(id)); err != nil {
+			viewError(w, err)
+			return
+		}
+		s.logger.Info("[VIEWS] Deleted", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeView reads and validates a ViewRequest
+func decodeView(w http.ResponseWriter, r *http.Request) (*database.SavedView, bool) {
+	var req ViewRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return nil, false
+	}
+	view := &database.SavedView{Name: req.Name, Description: req.Description, Filters: map[string]string{}}
+	for name, value := range req.Filters {
+		if !slices.Contains(viewParams, name) {
+			http.Error(w, "unknown filter "+strconv.Quote(name), http.StatusBadRequest)
+			return nil, false
+		}
+		if value != "" {
+			view.Filters[name] = value
+		}
+	}
+	if _, err := view.Filter(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return view, true
+}
+
+// saveView stores a view and writes it back with the given status
+func (s *Server) saveView(w http.ResponseWriter, view *database.SavedView, status int) {
+	if err := s.db.SaveView(view); err != nil {
+		viewError(w, err)
+		return
+	}
+	if saved, err := s.db.View(view.ID); err == nil {
+		view = saved
+	}
+	s.logger.Info("[VIEWS] Saved", "id", view.ID, "name", view.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(view)
+}
+
+// viewError maps a saved view error to its HTTP status
+func viewError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrViewNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrViewExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,751 @@
+// Code generated by net-watcher openapi --client ts; DO NOT EDIT.
+// Client of the net-watcher REST API
+
+export interface ActiveConnections {
+  connections: ActiveSession[];
+  total: number;
+}
+
+export interface ActiveSession {
+  flowId?: string;
+  protocol: string;
+  interface: string;
+  srcIp: string;
+  srcPort?: number;
+  dstIp: string;
+  dstPort?: number;
+  hostname?: string;
+  startTime: string;
+  lastSeen: string;
+  duration: number;
+  bytes: number;
+  srcBytes: number;
+  dstBytes: number;
+}
+
+export interface Beacon {
+  srcIp: string;
+  dstIp: string;
+  dstPort: number;
+  protocol: string;
+  domain?: string;
+  connections: number;
+  firstSeen: string;
+  lastSeen: string;
+  interval: number;
+  jitter: number;
+  medianBytes: number;
+  sizeJitter: number;
+  score: number;
+  detectedAt: string;
+}
+
+export interface BeaconsResponse {
+  beacons: Beacon[];
+}
+
+export interface BehaviorItem {
+  name: string;
+  firstSeen: string;
+  eventCount: number;
+}
+
+export interface DNSClientErrors {
+  ip: string;
+  queries: number;
+  nxdomain: number;
+  rate: number;
+}
+
+export interface DNSDomainVolume {
+  name: string;
+  queries: number;
+  clients: number;
+}
+
+export interface DNSRegisteredDomain {
+  domain: string;
+  subdomains: number;
+  queries: number;
+}
+
+export interface DNSResponse {
+  startTime: string;
+  endTime: string;
+  totalQueries: number;
+  domains: DNSDomainVolume[];
+  registeredDomains: DNSRegisteredDomain[];
+  responseTimes: DNSResponseTimes;
+  clients: DNSClientErrors[];
+}
+
+export interface DNSResponseTimes {
+  samples: number;
+  p50: number;
+  p90: number;
+  p95: number;
+  p99: number;
+  max: number;
+}
+
+export interface Destination {
+  kind: string;
+  name: string;
+  firstSeen: string;
+  lastSeen: string;
+  firstClient: string;
+  events: number;
+}
+
+export interface DeviceBehavior {
+  ip: string;
+  newDevice: boolean;
+  newDomains: BehaviorItem[];
+  newPorts: BehaviorItem[];
+  moreDomains?: number;
+  morePorts?: number;
+}
+
+export interface DeviceCount {
+  name: string;
+  eventCount: number;
+  byteCount: number;
+}
+
+export interface DeviceSummary {
+  ip: string;
+  sensor?: string;
+  firstSeen: string;
+  lastSeen: string;
+  eventCount: number;
+  bytesOut: number;
+  bytesIn: number;
+  topDomains: DeviceCount[];
+  topDestinations: DeviceCount[];
+  protocols: Record<string, number>;
+}
+
+export interface DevicesResponse {
+  devices: DeviceSummary[];
+  total: number;
+  page: number;
+  pageSize: number;
+  startTime: string;
+  endTime: string;
+}
+
+export interface EventsResponse {
+  events: NetworkEvent[];
+  total: number;
+  pageSize: number;
+  nextCursor?: string;
+  prevCursor?: string;
+}
+
+export interface IngestRejection {
+  index: number;
+  error: string;
+}
+
+export interface IngestRequest {
+  sensor: string;
+  events: NetworkEvent[];
+}
+
+export interface IngestResponse {
+  accepted: number;
+  duplicates: number;
+  rejected?: IngestRejection[];
+}
+
+export interface JobList {
+  jobs: JobStatus[];
+}
+
+export interface JobRun {
+  job: string;
+  status: string;
+}
+
+export interface JobStatus {
+  name: string;
+  schedule: string;
+  jitter?: string;
+  running: boolean;
+  runs: number;
+  lastRun?: string;
+  lastDuration?: string;
+  lastError?: string;
+  nextRun?: string;
+}
+
+export interface NetworkEvent {
+  ID: number;
+  Timestamp: string;
+  EventType: string;
+  Interface: string;
+  VLAN: number;
+  InnerVLAN: number;
+  IPVersion: number;
+  FlowID: string;
+  Sensor: string;
+  Tunnel: string;
+  TunnelID: number;
+  TunnelSrcIP: string;
+  TunnelDstIP: string;
+  SrcIP: string;
+  SrcPort: number;
+  DstIP: string;
+  DstPort: number;
+  DNSType: string;
+  DNSID: number;
+  DNSQuery: string;
+  DNSAnswers: string;
+  DNSCNAMEs: string;
+  DNSRCode: string;
+  DNSAnswerCount: number;
+  DNSTTL: number;
+  TLSSNI: string;
+  TLSJA3: string;
+  TLSJA4: string;
+  TLSVersion: string;
+  TLSCipher: string;
+  TLSALPN: string;
+  TLSECH: boolean;
+  RemoteVersion: string;
+  RemoteClient: string;
+  RemoteServer: string;
+  ShareServer: string;
+  Shares: string;
+  ShareVersion: string;
+  NTPVersion: number;
+  NTPStratum: number;
+  NTPRefID: string;
+  Hostname: string;
+  DNSAge: number;
+  Duration: number;
+  ByteCount: number;
+  SrcBytes: number;
+  DstBytes: number;
+  Reason: string;
+  EndTime: string;
+  ICMPType: number;
+  ICMPCode: number;
+  ICMPDesc: string;
+  ICMPOrigProto: string;
+  ICMPOrigSrcIP: string;
+  ICMPOrigSrcPort: number;
+  ICMPOrigDstIP: string;
+  ICMPOrigDstPort: number;
+  Protocol: string;
+  Threat: boolean;
+  ThreatList: string;
+  AnomalyScore: number;
+  AnomalyReasons: string;
+  Tags: string;
+  P2P: string;
+  CaptureFile: string;
+  CaptureFrame: number;
+  Compacted: boolean;
+  OriginalRef: string;
+  EventCount: number;
+  Repeats: number;
+  Hash: string;
+}
+
+export interface NewBehaviorResponse {
+  weekStart: string;
+  weekEnd: string;
+  devices: DeviceBehavior[];
+}
+
+export interface NewDestinationsResponse {
+  since: string;
+  destinations: Destination[];
+}
+
+export interface PurgeRequest {
+  before: string;
+  domain: string;
+  ip: string;
+  dryRun: boolean;
+}
+
+export interface PurgeStats {
+  events: number;
+  originals: number;
+  baselines: number;
+  sizeBefore: number;
+  sizeAfter: number;
+  freed: number;
+  reusable: number;
+}
+
+export interface ReportJob {
+  id: string;
+  status: string;
+  range: string;
+  format: string;
+  sections?: string[];
+  createdAt: string;
+  finishedAt?: string | null;
+  error?: string;
+  statusUrl: string;
+  downloadUrl?: string;
+}
+
+export interface ReportList {
+  reports: ReportJob[];
+}
+
+export interface ReportRequest {
+  range: string;
+  format: string;
+  sections: string[];
+  limit: number;
+  query: string;
+  view: string;
+  compare: string;
+}
+
+export interface SavedView {
+  id: number;
+  name: string;
+  description: string;
+  filters: Record<string, string>;
+  createdAt: string;
+  updatedAt: string;
+}
+
+export interface SessionTable {
+  active: number;
+  max: number;
+  byProtocol: Record<string, number>;
+  tcpTimeout: string;
+  udpTimeout: string;
+  oldestSeen?: string;
+  expired: number;
+  evicted: number;
+}
+
+export interface StatsResponse {
+  totalEvents: number;
+  eventCounts: Record<string, number>;
+  lastEvent?: string | null;
+  firstEvent?: string | null;
+}
+
+export interface TLSFingerprintEntry {
+  fingerprint: string;
+  eventCount: number;
+  clientCount: number;
+  sniCount: number;
+  firstSeen: string;
+  lastSeen: string;
+  clients: string[];
+  snis: string[];
+}
+
+export interface TLSFingerprintsResponse {
+  fingerprints: TLSFingerprintEntry[];
+  total: number;
+  type: string;
+}
+
+export interface TimelineSeries {
+  name: string;
+  data: TrafficDataPoint[];
+  totalIn: number;
+  totalOut: number;
+  events: number;
+}
+
+export interface TopHostEntry {
+  host: string;
+  eventCount: number;
+  byteCount: number;
+  sparkline?: number[];
+}
+
+export interface TopHostsResponse {
+  hosts: TopHostEntry[];
+  total: number;
+  metric: string;
+  hostType: string;
+  sparklineStart?: string | null;
+}
+
+export interface TrafficDataPoint {
+  timestamp: string;
+  bytesIn: number;
+  bytesOut: number;
+  eventCount: number;
+}
+
+export interface TrafficTimelineResponse {
+  data: TrafficDataPoint[];
+  startTime: string;
+  endTime: string;
+  bucketSize: string;
+  totalIn: number;
+  totalOut: number;
+  buckets: number;
+  downsampled?: boolean;
+  groupBy?: string;
+  series?: TimelineSeries[];
+}
+
+export interface VersionResponse {
+  version: string;
+  buildTime?: string;
+}
+
+export interface ViewList {
+  views: SavedView[];
+}
+
+export interface ViewRequest {
+  name: string;
+  description: string;
+  filters: Record<string, string>;
+}
+
+export interface ListBeaconsParams {
+  /** Lowest score, 0-100 (default: all stored, 70 and up) */
+  minScore?: number;
+  /** Only this host's beacons */
+  srcIP?: string;
+  /** 1-500 (default: 100) */
+  limit?: number;
+}
+
+export interface GetChartParams {
+  width?: number;
+  height?: number;
+  title?: string;
+}
+
+export interface ListActiveConnectionsParams {
+  /** Connections returned, 1-1000 (default: 50) */
+  limit?: number;
+  /** Only connections of this protocol, e.g. TCP */
+  protocol?: string;
+}
+
+export interface GetNewDestinationsParams {
+  /** How far back, e.g. 24h or 7d (default: 24h) */
+  since?: string;
+  kind?: "domain" | "ip";
+  /** 1-1000 (default: 100) */
+  limit?: number;
+}
+
+export interface ListDevicesParams {
+  /** Start of the range, RFC 3339 or YYYY-MM-DD (default: 24 hours ago) */
+  start?: string;
+  /** End of the range, RFC 3339 or YYYY-MM-DD (default: now) */
+  end?: string;
+  page?: number;
+  /** Devices per page, 1-50 (default: 20) */
+  pageSize?: number;
+  /** Part of the device address */
+  q?: string;
+  /** Include non-local sources */
+  all?: boolean;
+  sort?: "bytes" | "events" | "lastSeen";
+}
+
+export interface GetNewBehaviorParams {
+  /** A day of the week, YYYY-MM-DD (default: the last completed week) */
+  week?: string;
+}
+
+export interface GetDNSAnalyticsParams {
+  /** Start of the range, RFC 3339 or YYYY-MM-DD (default: 24 hours ago) */
+  start?: string;
+  /** End of the range, RFC 3339 or YYYY-MM-DD (default: now) */
+  end?: string;
+  /** Entries per list, 1-100 (default: 20) */
+  limit?: number;
+  /** Only this client's queries */
+  srcIP?: string;
+}
+
+export interface ListEventsParams {
+  /** Events per page, 1-100 (default: 20) */
+  pageSize?: number;
+  /** nextCursor or prevCursor of the previous page */
+  cursor?: string;
+  /** prev pages backwards from cursor */
+  direction?: "next" | "prev";
+  /** Order by time or by anomaly score */
+  sort?: "time" | "score";
+  eventType?: string;
+  srcIP?: string;
+  dstIP?: string;
+  q?: string;
+  startDate?: string;
+  endDate?: string;
+  threat?: string;
+  threatList?: string;
+  dnsRcode?: string;
+  dnsFailed?: string;
+  ja3?: string;
+  ja4?: string;
+  tlsVersion?: string;
+  ech?: string;
+  minScore?: string;
+  anomalyReason?: string;
+  tag?: string;
+  vlan?: string;
+  p2p?: string;
+  /** Filter expression, e.g. dst_port=443 AND threat=true */
+  query?: string;
+}
+
+export interface ListTLSFingerprintsParams {
+  /** Fingerprints returned */
+  limit?: number;
+  type?: "ja4" | "ja3";
+  /** rare lists the least common first */
+  order?: "common" | "rare";
+  /** Only fingerprints of this client */
+  srcIP?: string;
+}
+
+export interface GetTopHostsParams {
+  /** Hosts returned, 1-100 (default: 10) */
+  limit?: number;
+  /** Rank by event count or bytes */
+  metric?: "events" | "traffic";
+  /** Group by hostname, source or destination IP */
+  type?: "hostname" | "srcIP" | "dstIP";
+  /** Start of the range, RFC 3339 or YYYY-MM-DD (default: all events, or 24 hours for sparklines) */
+  start?: string;
+  /** End of the range, RFC 3339 or YYYY-MM-DD (default: now) */
+  end?: string;
+  /** Only events captured on this interface */
+  interface?: string;
+  /** Only events sent by local hosts (out) or from outside (in) */
+  direction?: "in" | "out";
+  /** Only these event types, comma-separated */
+  eventType?: string;
+  /** Add hourly values per host over the range (default range: 24 hours) */
+  sparkline?: boolean;
+}
+
+export interface GetTrafficTimelineParams {
+  /** Start of the range, RFC 3339 or YYYY-MM-DD (default: 24 hours ago) */
+  start?: string;
+  /** End of the range, RFC 3339 or YYYY-MM-DD (default: now) */
+  end?: string;
+  /** Finest bucket size wanted */
+  bucket?: "1min" | "5min" | "15min" | "30min" | "1hour" | "2hour" | "6hour" | "1day" | "1week";
+  /** Most data points returned, at least 10 */
+  points?: number;
+  /** Series whose shape downsampling preserves */
+  metric?: "bytes" | "events";
+  /** Add a series per host, protocol or interface */
+  groupBy?: "host" | "protocol" | "interface";
+  /** Hosts or interfaces with a series, 1-50, the rest summed as other (default: 10) */
+  series?: number;
+}
+
+/** A response with a status other than 2xx */
+export class NetWatcherError extends Error {
+  constructor(public readonly status: number, message: string) {
+    super(`net-watcher API: ${status} ${message}`);
+  }
+}
+
+export interface NetWatcherClientOptions {
+  /** Sent as a bearer token: one of --api-tokens, or for /api/ingest its token */
+  token?: string;
+  fetch?: typeof fetch;
+}
+
+/** Client of the net-watcher REST API */
+export class NetWatcherClient {
+  private readonly baseUrl: string;
+
+  constructor(baseUrl: string, private readonly options: NetWatcherClientOptions = {}) {
+    this.baseUrl = baseUrl.replace(/\/+$/, "");
+  }
+
+  private async send(method: string, path: string, params?: object, body?: unknown): Promise<Response> {
+    const query = new URLSearchParams();
+    for (const [name, value] of Object.entries(params ?? {})) {
+      if (value !== undefined && value !== null && value !== "") {
+        query.set(name, String(value));
+      }
+    }
+    const headers: Record<string, string> = {};
+    if (body !== undefined) {
+      headers["Content-Type"] = "application/json";
+    }
+    if (this.options.token) {
+      headers["Authorization"] = `Bearer ${this.options.token}`;
+    }
+    const search = query.toString();
+    const doFetch = this.options.fetch ?? fetch;
+    const response = await doFetch(this.baseUrl + path + (search ? "?" + search : ""), {
+      method,
+      headers,
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!response.ok) {
+      throw new NetWatcherError(response.status, (await response.text()).trim());
+    }
+    return response;
+  }
+
+  /** Lists hosts connecting to a remote service at regular intervals with constant sizes */
+  async listBeacons(params: ListBeaconsParams = {}): Promise<BeaconsResponse> {
+    return (await this.send("GET", `/api/beacons`, params, undefined)).json();
+  }
+
+  /** Renders a chart as an image */
+  async getChart(file: string, params: GetChartParams = {}): Promise<Blob> {
+    return (await this.send("GET", `/api/charts/${encodeURIComponent(String(file))}`, params, undefined)).blob();
+  }
+
+  /** Lists the connections tracked right now, most recently seen first */
+  async listActiveConnections(params: ListActiveConnectionsParams = {}): Promise<ActiveConnections> {
+    return (await this.send("GET", `/api/connections/active`, params, undefined)).json();
+  }
+
+  /** Lists the domains and remote addresses reached for the first time, or the first time in 30 days */
+  async getNewDestinations(params: GetNewDestinationsParams = {}): Promise<NewDestinationsResponse> {
+    return (await this.send("GET", `/api/destinations/new`, params, undefined)).json();
+  }
+
+  /** Lists devices with their traffic, one page at a time */
+  async listDevices(params: ListDevicesParams = {}): Promise<DevicesResponse> {
+    return (await this.send("GET", `/api/devices`, params, undefined)).json();
+  }
+
+  /** Lists the domains and ports devices contacted for the first time in a week */
+  async getNewBehavior(params: GetNewBehaviorParams = {}): Promise<NewBehaviorResponse> {
+    return (await this.send("GET", `/api/devices/new-behavior`, params, undefined)).json();
+  }
+
+  /** Aggregates DNS queries: volume per name, unique subdomains per registered domain, response times and NXDOMAIN rates per client */
+  async getDNSAnalytics(params: GetDNSAnalyticsParams = {}): Promise<DNSResponse> {
+    return (await this.send("GET", `/api/dns`, params, undefined)).json();
+  }
+
+  /** Lists the event types stored */
+  async listEventTypes(): Promise<string[]> {
+    return (await this.send("GET", `/api/event-types`, undefined, undefined)).json();
+  }
+
+  /** Lists events, newest first, one page at a time */
+  async listEvents(params: ListEventsParams = {}): Promise<EventsResponse> {
+    return (await this.send("GET", `/api/events`, params, undefined)).json();
+  }
+
+  /** Returns the events a compacted record was merged from */
+  async getEventOriginals(id: number): Promise<NetworkEvent[]> {
+    return (await this.send("GET", `/api/events/${encodeURIComponent(String(id))}/originals`, undefined, undefined)).json();
+  }
+
+  /** Stores events sent by an external sensor */
+  async ingestEvents(body: IngestRequest): Promise<IngestResponse> {
+    return (await this.send("POST", `/api/ingest`, undefined, body)).json();
+  }
+
+  /** Lists the periodic jobs with their last and next runs */
+  async listJobs(): Promise<JobList> {
+    return (await this.send("GET", `/api/jobs`, undefined, undefined)).json();
+  }
+
+  /** Runs a job now, outside its schedule */
+  async runJob(name: string): Promise<JobRun> {
+    return (await this.send("POST", `/api/jobs/${encodeURIComponent(String(name))}/run`, undefined, undefined)).json();
+  }
+
+  /** Returns this document */
+  async getOpenAPI(): Promise<Record<string, unknown>> {
+    return (await this.send("GET", `/api/openapi.json`, undefined, undefined)).json();
+  }
+
+  /** Deletes the events matching every criterion given */
+  async purgeEvents(body: PurgeRequest): Promise<PurgeStats> {
+    return (await this.send("POST", `/api/purge`, undefined, body)).json();
+  }
+
+  /** Lists report jobs, newest first */
+  async listReports(): Promise<ReportList> {
+    return (await this.send("GET", `/api/reports`, undefined, undefined)).json();
+  }
+
+  /** Starts generating a report */
+  async createReport(body: ReportRequest): Promise<ReportJob> {
+    return (await this.send("POST", `/api/reports`, undefined, body)).json();
+  }
+
+  /** Returns a report job */
+  async getReport(id: string): Promise<ReportJob> {
+    return (await this.send("GET", `/api/reports/${encodeURIComponent(String(id))}`, undefined, undefined)).json();
+  }
+
+  /** Downloads a finished report */
+  async downloadReport(id: string): Promise<Blob> {
+    return (await this.send("GET", `/api/reports/${encodeURIComponent(String(id))}/download`, undefined, undefined)).blob();
+  }
+
+  /** Returns the occupancy and limits of the session table */
+  async getSessionTable(): Promise<SessionTable> {
+    return (await this.send("GET", `/api/sessions`, undefined, undefined)).json();
+  }
+
+  /** Returns the number of events by type and their time span */
+  async getStats(): Promise<StatsResponse> {
+    return (await this.send("GET", `/api/stats`, undefined, undefined)).json();
+  }
+
+  /** Lists TLS client fingerprints with their clients */
+  async listTLSFingerprints(params: ListTLSFingerprintsParams = {}): Promise<TLSFingerprintsResponse> {
+    return (await this.send("GET", `/api/tls/fingerprints`, params, undefined)).json();
+  }
+
+  /** Ranks hosts by events or traffic */
+  async getTopHosts(params: GetTopHostsParams = {}): Promise<TopHostsResponse> {
+    return (await this.send("GET", `/api/top-hosts`, params, undefined)).json();
+  }
+
+  /** Returns traffic in and out over time */
+  async getTrafficTimeline(params: GetTrafficTimelineParams = {}): Promise<TrafficTimelineResponse> {
+    return (await this.send("GET", `/api/traffic-timeline`, params, undefined)).json();
+  }
+
+  /** Returns the server version */
+  async getVersion(): Promise<VersionResponse> {
+    return (await this.send("GET", `/api/version`, undefined, undefined)).json();
+  }
+
+  /** Lists saved views */
+  async listViews(): Promise<ViewList> {
+    return (await this.send("GET", `/api/views`, undefined, undefined)).json();
+  }
+
+  /** Saves a view */
+  async createView(body: ViewRequest): Promise<SavedView> {
+    return (await this.send("POST", `/api/views`, undefined, body)).json();
+  }
+
+  /** Returns a saved view */
+  async getView(id: number): Promise<SavedView> {
+    return (await this.send("GET", `/api/views/${encodeURIComponent(String(id))}`, undefined, undefined)).json();
+  }
+
+  /** Replaces a saved view */
+  async updateView(id: number, body: ViewRequest): Promise<SavedView> {
+    return (await this.send("PUT", `/api/views/${encodeURIComponent(String(id))}`, undefined, body)).json();
+  }
+
+  /** Deletes a saved view */
+  async deleteView(id: number): Promise<void> {
+    await this.send("DELETE", `/api/views/${encodeURIComponent(String(id))}`, undefined, undefined);
+  }
+}
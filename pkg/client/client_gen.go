@@ -0,0 +1,1193 @@
+// Code generated by net-watcher openapi --client go; DO NOT EDIT.
+
+// Package client is a client of the net-watcher REST API
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the net-watcher REST API
+type Client struct {
+	// BaseURL is the web server's address, e.g. http://localhost:8080
+	BaseURL string
+	// Token is sent as a bearer token: one of --api-tokens, or for /api/ingest its token
+	Token string
+	// HTTPClient makes the requests; http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// New creates a client of the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is a response with a status other than 2xx
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("net-watcher API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// send makes a request and returns the body of its 2xx response
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body any) (io.ReadCloser, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	target := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return resp.Body, nil
+}
+
+// call makes a request and decodes its JSON response into out, unless nil
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	rc, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(rc).Decode(out)
+}
+
+// ActiveConnections is a schema of the API
+type ActiveConnections struct {
+	Connections []ActiveSession `json:"connections"`
+	Total       int64           `json:"total"`
+}
+
+// ActiveSession is a schema of the API
+type ActiveSession struct {
+	FlowID    string    `json:"flowId,omitempty"`
+	Protocol  string    `json:"protocol"`
+	Interface string    `json:"interface"`
+	SrcIP     string    `json:"srcIp"`
+	SrcPort   int32     `json:"srcPort,omitempty"`
+	DstIP     string    `json:"dstIp"`
+	DstPort   int32     `json:"dstPort,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"`
+	StartTime time.Time `json:"startTime"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Duration  int64     `json:"duration"`
+	Bytes     int64     `json:"bytes"`
+	SrcBytes  int64     `json:"srcBytes"`
+	DstBytes  int64     `json:"dstBytes"`
+}
+
+// Beacon is a schema of the API
+type Beacon struct {
+	SrcIP       string    `json:"srcIp"`
+	DstIP       string    `json:"dstIp"`
+	DstPort     int32     `json:"dstPort"`
+	Protocol    string    `json:"protocol"`
+	Domain      string    `json:"domain,omitempty"`
+	Connections int64     `json:"connections"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Interval    float64   `json:"interval"`
+	Jitter      float64   `json:"jitter"`
+	MedianBytes int64     `json:"medianBytes"`
+	SizeJitter  float64   `json:"sizeJitter"`
+	Score       int64     `json:"score"`
+	DetectedAt  time.Time `json:"detectedAt"`
+}
+
+// BeaconsResponse is a schema of the API
+type BeaconsResponse struct {
+	Beacons []Beacon `json:"beacons"`
+}
+
+// BehaviorItem is a schema of the API
+type BehaviorItem struct {
+	Name       string    `json:"name"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	EventCount int64     `json:"eventCount"`
+}
+
+// DNSClientErrors is a schema of the API
+type DNSClientErrors struct {
+	IP       string  `json:"ip"`
+	Queries  int64   `json:"queries"`
+	Nxdomain int64   `json:"nxdomain"`
+	Rate     float64 `json:"rate"`
+}
+
+// DNSDomainVolume is a schema of the API
+type DNSDomainVolume struct {
+	Name    string `json:"name"`
+	Queries int64  `json:"queries"`
+	Clients int64  `json:"clients"`
+}
+
+// DNSRegisteredDomain is a schema of the API
+type DNSRegisteredDomain struct {
+	Domain     string `json:"domain"`
+	Subdomains int64  `json:"subdomains"`
+	Queries    int64  `json:"queries"`
+}
+
+// DNSResponse is a schema of the API
+type DNSResponse struct {
+	StartTime         time.Time             `json:"startTime"`
+	EndTime           time.Time             `json:"endTime"`
+	TotalQueries      int64                 `json:"totalQueries"`
+	Domains           []DNSDomainVolume     `json:"domains"`
+	RegisteredDomains []DNSRegisteredDomain `json:"registeredDomains"`
+	ResponseTimes     DNSResponseTimes      `json:"responseTimes"`
+	Clients           []DNSClientErrors     `json:"clients"`
+}
+
+// DNSResponseTimes is a schema of the API
+type DNSResponseTimes struct {
+	Samples int64 `json:"samples"`
+	P50     int64 `json:"p50"`
+	P90     int64 `json:"p90"`
+	P95     int64 `json:"p95"`
+	P99     int64 `json:"p99"`
+	Max     int64 `json:"max"`
+}
+
+// Destination is a schema of the API
+type Destination struct {
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	FirstClient string    `json:"firstClient"`
+	Events      int64     `json:"events"`
+}
+
+// DeviceBehavior is a schema of the API
+type DeviceBehavior struct {
+	IP          string         `json:"ip"`
+	NewDevice   bool           `json:"newDevice"`
+	NewDomains  []BehaviorItem `json:"newDomains"`
+	NewPorts    []BehaviorItem `json:"newPorts"`
+	MoreDomains int64          `json:"moreDomains,omitempty"`
+	MorePorts   int64          `json:"morePorts,omitempty"`
+}
+
+// DeviceCount is a schema of the API
+type DeviceCount struct {
+	Name       string `json:"name"`
+	EventCount int64  `json:"eventCount"`
+	ByteCount  int64  `json:"byteCount"`
+}
+
+// DeviceSummary is a schema of the API
+type DeviceSummary struct {
+	IP              string           `json:"ip"`
+	Sensor          string           `json:"sensor,omitempty"`
+	FirstSeen       time.Time        `json:"firstSeen"`
+	LastSeen        time.Time        `json:"lastSeen"`
+	EventCount      int64            `json:"eventCount"`
+	BytesOut        int64            `json:"bytesOut"`
+	BytesIn         int64            `json:"bytesIn"`
+	TopDomains      []DeviceCount    `json:"topDomains"`
+	TopDestinations []DeviceCount    `json:"topDestinations"`
+	Protocols       map[string]int64 `json:"protocols"`
+}
+
+// DevicesResponse is a schema of the API
+type DevicesResponse struct {
+	Devices   []DeviceSummary `json:"devices"`
+	Total     int64           `json:"total"`
+	Page      int64           `json:"page"`
+	PageSize  int64           `json:"pageSize"`
+	StartTime time.Time       `json:"startTime"`
+	EndTime   time.Time       `json:"endTime"`
+}
+
+// EventsResponse is a schema of the API
+type EventsResponse struct {
+	Events     []NetworkEvent `json:"events"`
+	Total      int64          `json:"total"`
+	PageSize   int64          `json:"pageSize"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+	PrevCursor string         `json:"prevCursor,omitempty"`
+}
+
+// IngestRejection is a schema of the API
+type IngestRejection struct {
+	Index int64  `json:"index"`
+	Error string `json:"error"`
+}
+
+// IngestRequest is a schema of the API
+type IngestRequest struct {
+	Sensor string         `json:"sensor"`
+	Events []NetworkEvent `json:"events"`
+}
+
+// IngestResponse is a schema of the API
+type IngestResponse struct {
+	Accepted   int64             `json:"accepted"`
+	Duplicates int64             `json:"duplicates"`
+	Rejected   []IngestRejection `json:"rejected,omitempty"`
+}
+
+// JobList is a schema of the API
+type JobList struct {
+	Jobs []JobStatus `json:"jobs"`
+}
+
+// JobRun is a schema of the API
+type JobRun struct {
+	Job    string `json:"job"`
+	Status string `json:"status"`
+}
+
+// JobStatus is a schema of the API
+type JobStatus struct {
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule"`
+	Jitter       string    `json:"jitter,omitempty"`
+	Running      bool      `json:"running"`
+	Runs         int64     `json:"runs"`
+	LastRun      time.Time `json:"lastRun,omitempty"`
+	LastDuration string    `json:"lastDuration,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+	NextRun      time.Time `json:"nextRun,omitempty"`
+}
+
+// NetworkEvent is a schema of the API
+type NetworkEvent struct {
+	ID              int64     `json:"ID"`
+	Timestamp       time.Time `json:"Timestamp"`
+	EventType       string    `json:"EventType"`
+	Interface       string    `json:"Interface"`
+	VLAN            int32     `json:"VLAN"`
+	InnerVLAN       int32     `json:"InnerVLAN"`
+	IPVersion       int32     `json:"IPVersion"`
+	FlowID          string    `json:"FlowID"`
+	Sensor          string    `json:"Sensor"`
+	Tunnel          string    `json:"Tunnel"`
+	TunnelID        int64     `json:"TunnelID"`
+	TunnelSrcIP     string    `json:"TunnelSrcIP"`
+	TunnelDstIP     string    `json:"TunnelDstIP"`
+	SrcIP           string    `json:"SrcIP"`
+	SrcPort         int32     `json:"SrcPort"`
+	DstIP           string    `json:"DstIP"`
+	DstPort         int32     `json:"DstPort"`
+	DNSType         string    `json:"DNSType"`
+	DNSID           int32     `json:"DNSID"`
+	DNSQuery        string    `json:"DNSQuery"`
+	DNSAnswers      string    `json:"DNSAnswers"`
+	DNSCNAMEs       string    `json:"DNSCNAMEs"`
+	DNSRCode        string    `json:"DNSRCode"`
+	DNSAnswerCount  int32     `json:"DNSAnswerCount"`
+	DNSTTL          int64     `json:"DNSTTL"`
+	TLSSNI          string    `json:"TLSSNI"`
+	TLSJA3          string    `json:"TLSJA3"`
+	TLSJA4          string    `json:"TLSJA4"`
+	TLSVersion      string    `json:"TLSVersion"`
+	TLSCipher       string    `json:"TLSCipher"`
+	TLSALPN         string    `json:"TLSALPN"`
+	TLSECH          bool      `json:"TLSECH"`
+	RemoteVersion   string    `json:"RemoteVersion"`
+	RemoteClient    string    `json:"RemoteClient"`
+	RemoteServer    string    `json:"RemoteServer"`
+	ShareServer     string    `json:"ShareServer"`
+	Shares          string    `json:"Shares"`
+	ShareVersion    string    `json:"ShareVersion"`
+	NTPVersion      int32     `json:"NTPVersion"`
+	NTPStratum      int32     `json:"NTPStratum"`
+	NTPRefID        string    `json:"NTPRefID"`
+	Hostname        string    `json:"Hostname"`
+	DNSAge          int64     `json:"DNSAge"`
+	Duration        int64     `json:"Duration"`
+	ByteCount       int64     `json:"ByteCount"`
+	SrcBytes        int64     `json:"SrcBytes"`
+	DstBytes        int64     `json:"DstBytes"`
+	Reason          string    `json:"Reason"`
+	EndTime         time.Time `json:"EndTime"`
+	ICMPType        int32     `json:"ICMPType"`
+	ICMPCode        int32     `json:"ICMPCode"`
+	ICMPDesc        string    `json:"ICMPDesc"`
+	ICMPOrigProto   string    `json:"ICMPOrigProto"`
+	ICMPOrigSrcIP   string    `json:"ICMPOrigSrcIP"`
+	ICMPOrigSrcPort int32     `json:"ICMPOrigSrcPort"`
+	ICMPOrigDstIP   string    `json:"ICMPOrigDstIP"`
+	ICMPOrigDstPort int32     `json:"ICMPOrigDstPort"`
+	Protocol        string    `json:"Protocol"`
+	Threat          bool      `json:"Threat"`
+	ThreatList      string    `json:"ThreatList"`
+	AnomalyScore    int32     `json:"AnomalyScore"`
+	AnomalyReasons  string    `json:"AnomalyReasons"`
+	Tags            string    `json:"Tags"`
+	P2P             string    `json:"P2P"`
+	CaptureFile     string    `json:"CaptureFile"`
+	CaptureFrame    int64     `json:"CaptureFrame"`
+	Compacted       bool      `json:"Compacted"`
+	OriginalRef     string    `json:"OriginalRef"`
+	EventCount      int64     `json:"EventCount"`
+	Repeats         int64     `json:"Repeats"`
+	Hash            string    `json:"Hash"`
+}
+
+// NewBehaviorResponse is a schema of the API
+type NewBehaviorResponse struct {
+	WeekStart time.Time        `json:"weekStart"`
+	WeekEnd   time.Time        `json:"weekEnd"`
+	Devices   []DeviceBehavior `json:"devices"`
+}
+
+// NewDestinationsResponse is a schema of the API
+type NewDestinationsResponse struct {
+	Since        time.Time     `json:"since"`
+	Destinations []Destination `json:"destinations"`
+}
+
+// PurgeRequest is a schema of the API
+type PurgeRequest struct {
+	Before string `json:"before"`
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
+	DryRun bool   `json:"dryRun"`
+}
+
+// PurgeStats is a schema of the API
+type PurgeStats struct {
+	Events     int64 `json:"events"`
+	Originals  int64 `json:"originals"`
+	Baselines  int64 `json:"baselines"`
+	SizeBefore int64 `json:"sizeBefore"`
+	SizeAfter  int64 `json:"sizeAfter"`
+	Freed      int64 `json:"freed"`
+	Reusable   int64 `json:"reusable"`
+}
+
+// ReportJob is a schema of the API
+type ReportJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Range       string     `json:"range"`
+	Format      string     `json:"format"`
+	Sections    []string   `json:"sections,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StatusURL   string     `json:"statusUrl"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+}
+
+// ReportList is a schema of the API
+type ReportList struct {
+	Reports []ReportJob `json:"reports"`
+}
+
+// ReportRequest is a schema of the API
+type ReportRequest struct {
+	Range    string   `json:"range"`
+	Format   string   `json:"format"`
+	Sections []string `json:"sections"`
+	Limit    int64    `json:"limit"`
+	Query    string   `json:"query"`
+	View     string   `json:"view"`
+	Compare  string   `json:"compare"`
+}
+
+// SavedView is a schema of the API
+type SavedView struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Filters     map[string]string `json:"filters"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// SessionTable is a schema of the API
+type SessionTable struct {
+	Active     int64            `json:"active"`
+	Max        int64            `json:"max"`
+	ByProtocol map[string]int64 `json:"byProtocol"`
+	TcpTimeout string           `json:"tcpTimeout"`
+	UdpTimeout string           `json:"udpTimeout"`
+	OldestSeen time.Time        `json:"oldestSeen,omitempty"`
+	Expired    int64            `json:"expired"`
+	Evicted    int64            `json:"evicted"`
+}
+
+// StatsResponse is a schema of the API
+type StatsResponse struct {
+	TotalEvents int64            `json:"totalEvents"`
+	EventCounts map[string]int64 `json:"eventCounts"`
+	LastEvent   *time.Time       `json:"lastEvent,omitempty"`
+	FirstEvent  *time.Time       `json:"firstEvent,omitempty"`
+}
+
+// TLSFingerprintEntry is a schema of the API
+type TLSFingerprintEntry struct {
+	Fingerprint string    `json:"fingerprint"`
+	EventCount  int64     `json:"eventCount"`
+	ClientCount int64     `json:"clientCount"`
+	SniCount    int64     `json:"sniCount"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Clients     []string  `json:"clients"`
+	Snis        []string  `json:"snis"`
+}
+
+// TLSFingerprintsResponse is a schema of the API
+type TLSFingerprintsResponse struct {
+	Fingerprints []TLSFingerprintEntry `json:"fingerprints"`
+	Total        int64                 `json:"total"`
+	Type         string                `json:"type"`
+}
+
+// TimelineSeries is a schema of the API
+type TimelineSeries struct {
+	Name     string             `json:"name"`
+	Data     []TrafficDataPoint `json:"data"`
+	TotalIn  int64              `json:"totalIn"`
+	TotalOut int64              `json:"totalOut"`
+	Events   int64              `json:"events"`
+}
+
+// TopHostEntry is a schema of the API
+type TopHostEntry struct {
+	Host       string  `json:"host"`
+	EventCount int64   `json:"eventCount"`
+	ByteCount  int64   `json:"byteCount"`
+	Sparkline  []int64 `json:"sparkline,omitempty"`
+}
+
+// TopHostsResponse is a schema of the API
+type TopHostsResponse struct {
+	Hosts          []TopHostEntry `json:"hosts"`
+	Total          int64          `json:"total"`
+	Metric         string         `json:"metric"`
+	HostType       string         `json:"hostType"`
+	SparklineStart *time.Time     `json:"sparklineStart,omitempty"`
+}
+
+// TrafficDataPoint is a schema of the API
+type TrafficDataPoint struct {
+	Timestamp  time.Time `json:"timestamp"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	EventCount int64     `json:"eventCount"`
+}
+
+// TrafficTimelineResponse is a schema of the API
+type TrafficTimelineResponse struct {
+	Data        []TrafficDataPoint `json:"data"`
+	StartTime   time.Time          `json:"startTime"`
+	EndTime     time.Time          `json:"endTime"`
+	BucketSize  string             `json:"bucketSize"`
+	TotalIn     int64              `json:"totalIn"`
+	TotalOut    int64              `json:"totalOut"`
+	Buckets     int64              `json:"buckets"`
+	Downsampled bool               `json:"downsampled,omitempty"`
+	GroupBy     string             `json:"groupBy,omitempty"`
+	Series      []TimelineSeries   `json:"series,omitempty"`
+}
+
+// VersionResponse is a schema of the API
+type VersionResponse struct {
+	Version   string `json:"version"`
+	BuildTime string `json:"buildTime,omitempty"`
+}
+
+// ViewList is a schema of the API
+type ViewList struct {
+	Views []SavedView `json:"views"`
+}
+
+// ViewRequest is a schema of the API
+type ViewRequest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Filters     map[string]string `json:"filters"`
+}
+
+// ListBeaconsParams are the query parameters of ListBeacons
+type ListBeaconsParams struct {
+	// Lowest score, 0-100 (default: all stored, 70 and up)
+	MinScore int
+	// Only this host's beacons
+	SrcIP string
+	// 1-500 (default: 100)
+	Limit int
+}
+
+// ListBeacons lists hosts connecting to a remote service at regular intervals with constant sizes
+func (c *Client) ListBeacons(ctx context.Context, params *ListBeaconsParams) (*BeaconsResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.MinScore != 0 {
+			query.Set("minScore", strconv.Itoa(params.MinScore))
+		}
+		if params.SrcIP != "" {
+			query.Set("srcIP", params.SrcIP)
+		}
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+	}
+	out := new(BeaconsResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/beacons", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetChartParams are the query parameters of GetChart
+type GetChartParams struct {
+	Width  int
+	Height int
+	Title  string
+}
+
+// GetChart renders a chart as an image
+// The caller closes the returned body.
+func (c *Client) GetChart(ctx context.Context, file string, params *GetChartParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Width != 0 {
+			query.Set("width", strconv.Itoa(params.Width))
+		}
+		if params.Height != 0 {
+			query.Set("height", strconv.Itoa(params.Height))
+		}
+		if params.Title != "" {
+			query.Set("title", params.Title)
+		}
+	}
+	return c.send(ctx, http.MethodGet, "/api/charts/"+url.PathEscape(fmt.Sprint(file)), query, nil)
+}
+
+// ListActiveConnectionsParams are the query parameters of ListActiveConnections
+type ListActiveConnectionsParams struct {
+	// Connections returned, 1-1000 (default: 50)
+	Limit int
+	// Only connections of this protocol, e.g. TCP
+	Protocol string
+}
+
+// ListActiveConnections lists the connections tracked right now, most recently seen first
+func (c *Client) ListActiveConnections(ctx context.Context, params *ListActiveConnectionsParams) (*ActiveConnections, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+		if params.Protocol != "" {
+			query.Set("protocol", params.Protocol)
+		}
+	}
+	out := new(ActiveConnections)
+	if err := c.call(ctx, http.MethodGet, "/api/connections/active", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetNewDestinationsParams are the query parameters of GetNewDestinations
+type GetNewDestinationsParams struct {
+	// How far back, e.g. 24h or 7d (default: 24h)
+	Since string
+	Kind  string
+	// 1-1000 (default: 100)
+	Limit int
+}
+
+// GetNewDestinations lists the domains and remote addresses reached for the first time, or the first time in 30 days
+func (c *Client) GetNewDestinations(ctx context.Context, params *GetNewDestinationsParams) (*NewDestinationsResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Since != "" {
+			query.Set("since", params.Since)
+		}
+		if params.Kind != "" {
+			query.Set("kind", params.Kind)
+		}
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+	}
+	out := new(NewDestinationsResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/destinations/new", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListDevicesParams are the query parameters of ListDevices
+type ListDevicesParams struct {
+	// Start of the range, RFC 3339 or YYYY-MM-DD (default: 24 hours ago)
+	Start string
+	// End of the range, RFC 3339 or YYYY-MM-DD (default: now)
+	End  string
+	Page int
+	// Devices per page, 1-50 (default: 20)
+	PageSize int
+	// Part of the device address
+	Q string
+	// Include non-local sources
+	All  bool
+	Sort string
+}
+
+// ListDevices lists devices with their traffic, one page at a time
+func (c *Client) ListDevices(ctx context.Context, params *ListDevicesParams) (*DevicesResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Start != "" {
+			query.Set("start", params.Start)
+		}
+		if params.End != "" {
+			query.Set("end", params.End)
+		}
+		if params.Page != 0 {
+			query.Set("page", strconv.Itoa(params.Page))
+		}
+		if params.PageSize != 0 {
+			query.Set("pageSize", strconv.Itoa(params.PageSize))
+		}
+		if params.Q != "" {
+			query.Set("q", params.Q)
+		}
+		if params.All {
+			query.Set("all", "true")
+		}
+		if params.Sort != "" {
+			query.Set("sort", params.Sort)
+		}
+	}
+	out := new(DevicesResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/devices", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetNewBehaviorParams are the query parameters of GetNewBehavior
+type GetNewBehaviorParams struct {
+	// A day of the week, YYYY-MM-DD (default: the last completed week)
+	Week string
+}
+
+// GetNewBehavior lists the domains and ports devices contacted for the first time in a week
+func (c *Client) GetNewBehavior(ctx context.Context, params *GetNewBehaviorParams) (*NewBehaviorResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Week != "" {
+			query.Set("week", params.Week)
+		}
+	}
+	out := new(NewBehaviorResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/devices/new-behavior", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetDNSAnalyticsParams are the query parameters of GetDNSAnalytics
+type GetDNSAnalyticsParams struct {
+	// Start of the range, RFC 3339 or YYYY-MM-DD (default: 24 hours ago)
+	Start string
+	// End of the range, RFC 3339 or YYYY-MM-DD (default: now)
+	End string
+	// Entries per list, 1-100 (default: 20)
+	Limit int
+	// Only this client's queries
+	SrcIP string
+}
+
+// GetDNSAnalytics aggregates DNS queries: volume per name, unique subdomains per registered domain, response times and NXDOMAIN rates per client
+func (c *Client) GetDNSAnalytics(ctx context.Context, params *GetDNSAnalyticsParams) (*DNSResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Start != "" {
+			query.Set("start", params.Start)
+		}
+		if params.End != "" {
+			query.Set("end", params.End)
+		}
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+		if params.SrcIP != "" {
+			query.Set("srcIP", params.SrcIP)
+		}
+	}
+	out := new(DNSResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/dns", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListEventTypes lists the event types stored
+func (c *Client) ListEventTypes(ctx context.Context) ([]string, error) {
+	var out []string
+	if err := c.call(ctx, http.MethodGet, "/api/event-types", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListEventsParams are the query parameters of ListEvents
+type ListEventsParams struct {
+	// Events per page, 1-100 (default: 20)
+	PageSize int
+	// nextCursor or prevCursor of the previous page
+	Cursor string
+	// prev pages backwards from cursor
+	Direction string
+	// Order by time or by anomaly score
+	Sort          string
+	EventType     string
+	SrcIP         string
+	DstIP         string
+	Q             string
+	StartDate     string
+	EndDate       string
+	Threat        string
+	ThreatList    string
+	DNSRcode      string
+	DNSFailed     string
+	Ja3           string
+	Ja4           string
+	TLSVersion    string
+	ECH           string
+	MinScore      string
+	AnomalyReason string
+	Tag           string
+	VLAN          string
+	P2p           string
+	// Filter expression, e.g. dst_port=443 AND threat=true
+	Query string
+}
+
+// ListEvents lists events, newest first, one page at a time
+func (c *Client) ListEvents(ctx context.Context, params *ListEventsParams) (*EventsResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.PageSize != 0 {
+			query.Set("pageSize", strconv.Itoa(params.PageSize))
+		}
+		if params.Cursor != "" {
+			query.Set("cursor", params.Cursor)
+		}
+		if params.Direction != "" {
+			query.Set("direction", params.Direction)
+		}
+		if params.Sort != "" {
+			query.Set("sort", params.Sort)
+		}
+		if params.EventType != "" {
+			query.Set("eventType", params.EventType)
+		}
+		if params.SrcIP != "" {
+			query.Set("srcIP", params.SrcIP)
+		}
+		if params.DstIP != "" {
+			query.Set("dstIP", params.DstIP)
+		}
+		if params.Q != "" {
+			query.Set("q", params.Q)
+		}
+		if params.StartDate != "" {
+			query.Set("startDate", params.StartDate)
+		}
+		if params.EndDate != "" {
+			query.Set("endDate", params.EndDate)
+		}
+		if params.Threat != "" {
+			query.Set("threat", params.Threat)
+		}
+		if params.ThreatList != "" {
+			query.Set("threatList", params.ThreatList)
+		}
+		if params.DNSRcode != "" {
+			query.Set("dnsRcode", params.DNSRcode)
+		}
+		if params.DNSFailed != "" {
+			query.Set("dnsFailed", params.DNSFailed)
+		}
+		if params.Ja3 != "" {
+			query.Set("ja3", params.Ja3)
+		}
+		if params.Ja4 != "" {
+			query.Set("ja4", params.Ja4)
+		}
+		if params.TLSVersion != "" {
+			query.Set("tlsVersion", params.TLSVersion)
+		}
+		if params.ECH != "" {
+			query.Set("ech", params.ECH)
+		}
+		if params.MinScore != "" {
+			query.Set("minScore", params.MinScore)
+		}
+		if params.AnomalyReason != "" {
+			query.Set("anomalyReason", params.AnomalyReason)
+		}
+		if params.Tag != "" {
+			query.Set("tag", params.Tag)
+		}
+		if params.VLAN != "" {
+			query.Set("vlan", params.VLAN)
+		}
+		if params.P2p != "" {
+			query.Set("p2p", params.P2p)
+		}
+		if params.Query != "" {
+			query.Set("query", params.Query)
+		}
+	}
+	out := new(EventsResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/events", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetEventOriginals returns the events a compacted record was merged from
+func (c *Client) GetEventOriginals(ctx context.Context, id int64) ([]NetworkEvent, error) {
+	var out []NetworkEvent
+	if err := c.call(ctx, http.MethodGet, "/api/events/"+url.PathEscape(fmt.Sprint(id))+"/originals", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IngestEvents stores events sent by an external sensor
+func (c *Client) IngestEvents(ctx context.Context, body *IngestRequest) (*IngestResponse, error) {
+	out := new(IngestResponse)
+	if err := c.call(ctx, http.MethodPost, "/api/ingest", nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListJobs lists the periodic jobs with their last and next runs
+func (c *Client) ListJobs(ctx context.Context) (*JobList, error) {
+	out := new(JobList)
+	if err := c.call(ctx, http.MethodGet, "/api/jobs", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RunJob runs a job now, outside its schedule
+func (c *Client) RunJob(ctx context.Context, name string) (*JobRun, error) {
+	out := new(JobRun)
+	if err := c.call(ctx, http.MethodPost, "/api/jobs/"+url.PathEscape(fmt.Sprint(name))+"/run", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetOpenAPI returns this document
+func (c *Client) GetOpenAPI(ctx context.Context) (map[string]json.RawMessage, error) {
+	var out map[string]json.RawMessage
+	if err := c.call(ctx, http.MethodGet, "/api/openapi.json", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PurgeEvents deletes the events matching every criterion given
+func (c *Client) PurgeEvents(ctx context.Context, body *PurgeRequest) (*PurgeStats, error) {
+	out := new(PurgeStats)
+	if err := c.call(ctx, http.MethodPost, "/api/purge", nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListReports lists report jobs, newest first
+func (c *Client) ListReports(ctx context.Context) (*ReportList, error) {
+	out := new(ReportList)
+	if err := c.call(ctx, http.MethodGet, "/api/reports", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateReport starts generating a report
+func (c *Client) CreateReport(ctx context.Context, body *ReportRequest) (*ReportJob, error) {
+	out := new(ReportJob)
+	if err := c.call(ctx, http.MethodPost, "/api/reports", nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetReport returns a report job
+func (c *Client) GetReport(ctx context.Context, id string) (*ReportJob, error) {
+	out := new(ReportJob)
+	if err := c.call(ctx, http.MethodGet, "/api/reports/"+url.PathEscape(fmt.Sprint(id)), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DownloadReport downloads a finished report
+// The caller closes the returned body.
+func (c *Client) DownloadReport(ctx context.Context, id string) (io.ReadCloser, error) {
+	return c.send(ctx, http.MethodGet, "/api/reports/"+url.PathEscape(fmt.Sprint(id))+"/download", nil, nil)
+}
+
+// GetSessionTable returns the occupancy and limits of the session table
+func (c *Client) GetSessionTable(ctx context.Context) (*SessionTable, error) {
+	out := new(SessionTable)
+	if err := c.call(ctx, http.MethodGet, "/api/sessions", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetStats returns the number of events by type and their time span
+func (c *Client) GetStats(ctx context.Context) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/stats", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListTLSFingerprintsParams are the query parameters of ListTLSFingerprints
+type ListTLSFingerprintsParams struct {
+	// Fingerprints returned
+	Limit int
+	Type  string
+	// rare lists the least common first
+	Order string
+	// Only fingerprints of this client
+	SrcIP string
+}
+
+// ListTLSFingerprints lists TLS client fingerprints with their clients
+func (c *Client) ListTLSFingerprints(ctx context.Context, params *ListTLSFingerprintsParams) (*TLSFingerprintsResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+		if params.Type != "" {
+			query.Set("type", params.Type)
+		}
+		if params.Order != "" {
+			query.Set("order", params.Order)
+		}
+		if params.SrcIP != "" {
+			query.Set("srcIP", params.SrcIP)
+		}
+	}
+	out := new(TLSFingerprintsResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/tls/fingerprints", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetTopHostsParams are the query parameters of GetTopHosts
+type GetTopHostsParams struct {
+	// Hosts returned, 1-100 (default: 10)
+	Limit int
+	// Rank by event count or bytes
+	Metric string
+	// Group by hostname, source or destination IP
+	Type string
+	// Start of the range, RFC 3339 or YYYY-MM-DD (default: all events, or 24 hours for sparklines)
+	Start string
+	// End of the range, RFC 3339 or YYYY-MM-DD (default: now)
+	End string
+	// Only events captured on this interface
+	Interface string
+	// Only events sent by local hosts (out) or from outside (in)
+	Direction string
+	// Only these event types, comma-separated
+	EventType string
+	// Add hourly values per host over the range (default range: 24 hours)
+	Sparkline bool
+}
+
+// GetTopHosts ranks hosts by events or traffic
+func (c *Client) GetTopHosts(ctx context.Context, params *GetTopHostsParams) (*TopHostsResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+		if params.Metric != "" {
+			query.Set("metric", params.Metric)
+		}
+		if params.Type != "" {
+			query.Set("type", params.Type)
+		}
+		if params.Start != "" {
+			query.Set("start", params.Start)
+		}
+		if params.End != "" {
+			query.Set("end", params.End)
+		}
+		if params.Interface != "" {
+			query.Set("interface", params.Interface)
+		}
+		if params.Direction != "" {
+			query.Set("direction", params.Direction)
+		}
+		if params.EventType != "" {
+			query.Set("eventType", params.EventType)
+		}
+		if params.Sparkline {
+			query.Set("sparkline", "true")
+		}
+	}
+	out := new(TopHostsResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/top-hosts", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetTrafficTimelineParams are the query parameters of GetTrafficTimeline
+type GetTrafficTimelineParams struct {
+	// Start of the range, RFC 3339 or YYYY-MM-DD (default: 24 hours ago)
+	Start string
+	// End of the range, RFC 3339 or YYYY-MM-DD (default: now)
+	End string
+	// Finest bucket size wanted
+	Bucket string
+	// Most data points returned, at least 10
+	Points int
+	// Series whose shape downsampling preserves
+	Metric string
+	// Add a series per host, protocol or interface
+	GroupBy string
+	// Hosts or interfaces with a series, 1-50, the rest summed as other (default: 10)
+	Series int
+}
+
+// GetTrafficTimeline returns traffic in and out over time
+func (c *Client) GetTrafficTimeline(ctx context.Context, params *GetTrafficTimelineParams) (*TrafficTimelineResponse, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Start != "" {
+			query.Set("start", params.Start)
+		}
+		if params.End != "" {
+			query.Set("end", params.End)
+		}
+		if params.Bucket != "" {
+			query.Set("bucket", params.Bucket)
+		}
+		if params.Points != 0 {
+			query.Set("points", strconv.Itoa(params.Points))
+		}
+		if params.Metric != "" {
+			query.Set("metric", params.Metric)
+		}
+		if params.GroupBy != "" {
+			query.Set("groupBy", params.GroupBy)
+		}
+		if params.Series != 0 {
+			query.Set("series", strconv.Itoa(params.Series))
+		}
+	}
+	out := new(TrafficTimelineResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/traffic-timeline", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetVersion returns the server version
+func (c *Client) GetVersion(ctx context.Context) (*VersionResponse, error) {
+	out := new(VersionResponse)
+	if err := c.call(ctx, http.MethodGet, "/api/version", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListViews lists saved views
+func (c *Client) ListViews(ctx context.Context) (*ViewList, error) {
+	out := new(ViewList)
+	if err := c.call(ctx, http.MethodGet, "/api/views", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateView saves a view
+func (c *Client) CreateView(ctx context.Context, body *ViewRequest) (*SavedView, error) {
+	out := new(SavedView)
+	if err := c.call(ctx, http.MethodPost, "/api/views", nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetView returns a saved view
+func (c *Client) GetView(ctx context.Context, id int64) (*SavedView, error) {
+	out := new(SavedView)
+	if err := c.call(ctx, http.MethodGet, "/api/views/"+url.PathEscape(fmt.Sprint(id)), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateView replaces a saved view
+func (c *Client) UpdateView(ctx context.Context, id int64, body *ViewRequest) (*SavedView, error) {
+	out := new(SavedView)
+	if err := c.call(ctx, http.MethodPut, "/api/views/"+url.PathEscape(fmt.Sprint(id)), nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteView deletes a saved view
+func (c *Client) DeleteView(ctx context.Context, id int64) error {
+	return c.call(ctx, http.MethodDelete, "/api/views/"+url.PathEscape(fmt.Sprint(id)), nil, nil, nil)
+}
@@ -0,0 +1,6 @@
+package client
+
+// The clients are generated from the OpenAPI document the web server serves
+// at /api/openapi.json; regenerate them after changing an API handler.
+//go:generate sh -c "go run ../.. openapi --client go > client_gen.go"
+//go:generate sh -c "go run ../.. openapi --client ts > client.ts"
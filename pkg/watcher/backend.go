@@ -0,0 +1,183 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"golang.org/x/net/bpf"
+)
+
+// Capture backends: afpacket reads a TPACKET_V3 ring the kernel copies
+// frames into; xdp has the NIC driver hand frames to AF_XDP sockets,
+// bypassing the network stack, for links too busy for the ring
+const (
+	BackendAFPacket = "afpacket"
+	BackendXDP      = "xdp"
+)
+
+// CaptureBackends lists the values of --capture-backend
+var CaptureBackends = []string{BackendAFPacket, BackendXDP}
+
+// ValidateCaptureBackend checks a --capture-backend value
+func ValidateCaptureBackend(backend string) error {
+	if !slices.Contains(CaptureBackends, backend) {
+		return fmt.Errorf("unknown capture backend %q (use %s)", backend, strings.Join(CaptureBackends, " or "))
+	}
+	return nil
+}
+
+// capturePollTimeout is how long a read waits for a packet, so a capture
+// worker notices when it is stopped
+const capturePollTimeout = 100 * time.Millisecond
+
+// errNoPacket is returned by reads that waited capturePollTimeout in vain
+var errNoPacket = errors.New("no packet arrived")
+
+// captureHandle is an open capture of one interface, read by one capture
+// worker
+type captureHandle interface {
+	// ZeroCopyReadPacketData returns the next frame, valid until the next
+	// call, or errNoPacket
+	gopacket.ZeroCopyPacketDataSource
+	// SetBPF installs a socket filter, which also truncates packets
+	SetBPF(filter []bpf.RawInstruction) error
+	// counters returns the packets delivered and dropped since it opened
+	counters() (packets, drops uint64, err error)
+	Close()
+}
+
+// afpacketHandle is a captureHandle on an AF_PACKET ring
+type afpacketHandle struct {
+	*afpacket.TPacket
+}
+
+func (h afpacketHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := h.TPacket.ZeroCopyReadPacketData()
+	if err == afpacket.ErrTimeout {
+		err = errNoPacket
+	}
+	return data, ci, err
+}
+
+func (h afpacketHandle) counters() (packets, drops uint64, err error) {
+	_, stats, err := h.SocketStats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(stats.Packets()), uint64(stats.Drops()), nil
+}
+
+// SetCaptureBackend selects how interfaces started from now on are
+// captured, one of CaptureBackends. Interfaces where the xdp backend cannot
+// run fall back to afpacket.
+func (w *Watcher) SetCaptureBackend(backend string) {
+	w.configMux.Lock()
+	w.backend = backend
+	w.configMux.Unlock()
+}
+
+// SetCaptureWorkers sets how many goroutines capture each interface started
+// from now on, unless its workers option overrides it. Each has its own
+// ring, or its own share of the AF_XDP receive queues, and decoder.
+func (w *Watcher) SetCaptureWorkers(workers int) {
+	w.configMux.Lock()
+	w.workers = workers
+	w.configMux.Unlock()
+}
+
+// ValidateCaptureWorkers checks a --capture-workers value
+func ValidateCaptureWorkers(workers int) error {
+	if workers < 1 || workers > maxCaptureWorkers {
+		return fmt.Errorf("capture workers must be between 1 and %d", maxCaptureWorkers)
+	}
+	return nil
+}
+
+// maxCaptureWorkers bounds the workers of one interface
+const maxCaptureWorkers = 64
+
+// fanoutAttempts bounds the random fanout group IDs tried for a capture
+const fanoutAttempts = 8
+
+// openCapture opens the capture of an interface with the configured
+// backend, one handle per capture worker, and returns the backend used
+func (w *Watcher) openCapture(iface net.Interface, cfg InterfaceConfig) ([]captureHandle, string, error) {
+	w.configMux.RLock()
+	backend, workers := w.backend, max(w.workers, 1)
+	w.configMux.RUnlock()
+	if cfg.Workers > 0 {
+		workers = cfg.Workers
+	}
+
+	if backend == BackendXDP {
+		xdp, err := newXDPHandles(iface, workers)
+		if err == nil {
+			handles := make([]captureHandle, len(xdp))
+			queues := 0
+			for i, h := range xdp {
+				handles[i] = h
+				queues += len(h.queues)
+			}
+			w.logger.Info("AF_XDP capture", "interface", iface.Name, "queues", queues, "workers", len(xdp), "zerocopy", xdp[0].zeroCopy)
+			return handles, BackendXDP, nil
+		}
+		w.logger.Warn("AF_XDP capture unavailable, falling back to afpacket", "interface", iface.Name, "error", err)
+	}
+
+	numBlocks := 128 // 64MB ring with 512KB blocks
+	// Truncated frames take a fraction of the room, so captures that cut
+	// them get by with a quarter of the ring, which small devices notice
+	if snapLen := w.snapLenFor(cfg); snapLen == SnapHeaders || (snapLen > 0 && snapLen <= 512) {
+		numBlocks = 32
+	}
+	if cfg.RingMB > 0 {
+		numBlocks = max(cfg.RingMB*1024*1024/(4096*128), 1)
+	}
+	// Workers join a fanout group the kernel spreads packets over by flow
+	// hash, reassembling fragments first, so both directions of a flow
+	// reach the same worker. The group ID is random, leaving other
+	// captures of the interface their own copy; the kernel refuses the
+	// first worker an ID in use by a group it cannot join, and another
+	// is drawn.
+	group := uint16(rand.Uint32())
+	handles := make([]captureHandle, 0, workers)
+	closeAll := func() {
+		for _, h := range handles {
+			h.Close()
+		}
+	}
+	for range workers {
+		// A Ring Buffer Clone of interface is created by kernel
+		handle, err := afpacket.NewTPacket(
+			afpacket.OptInterface(iface.Name),
+			afpacket.OptFrameSize(4096),
+			afpacket.OptBlockSize(4096*128),
+			afpacket.OptNumBlocks(numBlocks),
+			afpacket.OptPollTimeout(capturePollTimeout),
+		)
+		if err != nil {
+			closeAll()
+			return nil, "", fmt.Errorf("failed to create afpacket: %w", err)
+		}
+		handles = append(handles, afpacketHandle{handle})
+		if workers > 1 {
+			err := handle.SetFanout(afpacket.FanoutHashWithDefrag, group)
+			for attempt := 1; err != nil && len(handles) == 1 && attempt < fanoutAttempts; attempt++ {
+				group = uint16(rand.Uint32())
+				err = handle.SetFanout(afpacket.FanoutHashWithDefrag, group)
+			}
+			if err != nil {
+				closeAll()
+				return nil, "", fmt.Errorf("failed to join fanout group %d: %w", group, err)
+			}
+		}
+	}
+	return handles, BackendAFPacket, nil
+}
@@ -0,0 +1,277 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// maxBPFInstructions is the kernel's limit for a classic BPF socket filter
+const maxBPFInstructions = 4096
+
+// acceptAll keeps whole packets; it replaces a filter removed on reload
+var acceptAll = []bpf.Instruction{bpf.RetConstant{Val: 0xffffffff}}
+
+// LoadBPFFilter reads a classic BPF program in the format tcpdump -ddd
+// prints, e.g. tcpdump -ddd 'not port 22' > /etc/net-watcher/lan.bpf: the
+// instruction count, then one "code jt jf k" line per instruction. Filters
+// come compiled because net-watcher is built without libpcap.
+func LoadBPFFilter(path string) ([]bpf.Instruction, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.FieldsFunc(string(data), func(r rune) bool { return r == '\n' })
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s: empty BPF program", path)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil || count != len(lines)-1 {
+		return nil, fmt.Errorf("%s: expected the instruction count and %d instructions, as printed by tcpdump -ddd", path, len(lines)-1)
+	}
+	if count == 0 || count > maxBPFInstructions {
+		return nil, fmt.Errorf("%s: BPF program must have 1 to %d instructions", path, maxBPFInstructions)
+	}
+
+	program := make([]bpf.Instruction, 0, count)
+	for i, line := range lines[1:] {
+		fields := strings.Fields(line)
+		var values [4]uint64
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: expected \"code jt jf k\"", path, i+2)
+		}
+		for j, field := range fields {
+			bits := []int{16, 8, 8, 32}[j]
+			if values[j], err = strconv.ParseUint(field, 10, bits); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid value %q", path, i+2, field)
+			}
+		}
+		raw := bpf.RawInstruction{Op: uint16(values[0]), Jt: uint8(values[1]), Jf: uint8(values[2]), K: uint32(values[3])}
+		ins := raw.Disassemble()
+		var skips []uint32
+		switch ins := ins.(type) {
+		case bpf.Jump:
+			skips = []uint32{ins.Skip}
+		case bpf.JumpIf:
+			skips = []uint32{uint32(ins.SkipTrue), uint32(ins.SkipFalse)}
+		case bpf.JumpIfX:
+			skips = []uint32{uint32(ins.SkipTrue), uint32(ins.SkipFalse)}
+		}
+		for _, skip := range skips {
+			if i+1+int(skip) >= count {
+				return nil, fmt.Errorf("%s:%d: jump past the end of the program", path, i+2)
+			}
+		}
+		program = append(program, ins)
+	}
+	switch program[count-1].(type) {
+	case bpf.RetA, bpf.RetConstant:
+	default:
+		return nil, fmt.Errorf("%s: BPF program must end with a return instruction", path)
+	}
+	return program, nil
+}
+
+// SnapHeaders as a snap length selects header-only capture, see
+// headerFilter
+const SnapHeaders = -1
+
+// headerSnapLen is what header-only capture keeps of the packets it cuts:
+// Ethernet with two VLAN tags, the longest IPv4 and TCP headers and the
+// start of the payload, enough for ICMP errors, NTP and P2P detection
+const headerSnapLen = 192
+
+// ParseSnapLen parses a --snaplen value: a number of bytes, 0 for whole
+// frames, or "headers" for SnapHeaders
+func ParseSnapLen(s string) (int, error) {
+	if s == "headers" {
+		return SnapHeaders, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid snap length %q (expected bytes or \"headers\")", s)
+	}
+	return n, nil
+}
+
+// snapLenString formats a snap length for logs
+func snapLenString(snapLen int) string {
+	if snapLen == SnapHeaders {
+		return "headers"
+	}
+	return strconv.Itoa(snapLen)
+}
+
+// captureFilter assembles the socket filter for a capture: program with the
+// bytes it keeps capped at snapLen, a filter that only truncates when there
+// is no program, or one keeping whole packets when neither is set. With
+// SnapHeaders the packets program keeps go through headerFilter.
+func captureFilter(program []bpf.Instruction, snapLen int) ([]bpf.RawInstruction, error) {
+	if len(program) == 0 {
+		program = acceptAll
+	}
+	filter := slices.Clone(program)
+	for i, ins := range filter {
+		switch ret := ins.(type) {
+		case bpf.RetConstant:
+			// "ret #k" keeps k bytes of the packet, zero drops it
+			switch {
+			case ret.Val == 0:
+			case snapLen == SnapHeaders:
+				filter[i] = bpf.Jump{Skip: uint32(len(filter) - i - 1)}
+			case snapLen > 0 && ret.Val > uint32(snapLen):
+				filter[i] = bpf.RetConstant{Val: uint32(snapLen)}
+			}
+		case bpf.RetA:
+			if snapLen == SnapHeaders {
+				return nil, fmt.Errorf("header-only capture needs a BPF program returning constants, as tcpdump prints")
+			}
+		}
+	}
+	if snapLen == SnapHeaders {
+		filter = append(filter, headerFilter()...)
+	}
+	return bpf.Assemble(filter)
+}
+
+// headerFilter is the program of header-only capture. It keeps whole the
+// packets whose payload is parsed: DNS over UDP, TCP segments starting with
+// a TLS handshake record, an SSH banner or an RDP (TPKT) message, IP
+// fragments, which are reassembled, and tunnels, whose inner packet is
+// tracked. Everything else is cut to headerSnapLen.
+func headerFilter() []bpf.Instruction {
+	var a filterAsm
+	// X holds the offset of the header being read
+	a.op(bpf.LoadConstant{Dst: bpf.RegX, Val: 14}, bpf.LoadAbsolute{Off: 12, Size: 2})
+	// The kernel strips the outer VLAN tag; QinQ frames keep one more
+	a.jumpIf(bpf.JumpEqual, 0x8100, "vlan", "")
+	a.jumpIf(bpf.JumpEqual, 0x88a8, "vlan", "l3")
+	a.label("vlan")
+	a.op(bpf.LoadConstant{Dst: bpf.RegX, Val: 18}, bpf.LoadAbsolute{Off: 16, Size: 2})
+	a.label("l3")
+	a.jumpIf(bpf.JumpEqual, 0x0800, "ipv4", "")
+	a.jumpIf(bpf.JumpEqual, 0x86dd, "ipv6", "cut")
+
+	a.label("ipv4")
+	a.op(bpf.LoadIndirect{Off: 6, Size: 2})
+	a.jumpIf(bpf.JumpBitsSet, 0x3fff, "keep", "") // more fragments or an offset
+	a.op(bpf.LoadIndirect{Off: 9, Size: 1}, bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.LoadIndirect{Off: 0, Size: 1}, // X += IHL * 4
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0f},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd}, bpf.TAX{},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 0})
+	a.goTo("l4")
+
+	a.label("ipv6")
+	a.op(bpf.LoadIndirect{Off: 6, Size: 1})
+	a.jumpIf(bpf.JumpEqual, uint32(layers.IPProtocolIPv6Fragment), "keep", "")
+	a.op(bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.TXA{}, bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 40}, bpf.TAX{},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 0})
+
+	a.label("l4")
+	a.jumpIf(bpf.JumpEqual, uint32(layers.IPProtocolTCP), "tcp", "")
+	a.jumpIf(bpf.JumpEqual, uint32(layers.IPProtocolUDP), "udp", "")
+	a.jumpIf(bpf.JumpEqual, uint32(layers.IPProtocolGRE), "keep", "")
+	a.jumpIf(bpf.JumpEqual, uint32(layers.IPProtocolIPv4), "keep", "")
+	a.jumpIf(bpf.JumpEqual, uint32(layers.IPProtocolIPv6), "keep", "cut")
+
+	a.label("udp")
+	for _, off := range []uint32{0, 2} { // source and destination port
+		a.op(bpf.LoadIndirect{Off: off, Size: 2})
+		a.jumpIf(bpf.JumpEqual, 53, "keep", "")
+		a.jumpIf(bpf.JumpEqual, portVXLAN, "keep", "")
+		a.jumpIf(bpf.JumpEqual, portGeneve, "keep", "")
+	}
+	a.goTo("cut")
+
+	a.label("tcp")
+	a.op(bpf.LoadIndirect{Off: 12, Size: 1}, // X += data offset * 4
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd}, bpf.TAX{})
+	// Reading past the end drops the packet, so check there is a payload
+	a.op(bpf.LoadExtension{Num: bpf.ExtLen})
+	a.jumpIfX(bpf.JumpGreaterThan, "", "cut")
+	a.op(bpf.LoadIndirect{Off: 0, Size: 1})
+	a.jumpIf(bpf.JumpEqual, tlsRecordHandshake, "keep", "")
+	a.jumpIf(bpf.JumpEqual, 'S', "keep", "")     // "SSH-"
+	a.jumpIf(bpf.JumpEqual, 0x03, "keep", "cut") // TPKT
+
+	a.label("cut")
+	a.op(bpf.RetConstant{Val: headerSnapLen})
+	a.label("keep")
+	a.op(acceptAll...)
+	return a.assemble()
+}
+
+// filterAsm builds a BPF program whose jumps name the label they go to
+type filterAsm struct {
+	prog   []bpf.Instruction
+	labels map[string]int
+	jumps  map[int][2]string // instruction -> labels if true and false
+}
+
+func (a *filterAsm) op(ins ...bpf.Instruction) {
+	a.prog = append(a.prog, ins...)
+}
+
+func (a *filterAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.prog)
+}
+
+// jumpIf compares A with val; an empty label continues with the next
+// instruction
+func (a *filterAsm) jumpIf(cond bpf.JumpTest, val uint32, ifTrue, ifFalse string) {
+	a.jump(bpf.JumpIf{Cond: cond, Val: val}, ifTrue, ifFalse)
+}
+
+// jumpIfX compares A with X
+func (a *filterAsm) jumpIfX(cond bpf.JumpTest, ifTrue, ifFalse string) {
+	a.jump(bpf.JumpIfX{Cond: cond}, ifTrue, ifFalse)
+}
+
+func (a *filterAsm) goTo(label string) {
+	a.jump(bpf.Jump{}, label, "")
+}
+
+func (a *filterAsm) jump(ins bpf.Instruction, ifTrue, ifFalse string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int][2]string)
+	}
+	a.jumps[len(a.prog)] = [2]string{ifTrue, ifFalse}
+	a.prog = append(a.prog, ins)
+}
+
+// assemble resolves the jumps. Labels are all forward, as BPF requires.
+func (a *filterAsm) assemble() []bpf.Instruction {
+	skip := func(at int, label string) uint32 {
+		if label == "" {
+			return 0
+		}
+		return uint32(a.labels[label] - at - 1)
+	}
+	for at, to := range a.jumps {
+		t, f := skip(at, to[0]), skip(at, to[1])
+		switch ins := a.prog[at].(type) {
+		case bpf.Jump:
+			a.prog[at] = bpf.Jump{Skip: t}
+		case bpf.JumpIf:
+			ins.SkipTrue, ins.SkipFalse = uint8(t), uint8(f)
+			a.prog[at] = ins
+		case bpf.JumpIfX:
+			ins.SkipTrue, ins.SkipFalse = uint8(t), uint8(f)
+			a.prog[at] = ins
+		}
+	}
+	return a.prog
+}
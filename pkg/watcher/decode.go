@@ -0,0 +1,111 @@
+package watcher
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetDecodeOptions decodes layers only when processPacket asks for them
+// and lets them point into the packet data instead of copying it. NoCopy is
+// safe because capture workers clone the frames they hand to gopacket, and
+// nothing keeps slices of it past processPacket: events hold strings.
+var packetDecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+
+// packetInfo is what is tracked of a packet: its addresses and transport
+// layer, one of tcp, udp, icmp4 and icmp6, or none for IPsec
+type packetInfo struct {
+	srcIP, dstIP net.IP
+	isIPv6       bool
+	length       int // bytes captured
+	tcp          *layers.TCP
+	udp          *layers.UDP
+	icmp4        *layers.ICMPv4
+	icmp6        *layers.ICMPv6
+	ipsec        bool // ESP or AH, which carry no ports
+}
+
+// packetDecoder decodes the bulk of captured frames, Ethernet with any VLAN
+// tags, then IPv4 or IPv6, then TCP, UDP or ICMP, into layers it reuses for
+// every frame, so decoding them allocates nothing. Each capture worker has
+// its own, used only by its goroutine.
+type packetDecoder struct {
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	tcp     layers.TCP
+	udp     layers.UDP
+	icmp4   layers.ICMPv4
+	icmp6   layers.ICMPv6
+}
+
+func newPacketDecoder() *packetDecoder {
+	d := &packetDecoder{decoded: make([]gopacket.LayerType, 0, 8)}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
+		&d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.icmp4, &d.icmp6)
+	// Decoding stops at the first layer not listed, such as a payload
+	d.parser.IgnoreUnsupported = true
+	return d
+}
+
+// decode fills info from a frame, pointing into data, and reports whether
+// it could. Frames that need gopacket's full decoding are left to it:
+// fragments, IPv6 extension headers, other protocols and malformed or
+// truncated headers. So are tunnels, which the parser would otherwise
+// decode through: IP-in-IP and 6in4 as a second IP layer, VXLAN and Geneve
+// by their UDP port. The full decoding records them as the packet's
+// Tunnel.
+func (d *packetDecoder) decode(data []byte, info *packetInfo) bool {
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil || d.parser.Truncated {
+		return false
+	}
+	var ip, transport bool
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			if ip || d.ip4.Protocol == layers.IPProtocolIPv4 || d.ip4.Protocol == layers.IPProtocolIPv6 {
+				return false
+			}
+			info.srcIP, info.dstIP, info.isIPv6 = d.ip4.SrcIP, d.ip4.DstIP, false
+			ip = true
+		case layers.LayerTypeIPv6:
+			if ip || d.ip6.NextHeader == layers.IPProtocolIPv4 || d.ip6.NextHeader == layers.IPProtocolIPv6 {
+				return false
+			}
+			info.srcIP, info.dstIP, info.isIPv6 = d.ip6.SrcIP, d.ip6.DstIP, true
+			ip = true
+		case layers.LayerTypeTCP:
+			info.tcp, transport = &d.tcp, true
+		case layers.LayerTypeUDP:
+			if d.udp.SrcPort == portVXLAN || d.udp.DstPort == portVXLAN ||
+				d.udp.SrcPort == portGeneve || d.udp.DstPort == portGeneve {
+				return false
+			}
+			info.udp, transport = &d.udp, true
+		case layers.LayerTypeICMPv4:
+			info.icmp4, transport = &d.icmp4, true
+		case layers.LayerTypeICMPv6:
+			info.icmp6, transport = &d.icmp6, true
+		}
+	}
+	info.length = len(data)
+	return ip && transport
+}
+
+// formatAddr returns "[ip]:port", the session address format. Sessions
+// are keyed by netip.AddrPort, so this only runs for sessions and events,
+// not for every packet.
+func formatAddr(ap netip.AddrPort) string {
+	var scratch [len("[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff%zone]:65535")]byte
+	buf := append(scratch[:0], '[')
+	buf = ap.Addr().AppendTo(buf)
+	buf = append(buf, ']', ':')
+	buf = strconv.AppendUint(buf, uint64(ap.Port()), 10)
+	return string(buf)
+}
@@ -0,0 +1,152 @@
+package watcher
+
+import (
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// DefaultDedupWindow is used unless SetDedupWindow replaces it
+const DefaultDedupWindow = 30 * time.Second
+
+// deduper collapses runs of identical consecutive events of one flow, such
+// as ICMP unreachable storms or repeated mDNS announcements, into the
+// run's first event: later ones raise its Repeats and move its EndTime
+// instead of being stored. A run ends with a different event of the flow
+// or a gap longer than the window. Repeats within a batch are folded
+// before it is written; later ones update the stored event, if the store
+// can (see database.RepeatStore). It runs on the writer goroutine only.
+type deduper struct {
+	window time.Duration
+	runs   map[dedupKey]*dedupRun
+	dirty  []*dedupRun // stored runs with repeats not yet written
+	pruned time.Time
+}
+
+// dedupKey is the flow an event belongs to: its flow ID, or its addresses
+// for events without one
+type dedupKey struct {
+	flowID, iface, src, dst string
+	srcPort, dstPort        uint16
+}
+
+// dedupRun is the latest run of identical events of a flow
+type dedupRun struct {
+	key     dedupKey
+	event   database.NetworkEvent // first event, without what differs between repeats
+	id      uint                  // stored event, once written
+	repeats int64                 // events folded into it
+	last    time.Time
+	dirty   bool
+}
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{window: window, runs: make(map[dedupKey]*dedupRun)}
+}
+
+// dedupable reports whether repeats of an event may be folded: summaries
+// already count several events, and each capture gap is its own outage
+func dedupable(e *database.NetworkEvent) bool {
+	switch e.EventType {
+	case database.EventRateLimited, database.EventSampled, database.EventScan, database.EventHourlySummary, database.EventCaptureGap:
+		return false
+	}
+	return e.EventCount == 0 && !e.Compacted
+}
+
+// sameAs is an event without the fields that differ between otherwise
+// identical occurrences: its ID, times and packet reference
+func sameAs(e *database.NetworkEvent) database.NetworkEvent {
+	s := *e
+	s.ID, s.Timestamp, s.EndTime, s.DNSAge = 0, time.Time{}, time.Time{}, 0
+	s.CaptureFile, s.CaptureFrame = "", 0
+	return s
+}
+
+// fold drops the events of a batch that repeat the run of their flow,
+// counting them on the run's first event. It returns the events to write
+// and, for each, the run it starts.
+func (d *deduper) fold(events []database.NetworkEvent) ([]database.NetworkEvent, []*dedupRun) {
+	kept := events[:0]
+	runs := make([]*dedupRun, 0, len(events))
+	for _, e := range events {
+		if !dedupable(&e) {
+			kept = append(kept, e)
+			runs = append(runs, nil)
+			continue
+		}
+		key := dedupKey{flowID: e.FlowID}
+		if e.FlowID == "" {
+			key = dedupKey{iface: e.Interface, src: e.SrcIP, dst: e.DstIP, srcPort: e.SrcPort, dstPort: e.DstPort}
+		}
+		same := sameAs(&e)
+		if run := d.runs[key]; run != nil && run.event == same && e.Timestamp.Sub(run.last) <= d.window {
+			run.repeats++
+			if e.Timestamp.After(run.last) {
+				run.last = e.Timestamp
+			}
+			if run.id != 0 && !run.dirty {
+				run.dirty = true
+				d.dirty = append(d.dirty, run)
+			}
+			continue
+		}
+		run := &dedupRun{key: key, event: same, last: e.Timestamp}
+		d.runs[key] = run
+		kept = append(kept, e)
+		runs = append(runs, run)
+	}
+	// Repeats within the batch go straight into the events written
+	for i, run := range runs {
+		if run != nil && run.repeats > 0 {
+			kept[i].Repeats, kept[i].EndTime = run.repeats, run.last
+		}
+	}
+	return kept, runs
+}
+
+// stored records the IDs of the events written, so later repeats update
+// them. Without updatable storage runs end with their batch.
+func (d *deduper) stored(events []database.NetworkEvent, runs []*dedupRun, updatable bool) {
+	if !updatable {
+		clear(d.runs)
+		return
+	}
+	for i, run := range runs {
+		if run != nil {
+			run.id = events[i].ID
+		}
+	}
+}
+
+// discard forgets the runs started by a batch that could not be stored, so
+// later repeats start new runs instead of being counted on events that
+// were never written
+func (d *deduper) discard(runs []*dedupRun) {
+	for _, run := range runs {
+		if run != nil && d.runs[run.key] == run {
+			delete(d.runs, run.key)
+		}
+	}
+}
+
+// updates returns the repeat counts of stored events raised since the
+// last call, and forgets runs idle for longer than the window
+func (d *deduper) updates(now time.Time) []database.Repeat {
+	var updates []database.Repeat
+	for _, run := range d.dirty {
+		updates = append(updates, database.Repeat{ID: run.id, Repeats: run.repeats, LastSeen: run.last})
+		run.dirty = false
+	}
+	d.dirty = d.dirty[:0]
+
+	if now.Sub(d.pruned) >= d.window {
+		for key, run := range d.runs {
+			if now.Sub(run.last) > d.window {
+				delete(d.runs, key)
+			}
+		}
+		d.pruned = now
+	}
+	return updates
+}
@@ -0,0 +1,341 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Fragment reassembly limits of one capture. The timeout is the one Linux
+// uses; the datagram and byte limits bound what a flood of fragments that
+// never complete can hold.
+const (
+	defragTimeout      = 30 * time.Second
+	defragMaxDatagrams = 1024
+	defragMaxBytes     = 4 << 20
+	defragMaxFragments = 64
+	maxDatagramSize    = 65535
+)
+
+// defragmenter reassembles fragmented IPv4 and IPv6 datagrams before
+// transport parsing, so a DNS response or tunnelled packet split over
+// several fragments is parsed whole instead of being skipped. Each capture
+// has its own, used only by its goroutine; Status reads the counters.
+type defragmenter struct {
+	pending   map[fragKey]*fragDatagram
+	bytes     int // payload held by pending datagrams
+	lastSweep time.Time
+
+	reassembled atomic.Uint64 // datagrams rebuilt from fragments
+	dropped     atomic.Uint64 // fragments given up on: expired, overlapping, malformed or over the limits
+}
+
+// fragKey identifies the datagram a fragment belongs to (RFC 791, RFC 8200)
+type fragKey struct {
+	src, dst netip.Addr
+	id       uint32
+	proto    uint8 // IPv4 only
+}
+
+// fragment is one piece of a datagram; header is the IP header to rebuild
+// the datagram with, used from the fragment at offset zero
+type fragment struct {
+	offset int
+	more   bool
+	data   []byte
+	header []byte
+}
+
+type fragDatagram struct {
+	header    []byte
+	pieces    []fragment
+	size      int // payload length, -1 until the last fragment arrived
+	received  int
+	firstSeen time.Time
+}
+
+func newDefragmenter() *defragmenter {
+	return &defragmenter{pending: make(map[fragKey]*fragDatagram)}
+}
+
+// Process returns the packet to parse: the packet itself when it is not a
+// fragment, the reassembled datagram when the packet completes one, and
+// false while fragments are missing or were discarded. IPv6 packets whose
+// extension headers gopacket does not decode are returned with the
+// extension headers removed.
+func (d *defragmenter) Process(packet gopacket.Packet) (gopacket.Packet, bool) {
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+			return packet, true
+		}
+		return d.processIPv4(packet, ip)
+	case *layers.IPv6:
+		return d.processIPv6(packet, ip)
+	}
+	return packet, true
+}
+
+func (d *defragmenter) processIPv4(packet gopacket.Packet, ip *layers.IPv4) (gopacket.Packet, bool) {
+	// A fragment cut short by the snap length cannot be reassembled
+	if packet.Metadata().Truncated {
+		d.dropped.Add(1)
+		return nil, false
+	}
+	src, _ := netip.AddrFromSlice(ip.SrcIP)
+	dst, _ := netip.AddrFromSlice(ip.DstIP)
+	key := fragKey{src: src.Unmap(), dst: dst.Unmap(), id: uint32(ip.Id), proto: uint8(ip.Protocol)}
+	dg := d.add(key, packetTime(packet), fragment{
+		offset: int(ip.FragOffset) * 8,
+		more:   ip.Flags&layers.IPv4MoreFragments != 0,
+		data:   ip.Payload,
+		header: ip.Contents,
+	})
+	if dg == nil {
+		return nil, false
+	}
+
+	buf := make([]byte, len(dg.header)+dg.size)
+	copy(buf, dg.header)
+	dg.assemble(buf[len(dg.header):])
+	if len(buf) > maxDatagramSize {
+		d.dropped.Add(uint64(len(dg.pieces)))
+		return nil, false
+	}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	buf[6] &= 0x40 // keep don't fragment, clear more fragments and the offset
+	buf[7] = 0
+	binary.BigEndian.PutUint16(buf[10:12], 0)
+	binary.BigEndian.PutUint16(buf[10:12], ipv4Checksum(buf[:len(dg.header)]))
+	return redecode(packet, buf, layers.LayerTypeIPv4), true
+}
+
+func (d *defragmenter) processIPv6(packet gopacket.Packet, ip *layers.IPv6) (gopacket.Packet, bool) {
+	next, payload := byte(ip.NextHeader), ip.Payload
+	if ip.HopByHop != nil {
+		next = byte(ip.HopByHop.NextHeader)
+	}
+	// Walk the extension header chain to the fragment header or transport.
+	// gopacket stops at extension headers it has no decoder for, so a
+	// packet carrying one is rebuilt without them.
+	rebuild := false
+	for isExtensionHeader(next) {
+		n := extensionHeaderLength(next, payload)
+		if n == 0 {
+			return packet, true
+		}
+		if next == 44 {
+			return d.addIPv6(packet, ip, payload[:8], payload[8:])
+		}
+		switch next {
+		case 135, 139, 140:
+			rebuild = true
+		}
+		next, payload = payload[0], payload[n:]
+	}
+	if !rebuild {
+		return packet, true
+	}
+	return redecode(packet, ipv6Datagram(ip.Contents, next, payload), layers.LayerTypeIPv6), true
+}
+
+// addIPv6 handles a packet with the fragment header hdr, followed by data
+func (d *defragmenter) addIPv6(packet gopacket.Packet, ip *layers.IPv6, hdr, data []byte) (gopacket.Packet, bool) {
+	next := hdr[0]
+	offset := int(binary.BigEndian.Uint16(hdr[2:4]) &^ 7)
+	more := hdr[3]&1 != 0
+	// An atomic fragment (RFC 6946) is a whole datagram
+	if offset == 0 && !more {
+		return redecode(packet, ipv6Datagram(ip.Contents, next, data), layers.LayerTypeIPv6), true
+	}
+	if packet.Metadata().Truncated {
+		d.dropped.Add(1)
+		return nil, false
+	}
+	src, _ := netip.AddrFromSlice(ip.SrcIP)
+	dst, _ := netip.AddrFromSlice(ip.DstIP)
+	key := fragKey{src: src, dst: dst, id: binary.BigEndian.Uint32(hdr[4:8])}
+	header := append(bytes.Clone(ip.Contents[:40]), next)
+	dg := d.add(key, packetTime(packet), fragment{offset: offset, more: more, data: data, header: header})
+	if dg == nil {
+		return nil, false
+	}
+	payload := make([]byte, dg.size)
+	dg.assemble(payload)
+	return redecode(packet, ipv6Datagram(dg.header[:40], dg.header[40], payload), layers.LayerTypeIPv6), true
+}
+
+// add stores a fragment and returns its datagram once every fragment
+// arrived. Overlapping fragments discard the datagram, as RFC 5722 asks
+// for IPv6; an exact duplicate is ignored.
+func (d *defragmenter) add(key fragKey, now time.Time, f fragment) *fragDatagram {
+	d.expire(now)
+	end := f.offset + len(f.data)
+	if end > maxDatagramSize || len(f.data) == 0 || (f.more && len(f.data)%8 != 0) {
+		d.dropped.Add(1)
+		return nil
+	}
+
+	dg := d.pending[key]
+	if dg == nil {
+		if len(d.pending) >= defragMaxDatagrams || d.bytes+len(f.data) > defragMaxBytes {
+			d.dropped.Add(1)
+			return nil
+		}
+		dg = &fragDatagram{size: -1, firstSeen: now}
+		d.pending[key] = dg
+	}
+	for _, p := range dg.pieces {
+		if f.offset < p.offset+len(p.data) && p.offset < end {
+			if p.offset == f.offset && len(p.data) == len(f.data) {
+				return nil
+			}
+			d.discard(key, dg, 1)
+			return nil
+		}
+	}
+	switch {
+	case !f.more && dg.size >= 0 && dg.size != end,
+		!f.more && dg.received > 0 && dg.lastEnd() > end,
+		dg.size >= 0 && end > dg.size,
+		len(dg.pieces) >= defragMaxFragments,
+		d.bytes+len(f.data) > defragMaxBytes:
+		d.discard(key, dg, 1)
+		return nil
+	}
+
+	if !f.more {
+		dg.size = end
+	}
+	if f.offset == 0 {
+		dg.header = bytes.Clone(f.header)
+	}
+	f.data, f.header = bytes.Clone(f.data), nil
+	dg.pieces = append(dg.pieces, f)
+	dg.received += len(f.data)
+	d.bytes += len(f.data)
+
+	// Without overlaps and with every piece inside the datagram, the
+	// pieces cover it once they add up to its size
+	if dg.header == nil || dg.received != dg.size {
+		return nil
+	}
+	delete(d.pending, key)
+	d.bytes -= dg.received
+	d.reassembled.Add(1)
+	return dg
+}
+
+// discard gives up on a datagram; extra counts a fragment not stored in it
+func (d *defragmenter) discard(key fragKey, dg *fragDatagram, extra int) {
+	delete(d.pending, key)
+	d.bytes -= dg.received
+	d.dropped.Add(uint64(len(dg.pieces) + extra))
+}
+
+// expire discards datagrams still incomplete after defragTimeout, checking
+// at most once a second
+func (d *defragmenter) expire(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Second {
+		return
+	}
+	d.lastSweep = now
+	for key, dg := range d.pending {
+		if now.Sub(dg.firstSeen) > defragTimeout {
+			d.discard(key, dg, 0)
+		}
+	}
+}
+
+// lastEnd returns the end of the highest fragment received so far
+func (dg *fragDatagram) lastEnd() int {
+	end := 0
+	for _, p := range dg.pieces {
+		end = max(end, p.offset+len(p.data))
+	}
+	return end
+}
+
+// assemble copies the fragments into payload, which is dg.size long
+func (dg *fragDatagram) assemble(payload []byte) {
+	for _, p := range dg.pieces {
+		copy(payload[p.offset:], p.data)
+	}
+}
+
+// isExtensionHeader reports whether an IPv6 next header value is an
+// extension header: hop-by-hop, routing, fragment, authentication,
+// destination options, mobility, HIP and shim6
+func isExtensionHeader(next byte) bool {
+	switch next {
+	case 0, 43, 44, 51, 60, 135, 139, 140:
+		return true
+	}
+	return false
+}
+
+// extensionHeaderLength returns the length of the extension header of type
+// next at the start of data, or zero when data is too short to hold it
+func extensionHeaderLength(next byte, data []byte) int {
+	if len(data) < 8 {
+		return 0
+	}
+	n := (int(data[1]) + 1) * 8
+	switch next {
+	case 44:
+		n = 8
+	case 51: // the authentication header counts 4-byte words, less two
+		n = (int(data[1]) + 2) * 4
+	}
+	if len(data) < n {
+		return 0
+	}
+	return n
+}
+
+// ipv6Datagram builds an IPv6 packet from the fixed header of header with
+// next as its next header, followed by payload
+func ipv6Datagram(header []byte, next byte, payload []byte) []byte {
+	buf := make([]byte, 40+len(payload))
+	copy(buf, header[:40])
+	buf[6] = next
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(payload)))
+	copy(buf[40:], payload)
+	return buf
+}
+
+// ipv4Checksum returns the header checksum of an IPv4 header whose checksum
+// field is zero
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// redecode decodes a rebuilt IP datagram, keeping the capture metadata of
+// the packet it was rebuilt from
+func redecode(from gopacket.Packet, data []byte, first gopacket.LayerType) gopacket.Packet {
+	packet := gopacket.NewPacket(data, first, packetDecodeOptions)
+	md := packet.Metadata()
+	md.CaptureInfo = from.Metadata().CaptureInfo
+	md.CaptureLength, md.Length = len(data), len(data)
+	return packet
+}
+
+// packetTime returns when a packet was captured
+func packetTime(packet gopacket.Packet) time.Time {
+	if ts := packet.Metadata().Timestamp; !ts.IsZero() {
+		return ts
+	}
+	return time.Now()
+}
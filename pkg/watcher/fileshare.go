@@ -0,0 +1,384 @@
+package watcher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// FileShare is what a flow revealed of SMB or NFS file sharing: the
+// protocol version, the server name and the shares or exports accessed
+type FileShare struct {
+	Protocol  string   // SMB or NFS
+	Version   string   // SMB dialect (1, 2.1, 3.1.1, ...) or NFS version (3, 4.1, ...)
+	Server    string   // server name in SMB tree paths
+	Shares    []string // shares or exports, in the order first accessed
+	Encrypted bool     // SMB3 encrypted messages were seen
+}
+
+// maxShares caps the shares remembered per flow
+const maxShares = 16
+
+// addShare records a share or export once
+func (fs *FileShare) addShare(share string) {
+	if share != "" && len(fs.Shares) < maxShares && !slices.Contains(fs.Shares, share) {
+		fs.Shares = append(fs.Shares, share)
+	}
+}
+
+// VersionInfo describes the protocol version, noting SMB3 encryption
+func (fs *FileShare) VersionInfo() string {
+	if fs.Encrypted {
+		return strings.TrimSpace(fs.Version + " encrypted")
+	}
+	return fs.Version
+}
+
+// SMBMessage is what an SMB message shows of a file-sharing session: the
+// dialect a server selected, or the \\server\share path of a tree connect
+type SMBMessage struct {
+	Dialect   string
+	Server    string
+	Share     string
+	Encrypted bool // an SMB3 transform header, hiding everything else
+}
+
+// SMB2 commands, header flags and dialects ([MS-SMB2] 2.2)
+const (
+	smb2HeaderSize    = 64
+	smb2Negotiate     = 0x0000
+	smb2TreeConnect   = 0x0003
+	smb2FlagsResponse = 0x00000001
+
+	smb1Negotiate       = 0x72
+	smb1TreeConnectAndX = 0x75
+	smb1Flags2Unicode   = 0x8000
+)
+
+var smb2Dialects = map[uint16]string{
+	0x0202: "2.0.2",
+	0x0210: "2.1",
+	0x0300: "3.0",
+	0x0302: "3.0.2",
+	0x0311: "3.1.1",
+}
+
+// ParseSMB parses the SMB message at the start of a TCP payload in NetBIOS
+// session framing, as sent on port 445 and 139 alike, returning nil if the
+// payload is not SMB or tells nothing about the session
+func ParseSMB(payload []byte) *SMBMessage {
+	// NetBIOS session message: type 0, then a 24-bit length
+	if len(payload) < 8 || payload[0] != 0 {
+		return nil
+	}
+	msg := payload[4:]
+	switch string(msg[:4]) {
+	case "\xfdSMB":
+		return &SMBMessage{Encrypted: true}
+	case "\xfeSMB":
+		return parseSMB2(msg)
+	case "\xffSMB":
+		return parseSMB1(msg)
+	}
+	return nil
+}
+
+// parseSMB2 reads the dialect of a negotiate response and the path of a
+// tree connect request
+func parseSMB2(msg []byte) *SMBMessage {
+	if len(msg) < smb2HeaderSize+8 || binary.LittleEndian.Uint16(msg[4:6]) != smb2HeaderSize {
+		return nil
+	}
+	command := binary.LittleEndian.Uint16(msg[12:14])
+	response := binary.LittleEndian.Uint32(msg[16:20])&smb2FlagsResponse != 0
+	body := msg[smb2HeaderSize:]
+	switch {
+	case command == smb2Negotiate && response:
+		// StructureSize 65, SecurityMode, DialectRevision
+		if binary.LittleEndian.Uint16(body[0:2]) != 65 {
+			return nil
+		}
+		dialect, ok := smb2Dialects[binary.LittleEndian.Uint16(body[4:6])]
+		if !ok {
+			return nil
+		}
+		return &SMBMessage{Dialect: dialect}
+	case command == smb2TreeConnect && !response:
+		// StructureSize 9, Flags, PathOffset (from the header), PathLength
+		if binary.LittleEndian.Uint16(body[0:2]) != 9 {
+			return nil
+		}
+		offset := int(binary.LittleEndian.Uint16(body[4:6]))
+		length := int(binary.LittleEndian.Uint16(body[6:8]))
+		if offset < smb2HeaderSize || offset+length > len(msg) {
+			return nil
+		}
+		return smbPath(decodeUTF16(msg[offset : offset+length]))
+	}
+	return nil
+}
+
+// parseSMB1 recognises SMB1 negotiation, which modern systems disable,
+// and reads the path of a Tree Connect AndX request
+func parseSMB1(msg []byte) *SMBMessage {
+	const headerSize = 32
+	if len(msg) < headerSize+1 {
+		return nil
+	}
+	response := msg[9]&0x80 != 0
+	switch msg[4] {
+	case smb1Negotiate:
+		if !response {
+			return nil
+		}
+		return &SMBMessage{Dialect: "1"}
+	case smb1TreeConnectAndX:
+		if response {
+			return nil
+		}
+	default:
+		return nil
+	}
+	// WordCount 4: AndX command, reserved, offset, flags, password length
+	words := msg[headerSize:]
+	if words[0] != 4 || len(words) < 1+8+2 {
+		return nil
+	}
+	passwordLength := int(binary.LittleEndian.Uint16(words[7:9]))
+	data := words[1+8+2:]
+	if passwordLength > len(data) {
+		return nil
+	}
+	start := headerSize + 1 + 8 + 2 + passwordLength
+	path := data[passwordLength:]
+	if binary.LittleEndian.Uint16(msg[10:12])&smb1Flags2Unicode != 0 {
+		// Unicode strings are aligned to 2 bytes from the header
+		if start%2 == 1 && len(path) > 0 {
+			path = path[1:]
+		}
+		for i := 0; i+1 < len(path); i += 2 {
+			if path[i] == 0 && path[i+1] == 0 {
+				return smbPath(decodeUTF16(path[:i]))
+			}
+		}
+		return nil
+	}
+	end := slices.Index(path, 0)
+	if end < 0 {
+		return nil
+	}
+	return smbPath(string(path[:end]))
+}
+
+// smbPath splits a \\server\share path; it must name both
+func smbPath(path string) *SMBMessage {
+	server, share, ok := strings.Cut(strings.TrimPrefix(path, `\\`), `\`)
+	if !ok || server == "" || share == "" || !strings.HasPrefix(path, `\\`) {
+		return nil
+	}
+	return &SMBMessage{Server: server, Share: share}
+}
+
+// decodeUTF16 decodes little-endian UTF-16 text
+func decodeUTF16(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// NFSCall is what an ONC RPC call shows of NFS: the NFS version, and the
+// export path of a MOUNT request or an NFSv4 lookup from the root
+type NFSCall struct {
+	Version string
+	Export  string
+}
+
+// ONC RPC programs and procedures (RFC 5531, RFC 1813, RFC 7530)
+const (
+	rpcCall          = 0
+	rpcVersion       = 2
+	rpcProgramNFS    = 100003
+	rpcProgramMount  = 100005
+	mountProcMNT     = 1
+	nfs4ProcCompound = 1
+
+	nfs4OpLookup    = 15
+	nfs4OpPutRootFH = 24
+	nfs4OpSequence  = 53
+)
+
+// maxExportPath bounds the length of export paths read from calls
+const maxExportPath = 1024
+
+// ParseNFSCall parses an ONC RPC call to NFS or its MOUNT protocol, which
+// run on port 2049 and ports assigned by the portmapper. Over TCP the call
+// follows a record marker. It returns nil for other payloads.
+func ParseNFSCall(payload []byte, tcp bool) *NFSCall {
+	r := xdrReader{b: payload}
+	if tcp {
+		r.uint32() // record marker: last fragment bit and length
+	}
+	r.uint32() // xid
+	if r.uint32() != rpcCall || r.uint32() != rpcVersion {
+		return nil
+	}
+	program, version, procedure := r.uint32(), r.uint32(), r.uint32()
+	for range 2 { // credentials and verifier: flavor, opaque body
+		r.uint32()
+		r.opaque(400)
+	}
+	if r.err {
+		return nil
+	}
+
+	switch program {
+	case rpcProgramMount:
+		if version < 1 || version > 3 {
+			return nil
+		}
+		call := &NFSCall{Version: mountNFSVersion(version)}
+		if procedure == mountProcMNT {
+			if path := r.opaque(maxExportPath); !r.err {
+				call.Export = string(path)
+			}
+		}
+		return call
+	case rpcProgramNFS:
+		if version < 2 || version > 4 {
+			return nil
+		}
+		call := &NFSCall{Version: fmt.Sprint(version)}
+		if version == 4 && procedure == nfs4ProcCompound {
+			r.opaque(maxExportPath) // tag
+			minor := r.uint32()
+			if r.err {
+				return call
+			}
+			if minor > 0 {
+				call.Version = fmt.Sprintf("4.%d", minor)
+			}
+			call.Export = nfs4RootLookup(&r)
+		}
+		return call
+	}
+	return nil
+}
+
+// mountNFSVersion is the NFS version a MOUNT protocol version serves
+func mountNFSVersion(mount uint32) string {
+	if mount == 3 {
+		return "3"
+	}
+	return "2"
+}
+
+// nfs4RootLookup reads the path an NFSv4 COMPOUND looks up from the root
+// file handle (PUTROOTFH, then a LOOKUP per component), as clients do when
+// mounting, skipping a leading NFSv4.1 SEQUENCE
+func nfs4RootLookup(r *xdrReader) string {
+	ops := r.uint32()
+	var components []string
+	root := false
+	for i := uint32(0); i < ops && i < 32 && !r.err; i++ {
+		switch op := r.uint32(); {
+		case op == nfs4OpSequence && i == 0:
+			r.skip(32) // session ID, sequence and slot IDs, cachethis
+		case op == nfs4OpPutRootFH && !root:
+			root = true
+		case op == nfs4OpLookup && root:
+			name := r.opaque(maxExportPath)
+			if r.err {
+				return ""
+			}
+			components = append(components, string(name))
+		default:
+			i = ops
+		}
+	}
+	if !root || len(components) == 0 {
+		return ""
+	}
+	return "/" + strings.Join(components, "/")
+}
+
+// xdrReader reads big-endian XDR values, setting err once the data runs out
+type xdrReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = true
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+// opaque reads variable-length data padded to 4 bytes, up to limit bytes long
+func (r *xdrReader) opaque(limit uint32) []byte {
+	n := r.uint32()
+	if r.err || n > limit {
+		r.err = true
+		return nil
+	}
+	padded := int(n+3) &^ 3
+	if len(r.b) < padded {
+		r.err = true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[padded:]
+	return v
+}
+
+func (r *xdrReader) skip(n int) {
+	if len(r.b) < n {
+		r.err = true
+		return
+	}
+	r.b = r.b[n:]
+}
+
+// inspectFileShare looks for SMB and NFS in the payload of a tracked flow
+// and records what it reveals in the session. The server is the side the
+// SMB requests and RPC calls are sent to.
+func inspectFileShare(session *Session, tcp bool, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	if tcp {
+		if msg := ParseSMB(payload); msg != nil {
+			fs := session.fileShare("SMB")
+			if msg.Dialect != "" {
+				fs.Version = msg.Dialect
+			}
+			if msg.Server != "" {
+				fs.Server = msg.Server
+			}
+			fs.addShare(msg.Share)
+			fs.Encrypted = fs.Encrypted || msg.Encrypted
+			return
+		}
+	}
+	if call := ParseNFSCall(payload, tcp); call != nil {
+		fs := session.fileShare("NFS")
+		fs.Version = call.Version
+		fs.addShare(call.Export)
+	}
+}
+
+// fileShare returns the session's file sharing state for protocol,
+// starting it on the first message
+func (s *Session) fileShare(protocol string) *FileShare {
+	if s.FileShare == nil || s.FileShare.Protocol != protocol {
+		s.FileShare = &FileShare{Protocol: protocol}
+	}
+	return s.FileShare
+}
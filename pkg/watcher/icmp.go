@@ -0,0 +1,134 @@
+package watcher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// IP protocol numbers of the transports an ICMP error can quote
+const (
+	ipProtoICMP   = 1
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+)
+
+// quotedFlow is the packet an ICMP error was sent in response to, read from
+// the header the error quotes
+type quotedFlow struct {
+	Proto            string // TCP, UDP, ICMP or the protocol number
+	SrcIP, DstIP     string
+	SrcPort, DstPort uint16 // zero unless Proto is TCP or UDP
+}
+
+// sessionKey returns the key the triggering packet's session is tracked
+// under, or false unless it is TCP or UDP
+func (q *quotedFlow) sessionKey() (sessionKey, bool) {
+	var proto Protocol
+	switch q.Proto {
+	case "TCP":
+		proto = ProtoTCP
+	case "UDP":
+		proto = ProtoUDP
+	default:
+		return sessionKey{}, false
+	}
+	src, err := netip.ParseAddr(q.SrcIP)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	dst, err := netip.ParseAddr(q.DstIP)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	return sessionKey{
+		proto: proto,
+		src:   netip.AddrPortFrom(src, q.SrcPort),
+		dst:   netip.AddrPortFrom(dst, q.DstPort),
+	}, true
+}
+
+func (q *quotedFlow) String() string {
+	if q.SrcPort != 0 || q.DstPort != 0 {
+		return fmt.Sprintf("%s [%s]:%d->[%s]:%d", q.Proto, q.SrcIP, q.SrcPort, q.DstIP, q.DstPort)
+	}
+	return fmt.Sprintf("%s %s->%s", q.Proto, q.SrcIP, q.DstIP)
+}
+
+// isICMPError reports whether the message quotes the packet that caused it:
+// destination unreachable, source quench, redirect, time exceeded and
+// parameter problem for ICMPv4; unreachable, packet too big, time exceeded
+// and parameter problem for ICMPv6
+func isICMPError(icmpType uint8, isIPv6 bool) bool {
+	if isIPv6 {
+		return icmpType >= 1 && icmpType <= 4
+	}
+	switch icmpType {
+	case 3, 4, 5, 11, 12:
+		return true
+	}
+	return false
+}
+
+// parseQuotedFlow reads the IP header and first transport bytes an ICMP
+// error carries. For ICMPv4 the payload starts with the quoted header; the
+// ICMPv6 payload starts with the 4-byte unused/MTU/pointer field.
+func parseQuotedFlow(payload []byte, isIPv6 bool) (*quotedFlow, bool) {
+	var q quotedFlow
+	var proto byte
+	var transport []byte
+	if isIPv6 {
+		if len(payload) < 4+40 || payload[4]>>4 != 6 {
+			return nil, false
+		}
+		ip := payload[4:]
+		src, _ := netip.AddrFromSlice(ip[8:24])
+		dst, _ := netip.AddrFromSlice(ip[24:40])
+		q.SrcIP, q.DstIP = src.String(), dst.String()
+		proto, transport = skipExtensionHeaders(ip[6], ip[40:])
+	} else {
+		if len(payload) < 20 || payload[0]>>4 != 4 {
+			return nil, false
+		}
+		ihl := int(payload[0]&0x0f) * 4
+		if ihl < 20 || len(payload) < ihl {
+			return nil, false
+		}
+		src, _ := netip.AddrFromSlice(payload[12:16])
+		dst, _ := netip.AddrFromSlice(payload[16:20])
+		q.SrcIP, q.DstIP = src.String(), dst.String()
+		proto, transport = payload[9], payload[ihl:]
+	}
+
+	switch proto {
+	case ipProtoTCP, ipProtoUDP:
+		q.Proto = "TCP"
+		if proto == ipProtoUDP {
+			q.Proto = "UDP"
+		}
+		// RFC 792 guarantees 8 bytes of the datagram, enough for both ports
+		if len(transport) >= 4 {
+			q.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+			q.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		}
+	case ipProtoICMP, ipProtoICMPv6:
+		q.Proto = "ICMP"
+	default:
+		q.Proto = fmt.Sprintf("%d", proto)
+	}
+	return &q, true
+}
+
+// skipExtensionHeaders follows the IPv6 next-header chain past the
+// extension headers to the transport
+func skipExtensionHeaders(next byte, data []byte) (byte, []byte) {
+	for isExtensionHeader(next) {
+		n := extensionHeaderLength(next, data)
+		if n == 0 {
+			return next, nil
+		}
+		next, data = data[0], data[n:]
+	}
+	return next, data
+}
@@ -0,0 +1,232 @@
+package watcher
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// InterfacePattern selects interfaces by glob, e.g. "eth*,wg*,!eth2".
+// Entries prefixed with "!" exclude matching interfaces.
+type InterfacePattern struct {
+	includes []string
+	excludes []string
+}
+
+// ParseInterfacePattern parses a comma-separated list of interface globs
+func ParseInterfacePattern(spec string) (*InterfacePattern, error) {
+	p := &InterfacePattern{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		exclude := strings.HasPrefix(entry, "!")
+		glob := strings.TrimPrefix(entry, "!")
+		if glob == "" {
+			return nil, fmt.Errorf("empty interface pattern in %q", spec)
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q: %w", glob, err)
+		}
+		if exclude {
+			p.excludes = append(p.excludes, glob)
+		} else {
+			p.includes = append(p.includes, glob)
+		}
+	}
+	return p, nil
+}
+
+// IsInterfacePattern reports whether spec uses glob or exclusion syntax
+// rather than a plain list of interface names
+func IsInterfacePattern(spec string) bool {
+	return strings.ContainsAny(spec, "*?[!")
+}
+
+// Match reports whether an interface name is selected by the pattern.
+// With no include entries every interface not excluded is selected.
+func (p *InterfacePattern) Match(name string) bool {
+	for _, glob := range p.excludes {
+		if ok, _ := path.Match(glob, name); ok {
+			return false
+		}
+	}
+	if len(p.includes) == 0 {
+		return true
+	}
+	for _, glob := range p.includes {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the pattern in its comma-separated form
+func (p *InterfacePattern) String() string {
+	entries := append([]string{}, p.includes...)
+	for _, glob := range p.excludes {
+		entries = append(entries, "!"+glob)
+	}
+	return strings.Join(entries, ",")
+}
+
+// Resolve returns the interfaces that are currently up and match the pattern.
+// Loopback is only selected when named by an include entry without wildcards.
+func (p *InterfacePattern) Resolve() ([]net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+
+	var matched []net.Interface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || !p.Match(iface.Name) {
+			continue
+		}
+		if iface.Flags&net.FlagLoopback != 0 && !p.namesExplicitly(iface.Name) {
+			continue
+		}
+		matched = append(matched, iface)
+	}
+	return matched, nil
+}
+
+// namesExplicitly reports whether name appears as a literal include entry
+func (p *InterfacePattern) namesExplicitly(name string) bool {
+	for _, glob := range p.includes {
+		if glob == name {
+			return true
+		}
+	}
+	return false
+}
+
+// InterfaceConfig overrides capture settings for interfaces matching Pattern.
+// Empty filter fields inherit the global --only/--traffic-exclude/--exclude-ports.
+type InterfaceConfig struct {
+	Pattern      string // interface name or glob
+	Only         string // comma-separated protocols, like --only
+	Exclude      string // comma-separated traffic classes, like --traffic-exclude
+	ExcludePorts string // comma-separated ports, like --exclude-ports
+	BPF          string // tcpdump -ddd program file, see LoadBPFFilter; empty uses --bpf
+	VLANs        string // comma-separated VLAN IDs to record, see ParseVLANs; empty uses --vlan
+	SnapLen      int    // bytes captured per packet, or SnapHeaders; 0 uses --snaplen
+	RingMB       int    // AF_PACKET ring buffer size, per worker; 0 uses the default
+	Workers      int    // capture workers; 0 uses --capture-workers
+}
+
+// ParseInterfaceSpec splits an --interface value such as
+// "eth0:only=dns+tls:snaplen=256,wlan0" into the plain interface list used to
+// select interfaces and the per-interface settings. Option values use "+"
+// between items since "," already separates interfaces.
+func ParseInterfaceSpec(spec string) (string, []InterfaceConfig, error) {
+	var names []string
+	var configs []InterfaceConfig
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		names = append(names, parts[0])
+		if len(parts) == 1 {
+			continue
+		}
+		if strings.HasPrefix(parts[0], "!") {
+			return "", nil, fmt.Errorf("excluded interface %q cannot have options", parts[0])
+		}
+
+		cfg, err := parseInterfaceOptions(parts[0], parts[1:])
+		if err != nil {
+			return "", nil, err
+		}
+		configs = append(configs, cfg)
+	}
+	return strings.Join(names, ","), configs, nil
+}
+
+// ParseInterfaceConfigs parses --interface-config, per-interface settings
+// that do not select interfaces: entries such as
+// "br-lan:bpf=/etc/net-watcher/lan.bpf;wan0:only=dns,tls" separated by ";".
+// They apply after the options given in --interface.
+func ParseInterfaceConfigs(spec string) ([]InterfaceConfig, error) {
+	var configs []InterfaceConfig
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if _, err := path.Match(parts[0], ""); err != nil || parts[0] == "" || strings.HasPrefix(parts[0], "!") {
+			return nil, fmt.Errorf("invalid interface %q in %q", parts[0], entry)
+		}
+		cfg, err := parseInterfaceOptions(parts[0], parts[1:])
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// parseInterfaceOptions parses the key=value options of one interface
+func parseInterfaceOptions(pattern string, opts []string) (InterfaceConfig, error) {
+	cfg := InterfaceConfig{Pattern: pattern}
+	for _, opt := range opts {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid interface option %q, expected key=value", opt)
+		}
+		switch key {
+		case "only":
+			cfg.Only = strings.ReplaceAll(value, "+", ",")
+		case "exclude":
+			cfg.Exclude = strings.ReplaceAll(value, "+", ",")
+		case "exclude-ports":
+			cfg.ExcludePorts = strings.ReplaceAll(value, "+", ",")
+		case "bpf":
+			cfg.BPF = value
+		case "vlan":
+			cfg.VLANs = strings.ReplaceAll(value, "+", ",")
+			if _, err := ParseVLANs(cfg.VLANs); err != nil {
+				return cfg, fmt.Errorf("interface %s: %w", pattern, err)
+			}
+		case "snaplen":
+			n, err := ParseSnapLen(value)
+			if err != nil {
+				return cfg, fmt.Errorf("interface %s: %w", pattern, err)
+			}
+			cfg.SnapLen = n
+		case "ring":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return cfg, fmt.Errorf("invalid %s %q for interface %s", key, value, pattern)
+			}
+			cfg.RingMB = n
+		case "workers":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid workers %q for interface %s", value, pattern)
+			}
+			if err := ValidateCaptureWorkers(n); err != nil {
+				return cfg, fmt.Errorf("interface %s: %w", pattern, err)
+			}
+			cfg.Workers = n
+		default:
+			return cfg, fmt.Errorf("unknown interface option %q (expected only, exclude, exclude-ports, bpf, vlan, snaplen, ring, workers)", key)
+		}
+	}
+	if err := ValidateFilters(cfg.Only, cfg.Exclude, cfg.ExcludePorts); err != nil {
+		return cfg, fmt.Errorf("interface %s: %w", pattern, err)
+	}
+	return cfg, nil
+}
+
+// hasFilters reports whether the config overrides any traffic filter
+func (c InterfaceConfig) hasFilters() bool {
+	return c.Only != "" || c.Exclude != "" || c.ExcludePorts != ""
+}
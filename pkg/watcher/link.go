@@ -0,0 +1,275 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Delay before reopening a failed capture, doubling while it keeps
+	// failing and reset once a capture ran for captureRetryMax
+	captureRetryMin = time.Second
+	captureRetryMax = time.Minute
+	// How often an interface that is down is checked in case a link
+	// notification was missed
+	linkRecheckInterval = 10 * time.Second
+	// Quiet time after a link change before interfaces are rescanned
+	rescanSettleDelay = 250 * time.Millisecond
+)
+
+// linkMonitor follows interfaces going down and up through netlink link
+// notifications, so sniffers can stop and reopen their capture
+type linkMonitor struct {
+	mutex    sync.Mutex
+	watches  map[string]chan bool
+	onChange func() // called after notifications about any interface; may be nil
+}
+
+// newLinkMonitor creates a monitor without watched interfaces
+func newLinkMonitor(onChange func()) *linkMonitor {
+	return &linkMonitor{watches: make(map[string]chan bool), onChange: onChange}
+}
+
+// watch returns a channel holding the latest state reported for an
+// interface: true when it is up with a carrier. A newer state replaces one
+// not yet read.
+func (m *linkMonitor) watch(name string) <-chan bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ch := make(chan bool, 1)
+	m.watches[name] = ch
+	return ch
+}
+
+// unwatch stops reporting the state of an interface
+func (m *linkMonitor) unwatch(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.watches, name)
+}
+
+// notify reports the state of an interface if it is watched
+func (m *linkMonitor) notify(name string, up bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ch, ok := m.watches[name]
+	if !ok {
+		return
+	}
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- up
+}
+
+// resync reports the current state of every watched interface, after
+// notifications were lost
+func (m *linkMonitor) resync() {
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.watches))
+	for name := range m.watches {
+		names = append(names, name)
+	}
+	m.mutex.Unlock()
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		m.notify(name, err == nil && linkUp(*iface))
+	}
+}
+
+// run subscribes to link notifications (RTMGRP_LINK) and reports them
+// until ctx is cancelled
+func (m *linkMonitor) run(ctx context.Context) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+		return fmt.Errorf("failed to subscribe to link notifications: %w", err)
+	}
+	// Wake up every second to notice ctx
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return fmt.Errorf("failed to set netlink timeout: %w", err)
+	}
+
+	buf := make([]byte, 64<<10)
+	for ctx.Err() == nil {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		switch {
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.ENOBUFS):
+			// The socket overflowed and notifications were lost
+			m.resync()
+			m.changed()
+			continue
+		case err != nil:
+			return fmt.Errorf("failed to read link notifications: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		changed := false
+		for i := range msgs {
+			if name, up, ok := parseLinkMessage(&msgs[i]); ok {
+				m.notify(name, up)
+				changed = true
+			}
+		}
+		if changed {
+			m.changed()
+		}
+	}
+	return nil
+}
+
+// changed calls onChange, if set
+func (m *linkMonitor) changed() {
+	if m.onChange != nil {
+		m.onChange()
+	}
+}
+
+// parseLinkMessage returns the interface and state a link notification
+// reports. A deleted interface is down.
+func parseLinkMessage(msg *syscall.NetlinkMessage) (name string, up, ok bool) {
+	if msg.Header.Type != unix.RTM_NEWLINK && msg.Header.Type != unix.RTM_DELLINK {
+		return "", false, false
+	}
+	if len(msg.Data) < unix.SizeofIfInfomsg {
+		return "", false, false
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		return "", false, false
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == unix.IFLA_IFNAME {
+			name = string(bytes.TrimRight(attr.Value, "\x00"))
+		}
+	}
+	// struct ifinfomsg: family, pad, type, index, then the flags
+	flags := binary.NativeEndian.Uint32(msg.Data[8:12])
+	up = msg.Header.Type == unix.RTM_NEWLINK && flags&unix.IFF_UP != 0 && flags&unix.IFF_RUNNING != 0
+	return name, up, name != ""
+}
+
+// linkUp reports whether an interface is up with a carrier
+func linkUp(iface net.Interface) bool {
+	return iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagRunning != 0
+}
+
+// runSniffer captures an interface until ctx is cancelled. When its link
+// goes down or the capture fails, the handles are closed and reopened once
+// the interface is up again, and the time without capture is stored as a
+// CAPTURE_GAP event.
+func (w *Watcher) runSniffer(ctx context.Context, iface net.Interface, cfg InterfaceConfig) {
+	name := iface.Name
+	link := w.links.watch(name)
+	defer w.links.unwatch(name)
+
+	retry := captureRetryMin
+	for {
+		w.logger.Info("Capture started", "interface", name)
+		started := time.Now()
+		cctx, stop := context.WithCancel(ctx)
+		go func() {
+			for {
+				select {
+				case <-cctx.Done():
+					return
+				case up := <-link:
+					if !up {
+						stop()
+						return
+					}
+				}
+			}
+		}()
+		err := w.sniffInterface(cctx, iface, cfg)
+		down := cctx.Err() != nil
+		stop()
+		if ctx.Err() != nil {
+			break
+		}
+
+		reason := "link down"
+		if !down && err != nil {
+			reason = err.Error()
+		}
+		stopped := time.Now()
+		w.logger.Warn("Capture interrupted, waiting for the interface", "interface", name, "reason", reason)
+		if stopped.Sub(started) >= captureRetryMax {
+			retry = captureRetryMin
+		}
+
+		w.sniffersMux.Lock()
+		w.linkDown[name] = stopped
+		w.sniffersMux.Unlock()
+		var ok bool
+		iface, ok = w.awaitInterface(ctx, name, link, retry)
+		w.sniffersMux.Lock()
+		delete(w.linkDown, name)
+		w.sniffersMux.Unlock()
+		if !ok {
+			break
+		}
+
+		retry = min(retry*2, captureRetryMax)
+		w.recordCaptureGap(name, stopped, time.Now(), reason)
+		// Reopened like a new sniffer, with the current configuration
+		cfg = w.configFor(name)
+	}
+	w.logger.Info("Capture stopped", "interface", name)
+}
+
+// awaitInterface waits for delay, then until the interface is up with a
+// carrier, and returns it as it is now: a re-created interface has a new
+// index. It reports false when ctx is cancelled first.
+func (w *Watcher) awaitInterface(ctx context.Context, name string, link <-chan bool, delay time.Duration) (net.Interface, bool) {
+	select {
+	case <-ctx.Done():
+		return net.Interface{}, false
+	case <-time.After(delay):
+	}
+	recheck := time.NewTicker(linkRecheckInterval)
+	defer recheck.Stop()
+	for {
+		if iface, err := net.InterfaceByName(name); err == nil && linkUp(*iface) {
+			return *iface, true
+		}
+		select {
+		case <-ctx.Done():
+			return net.Interface{}, false
+		case <-link:
+		case <-recheck.C:
+		}
+	}
+}
+
+// recordCaptureGap stores the period an interface was not captured
+func (w *Watcher) recordCaptureGap(name string, from, to time.Time, reason string) {
+	w.logger.Info("Capture resumed", "interface", name, "gap", to.Sub(from).Round(time.Millisecond))
+	w.sessionManager.bufferEvent(database.NetworkEvent{
+		Timestamp: from,
+		EndTime:   to,
+		EventType: database.EventCaptureGap,
+		Interface: name,
+		Duration:  to.Sub(from).Milliseconds(),
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,269 @@
+package watcher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// NTPPacket is the header of an NTP message, and whether it is protected
+// by Network Time Security
+type NTPPacket struct {
+	Version uint8
+	Mode    uint8 // 3 for client requests, 4 for server replies
+	Stratum uint8
+	RefID   string // clock source of stratum 1 servers (GPS, PPS, ...), else the upstream server
+	NTS     bool   // carries NTS extension fields (RFC 8915)
+}
+
+// NTP modes and the extension fields NTS adds to NTP packets
+const (
+	ntpPort       = 123
+	ntpModeServer = 4
+	ntpHeaderSize = 48
+
+	ntsUniqueIdentifier = 0x0104
+	ntsCookie           = 0x0204
+	ntsCookiePlacehold  = 0x0304
+	ntsAuthenticator    = 0x0404
+)
+
+// ParseNTP parses an NTP packet sent to or from port 123, returning nil if
+// the payload is not one
+func ParseNTP(payload []byte) *NTPPacket {
+	if len(payload) < ntpHeaderSize {
+		return nil
+	}
+	p := &NTPPacket{
+		Version: payload[0] >> 3 & 0x07,
+		Mode:    payload[0] & 0x07,
+		Stratum: payload[1],
+	}
+	if p.Version < 1 || p.Version > 4 || p.Mode < 1 || p.Mode > 5 {
+		return nil
+	}
+	ref := payload[12:16]
+	switch {
+	case p.Mode != ntpModeServer:
+	case p.Stratum <= 1:
+		p.RefID = strings.TrimRight(string(ref), "\x00")
+		for _, c := range p.RefID {
+			if c < 0x20 || c > 0x7e {
+				p.RefID = ""
+				break
+			}
+		}
+	case p.Stratum < 16:
+		// The upstream server's IPv4 address, or a hash of its IPv6 address
+		p.RefID = netip.AddrFrom4([4]byte(ref)).String()
+	}
+
+	// Extension fields: type, length of the whole field, then the value
+	ext := payload[ntpHeaderSize:]
+	for len(ext) >= 16 {
+		fieldType := binary.BigEndian.Uint16(ext[0:2])
+		length := int(binary.BigEndian.Uint16(ext[2:4]))
+		if length < 16 || length%4 != 0 || length > len(ext) {
+			break
+		}
+		switch fieldType {
+		case ntsUniqueIdentifier, ntsCookie, ntsCookiePlacehold, ntsAuthenticator:
+			p.NTS = true
+		}
+		ext = ext[length:]
+	}
+	return p
+}
+
+// Protocol names the time protocol of the packet for events
+func (p *NTPPacket) Protocol() string {
+	if p.NTS {
+		return "NTS"
+	}
+	return "NTP"
+}
+
+// ntpPolicy holds the time servers devices are expected to use: addresses,
+// CIDR ranges and host names, where * matches any label and *.example.com
+// also matches example.com
+type ntpPolicy struct {
+	prefixes []netip.Prefix
+	names    []string
+}
+
+// parseNTPServers parses a comma-separated --ntp-servers list
+func parseNTPServers(list string) (*ntpPolicy, error) {
+	policy := &ntpPolicy{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid NTP server range %q: %w", entry, err)
+			}
+			policy.prefixes = append(policy.prefixes, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				policy.prefixes = append(policy.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			if _, err := path.Match(entry, ""); err != nil {
+				return nil, fmt.Errorf("invalid NTP server name %q: %w", entry, err)
+			}
+			policy.names = append(policy.names, entry)
+		}
+	}
+	return policy, nil
+}
+
+// ValidateNTPServers checks an --ntp-servers value
+func ValidateNTPServers(list string) error {
+	_, err := parseNTPServers(list)
+	return err
+}
+
+// expected reports whether a time server is one devices may use: any
+// server on the local network, and with an empty policy any server at all
+func (p *ntpPolicy) expected(server, hostname string) bool {
+	addr, err := netip.ParseAddr(server)
+	if err != nil || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return true
+	}
+	if len(p.prefixes) == 0 && len(p.names) == 0 {
+		return true
+	}
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if hostname == "" {
+		return false
+	}
+	for _, pattern := range p.names {
+		if ok, _ := path.Match(pattern, hostname); ok {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && hostname == pattern[2:] {
+			return true
+		}
+	}
+	return false
+}
+
+// ntpReportInterval is how often an NTP event is written for a device
+// that keeps synchronising with the same server
+const ntpReportInterval = time.Hour
+
+// ntpUnexpected is the Reason of NTP events with a server outside the
+// expected time sources
+const ntpUnexpected = "UNEXPECTED_SOURCE"
+
+// SetNTPServers sets the time servers devices are expected to use; NTP
+// events with other external servers are flagged. The list is validated
+// with ValidateNTPServers; an empty list expects any server.
+func (sm *SessionManager) SetNTPServers(list string) {
+	policy, err := parseNTPServers(list)
+	if err != nil {
+		sm.logger.Error("Ignoring invalid --ntp-servers", "error", err)
+		policy = &ntpPolicy{}
+	}
+	sm.ntpPolicy.Store(policy)
+}
+
+// TrackNTP records a server's reply to an NTP client: which server each
+// device synchronises with, its stratum and whether NTS protects it. A
+// device and server pair is written once per ntpReportInterval.
+func (sm *SessionManager) TrackNTP(iface string, encap Encap, src, dst netip.AddrPort, pkt *NTPPacket, isIPv6 bool, ref CaptureRef) {
+	if pkt.Mode != ntpModeServer {
+		return
+	}
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("ntp") {
+		return
+	}
+	serverIP, serverPort := src.Addr().String(), src.Port()
+	clientIP, clientPort := dst.Addr().String(), dst.Port()
+	if f.shouldExclude(dst.Addr(), src.Addr(), clientPort, serverPort) {
+		return
+	}
+
+	key := clientIP + "->" + serverIP
+	now := sm.now()
+	sm.ntpSeenMux.Lock()
+	last, seen := sm.ntpSeen[key]
+	if seen && now.Sub(last) < ntpReportInterval {
+		sm.ntpSeenMux.Unlock()
+		return
+	}
+	sm.ntpSeen[key] = now
+	sm.ntpSeenMux.Unlock()
+
+	ipVersion := uint8(4)
+	if isIPv6 {
+		ipVersion = 6
+	}
+	hostname, _ := sm.lookupDNSCache(serverIP)
+	event := database.NetworkEvent{
+		Timestamp:    now,
+		EventType:    database.EventNTP,
+		CaptureFile:  ref.File,
+		CaptureFrame: ref.Frame,
+		Interface:    iface,
+		VLAN:         encap.Outer,
+		InnerVLAN:    encap.Inner,
+		Tunnel:       encap.Tunnel.Kind,
+		TunnelID:     encap.Tunnel.ID,
+		TunnelSrcIP:  encap.Tunnel.Src,
+		TunnelDstIP:  encap.Tunnel.Dst,
+		IPVersion:    ipVersion,
+		SrcIP:        clientIP,
+		SrcPort:      clientPort,
+		DstIP:        serverIP,
+		DstPort:      serverPort,
+		Hostname:     hostname,
+		Protocol:     pkt.Protocol(),
+		NTPVersion:   pkt.Version,
+		NTPStratum:   pkt.Stratum,
+		NTPRefID:     pkt.RefID,
+	}
+	if policy := sm.ntpPolicy.Load(); policy != nil && !policy.expected(serverIP, hostname) {
+		event.Reason = ntpUnexpected
+		sm.logger.Warn("[NTP] Unexpected time source",
+			"iface", iface,
+			"client", clientIP,
+			"server", serverIP,
+			"hostname", sm.logName("hostname", hostname),
+		)
+	} else {
+		sm.logger.Info("[NTP]",
+			"iface", iface,
+			"protocol", event.Protocol,
+			"client", clientIP,
+			"server", serverIP,
+			"hostname", sm.logName("hostname", hostname),
+			"stratum", pkt.Stratum,
+		)
+	}
+	sm.queueEvent(event)
+}
+
+// pruneNTPSeen forgets device and server pairs not reported for an
+// interval, so the next reply is written again
+func (sm *SessionManager) pruneNTPSeen(now time.Time) {
+	sm.ntpSeenMux.Lock()
+	for key, last := range sm.ntpSeen {
+		if now.Sub(last) >= ntpReportInterval {
+			delete(sm.ntpSeen, key)
+		}
+	}
+	sm.ntpSeenMux.Unlock()
+}
@@ -0,0 +1,91 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// BitTorrent traffic classes recorded in the P2P field of events
+const (
+	P2PDHT     = "dht"     // Mainline DHT queries and responses (KRPC over UDP)
+	P2PUTP     = "utp"     // uTP peer connections over UDP
+	P2PTracker = "tracker" // HTTP and UDP tracker announces
+	P2PPeer    = "peer"    // peer wire protocol, or traffic on a BitTorrent port
+)
+
+// P2PModes lists what is done with classified P2P flows: log records them
+// with their class, exclude drops them like --traffic-exclude bittorrent
+var P2PModes = []string{"log", "exclude"}
+
+// ValidateP2PMode checks a --p2p value
+func ValidateP2PMode(mode string) error {
+	if !slices.Contains(P2PModes, mode) {
+		return fmt.Errorf("unknown P2P mode %q (use log or exclude)", mode)
+	}
+	return nil
+}
+
+// bitTorrentPorts are the default listening ports of BitTorrent clients
+var bitTorrentPorts = map[uint16]bool{
+	6881: true, 6882: true, 6883: true, 6884: true, 6885: true,
+	6886: true, 6887: true, 6888: true, 6889: true, 6890: true,
+	51413: true, // Transmission default
+}
+
+// udpTrackerPort is the customary port of UDP trackers
+const udpTrackerPort = 6969
+
+// udpTrackerMagic opens a UDP tracker connect request (BEP 15)
+var udpTrackerMagic = []byte{0x00, 0x00, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80}
+
+// classifyP2P returns the BitTorrent class of a packet from its payload,
+// falling back to the well-known client ports, or "" for other traffic
+func classifyP2P(udp bool, srcPort, dstPort uint16, payload []byte) string {
+	if udp {
+		switch {
+		case isKRPC(payload):
+			return P2PDHT
+		case len(payload) >= 16 && bytes.HasPrefix(payload, udpTrackerMagic) && binary.BigEndian.Uint32(payload[8:12]) == 0:
+			return P2PTracker
+		case srcPort >= 1024 && dstPort >= 1024 && isUTP(payload):
+			return P2PUTP
+		case srcPort == udpTrackerPort || dstPort == udpTrackerPort:
+			return P2PTracker
+		}
+	} else {
+		switch {
+		case bytes.HasPrefix(payload, []byte("\x13BitTorrent protocol")):
+			return P2PPeer
+		case (bytes.HasPrefix(payload, []byte("GET /announce")) || bytes.HasPrefix(payload, []byte("GET /scrape"))) &&
+			bytes.Contains(payload, []byte("info_hash=")):
+			return P2PTracker
+		}
+	}
+	if bitTorrentPorts[srcPort] || bitTorrentPorts[dstPort] {
+		return P2PPeer
+	}
+	return ""
+}
+
+// isKRPC matches the bencoded dictionaries of DHT messages, which carry
+// their kind as y: q (query), r (response) or e (error)
+func isKRPC(p []byte) bool {
+	return len(p) >= 12 && bytes.HasPrefix(p, []byte("d1:")) && p[len(p)-1] == 'e' &&
+		(bytes.Contains(p, []byte("1:y1:q")) || bytes.Contains(p, []byte("1:y1:r")) || bytes.Contains(p, []byte("1:y1:e")))
+}
+
+// isUTP matches the 20-byte uTP header (BEP 29): version 1 with one of
+// the five packet types, and an extension type. Only data packets carry
+// a payload.
+func isUTP(p []byte) bool {
+	if len(p) < 20 || p[0]&0x0f != 1 || p[0]>>4 > 4 || p[1] > 2 {
+		return false
+	}
+	const stData = 0
+	if p[0]>>4 != stData && p[1] == 0 {
+		return len(p) == 20
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package watcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// rateLimiter caps the number of events recorded per source IP with a token
+// bucket. Suppressed events are counted and later folded into a single
+// RATE_LIMITED summary per source instead of being stored individually.
+type rateLimiter struct {
+	rate    float64 // tokens added per second
+	burst   float64 // bucket capacity
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the limiter state for one source IP
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// Suppressed events not yet summarised
+	suppressed      int64
+	byType          map[database.EventType]int64
+	iface           string
+	ipVersion       uint8
+	firstSuppressed time.Time
+	lastSuppressed  time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate events/second per source
+// with bursts of up to burst events
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow consumes a token for the event's source and reports whether the
+// event may be recorded. Denied events are tallied for the next summary.
+func (rl *rateLimiter) Allow(event *database.NetworkEvent) bool {
+	if event.SrcIP == "" {
+		return true
+	}
+
+	now := time.Now()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	b, ok := rl.buckets[event.SrcIP]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[event.SrcIP] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	if b.suppressed == 0 {
+		b.firstSuppressed = now
+		b.byType = make(map[database.EventType]int64)
+	}
+	b.suppressed++
+	b.byType[event.EventType]++
+	b.iface = event.Interface
+	b.ipVersion = event.IPVersion
+	b.lastSuppressed = now
+	return false
+}
+
+// Summaries drains suppressed counters into RATE_LIMITED events, whose
+// Reason holds the rate and the count of each suppressed event type, and
+// forgets sources whose bucket has refilled, keeping memory bounded
+func (rl *rateLimiter) Summaries() []database.NetworkEvent {
+	now := time.Now()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	var summaries []database.NetworkEvent
+	for src, b := range rl.buckets {
+		if b.suppressed > 0 {
+			summaries = append(summaries, database.NetworkEvent{
+				Timestamp:  b.firstSuppressed,
+				EndTime:    b.lastSuppressed,
+				EventType:  database.EventRateLimited,
+				Interface:  b.iface,
+				IPVersion:  b.ipVersion,
+				SrcIP:      src,
+				EventCount: b.suppressed,
+				Duration:   b.lastSuppressed.Sub(b.firstSuppressed).Milliseconds(),
+				Reason:     fmt.Sprintf("exceeded %.0f events/s: %s", rl.rate, formatTypeCounts(b.byType)),
+			})
+			b.suppressed = 0
+			b.byType = nil
+			continue
+		}
+
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, src)
+		}
+	}
+	return summaries
+}
+
+// formatTypeCounts renders per-type counts as "DNS:1200,UDP_START:40"
+func formatTypeCounts(counts map[database.EventType]int64) string {
+	parts := make([]string, 0, len(counts))
+	for t, c := range counts {
+		parts = append(parts, fmt.Sprintf("%s:%d", t, c))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,320 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// CaptureRef locates the raw packet an event was built from in the
+// capture archive
+type CaptureRef struct {
+	File  string // archive file the packet was written to
+	Frame uint64 // 1-based frame number within File
+}
+
+// PacketRecorder writes captured packets to an archive, such as a rotating
+// pcapng writer, and reports where each one ended up
+type PacketRecorder interface {
+	Record(iface string, ci gopacket.CaptureInfo, data []byte) (CaptureRef, error)
+}
+
+// SetPacketRecorder records every processed packet and stores its archive
+// location on the events it produces. It must be called before Run.
+func (w *Watcher) SetPacketRecorder(r PacketRecorder) {
+	w.recorder = r
+}
+
+const (
+	pcapPrefix = "netwatcher-"
+	pcapSuffix = ".pcapng"
+	// A file is also rotated at this share of the budget, so the oldest
+	// file can be deleted without dropping most of the history at once
+	pcapFilesPerBudget = 10
+	// Buffered packets are written out at least this often
+	pcapFlushInterval = time.Second
+	// Packets waiting for the writer; capture workers wait when it is full
+	pcapQueueSize = 4096
+	// Bytes an enhanced packet block adds to a packet, for the file size
+	// estimate that decides rotation
+	pcapBlockOverhead = 32
+)
+
+// PcapRecorder writes every captured packet to pcapng files in a directory,
+// starting a new file after a fixed duration and deleting the oldest files
+// once the directory holds more than the disk budget. Record only assigns
+// each packet its file and frame and queues a copy, so capture workers do
+// not wait for each other's writes; a single goroutine writes the files.
+type PcapRecorder struct {
+	dir    string
+	budget int64
+	rotate time.Duration
+	logger *log.Logger
+
+	// File and frame assignment, by Record
+	mutex  sync.Mutex
+	path   string
+	opened time.Time
+	size   int64 // estimated bytes written to path
+	frames uint64
+	closed bool
+	queue  chan *pcapPacket
+	done   chan struct{}
+
+	// Owned by the writer goroutine
+	file     *os.File
+	writer   *pcapgo.NgWriter
+	ifaces   map[string]int // interface name -> index in the current file
+	current  string         // path of the file being written, even if it failed to open
+	errors   int
+	closeErr error
+}
+
+// pcapPacket is a packet queued for the writer, with the file it goes to
+type pcapPacket struct {
+	iface string
+	ci    gopacket.CaptureInfo
+	data  *[]byte // from pcapBufPool
+	path  string
+}
+
+// pcapBufPool holds packet copies, since capture buffers are reused once
+// Record returns
+var pcapBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 2048)
+		return &buf
+	},
+}
+
+// NewPcapRecorder creates a recorder writing to dir, which is created if
+// missing, keeping at most budgetMB megabytes of files of rotate each
+func NewPcapRecorder(dir string, budgetMB int, rotate time.Duration, logger *log.Logger) (*PcapRecorder, error) {
+	if budgetMB <= 0 {
+		return nil, fmt.Errorf("pcap budget must be positive")
+	}
+	if rotate <= 0 {
+		return nil, fmt.Errorf("pcap rotation interval must be positive")
+	}
+	// Events store the file path, so keep it usable from any directory
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pcap directory: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create pcap directory: %w", err)
+	}
+	r := &PcapRecorder{
+		dir:    dir,
+		budget: int64(budgetMB) * 1024 * 1024,
+		rotate: rotate,
+		logger: logger,
+		queue:  make(chan *pcapPacket, pcapQueueSize),
+		done:   make(chan struct{}),
+	}
+	r.enforceBudget()
+	go r.run()
+	return r, nil
+}
+
+// Record queues a packet for the current file, starting a new file first
+// when the current one is too old or too large, and returns where it will
+// be. Write errors are logged by the writer.
+func (r *PcapRecorder) Record(iface string, ci gopacket.CaptureInfo, data []byte) (CaptureRef, error) {
+	buf := pcapBufPool.Get().(*[]byte)
+	*buf = append((*buf)[:0], data...)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		pcapBufPool.Put(buf)
+		return CaptureRef{}, fmt.Errorf("pcap recorder is closed")
+	}
+	now := time.Now()
+	if r.path == "" || now.Sub(r.opened) >= r.rotate || r.size >= r.budget/pcapFilesPerBudget {
+		// Within the millisecond of the last rotation, the file is kept
+		if path := filepath.Join(r.dir, pcapPrefix+now.UTC().Format("20060102-150405.000")+pcapSuffix); path != r.path {
+			r.path, r.opened, r.size, r.frames = path, now, 0, 0
+		}
+	}
+	r.frames++
+	r.size += int64(len(data)) + pcapBlockOverhead
+	// Sent under the mutex, so packets reach the writer in frame order
+	r.queue <- &pcapPacket{iface: iface, ci: ci, data: buf, path: r.path}
+	return CaptureRef{File: r.path, Frame: r.frames}, nil
+}
+
+// Close writes the queued packets and closes the current file
+func (r *PcapRecorder) Close() error {
+	r.mutex.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mutex.Unlock()
+	<-r.done
+	return r.closeErr
+}
+
+// run writes queued packets, flushing the current file every
+// pcapFlushInterval, until Close
+func (r *PcapRecorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(pcapFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case p, ok := <-r.queue:
+			if !ok {
+				r.closeErr = r.closeFile()
+				return
+			}
+			r.write(p)
+			pcapBufPool.Put(p.data)
+		case <-ticker.C:
+			if r.writer != nil {
+				if err := r.writer.Flush(); err != nil {
+					r.writeFailed(fmt.Errorf("failed to flush pcap file: %w", err))
+				}
+			}
+		}
+	}
+}
+
+// write appends a packet to its file, opening the file when it is the
+// first packet of a new one
+func (r *PcapRecorder) write(p *pcapPacket) {
+	if p.path != r.current {
+		if err := r.closeFile(); err != nil {
+			r.logger.Warn("Failed to close pcap file", "file", r.current, "error", err)
+		}
+		r.current = p.path
+		r.enforceBudget()
+		if err := r.openFile(p.path, p.iface); err != nil {
+			r.logger.Warn("Failed to open pcap file, its packets are not recorded", "file", p.path, "error", err)
+		}
+	}
+	if r.writer == nil {
+		return
+	}
+
+	index, ok := r.ifaces[p.iface]
+	if !ok {
+		var err error
+		index, err = r.writer.AddInterface(ngInterface(p.iface))
+		if err != nil {
+			r.writeFailed(fmt.Errorf("failed to add interface to pcap file: %w", err))
+			return
+		}
+		r.ifaces[p.iface] = index
+	}
+	ci := p.ci
+	ci.InterfaceIndex = index
+	if err := r.writer.WritePacket(ci, *p.data); err != nil {
+		r.writeFailed(fmt.Errorf("failed to write packet: %w", err))
+	}
+}
+
+// writeFailed logs every thousandth write error
+func (r *PcapRecorder) writeFailed(err error) {
+	if r.errors++; r.errors%1000 == 1 {
+		r.logger.Warn("Failed to record packet", "file", r.current, "errors", r.errors, "error", err)
+	}
+}
+
+// openFile starts a new file whose first interface is iface
+func (r *PcapRecorder) openFile(path, iface string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create pcap file: %w", err)
+	}
+	options := pcapgo.DefaultNgWriterOptions
+	options.SectionInfo.Application = "net-watcher"
+	writer, err := pcapgo.NewNgWriterInterface(f, ngInterface(iface), options)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write pcap header: %w", err)
+	}
+	r.file, r.writer = f, writer
+	r.ifaces = map[string]int{iface: 0}
+	r.logger.Debug("Opened pcap file", "file", path)
+	return nil
+}
+
+// closeFile flushes and closes the current file, if any
+func (r *PcapRecorder) closeFile() error {
+	if r.writer == nil {
+		return nil
+	}
+	err := r.writer.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file, r.writer = nil, nil
+	return err
+}
+
+// enforceBudget deletes the oldest recorder files until the rest fit in
+// the budget; called by the writer, or before it starts
+func (r *PcapRecorder) enforceBudget() {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		r.logger.Warn("Failed to list pcap directory", "dir", r.dir, "error", err)
+		return
+	}
+	type pcapFile struct {
+		path string
+		size int64
+	}
+	var files []pcapFile
+	var total int64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, pcapPrefix) || !strings.HasSuffix(name, pcapSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, pcapFile{filepath.Join(r.dir, name), info.Size()})
+		total += info.Size()
+	}
+	// Names carry the UTC start time, so they sort oldest first
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	for _, f := range files {
+		if total <= r.budget {
+			break
+		}
+		if f.path == r.current {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			r.logger.Warn("Failed to delete pcap file", "file", f.path, "error", err)
+			continue
+		}
+		total -= f.size
+		r.logger.Debug("Deleted pcap file over budget", "file", f.path)
+	}
+}
+
+// ngInterface describes a capture interface in a pcapng file
+func ngInterface(name string) pcapgo.NgInterface {
+	return pcapgo.NgInterface{
+		Name:                name,
+		OS:                  runtime.GOOS,
+		LinkType:            layers.LinkTypeEthernet,
+		TimestampResolution: 9,
+	}
+}
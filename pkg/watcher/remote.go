@@ -0,0 +1,193 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// SSHBanner is the identification string each side of an SSH connection
+// sends first, e.g. "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13"
+type SSHBanner struct {
+	Version  string // protocol version: 2.0, 1.99 (server speaking 1 and 2) or 1.5
+	Software string // software version and comments
+}
+
+// String returns the identification string as sent, without line ending
+func (b *SSHBanner) String() string {
+	return "SSH-" + b.Version + "-" + b.Software
+}
+
+// sshVersion returns the protocol version of an identification string
+func sshVersion(ident string) string {
+	version, _, _ := strings.Cut(strings.TrimPrefix(ident, "SSH-"), "-")
+	return version
+}
+
+// maxSSHBanner is the longest identification line RFC 4253 allows
+const maxSSHBanner = 255
+
+// ParseSSHBanner parses an SSH identification string at the start of a TCP
+// payload, returning nil if the payload is not one
+func ParseSSHBanner(payload []byte) *SSHBanner {
+	if !bytes.HasPrefix(payload, []byte("SSH-")) {
+		return nil
+	}
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 || end > maxSSHBanner {
+		return nil
+	}
+	line := strings.TrimSuffix(string(payload[4:end]), "\r")
+	version, software, ok := strings.Cut(line, "-")
+	if !ok || !validSSHVersion(version) {
+		return nil
+	}
+	for _, c := range software {
+		if c < 0x20 || c > 0x7e {
+			return nil
+		}
+	}
+	return &SSHBanner{Version: version, Software: software}
+}
+
+// validSSHVersion accepts protocol versions of the form major.minor
+func validSSHVersion(v string) bool {
+	major, minor, ok := strings.Cut(v, ".")
+	return ok && digits(major) && digits(minor)
+}
+
+// digits reports whether s is a non-empty run of ASCII digits
+func digits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiatedSSHVersion is the protocol version two SSH banners agree on:
+// a server announcing 1.99 follows the client, otherwise the lower wins
+func negotiatedSSHVersion(client, server string) string {
+	switch {
+	case client == "":
+		return server
+	case server == "", server == "1.99":
+		return client
+	case client == "1.99":
+		return server
+	}
+	return min(client, server)
+}
+
+// RDPNegotiation is the X.224 connection request of an RDP client or the
+// server's confirmation, with the security protocols it offers or selects
+type RDPNegotiation struct {
+	Request   bool     // client Connection Request, otherwise a Connection Confirm
+	Protocols []string // offered by the client, or the one selected by the server
+	Failure   string   // reason the server refused the connection
+	Cookie    bool     // the request carries an mstshash cookie or routing token
+}
+
+// X.224 TPDU codes and RDP negotiation message types ([MS-RDPBCGR] 2.2.1)
+const (
+	x224ConnectionRequest = 0xe0
+	x224ConnectionConfirm = 0xd0
+
+	rdpNegRequest  = 0x01
+	rdpNegResponse = 0x02
+	rdpNegFailure  = 0x03
+)
+
+// rdpProtocols names the bits of requestedProtocols and selectedProtocol
+var rdpProtocols = []struct {
+	bit  uint32
+	name string
+}{
+	{0x01, "TLS"},
+	{0x02, "CredSSP"},
+	{0x04, "RDSTLS"},
+	{0x08, "CredSSP-EX"},
+	{0x10, "RDSAAD"},
+}
+
+// rdpFailures names the failureCode of an RDP negotiation failure
+var rdpFailures = map[uint32]string{
+	1: "SSL_REQUIRED_BY_SERVER",
+	2: "SSL_NOT_ALLOWED_BY_SERVER",
+	3: "SSL_CERT_NOT_ON_SERVER",
+	4: "INCONSISTENT_FLAGS",
+	5: "HYBRID_REQUIRED_BY_SERVER",
+	6: "SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER",
+}
+
+// ParseRDPNegotiation parses the TPKT-framed X.224 connection request or
+// confirm that opens an RDP connection on any port. Other users of X.224,
+// such as ISO-TSAP on port 102, are told apart by the RDP cookie or
+// negotiation message.
+func ParseRDPNegotiation(payload []byte) *RDPNegotiation {
+	// TPKT: version 3, reserved, total length; X.224: length, code, refs, class
+	if len(payload) < 11 || payload[0] != 3 || payload[1] != 0 {
+		return nil
+	}
+	if int(binary.BigEndian.Uint16(payload[2:4])) != len(payload) || int(payload[4]) != len(payload)-5 {
+		return nil
+	}
+	neg := &RDPNegotiation{}
+	switch payload[5] {
+	case x224ConnectionRequest:
+		neg.Request = true
+	case x224ConnectionConfirm:
+	default:
+		return nil
+	}
+	data := payload[11:]
+
+	if neg.Request && bytes.HasPrefix(data, []byte("Cookie: ")) {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end < 0 {
+			return nil
+		}
+		neg.Cookie, data = true, data[end+2:]
+	}
+
+	switch {
+	case len(data) == 0:
+		// Standard RDP security, negotiated by neither side
+		if neg.Request && !neg.Cookie {
+			return nil
+		}
+		neg.Protocols = []string{"RDP"}
+		return neg
+	case len(data) != 8 || binary.LittleEndian.Uint16(data[2:4]) != 8:
+		return nil
+	}
+	value := binary.LittleEndian.Uint32(data[4:8])
+	switch {
+	case neg.Request && data[0] == rdpNegRequest:
+		neg.Protocols = []string{"RDP"}
+		for _, p := range rdpProtocols {
+			if value&p.bit != 0 {
+				neg.Protocols = append(neg.Protocols, p.name)
+			}
+		}
+	case !neg.Request && data[0] == rdpNegResponse:
+		neg.Protocols = []string{"RDP"}
+		for _, p := range rdpProtocols {
+			if value == p.bit {
+				neg.Protocols = []string{p.name}
+			}
+		}
+	case !neg.Request && data[0] == rdpNegFailure:
+		neg.Failure = rdpFailures[value]
+		if neg.Failure == "" {
+			neg.Failure = "UNKNOWN_FAILURE"
+		}
+	default:
+		return nil
+	}
+	return neg
+}
@@ -0,0 +1,171 @@
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// ReplayOptions controls how a capture file is replayed
+type ReplayOptions struct {
+	// Interface recorded on the events; default the interface names of a
+	// pcapng file, or the file name
+	Interface string
+	// Filter keeps only the packets this classic BPF program accepts, as
+	// --bpf does for live capture; nil keeps every packet
+	Filter []bpf.Instruction
+	// Progress, if set, is called every 100000 packets
+	Progress func(stats ReplayStats)
+}
+
+// ReplayStats reports what a replay read
+type ReplayStats struct {
+	Packets  uint64    `json:"packets"`  // packets read from the file
+	Filtered uint64    `json:"filtered"` // packets the BPF filter rejected
+	Events   uint64    `json:"events"`   // events stored
+	First    time.Time `json:"first"`    // timestamp of the first packet
+	Last     time.Time `json:"last"`     // timestamp of the last packet
+}
+
+// replayProgressEvery is how many packets pass between progress reports
+const replayProgressEvery = 100000
+
+// pcapngMagic starts a pcapng file (its section header block type)
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// packetReader is what the pcap and pcapng readers have in common
+type packetReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// ReplayPcap runs the packets of a pcap or pcapng file, such as one written
+// by tcpdump -w, through the capture pipeline: session tracking, DNS, TLS
+// and the other parsers, enrichers and the event store. Events carry the
+// packets' original timestamps, and sessions time out as packet time
+// passes. Sessions still open when the file ends are written with the
+// CAPTURE_END reason. It is used instead of Run, and stops the watcher.
+func (w *Watcher) ReplayPcap(ctx context.Context, path string, opts ReplayOptions) (ReplayStats, error) {
+	var stats ReplayStats
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, 1<<20)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return stats, fmt.Errorf("%s: not a capture file: %w", path, err)
+	}
+	var reader packetReader
+	var ng *pcapgo.NgReader
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		reader = ng
+	} else {
+		reader, err = pcapgo.NewReader(br)
+	}
+	if err != nil {
+		return stats, fmt.Errorf("%s: not a pcap or pcapng file: %w", path, err)
+	}
+
+	var vm *bpf.VM
+	if opts.Filter != nil {
+		if vm, err = bpf.NewVM(opts.Filter); err != nil {
+			return stats, fmt.Errorf("invalid BPF filter: %w", err)
+		}
+	}
+	ifaceName := func(ci gopacket.CaptureInfo) string {
+		if opts.Interface != "" {
+			return opts.Interface
+		}
+		if ng != nil {
+			if iface, err := ng.Interface(ci.InterfaceIndex); err == nil && iface.Name != "" {
+				return iface.Name
+			}
+		}
+		return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	archive, err := filepath.Abs(path)
+	if err != nil {
+		archive = path
+	}
+
+	sm := w.sessionManager
+	// The file is read faster than it was captured: wait for the writer
+	// rather than drop events
+	writeOpts := sm.writer.opts
+	writeOpts.Wait = true
+	sm.SetWriteOptions(writeOpts)
+	written := sm.eventsWritten.Load()
+
+	source := gopacket.NewPacketSource(reader, reader.LinkType())
+	source.DecodeOptions = packetDecodeOptions
+	defrag := newDefragmenter()
+	var lastCleanup time.Time
+	for {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		packet, err := source.NextPacket()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			// Skip packets that fail to read, as tcpdump does
+			w.logger.Debug("Failed to read packet", "file", path, "packet", stats.Packets+1, "error", err)
+			continue
+		}
+		stats.Packets++
+		ci := packet.Metadata().CaptureInfo
+		if vm != nil {
+			if keep, err := vm.Run(packet.Data()); err != nil || keep == 0 {
+				stats.Filtered++
+				continue
+			}
+		}
+
+		ts := ci.Timestamp
+		if stats.First.IsZero() {
+			stats.First = ts
+		}
+		// Packet time never runs backwards, even when the file is not sorted
+		if ts.After(stats.Last) {
+			stats.Last = ts
+			sm.clock.Store(&ts)
+		}
+		if stats.Last.Sub(lastCleanup) >= sm.cleanupInterval {
+			if !lastCleanup.IsZero() {
+				sm.cleanup(stats.Last)
+			}
+			lastCleanup = stats.Last
+		}
+
+		vlan := packetVLANs(packet)
+		if packet, ok := defrag.Process(packet); ok {
+			w.processPacket(packet, ifaceName(ci), vlan, CaptureRef{File: archive, Frame: stats.Packets})
+		}
+		if opts.Progress != nil && stats.Packets%replayProgressEvery == 0 {
+			stats.Events = sm.eventsWritten.Load() - written
+			opts.Progress(stats)
+		}
+	}
+
+	sm.cleanup(stats.Last)
+	sm.endSessions(sessionEnded)
+	sm.Stop()
+	stats.Events = sm.eventsWritten.Load() - written
+	return stats, ctx.Err()
+}
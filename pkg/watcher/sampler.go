@@ -0,0 +1,122 @@
+package watcher
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// sampler thins out the events of chatty sources: once a source IP has
+// produced more than threshold events within the current second, only one
+// in every rate further events of that second is recorded. Skipped events
+// are counted and later folded into a single SAMPLED summary per source,
+// so totals stay known while a looping IoT device costs a few rows.
+type sampler struct {
+	threshold int64 // events per second recorded in full
+	rate      int64 // 1-in-rate events kept above the threshold
+	mutex     sync.Mutex
+	sources   map[string]*sampleWindow
+}
+
+// sampleWindow holds the sampler state for one source IP
+type sampleWindow struct {
+	start time.Time // start of the current one-second window
+	count int64     // events seen in the window
+	// Skipped events not yet summarised
+	skipped     int64
+	kept        int64
+	byType      map[database.EventType]int64
+	iface       string
+	ipVersion   uint8
+	firstSample time.Time
+	lastSample  time.Time
+}
+
+// newSampler creates a sampler recording threshold events/second per
+// source in full and one in rate events beyond that
+func newSampler(threshold, rate int) *sampler {
+	if rate < 2 {
+		rate = 2
+	}
+	return &sampler{
+		threshold: int64(threshold),
+		rate:      int64(rate),
+		sources:   make(map[string]*sampleWindow),
+	}
+}
+
+// Keep counts the event against its source and reports whether it should
+// be recorded. Skipped events are tallied for the next summary.
+func (s *sampler) Keep(event *database.NetworkEvent) bool {
+	if event.SrcIP == "" {
+		return true
+	}
+
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w, ok := s.sources[event.SrcIP]
+	if !ok {
+		w = &sampleWindow{start: now}
+		s.sources[event.SrcIP] = w
+	}
+	if now.Sub(w.start) >= time.Second {
+		w.start, w.count = now, 0
+	}
+	w.count++
+
+	over := w.count - s.threshold
+	if over <= 0 {
+		return true
+	}
+
+	if w.skipped == 0 && w.kept == 0 {
+		w.firstSample = now
+		w.byType = make(map[database.EventType]int64)
+	}
+	w.iface = event.Interface
+	w.ipVersion = event.IPVersion
+	w.lastSample = now
+	if over%s.rate == 1 {
+		w.kept++
+		return true
+	}
+	w.skipped++
+	w.byType[event.EventType]++
+	return false
+}
+
+// Summaries drains skipped counters into SAMPLED events, whose Reason holds
+// the sampling rate and the count of each skipped event type, and forgets
+// sources that have been quiet for a whole window, keeping memory bounded
+func (s *sampler) Summaries() []database.NetworkEvent {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var summaries []database.NetworkEvent
+	for src, w := range s.sources {
+		if w.skipped > 0 {
+			summaries = append(summaries, database.NetworkEvent{
+				Timestamp:  w.firstSample,
+				EndTime:    w.lastSample,
+				EventType:  database.EventSampled,
+				Interface:  w.iface,
+				IPVersion:  w.ipVersion,
+				SrcIP:      src,
+				EventCount: w.skipped,
+				Duration:   w.lastSample.Sub(w.firstSample).Milliseconds(),
+				Reason:     fmt.Sprintf("kept 1 in %d above %d events/s (%d kept): %s", s.rate, s.threshold, w.kept, formatTypeCounts(w.byType)),
+			})
+		}
+		w.skipped, w.kept, w.byType = 0, 0, nil
+
+		if now.Sub(w.start) >= 2*time.Second {
+			delete(s.sources, src)
+		}
+	}
+	return summaries
+}
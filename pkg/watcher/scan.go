@@ -0,0 +1,246 @@
+package watcher
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// scanDetector flags sources probing many ports of one host (a port scan)
+// or one port across many hosts (a sweep) within a window. Connection
+// attempts are TCP_START and UDP_START events and ICMP echo requests; sweeps
+// only count hosts on local networks, where browsing never reaches dozens
+// of hosts on one port. A detected scan lasts until the source has been
+// quiet towards its target for a whole window, and is then summarised as
+// one SCAN event.
+type scanDetector struct {
+	window    time.Duration
+	portLimit int // distinct ports of one host making a port scan
+	hostLimit int // distinct hosts on one port making a sweep
+	mutex     sync.Mutex
+	sources   map[string]*scanSource
+}
+
+// scanSource holds what one source IP contacted within the window
+type scanSource struct {
+	ports  map[string]map[uint16]time.Time // "PROTO ip" -> port -> last attempt
+	hosts  map[string]map[string]time.Time // "PROTO :port" -> host -> last attempt
+	scans  map[string]*scan                // by target, "PROTO ip" or "PROTO :port"
+	iface  string
+	ipVer  uint8
+	latest time.Time
+}
+
+// scan is a port scan or sweep in progress
+type scan struct {
+	sweep    bool
+	proto    string
+	host     string // port scan target
+	port     uint16 // sweep target
+	first    time.Time
+	last     time.Time
+	targets  map[string]bool // ports or hosts contacted
+	attempts int64
+}
+
+// newScanDetector creates a detector flagging portLimit ports or hostLimit
+// hosts within window; a limit of zero disables that kind of scan
+func newScanDetector(window time.Duration, portLimit, hostLimit int) *scanDetector {
+	return &scanDetector{
+		window:    window,
+		portLimit: portLimit,
+		hostLimit: hostLimit,
+		sources:   make(map[string]*scanSource),
+	}
+}
+
+// scanAttempt returns the protocol and port of a connection attempt, and
+// whether the event is one
+func scanAttempt(e *database.NetworkEvent) (string, uint16, bool) {
+	switch e.EventType {
+	case database.EventTCPStart:
+		return "TCP", e.DstPort, true
+	case database.EventUDPStart:
+		return "UDP", e.DstPort, true
+	case database.EventICMP:
+		// Echo requests of ICMP and ICMPv6
+		return "ICMP", 0, e.IPVersion == 4 && e.ICMPType == 8 || e.IPVersion == 6 && e.ICMPType == 128
+	}
+	return "", 0, false
+}
+
+// Observe counts a connection attempt against its source and reports the
+// scans it starts, for logging
+func (d *scanDetector) Observe(e *database.NetworkEvent) []*scan {
+	proto, port, ok := scanAttempt(e)
+	if !ok || e.SrcIP == "" || e.DstIP == "" {
+		return nil
+	}
+	now := e.Timestamp
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	s, ok := d.sources[e.SrcIP]
+	if !ok {
+		s = &scanSource{
+			ports: make(map[string]map[uint16]time.Time),
+			hosts: make(map[string]map[string]time.Time),
+			scans: make(map[string]*scan),
+		}
+		d.sources[e.SrcIP] = s
+	}
+	s.iface, s.ipVer, s.latest = e.Interface, e.IPVersion, now
+
+	var started []*scan
+	if d.portLimit > 0 && proto != "ICMP" {
+		key := proto + " " + e.DstIP
+		if sc := s.scans[key]; sc != nil {
+			sc.add(fmt.Sprint(port), now)
+		} else if count := observeTarget(s.ports, key, port, now, d.window); count >= d.portLimit {
+			sc := &scan{proto: proto, host: e.DstIP, first: now, targets: make(map[string]bool)}
+			for p, t := range s.ports[key] {
+				sc.targets[fmt.Sprint(p)] = true
+				sc.first = minTime(sc.first, t)
+			}
+			sc.attempts, sc.last = int64(len(sc.targets)), now
+			s.scans[key] = sc
+			delete(s.ports, key)
+			started = append(started, sc)
+		}
+	}
+	if d.hostLimit > 0 && isLocalIP(e.DstIP) {
+		key := fmt.Sprintf("%s :%d", proto, port)
+		if sc := s.scans[key]; sc != nil {
+			sc.add(e.DstIP, now)
+		} else if count := observeTarget(s.hosts, key, e.DstIP, now, d.window); count >= d.hostLimit {
+			sc := &scan{sweep: true, proto: proto, port: port, first: now, targets: make(map[string]bool)}
+			for h, t := range s.hosts[key] {
+				sc.targets[h] = true
+				sc.first = minTime(sc.first, t)
+			}
+			sc.attempts, sc.last = int64(len(sc.targets)), now
+			s.scans[key] = sc
+			delete(s.hosts, key)
+			started = append(started, sc)
+		}
+	}
+	return started
+}
+
+// observeTarget records an attempt on one of a target's ports or hosts and
+// returns how many were tried within the window
+func observeTarget[K comparable](targets map[string]map[K]time.Time, key string, item K, now time.Time, window time.Duration) int {
+	items, ok := targets[key]
+	if !ok {
+		items = make(map[K]time.Time)
+		targets[key] = items
+	}
+	items[item] = now
+	return pruneTargets(items, now, window)
+}
+
+// add counts another attempt of a scan in progress
+func (sc *scan) add(target string, now time.Time) {
+	sc.targets[target] = true
+	sc.attempts++
+	sc.last = now
+}
+
+// Summaries turns scans quiet for a whole window into SCAN events and
+// forgets attempts and sources older than the window
+func (d *scanDetector) Summaries(now time.Time) []database.NetworkEvent {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var summaries []database.NetworkEvent
+	for src, s := range d.sources {
+		for target, sc := range s.scans {
+			if now.Sub(sc.last) < d.window {
+				continue
+			}
+			summaries = append(summaries, sc.event(src, s))
+			delete(s.scans, target)
+		}
+		for key, ports := range s.ports {
+			if pruneTargets(ports, now, d.window) == 0 {
+				delete(s.ports, key)
+			}
+		}
+		for key, hosts := range s.hosts {
+			if pruneTargets(hosts, now, d.window) == 0 {
+				delete(s.hosts, key)
+			}
+		}
+		if len(s.scans) == 0 && now.Sub(s.latest) > d.window {
+			delete(d.sources, src)
+		}
+	}
+	return summaries
+}
+
+// Flush summarises every scan in progress, when capture stops
+func (d *scanDetector) Flush() []database.NetworkEvent {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var summaries []database.NetworkEvent
+	for src, s := range d.sources {
+		for _, sc := range s.scans {
+			summaries = append(summaries, sc.event(src, s))
+		}
+	}
+	d.sources = make(map[string]*scanSource)
+	return summaries
+}
+
+// pruneTargets forgets attempts older than the window and returns how many
+// remain
+func pruneTargets[K comparable](items map[K]time.Time, now time.Time, window time.Duration) int {
+	for k, t := range items {
+		if now.Sub(t) > window {
+			delete(items, k)
+		}
+	}
+	return len(items)
+}
+
+// event is the SCAN event summarising a scan: EventCount holds the ports
+// or hosts contacted, Reason what kind of scan it was and the attempts
+func (sc *scan) event(src string, s *scanSource) database.NetworkEvent {
+	e := database.NetworkEvent{
+		Timestamp:  sc.first,
+		EndTime:    sc.last,
+		EventType:  database.EventScan,
+		Interface:  s.iface,
+		IPVersion:  s.ipVer,
+		SrcIP:      src,
+		Protocol:   sc.proto,
+		EventCount: int64(len(sc.targets)),
+		Duration:   sc.last.Sub(sc.first).Milliseconds(),
+	}
+	if sc.sweep {
+		e.DstPort = sc.port
+		e.Reason = fmt.Sprintf("sweep of %d hosts, %d attempts", len(sc.targets), sc.attempts)
+	} else {
+		e.DstIP = sc.host
+		e.Reason = fmt.Sprintf("port scan of %d ports, %d attempts", len(sc.targets), sc.attempts)
+	}
+	return e
+}
+
+// isLocalIP reports whether an address is on a private or link-local network
+func isLocalIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && (addr.IsPrivate() || addr.IsLinkLocalUnicast())
+}
+
+// minTime returns the earlier of two times
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -2,16 +2,24 @@ package watcher
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"path"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/abja/net-watcher/internal/database"
+	"github.com/abja/net-watcher/internal/enrich"
+	"github.com/abja/net-watcher/internal/sink"
 	"github.com/charmbracelet/log"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/afpacket"
 	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
 )
 
 // Watcher orchestrates multiple sniffers and the database writer
@@ -21,6 +29,38 @@ type Watcher struct {
 	logger         *log.Logger
 	sessionManager *SessionManager
 	db             *database.DB
+	// Dynamic interface selection
+	pattern        *InterfacePattern
+	rescanInterval time.Duration
+	linkRescan     bool          // also rescan when netlink reports a link change
+	rescanSignal   chan struct{} // requests a rescan, see requestRescan
+	sniffers       map[string]context.CancelFunc
+	sniffersMux    sync.Mutex
+	links          *linkMonitor
+	linkDown       map[string]time.Time // sniffers waiting for their interface, since when
+	wg             sync.WaitGroup
+	topology       *topologyResolver
+	// Global filters and per-interface overrides, replaced on reload
+	onlyFilter    string
+	excludeFilter string
+	excludePorts  string
+	bpfFilter     string // tcpdump -ddd program for interfaces without their own
+	vlanFilter    string // VLAN IDs recorded on interfaces without their own
+	snapLen       int    // snap length of interfaces without their own
+	ifaceConfigs  []InterfaceConfig
+	configMux     sync.RWMutex
+	// Runtime state reported over the control socket
+	started  time.Time
+	paused   atomic.Bool
+	captures map[string]*captureStats
+	rate     writeRate
+	health   healthState
+	// Optional raw packet archive
+	recorder PacketRecorder
+	// Capture backend of interfaces started from now on, and the capture
+	// workers of each
+	backend string
+	workers int
 }
 
 // New creates a new Watcher instance
@@ -40,6 +80,11 @@ func New(dbPath string, ifaces []net.Interface, logger *log.Logger, onlyFilter,
 		logger:         logger,
 		sessionManager: NewSessionManager(logger, db, onlyFilter, excludeFilter, excludePorts),
 		db:             db,
+		onlyFilter:     onlyFilter,
+		excludeFilter:  excludeFilter,
+		excludePorts:   excludePorts,
+		started:        time.Now(),
+		captures:       make(map[string]*captureStats),
 	}, nil
 }
 
@@ -51,76 +96,525 @@ func NewWithDB(db *database.DB, ifaces []net.Interface, logger *log.Logger, only
 		logger:         logger,
 		sessionManager: NewSessionManager(logger, db, onlyFilter, excludeFilter, excludePorts),
 		db:             nil, // DB managed externally, don't close it
+		onlyFilter:     onlyFilter,
+		excludeFilter:  excludeFilter,
+		excludePorts:   excludePorts,
+		started:        time.Now(),
+		captures:       make(map[string]*captureStats),
 	}, nil
 }
 
+// AddSink registers a streaming output for captured events
+func (w *Watcher) AddSink(s sink.Sink) {
+	w.sessionManager.AddSink(s)
+}
+
+// WatchInterfaces enables periodic re-evaluation of an interface pattern so
+// interfaces that appear later (VPN tunnels, USB NICs) are captured and
+// interfaces that disappear or stop matching are released
+func (w *Watcher) WatchInterfaces(pattern *InterfacePattern, interval time.Duration) {
+	w.pattern = pattern
+	w.rescanInterval = interval
+}
+
+// WatchInterfaceLinks re-evaluates the pattern of WatchInterfaces as soon as
+// netlink reports an interface appearing, disappearing or changing state,
+// rather than only every rescan interval
+func (w *Watcher) WatchInterfaceLinks() {
+	w.linkRescan = true
+}
+
+// SetInterfaceConfigs sets per-interface filters and capture settings. The
+// first config whose pattern matches an interface applies to it.
+func (w *Watcher) SetInterfaceConfigs(configs []InterfaceConfig) {
+	w.configMux.Lock()
+	w.ifaceConfigs = configs
+	w.configMux.Unlock()
+}
+
+// SetCaptureFilters sets the BPF program file, see LoadBPFFilter, that the
+// kernel applies, the VLAN IDs recorded, see ParseVLANs, and the snap
+// length, see ParseSnapLen, on interfaces without their own. Running
+// captures pick them up on ReloadFilters.
+func (w *Watcher) SetCaptureFilters(bpfFile, vlans string, snapLen int) {
+	w.configMux.Lock()
+	w.bpfFilter = bpfFile
+	w.vlanFilter = vlans
+	w.snapLen = snapLen
+	w.configMux.Unlock()
+}
+
+// snapLenFor returns the snap length of an interface
+func (w *Watcher) snapLenFor(cfg InterfaceConfig) int {
+	if cfg.SnapLen != 0 {
+		return cfg.SnapLen
+	}
+	w.configMux.RLock()
+	defer w.configMux.RUnlock()
+	return w.snapLen
+}
+
+// ReloadFilters replaces the global and per-interface filters while capture
+// keeps running, and reloads the BPF programs and snap lengths of running
+// captures. Ring size and workers only apply to sniffers started after the
+// reload.
+func (w *Watcher) ReloadFilters(onlyFilter, excludeFilter, excludePorts string, configs []InterfaceConfig) {
+	w.configMux.Lock()
+	w.onlyFilter = onlyFilter
+	w.excludeFilter = excludeFilter
+	w.excludePorts = excludePorts
+	w.ifaceConfigs = configs
+	w.configMux.Unlock()
+
+	w.sniffersMux.Lock()
+	perIface := make(map[string]*filterSet)
+	for name := range w.sniffers {
+		if only, exclude, ports, ok := w.interfaceFilters(name); ok {
+			perIface[name] = newFilterSet(only, exclude, ports)
+		}
+	}
+	for name, c := range w.captures {
+		if err := w.setCaptureFilter(c, name, w.configFor(name)); err != nil {
+			w.logger.Error("Failed to reload capture filter, keeping the previous one", "interface", name, "error", err)
+		}
+	}
+	w.sniffersMux.Unlock()
+
+	w.sessionManager.replaceFilters(newFilterSet(onlyFilter, excludeFilter, excludePorts), perIface)
+	w.logger.Info("Filters reloaded", "only", onlyFilter, "exclude", excludeFilter, "exclude_ports", excludePorts, "interface_overrides", len(perIface))
+}
+
+// configFor returns the capture settings for an interface
+func (w *Watcher) configFor(name string) InterfaceConfig {
+	w.configMux.RLock()
+	defer w.configMux.RUnlock()
+	for _, cfg := range w.ifaceConfigs {
+		if ok, _ := path.Match(cfg.Pattern, name); ok {
+			return cfg
+		}
+	}
+	return InterfaceConfig{Pattern: name}
+}
+
+// setCaptureFilter installs the BPF program and snap length of an interface
+// on its capture sockets and sets the VLANs it records
+func (w *Watcher) setCaptureFilter(capture *captureStats, name string, cfg InterfaceConfig) error {
+	file, vlanSpec := cfg.BPF, cfg.VLANs
+	w.configMux.RLock()
+	if file == "" {
+		file = w.bpfFilter
+	}
+	if vlanSpec == "" {
+		vlanSpec = w.vlanFilter
+	}
+	w.configMux.RUnlock()
+
+	vlans, err := ParseVLANs(vlanSpec)
+	if err != nil {
+		return err
+	}
+	var program []bpf.Instruction
+	if file != "" {
+		if program, err = LoadBPFFilter(file); err != nil {
+			return err
+		}
+	}
+	snapLen := w.snapLenFor(cfg)
+	filter, err := captureFilter(program, snapLen)
+	if err != nil {
+		return fmt.Errorf("failed to build capture filter: %w", err)
+	}
+	for _, handle := range capture.handles {
+		if err := handle.SetBPF(filter); err != nil {
+			return fmt.Errorf("failed to set capture filter: %w", err)
+		}
+	}
+	if vlans != nil {
+		capture.vlans.Store(&vlans)
+	} else {
+		capture.vlans.Store(nil)
+	}
+	if file != "" || snapLen != 0 || vlans != nil {
+		w.logger.Info("Capture filter set", "interface", name, "bpf", file, "instructions", len(program), "snaplen", snapLenString(snapLen), "vlan", vlanSpec)
+	}
+	return nil
+}
+
+// interfaceFilters returns the filters for an interface with per-interface
+// overrides, filling unset fields from the global filters. ok is false when
+// the interface just uses the global filters.
+func (w *Watcher) interfaceFilters(name string) (only, exclude, ports string, ok bool) {
+	cfg := w.configFor(name)
+	if !cfg.hasFilters() {
+		return "", "", "", false
+	}
+	w.configMux.RLock()
+	defer w.configMux.RUnlock()
+	only, exclude, ports = cfg.Only, cfg.Exclude, cfg.ExcludePorts
+	if only == "" {
+		only = w.onlyFilter
+	}
+	if exclude == "" {
+		exclude = w.excludeFilter
+	}
+	if ports == "" {
+		ports = w.excludePorts
+	}
+	return only, exclude, ports, true
+}
+
+// AddEnricher registers an enricher applied to every captured event
+func (w *Watcher) AddEnricher(e enrich.Enricher) {
+	w.sessionManager.AddEnricher(e)
+}
+
+// SetPrivacy applies privacy mode to the names the capture log shows
+func (w *Watcher) SetPrivacy(p *enrich.Privacy) {
+	w.sessionManager.SetPrivacy(p)
+}
+
+// EnrichIngested runs events sent by external producers through scan
+// detection and the enrichers (see SessionManager.EnrichIngested)
+func (w *Watcher) EnrichIngested(events []database.NetworkEvent) {
+	w.sessionManager.EnrichIngested(events)
+}
+
+// StoreIngested writes ingested events to the event store and sinks (see
+// SessionManager.StoreIngested)
+func (w *Watcher) StoreIngested(events []database.NetworkEvent) ([]database.NetworkEvent, int, error) {
+	return w.sessionManager.StoreIngested(events)
+}
+
+// SetRateLimit caps recorded events per source IP (see SessionManager.SetRateLimit)
+func (w *Watcher) SetRateLimit(rate float64, burst int) {
+	w.sessionManager.SetRateLimit(rate, burst)
+}
+
+// SetScanDetection flags port scans and sweeps (see SessionManager.SetScanDetection)
+func (w *Watcher) SetScanDetection(window time.Duration, ports, hosts int) {
+	w.sessionManager.SetScanDetection(window, ports, hosts)
+}
+
+// SetSampling samples events of chatty source IPs (see SessionManager.SetSampling)
+func (w *Watcher) SetSampling(threshold, rate int) {
+	w.sessionManager.SetSampling(threshold, rate)
+}
+
+// SetP2PMode sets whether flows classified as BitTorrent are logged or
+// excluded; see P2PModes
+func (w *Watcher) SetP2PMode(mode string) {
+	w.sessionManager.SetP2PMode(mode)
+}
+
+// SetNTPServers sets the time servers devices are expected to use (see
+// SessionManager.SetNTPServers)
+func (w *Watcher) SetNTPServers(list string) {
+	w.sessionManager.SetNTPServers(list)
+}
+
+// SetSessionLimits sets the session timeouts and table size (see
+// SessionManager.SetSessionLimits)
+func (w *Watcher) SetSessionLimits(limits SessionLimits) {
+	w.sessionManager.SetSessionLimits(limits)
+}
+
+// SessionTable reports the occupancy of the session table
+func (w *Watcher) SessionTable() SessionTable {
+	return w.sessionManager.SessionTable()
+}
+
+// ActiveSessions lists the tracked sessions, most recently seen first
+func (w *Watcher) ActiveSessions(protocol string, limit int) []ActiveSession {
+	return w.sessionManager.ActiveSessions(protocol, limit)
+}
+
+// SetWriteOptions sets the database writer's queue size, batch size and
+// flush interval. It must be called before Run.
+func (w *Watcher) SetWriteOptions(opts WriteOptions) {
+	w.sessionManager.SetWriteOptions(opts)
+}
+
+// SetDedupWindow sets how far apart identical events of a flow may be to
+// be stored once with a repeat count (0 disables). It must be called
+// before Run.
+func (w *Watcher) SetDedupWindow(window time.Duration) {
+	w.sessionManager.SetDedupWindow(window)
+}
+
+// SetEventStore writes captured events to store instead of the watcher's
+// database, which keeps serving baselines and summaries. It must be called
+// before Run.
+func (w *Watcher) SetEventStore(store database.EventStore) {
+	w.sessionManager.SetEventStore(store)
+}
+
+// ResolveLinkTopology makes the watcher capture on bond masters instead of
+// their slaves and on bridge member ports instead of the bridge device, so
+// bridged and bonded traffic is not silently missed
+func (w *Watcher) ResolveLinkTopology() {
+	w.topology = newTopologyResolver(w.logger)
+}
+
 // Run starts the monitoring process. It blocks until the context is cancelled.
 func (w *Watcher) Run(ctx context.Context) error {
-	var wg sync.WaitGroup
+	w.sniffersMux.Lock()
+	w.sniffers = make(map[string]context.CancelFunc)
+	w.linkDown = make(map[string]time.Time)
+	w.sniffersMux.Unlock()
+	go w.sampleWriteRate(ctx)
+
+	w.rescanSignal = make(chan struct{}, 1)
+	var onLinkChange func()
+	if w.pattern != nil && w.linkRescan {
+		onLinkChange = w.requestRescan
+	}
+	w.links = newLinkMonitor(onLinkChange)
+	go func() {
+		if err := w.links.run(ctx); err != nil {
+			w.logger.Warn("Interface link monitoring unavailable, link changes are only noticed by failed captures and periodic rescans", "error", err)
+		}
+	}()
 
+	if w.topology != nil {
+		w.interfaces = w.topology.Resolve(w.interfaces)
+	}
 	for _, iface := range w.interfaces {
-		wg.Add(1)
-		go func(name string) {
-			defer wg.Done()
-			log.Info("Capture started", "interface", name)
-			if err := w.sniffInterface(ctx, iface); err != nil {
-				log.Error("Sniffer error", "interface", name, "error", err)
-			}
-			log.Info("Capture stopped", "interface", name)
-		}(iface.Name)
+		w.startSniffer(ctx, iface)
 	}
 
 	log.Info("Sniffers running for interfaces", "count", len(w.interfaces))
-	<-ctx.Done() // Block here until Ctrl+C
+
+	if w.pattern != nil && (w.rescanInterval > 0 || w.linkRescan) {
+		log.Info("Watching for interface changes", "pattern", w.pattern.String(), "interval", w.rescanInterval, "netlink", w.linkRescan)
+		var tick <-chan time.Time
+		if w.rescanInterval > 0 {
+			ticker := time.NewTicker(w.rescanInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		// Link changes come in bursts as an interface is created, renamed
+		// and brought up, so they are rescanned once the burst settled
+		settle := time.NewTimer(rescanSettleDelay)
+		settle.Stop()
+		defer settle.Stop()
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-tick:
+				w.rescanInterfaces(ctx)
+			case <-w.rescanSignal:
+				settle.Reset(rescanSettleDelay)
+			case <-settle.C:
+				w.rescanInterfaces(ctx)
+			}
+		}
+	} else {
+		<-ctx.Done() // Block here until Ctrl+C
+	}
+
 	log.Info("Shutting down watcher...")
+	// Sniffers stop first so no event is buffered after the writer closed,
+	// and the writer drains before the database closes
+	w.wg.Wait()
 	w.sessionManager.Stop()
 	if w.db != nil {
 		w.db.Close()
 	}
-	wg.Wait()
 
 	return nil
 }
 
-// sniffInterface is the core logic that uses afpacket
-func (w *Watcher) sniffInterface(ctx context.Context, iface net.Interface) error {
+// startSniffer launches a capture goroutine for one interface
+func (w *Watcher) startSniffer(ctx context.Context, iface net.Interface) {
+	sctx, cancel := context.WithCancel(ctx)
+
+	cfg := w.configFor(iface.Name)
+	if only, exclude, ports, ok := w.interfaceFilters(iface.Name); ok {
+		w.sessionManager.SetInterfaceFilters(iface.Name, only, exclude, ports)
+		w.logger.Info("Interface filters", "interface", iface.Name, "only", only, "exclude", exclude, "exclude_ports", ports)
+	}
+
+	w.sniffersMux.Lock()
+	w.sniffers[iface.Name] = cancel
+	w.sniffersMux.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer cancel()
+		w.runSniffer(sctx, iface, cfg)
+
+		// Forget the sniffer so a later rescan can restart it
+		w.sniffersMux.Lock()
+		delete(w.sniffers, iface.Name)
+		w.sniffersMux.Unlock()
+		if w.linkRescan {
+			w.requestRescan()
+		}
+	}()
+}
+
+// requestRescan has the pattern of WatchInterfaces re-evaluated shortly,
+// without waiting for the rescan interval
+func (w *Watcher) requestRescan() {
+	select {
+	case w.rescanSignal <- struct{}{}:
+	default:
+	}
+}
+
+// rescanInterfaces starts sniffers for newly matching interfaces and stops
+// sniffers whose interface vanished or no longer matches the pattern. A
+// matching interface that is down keeps its sniffer, which reopens the
+// capture when it comes back up.
+func (w *Watcher) rescanInterfaces(ctx context.Context) {
+	ifaces, err := w.pattern.Resolve()
+	if err != nil {
+		w.logger.Warn("Interface rescan failed", "error", err)
+		return
+	}
+	if w.topology != nil {
+		ifaces = w.topology.Resolve(ifaces)
+	}
+
+	current := make(map[string]bool, len(ifaces))
+	for _, iface := range ifaces {
+		current[iface.Name] = true
+
+		w.sniffersMux.Lock()
+		_, running := w.sniffers[iface.Name]
+		w.sniffersMux.Unlock()
+
+		if !running {
+			w.logger.Info("Interface matched pattern, starting capture", "interface", iface.Name)
+			w.startSniffer(ctx, iface)
+		}
+	}
+
+	w.sniffersMux.Lock()
+	defer w.sniffersMux.Unlock()
+	for name, cancel := range w.sniffers {
+		if current[name] {
+			continue
+		}
+		if iface, err := net.InterfaceByName(name); err == nil && !linkUp(*iface) && w.pattern.Match(name) {
+			continue
+		}
+		w.logger.Info("Interface gone or no longer matches, stopping capture", "interface", name)
+		cancel()
+	}
+}
+
+// sniffInterface is the core logic: it opens a capture with the configured
+// backend and processes its packets until ctx is cancelled
+func (w *Watcher) sniffInterface(ctx context.Context, iface net.Interface, cfg InterfaceConfig) error {
 	log.Info("Opening raw socket", "interface", iface.Name)
 
-	// 1. Open AF_PACKET handle (Linux specific high-performance capture)
-	// A Ring Buffer Clone of interface is created by kernel 
-	handle, err := afpacket.NewTPacket(
-		afpacket.OptInterface(iface.Name),
-		afpacket.OptFrameSize(4096),
-		afpacket.OptBlockSize(4096*128),
-		afpacket.OptNumBlocks(128),
-	)
+	// 1. Open the capture: AF_PACKET rings (Linux specific high-performance
+	// capture) or AF_XDP sockets, one per worker
+	handles, backend, err := w.openCapture(iface, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create afpacket: %w", err)
+		return err
 	}
-	defer handle.Close()
+	defer func() {
+		for _, handle := range handles {
+			handle.Close()
+		}
+	}()
 
-	// 2. Create the packet source from the handle
-	// This turns raw bytes into readable packets
-	source := gopacket.NewPacketSource(handle, layers.LinkTypeEthernet)
+	// 2. Start packet drop monitoring goroutine
+	capture := w.trackCapture(iface.Name, handles, backend)
+	defer w.untrackCapture(iface.Name, capture)
 
-	// 3. Start packet drop monitoring goroutine
-	go w.monitorDrops(ctx, handle, iface.Name)
+	// Filter and truncate packets in the kernel, like tcpdump -s
+	if err := w.setCaptureFilter(capture, iface.Name, cfg); err != nil {
+		return err
+	}
+	go w.monitorDrops(ctx, capture, iface.Name)
 
-	// 4. Process packets loop
-	w.logger.Info("Capture running...", "interface", iface.Name)
+	// 3. Process packets, each worker reading its own handle. The handles
+	// close once every worker is done with them.
+	w.logger.Info("Capture running...", "interface", iface.Name, "workers", len(handles))
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case packet := <-source.Packets():
-			w.processPacket(packet, iface.Name)
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(handles))
+	var wg sync.WaitGroup
+	for i, handle := range handles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A failed worker stops the whole capture, so it is reopened
+			// rather than running short of a worker
+			defer cancel()
+			errs[i] = w.captureWorker(wctx, handle, capture, capture.defrags[i], iface.Name)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// captureWorker processes the packets of one capture handle until ctx is
+// cancelled. Frames are read in place and the common ones decoded into
+// reused layers; only the others are copied for gopacket's full decoder.
+func (w *Watcher) captureWorker(ctx context.Context, handle captureHandle, capture *captureStats, defrag *defragmenter, ifaceName string) error {
+	decoder := newPacketDecoder()
+	var recordErrors uint64
+	for ctx.Err() == nil {
+		// Valid until the next read
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if err == errNoPacket {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read packet: %w", err)
+		}
+		if w.paused.Load() {
+			continue
+		}
+		capture.processed.Add(1)
+
+		var info packetInfo
+		var packet gopacket.Packet
+		var vlan VLANTags
+		fast := decoder.decode(data, &info)
+		if fast {
+			info.length = max(info.length, ci.Length)
+			vlan = frameVLANs(ci.AncillaryData, &decoder.eth)
+		} else {
+			packet = gopacket.NewPacket(slices.Clone(data), layers.LinkTypeEthernet, packetDecodeOptions)
+			packet.Metadata().CaptureInfo = ci
+			vlan = packetVLANs(packet)
+		}
+		if vlans := capture.vlans.Load(); vlans != nil && !vlans.Allows(vlan) {
+			continue
+		}
+		var ref CaptureRef
+		if w.recorder != nil {
+			ref, err = w.recorder.Record(ifaceName, ci, data)
+			if err != nil {
+				if recordErrors++; recordErrors%1000 == 1 {
+					w.logger.Warn("Failed to record packet", "interface", ifaceName, "errors", recordErrors, "error", err)
+				}
+			}
+		}
+		if fast {
+			w.trackPacket(&info, ifaceName, Encap{VLANTags: vlan}, ref)
+			continue
+		}
+		// Parse whole datagrams; fragments are recorded as captured
+		if packet, ok := defrag.Process(packet); ok {
+			w.processPacket(packet, ifaceName, vlan, ref)
 		}
 	}
+	return nil
 }
 
-// monitorDrops periodically checks for packet drops and logs warnings
-func (w *Watcher) monitorDrops(ctx context.Context, handle *afpacket.TPacket, ifaceName string) {
+// monitorDrops periodically checks for packet drops, logs warnings and
+// stores the counters
+func (w *Watcher) monitorDrops(ctx context.Context, capture *captureStats, ifaceName string) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
@@ -131,14 +625,12 @@ func (w *Watcher) monitorDrops(ctx context.Context, handle *afpacket.TPacket, if
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			_, stats, err := handle.SocketStats()
+			total, drops, err := capture.sample()
 			if err != nil {
 				w.logger.Error("Failed to get socket stats", "interface", ifaceName, "error", err)
 				continue
 			}
-
-			drops := uint64(stats.Drops())
-			total := uint64(stats.Packets())
+			w.saveCounters(ifaceName, capture)
 
 			// Calculate drops since last check
 			newDrops := drops - lastDrops
@@ -169,106 +661,139 @@ func (w *Watcher) monitorDrops(ctx context.Context, handle *afpacket.TPacket, if
 	}
 }
 
-// processPacket handles a single captured packet
-func (w *Watcher) processPacket(packet gopacket.Packet, ifaceName string) {
-	// Check for packet decoding errors
-	if errLayer := packet.ErrorLayer(); errLayer != nil {
-		// Get full hex dump for debugging
-		data := packet.Data()
-		hexDump := ""
-		for i := 0; i < len(data); i++ {
-			if i > 0 && i%16 == 0 {
-				hexDump += " "
-			}
-			hexDump += fmt.Sprintf("%02x", data[i])
-		}
-
-		w.logger.Debug("[PACKET ERROR]",
-			"interface", ifaceName,
-			"error", errLayer.Error(),
-			"len", len(data),
-			"hex", hexDump,
-		)
-		return
-	}
+// processPacket handles a single captured packet. Packets are decoded
+// lazily, so only the layers looked up here are ever parsed.
+func (w *Watcher) processPacket(packet gopacket.Packet, ifaceName string, vlan VLANTags, ref CaptureRef) {
+	// Track the flow inside GRE, VXLAN, Geneve and IP-in-IP tunnels rather
+	// than the tunnel itself
+	packet, tunnel := decapsulate(packet)
+	encap := Encap{VLANTags: vlan, Tunnel: tunnel}
 
-	var srcIP, dstIP net.IP
-	var isIPv6 bool
+	var info packetInfo
 
 	// Try IPv4 first
 	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
 		ip, _ := ipLayer.(*layers.IPv4)
-		srcIP = ip.SrcIP
-		dstIP = ip.DstIP
-		isIPv6 = false
+		info.srcIP = ip.SrcIP
+		info.dstIP = ip.DstIP
+		info.isIPv6 = false
 	} else if ip6Layer := packet.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
 		// Try IPv6
 		ip6, _ := ip6Layer.(*layers.IPv6)
-		srcIP = ip6.SrcIP
-		dstIP = ip6.DstIP
-		isIPv6 = true
+		info.srcIP = ip6.SrcIP
+		info.dstIP = ip6.DstIP
+		info.isIPv6 = true
 	} else {
-		// Neither IPv4 nor IPv6
+		// Neither IPv4 nor IPv6, or the headers failed to decode. Asking
+		// for the error layer decodes the whole packet, so only do it here.
+		if errLayer := packet.ErrorLayer(); errLayer != nil {
+			w.logger.Debug("[PACKET ERROR]",
+				"interface", ifaceName,
+				"error", errLayer.Error(),
+				"len", len(packet.Data()),
+				"hex", hex.EncodeToString(packet.Data()),
+			)
+		}
 		return
 	}
+	// Packets cut short by the snap length count with their full length
+	info.length = max(len(packet.Data()), packet.Metadata().Length)
 
-	// Check for TCP
 	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-		tcp, _ := tcpLayer.(*layers.TCP)
-		src := fmt.Sprintf("[%s]:%d", srcIP, tcp.SrcPort)
-		dst := fmt.Sprintf("[%s]:%d", dstIP, tcp.DstPort)
-		length := len(packet.Data())
+		info.tcp, _ = tcpLayer.(*layers.TCP)
+	} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		info.udp, _ = udpLayer.(*layers.UDP)
+	} else if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		info.icmp4, _ = icmpLayer.(*layers.ICMPv4)
+	} else if icmp6Layer := packet.Layer(layers.LayerTypeICMPv6); icmp6Layer != nil {
+		info.icmp6, _ = icmp6Layer.(*layers.ICMPv6)
+	} else if packet.Layer(layers.LayerTypeIPSecESP) != nil || packet.Layer(layers.LayerTypeIPSecAH) != nil {
+		info.ipsec = true
+	}
+	w.trackPacket(&info, ifaceName, encap, ref)
+}
 
-		// Track TCP connection lifecycle
-		w.sessionManager.TrackTCP(ifaceName, src, dst, tcp.SYN && !tcp.ACK, tcp.FIN, tcp.RST, length, isIPv6)
+// trackPacket hands a decoded packet to the session manager
+func (w *Watcher) trackPacket(info *packetInfo, ifaceName string, encap Encap, ref CaptureRef) {
+	isIPv6, length := info.isIPv6, info.length
+	// Sessions are keyed by comparable addresses; strings are only made
+	// for the events they write
+	srcIP, _ := netip.AddrFromSlice(info.srcIP)
+	dstIP, _ := netip.AddrFromSlice(info.dstIP)
+	srcIP, dstIP = srcIP.Unmap(), dstIP.Unmap()
+
+	// Check for TCP
+	if tcp := info.tcp; tcp != nil {
+		src := netip.AddrPortFrom(srcIP, uint16(tcp.SrcPort))
+		dst := netip.AddrPortFrom(dstIP, uint16(tcp.DstPort))
 
-		// Check for TLS handshake (port 443 or has payload starting with 0x16)
-		if len(tcp.Payload) > 0 && tcp.Payload[0] == 0x16 {
-			if sni := ParseTLSSNI(tcp.Payload); sni != "" {
-				w.sessionManager.TrackTLSHandshake(ifaceName, src, dst, sni, isIPv6)
+		// Track TCP connection lifecycle
+		w.sessionManager.TrackTCP(ifaceName, encap, src, dst, tcp.SYN && !tcp.ACK, tcp.FIN, tcp.RST, tcp.Payload, length, isIPv6, ref)
+
+		// Check for a TLS handshake on any port; the parsers validate the
+		// record header, so only plausible hellos are reported
+		if len(tcp.Payload) > 0 && tcp.Payload[0] == tlsRecordHandshake {
+			if hello := ParseClientHello(tcp.Payload); hello != nil {
+				w.sessionManager.TrackTLSHandshake(ifaceName, encap, src, dst, hello, isIPv6, ref)
+			} else if hello := ParseServerHello(tcp.Payload); hello != nil {
+				w.sessionManager.TrackTLSServerHello(src, dst, hello)
 			}
 		}
+
+		// SSH and RDP are recognised by their handshakes, on any port
+		if banner := ParseSSHBanner(tcp.Payload); banner != nil {
+			w.sessionManager.TrackSSHBanner(ifaceName, encap, src, dst, banner, isIPv6, ref)
+		} else if neg := ParseRDPNegotiation(tcp.Payload); neg != nil {
+			w.sessionManager.TrackRDP(ifaceName, encap, src, dst, neg, isIPv6, ref)
+		}
 		return
 	}
 
 	// Check for UDP
-	if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-		udp, _ := udpLayer.(*layers.UDP)
-		src := fmt.Sprintf("[%s]:%d", srcIP, udp.SrcPort)
-		dst := fmt.Sprintf("[%s]:%d", dstIP, udp.DstPort)
-		length := len(packet.Data())
+	if udp := info.udp; udp != nil {
+		src := netip.AddrPortFrom(srcIP, uint16(udp.SrcPort))
+		dst := netip.AddrPortFrom(dstIP, uint16(udp.DstPort))
+
+		// VPN tunnels are tracked as such, unless VPN events are filtered out
+		size := max(len(udp.Payload), int(udp.Length)-8)
+		if vpn := vpnProtocol(uint16(udp.SrcPort), uint16(udp.DstPort), udp.Payload, size); vpn != "" &&
+			w.sessionManager.TrackVPN(ifaceName, encap, src, dst, vpn, length, isIPv6, ref) {
+			return
+		}
 
 		// Track UDP "connection"
-		w.sessionManager.TrackUDP(ifaceName, src, dst, uint16(udp.SrcPort), uint16(udp.DstPort), length, isIPv6)
+		w.sessionManager.TrackUDP(ifaceName, encap, src, dst, udp.Payload, length, isIPv6, ref)
 
 		// Check for DNS (port 53)
 		if udp.SrcPort == 53 || udp.DstPort == 53 {
-			if queries, resolvedIPs, cnames, isResponse := ParseDNSResponse(udp.Payload); len(queries) > 0 {
-				w.sessionManager.TrackDNS(ifaceName, src, dst, queries, isResponse, resolvedIPs, cnames, isIPv6)
+			if msg := ParseDNSMessage(udp.Payload); msg != nil && len(msg.Queries) > 0 {
+				w.sessionManager.TrackDNS(ifaceName, encap, src, dst, msg, isIPv6, ref)
+			}
+		}
+
+		// Check for NTP (port 123), recording the server each device syncs with
+		if udp.SrcPort == ntpPort || udp.DstPort == ntpPort {
+			if pkt := ParseNTP(udp.Payload); pkt != nil {
+				w.sessionManager.TrackNTP(ifaceName, encap, src, dst, pkt, isIPv6, ref)
 			}
 		}
 		return
 	}
 
 	// Check for ICMPv4
-	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
-		icmp, _ := icmpLayer.(*layers.ICMPv4)
-		src := srcIP.String()
-		dst := dstIP.String()
-		length := len(packet.Data())
-
-		w.sessionManager.TrackICMP(ifaceName, src, dst, uint8(icmp.TypeCode.Type()), uint8(icmp.TypeCode.Code()), length, false, icmp.Payload)
+	if icmp := info.icmp4; icmp != nil {
+		w.sessionManager.TrackICMP(ifaceName, encap, srcIP, dstIP, uint8(icmp.TypeCode.Type()), uint8(icmp.TypeCode.Code()), length, false, icmp.Payload, ref)
 		return
 	}
 
 	// Check for ICMPv6
-	if icmp6Layer := packet.Layer(layers.LayerTypeICMPv6); icmp6Layer != nil {
-		icmp6, _ := icmp6Layer.(*layers.ICMPv6)
-		src := srcIP.String()
-		dst := dstIP.String()
-		length := len(packet.Data())
-
-		w.sessionManager.TrackICMP(ifaceName, src, dst, uint8(icmp6.TypeCode.Type()), uint8(icmp6.TypeCode.Code()), length, true, icmp6.Payload)
+	if icmp6 := info.icmp6; icmp6 != nil {
+		w.sessionManager.TrackICMP(ifaceName, encap, srcIP, dstIP, uint8(icmp6.TypeCode.Type()), uint8(icmp6.TypeCode.Code()), length, true, icmp6.Payload, ref)
 		return
 	}
+
+	// IPsec ESP and AH carry no ports; track them between the two hosts
+	if info.ipsec {
+		w.sessionManager.TrackVPN(ifaceName, encap, netip.AddrPortFrom(srcIP, 0), netip.AddrPortFrom(dstIP, 0), "IPsec", length, isIPv6, ref)
+	}
 }
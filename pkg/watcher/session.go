@@ -1,14 +1,24 @@
 package watcher
 
 import (
+	"container/list"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/abja/net-watcher/internal/database"
+	"github.com/abja/net-watcher/internal/enrich"
+	"github.com/abja/net-watcher/internal/sink"
 	"github.com/charmbracelet/log"
 )
 
@@ -19,24 +29,40 @@ const (
 	ProtoTCP  Protocol = "TCP"
 	ProtoUDP  Protocol = "UDP"
 	ProtoICMP Protocol = "ICMP"
+	ProtoVPN  Protocol = "VPN"
 )
 
 // Session represents an active connection in memory
 type Session struct {
-	ID        string
+	FlowID    string // Stable ID shared by every event of this connection
 	Protocol  Protocol
 	Src       string
 	Dst       string
 	Iface     string
+	VLAN      VLANTags
+	Tunnel    Tunnel
 	IPVersion uint8 // 4 or 6
 	StartTime time.Time
 	LastSeen  time.Time
 	ByteCount int64
+	SrcBytes  int64  // Of ByteCount, sent by Src
+	DstBytes  int64  // Of ByteCount, sent by Dst (replies)
 	Hostname  string // Cached hostname for this connection
 	// DNS specific
 	DNSQueries []string
 	// TLS specific
 	SNI string
+	// VPN specific: WireGuard, IPsec or OpenVPN
+	VPN string
+	// P2P specific: BitTorrent class (dht, utp, tracker, peer)
+	P2P string
+	// File sharing: SMB or NFS, once seen in the payload
+	FileShare *FileShare
+	// Key and position in the least-recently-seen order of its shard of
+	// the session table
+	key   sessionKey
+	lru   *list.Element
+	shard *sessionShard
 }
 
 // DNSCacheEntry stores a resolved hostname with timestamp
@@ -47,68 +73,186 @@ type DNSCacheEntry struct {
 
 // SessionManager handles the state of active connections
 type SessionManager struct {
-	sessions map[string]*Session
-	mutex    sync.RWMutex
-	logger   *log.Logger
-	db       *database.DB
+	// Session table, split by flow so capture workers rarely wait for
+	// each other
+	shards [sessionShards]sessionShard
+	logger *log.Logger
+	db     *database.DB
+	store  database.EventStore // where batches are written; db unless replaced
 	// Configuration
 	cleanupInterval time.Duration
-	sessionTimeout  time.Duration
+	limits          atomic.Pointer[SessionLimits]
 	stopChan        chan struct{}
-	// Filters - which protocols/events to log
-	filters      map[string]bool
-	exclusions   map[string]bool
-	excludePorts map[uint16]bool
+	cleanupDone     chan struct{} // closed when cleanupLoop returned
+	// Sessions ended by their idle timeout and by eviction, in total and
+	// evicted since the last cleanup tick
+	sessionsExpired, sessionsEvicted, evictedSinceTick atomic.Uint64
+	// Sessions tracked in all shards, held to MaxSessions
+	sessionTotal atomic.Int64
+	// Filters - which protocols/events to log, globally and per interface
+	filters      *filterSet
+	ifaceFilters map[string]*filterSet
+	filtersMux   sync.RWMutex
 	// Track recent rejected UDP to combine with ICMP unreachable
 	recentUDPRejects map[string]time.Time
 	// DNS cache: IP -> hostname + timestamp
 	dnsCache      map[string]*DNSCacheEntry
 	dnsCacheMutex sync.RWMutex
-	// Event batching
-	eventBuffer    []database.NetworkEvent
-	eventBufferMux sync.Mutex
-	batchSize      int
+	// Event batching, done by a single writer goroutine
+	writer *eventWriter
+	// Folds repeated identical events of a flow before they are written
+	dedup *deduper
+	// Streaming outputs that receive every written batch, from the writer
+	// and from ingestion
+	sinks     []sink.Sink
+	sinkMutex sync.Mutex
+	// Events successfully stored, for status reporting
+	eventsWritten atomic.Uint64
+	// Set by Stop, after which ingestion is refused; ingestion holds the
+	// read lock so Stop waits for batches being stored
+	stopped   bool
+	ingestMux sync.RWMutex
+	// Optional per-source event rate cap
+	rateLimiter *rateLimiter
+	// Optional per-source sampling of events above a rate
+	sampler *sampler
+	// Optional port-scan and sweep detection
+	scans *scanDetector
+	// Drop flows classified as P2P on every interface instead of logging them
+	p2pExclude atomic.Bool
+	// Annotate events before they are stored
+	enrichers []enrich.Enricher
+	// Privacy mode, applied to the names the capture log shows; nil logs
+	// them as captured
+	privacy *enrich.Privacy
+	// TLS_SNI events waiting for the ServerHello: "client->server" -> handshake
+	pendingTLS    map[string]*pendingHandshake
+	pendingTLSMux sync.Mutex
+	// REMOTE_ACCESS events waiting for the other side: "client->server" -> handshake
+	pendingRemote    map[string]*pendingHandshake
+	pendingRemoteMux sync.Mutex
+	// Expected time servers, and when each "client->server" NTP pair was last written
+	ntpPolicy  atomic.Pointer[ntpPolicy]
+	ntpSeen    map[string]time.Time
+	ntpSeenMux sync.Mutex
+	// Time of the packet being replayed from a capture file; nil while
+	// capturing live, which uses the wall clock
+	clock atomic.Pointer[time.Time]
+}
+
+// now is the current time of the traffic: the wall clock, or the packet
+// time while replaying a capture file
+func (sm *SessionManager) now() time.Time {
+	if t := sm.clock.Load(); t != nil {
+		return *t
+	}
+	return time.Now()
 }
 
+// pendingHandshake is a ClientHello whose event is held back until the
+// server's choice of version, cipher and ALPN is known
+type pendingHandshake struct {
+	event database.NetworkEvent
+	seen  time.Time
+}
+
+// tlsHandshakeTimeout is how long a ClientHello waits for its ServerHello
+// before the event is written without the negotiated parameters
+const tlsHandshakeTimeout = 10 * time.Second
+
+// remoteHandshakeTimeout is how long the first SSH banner or RDP request of
+// a connection waits for the other side before its event is written alone
+const remoteHandshakeTimeout = 10 * time.Second
+
 // NewSessionManager creates a new session manager and starts the cleanup goroutine
-// onlyFilter is a comma-separated list of protocols to log (tcp,udp,icmp,dns,tls)
+// onlyFilter is a comma-separated list of protocols to log (tcp,udp,icmp,dns,tls,vpn,remote,fileshare,ntp)
 // excludeFilter is a comma-separated list of traffic to exclude
 // excludePortsStr is a comma-separated list of ports to exclude
 // Empty string means log everything / exclude nothing
 func NewSessionManager(logger *log.Logger, db *database.DB, onlyFilter, excludeFilter, excludePortsStr string) *SessionManager {
-	filters := parseFilters(onlyFilter)
-	exclusions := parseFilters(excludeFilter)
-	excludePorts := parsePortsFilter(excludePortsStr)
+	filters := newFilterSet(onlyFilter, excludeFilter, excludePortsStr)
 
 	// Debug: log excluded ports
-	if len(excludePorts) > 0 {
+	if len(filters.excludePorts) > 0 {
 		var ports []uint16
-		for p := range excludePorts {
+		for p := range filters.excludePorts {
 			ports = append(ports, p)
 		}
 		logger.Info("Excluding ports", "ports", ports)
 	}
 
 	sm := &SessionManager{
-		sessions:         make(map[string]*Session),
 		logger:           logger,
 		db:               db,
 		cleanupInterval:  30 * time.Second,
-		sessionTimeout:   2 * time.Minute,
 		stopChan:         make(chan struct{}),
+		cleanupDone:      make(chan struct{}),
 		filters:          filters,
-		exclusions:       exclusions,
-		excludePorts:     excludePorts,
+		ifaceFilters:     make(map[string]*filterSet),
 		recentUDPRejects: make(map[string]time.Time),
 		dnsCache:         make(map[string]*DNSCacheEntry),
-		eventBuffer:      make([]database.NetworkEvent, 0, 100),
-		batchSize:        100,
+		pendingTLS:       make(map[string]*pendingHandshake),
+		pendingRemote:    make(map[string]*pendingHandshake),
+		ntpSeen:          make(map[string]time.Time),
+		dedup:            newDeduper(DefaultDedupWindow),
+	}
+	for i := range sm.shards {
+		sm.shards[i].sessions = make(map[sessionKey]*Session)
+		sm.shards[i].lru = list.New()
+	}
+	limits := DefaultSessionLimits
+	sm.limits.Store(&limits)
+	if db != nil {
+		sm.store = db
 	}
+	sm.writer = newEventWriter(DefaultWriteOptions, sm.writeBatch, logger)
 	// Start Garbage Collector in background
 	go sm.cleanupLoop()
 	return sm
 }
 
+// filterSet holds the only/exclude/port filters applied to captured traffic
+type filterSet struct {
+	filters      map[string]bool
+	exclusions   map[string]bool
+	excludePorts map[uint16]bool
+}
+
+// newFilterSet parses comma-separated only, exclude and port filters
+func newFilterSet(onlyFilter, excludeFilter, excludePorts string) *filterSet {
+	return &filterSet{
+		filters:      parseFilters(onlyFilter),
+		exclusions:   parseFilters(excludeFilter),
+		excludePorts: parsePortsFilter(excludePorts),
+	}
+}
+
+// SetInterfaceFilters replaces the global filters for one interface
+func (sm *SessionManager) SetInterfaceFilters(iface, onlyFilter, excludeFilter, excludePorts string) {
+	sm.filtersMux.Lock()
+	sm.ifaceFilters[iface] = newFilterSet(onlyFilter, excludeFilter, excludePorts)
+	sm.filtersMux.Unlock()
+}
+
+// replaceFilters atomically swaps the global filters and all per-interface
+// overrides; packets already being processed finish with the old filters
+func (sm *SessionManager) replaceFilters(global *filterSet, perIface map[string]*filterSet) {
+	sm.filtersMux.Lock()
+	sm.filters = global
+	sm.ifaceFilters = perIface
+	sm.filtersMux.Unlock()
+}
+
+// filtersFor returns the filters that apply to traffic on an interface
+func (sm *SessionManager) filtersFor(iface string) *filterSet {
+	sm.filtersMux.RLock()
+	defer sm.filtersMux.RUnlock()
+	if f, ok := sm.ifaceFilters[iface]; ok {
+		return f
+	}
+	return sm.filters
+}
+
 // parseFilters converts comma-separated filter string to a map
 func parseFilters(filterStr string) map[string]bool {
 	filters := make(map[string]bool)
@@ -143,78 +287,99 @@ func parsePortsFilter(portsStr string) map[uint16]bool {
 	return ports
 }
 
+// Names accepted by the only and exclude filters
+var (
+	OnlyFilterNames    = []string{"tcp", "udp", "icmp", "dns", "tls", "vpn", "remote", "fileshare", "ntp"}
+	ExcludeFilterNames = []string{"multicast", "broadcast", "linklocal", "bittorrent", "mdns", "ssdp", "metadata", "ndp", "unreachable"}
+)
+
+// ValidateFilters checks only, exclude and exclude-ports filter values,
+// which the session manager would otherwise apply ignoring unknown names
+func ValidateFilters(only, exclude, ports string) error {
+	for _, check := range []struct {
+		kind, value string
+		known       []string
+	}{
+		{"protocol", only, OnlyFilterNames},
+		{"exclusion", exclude, ExcludeFilterNames},
+	} {
+		for name := range parseFilters(check.value) {
+			if !slices.Contains(check.known, name) {
+				return fmt.Errorf("unknown %s %q (expected %s)", check.kind, name, strings.Join(check.known, ", "))
+			}
+		}
+	}
+	for _, p := range strings.Split(ports, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if port, err := strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %q", p)
+		}
+	}
+	return nil
+}
+
 // shouldLog returns true if the given protocol should be logged
-func (sm *SessionManager) shouldLog(protocol string) bool {
+func (f *filterSet) shouldLog(protocol string) bool {
 	// If no filters specified, log everything
-	if len(sm.filters) == 0 {
+	if len(f.filters) == 0 {
 		return true
 	}
-	return sm.filters[strings.ToLower(protocol)]
+	return f.filters[strings.ToLower(protocol)]
 }
 
 // shouldExclude checks if traffic should be excluded based on src/dst addresses and ports
-func (sm *SessionManager) shouldExclude(src, dst string, srcPort, dstPort uint16) bool {
+func (f *filterSet) shouldExclude(src, dst netip.Addr, srcPort, dstPort uint16) bool {
 	// Check for explicitly excluded ports first (independent of --exclude flag)
-	if len(sm.excludePorts) > 0 {
-		if sm.excludePorts[srcPort] || sm.excludePorts[dstPort] {
+	if len(f.excludePorts) > 0 {
+		if f.excludePorts[srcPort] || f.excludePorts[dstPort] {
 			return true
 		}
 	}
 
-	if len(sm.exclusions) == 0 {
+	if len(f.exclusions) == 0 {
 		return false
 	}
 
 	// Check for multicast exclusion (224.0.0.0/4 for IPv4, ff00::/8 for IPv6)
-	if sm.exclusions["multicast"] {
-		if isMulticastAddress(dst) {
+	if f.exclusions["multicast"] {
+		if dst.IsMulticast() {
 			return true
 		}
 	}
 
 	// Check for broadcast exclusion
-	if sm.exclusions["broadcast"] {
-		if strings.Contains(dst, "255.255.255.255") {
+	if f.exclusions["broadcast"] {
+		if dst == broadcastAddr {
 			return true
 		}
 	}
 
 	// Check for link-local exclusion (169.254.x.x, fe80::)
-	if sm.exclusions["linklocal"] {
-		if isLinkLocalAddress(src) || isLinkLocalAddress(dst) {
-			return true
-		}
-	}
-
-	// Check for BitTorrent exclusion (common DHT ports)
-	if sm.exclusions["bittorrent"] {
-		btPorts := map[uint16]bool{
-			6881: true, 6882: true, 6883: true, 6884: true, 6885: true,
-			6886: true, 6887: true, 6888: true, 6889: true, 6890: true,
-			51413: true, // Transmission default
-		}
-		if btPorts[srcPort] || btPorts[dstPort] {
+	if f.exclusions["linklocal"] {
+		if src.IsLinkLocalUnicast() || dst.IsLinkLocalUnicast() {
 			return true
 		}
 	}
 
 	// Check for mDNS exclusion
-	if sm.exclusions["mdns"] {
+	if f.exclusions["mdns"] {
 		if srcPort == 5353 || dstPort == 5353 {
 			return true
 		}
 	}
 
 	// Check for SSDP/UPnP exclusion
-	if sm.exclusions["ssdp"] {
+	if f.exclusions["ssdp"] {
 		if srcPort == 1900 || dstPort == 1900 {
 			return true
 		}
 	}
 
 	// Check for cloud metadata service exclusion (169.254.169.254)
-	if sm.exclusions["metadata"] {
-		if isMetadataAddress(src) || isMetadataAddress(dst) {
+	if f.exclusions["metadata"] {
+		if src == metadataAddr || dst == metadataAddr {
 			return true
 		}
 	}
@@ -222,90 +387,326 @@ func (sm *SessionManager) shouldExclude(src, dst string, srcPort, dstPort uint16
 	return false
 }
 
-// isMulticastAddress checks if address is multicast
-func isMulticastAddress(addr string) bool {
-	// IPv4 multicast: 224.0.0.0 - 239.255.255.255
-	// IPv6 multicast: ff00::/8
-	if strings.HasPrefix(addr, "[224.") || strings.HasPrefix(addr, "[225.") ||
-		strings.HasPrefix(addr, "[226.") || strings.HasPrefix(addr, "[227.") ||
-		strings.HasPrefix(addr, "[228.") || strings.HasPrefix(addr, "[229.") ||
-		strings.HasPrefix(addr, "[230.") || strings.HasPrefix(addr, "[231.") ||
-		strings.HasPrefix(addr, "[232.") || strings.HasPrefix(addr, "[233.") ||
-		strings.HasPrefix(addr, "[234.") || strings.HasPrefix(addr, "[235.") ||
-		strings.HasPrefix(addr, "[236.") || strings.HasPrefix(addr, "[237.") ||
-		strings.HasPrefix(addr, "[238.") || strings.HasPrefix(addr, "[239.") ||
-		strings.HasPrefix(addr, "[ff") {
-		return true
+var (
+	// broadcastAddr is the IPv4 limited broadcast address
+	broadcastAddr = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+	// metadataAddr is the cloud metadata service address
+	metadataAddr = netip.AddrFrom4([4]byte{169, 254, 169, 254})
+)
+
+// SetRateLimit caps recorded events per source IP to rate events/second with
+// bursts of up to burst events; excess events are summarised periodically
+// as RATE_LIMITED events. A rate of zero disables limiting.
+func (sm *SessionManager) SetRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		sm.rateLimiter = nil
+		return
 	}
-	return false
+	sm.rateLimiter = newRateLimiter(rate, burst)
 }
 
-// isLinkLocalAddress checks if address is link-local
-func isLinkLocalAddress(addr string) bool {
-	// IPv4 link-local: 169.254.x.x
-	// IPv6 link-local: fe80::/10
-	if strings.HasPrefix(addr, "[169.254.") || strings.HasPrefix(addr, "[fe80:") ||
-		strings.HasPrefix(addr, "169.254.") || strings.HasPrefix(addr, "fe80:") {
-		return true
+// SetSampling records only one in rate events of a source IP beyond its
+// first threshold events in any second; skipped events are summarised
+// periodically as SAMPLED events. A threshold of zero disables sampling.
+func (sm *SessionManager) SetSampling(threshold, rate int) {
+	if threshold <= 0 {
+		sm.sampler = nil
+		return
 	}
-	return false
+	sm.sampler = newSampler(threshold, rate)
+}
+
+// SetScanDetection flags a source contacting ports distinct ports of one
+// host, or one port on hosts distinct local hosts, within window; each scan
+// is recorded as a SCAN event once it stops. Zero limits disable detection.
+func (sm *SessionManager) SetScanDetection(window time.Duration, ports, hosts int) {
+	if window <= 0 || ports <= 0 && hosts <= 0 {
+		sm.scans = nil
+		return
+	}
+	sm.scans = newScanDetector(window, ports, hosts)
 }
 
-// isMetadataAddress checks if address is cloud metadata service (169.254.169.254)
-func isMetadataAddress(addr string) bool {
-	return strings.Contains(addr, "169.254.169.254")
+// SetP2PMode sets what is done with flows classified as BitTorrent: "log"
+// records them with their class, "exclude" drops them on every interface
+func (sm *SessionManager) SetP2PMode(mode string) {
+	sm.p2pExclude.Store(mode == "exclude")
 }
 
-// Stop stops the session manager cleanup goroutine and flushes remaining events
+// excludesP2P reports whether classified P2P flows are dropped on an
+// interface, by --p2p exclude or its bittorrent traffic exclusion
+func (sm *SessionManager) excludesP2P(f *filterSet) bool {
+	return sm.p2pExclude.Load() || f.exclusions["bittorrent"]
+}
+
+// AddEnricher registers an enricher applied to every event before it is stored
+func (sm *SessionManager) AddEnricher(e enrich.Enricher) {
+	sm.enrichers = append(sm.enrichers, e)
+}
+
+// SetPrivacy rewrites the names the capture log shows as privacy mode
+// stores them; the enricher itself is added with AddEnricher
+func (sm *SessionManager) SetPrivacy(p *enrich.Privacy) {
+	sm.privacy = p
+}
+
+// logName returns a name of one privacy field (dns, sni or hostname) as
+// it may be logged
+func (sm *SessionManager) logName(field, name string) string {
+	if sm.privacy == nil {
+		return name
+	}
+	return sm.privacy.Rewrite(field, name)
+}
+
+// AddSink registers a streaming output that receives every written event batch
+func (sm *SessionManager) AddSink(s sink.Sink) {
+	sm.sinks = append(sm.sinks, s)
+}
+
+// SetEventStore replaces the store event batches are written to. It must
+// be called before capture starts.
+func (sm *SessionManager) SetEventStore(store database.EventStore) {
+	sm.store = store
+}
+
+// SetDedupWindow sets how far apart identical events of a flow may be to
+// be stored as one event with a repeat count; 0 stores every event. It
+// must be called before capture starts.
+func (sm *SessionManager) SetDedupWindow(window time.Duration) {
+	sm.dedup = nil
+	if window > 0 {
+		sm.dedup = newDeduper(window)
+	}
+}
+
+// SetWriteOptions replaces the event writer's queue and batching settings.
+// It must be called before capture starts.
+func (sm *SessionManager) SetWriteOptions(opts WriteOptions) {
+	sm.writer.close()
+	sm.writer = newEventWriter(opts, sm.writeBatch, sm.logger)
+}
+
+// Stop stops the session manager cleanup goroutine and flushes remaining
+// events. Capture must have stopped: events buffered after the writer is
+// closed would be sent on a closed channel.
 func (sm *SessionManager) Stop() {
+	sm.ingestMux.Lock()
+	sm.stopped = true
+	sm.ingestMux.Unlock()
 	close(sm.stopChan)
-	// Flush any remaining buffered events
-	sm.flushEvents()
+	// A cleanup in progress still buffers its summaries
+	<-sm.cleanupDone
+	// Write handshakes still waiting for the server, then drain the writer
+	sm.flushPendingTLS(sm.now())
+	sm.flushPendingRemote(sm.now())
+	if sm.scans != nil {
+		for _, summary := range sm.scans.Flush() {
+			sm.logScan(summary)
+			sm.bufferEvent(summary)
+		}
+	}
+	sm.writer.close()
+	for _, s := range sm.sinks {
+		if err := s.Close(); err != nil {
+			sm.logger.Error("Failed to close sink", "sink", s.Name(), "error", err)
+		}
+	}
 }
 
-// queueEvent adds an event to the buffer and flushes when batch size is reached
+// queueEvent applies scan detection, sampling, the rate limiter and
+// enrichers and buffers the event for writing
 func (sm *SessionManager) queueEvent(event database.NetworkEvent) {
-	if sm.db == nil {
+	// The filters and enrichers take a pointer, which would move every
+	// event to the heap; a pooled copy is used instead
+	e := eventPool.Get().(*database.NetworkEvent)
+	*e = event
+	if sm.admitEvent(e) {
+		enrich.Apply(sm.enrichers, e)
+		sm.bufferEvent(*e)
+	}
+	*e = database.NetworkEvent{}
+	eventPool.Put(e)
+}
+
+// eventPool holds the events queueEvent works on. Every event built while
+// processing a packet (TCP_START, UDP, DNS, TLS_SNI, ...) passes through
+// queueEvent, so this is where the capture path reuses event structs;
+// processPacket itself only holds the decoded layers.
+var eventPool = sync.Pool{New: func() any { return new(database.NetworkEvent) }}
+
+// admitEvent runs scan detection, sampling and rate limiting on an event
+// and reports whether it is kept
+func (sm *SessionManager) admitEvent(event *database.NetworkEvent) bool {
+	// Before sampling and rate limiting, which a scan is likely to trigger
+	if sm.scans != nil {
+		for _, sc := range sm.scans.Observe(event) {
+			if sc.sweep {
+				sm.logger.Warn("[SCAN] Sweep detected", "iface", event.Interface, "src", event.SrcIP,
+					"proto", sc.proto, "port", sc.port, "hosts", len(sc.targets))
+			} else {
+				sm.logger.Warn("[SCAN] Port scan detected", "iface", event.Interface, "src", event.SrcIP,
+					"proto", sc.proto, "dst", sc.host, "ports", len(sc.targets))
+			}
+		}
+	}
+	if sm.sampler != nil && !sm.sampler.Keep(event) {
+		return false
+	}
+	return sm.rateLimiter == nil || sm.rateLimiter.Allow(event)
+}
+
+// bufferEvent hands an event to the writer without blocking the caller
+func (sm *SessionManager) bufferEvent(event database.NetworkEvent) {
+	if sm.store == nil {
 		return
 	}
+	sm.writer.enqueue(event)
+}
 
-	sm.eventBufferMux.Lock()
-	sm.eventBuffer = append(sm.eventBuffer, event)
-	shouldFlush := len(sm.eventBuffer) >= sm.batchSize
-	sm.eventBufferMux.Unlock()
+// writeBatch stores one batch and passes it on to live subscribers and sinks.
+// It runs on the writer goroutine only, which also calls it with an empty
+// batch when idle so repeats of stored events are written.
+func (sm *SessionManager) writeBatch(events []database.NetworkEvent) {
+	var runs []*dedupRun
+	if sm.dedup != nil {
+		events, runs = sm.dedup.fold(events)
+	}
+	if len(events) > 0 {
+		if !sm.insertBatch(events, runs) {
+			return
+		}
+	}
+	if sm.dedup != nil {
+		if repeats := sm.dedup.updates(sm.now()); len(repeats) > 0 {
+			if err := sm.store.(database.RepeatStore).UpdateRepeats(repeats); err != nil {
+				sm.logger.Error("Failed to update repeated events", "count", len(repeats), "error", err)
+			}
+		}
+	}
+}
 
-	if shouldFlush {
-		sm.flushEvents()
+// insertBatch stores a non-empty batch, passes it on to live subscribers
+// and sinks, and reports whether it was stored
+func (sm *SessionManager) insertBatch(events []database.NetworkEvent, runs []*dedupRun) bool {
+	if err := sm.store.InsertBatch(events); err != nil {
+		sm.logger.Error("Failed to insert event batch", "count", len(events), "error", err)
+		if sm.dedup != nil {
+			sm.dedup.discard(runs)
+		}
+		return false
+	}
+	if sm.dedup != nil {
+		_, updatable := sm.store.(database.RepeatStore)
+		sm.dedup.stored(events, runs, updatable)
 	}
+	sm.logger.Debug("Flushed event batch", "count", len(events))
+	sm.eventsWritten.Add(uint64(len(events)))
+	// Push events to WebSocket subscribers as soon as they are stored
+	database.PublishEvents(events)
+	sm.writeSinks(events)
+	return true
 }
 
-// flushEvents writes all buffered events to the database
-func (sm *SessionManager) flushEvents() {
-	sm.eventBufferMux.Lock()
-	if len(sm.eventBuffer) == 0 {
-		sm.eventBufferMux.Unlock()
-		return
+// writeSinks passes stored events on to every sink
+func (sm *SessionManager) writeSinks(events []database.NetworkEvent) {
+	sm.sinkMutex.Lock()
+	defer sm.sinkMutex.Unlock()
+	for _, s := range sm.sinks {
+		if err := s.Write(events); err != nil {
+			sm.logger.Error("Failed to stream event batch", "sink", s.Name(), "error", err)
+		}
 	}
-	// Copy buffer and reset
-	events := make([]database.NetworkEvent, len(sm.eventBuffer))
-	copy(events, sm.eventBuffer)
-	sm.eventBuffer = sm.eventBuffer[:0]
-	sm.eventBufferMux.Unlock()
+}
 
-	if err := sm.db.InsertBatch(events); err != nil {
-		sm.logger.Error("Failed to insert event batch", "count", len(events), "error", err)
+// EnrichIngested applies scan detection and the enrichers to events sent
+// by external producers, as queueEvent does for captured ones. Sampling
+// and the rate limiter are left out: producers send bounded batches and
+// get told what was stored.
+func (sm *SessionManager) EnrichIngested(events []database.NetworkEvent) {
+	for i := range events {
+		if sm.scans != nil {
+			for _, sc := range sm.scans.Observe(&events[i]) {
+				sm.logger.Warn("[SCAN] Scan detected in ingested events", "sensor", events[i].Sensor,
+					"src", events[i].SrcIP, "proto", sc.proto, "targets", len(sc.targets))
+			}
+		}
+		enrich.Apply(sm.enrichers, &events[i])
+	}
+}
+
+// ErrStopped is returned by StoreIngested once the session manager stopped
+// and its store and sinks are closing
+var ErrStopped = errors.New("capture pipeline stopped")
+
+// StoreIngested writes enriched events sent by external producers at once,
+// bypassing the writer queue so the producer learns the outcome, and
+// passes the events stored on to live subscribers and sinks. Stores able to
+// skip events already stored (by content hash) do so, letting producers
+// retry a batch.
+func (sm *SessionManager) StoreIngested(events []database.NetworkEvent) (stored []database.NetworkEvent, duplicates int, err error) {
+	sm.ingestMux.RLock()
+	defer sm.ingestMux.RUnlock()
+	if sm.stopped {
+		return nil, 0, ErrStopped
+	}
+	if sm.store == nil || len(events) == 0 {
+		return nil, 0, nil
+	}
+	if store, ok := sm.store.(database.UniqueStore); ok {
+		if _, duplicates, err = store.InsertUnique(events); err != nil {
+			return nil, duplicates, err
+		}
+		for _, e := range events {
+			if e.ID != 0 {
+				stored = append(stored, e)
+			}
+		}
 	} else {
-		sm.logger.Debug("Flushed event batch", "count", len(events))
-		// Publish events to WebSocket subscribers
-		for i := range events {
-			database.PublishEvent(&events[i])
+		if err := sm.store.InsertBatch(events); err != nil {
+			return nil, 0, err
 		}
+		stored = events
 	}
+	if len(stored) > 0 {
+		sm.eventsWritten.Add(uint64(len(stored)))
+		database.PublishEvents(stored)
+		sm.writeSinks(stored)
+	}
+	return stored, duplicates, nil
+}
+
+// queueStatus reports how many events, handshakes and sessions are held in memory
+func (sm *SessionManager) queueStatus() QueueStatus {
+	q := QueueStatus{
+		WriteQueue:     len(sm.writer.queue),
+		WriteQueueCap:  cap(sm.writer.queue),
+		WriteQueuePeak: int(sm.writer.peak.Load()),
+		WriteDropped:   sm.writer.dropped.Load(),
+	}
+	sm.pendingTLSMux.Lock()
+	q.PendingTLS = len(sm.pendingTLS)
+	sm.pendingTLSMux.Unlock()
+	q.Sessions = sm.sessionCount()
+	sm.dnsCacheMutex.RLock()
+	q.DNSCache = len(sm.dnsCache)
+	sm.dnsCacheMutex.RUnlock()
+
+	for _, s := range sm.sinks {
+		if st, ok := s.(interface{ QueueDepth() int }); ok {
+			if q.Sinks == nil {
+				q.Sinks = make(map[string]int)
+			}
+			q.Sinks[s.Name()] = st.QueueDepth()
+		}
+	}
+	return q
 }
 
 // TrackTCP handles TCP connection state machine
-func (sm *SessionManager) TrackTCP(iface, src, dst string, isSyn, isFin, isRst bool, length int, isIPv6 bool) {
-	if !sm.shouldLog("tcp") {
+func (sm *SessionManager) TrackTCP(iface string, encap Encap, src, dst netip.AddrPort, isSyn, isFin, isRst bool, payload []byte, length int, isIPv6 bool, ref CaptureRef) {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("tcp") {
 		return
 	}
 
@@ -315,78 +716,123 @@ func (sm *SessionManager) TrackTCP(iface, src, dst string, isSyn, isFin, isRst b
 	}
 
 	// Check metadata service exclusion
-	if sm.exclusions["metadata"] {
-		if isMetadataAddress(src) || isMetadataAddress(dst) {
+	if f.exclusions["metadata"] {
+		if src.Addr() == metadataAddr || dst.Addr() == metadataAddr {
 			return
 		}
 	}
 
-	// Generate a consistent key for this connection
-	key := fmt.Sprintf("TCP:%s->%s", src, dst)
+	key := sessionKey{proto: ProtoTCP, src: src, dst: dst}
+	shard := sm.shard(src, dst)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
+	session, exists := shard.sessions[key]
+	// Packets from the server belong to the session of the client's SYN
+	reply := false
+	if !exists && !isSyn {
+		if session, exists = shard.sessions[key.reverse()]; exists {
+			reply = true
+		}
+	}
 
-	session, exists := sm.sessions[key]
+	// Classify BitTorrent by the ports of the SYN, then by the payload until
+	// recognised; excluded connections are forgotten without an END event
+	var p2p string
+	if (isSyn && !exists) || (exists && session.P2P == "" && len(payload) > 0) {
+		p2p = classifyP2P(false, src.Port(), dst.Port(), payload)
+	}
+	if p2p != "" && sm.excludesP2P(f) {
+		if exists {
+			sm.removeSession(session)
+		}
+		return
+	}
+	if exists && p2p != "" {
+		session.P2P = p2p
+	}
 
 	// CASE A: New Connection (SYN without ACK)
 	if isSyn && !exists {
 		// Look up hostname from DNS cache
-		dstIP := extractIPFromAddr(dst)
+		srcIP, dstIP := src.Addr().String(), dst.Addr().String()
 		hostname, dnsAge := sm.lookupDNSCache(dstIP)
 
-		sm.sessions[key] = &Session{
-			ID:        key,
+		session = &Session{
+			key:       key,
+			FlowID:    newFlowID(),
 			Protocol:  ProtoTCP,
-			Src:       src,
-			Dst:       dst,
+			Src:       formatAddr(src),
+			Dst:       formatAddr(dst),
 			Iface:     iface,
+			VLAN:      encap.VLANTags,
+			Tunnel:    encap.Tunnel,
 			IPVersion: ipVersion,
 			Hostname:  hostname,
-			StartTime: time.Now(),
-			LastSeen:  time.Now(),
+			P2P:       p2p,
+			StartTime: sm.now(),
+			LastSeen:  sm.now(),
 			ByteCount: int64(length),
+			SrcBytes:  int64(length),
 		}
-
-		srcIP, srcPortNum := parseAddr(src)
-		dstIPParsed, dstPortNum := parseAddr(dst)
+		sm.addSession(shard, session)
 
 		// Log and save to DB
 		if hostname != "" {
 			sm.logger.Info("[TCP START]",
 				"iface", iface,
-				"src", src,
-				"dst", dst,
-				"hostname", hostname,
+				"src", session.Src,
+				"dst", session.Dst,
+				"hostname", sm.logName("hostname", hostname),
 				"dns_age", dnsAge.Round(time.Millisecond),
 			)
 			sm.queueEvent(database.NetworkEvent{
-				Timestamp: time.Now(),
-				EventType: database.EventTCPStart,
-				Interface: iface,
-				IPVersion: ipVersion,
-				SrcIP:     srcIP,
-				SrcPort:   srcPortNum,
-				DstIP:     dstIPParsed,
-				DstPort:   dstPortNum,
-				Hostname:  hostname,
-				DNSAge:    dnsAge.Milliseconds(),
+				Timestamp:    sm.now(),
+				EventType:    database.EventTCPStart,
+				CaptureFile:  ref.File,
+				CaptureFrame: ref.Frame,
+				FlowID:       session.FlowID,
+				Interface:    iface,
+				VLAN:         encap.Outer,
+				InnerVLAN:    encap.Inner,
+				Tunnel:       encap.Tunnel.Kind,
+				TunnelID:     encap.Tunnel.ID,
+				TunnelSrcIP:  encap.Tunnel.Src,
+				TunnelDstIP:  encap.Tunnel.Dst,
+				IPVersion:    ipVersion,
+				SrcIP:        srcIP,
+				SrcPort:      src.Port(),
+				DstIP:        dstIP,
+				DstPort:      dst.Port(),
+				Hostname:     hostname,
+				DNSAge:       dnsAge.Milliseconds(),
+				P2P:          p2p,
 			})
 		} else {
 			sm.logger.Info("[TCP START]",
 				"iface", iface,
-				"src", src,
-				"dst", dst,
+				"src", session.Src,
+				"dst", session.Dst,
 			)
 			sm.queueEvent(database.NetworkEvent{
-				Timestamp: time.Now(),
-				EventType: database.EventTCPStart,
-				Interface: iface,
-				IPVersion: ipVersion,
-				SrcIP:     srcIP,
-				SrcPort:   srcPortNum,
-				DstIP:     dstIPParsed,
-				DstPort:   dstPortNum,
+				Timestamp:    sm.now(),
+				EventType:    database.EventTCPStart,
+				CaptureFile:  ref.File,
+				CaptureFrame: ref.Frame,
+				FlowID:       session.FlowID,
+				Interface:    iface,
+				VLAN:         encap.Outer,
+				InnerVLAN:    encap.Inner,
+				Tunnel:       encap.Tunnel.Kind,
+				TunnelID:     encap.Tunnel.ID,
+				TunnelSrcIP:  encap.Tunnel.Src,
+				TunnelDstIP:  encap.Tunnel.Dst,
+				IPVersion:    ipVersion,
+				SrcIP:        srcIP,
+				SrcPort:      src.Port(),
+				DstIP:        dstIP,
+				DstPort:      dst.Port(),
+				P2P:          p2p,
 			})
 		}
 		return
@@ -394,54 +840,75 @@ func (sm *SessionManager) TrackTCP(iface, src, dst string, isSyn, isFin, isRst b
 
 	// CASE B: Existing Connection (Update)
 	if exists {
-		session.LastSeen = time.Now()
+		sm.touchSession(session)
 		session.ByteCount += int64(length)
+		if reply {
+			session.DstBytes += int64(length)
+		} else {
+			session.SrcBytes += int64(length)
+		}
+		inspectFileShare(session, true, payload)
 
 		// CASE C: End of Connection (FIN or RST)
 		if isFin || isRst {
-			duration := time.Since(session.StartTime)
+			duration := sm.now().Sub(session.StartTime)
 			endReason := "FIN"
 			if isRst {
 				endReason = "RST"
 			}
 			sm.logger.Info("[TCP END]",
 				"iface", session.Iface,
-				"src", src,
-				"dst", dst,
+				"src", session.Src,
+				"dst", session.Dst,
 				"duration", duration.Round(time.Millisecond),
 				"bytes", session.ByteCount,
 				"reason", endReason,
 			)
 
-			srcIP, srcPortNum := parseAddr(src)
-			dstIP, dstPortNum := parseAddr(dst)
+			srcIP, srcPortNum := session.key.src.Addr().String(), session.key.src.Port()
+			dstIP, dstPortNum := session.key.dst.Addr().String(), session.key.dst.Port()
 			sm.queueEvent(database.NetworkEvent{
-				Timestamp: time.Now(),
-				EventType: database.EventTCPEnd,
-				Interface: session.Iface,
-				IPVersion: session.IPVersion,
-				SrcIP:     srcIP,
-				SrcPort:   srcPortNum,
-				DstIP:     dstIP,
-				DstPort:   dstPortNum,
-				Hostname:  session.Hostname,
-				Duration:  duration.Milliseconds(),
-				ByteCount: session.ByteCount,
-				Reason:    endReason,
+				Timestamp:    sm.now(),
+				EventType:    database.EventTCPEnd,
+				CaptureFile:  ref.File,
+				CaptureFrame: ref.Frame,
+				FlowID:       session.FlowID,
+				Interface:    session.Iface,
+				VLAN:         session.VLAN.Outer,
+				InnerVLAN:    session.VLAN.Inner,
+				Tunnel:       session.Tunnel.Kind,
+				TunnelID:     session.Tunnel.ID,
+				TunnelSrcIP:  session.Tunnel.Src,
+				TunnelDstIP:  session.Tunnel.Dst,
+				IPVersion:    session.IPVersion,
+				SrcIP:        srcIP,
+				SrcPort:      srcPortNum,
+				DstIP:        dstIP,
+				DstPort:      dstPortNum,
+				Hostname:     session.Hostname,
+				P2P:          session.P2P,
+				Duration:     duration.Milliseconds(),
+				ByteCount:    session.ByteCount,
+				SrcBytes:     session.SrcBytes,
+				DstBytes:     session.DstBytes,
+				Reason:       endReason,
 			})
-			delete(sm.sessions, key)
+			sm.queueFileShare(session, endReason)
+			sm.removeSession(session)
 		}
 	}
 }
 
 // TrackUDP handles UDP "connections" using timeout-based tracking
-func (sm *SessionManager) TrackUDP(iface, src, dst string, srcPort, dstPort uint16, length int, isIPv6 bool) {
-	if !sm.shouldLog("udp") {
+func (sm *SessionManager) TrackUDP(iface string, encap Encap, src, dst netip.AddrPort, payload []byte, length int, isIPv6 bool, ref CaptureRef) {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("udp") {
 		return
 	}
+	srcPort, dstPort := src.Port(), dst.Port()
 
 	// Check exclusions
-	if sm.shouldExclude(src, dst, srcPort, dstPort) {
+	if f.shouldExclude(src.Addr(), dst.Addr(), srcPort, dstPort) {
 		return
 	}
 
@@ -450,112 +917,257 @@ func (sm *SessionManager) TrackUDP(iface, src, dst string, srcPort, dstPort uint
 		ipVersion = 6
 	}
 
-	// For UDP, we create bi-directional session keys
-	key := fmt.Sprintf("UDP:%s<->%s", src, dst)
-	reverseKey := fmt.Sprintf("UDP:%s<->%s", dst, src)
+	// BitTorrent is classified on every packet until recognised
+	p2p := classifyP2P(true, srcPort, dstPort, payload)
 
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
+	key := sessionKey{proto: ProtoUDP, src: src, dst: dst}
+	shard := sm.shard(src, dst)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
 	// Check if session exists in either direction
-	session, exists := sm.sessions[key]
+	session, exists := shard.sessions[key]
 	if !exists {
-		session, exists = sm.sessions[reverseKey]
+		session, exists = shard.sessions[key.reverse()]
+	}
+	if p2p != "" && sm.excludesP2P(f) {
 		if exists {
-			key = reverseKey
+			sm.removeSession(session)
 		}
+		return
 	}
 
 	if !exists {
 		// Identify service based on port
 		service := identifyUDPService(srcPort, dstPort)
+		srcIP, dstIP := src.Addr().String(), dst.Addr().String()
+		hostname, _ := sm.lookupDNSCache(dstIP)
 
 		// New UDP "connection"
-		sm.sessions[key] = &Session{
-			ID:        key,
+		session = &Session{
+			key:       key,
+			FlowID:    newFlowID(),
 			Protocol:  ProtoUDP,
-			Src:       src,
-			Dst:       dst,
+			Src:       formatAddr(src),
+			Dst:       formatAddr(dst),
 			Iface:     iface,
+			VLAN:      encap.VLANTags,
+			Tunnel:    encap.Tunnel,
 			IPVersion: ipVersion,
-			StartTime: time.Now(),
-			LastSeen:  time.Now(),
+			Hostname:  hostname,
+			P2P:       p2p,
+			StartTime: sm.now(),
+			LastSeen:  sm.now(),
 			ByteCount: int64(length),
+			SrcBytes:  int64(length),
 		}
-
-		srcIP, srcPortNum := parseAddr(src)
-		dstIP, dstPortNum := parseAddr(dst)
+		sm.addSession(shard, session)
 
 		if service != "" {
 			sm.logger.Info("[UDP START]",
 				"iface", iface,
-				"src", src,
-				"dst", dst,
+				"src", session.Src,
+				"dst", session.Dst,
 				"service", service,
 			)
 		} else {
 			sm.logger.Info("[UDP START]",
 				"iface", iface,
-				"src", src,
-				"dst", dst,
+				"src", session.Src,
+				"dst", session.Dst,
 			)
 		}
 
 		sm.queueEvent(database.NetworkEvent{
-			Timestamp: time.Now(),
-			EventType: database.EventUDPStart,
-			Interface: iface,
-			IPVersion: ipVersion,
-			SrcIP:     srcIP,
-			SrcPort:   srcPortNum,
-			DstIP:     dstIP,
-			DstPort:   dstPortNum,
-			Protocol:  service,
+			Timestamp:    sm.now(),
+			EventType:    database.EventUDPStart,
+			CaptureFile:  ref.File,
+			CaptureFrame: ref.Frame,
+			FlowID:       session.FlowID,
+			Interface:    iface,
+			VLAN:         encap.Outer,
+			InnerVLAN:    encap.Inner,
+			Tunnel:       encap.Tunnel.Kind,
+			TunnelID:     encap.Tunnel.ID,
+			TunnelSrcIP:  encap.Tunnel.Src,
+			TunnelDstIP:  encap.Tunnel.Dst,
+			IPVersion:    ipVersion,
+			SrcIP:        srcIP,
+			SrcPort:      srcPort,
+			DstIP:        dstIP,
+			DstPort:      dstPort,
+			Hostname:     hostname,
+			Protocol:     service,
+			P2P:          p2p,
 		})
 	} else {
 		// Update existing session
-		session.LastSeen = time.Now()
+		sm.touchSession(session)
+		session.ByteCount += int64(length)
+		if src == session.key.src {
+			session.SrcBytes += int64(length)
+		} else {
+			session.DstBytes += int64(length)
+		}
+		if session.P2P == "" {
+			session.P2P = p2p
+		}
+	}
+	inspectFileShare(session, false, payload)
+}
+
+// TrackVPN tracks WireGuard, IPsec and OpenVPN tunnels between two
+// endpoints: a VPN event when a tunnel is first seen and one with its
+// duration and byte counts once it goes idle. It returns false when VPN
+// events are filtered out, so the packet is tracked as plain UDP instead.
+func (sm *SessionManager) TrackVPN(iface string, encap Encap, src, dst netip.AddrPort, vpn string, length int, isIPv6 bool, ref CaptureRef) bool {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("vpn") {
+		return false
+	}
+	if f.shouldExclude(src.Addr(), dst.Addr(), src.Port(), dst.Port()) {
+		return true
+	}
+
+	ipVersion := uint8(4)
+	if isIPv6 {
+		ipVersion = 6
+	}
+
+	key := sessionKey{proto: ProtoVPN, vpn: vpn, src: src, dst: dst}
+	shard := sm.shard(src, dst)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	session, exists := shard.sessions[key]
+	if !exists {
+		session, exists = shard.sessions[key.reverse()]
+	}
+	if exists {
+		sm.touchSession(session)
 		session.ByteCount += int64(length)
+		if src == session.key.src {
+			session.SrcBytes += int64(length)
+		} else {
+			session.DstBytes += int64(length)
+		}
+		return true
+	}
+
+	srcIP, dstIP := src.Addr().String(), dst.Addr().String()
+	srcAddr, dstAddr := formatAddr(src), formatAddr(dst)
+	if src.Port() == 0 && dst.Port() == 0 {
+		// IPsec has no ports; it is tracked between the two hosts
+		srcAddr, dstAddr = srcIP, dstIP
+	}
+	hostname, _ := sm.lookupDNSCache(dstIP)
+	session = &Session{
+		key:       key,
+		FlowID:    newFlowID(),
+		Protocol:  ProtoVPN,
+		Src:       srcAddr,
+		Dst:       dstAddr,
+		Iface:     iface,
+		VLAN:      encap.VLANTags,
+		Tunnel:    encap.Tunnel,
+		IPVersion: ipVersion,
+		Hostname:  hostname,
+		StartTime: sm.now(),
+		LastSeen:  sm.now(),
+		ByteCount: int64(length),
+		SrcBytes:  int64(length),
+		VPN:       vpn,
 	}
+	sm.addSession(shard, session)
+
+	sm.logger.Info("[VPN]",
+		"vpn", vpn,
+		"iface", iface,
+		"src", session.Src,
+		"dst", session.Dst,
+	)
+	sm.queueEvent(database.NetworkEvent{
+		Timestamp:    sm.now(),
+		EventType:    database.EventVPN,
+		CaptureFile:  ref.File,
+		CaptureFrame: ref.Frame,
+		FlowID:       session.FlowID,
+		Interface:    iface,
+		VLAN:         encap.Outer,
+		InnerVLAN:    encap.Inner,
+		Tunnel:       encap.Tunnel.Kind,
+		TunnelID:     encap.Tunnel.ID,
+		TunnelSrcIP:  encap.Tunnel.Src,
+		TunnelDstIP:  encap.Tunnel.Dst,
+		IPVersion:    ipVersion,
+		SrcIP:        srcIP,
+		SrcPort:      src.Port(),
+		DstIP:        dstIP,
+		DstPort:      dst.Port(),
+		Protocol:     vpn,
+		Hostname:     hostname,
+		ByteCount:    int64(length),
+	})
+	return true
 }
+
 // TrackICMP handles ICMP packets
-// icmpPayload contains the original packet header for destination unreachable messages
-func (sm *SessionManager) TrackICMP(iface, src, dst string, icmpType, icmpCode uint8, length int, isIPv6 bool, icmpPayload []byte) {
-	if !sm.shouldLog("icmp") {
+// icmpPayload contains the original packet header for error messages, which
+// ties the error to the flow that caused it
+func (sm *SessionManager) TrackICMP(iface string, encap Encap, src, dst netip.Addr, icmpType, icmpCode uint8, length int, isIPv6 bool, icmpPayload []byte, ref CaptureRef) {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("icmp") {
 		return
 	}
 
 	// Check NDP exclusion (ICMPv6 types 133-137 are NDP)
-	if sm.exclusions["ndp"] && isIPv6 {
+	if f.exclusions["ndp"] && isIPv6 {
 		if icmpType >= 133 && icmpType <= 137 {
 			return
 		}
 	}
 
 	// Check destination unreachable exclusion
-	if sm.exclusions["unreachable"] {
+	if f.exclusions["unreachable"] {
 		if (!isIPv6 && icmpType == 3) || (isIPv6 && icmpType == 1) {
 			return
 		}
 	}
 
+	var quoted *quotedFlow
+	if isICMPError(icmpType, isIPv6) {
+		quoted, _ = parseQuotedFlow(icmpPayload, isIPv6)
+	}
+
 	// For ICMP destination unreachable, check if the original packet's port is excluded
 	// ICMPv4 type 3 code 3 = Port Unreachable, ICMPv6 type 1 code 4 = Port Unreachable
-	if len(sm.excludePorts) > 0 {
+	if len(f.excludePorts) > 0 && quoted != nil {
 		if (!isIPv6 && icmpType == 3 && icmpCode == 3) || (isIPv6 && icmpType == 1 && icmpCode == 4) {
-			port := extractPortFromICMPPayload(icmpPayload, isIPv6)
-			if port > 0 && sm.excludePorts[port] {
+			if quoted.DstPort > 0 && f.excludePorts[quoted.DstPort] {
 				return
 			}
 		}
 	}
 
-	key := fmt.Sprintf("ICMP:%s->%s", src, dst)
+	// Errors about different flows are separate events, so every probe of a
+	// traceroute and every rejected connection is recorded
+	key := sessionKey{proto: ProtoICMP, src: netip.AddrPortFrom(src, 0), dst: netip.AddrPortFrom(dst, 0)}
+	if quoted != nil {
+		key.about = quoted.String()
+	}
+
+	// The connection an error is about is looked up first, as its
+	// session may be in another shard
+	var flow Session
+	if quoted != nil {
+		flow = sm.quotedSession(quoted)
+	}
 
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
+	shard := sm.shard(key.src, key.dst)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	session, exists := sm.sessions[key]
+	session, exists := shard.sessions[key]
 
 	ipVersion := uint8(4)
 	if isIPv6 {
@@ -563,51 +1175,84 @@ func (sm *SessionManager) TrackICMP(iface, src, dst string, icmpType, icmpCode u
 	}
 
 	if !exists {
-		sm.sessions[key] = &Session{
-			ID:        key,
+		srcIP, dstIP := src.String(), dst.String()
+		sm.addSession(shard, &Session{
+			key:       key,
 			Protocol:  ProtoICMP,
-			Src:       src,
-			Dst:       dst,
+			Src:       srcIP,
+			Dst:       dstIP,
 			Iface:     iface,
+			VLAN:      encap.VLANTags,
+			Tunnel:    encap.Tunnel,
 			IPVersion: ipVersion,
-			StartTime: time.Now(),
-			LastSeen:  time.Now(),
+			StartTime: sm.now(),
+			LastSeen:  sm.now(),
 			ByteCount: int64(length),
-		}
+			SrcBytes:  int64(length),
+		})
 
 		desc := icmpTypeDescription(icmpType, isIPv6)
-		sm.logger.Info("[ICMP]",
+		event := database.NetworkEvent{
+			Timestamp:    sm.now(),
+			EventType:    database.EventICMP,
+			CaptureFile:  ref.File,
+			CaptureFrame: ref.Frame,
+			Interface:    iface,
+			VLAN:         encap.Outer,
+			InnerVLAN:    encap.Inner,
+			Tunnel:       encap.Tunnel.Kind,
+			TunnelID:     encap.Tunnel.ID,
+			TunnelSrcIP:  encap.Tunnel.Src,
+			TunnelDstIP:  encap.Tunnel.Dst,
+			IPVersion:    ipVersion,
+			SrcIP:        srcIP,
+			DstIP:        dstIP,
+			ICMPType:     icmpType,
+			ICMPCode:     icmpCode,
+			ICMPDesc:     desc,
+		}
+		if quoted != nil {
+			event.ICMPOrigProto = quoted.Proto
+			event.ICMPOrigSrcIP, event.ICMPOrigSrcPort = quoted.SrcIP, quoted.SrcPort
+			event.ICMPOrigDstIP, event.ICMPOrigDstPort = quoted.DstIP, quoted.DstPort
+			// Share the flow ID of the connection the error is about
+			event.FlowID = flow.FlowID
+			event.Hostname = flow.Hostname
+		}
+		fields := []interface{}{
 			"iface", iface,
-			"src", src,
-			"dst", dst,
+			"src", srcIP,
+			"dst", dstIP,
 			"type", icmpType,
 			"code", icmpCode,
 			"desc", desc,
-		)
+		}
+		if quoted != nil {
+			fields = append(fields, "about", quoted.String())
+		}
+		sm.logger.Info("[ICMP]", fields...)
 
-		sm.queueEvent(database.NetworkEvent{
-			Timestamp: time.Now(),
-			EventType: database.EventICMP,
-			Interface: iface,
-			IPVersion: ipVersion,
-			SrcIP:     src,
-			DstIP:     dst,
-			ICMPType:  icmpType,
-			ICMPCode:  icmpCode,
-			ICMPDesc:  desc,
-		})
+		sm.queueEvent(event)
 	} else {
-		session.LastSeen = time.Now()
+		sm.touchSession(session)
 		session.ByteCount += int64(length)
+		session.SrcBytes += int64(length)
 	}
 }
 
 // TrackDNS logs DNS queries and caches resolved IPs
-func (sm *SessionManager) TrackDNS(iface, src, dst string, queries []string, isResponse bool, resolvedIPs []string, cnames []string, isIPv6 bool) {
-	if !sm.shouldLog("dns") {
+func (sm *SessionManager) TrackDNS(iface string, encap Encap, srcAddr, dstAddr netip.AddrPort, msg *DNSMessage, isIPv6 bool, ref CaptureRef) {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("dns") {
 		return
 	}
 
+	queries, resolvedIPs, cnames, isResponse := msg.Queries, msg.ResolvedIPs, msg.CNAMEs, msg.IsResponse
+	rcode := ""
+	if isResponse {
+		rcode = msg.RCodeName()
+	}
+
 	ipVersion := uint8(4)
 	if isIPv6 {
 		ipVersion = 6
@@ -624,15 +1269,16 @@ func (sm *SessionManager) TrackDNS(iface, src, dst string, queries []string, isR
 			for _, ip := range resolvedIPs {
 				sm.dnsCache[ip] = &DNSCacheEntry{
 					Hostname:  hostname,
-					Timestamp: time.Now(),
+					Timestamp: sm.now(),
 				}
 			}
 			sm.dnsCacheMutex.Unlock()
 		}
 	}
 
-	srcIP, srcPort := parseAddr(src)
-	dstIP, dstPort := parseAddr(dst)
+	src, dst := formatAddr(srcAddr), formatAddr(dstAddr)
+	srcIP, srcPort := srcAddr.Addr().String(), srcAddr.Port()
+	dstIP, dstPort := dstAddr.Addr().String(), dstAddr.Port()
 
 	for _, q := range queries {
 		answersStr := ""
@@ -641,13 +1287,17 @@ func (sm *SessionManager) TrackDNS(iface, src, dst string, queries []string, isR
 			answersStr = strings.Join(resolvedIPs, ",")
 			if len(cnames) > 0 {
 				cnamesStr = strings.Join(cnames, ",")
+				logCNAMEs := make([]string, len(cnames))
+				for i, name := range cnames {
+					logCNAMEs[i] = sm.logName("dns", name)
+				}
 				sm.logger.Info("[DNS]",
 					"iface", iface,
 					"type", queryType,
 					"src", src,
 					"dst", dst,
-					"domain", q,
-					"cnames", cnames,
+					"domain", sm.logName("dns", q),
+					"cnames", logCNAMEs,
 					"answers", resolvedIPs,
 				)
 			} else {
@@ -656,73 +1306,396 @@ func (sm *SessionManager) TrackDNS(iface, src, dst string, queries []string, isR
 					"type", queryType,
 					"src", src,
 					"dst", dst,
-					"domain", q,
+					"domain", sm.logName("dns", q),
 					"answers", resolvedIPs,
 				)
 			}
+		} else if isResponse && msg.RCode != 0 {
+			sm.logger.Info("[DNS]",
+				"iface", iface,
+				"type", queryType,
+				"src", src,
+				"dst", dst,
+				"domain", sm.logName("dns", q),
+				"rcode", rcode,
+			)
 		} else {
 			sm.logger.Info("[DNS]",
 				"iface", iface,
 				"type", queryType,
 				"src", src,
 				"dst", dst,
-				"domain", q,
+				"domain", sm.logName("dns", q),
 			)
 		}
 
 		sm.queueEvent(database.NetworkEvent{
-			Timestamp:  time.Now(),
-			EventType:  database.EventDNS,
-			Interface:  iface,
-			IPVersion:  ipVersion,
-			SrcIP:      srcIP,
-			SrcPort:    srcPort,
-			DstIP:      dstIP,
-			DstPort:    dstPort,
-			DNSQuery:   q,
-			DNSType:    queryType,
-			DNSAnswers: answersStr,
-			DNSCNAMEs:  cnamesStr,
+			Timestamp:      sm.now(),
+			EventType:      database.EventDNS,
+			CaptureFile:    ref.File,
+			CaptureFrame:   ref.Frame,
+			Interface:      iface,
+			VLAN:           encap.Outer,
+			InnerVLAN:      encap.Inner,
+			Tunnel:         encap.Tunnel.Kind,
+			TunnelID:       encap.Tunnel.ID,
+			TunnelSrcIP:    encap.Tunnel.Src,
+			TunnelDstIP:    encap.Tunnel.Dst,
+			IPVersion:      ipVersion,
+			SrcIP:          srcIP,
+			SrcPort:        srcPort,
+			DstIP:          dstIP,
+			DstPort:        dstPort,
+			DNSQuery:       q,
+			DNSType:        queryType,
+			DNSID:          msg.ID,
+			DNSAnswers:     answersStr,
+			DNSCNAMEs:      cnamesStr,
+			DNSRCode:       rcode,
+			DNSAnswerCount: msg.AnswerCount,
+			DNSTTL:         msg.MinTTL,
 		})
 	}
 }
 
-// TrackTLSHandshake logs TLS SNI (Server Name Indication)
-func (sm *SessionManager) TrackTLSHandshake(iface, src, dst, sni string, isIPv6 bool) {
-	if !sm.shouldLog("tls") {
+// TrackTLSHandshake logs TLS SNI (Server Name Indication) and the JA3/JA4
+// fingerprints of the client
+func (sm *SessionManager) TrackTLSHandshake(iface string, encap Encap, srcAddr, dstAddr netip.AddrPort, hello *ClientHello, isIPv6 bool, ref CaptureRef) {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("tls") {
 		return
 	}
+	src, dst := formatAddr(srcAddr), formatAddr(dstAddr)
 
 	ipVersion := uint8(4)
 	if isIPv6 {
 		ipVersion = 6
 	}
 
+	_, ja3 := hello.JA3()
+	ja4 := hello.JA4()
+
 	sm.logger.Info("[TLS SNI]",
 		"iface", iface,
 		"src", src,
 		"dst", dst,
-		"server_name", sni,
+		"server_name", sm.logName("sni", hello.SNI),
+		"ja4", ja4,
+		"ech", hello.ECH,
 	)
 
-	srcIP, srcPort := parseAddr(src)
-	dstIP, dstPort := parseAddr(dst)
+	srcIP, srcPort := srcAddr.Addr().String(), srcAddr.Port()
+	dstIP, dstPort := dstAddr.Addr().String(), dstAddr.Port()
+
+	var flowID string
+	shard := sm.shard(srcAddr, dstAddr)
+	shard.mutex.Lock()
+	if session, ok := shard.sessions[sessionKey{proto: ProtoTCP, src: srcAddr, dst: dstAddr}]; ok {
+		flowID = session.FlowID
+	}
+	shard.mutex.Unlock()
+
+	now := sm.now()
+	sm.pendingTLSMux.Lock()
+	sm.pendingTLS[src+"->"+dst] = &pendingHandshake{
+		event: database.NetworkEvent{
+			Timestamp:    now,
+			EventType:    database.EventTLSSNI,
+			CaptureFile:  ref.File,
+			CaptureFrame: ref.Frame,
+			FlowID:       flowID,
+			Interface:    iface,
+			VLAN:         encap.Outer,
+			InnerVLAN:    encap.Inner,
+			Tunnel:       encap.Tunnel.Kind,
+			TunnelID:     encap.Tunnel.ID,
+			TunnelSrcIP:  encap.Tunnel.Src,
+			TunnelDstIP:  encap.Tunnel.Dst,
+			IPVersion:    ipVersion,
+			SrcIP:        srcIP,
+			SrcPort:      srcPort,
+			DstIP:        dstIP,
+			DstPort:      dstPort,
+			TLSSNI:       hello.SNI,
+			TLSJA3:       ja3,
+			TLSJA4:       ja4,
+			TLSALPN:      strings.Join(hello.ALPN, ","),
+			TLSECH:       hello.ECH,
+		},
+		seen: now,
+	}
+	sm.pendingTLSMux.Unlock()
+}
+
+// TrackTLSServerHello completes a pending handshake with the negotiated
+// version, cipher suite and ALPN and writes its TLS_SNI event.
+// src and dst are as seen on the ServerHello (server -> client).
+func (sm *SessionManager) TrackTLSServerHello(srcAddr, dstAddr netip.AddrPort, hello *ServerHello) {
+	src, dst := formatAddr(srcAddr), formatAddr(dstAddr)
+	key := dst + "->" + src
+	sm.pendingTLSMux.Lock()
+	pending, ok := sm.pendingTLS[key]
+	if ok {
+		delete(sm.pendingTLS, key)
+	}
+	sm.pendingTLSMux.Unlock()
+	if !ok {
+		return
+	}
+
+	event := pending.event
+	event.TLSVersion = TLSVersionName(hello.Version)
+	event.TLSCipher = TLSCipherName(hello.CipherSuite)
+	// TLS 1.3 sends the chosen ALPN encrypted; keep the offered list then
+	if hello.ALPN != "" {
+		event.TLSALPN = hello.ALPN
+	}
+
+	if hello.Version < 0x0303 {
+		sm.logger.Warn("[TLS LEGACY]",
+			"iface", event.Interface,
+			"client", dst,
+			"server", src,
+			"server_name", sm.logName("sni", event.TLSSNI),
+			"version", event.TLSVersion,
+			"cipher", event.TLSCipher,
+		)
+	}
+
+	sm.queueEvent(event)
+}
+
+// flushPendingTLS writes handshakes first seen before the cutoff whose
+// ServerHello never arrived (lost packet, mid-stream capture start)
+func (sm *SessionManager) flushPendingTLS(cutoff time.Time) {
+	var expired []database.NetworkEvent
+	sm.pendingTLSMux.Lock()
+	for key, pending := range sm.pendingTLS {
+		if !pending.seen.After(cutoff) {
+			expired = append(expired, pending.event)
+			delete(sm.pendingTLS, key)
+		}
+	}
+	sm.pendingTLSMux.Unlock()
+
+	for _, event := range expired {
+		sm.queueEvent(event)
+	}
+}
+
+// TrackSSHBanner records the identification string of either side of an SSH
+// connection; its REMOTE_ACCESS event is written once both sides are known
+func (sm *SessionManager) TrackSSHBanner(iface string, encap Encap, src, dst netip.AddrPort, banner *SSHBanner, isIPv6 bool, ref CaptureRef) {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("remote") {
+		return
+	}
+	client, server, flowID := sm.clientServer(src, dst)
+	key := formatAddr(client) + "->" + formatAddr(server)
 
+	sm.pendingRemoteMux.Lock()
+	pending, ok := sm.pendingRemote[key]
+	if !ok || pending.event.Protocol != "SSH" {
+		pending = &pendingHandshake{
+			event: sm.remoteEvent(iface, encap, client, server, flowID, "SSH", isIPv6, ref),
+			seen:  sm.now(),
+		}
+		sm.pendingRemote[key] = pending
+	}
+	event := &pending.event
+	if src == client {
+		event.RemoteClient = banner.String()
+	} else {
+		event.RemoteServer = banner.String()
+	}
+	event.RemoteVersion = negotiatedSSHVersion(sshVersion(event.RemoteClient), sshVersion(event.RemoteServer))
+	done := event.RemoteClient != "" && event.RemoteServer != ""
+	if done {
+		delete(sm.pendingRemote, key)
+	}
+	sm.pendingRemoteMux.Unlock()
+
+	if done {
+		sm.queueRemote(pending.event)
+	}
+}
+
+// TrackRDP records the X.224 negotiation opening an RDP connection: the
+// client's request waits for the server's confirm, which completes its
+// REMOTE_ACCESS event with the selected security protocol
+func (sm *SessionManager) TrackRDP(iface string, encap Encap, src, dst netip.AddrPort, neg *RDPNegotiation, isIPv6 bool, ref CaptureRef) {
+	f := sm.filtersFor(iface)
+	if !f.shouldLog("remote") {
+		return
+	}
+
+	if neg.Request {
+		_, _, flowID := sm.clientServer(src, dst)
+		event := sm.remoteEvent(iface, encap, src, dst, flowID, "RDP", isIPv6, ref)
+		event.RemoteClient = strings.Join(neg.Protocols, ",")
+		sm.pendingRemoteMux.Lock()
+		sm.pendingRemote[formatAddr(src)+"->"+formatAddr(dst)] = &pendingHandshake{event: event, seen: sm.now()}
+		sm.pendingRemoteMux.Unlock()
+		return
+	}
+
+	// A confirm answers the request of the client it is sent to
+	key := formatAddr(dst) + "->" + formatAddr(src)
+	sm.pendingRemoteMux.Lock()
+	pending, ok := sm.pendingRemote[key]
+	if ok && pending.event.Protocol == "RDP" {
+		delete(sm.pendingRemote, key)
+	}
+	sm.pendingRemoteMux.Unlock()
+	if !ok || pending.event.Protocol != "RDP" {
+		return
+	}
+
+	event := pending.event
+	if neg.Failure != "" {
+		event.Reason = neg.Failure
+	} else {
+		event.RemoteVersion = neg.Protocols[0]
+	}
+	sm.queueRemote(event)
+}
+
+// queueFileShare logs and writes the FILESHARE event of a closed flow
+// that carried SMB or NFS, with its byte counts
+func (sm *SessionManager) queueFileShare(session *Session, reason string) {
+	fs := session.FileShare
+	if fs == nil || !sm.filtersFor(session.Iface).shouldLog("fileshare") {
+		return
+	}
+	srcIP, srcPort := session.key.src.Addr().String(), session.key.src.Port()
+	dstIP, dstPort := session.key.dst.Addr().String(), session.key.dst.Port()
+	shares := strings.Join(fs.Shares, ",")
+	sm.logger.Info("[FILESHARE]",
+		"iface", session.Iface,
+		"protocol", fs.Protocol,
+		"client", session.Src,
+		"server", session.Dst,
+		"shares", shares,
+		"bytes", session.ByteCount,
+	)
 	sm.queueEvent(database.NetworkEvent{
-		Timestamp: time.Now(),
-		EventType: database.EventTLSSNI,
-		Interface: iface,
-		IPVersion: ipVersion,
-		SrcIP:     srcIP,
-		SrcPort:   srcPort,
-		DstIP:     dstIP,
-		DstPort:   dstPort,
-		TLSSNI:    sni,
+		Timestamp:    sm.now(),
+		EventType:    database.EventFileShare,
+		FlowID:       session.FlowID,
+		Interface:    session.Iface,
+		VLAN:         session.VLAN.Outer,
+		InnerVLAN:    session.VLAN.Inner,
+		Tunnel:       session.Tunnel.Kind,
+		TunnelID:     session.Tunnel.ID,
+		TunnelSrcIP:  session.Tunnel.Src,
+		TunnelDstIP:  session.Tunnel.Dst,
+		IPVersion:    session.IPVersion,
+		SrcIP:        srcIP,
+		SrcPort:      srcPort,
+		DstIP:        dstIP,
+		DstPort:      dstPort,
+		Protocol:     fs.Protocol,
+		Hostname:     session.Hostname,
+		ShareServer:  fs.Server,
+		Shares:       shares,
+		ShareVersion: fs.VersionInfo(),
+		EndTime:      session.LastSeen,
+		Duration:     session.LastSeen.Sub(session.StartTime).Milliseconds(),
+		ByteCount:    session.ByteCount,
+		SrcBytes:     session.SrcBytes,
+		DstBytes:     session.DstBytes,
+		Reason:       reason,
 	})
 }
 
+// clientServer orders the endpoints of a TCP packet as client and server
+// by the tracked connection, or failing that by taking the lower port as
+// the server's, and returns the connection's flow ID if it is tracked
+func (sm *SessionManager) clientServer(src, dst netip.AddrPort) (client, server netip.AddrPort, flowID string) {
+	key := sessionKey{proto: ProtoTCP, src: src, dst: dst}
+	shard := sm.shard(src, dst)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if session, ok := shard.sessions[key]; ok {
+		return src, dst, session.FlowID
+	}
+	if session, ok := shard.sessions[key.reverse()]; ok {
+		return dst, src, session.FlowID
+	}
+	if src.Port() < dst.Port() {
+		return dst, src, ""
+	}
+	return src, dst, ""
+}
+
+// remoteEvent starts the REMOTE_ACCESS event of a connection from client
+// to server using protocol
+func (sm *SessionManager) remoteEvent(iface string, encap Encap, client, server netip.AddrPort, flowID, protocol string, isIPv6 bool, ref CaptureRef) database.NetworkEvent {
+	ipVersion := uint8(4)
+	if isIPv6 {
+		ipVersion = 6
+	}
+	srcIP, srcPort := client.Addr().String(), client.Port()
+	dstIP, dstPort := server.Addr().String(), server.Port()
+	hostname, _ := sm.lookupDNSCache(dstIP)
+
+	return database.NetworkEvent{
+		Timestamp:    sm.now(),
+		EventType:    database.EventRemoteAccess,
+		CaptureFile:  ref.File,
+		CaptureFrame: ref.Frame,
+		FlowID:       flowID,
+		Interface:    iface,
+		VLAN:         encap.Outer,
+		InnerVLAN:    encap.Inner,
+		Tunnel:       encap.Tunnel.Kind,
+		TunnelID:     encap.Tunnel.ID,
+		TunnelSrcIP:  encap.Tunnel.Src,
+		TunnelDstIP:  encap.Tunnel.Dst,
+		IPVersion:    ipVersion,
+		SrcIP:        srcIP,
+		SrcPort:      srcPort,
+		DstIP:        dstIP,
+		DstPort:      dstPort,
+		Protocol:     protocol,
+		Hostname:     hostname,
+	}
+}
+
+// queueRemote logs and writes a REMOTE_ACCESS event
+func (sm *SessionManager) queueRemote(event database.NetworkEvent) {
+	sm.logger.Info("[REMOTE ACCESS]",
+		"iface", event.Interface,
+		"protocol", event.Protocol,
+		"client", eventAddr(event.SrcIP, event.SrcPort),
+		"server", eventAddr(event.DstIP, event.DstPort),
+		"version", event.RemoteVersion,
+		"hostname", sm.logName("hostname", event.Hostname),
+	)
+	sm.queueEvent(event)
+}
+
+// flushPendingRemote writes SSH and RDP handshakes first seen before the
+// cutoff whose other side never arrived
+func (sm *SessionManager) flushPendingRemote(cutoff time.Time) {
+	var expired []database.NetworkEvent
+	sm.pendingRemoteMux.Lock()
+	for key, pending := range sm.pendingRemote {
+		if !pending.seen.After(cutoff) {
+			expired = append(expired, pending.event)
+			delete(sm.pendingRemote, key)
+		}
+	}
+	sm.pendingRemoteMux.Unlock()
+
+	for _, event := range expired {
+		sm.queueRemote(event)
+	}
+}
+
 // cleanupLoop removes stale connections (the "Ghost" problem solution)
 func (sm *SessionManager) cleanupLoop() {
+	defer close(sm.cleanupDone)
 	ticker := time.NewTicker(sm.cleanupInterval)
 	defer ticker.Stop()
 
@@ -731,79 +1704,88 @@ func (sm *SessionManager) cleanupLoop() {
 		case <-sm.stopChan:
 			return
 		case <-ticker.C:
-			sm.mutex.Lock()
-			threshold := time.Now().Add(-sm.sessionTimeout)
-			for key, session := range sm.sessions {
-				if session.LastSeen.Before(threshold) {
-					duration := session.LastSeen.Sub(session.StartTime)
-					srcIP, srcPort := parseAddr(session.Src)
-					dstIP, dstPort := parseAddr(session.Dst)
-
-					// Log as UDP END for UDP sessions, TIMEOUT for others
-					if session.Protocol == ProtoUDP {
-						sm.logger.Info("[UDP END]",
-							"iface", session.Iface,
-							"src", session.Src,
-							"dst", session.Dst,
-							"duration", duration.Round(time.Millisecond),
-							"bytes", session.ByteCount,
-						)
-
-						sm.queueEvent(database.NetworkEvent{
-							Timestamp: time.Now(),
-							EventType: database.EventUDPEnd,
-							Interface: session.Iface,
-							IPVersion: session.IPVersion,
-							SrcIP:     srcIP,
-							SrcPort:   srcPort,
-							DstIP:     dstIP,
-							DstPort:   dstPort,
-							Duration:  int64(duration.Milliseconds()),
-							ByteCount: session.ByteCount,
-						})
-					} else {
-						sm.logger.Info("[TIMEOUT]",
-							"protocol", session.Protocol,
-							"iface", session.Iface,
-							"src", session.Src,
-							"dst", session.Dst,
-							"duration", duration.Round(time.Millisecond),
-							"bytes", session.ByteCount,
-						)
-
-						sm.queueEvent(database.NetworkEvent{
-							Timestamp: time.Now(),
-							EventType: database.EventTimeout,
-							Interface: session.Iface,
-							IPVersion: session.IPVersion,
-							SrcIP:     srcIP,
-							SrcPort:   srcPort,
-							DstIP:     dstIP,
-							DstPort:   dstPort,
-							Protocol:  string(session.Protocol),
-							Duration:  int64(duration.Milliseconds()),
-							ByteCount: session.ByteCount,
-						})
-					}
-					delete(sm.sessions, key)
-				}
+			// Replays clean up as packet time passes instead
+			if sm.clock.Load() == nil {
+				sm.cleanup(time.Now())
 			}
-			sm.mutex.Unlock()
+		}
+	}
+}
 
-			// Also clean up old DNS cache entries (older than 10 minutes)
-			sm.dnsCacheMutex.Lock()
-			dnsThreshold := time.Now().Add(-10 * time.Minute)
-			for ip, entry := range sm.dnsCache {
-				if entry.Timestamp.Before(dnsThreshold) {
-					delete(sm.dnsCache, ip)
-				}
-			}
-			sm.dnsCacheMutex.Unlock()
+// cleanup ends idle sessions, forgets stale DNS cache entries, writes
+// handshakes that never completed and records what the rate limiter,
+// sampling and scan detection summarised, as of now
+func (sm *SessionManager) cleanup(now time.Time) {
+	evicted := sm.expireSessions(now)
+	maxSessions := sm.limits.Load().MaxSessions
+	if evicted > 0 {
+		sm.logger.Warn("[SESSIONS] Table full, ended the least recently seen sessions",
+			"evicted", evicted,
+			"max", maxSessions,
+		)
+	}
 
-			// Periodic flush to ensure events are visible to web readers
-			sm.flushEvents()
+	// Also clean up old DNS cache entries (older than 10 minutes)
+	sm.dnsCacheMutex.Lock()
+	dnsThreshold := now.Add(-10 * time.Minute)
+	for ip, entry := range sm.dnsCache {
+		if entry.Timestamp.Before(dnsThreshold) {
+			delete(sm.dnsCache, ip)
+		}
+	}
+	sm.dnsCacheMutex.Unlock()
+
+	// Write handshakes that never saw a ServerHello, SSH banner or RDP confirm
+	sm.flushPendingTLS(now.Add(-tlsHandshakeTimeout))
+	sm.flushPendingRemote(now.Add(-remoteHandshakeTimeout))
+	sm.pruneNTPSeen(now)
+
+	// Record what the rate limiter suppressed since the last tick
+	if sm.rateLimiter != nil {
+		for _, summary := range sm.rateLimiter.Summaries() {
+			sm.logger.Warn("[RATE LIMITED]",
+				"iface", summary.Interface,
+				"src", summary.SrcIP,
+				"suppressed", summary.EventCount,
+				"reason", summary.Reason,
+			)
+			sm.bufferEvent(summary)
 		}
 	}
+
+	// Record what sampling skipped since the last tick
+	if sm.sampler != nil {
+		for _, summary := range sm.sampler.Summaries() {
+			sm.logger.Info("[SAMPLED]",
+				"iface", summary.Interface,
+				"src", summary.SrcIP,
+				"skipped", summary.EventCount,
+				"reason", summary.Reason,
+			)
+			sm.bufferEvent(summary)
+		}
+	}
+
+	// Record the scans that stopped
+	if sm.scans != nil {
+		for _, summary := range sm.scans.Summaries(now) {
+			sm.logScan(summary)
+			sm.bufferEvent(summary)
+		}
+	}
+}
+
+// logScan logs the SCAN event summarising a scan
+func (sm *SessionManager) logScan(summary database.NetworkEvent) {
+	sm.logger.Warn("[SCAN]",
+		"iface", summary.Interface,
+		"src", summary.SrcIP,
+		"dst", summary.DstIP,
+		"port", summary.DstPort,
+		"proto", summary.Protocol,
+		"targets", summary.EventCount,
+		"duration", time.Duration(summary.Duration)*time.Millisecond,
+	)
 }
 
 // lookupDNSCache returns the hostname and age for a given IP
@@ -812,46 +1794,38 @@ func (sm *SessionManager) lookupDNSCache(ip string) (string, time.Duration) {
 	defer sm.dnsCacheMutex.RUnlock()
 
 	if entry, ok := sm.dnsCache[ip]; ok {
-		return entry.Hostname, time.Since(entry.Timestamp)
+		return entry.Hostname, sm.now().Sub(entry.Timestamp)
 	}
 	return "", 0
 }
 
-// extractIPFromAddr extracts IP from "[ip]:port" format
-func extractIPFromAddr(addr string) string {
-	// Handle "[ip]:port" format
-	if strings.HasPrefix(addr, "[") {
-		end := strings.Index(addr, "]")
-		if end > 1 {
-			return addr[1:end]
-		}
-	}
-	// Handle "ip:port" format (shouldn't happen but just in case)
-	if idx := strings.LastIndex(addr, ":"); idx > 0 {
-		return addr[:idx]
-	}
-	return addr
+// newFlowID returns a random ID linking the events of one connection
+func newFlowID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-// parseAddr extracts IP and port from "[ip]:port" format
-func parseAddr(addr string) (string, uint16) {
-	host, portStr, err := net.SplitHostPort(addr)
+// eventAddr formats the IP and port of an event in the session address
+// format
+func eventAddr(ip string, port uint16) string {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return addr, 0
+		return ip
 	}
-	var port uint16
-	_, _ = fmt.Sscanf(portStr, "%d", &port)
-	return host, port
+	return formatAddr(netip.AddrPortFrom(addr, port))
 }
 
 // GetActiveSessions returns a snapshot of active sessions (for debugging/stats)
 func (sm *SessionManager) GetActiveSessions() []Session {
-	sm.mutex.RLock()
-	defer sm.mutex.RUnlock()
-
-	sessions := make([]Session, 0, len(sm.sessions))
-	for _, s := range sm.sessions {
-		sessions = append(sessions, *s)
+	var sessions []Session
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		for _, s := range shard.sessions {
+			sessions = append(sessions, *s)
+		}
+		shard.mutex.Unlock()
 	}
 	return sessions
 }
@@ -914,38 +1888,24 @@ func icmpv6TypeDescription(icmpType uint8) string {
 	}
 }
 
-// extractPortFromICMPPayload extracts the destination port from the original packet
-// embedded in an ICMP destination unreachable message
-// ICMP payload contains: Original IP header + first 8 bytes of original datagram (UDP/TCP header)
-func extractPortFromICMPPayload(payload []byte, isIPv6 bool) uint16 {
-	if len(payload) < 8 {
-		return 0
+// quotedSession returns a copy of the tracked session of the packet an
+// ICMP error quotes, or the zero Session
+func (sm *SessionManager) quotedSession(q *quotedFlow) Session {
+	key, ok := q.sessionKey()
+	if !ok {
+		return Session{}
 	}
-
-	var ipHeaderLen int
-	if isIPv6 {
-		// IPv6 header is fixed 40 bytes, but ICMP payload starts after ICMP header
-		// The payload should already be the original packet (IP header + transport)
-		ipHeaderLen = 40
-	} else {
-		// IPv4: IHL field (lower 4 bits of first byte) * 4
-		if len(payload) < 1 {
-			return 0
-		}
-		ipHeaderLen = int(payload[0]&0x0f) * 4
+	shard := sm.shard(key.src, key.dst)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if session, ok := shard.sessions[key]; ok {
+		return *session
 	}
-
-	// After IP header, we have the transport header
-	// UDP header: src port (2 bytes) + dst port (2 bytes)
-	// We want the destination port (bytes 2-3 of transport header)
-	transportOffset := ipHeaderLen
-	if len(payload) < transportOffset+4 {
-		return 0
+	// UDP sessions are keyed by whichever side sent first
+	if session, ok := shard.sessions[key.reverse()]; ok && key.proto == ProtoUDP {
+		return *session
 	}
-
-	// Destination port is at offset 2-3 of UDP/TCP header
-	dstPort := binary.BigEndian.Uint16(payload[transportOffset+2 : transportOffset+4])
-	return dstPort
+	return Session{}
 }
 
 // identifyUDPService returns service name based on port
@@ -983,17 +1943,58 @@ func identifyUDPService(srcPort, dstPort uint16) string {
 	return ""
 }
 
-// ParseDNSResponse extracts domain names, resolved IPs, and CNAMEs from DNS response
-func ParseDNSResponse(payload []byte) (queries []string, resolvedIPs []string, cnames []string, isResponse bool) {
+// DNSMessage holds the fields net-watcher extracts from a DNS packet
+type DNSMessage struct {
+	ID          uint16 // Transaction ID
+	IsResponse  bool
+	RCode       uint8
+	Queries     []string
+	ResolvedIPs []string
+	CNAMEs      []string
+	AnswerCount uint16
+	MinTTL      uint32 // Lowest TTL across answer records, in seconds
+}
+
+// RCodeName returns the mnemonic for the response code (NOERROR, NXDOMAIN, ...)
+func (m *DNSMessage) RCodeName() string {
+	return dnsRCodeName(m.RCode)
+}
+
+// dnsRCodeName maps a DNS response code to its mnemonic
+func dnsRCodeName(rcode uint8) string {
+	switch rcode {
+	case 0:
+		return "NOERROR"
+	case 1:
+		return "FORMERR"
+	case 2:
+		return "SERVFAIL"
+	case 3:
+		return "NXDOMAIN"
+	case 4:
+		return "NOTIMP"
+	case 5:
+		return "REFUSED"
+	default:
+		return fmt.Sprintf("RCODE%d", rcode)
+	}
+}
+
+// ParseDNSMessage parses the header, questions and answer records of a DNS packet
+func ParseDNSMessage(payload []byte) *DNSMessage {
 	if len(payload) < 12 {
-		return nil, nil, nil, false
+		return nil
 	}
 
 	// DNS header: ID(2) + Flags(2) + QDCOUNT(2) + ANCOUNT(2) + NSCOUNT(2) + ARCOUNT(2)
 	flags := binary.BigEndian.Uint16(payload[2:4])
-	isResponse = (flags & 0x8000) != 0
+	msg := &DNSMessage{
+		ID:          binary.BigEndian.Uint16(payload[0:2]),
+		IsResponse:  (flags & 0x8000) != 0,
+		RCode:       uint8(flags & 0x000f),
+		AnswerCount: binary.BigEndian.Uint16(payload[6:8]),
+	}
 	qdCount := binary.BigEndian.Uint16(payload[4:6])
-	anCount := binary.BigEndian.Uint16(payload[6:8])
 
 	offset := 12 // Start of questions section
 
@@ -1001,14 +2002,14 @@ func ParseDNSResponse(payload []byte) (queries []string, resolvedIPs []string, c
 	for i := uint16(0); i < qdCount && offset < len(payload); i++ {
 		name, newOffset := parseDNSName(payload, offset)
 		if name != "" {
-			queries = append(queries, name)
+			msg.Queries = append(msg.Queries, name)
 		}
 		offset = newOffset + 4 // Skip QTYPE(2) + QCLASS(2)
 	}
 
 	// Parse answers (only if response)
-	if isResponse && anCount > 0 {
-		for i := uint16(0); i < anCount && offset < len(payload); i++ {
+	if msg.IsResponse && msg.AnswerCount > 0 {
+		for i := uint16(0); i < msg.AnswerCount && offset < len(payload); i++ {
 			// Skip name (might be compressed)
 			_, newOffset := parseDNSName(payload, offset)
 			offset = newOffset
@@ -1020,7 +2021,10 @@ func ParseDNSResponse(payload []byte) (queries []string, resolvedIPs []string, c
 			rtype := binary.BigEndian.Uint16(payload[offset : offset+2])
 			// Skip rclass(2)
 			offset += 4
-			// Skip TTL(4)
+			ttl := binary.BigEndian.Uint32(payload[offset : offset+4])
+			if i == 0 || ttl < msg.MinTTL {
+				msg.MinTTL = ttl
+			}
 			offset += 4
 			rdlength := binary.BigEndian.Uint16(payload[offset : offset+2])
 			offset += 2
@@ -1032,18 +2036,18 @@ func ParseDNSResponse(payload []byte) (queries []string, resolvedIPs []string, c
 			// A record (IPv4)
 			if rtype == 1 && rdlength == 4 {
 				ip := net.IP(payload[offset : offset+4])
-				resolvedIPs = append(resolvedIPs, ip.String())
+				msg.ResolvedIPs = append(msg.ResolvedIPs, ip.String())
 			}
 			// AAAA record (IPv6)
 			if rtype == 28 && rdlength == 16 {
 				ip := net.IP(payload[offset : offset+16])
-				resolvedIPs = append(resolvedIPs, ip.String())
+				msg.ResolvedIPs = append(msg.ResolvedIPs, ip.String())
 			}
 			// CNAME record
 			if rtype == 5 {
 				cname, _ := parseDNSName(payload, offset)
 				if cname != "" {
-					cnames = append(cnames, cname)
+					msg.CNAMEs = append(msg.CNAMEs, cname)
 				}
 			}
 
@@ -1051,7 +2055,16 @@ func ParseDNSResponse(payload []byte) (queries []string, resolvedIPs []string, c
 		}
 	}
 
-	return queries, resolvedIPs, cnames, isResponse
+	return msg
+}
+
+// ParseDNSResponse extracts domain names, resolved IPs, and CNAMEs from DNS response
+func ParseDNSResponse(payload []byte) (queries []string, resolvedIPs []string, cnames []string, isResponse bool) {
+	msg := ParseDNSMessage(payload)
+	if msg == nil {
+		return nil, nil, nil, false
+	}
+	return msg.Queries, msg.ResolvedIPs, msg.CNAMEs, msg.IsResponse
 }
 
 // ParseDNSQueries extracts domain names from DNS layer (legacy, use ParseDNSResponse instead)
@@ -1093,87 +2106,8 @@ func parseDNSName(payload []byte, offset int) (string, int) {
 
 // ParseTLSSNI extracts Server Name Indication from TLS ClientHello
 func ParseTLSSNI(payload []byte) string {
-	// Minimum TLS record: 5 bytes header + some content
-	if len(payload) < 43 {
-		return ""
-	}
-
-	// Check TLS Handshake record type (0x16)
-	if payload[0] != 0x16 {
-		return ""
-	}
-
-	// Check for ClientHello (handshake type 0x01)
-	// TLS record header: Type(1) + Version(2) + Length(2)
-	// Handshake header: Type(1) + Length(3)
-	if payload[5] != 0x01 {
-		return ""
-	}
-
-	// Skip to extensions
-	// ClientHello: Version(2) + Random(32) + SessionID(1+var) + CipherSuites(2+var) + Compression(1+var)
-	offset := 5 + 4 // TLS header + Handshake header
-
-	// Skip version
-	offset += 2
-
-	// Skip random
-	offset += 32
-
-	// Skip session ID
-	if offset >= len(payload) {
-		return ""
-	}
-	sessionIDLen := int(payload[offset])
-	offset += 1 + sessionIDLen
-
-	// Skip cipher suites
-	if offset+2 > len(payload) {
-		return ""
-	}
-	cipherSuitesLen := int(binary.BigEndian.Uint16(payload[offset : offset+2]))
-	offset += 2 + cipherSuitesLen
-
-	// Skip compression methods
-	if offset >= len(payload) {
-		return ""
-	}
-	compressionLen := int(payload[offset])
-	offset += 1 + compressionLen
-
-	// Extensions length
-	if offset+2 > len(payload) {
-		return ""
-	}
-	extensionsLen := int(binary.BigEndian.Uint16(payload[offset : offset+2]))
-	offset += 2
-
-	// Parse extensions looking for SNI (type 0x0000)
-	endOffset := offset + extensionsLen
-	if endOffset > len(payload) {
-		endOffset = len(payload)
+	if hello := ParseClientHello(payload); hello != nil {
+		return hello.SNI
 	}
-
-	for offset+4 <= endOffset {
-		extType := binary.BigEndian.Uint16(payload[offset : offset+2])
-		extLen := int(binary.BigEndian.Uint16(payload[offset+2 : offset+4]))
-		offset += 4
-
-		if offset+extLen > endOffset {
-			break
-		}
-
-		// SNI extension type is 0x0000
-		if extType == 0x0000 && extLen > 5 {
-			// SNI list length (2) + name type (1) + name length (2) + name
-			nameLen := int(binary.BigEndian.Uint16(payload[offset+3 : offset+5]))
-			if offset+5+nameLen <= endOffset {
-				return string(payload[offset+5 : offset+5+nameLen])
-			}
-		}
-
-		offset += extLen
-	}
-
 	return ""
 }
@@ -0,0 +1,404 @@
+package watcher
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// SessionLimits bound the session table: how long idle sessions are kept
+// and how many are tracked at once
+type SessionLimits struct {
+	TCPTimeout  time.Duration // idle time after which a TCP connection ends as TIMEOUT
+	UDPTimeout  time.Duration // idle time for UDP flows, VPN tunnels and ICMP exchanges
+	MaxSessions int           // sessions tracked at once, the least recently seen ended first; 0 = no limit
+}
+
+// DefaultSessionLimits are used unless SetSessionLimits replaces them
+var DefaultSessionLimits = SessionLimits{
+	TCPTimeout:  2 * time.Minute,
+	UDPTimeout:  2 * time.Minute,
+	MaxSessions: 100000,
+}
+
+// Reasons recorded on the events of sessions ended by the table rather
+// than by the connection itself
+const (
+	sessionTimeout = "TIMEOUT"     // idle for longer than its protocol's timeout
+	sessionEvicted = "EVICTED"     // least recently seen when the table was full
+	sessionEnded   = "CAPTURE_END" // still open when a replayed capture file ended
+)
+
+// SessionTable is the occupancy of the session table, served by
+// /api/sessions
+type SessionTable struct {
+	Active     int            `json:"active"`
+	Max        int            `json:"max"` // 0 = no limit
+	ByProtocol map[string]int `json:"byProtocol"`
+	TCPTimeout string         `json:"tcpTimeout"`
+	UDPTimeout string         `json:"udpTimeout"`
+	// Least recently seen session, the next to be evicted
+	OldestSeen time.Time `json:"oldestSeen,omitzero"`
+	// Sessions ended since start by their idle timeout, and by eviction
+	Expired uint64 `json:"expired"`
+	Evicted uint64 `json:"evicted"`
+}
+
+// ValidateSessionLimits checks the values given for SessionLimits
+func ValidateSessionLimits(limits SessionLimits) error {
+	if limits.TCPTimeout < time.Second || limits.UDPTimeout < time.Second {
+		return fmt.Errorf("session timeouts must be at least 1s")
+	}
+	if limits.MaxSessions < 0 {
+		return fmt.Errorf("maximum sessions cannot be negative")
+	}
+	return nil
+}
+
+// sessionShards is how many parts the session table is split into. Both
+// directions of a flow hash to the same shard, so capture workers only
+// wait for each other on the flows they share.
+const sessionShards = 64
+
+// sessionShard is one part of the session table
+type sessionShard struct {
+	mutex    sync.Mutex
+	sessions map[sessionKey]*Session
+	lru      *list.List // sessions, most recently seen first
+}
+
+// sessionKey identifies a session in the session table: its protocol and
+// endpoints, the protocol of VPN tunnels, and for ICMP errors the flow the
+// error is about. Looking up the session of a packet allocates nothing;
+// endpoints are only formatted as strings for the events a session writes.
+type sessionKey struct {
+	proto    Protocol
+	vpn      string
+	src, dst netip.AddrPort // ports are zero for ICMP and IPsec
+	about    string
+}
+
+// reverse returns the key of the other direction of the flow
+func (k sessionKey) reverse() sessionKey {
+	k.src, k.dst = k.dst, k.src
+	return k
+}
+
+// shard returns the shard of the flow between two endpoints, the same in
+// either direction
+func (sm *SessionManager) shard(a, b netip.AddrPort) *sessionShard {
+	if a.Compare(b) > 0 {
+		a, b = b, a
+	}
+	// FNV-1a over both addresses and ports
+	h := uint32(2166136261)
+	for _, ap := range [2]netip.AddrPort{a, b} {
+		ip := ap.Addr().As16()
+		for _, c := range ip {
+			h = (h ^ uint32(c)) * 16777619
+		}
+		h = (h ^ uint32(ap.Port()>>8)) * 16777619
+		h = (h ^ uint32(ap.Port()&0xff)) * 16777619
+	}
+	return &sm.shards[h%sessionShards]
+}
+
+// sessionCount returns how many sessions are tracked
+func (sm *SessionManager) sessionCount() int {
+	return int(sm.sessionTotal.Load())
+}
+
+// SetSessionLimits replaces the session timeouts and table size. A smaller
+// table is trimmed as new sessions arrive.
+func (sm *SessionManager) SetSessionLimits(limits SessionLimits) {
+	sm.limits.Store(&limits)
+}
+
+// SessionTable reports the occupancy of the session table
+func (sm *SessionManager) SessionTable() SessionTable {
+	limits := sm.limits.Load()
+	t := SessionTable{
+		Max:        limits.MaxSessions,
+		ByProtocol: make(map[string]int),
+		TCPTimeout: limits.TCPTimeout.String(),
+		UDPTimeout: limits.UDPTimeout.String(),
+		Expired:    sm.sessionsExpired.Load(),
+		Evicted:    sm.sessionsEvicted.Load(),
+	}
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		t.Active += len(shard.sessions)
+		for _, s := range shard.sessions {
+			t.ByProtocol[string(s.Protocol)]++
+		}
+		if oldest := shard.lru.Back(); oldest != nil {
+			if seen := oldest.Value.(*Session).LastSeen; t.OldestSeen.IsZero() || seen.Before(t.OldestSeen) {
+				t.OldestSeen = seen
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return t
+}
+
+// addSession tracks a new session in its shard. When the table holds
+// MaxSessions, the least recently seen session of that shard ends first,
+// rather than the table's oldest, which would take every shard's lock.
+// Callers hold shard.mutex.
+func (sm *SessionManager) addSession(shard *sessionShard, s *Session) {
+	maxSessions := int64(sm.limits.Load().MaxSessions)
+	for maxSessions > 0 && sm.sessionTotal.Load() >= maxSessions {
+		if !sm.evictOne(shard) {
+			break
+		}
+	}
+	s.shard = shard
+	shard.sessions[s.key] = s
+	s.lru = shard.lru.PushFront(s)
+	sm.sessionTotal.Add(1)
+}
+
+// evictOne ends the least recently seen session of shard or, if it has
+// none, of another shard, and reports whether there was one. Other shards
+// locked at the moment are skipped instead of waited for, as their holder
+// may be waiting for shard; if all are, the table exceeds MaxSessions until
+// the next session arrives. Callers hold shard.mutex.
+func (sm *SessionManager) evictOne(shard *sessionShard) bool {
+	if oldest := shard.lru.Back(); oldest != nil {
+		sm.evict(oldest.Value.(*Session))
+		return true
+	}
+	for i := range sm.shards {
+		other := &sm.shards[i]
+		if other == shard || !other.mutex.TryLock() {
+			continue
+		}
+		oldest := other.lru.Back()
+		if oldest != nil {
+			sm.evict(oldest.Value.(*Session))
+		}
+		other.mutex.Unlock()
+		if oldest != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// evict ends a session to make room in the table. Callers hold its shard's
+// mutex.
+func (sm *SessionManager) evict(s *Session) {
+	sm.endSession(s, sessionEvicted)
+	sm.sessionsEvicted.Add(1)
+	sm.evictedSinceTick.Add(1)
+}
+
+// touchSession marks a session as just seen. Callers hold its shard's
+// mutex.
+func (sm *SessionManager) touchSession(s *Session) {
+	s.LastSeen = sm.now()
+	s.shard.lru.MoveToFront(s.lru)
+}
+
+// removeSession stops tracking a session. Callers hold its shard's mutex.
+func (sm *SessionManager) removeSession(s *Session) {
+	delete(s.shard.sessions, s.key)
+	s.shard.lru.Remove(s.lru)
+	sm.sessionTotal.Add(-1)
+}
+
+// idleTimeout is how long a session may go unseen before it ends
+func (l *SessionLimits) idleTimeout(s *Session) time.Duration {
+	if s.Protocol == ProtoTCP {
+		return l.TCPTimeout
+	}
+	return l.UDPTimeout
+}
+
+// expireSessions ends the sessions idle for longer than their timeout and
+// returns how many were evicted since the last call
+func (sm *SessionManager) expireSessions(now time.Time) (evicted uint64) {
+	limits := sm.limits.Load()
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		for _, session := range shard.sessions {
+			if now.Sub(session.LastSeen) > limits.idleTimeout(session) {
+				sm.endSession(session, sessionTimeout)
+				sm.sessionsExpired.Add(1)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return sm.evictedSinceTick.Swap(0)
+}
+
+// endSessions ends every tracked session with reason
+func (sm *SessionManager) endSessions(reason string) {
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		for _, session := range shard.sessions {
+			sm.endSession(session, reason)
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// endSession writes the closing event of a session the table ends, with
+// the reason, and stops tracking it: VPN for tunnels, UDP_END for UDP
+// flows and TIMEOUT for the rest. Callers hold its shard's mutex.
+func (sm *SessionManager) endSession(session *Session, reason string) {
+	sm.removeSession(session)
+	duration := session.LastSeen.Sub(session.StartTime)
+	srcIP, srcPort := session.key.src.Addr().String(), session.key.src.Port()
+	dstIP, dstPort := session.key.dst.Addr().String(), session.key.dst.Port()
+	// Evictions come in floods during scans; the cleanup loop summarises them
+	logf := sm.logger.Info
+	if reason == sessionEvicted {
+		logf = sm.logger.Debug
+	}
+
+	event := database.NetworkEvent{
+		Timestamp:   sm.now(),
+		FlowID:      session.FlowID,
+		Interface:   session.Iface,
+		VLAN:        session.VLAN.Outer,
+		InnerVLAN:   session.VLAN.Inner,
+		Tunnel:      session.Tunnel.Kind,
+		TunnelID:    session.Tunnel.ID,
+		TunnelSrcIP: session.Tunnel.Src,
+		TunnelDstIP: session.Tunnel.Dst,
+		IPVersion:   session.IPVersion,
+		SrcIP:       srcIP,
+		SrcPort:     srcPort,
+		DstIP:       dstIP,
+		DstPort:     dstPort,
+		Hostname:    session.Hostname,
+		P2P:         session.P2P,
+		EndTime:     session.LastSeen,
+		Duration:    int64(duration.Milliseconds()),
+		ByteCount:   session.ByteCount,
+		SrcBytes:    session.SrcBytes,
+		DstBytes:    session.DstBytes,
+		Reason:      reason,
+	}
+	switch session.Protocol {
+	case ProtoVPN:
+		logf("[VPN END]",
+			"vpn", session.VPN,
+			"iface", session.Iface,
+			"src", session.Src,
+			"dst", session.Dst,
+			"duration", duration.Round(time.Millisecond),
+			"bytes", session.ByteCount,
+			"reason", reason,
+		)
+		event.EventType = database.EventVPN
+		event.Protocol = session.VPN
+	case ProtoUDP:
+		logf("[UDP END]",
+			"iface", session.Iface,
+			"src", session.Src,
+			"dst", session.Dst,
+			"duration", duration.Round(time.Millisecond),
+			"bytes", session.ByteCount,
+			"reason", reason,
+		)
+		event.EventType = database.EventUDPEnd
+	default:
+		logf("[TIMEOUT]",
+			"protocol", session.Protocol,
+			"iface", session.Iface,
+			"src", session.Src,
+			"dst", session.Dst,
+			"duration", duration.Round(time.Millisecond),
+			"bytes", session.ByteCount,
+			"reason", reason,
+		)
+		event.EventType = database.EventTimeout
+		event.Protocol = string(session.Protocol)
+	}
+	sm.queueEvent(event)
+	if session.Protocol != ProtoVPN {
+		sm.queueFileShare(session, reason)
+	}
+}
+
+// ActiveSession is a session still being tracked, served by
+// /api/connections/active
+type ActiveSession struct {
+	FlowID    string    `json:"flowId,omitempty"`
+	Protocol  string    `json:"protocol"` // TCP, UDP, ICMP or the VPN protocol
+	Interface string    `json:"interface"`
+	SrcIP     string    `json:"srcIp"`
+	SrcPort   uint16    `json:"srcPort,omitempty"`
+	DstIP     string    `json:"dstIp"`
+	DstPort   uint16    `json:"dstPort,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"` // SNI for TLS connections
+	StartTime time.Time `json:"startTime"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Duration  int64     `json:"duration"` // milliseconds so far
+	Bytes     int64     `json:"bytes"`
+	SrcBytes  int64     `json:"srcBytes"`
+	DstBytes  int64     `json:"dstBytes"`
+}
+
+// ActiveSessions lists up to limit tracked sessions, most recently seen
+// first, optionally only those of one protocol; limit 0 lists all
+func (sm *SessionManager) ActiveSessions(protocol string, limit int) []ActiveSession {
+	now := sm.now()
+	var active []ActiveSession
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		// A shard's sessions past the limit cannot be among the most recent
+		n := 0
+		for e := shard.lru.Front(); e != nil && (limit <= 0 || n < limit); e = e.Next() {
+			s := e.Value.(*Session)
+			a := ActiveSession{
+				FlowID:    s.FlowID,
+				Protocol:  string(s.Protocol),
+				Interface: s.Iface,
+				Hostname:  s.Hostname,
+				StartTime: s.StartTime,
+				LastSeen:  s.LastSeen,
+				Duration:  now.Sub(s.StartTime).Milliseconds(),
+				Bytes:     s.ByteCount,
+				SrcBytes:  s.SrcBytes,
+				DstBytes:  s.DstBytes,
+			}
+			a.SrcIP, a.SrcPort = s.key.src.Addr().String(), s.key.src.Port()
+			a.DstIP, a.DstPort = s.key.dst.Addr().String(), s.key.dst.Port()
+			if s.Protocol == ProtoVPN {
+				a.Protocol = s.VPN
+			}
+			if s.SNI != "" {
+				a.Hostname = s.SNI
+			}
+			if protocol != "" && !strings.EqualFold(a.Protocol, protocol) {
+				continue
+			}
+			active = append(active, a)
+			n++
+		}
+		shard.mutex.Unlock()
+	}
+	slices.SortFunc(active, func(a, b ActiveSession) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	if limit > 0 && len(active) > limit {
+		active = active[:limit]
+	}
+	if active == nil {
+		active = []ActiveSession{}
+	}
+	return active
+}
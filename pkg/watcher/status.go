@@ -0,0 +1,342 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+)
+
+// Status is a snapshot of a running watcher, reported over the control socket
+type Status struct {
+	StartedAt     time.Time         `json:"startedAt"`
+	Uptime        string            `json:"uptime"`
+	Paused        bool              `json:"paused"`
+	Interfaces    []InterfaceStatus `json:"interfaces"`
+	EventsWritten uint64            `json:"eventsWritten"`
+	WriteRate     float64           `json:"writeRate"` // events/s over the last minute
+	Queues        QueueStatus       `json:"queues"`
+}
+
+// InterfaceStatus holds the capture counters of one interface
+type InterfaceStatus struct {
+	Name      string    `json:"name"`
+	Backend   string    `json:"backend"` // capture backend in use, see CaptureBackends
+	Workers   int       `json:"workers"` // goroutines capturing the interface
+	Since     time.Time `json:"since"`
+	Packets   uint64    `json:"packets"`   // delivered to the ring by the kernel
+	Drops     uint64    `json:"drops"`     // dropped by the kernel, ring full
+	Processed uint64    `json:"processed"` // decoded by net-watcher (not while paused)
+	// IP fragments: datagrams reassembled, and fragments discarded because
+	// they expired, overlapped or exceeded the reassembly limits
+	Reassembled      uint64 `json:"reassembled"`
+	FragmentsDropped uint64 `json:"fragmentsDropped"`
+	// Totals including earlier runs of the daemon
+	LifetimePackets uint64    `json:"lifetimePackets"`
+	LifetimeDrops   uint64    `json:"lifetimeDrops"`
+	LifetimeSince   time.Time `json:"lifetimeSince"`
+}
+
+// QueueStatus holds the depth of the in-memory queues between capture and storage
+type QueueStatus struct {
+	WriteQueue     int            `json:"writeQueue"`     // events waiting for the database writer
+	WriteQueueCap  int            `json:"writeQueueCap"`  // queue size; events beyond it are dropped
+	WriteQueuePeak int            `json:"writeQueuePeak"` // highest depth seen since start
+	WriteDropped   uint64         `json:"writeDropped"`   // events dropped because the queue was full
+	PendingTLS     int            `json:"pendingTls"`     // ClientHellos waiting for a ServerHello
+	Sessions       int            `json:"sessions"`       // open TCP/UDP sessions
+	DNSCache       int            `json:"dnsCache"`
+	Sinks          map[string]int `json:"sinks,omitempty"` // events queued per streaming sink
+}
+
+// captureStats tracks one running sniffer
+type captureStats struct {
+	handles   []captureHandle // one per capture worker
+	backend   string
+	since     time.Time
+	processed atomic.Uint64
+	defrags   []*defragmenter         // one per capture worker, as they are not shared
+	vlans     atomic.Pointer[VLANSet] // nil records every VLAN
+
+	mutex                                    sync.Mutex
+	rawPackets, rawDrops                     []uint64 // last socket counter reading of each handle
+	packets, drops                           uint64   // totals since the sniffer started
+	savedPackets, savedDrops, savedProcessed uint64   // part of the totals already stored
+	checkedPackets, checkedProcessed         uint64   // totals at the last Health check
+}
+
+// healthState holds the counters seen by the previous Health check
+type healthState struct {
+	mutex   sync.Mutex
+	written uint64
+}
+
+// sample reads the socket counters and adds what changed to the totals
+func (c *captureStats) sample() (packets, drops uint64, err error) {
+	rawPackets := make([]uint64, len(c.handles))
+	rawDrops := make([]uint64, len(c.handles))
+	for i, handle := range c.handles {
+		if rawPackets[i], rawDrops[i], err = handle.counters(); err != nil {
+			return 0, 0, err
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := range c.handles {
+		c.packets += counterDelta(c.rawPackets[i], rawPackets[i], bits.UintSize)
+		c.drops += counterDelta(c.rawDrops[i], rawDrops[i], bits.UintSize)
+	}
+	c.rawPackets, c.rawDrops = rawPackets, rawDrops
+	return c.packets, c.drops, nil
+}
+
+// fragments returns the datagrams the workers' defragmenters reassembled
+// and the fragments they dropped
+func (c *captureStats) fragments() (reassembled, dropped uint64) {
+	for _, d := range c.defrags {
+		reassembled += d.reassembled.Load()
+		dropped += d.dropped.Load()
+	}
+	return reassembled, dropped
+}
+
+// unsaved returns the counts not yet added to the stored totals
+func (c *captureStats) unsaved() (packets, drops, processed uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.packets - c.savedPackets, c.drops - c.savedDrops, c.processed.Load() - c.savedProcessed
+}
+
+// markSaved records that counts returned by unsaved have been stored
+func (c *captureStats) markSaved(packets, drops, processed uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.savedPackets += packets
+	c.savedDrops += drops
+	c.savedProcessed += processed
+}
+
+// counterDelta returns how much a socket counter of the given bit width
+// grew from prev to cur. The counters are the platform's uint, so on
+// 32-bit systems they wrap; they also restart from zero when the handle
+// is reset. A decrease from near the top of a 32-bit range is taken as a
+// wrap, any other decrease as a restart.
+func counterDelta(prev, cur uint64, width int) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	if width == 32 && prev >= 3<<30 {
+		return cur + (1 << 32) - prev
+	}
+	return cur
+}
+
+// writeRateWindow is the period the reported write rate is averaged over
+const writeRateWindow = time.Minute
+
+// writeSample is the written-events counter at one point in time
+type writeSample struct {
+	at      time.Time
+	written uint64
+}
+
+// writeRate keeps recent samples of the written-events counter
+type writeRate struct {
+	samples []writeSample
+	mutex   sync.Mutex
+}
+
+// Pause stops recording events. Sniffers keep draining their rings so the
+// kernel does not count drops, but packets are discarded until Resume.
+func (w *Watcher) Pause() {
+	if !w.paused.Swap(true) {
+		w.logger.Info("Capture paused")
+	}
+}
+
+// Resume starts recording events again after Pause
+func (w *Watcher) Resume() {
+	if w.paused.Swap(false) {
+		w.logger.Info("Capture resumed")
+	}
+}
+
+// Paused reports whether recording is paused
+func (w *Watcher) Paused() bool {
+	return w.paused.Load()
+}
+
+// Status returns uptime, per-interface counters, write rate and queue depths
+func (w *Watcher) Status() Status {
+	st := Status{
+		StartedAt:     w.started,
+		Uptime:        time.Since(w.started).Round(time.Second).String(),
+		Paused:        w.paused.Load(),
+		EventsWritten: w.sessionManager.eventsWritten.Load(),
+		WriteRate:     w.rate.perSecond(),
+		Queues:        w.sessionManager.queueStatus(),
+	}
+
+	var stored map[string]database.InterfaceCounters
+	if w.sessionManager.db != nil {
+		stored, _ = w.sessionManager.db.InterfaceCounterTotals()
+	}
+
+	w.sniffersMux.Lock()
+	for name, c := range w.captures {
+		is := InterfaceStatus{Name: name, Backend: c.backend, Workers: len(c.handles), Since: c.since, Processed: c.processed.Load()}
+		is.Reassembled, is.FragmentsDropped = c.fragments()
+		is.Packets, is.Drops, _ = c.sample()
+		packets, drops, _ := c.unsaved()
+		total := stored[name]
+		is.LifetimePackets = total.Packets + packets
+		is.LifetimeDrops = total.Drops + drops
+		is.LifetimeSince = total.FirstSeen
+		if is.LifetimeSince.IsZero() {
+			is.LifetimeSince = c.since
+		}
+		st.Interfaces = append(st.Interfaces, is)
+	}
+	w.sniffersMux.Unlock()
+	sort.Slice(st.Interfaces, func(i, j int) bool { return st.Interfaces[i].Name < st.Interfaces[j].Name })
+
+	return st
+}
+
+// Health reports whether capture is working: at least one interface is
+// captured or waiting for its link to come back up, packets the kernel delivered since the previous call were
+// processed, and the database writer keeps up with a full queue. It is
+// meant to be called periodically, e.g. to feed the systemd watchdog.
+func (w *Watcher) Health() error {
+	w.health.mutex.Lock()
+	defer w.health.mutex.Unlock()
+
+	w.sniffersMux.Lock()
+	captures := make(map[string]*captureStats, len(w.captures))
+	for name, c := range w.captures {
+		captures[name] = c
+	}
+	// An interface that is down is not a capture failure
+	waiting := len(w.linkDown)
+	w.sniffersMux.Unlock()
+	if len(captures) == 0 && waiting == 0 {
+		return errors.New("no interface is being captured")
+	}
+
+	var stalled error
+	for name, c := range captures {
+		packets, _, err := c.sample()
+		if err != nil {
+			return fmt.Errorf("capture on %s failed: %w", name, err)
+		}
+		processed := c.processed.Load()
+		c.mutex.Lock()
+		if packets > c.checkedPackets && processed == c.checkedProcessed && !w.paused.Load() && stalled == nil {
+			stalled = fmt.Errorf("capture on %s stalled, %d packets arrived and none was processed", name, packets-c.checkedPackets)
+		}
+		c.checkedPackets, c.checkedProcessed = packets, processed
+		c.mutex.Unlock()
+	}
+	if stalled != nil {
+		return stalled
+	}
+
+	written := w.sessionManager.eventsWritten.Load()
+	queues := w.sessionManager.queueStatus()
+	defer func() { w.health.written = written }()
+	if queues.WriteQueueCap > 0 && queues.WriteQueue >= queues.WriteQueueCap && written == w.health.written {
+		return fmt.Errorf("database writer stalled with %d events queued", queues.WriteQueue)
+	}
+	return nil
+}
+
+// trackCapture registers a sniffer's handles for status reporting
+func (w *Watcher) trackCapture(name string, handles []captureHandle, backend string) *captureStats {
+	c := &captureStats{
+		handles:    handles,
+		backend:    backend,
+		since:      time.Now(),
+		rawPackets: make([]uint64, len(handles)),
+		rawDrops:   make([]uint64, len(handles)),
+	}
+	for range handles {
+		c.defrags = append(c.defrags, newDefragmenter())
+	}
+	w.sniffersMux.Lock()
+	w.captures[name] = c
+	w.sniffersMux.Unlock()
+	return c
+}
+
+// untrackCapture stores the final counters of a sniffer and forgets it
+// before its handles are closed
+func (w *Watcher) untrackCapture(name string, c *captureStats) {
+	c.sample()
+	w.saveCounters(name, c)
+	w.sniffersMux.Lock()
+	delete(w.captures, name)
+	w.sniffersMux.Unlock()
+}
+
+// saveCounters adds what a sniffer counted since the last call to the
+// interface totals kept in the database
+func (w *Watcher) saveCounters(name string, c *captureStats) {
+	db := w.sessionManager.db
+	if db == nil {
+		return
+	}
+	packets, drops, processed := c.unsaved()
+	if packets == 0 && drops == 0 && processed == 0 {
+		return
+	}
+	if err := db.AddInterfaceCounters(name, c.since, packets, drops, processed); err != nil {
+		w.logger.Warn("Failed to store capture counters", "interface", name, "error", err)
+		return
+	}
+	c.markSaved(packets, drops, processed)
+}
+
+// sampleWriteRate records the written-events counter every few seconds
+func (w *Watcher) sampleWriteRate(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		w.rate.add(writeSample{at: time.Now(), written: w.sessionManager.eventsWritten.Load()})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// add appends a sample and drops those older than the window
+func (r *writeRate) add(s writeSample) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.samples = append(r.samples, s)
+	for len(r.samples) > 2 && s.at.Sub(r.samples[1].at) >= writeRateWindow {
+		r.samples = r.samples[1:]
+	}
+}
+
+// perSecond returns the average write rate between the oldest and newest sample
+func (r *writeRate) perSecond() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.samples) < 2 {
+		return 0
+	}
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.written-first.written) / elapsed
+}
@@ -0,0 +1,426 @@
+package watcher
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TLS extension types used for fingerprinting
+const (
+	tlsExtServerName          = 0x0000
+	tlsExtSupportedGroups     = 0x000a
+	tlsExtECPointFormats      = 0x000b
+	tlsExtSignatureAlgorithms = 0x000d
+	tlsExtALPN                = 0x0010
+	tlsExtSupportedVersions   = 0x002b
+	tlsExtECH                 = 0xfe0d
+	tlsExtESNI                = 0xffce
+)
+
+// ClientHello holds the fields of a TLS ClientHello needed for SNI logging
+// and JA3/JA4 client fingerprinting
+type ClientHello struct {
+	Version             uint16 // legacy record version from the hello body
+	SNI                 string
+	CipherSuites        []uint16
+	Extensions          []uint16 // in wire order
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	ALPN                []string
+	SupportedVersions   []uint16
+	// ECH reports an encrypted_client_hello (or draft ESNI) extension. Clients
+	// also send GREASE ECH, so this means ECH was offered, not accepted.
+	ECH bool
+}
+
+// ServerHello holds the parameters the server picked for a handshake
+type ServerHello struct {
+	Version     uint16 // negotiated version, from supported_versions for TLS 1.3
+	CipherSuite uint16
+	ALPN        string
+}
+
+// TLS record and handshake constants checked before parsing a hello
+const (
+	tlsRecordHandshake    = 0x16
+	tlsHandshakeClient    = 0x01
+	tlsHandshakeServer    = 0x02
+	tlsMaxRecordLen       = 1 << 14 // plaintext limit, RFC 8446 section 5.1
+	tlsMaxSessionIDLen    = 32
+	tlsHelloMinLen        = 43 // record and handshake headers, version, random, session ID length
+	tlsHelloVersionOffset = 9
+)
+
+// handshakeRecord returns the first TLS record of payload when it carries
+// a handshake message of the given type, cut to the record's length, and
+// nil otherwise. Hellos are looked for on every port, so besides the
+// content type the record version, record length, handshake type and hello
+// version must all be plausible; this keeps binary protocols whose first
+// byte happens to be 0x16 from being parsed as TLS. The payload may end
+// before the record does when the hello spans several segments.
+func handshakeRecord(payload []byte, handshakeType byte) []byte {
+	if len(payload) < tlsHelloMinLen || payload[0] != tlsRecordHandshake || payload[5] != handshakeType {
+		return nil
+	}
+	// SSL 3.0 to TLS 1.3 all use 0x0300-0x0304 here and in the hello
+	if payload[1] != 0x03 || payload[2] > 0x04 {
+		return nil
+	}
+	if v := payload[tlsHelloVersionOffset : tlsHelloVersionOffset+2]; v[0] != 0x03 || v[1] > 0x04 {
+		return nil
+	}
+	recordLen := int(binary.BigEndian.Uint16(payload[3:5]))
+	handshakeLen := int(payload[6])<<16 | int(payload[7])<<8 | int(payload[8])
+	if recordLen < tlsHelloMinLen-5 || recordLen > tlsMaxRecordLen || handshakeLen < tlsHelloMinLen-9 {
+		return nil
+	}
+	return payload[:min(len(payload), 5+recordLen)]
+}
+
+// ParseClientHello parses a TLS record carrying a ClientHello. It returns nil
+// when the payload is not a ClientHello or is truncated before the extensions.
+func ParseClientHello(payload []byte) *ClientHello {
+	// TLS record header: Type(1) + Version(2) + Length(2)
+	// Handshake header: Type(1) + Length(3)
+	payload = handshakeRecord(payload, tlsHandshakeClient)
+	if payload == nil {
+		return nil
+	}
+
+	hello := &ClientHello{}
+	offset := 5 + 4
+	hello.Version = binary.BigEndian.Uint16(payload[offset : offset+2])
+	offset += 2 + 32 // version + random
+
+	// Session ID
+	if offset >= len(payload) || payload[offset] > tlsMaxSessionIDLen {
+		return nil
+	}
+	offset += 1 + int(payload[offset])
+
+	// Cipher suites
+	if offset+2 > len(payload) {
+		return nil
+	}
+	cipherSuitesLen := int(binary.BigEndian.Uint16(payload[offset : offset+2]))
+	offset += 2
+	if cipherSuitesLen == 0 || cipherSuitesLen%2 != 0 || offset+cipherSuitesLen > len(payload) {
+		return nil
+	}
+	for i := 0; i+1 < cipherSuitesLen; i += 2 {
+		hello.CipherSuites = append(hello.CipherSuites, binary.BigEndian.Uint16(payload[offset+i:offset+i+2]))
+	}
+	offset += cipherSuitesLen
+
+	// Compression methods, at least "null"
+	if offset >= len(payload) || payload[offset] == 0 {
+		return nil
+	}
+	offset += 1 + int(payload[offset])
+
+	// Extensions (optional in very old clients)
+	if offset+2 > len(payload) {
+		return hello
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(payload[offset : offset+2]))
+	offset += 2
+	endOffset := offset + extensionsLen
+	if endOffset > len(payload) {
+		endOffset = len(payload)
+	}
+
+	for offset+4 <= endOffset {
+		extType := binary.BigEndian.Uint16(payload[offset : offset+2])
+		extLen := int(binary.BigEndian.Uint16(payload[offset+2 : offset+4]))
+		offset += 4
+		if offset+extLen > endOffset {
+			break
+		}
+		hello.Extensions = append(hello.Extensions, extType)
+		hello.parseExtension(extType, payload[offset:offset+extLen])
+		offset += extLen
+	}
+
+	return hello
+}
+
+// parseExtension records the contents of the extensions used by fingerprints
+func (h *ClientHello) parseExtension(extType uint16, data []byte) {
+	switch extType {
+	case tlsExtServerName:
+		// SNI list length (2) + name type (1) + name length (2) + name
+		if len(data) > 5 {
+			nameLen := int(binary.BigEndian.Uint16(data[3:5]))
+			if 5+nameLen <= len(data) {
+				h.SNI = string(data[5 : 5+nameLen])
+			}
+		}
+	case tlsExtSupportedGroups:
+		h.SupportedGroups = readUint16List(data, 2)
+	case tlsExtECPointFormats:
+		if len(data) > 0 && 1+int(data[0]) <= len(data) {
+			h.ECPointFormats = append([]uint8(nil), data[1:1+int(data[0])]...)
+		}
+	case tlsExtSignatureAlgorithms:
+		h.SignatureAlgorithms = readUint16List(data, 2)
+	case tlsExtALPN:
+		if len(data) < 2 {
+			return
+		}
+		for i := 2; i < len(data); {
+			n := int(data[i])
+			if i+1+n > len(data) {
+				break
+			}
+			h.ALPN = append(h.ALPN, string(data[i+1:i+1+n]))
+			i += 1 + n
+		}
+	case tlsExtSupportedVersions:
+		h.SupportedVersions = readUint16List(data, 1)
+	case tlsExtECH, tlsExtESNI:
+		h.ECH = true
+	}
+}
+
+// ParseServerHello parses a TLS record carrying a ServerHello and returns nil
+// for anything else
+func ParseServerHello(payload []byte) *ServerHello {
+	payload = handshakeRecord(payload, tlsHandshakeServer)
+	if payload == nil {
+		return nil
+	}
+
+	hello := &ServerHello{}
+	offset := 5 + 4
+	hello.Version = binary.BigEndian.Uint16(payload[offset : offset+2])
+	offset += 2 + 32 // version + random
+
+	// Session ID
+	if offset >= len(payload) || payload[offset] > tlsMaxSessionIDLen {
+		return nil
+	}
+	offset += 1 + int(payload[offset])
+
+	// Cipher suite (2) + compression method (1)
+	if offset+3 > len(payload) {
+		return nil
+	}
+	hello.CipherSuite = binary.BigEndian.Uint16(payload[offset : offset+2])
+	offset += 3
+
+	if offset+2 > len(payload) {
+		return hello
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(payload[offset : offset+2]))
+	offset += 2
+	endOffset := min(offset+extensionsLen, len(payload))
+
+	for offset+4 <= endOffset {
+		extType := binary.BigEndian.Uint16(payload[offset : offset+2])
+		extLen := int(binary.BigEndian.Uint16(payload[offset+2 : offset+4]))
+		offset += 4
+		if offset+extLen > endOffset {
+			break
+		}
+		data := payload[offset : offset+extLen]
+		switch extType {
+		case tlsExtSupportedVersions:
+			if len(data) == 2 {
+				hello.Version = binary.BigEndian.Uint16(data)
+			}
+		case tlsExtALPN:
+			// list length (2) + one protocol: length (1) + name
+			if len(data) > 3 && 3+int(data[2]) <= len(data) {
+				hello.ALPN = string(data[3 : 3+int(data[2])])
+			}
+		}
+		offset += extLen
+	}
+
+	return hello
+}
+
+// TLSVersionName returns a readable protocol version, e.g. "TLS1.2"
+func TLSVersionName(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "SSL3.0"
+	case 0x0301:
+		return "TLS1.0"
+	case 0x0302:
+		return "TLS1.1"
+	case 0x0303:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// TLSCipherName returns the IANA name of a cipher suite
+func TLSCipherName(id uint16) string {
+	return tls.CipherSuiteName(id)
+}
+
+// JA3 returns the JA3 string and its MD5 hash:
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+func (h *ClientHello) JA3() (string, string) {
+	formats := make([]string, len(h.ECPointFormats))
+	for i, f := range h.ECPointFormats {
+		formats[i] = strconv.Itoa(int(f))
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(h.CipherSuites),
+		joinDecimal(h.Extensions),
+		joinDecimal(h.SupportedGroups),
+		strings.Join(formats, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return s, hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint (TLS over TCP), e.g.
+// t13d1516h2_8daaf6152771_b186095e22b6
+func (h *ClientHello) JA4() string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	version := h.Version
+	if versions := withoutGREASE(h.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+
+	sni := "i"
+	if h.SNI != "" {
+		sni = "d"
+	}
+
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(version), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.ALPN))
+
+	// Ciphers and extensions are sorted so reordering does not change the hash;
+	// SNI and ALPN are already represented in the prefix
+	sortedCiphers := slices.Sorted(slices.Values(ciphers))
+
+	var sortedExt []uint16
+	for _, e := range extensions {
+		if e != tlsExtServerName && e != tlsExtALPN {
+			sortedExt = append(sortedExt, e)
+		}
+	}
+	slices.Sort(sortedExt)
+
+	extPart := joinHex(sortedExt)
+	if sigs := joinHex(withoutGREASE(h.SignatureAlgorithms)); sigs != "" {
+		extPart += "_" + sigs
+	}
+
+	return prefix + "_" + ja4Hash(joinHex(sortedCiphers), len(sortedCiphers)) + "_" + ja4Hash(extPart, len(sortedExt))
+}
+
+// ja4Version maps a TLS version to its two-character JA4 code
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last character of the first ALPN value,
+// falling back to hex for non-alphanumeric values
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	v := alpn[0]
+	first, last := v[0], v[len(v)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(v))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+// ja4Hash returns the first 12 hex characters of the SHA-256 of s
+func ja4Hash(s string, count int) string {
+	if count == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// isGREASE reports whether v is a reserved GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range withoutGREASE(values) {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// readUint16List reads a length-prefixed list of 16-bit values
+func readUint16List(data []byte, lenBytes int) []uint16 {
+	if len(data) < lenBytes {
+		return nil
+	}
+	n := int(data[0])
+	if lenBytes == 2 {
+		n = int(binary.BigEndian.Uint16(data[:2]))
+	}
+	data = data[lenBytes:]
+	if n > len(data) {
+		n = len(data)
+	}
+	var out []uint16
+	for i := 0; i+1 < n; i += 2 {
+		out = append(out, binary.BigEndian.Uint16(data[i:i+2]))
+	}
+	return out
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
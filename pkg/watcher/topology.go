@@ -0,0 +1,164 @@
+package watcher
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// sysClassNet is where the kernel exposes bridge and bond relationships
+const sysClassNet = "/sys/class/net"
+
+// linkKind classifies an interface's role in a bridge or bond
+type linkKind int
+
+const (
+	linkPlain linkKind = iota
+	linkBridge
+	linkBridgePort
+	linkBond
+	linkBondSlave
+)
+
+// topologyResolver maps user-selected interfaces onto the interfaces that
+// actually see the traffic, following kernel behaviour:
+//   - a bond master receives everything its slaves receive, so slaves are
+//     replaced by their master
+//   - a bridge device only sees traffic to/from the host, so bridges are
+//     replaced by their member ports to include bridged traffic
+type topologyResolver struct {
+	logger *log.Logger
+	warned map[string]bool
+	mutex  sync.Mutex
+}
+
+// newTopologyResolver creates a resolver that logs each warning only once
+func newTopologyResolver(logger *log.Logger) *topologyResolver {
+	return &topologyResolver{logger: logger, warned: make(map[string]bool)}
+}
+
+// Resolve returns the capture interfaces for the given selection
+func (t *topologyResolver) Resolve(ifaces []net.Interface) []net.Interface {
+	seen := make(map[string]bool)
+	var resolved []net.Interface
+
+	add := func(iface net.Interface) {
+		if !seen[iface.Name] {
+			seen[iface.Name] = true
+			resolved = append(resolved, iface)
+		}
+	}
+
+	for _, iface := range ifaces {
+		switch classifyLink(iface.Name) {
+		case linkBondSlave:
+			master := linkMaster(iface.Name)
+			if m, err := net.InterfaceByName(master); err == nil && m.Flags&net.FlagUp != 0 {
+				t.warnOnce(iface.Name, "Interface is a bond member, capturing on bond master instead",
+					"interface", iface.Name, "master", master)
+				add(*m)
+				continue
+			}
+			add(iface)
+
+		case linkBridge:
+			members := t.upMembers(bridgeMembers(iface.Name))
+			if len(members) == 0 {
+				t.warnOnce(iface.Name, "Bridge has no active member ports, capturing on bridge device; bridged traffic between ports will be missed",
+					"bridge", iface.Name)
+				add(iface)
+				continue
+			}
+			var names []string
+			for _, m := range members {
+				names = append(names, m.Name)
+				add(m)
+			}
+			t.warnOnce(iface.Name, "Interface is a bridge, capturing on its member ports so bridged traffic is included",
+				"bridge", iface.Name, "members", strings.Join(names, ","))
+
+		case linkBridgePort:
+			t.warnOnce(iface.Name, "Interface is a bridge port; traffic bridged between other ports will be missed",
+				"interface", iface.Name, "bridge", linkMaster(iface.Name))
+			add(iface)
+
+		default:
+			add(iface)
+		}
+	}
+
+	return resolved
+}
+
+// upMembers returns the member interfaces that are currently up
+func (t *topologyResolver) upMembers(names []string) []net.Interface {
+	var members []net.Interface
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		members = append(members, *iface)
+	}
+	return members
+}
+
+// warnOnce logs a topology warning the first time it applies to an interface
+func (t *topologyResolver) warnOnce(name, msg string, keyvals ...interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.warned[name] {
+		return
+	}
+	t.warned[name] = true
+	t.logger.Warn(msg, keyvals...)
+}
+
+// classifyLink inspects sysfs to determine an interface's bridge/bond role
+func classifyLink(name string) linkKind {
+	base := filepath.Join(sysClassNet, name)
+	switch {
+	case pathExists(filepath.Join(base, "bridge")):
+		return linkBridge
+	case pathExists(filepath.Join(base, "bonding")):
+		return linkBond
+	case pathExists(filepath.Join(base, "brport")):
+		return linkBridgePort
+	case pathExists(filepath.Join(base, "bonding_slave")):
+		return linkBondSlave
+	}
+	return linkPlain
+}
+
+// linkMaster returns the name of the interface's bridge or bond master
+func linkMaster(name string) string {
+	target, err := os.Readlink(filepath.Join(sysClassNet, name, "master"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// bridgeMembers lists the ports attached to a bridge
+func bridgeMembers(bridge string) []string {
+	entries, err := os.ReadDir(filepath.Join(sysClassNet, bridge, "brif"))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func pathExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,151 @@
+package watcher
+
+import (
+	"encoding/binary"
+	"slices"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Tunnel describes the encapsulation a packet was unwrapped from: GRE
+// (including ERSPAN mirror sessions), VXLAN, Geneve or IP-in-IP, the GRE
+// key or VNI, and the outer endpoints. Kind is empty for plain packets.
+type Tunnel struct {
+	Kind     string
+	ID       uint32
+	Src, Dst string
+}
+
+// Encap is how a packet reached the capture: the VLAN tags of the frame
+// and the tunnel the flow inside it was carried in
+type Encap struct {
+	VLANTags
+	Tunnel Tunnel
+}
+
+// Well-known UDP ports of tunnels and VPNs
+const (
+	portVXLAN   = 4789
+	portGeneve  = 6081
+	portIKE     = 500
+	portNATT    = 4500
+	portOpenVPN = 1194
+)
+
+// decapsulate returns the packet inside GRE, VXLAN, Geneve and IP-in-IP
+// tunnels, so the inner flow is tracked instead of the tunnel, and the
+// outermost tunnel it was carried in. Other packets are returned as they
+// are, without decoding them further.
+func decapsulate(packet gopacket.Packet) (gopacket.Packet, Tunnel) {
+	if !tunnelled(packet) {
+		return packet, Tunnel{}
+	}
+	var tunnel Tunnel
+	var outer, inner gopacket.NetworkLayer
+	kind, id := "", uint32(0)
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.GRE:
+			kind, id = "GRE", 0
+			if l.KeyPresent {
+				id = l.Key
+			}
+		case *layers.VXLAN:
+			kind, id = "VXLAN", l.VNI
+		case *layers.Geneve:
+			kind, id = "Geneve", l.VNI
+		case *layers.IPv4, *layers.IPv6:
+			ip := layer.(gopacket.NetworkLayer)
+			if outer != nil {
+				if kind == "" {
+					kind = "IPIP"
+				}
+				if tunnel.Kind == "" {
+					src, dst := outer.NetworkFlow().Endpoints()
+					tunnel = Tunnel{Kind: kind, ID: id, Src: src.String(), Dst: dst.String()}
+				}
+				inner, kind, id = ip, "", 0
+			}
+			outer = ip
+		}
+	}
+	if inner == nil {
+		return packet, Tunnel{}
+	}
+	first := layers.LayerTypeIPv4
+	if _, ok := inner.(*layers.IPv6); ok {
+		first = layers.LayerTypeIPv6
+	}
+	data := append(slices.Clone(inner.LayerContents()), inner.LayerPayload()...)
+	return redecode(packet, data, first), tunnel
+}
+
+// tunnelled reports whether a packet's outer IP header carries a tunnel,
+// looking only at the headers already decoded
+func tunnelled(packet gopacket.Packet) bool {
+	var proto layers.IPProtocol
+	var payload []byte
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		proto, payload = ip.Protocol, ip.Payload
+	case *layers.IPv6:
+		proto, payload = ip.NextHeader, ip.Payload
+	default:
+		return false
+	}
+	switch proto {
+	case layers.IPProtocolGRE, layers.IPProtocolIPv4, layers.IPProtocolIPv6:
+		return true
+	case layers.IPProtocolUDP:
+		if len(payload) < 8 {
+			return false
+		}
+		port := binary.BigEndian.Uint16(payload[2:4])
+		return port == portVXLAN || port == portGeneve
+	}
+	return false
+}
+
+// vpnProtocol returns the VPN a UDP datagram belongs to: WireGuard by its
+// message framing on any port, IPsec by IKE and NAT traversal on ports
+// 500 and 4500, OpenVPN by its opcode on port 1194. It returns "" for
+// other traffic. size is the payload length the UDP header gives, which
+// exceeds len(payload) when the snap length cut the datagram.
+func vpnProtocol(srcPort, dstPort uint16, payload []byte, size int) string {
+	port := func(p uint16) bool { return srcPort == p || dstPort == p }
+	switch {
+	case port(53):
+		return ""
+	case port(portNATT):
+		return "IPsec"
+	case port(portIKE) && len(payload) >= 28 && (payload[17] == 0x10 || payload[17] == 0x20):
+		// IKE header: two SPIs, next payload, then the major/minor version
+		return "IPsec"
+	case port(portOpenVPN) && len(payload) >= 1 && payload[0]>>3 >= 1 && payload[0]>>3 <= 11:
+		return "OpenVPN"
+	case isWireGuard(payload, size):
+		return "WireGuard"
+	}
+	return ""
+}
+
+// isWireGuard matches the four WireGuard message types: a type byte and
+// three reserved zero bytes, with the fixed sizes of handshake initiation,
+// response and cookie reply, or transport data padded to 16 bytes
+func isWireGuard(p []byte, size int) bool {
+	if size < 32 || len(p) < 4 || p[1] != 0 || p[2] != 0 || p[3] != 0 {
+		return false
+	}
+	switch p[0] {
+	case 1:
+		return size == 148
+	case 2:
+		return size == 92
+	case 3:
+		return size == 64
+	case 4:
+		return size%16 == 0
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+)
+
+// VLANTags holds the 802.1Q VLAN IDs a frame carried: Outer is the only tag
+// of a tagged frame or the service tag of a QinQ (802.1ad) frame, Inner the
+// customer tag. Zero means untagged.
+type VLANTags struct {
+	Outer, Inner uint16
+}
+
+// packetVLANs returns the VLAN tags of a captured frame. The kernel strips
+// the outer tag and reports it beside the frame; further tags stay in it.
+func packetVLANs(packet gopacket.Packet) VLANTags {
+	eth, _ := packet.LinkLayer().(*layers.Ethernet)
+	return frameVLANs(packet.Metadata().AncillaryData, eth)
+}
+
+// frameVLANs returns the VLAN tags of a frame from the tag the kernel
+// reported in its ancillary data and those left in its Ethernet header,
+// which may be nil
+func frameVLANs(ancillary []any, eth *layers.Ethernet) VLANTags {
+	var tags VLANTags
+	n := 0
+	add := func(id uint16) {
+		if n == 0 {
+			tags.Outer = id
+		} else {
+			tags.Inner = id
+		}
+		n++
+	}
+	for _, data := range ancillary {
+		if vlan, ok := data.(afpacket.AncillaryVLAN); ok && vlan.VLAN > 0 {
+			add(uint16(vlan.VLAN))
+		}
+	}
+	if eth != nil {
+		typ, payload := eth.EthernetType, eth.Payload
+		for (typ == layers.EthernetTypeDot1Q || typ == layers.EthernetTypeQinQ) && len(payload) >= 4 {
+			add(binary.BigEndian.Uint16(payload[0:2]) & 0x0fff)
+			typ, payload = layers.EthernetType(binary.BigEndian.Uint16(payload[2:4])), payload[4:]
+		}
+	}
+	return tags
+}
+
+// VLANSet is the VLAN IDs a capture records; nil records all
+type VLANSet map[uint16]bool
+
+// ParseVLANs parses a comma-separated list of VLAN IDs and ranges such as
+// "10,20-29"; 0 stands for untagged traffic
+func ParseVLANs(spec string) (VLANSet, error) {
+	var set VLANSet
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 0 || last > 4094 || first > last {
+			return nil, fmt.Errorf("invalid VLAN %q (expected IDs 0-4094, 0 for untagged)", part)
+		}
+		if set == nil {
+			set = make(VLANSet)
+		}
+		for id := first; id <= last; id++ {
+			set[uint16(id)] = true
+		}
+	}
+	return set, nil
+}
+
+// Allows reports whether traffic with the given tags is recorded: either
+// tag is in the set, or the set includes 0 and the frame is untagged
+func (s VLANSet) Allows(tags VLANTags) bool {
+	if s == nil {
+		return true
+	}
+	return s[tags.Outer] || (tags.Inner != 0 && s[tags.Inner])
+}
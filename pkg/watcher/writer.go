@@ -0,0 +1,123 @@
+package watcher
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/abja/net-watcher/internal/database"
+	"github.com/charmbracelet/log"
+)
+
+// WriteOptions controls how captured events are batched into the database
+type WriteOptions struct {
+	QueueSize     int           // events held in memory before new ones are dropped
+	BatchSize     int           // events per database transaction
+	FlushInterval time.Duration // maximum delay before a partial batch is written
+	Wait          bool          // wait for room in a full queue instead of dropping, when replaying a file
+}
+
+// DefaultWriteOptions are used until SetWriteOptions is called
+var DefaultWriteOptions = WriteOptions{
+	QueueSize:     10000,
+	BatchSize:     100,
+	FlushInterval: time.Second,
+}
+
+// eventWriter moves events from the capture path to the database through a
+// bounded queue. A single goroutine does all writes, so a slow SQLite commit
+// never stalls packet processing; when the queue is full new events are
+// dropped and counted instead.
+type eventWriter struct {
+	queue   chan database.NetworkEvent
+	opts    WriteOptions
+	write   func([]database.NetworkEvent)
+	logger  *log.Logger
+	dropped atomic.Uint64
+	peak    atomic.Int64
+	done    chan struct{}
+}
+
+// newEventWriter starts a writer that hands each batch to write
+func newEventWriter(opts WriteOptions, write func([]database.NetworkEvent), logger *log.Logger) *eventWriter {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = DefaultWriteOptions.QueueSize
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = DefaultWriteOptions.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultWriteOptions.FlushInterval
+	}
+	ew := &eventWriter{
+		queue:  make(chan database.NetworkEvent, opts.QueueSize),
+		opts:   opts,
+		write:  write,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	go ew.run()
+	return ew
+}
+
+// enqueue adds an event without blocking, dropping it if the queue is full
+// unless the writer waits
+func (ew *eventWriter) enqueue(event database.NetworkEvent) {
+	if ew.opts.Wait {
+		ew.queue <- event
+		return
+	}
+	select {
+	case ew.queue <- event:
+		if depth := int64(len(ew.queue)); depth > ew.peak.Load() {
+			ew.peak.Store(depth)
+		}
+	default:
+		if dropped := ew.dropped.Add(1); dropped%1000 == 1 {
+			ew.logger.Warn("[WRITER] Queue full, dropping events", "queue_size", ew.opts.QueueSize, "dropped", dropped)
+		}
+	}
+}
+
+// close writes the remaining events and stops the writer
+func (ew *eventWriter) close() {
+	close(ew.queue)
+	<-ew.done
+}
+
+// run collects events into batches and writes them
+func (ew *eventWriter) run() {
+	defer close(ew.done)
+
+	ticker := time.NewTicker(ew.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]database.NetworkEvent, 0, ew.opts.BatchSize)
+	writeBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ew.write(batch)
+		batch = make([]database.NetworkEvent, 0, ew.opts.BatchSize)
+	}
+
+	for {
+		select {
+		case e, ok := <-ew.queue:
+			if !ok {
+				writeBatch()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= ew.opts.BatchSize {
+				writeBatch()
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				// Lets the write side flush work of its own, such as repeat counts
+				ew.write(batch)
+				continue
+			}
+			writeBatch()
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package watcher
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// AF_XDP capture. A small XDP program on the interface redirects every
+// frame to the AF_XDP socket bound to its receive queue; the driver writes
+// the frame into memory shared with net-watcher (the UMEM) and posts its
+// place on the socket's RX ring, and the frame's buffer is handed back on
+// the fill ring once read. The program is attached through a BPF link, so
+// the kernel detaches it when net-watcher exits, even if it crashes.
+//
+// Redirected frames never reach the kernel's network stack, which is why
+// only interfaces without addresses, such as mirror (SPAN) ports and taps,
+// are captured this way. Requires Linux 5.9 or later and CAP_NET_ADMIN,
+// CAP_BPF (or CAP_SYS_ADMIN) and CAP_NET_RAW.
+
+const (
+	xdpFrameSize = 4096 // UMEM chunk holding one frame
+	xdpFrames    = 4096 // chunks per receive queue, all posted on the fill ring
+	xdpRxRing    = 2048 // RX ring slots per queue
+	xdpCompRing  = 64   // completion ring, unused without a TX ring but required
+)
+
+// xdpHandle is a captureHandle on the AF_XDP sockets of the receive queues
+// of an interface a capture worker reads
+type xdpHandle struct {
+	mutex    sync.Mutex
+	ifindex  int
+	queues   []*xdpQueue
+	poll     []unix.PollFd
+	next     int     // queue read first, so a busy queue does not starve the others
+	vm       *bpf.VM // socket filter; nil keeps whole packets
+	buf      []byte  // the frame last read
+	attach   *xdpAttach
+	zeroCopy bool // the driver writes frames to the UMEM itself
+	closed   bool
+}
+
+// xdpAttach is the redirect program of an interface, shared by the handles
+// of its capture workers and released with the last of them
+type xdpAttach struct {
+	xskMap int // XSKMAP of queue -> socket
+	prog   int // XDP program
+	link   int // attachment of prog to the interface
+	refs   atomic.Int32
+}
+
+// release drops a handle's reference, detaching the program with the last
+func (a *xdpAttach) release() {
+	if a.refs.Add(-1) > 0 {
+		return
+	}
+	for _, fd := range []int{a.link, a.prog, a.xskMap} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// xdpQueue is the AF_XDP socket of one receive queue and its UMEM
+type xdpQueue struct {
+	fd       int
+	umem     []byte
+	fill     xdpRing // UMEM addresses handed to the kernel, 8 bytes each
+	rx       xdpRing // descriptors of received frames, unix.XDPDesc
+	received uint64
+}
+
+// xdpRing is a single-producer single-consumer ring shared with the kernel
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	desc     uintptr // offset of the first entry in mem
+	mask     uint32
+}
+
+func (r *xdpRing) entry(i uint32, size uintptr) unsafe.Pointer {
+	return unsafe.Pointer(&r.mem[r.desc+uintptr(i&r.mask)*size])
+}
+
+// newXDPHandles attaches the redirect program to iface and opens a socket
+// per receive queue, dealt out to up to workers handles
+func newXDPHandles(iface net.Interface, workers int) ([]*xdpHandle, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			return nil, fmt.Errorf("interface has address %s, and frames taken by XDP would not reach the host; use xdp on mirror ports", ipNet.IP)
+		}
+	}
+	queues := rxQueueCount(iface.Name)
+	// Kernels before 5.11 charge BPF maps and the UMEM to RLIMIT_MEMLOCK
+	_ = unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+
+	attach := &xdpAttach{xskMap: -1, prog: -1, link: -1}
+	attach.refs.Store(1)
+	var opened []*xdpQueue
+	fail := func(err error) ([]*xdpHandle, error) {
+		for _, q := range opened {
+			q.close()
+		}
+		attach.release()
+		return nil, err
+	}
+	if attach.xskMap, err = bpfCreateXSKMap(queues); err != nil {
+		return fail(fmt.Errorf("failed to create XSKMAP: %w", err))
+	}
+	for id := range queues {
+		q, err := openXDPQueue(iface.Index, id)
+		if err != nil {
+			return fail(fmt.Errorf("queue %d: %w", id, err))
+		}
+		opened = append(opened, q)
+		if err := bpfMapUpdate(attach.xskMap, uint32(id), uint32(q.fd)); err != nil {
+			return fail(fmt.Errorf("failed to register queue %d socket: %w", id, err))
+		}
+	}
+	zeroCopy := xdpZeroCopy(opened[0].fd)
+	if attach.prog, err = bpfLoadRedirect(attach.xskMap); err != nil {
+		return fail(fmt.Errorf("failed to load XDP program: %w", err))
+	}
+	if attach.link, err = bpfLinkXDP(attach.prog, iface.Index); err != nil {
+		return fail(fmt.Errorf("failed to attach XDP program: %w", err))
+	}
+
+	// Worker i reads queues i, i+workers, ...; the NIC's receive hash
+	// keeps a flow on one queue, so on one worker
+	handles := make([]*xdpHandle, min(workers, queues))
+	for i := range handles {
+		handles[i] = &xdpHandle{ifindex: iface.Index, attach: attach, zeroCopy: zeroCopy}
+	}
+	for id, q := range opened {
+		h := handles[id%len(handles)]
+		h.queues = append(h.queues, q)
+		h.poll = append(h.poll, unix.PollFd{Fd: int32(q.fd), Events: unix.POLLIN})
+	}
+	attach.refs.Store(int32(len(handles)))
+	return handles, nil
+}
+
+// rxQueueCount returns the number of receive queues of an interface
+func rxQueueCount(name string) int {
+	queues, _ := filepath.Glob(filepath.Join("/sys/class/net", name, "queues", "rx-*"))
+	return max(len(queues), 1)
+}
+
+// openXDPQueue opens a socket bound to one receive queue, with its UMEM
+// posted on the fill ring
+func openXDPQueue(ifindex, id int) (q *xdpQueue, err error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AF_XDP socket: %w", err)
+	}
+	q = &xdpQueue{fd: fd}
+	defer func() {
+		if err != nil {
+			q.close()
+		}
+	}()
+
+	if q.umem, err = unix.Mmap(-1, 0, xdpFrames*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE); err != nil {
+		return q, fmt.Errorf("failed to allocate UMEM: %w", err)
+	}
+	reg := unix.XDPUmemReg{Addr: uint64(uintptr(unsafe.Pointer(&q.umem[0]))), Len: uint64(len(q.umem)), Size: xdpFrameSize}
+	if err = setsockopt(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return q, fmt.Errorf("failed to register UMEM: %w", err)
+	}
+	for _, ring := range [][2]int{{unix.XDP_UMEM_FILL_RING, xdpFrames}, {unix.XDP_UMEM_COMPLETION_RING, xdpCompRing}, {unix.XDP_RX_RING, xdpRxRing}} {
+		size := uint32(ring[1])
+		if err = setsockopt(fd, ring[0], unsafe.Pointer(&size), unsafe.Sizeof(size)); err != nil {
+			return q, fmt.Errorf("failed to size rings: %w", err)
+		}
+	}
+	var off unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS,
+		uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return q, fmt.Errorf("failed to read ring offsets: %w", errno)
+	}
+	if q.fill, err = mapXDPRing(fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, xdpFrames, 8); err != nil {
+		return q, fmt.Errorf("failed to map fill ring: %w", err)
+	}
+	if q.rx, err = mapXDPRing(fd, unix.XDP_PGOFF_RX_RING, off.Rx, xdpRxRing, unsafe.Sizeof(unix.XDPDesc{})); err != nil {
+		return q, fmt.Errorf("failed to map RX ring: %w", err)
+	}
+
+	for i := range uint32(xdpFrames) {
+		*(*uint64)(q.fill.entry(i, 8)) = uint64(i) * xdpFrameSize
+	}
+	atomic.StoreUint32(q.fill.producer, xdpFrames)
+
+	// The kernel uses zero-copy when the driver supports it, copy mode
+	// otherwise
+	if err = unix.Bind(fd, &unix.SockaddrXDP{Ifindex: uint32(ifindex), QueueID: uint32(id)}); err != nil {
+		return q, fmt.Errorf("failed to bind: %w", err)
+	}
+	return q, nil
+}
+
+// mapXDPRing maps a ring of a socket
+func mapXDPRing(fd int, pgoff int64, off unix.XDPRingOffset, entries uint32, size uintptr) (xdpRing, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+int(entries)*int(size), unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return xdpRing{}, err
+	}
+	return xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		desc:     uintptr(off.Desc),
+		mask:     entries - 1,
+	}, nil
+}
+
+// receive copies the next frame off the RX ring into buf and hands its
+// buffer back on the fill ring
+func (q *xdpQueue) receive(buf []byte) ([]byte, bool) {
+	cons := *q.rx.consumer
+	if cons == atomic.LoadUint32(q.rx.producer) {
+		return nil, false
+	}
+	desc := (*unix.XDPDesc)(q.rx.entry(cons, unsafe.Sizeof(unix.XDPDesc{})))
+	data := append(buf[:0], q.umem[desc.Addr:desc.Addr+uint64(desc.Len)]...)
+
+	fill := *q.fill.producer
+	*(*uint64)(q.fill.entry(fill, 8)) = desc.Addr &^ (xdpFrameSize - 1)
+	atomic.StoreUint32(q.fill.producer, fill+1)
+	atomic.StoreUint32(q.rx.consumer, cons+1)
+	q.received++
+	return data, true
+}
+
+func (q *xdpQueue) close() {
+	unix.Close(q.fd)
+	for _, mem := range [][]byte{q.rx.mem, q.fill.mem, q.umem} {
+		if mem != nil {
+			unix.Munmap(mem)
+		}
+	}
+}
+
+// ZeroCopyReadPacketData returns the next frame of any queue that accepts
+// the socket filter, waiting up to capturePollTimeout for one to arrive.
+// The frame is copied out of the UMEM into a buffer reused by the next read.
+func (h *xdpHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		h.mutex.Lock()
+		if h.closed {
+			h.mutex.Unlock()
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		for i := range h.queues {
+			q := h.queues[(h.next+i)%len(h.queues)]
+			for {
+				data, ok := q.receive(h.buf)
+				if !ok {
+					break
+				}
+				h.buf = data
+				ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data), InterfaceIndex: h.ifindex}
+				if h.vm != nil {
+					keep, err := h.vm.Run(data)
+					if err != nil || keep == 0 {
+						continue
+					}
+					if keep < len(data) {
+						data = data[:keep]
+						ci.CaptureLength = keep
+					}
+				}
+				h.next = (h.next + i + 1) % len(h.queues)
+				h.mutex.Unlock()
+				return data, ci, nil
+			}
+		}
+		h.mutex.Unlock()
+
+		n, err := unix.Poll(h.poll, int(capturePollTimeout/time.Millisecond))
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return nil, gopacket.CaptureInfo{}, os.NewSyscallError("poll", err)
+		}
+		if n == 0 && err == nil {
+			return nil, gopacket.CaptureInfo{}, errNoPacket
+		}
+	}
+}
+
+// SetBPF runs the filter on every frame read. AF_XDP sockets do not take
+// socket filters, so it runs in user space.
+func (h *xdpHandle) SetBPF(filter []bpf.RawInstruction) error {
+	var vm *bpf.VM
+	program := make([]bpf.Instruction, len(filter))
+	for i, raw := range filter {
+		program[i] = raw.Disassemble()
+	}
+	if len(program) != 1 || program[0] != acceptAll[0] {
+		var err error
+		if vm, err = bpf.NewVM(program); err != nil {
+			return err
+		}
+	}
+	h.mutex.Lock()
+	h.vm = vm
+	h.mutex.Unlock()
+	return nil
+}
+
+// counters returns the frames read and those the kernel dropped because a
+// ring was full or the fill ring empty
+func (h *xdpHandle) counters() (packets, drops uint64, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return 0, 0, errors.New("capture closed")
+	}
+	for _, q := range h.queues {
+		var stats unix.XDPStatistics
+		size := uint32(unsafe.Sizeof(stats))
+		if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(q.fd), unix.SOL_XDP, unix.XDP_STATISTICS,
+			uintptr(unsafe.Pointer(&stats)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+			return 0, 0, os.NewSyscallError("getsockopt", errno)
+		}
+		packets += q.received
+		drops += stats.Rx_dropped + stats.Rx_ring_full + stats.Rx_fill_ring_empty_descs
+	}
+	return packets, drops, nil
+}
+
+// Close releases the sockets, and detaches the XDP program once every
+// worker's handle is closed
+func (h *xdpHandle) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, q := range h.queues {
+		q.close()
+	}
+	h.attach.release()
+}
+
+// xdpZeroCopy reports whether a bound socket runs in zero-copy mode
+func xdpZeroCopy(fd int) bool {
+	var opts uint32
+	size := uint32(unsafe.Sizeof(opts))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_OPTIONS,
+		uintptr(unsafe.Pointer(&opts)), uintptr(unsafe.Pointer(&size)), 0)
+	return errno == 0 && opts&unix.XDP_OPTIONS_ZEROCOPY != 0
+}
+
+// setsockopt sets an SOL_XDP option
+func setsockopt(fd, opt int, value unsafe.Pointer, size uintptr) error {
+	if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt),
+		uintptr(value), size, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// bpfCall runs a bpf(2) command, returning the file descriptor it creates
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// bpfCreateXSKMap creates the map of receive queue to AF_XDP socket
+func bpfCreateXSKMap(entries int) (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, mapFlags uint32
+	}{mapType: unix.BPF_MAP_TYPE_XSKMAP, keySize: 4, valueSize: 4, maxEntries: uint32(entries)}
+	return bpfCall(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// bpfMapUpdate sets a key of a map with 4-byte keys and values
+func bpfMapUpdate(mapFD int, key, value uint32) error {
+	attr := struct {
+		mapFD      uint32
+		_          uint32
+		key, value uint64
+		flags      uint64
+	}{mapFD: uint32(mapFD), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+	_, err := bpfCall(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+	return err
+}
+
+// bpfInsn is an eBPF instruction
+type bpfInsn struct {
+	code uint8
+	regs uint8 // destination and source register, 4 bits each
+	off  int16
+	imm  int32
+}
+
+// bpfRegs packs the registers of an instruction; the field order is the
+// one of a C bitfield, which follows the byte order
+func bpfRegs(dst, src uint8) uint8 {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		return dst<<4 | src
+	}
+	return src<<4 | dst
+}
+
+// bpfLoadRedirect loads the XDP program sending every frame to the socket
+// of its receive queue:
+//
+//	return bpf_redirect_map(&xsks, ctx->rx_queue_index, XDP_PASS);
+//
+// Frames of a queue without a socket pass on to the network stack.
+func bpfLoadRedirect(xskMap int) (int, error) {
+	insns := []bpfInsn{
+		{code: 0x61, regs: bpfRegs(2, 1), off: 16},                // r2 = *(u32 *)(r1 + offsetof(xdp_md, rx_queue_index))
+		{code: 0x18, regs: bpfRegs(1, 1), imm: int32(xskMap)}, {}, // r1 = map by fd (BPF_PSEUDO_MAP_FD), 2 slots
+		{code: 0xb7, regs: bpfRegs(3, 0), imm: 2}, // r3 = XDP_PASS
+		{code: 0x85, imm: 51},                     // call bpf_redirect_map
+		{code: 0x95},                              // exit
+	}
+	license := []byte("MIT\x00")
+	attr := struct {
+		progType, insnCnt            uint32
+		insns, license               uint64
+		logLevel, logSize            uint32
+		logBuf                       uint64
+		kernVersion, progFlags       uint32
+		progName                     [16]byte
+		progIfindex, expectedAttachT uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_XDP,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	copy(attr.progName[:], "net_watcher")
+	fd, err := bpfCall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	return fd, err
+}
+
+// bpfLinkXDP attaches an XDP program to an interface, in driver mode when
+// the driver supports XDP and generic mode otherwise
+func bpfLinkXDP(prog, ifindex int) (int, error) {
+	attr := struct {
+		progFD, targetIfindex, attachType, flags uint32
+	}{progFD: uint32(prog), targetIfindex: uint32(ifindex), attachType: unix.BPF_XDP}
+	return bpfCall(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}